@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the per-client API rate limit
+const (
+	defaultAPIRate  = 5  // requests per second
+	defaultAPIBurst = 20 // requests allowed at once after an idle period
+)
+
+// auditPollWindow is how long repeated reads of the same route by the same
+// client are counted instead of each being written to the audit log, so a
+// dashboard polling /dashboard doesn't flood it
+const auditPollWindow = time.Minute
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows rate requests per second per client with bursts of
+// burst, using the defaults for zero values
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		rate = defaultAPIRate
+	}
+	if burst <= 0 {
+		burst = defaultAPIBurst
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), clients: make(map[string]*clientBucket)}
+}
+
+// allow takes a token from client's bucket, reporting whether there was one
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) > 1000 {
+			l.pruneLocked(now)
+		}
+		b = &clientBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneLocked forgets clients whose buckets have refilled. l.mu must be held.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// accessLog writes API requests to the audit log, and reads of raw data to
+// the signed access log
+type accessLog struct {
+	vehicle *Vehicle
+	mu      sync.Mutex
+	polls   map[string]*pollCount
+}
+
+type pollCount struct {
+	logged   time.Time
+	repeated int
+}
+
+func newAccessLog(vehicle *Vehicle) *accessLog {
+	return &accessLog{vehicle: vehicle, polls: make(map[string]*pollCount)}
+}
+
+// record audits a request described by details. A read repeated by the same
+// client within auditPollWindow is counted and the count logged with the next
+// line written for it, rather than logging every poll. access, if the request
+// disclosed data, is signed into the access log along with the audit line.
+func (l *accessLog) record(details map[string]interface{}, read bool, key string, access *AccessRecord) {
+	if read {
+		now := time.Now()
+		l.mu.Lock()
+		poll, ok := l.polls[key]
+		if ok && now.Sub(poll.logged) < auditPollWindow {
+			poll.repeated++
+			l.mu.Unlock()
+			return
+		}
+		if !ok {
+			if len(l.polls) > 1000 {
+				for k, p := range l.polls {
+					if now.Sub(p.logged) >= auditPollWindow {
+						delete(l.polls, k)
+					}
+				}
+			}
+			poll = &pollCount{}
+			l.polls[key] = poll
+		}
+		if poll.repeated > 0 {
+			details["repeated"] = poll.repeated
+			if access != nil {
+				access.Repeated = poll.repeated
+			}
+		}
+		poll.logged, poll.repeated = now, 0
+		l.mu.Unlock()
+	}
+	if err := appendAudit("api-request", details); err != nil {
+		fmt.Println("Failed to audit API request", err)
+	}
+	if access != nil && l.vehicle != nil {
+		if err := l.vehicle.recordAccess(*access); err != nil {
+			fmt.Println("Failed to record access", err)
+		}
+	}
+}
+
+// accessInfo collects what is known about a request's client while it is
+// handled, e.g. the token that authorized it and the data categories the
+// response disclosed
+type accessInfo struct {
+	token *APIToken
+	data  []string
+}
+
+type accessContextKey struct{}
+
+// requestAccess returns the accessInfo of a request, nil outside the API
+func requestAccess(r *http.Request) *accessInfo {
+	info, _ := r.Context().Value(accessContextKey{}).(*accessInfo)
+	return info
+}
+
+// clientHost returns the host of a remote address
+func clientHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// guardAPI rate limits requests per client host and writes every request to
+// the audit log: who (address, certificate, token), what and with what result
+func guardAPI(next http.Handler, limiter *rateLimiter, access *accessLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &accessInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), accessContextKey{}, info))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if limiter.allow(clientHost(r.RemoteAddr), time.Now()) {
+			next.ServeHTTP(sw, r)
+		} else {
+			sw.Header().Set("Retry-After", "1")
+			writeError(sw, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded"))
+		}
+
+		details := requestDetails(r)
+		details["method"], details["path"], details["status"] = r.Method, r.URL.Path, sw.status
+		if r.URL.RawQuery != "" {
+			details["query"] = r.URL.RawQuery
+		}
+		if info.token != nil {
+			details["tokenName"] = info.token.Name
+		}
+		// evidence and data downloads are GETs too, but every one of them is logged
+		download := strings.HasPrefix(r.URL.Path, "/evidence") || strings.HasPrefix(r.URL.Path, "/export")
+		read := r.Method == http.MethodGet && !download || sw.status == http.StatusTooManyRequests
+		var record *AccessRecord
+		if info.data != nil && sw.status/100 == 2 {
+			action := "api-read"
+			if strings.HasPrefix(r.URL.Path, "/evidence") {
+				action = "evidence-export"
+			} else if strings.HasPrefix(r.URL.Path, "/export") {
+				action = "data-export"
+			}
+			record = &AccessRecord{Action: action, Resource: r.URL.RequestURI(), Data: info.data, Who: requestWho("api", details, info.token)}
+		}
+		access.record(details, read, fmt.Sprintf("%v %s %s %d", details["token"], clientHost(r.RemoteAddr), r.URL.RequestURI(), sw.status), record)
+	})
+}
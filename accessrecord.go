@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// accessLogPath is the local log of every read of raw data and evidence
+// export, each record signed by the owner and chained to the one before
+const accessLogPath = "access.log"
+
+// accessRecordStream marks the anchored daily heads of the access log in hash
+// entry metadata
+const accessRecordStream = "access"
+
+// accessAnchorPath remembers the last day whose access records were anchored
+const accessAnchorPath = "access_anchor.json"
+
+// accessAnchorCheck is how often the recorder looks for a finished day of
+// access records to anchor
+const accessAnchorCheck = time.Hour
+
+var accessRecordsMu sync.Mutex
+
+// AccessRecord is who read or exported which data, and how. Prev chains every
+// line to the one before it, so the anchored head of a day covers every
+// record up to it.
+type AccessRecord struct {
+	Time     time.Time              `json:"time"`
+	Action   string                 `json:"action"`             // e.g. "api-read", "rpc-read", "evidence-export", "data-export"
+	Resource string                 `json:"resource"`           // API route, RPC or export destination
+	Data     []string               `json:"data,omitempty"`     // data categories disclosed
+	Who      map[string]interface{} `json:"who"`                // e.g. token, recipient, client certificate, address, phone or command line user
+	Repeated int                    `json:"repeated,omitempty"` // identical reads since the last record, for polling clients
+	Prev     string                 `json:"prev,omitempty"`     // hex SHA-256 of the previous line
+}
+
+// SignedAccess is an access record as written to the access log
+type SignedAccess struct {
+	Record    json.RawMessage `json:"record"`    // the exact bytes that were signed
+	Signature string          `json:"signature"` // hex ed25519 signature of Record
+	PubKey    string          `json:"pubkey"`    // hex public key of the signer
+}
+
+// accessAnchor is the last day anchored and the head anchored for it
+type accessAnchor struct {
+	Day  string `json:"day"`
+	Head string `json:"head"`
+}
+
+// recordAccess signs and appends an access record. The previous line is read
+// back each time, as the recorder and commands exporting data both append.
+func (vehicle *Vehicle) recordAccess(record AccessRecord) error {
+	if vehicle.owner == nil {
+		return errors.New("vehicle has no owner to sign access records")
+	}
+	accessRecordsMu.Lock()
+	defer accessRecordsMu.Unlock()
+	prev, err := lastLineHash(accessLogPath)
+	if err != nil {
+		return err
+	}
+	record.Time = time.Now().UTC()
+	if prev != nil {
+		record.Prev = hex.EncodeToString(prev)
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	signature := ed.Sign(vehicle.owner.ecAddress.Sec, payload)
+	line, err := json.Marshal(SignedAccess{
+		Record:    payload,
+		Signature: hex.EncodeToString(signature[:]),
+		PubKey:    hex.EncodeToString(vehicle.owner.ecAddress.PubBytes()),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(accessLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// logAccess records an access, printing rather than failing the access if
+// the record can't be written
+func (vehicle *Vehicle) logAccess(action, resource string, data []string, who map[string]interface{}) {
+	record := AccessRecord{Action: action, Resource: resource, Data: data, Who: who}
+	if err := vehicle.recordAccess(record); err != nil {
+		fmt.Println("Failed to record access", err)
+	}
+}
+
+// requestWho picks who made an API or RPC request out of its audit details
+func requestWho(via string, details map[string]interface{}, token *APIToken) map[string]interface{} {
+	who := map[string]interface{}{"via": via}
+	for _, key := range []string{"remote", "client", "token", "tokenName"} {
+		if value, ok := details[key]; ok {
+			who[key] = value
+		}
+	}
+	if token != nil && token.Recipient != "" {
+		who["recipient"] = token.Recipient
+	}
+	return who
+}
+
+// cliWho describes the user running a command, and whom the data is for if
+// they said
+func cliWho(recipient string) map[string]interface{} {
+	who := map[string]interface{}{"via": "cli"}
+	if u, err := user.Current(); err == nil {
+		who["user"] = u.Username
+	}
+	if recipient != "" {
+		who["recipient"] = recipient
+	}
+	return who
+}
+
+// accessHeadBefore returns the hash of the last line of the access log
+// recorded before t, nil if there is none
+func accessHeadBefore(t time.Time) ([]byte, error) {
+	file, err := os.Open(accessLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var head []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		var signed SignedAccess
+		var record AccessRecord
+		if json.Unmarshal(line, &signed) != nil || json.Unmarshal(signed.Record, &record) != nil {
+			continue
+		}
+		if !record.Time.Before(t) {
+			break
+		}
+		sum := sha256.Sum256(line)
+		head = sum[:]
+	}
+	return head, scanner.Err()
+}
+
+// RunAccessAnchoring anchors, once each UTC day is over, the head of the
+// access log as of the end of that day, so the chain proves every access up
+// to then was recorded and none was removed since, until stop is closed
+func (vehicle *Vehicle) RunAccessAnchoring(stop <-chan struct{}) error {
+	for {
+		var last accessAnchor
+		if data, err := ioutil.ReadFile(accessAnchorPath); err == nil {
+			json.Unmarshal(data, &last)
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		day := today.AddDate(0, 0, -1).Format("2006-01-02")
+		if last.Day != day {
+			if err := vehicle.anchorAccessDay(day, today, &last); err != nil {
+				fmt.Println("Failed to anchor the access log", err)
+			} else if err := writeSynced(accessAnchorPath, last); err != nil {
+				fmt.Println("Failed to save the access anchor", err)
+			}
+		}
+		if !sleep(accessAnchorCheck, stop) {
+			return nil
+		}
+	}
+}
+
+// anchorAccessDay anchors the head of the access log before end, the end of
+// day, unless no access was recorded since last, which it updates
+func (vehicle *Vehicle) anchorAccessDay(day string, end time.Time, last *accessAnchor) error {
+	head, err := accessHeadBefore(end)
+	if err != nil {
+		return err
+	}
+	if head != nil && hex.EncodeToString(head) != last.Head {
+		txID, err := vehicle.secureHashWithMeta(head, &HashMeta{Stream: accessRecordStream})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Access log of %s anchored. TxID: %s\n", day, txID)
+		last.Head = hex.EncodeToString(head)
+	}
+	last.Day = day
+	return nil
+}
+
+// AccessReport is the result of checking the access log
+type AccessReport struct {
+	Lines        int
+	BrokenAt     int       // first line not chained to the one before, 0 if none
+	UnsignedAt   int       // first line whose signature doesn't verify, 0 if none
+	AnchoredAt   int       // last line whose hash is anchored, 0 if none
+	AnchoredTime time.Time // block time of that anchor
+	Signers      []string  // hex keys that signed records
+	Records      []AccessRecord
+}
+
+// VerifyAccessLog checks the signatures and hash chain of the access log at
+// path and finds the last line covered by an anchor. anchored holds the owner
+// signed access anchors of the vehicle's chain, by hex hash.
+func VerifyAccessLog(path string, anchored map[string]*IndexedEntry) (*AccessReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	report := &AccessReport{}
+	var prev string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		report.Lines++
+		var signed SignedAccess
+		var record AccessRecord
+		if err := json.Unmarshal(line, &signed); err != nil {
+			return nil, fmt.Errorf("line %d: %v", report.Lines, err)
+		}
+		if err := json.Unmarshal(signed.Record, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", report.Lines, err)
+		}
+		if record.Prev != prev && report.BrokenAt == 0 {
+			report.BrokenAt = report.Lines
+		}
+		if !verifyDriverSig(signed.PubKey, signed.Signature, signed.Record) && report.UnsignedAt == 0 {
+			report.UnsignedAt = report.Lines
+		}
+		if !contains(report.Signers, signed.PubKey) {
+			report.Signers = append(report.Signers, signed.PubKey)
+		}
+		report.Records = append(report.Records, record)
+		sum := sha256.Sum256(bytes.TrimSpace(line))
+		prev = hex.EncodeToString(sum[:])
+		if entry, ok := anchored[prev]; ok {
+			report.AnchoredAt, report.AnchoredTime = report.Lines, entry.BlockTime
+		}
+	}
+	return report, scanner.Err()
+}
+
+// verifyAccessCommand checks the access log against the chain and, with
+// -list, prints who accessed what
+func verifyAccessCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("verify-access", flag.ExitOnError)
+	path := flags.String("log", accessLogPath, "Access log to check")
+	offline := flags.Bool("offline", false, "Use the local chain index without syncing it")
+	list := flags.Bool("list", false, "Print every access recorded")
+	flags.Parse(args)
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if !*offline {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, vehicle.vin); err != nil {
+			fmt.Println("Failed to sync the chain index, use -offline to skip", err)
+			os.Exit(1)
+		}
+	}
+	entries, err := store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindHash && e.Stream == accessRecordStream && e.Verified && e.SignedByOwner
+	})
+	if err != nil {
+		fmt.Println("Failed to query the chain index", err)
+		os.Exit(1)
+	}
+	anchored := make(map[string]*IndexedEntry, len(entries))
+	for _, entry := range entries {
+		anchored[entry.Hash] = entry
+	}
+	report, err := VerifyAccessLog(*path, anchored)
+	if err != nil {
+		fmt.Println("Failed to read the access log", err)
+		os.Exit(1)
+	}
+	if *list {
+		for _, record := range report.Records {
+			who := make([]string, 0, len(record.Who))
+			for key, value := range record.Who {
+				who = append(who, fmt.Sprintf("%s=%v", key, value))
+			}
+			sort.Strings(who)
+			fmt.Printf("%s  %-16s %-32s %-28s %s\n", record.Time.Local().Format(time.RFC3339), record.Action, record.Resource,
+				strings.Join(record.Data, ","), strings.Join(who, " "))
+		}
+	}
+	fmt.Printf("%d access records signed by %s\n", report.Lines, strings.Join(report.Signers, ", "))
+	if report.AnchoredAt > 0 {
+		fmt.Printf("Records up to %d are covered by the anchor of %s\n", report.AnchoredAt, report.AnchoredTime.Local().Format(time.RFC3339))
+	} else {
+		fmt.Println("No anchor covers the log yet")
+	}
+	failed := false
+	if report.UnsignedAt > 0 {
+		fmt.Printf("FAILED: the signature of record %d does not verify\n", report.UnsignedAt)
+		failed = true
+	}
+	if report.BrokenAt > 0 {
+		fmt.Printf("FAILED: record %d does not follow the record before it, the log was altered\n", report.BrokenAt)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("OK: every record is signed and the hash chain is intact")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// recentAlertCount is how many alerts are kept in memory for status displays
+const recentAlertCount = 50
+
+// Alert is a condition the owner should know about, e.g. a failing battery
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// alertLog keeps the most recent alerts
+type alertLog struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+// recent returns a copy of the most recent alerts, oldest first
+func (l *alertLog) recent() []Alert {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Alert(nil), l.alerts...)
+}
+
+func (l *alertLog) add(alert Alert) {
+	l.mu.Lock()
+	l.alerts = append(l.alerts, alert)
+	if len(l.alerts) > recentAlertCount {
+		l.alerts = l.alerts[len(l.alerts)-recentAlertCount:]
+	}
+	l.mu.Unlock()
+}
+
+// raiseAlert reports a condition to the owner and records it as a signed
+// "alert" event in the local event log
+func (vehicle *Vehicle) raiseAlert(kind, message string, data map[string]interface{}) {
+	alert := Alert{Kind: kind, Message: message, Time: time.Now().UTC()}
+	vehicle.alerts.add(alert)
+	fmt.Printf("ALERT %s: %s\n", kind, message)
+
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["kind"] = kind
+	data["message"] = message
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("alert", data), false); err != nil {
+		fmt.Println("Failed to log alert", err)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// anchorQueuePath is the write-ahead log of entries waiting to be anchored
+const anchorQueuePath = "anchors.wal"
+
+// anchorRetryInterval is how often entries that failed to anchor are retried
+const anchorRetryInterval = time.Minute
+
+// recentAnchorCount is how many anchors are kept in memory for status displays
+const recentAnchorCount = 50
+
+// Anchor describes an entry written to the vehicle's chain
+type Anchor struct {
+	Time time.Time `json:"time"`
+	TxID string    `json:"txID"`
+	Kind string    `json:"kind"`           // "hash", a stream, or "event:<type>"
+	Hash string    `json:"hash,omitempty"` // anchored hash, for hash entries, comma separated for batches
+}
+
+// anchorLog keeps the most recent anchors
+type anchorLog struct {
+	mu      sync.Mutex
+	anchors []Anchor
+}
+
+// recent returns a copy of the most recent anchors, oldest first
+func (l *anchorLog) recent() []Anchor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Anchor(nil), l.anchors...)
+}
+
+// add records an anchored entry
+func (l *anchorLog) add(entry *factom.Entry, txID string) {
+	anchor := Anchor{Time: time.Now().UTC(), TxID: txID, Kind: "hash"}
+	switch len(entry.ExtIDs) {
+	case 4: // event
+		anchor.Kind = "event:" + string(entry.ExtIDs[3])
+	case 3: // hash with metadata
+		var meta HashMeta
+		if json.Unmarshal(entry.ExtIDs[2], &meta) == nil && meta.Stream != "" {
+			anchor.Kind = meta.Stream
+		}
+		fallthrough
+	default:
+		hashes := make([]string, 0, 1)
+		for _, hash := range entryHashes(entry) {
+			hashes = append(hashes, hex.EncodeToString(hash))
+		}
+		anchor.Hash = strings.Join(hashes, ",")
+	}
+	l.mu.Lock()
+	l.anchors = append(l.anchors, anchor)
+	if len(l.anchors) > recentAnchorCount {
+		l.anchors = l.anchors[len(l.anchors)-recentAnchorCount:]
+	}
+	l.mu.Unlock()
+}
+
+// queuedEntry is a signed entry in the anchor queue. The same ID logged again
+// with a TxID marks it anchored.
+type queuedEntry struct {
+	ID      int64    `json:"id"`
+	ChainID string   `json:"chainID,omitempty"`
+	ExtIDs  [][]byte `json:"extIDs,omitempty"`
+	Content []byte   `json:"content,omitempty"`
+	TxID    string   `json:"txID,omitempty"`
+	// CommitTxID is the commit of an entry whose reveal failed, logged again
+	// with only the ID, so a retry reveals it instead of paying again
+	CommitTxID string `json:"commitTxID,omitempty"`
+	// Coalesced marks an entry replaced by a batch entry holding its hashes
+	Coalesced bool `json:"coalesced,omitempty"`
+
+	inFlight bool
+}
+
+// anchorQueue makes every entry durable before it is sent, so a power cut or a
+// network outage never loses an anchor, it is sent again later
+type anchorQueue struct {
+	mu      sync.Mutex
+	wal     *writeAheadLog
+	pending map[int64]*queuedEntry
+	next    int64
+}
+
+// openAnchorQueue opens the queue at path, keeping entries never anchored
+func openAnchorQueue(path string) (*anchorQueue, error) {
+	wal, entries, err := openWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &anchorQueue{wal: wal, pending: make(map[int64]*queuedEntry)}
+	for _, raw := range entries {
+		entry := new(queuedEntry)
+		if err := json.Unmarshal(raw, entry); err != nil {
+			continue
+		}
+		if entry.ID >= q.next {
+			q.next = entry.ID + 1
+		}
+		if entry.TxID != "" || entry.Coalesced {
+			delete(q.pending, entry.ID)
+		} else if entry.ExtIDs == nil && entry.Content == nil {
+			if queued, ok := q.pending[entry.ID]; ok && entry.CommitTxID != "" {
+				queued.CommitTxID = entry.CommitTxID
+			}
+		} else {
+			q.pending[entry.ID] = entry
+		}
+	}
+	return q, q.compact()
+}
+
+// add logs entry durably and returns its queue ID
+func (q *anchorQueue) add(entry *factom.Entry) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := &queuedEntry{ID: q.next, ChainID: entry.ChainID, ExtIDs: entry.ExtIDs, Content: entry.Content, inFlight: true}
+	q.next++
+	if err := q.wal.appendSync(queued); err != nil {
+		return 0, err
+	}
+	q.pending[queued.ID] = queued
+	return queued.ID, nil
+}
+
+// done marks the entry anchored
+func (q *anchorQueue) done(id int64, txID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, id)
+	if len(q.pending) == 0 {
+		return q.wal.reset(nil)
+	}
+	return q.wal.appendSync(queuedEntry{ID: id, TxID: txID})
+}
+
+// replace logs entry in place of the queued entries ids, whose hashes it
+// holds, and returns it marked in flight
+func (q *anchorQueue) replace(ids []int64, entry *factom.Entry) (*queuedEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := &queuedEntry{ID: q.next, ChainID: entry.ChainID, ExtIDs: entry.ExtIDs, Content: entry.Content, inFlight: true}
+	q.next++
+	// the batch is logged first, a crash before the originals are marked
+	// only anchors their hashes twice
+	if err := q.wal.appendSync(queued); err != nil {
+		return nil, err
+	}
+	q.pending[queued.ID] = queued
+	for _, id := range ids {
+		if err := q.wal.appendSync(queuedEntry{ID: id, Coalesced: true}); err != nil {
+			return nil, err
+		}
+		delete(q.pending, id)
+	}
+	return queued, nil
+}
+
+// committed logs the commit of a queued entry whose reveal failed
+func (q *anchorQueue) committed(id int64, txID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.pending[id]
+	if !ok {
+		return nil
+	}
+	entry.CommitTxID = txID
+	return q.wal.appendSync(queuedEntry{ID: id, CommitTxID: txID})
+}
+
+// failed returns the entry to the queue for a later retry
+func (q *anchorQueue) failed(id int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.pending[id]; ok {
+		entry.inFlight = false
+	}
+}
+
+// size returns the number of entries waiting to be anchored
+func (q *anchorQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// claim returns the queued entries not currently being sent and marks them in flight
+func (q *anchorQueue) claim() []*queuedEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var entries []*queuedEntry
+	for _, entry := range q.pending {
+		if !entry.inFlight {
+			entry.inFlight = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// compact rewrites the log with only the pending entries
+func (q *anchorQueue) compact() error {
+	entries := make([]interface{}, 0, len(q.pending))
+	for _, entry := range q.pending {
+		entries = append(entries, entry)
+	}
+	return q.wal.reset(entries)
+}
+
+// commitEntry commits and reveals entry, paid by the owner's entry credits,
+// retrying as defaultRetry allows. If the vehicle has an anchor queue the
+// entry is logged first and, should every attempt fail, retried until it
+// succeeds.
+func (vehicle *Vehicle) commitEntry(entry *factom.Entry) (string, error) {
+	return vehicle.commitEntryRetrying(entry, defaultRetry)
+}
+
+// commitEntryRetrying is commitEntry retrying as policy allows before leaving
+// the entry to the queue
+func (vehicle *Vehicle) commitEntryRetrying(entry *factom.Entry, policy retryPolicy) (string, error) {
+	if vehicle.anchors == nil {
+		return vehicle.sendEntry(entry, policy)
+	}
+	id, err := vehicle.anchors.add(entry)
+	if err != nil {
+		return "", err
+	}
+	if !vehicle.clock.certain() {
+		vehicle.anchors.failed(id)
+		return "", errClockUnset
+	}
+	txID, err := vehicle.sendEntry(entry, policy)
+	if err != nil {
+		vehicle.sendFailed(id, err)
+		return "", err
+	}
+	if err := vehicle.anchors.done(id, txID); err != nil {
+		fmt.Println("Failed to mark entry anchored", err)
+	}
+	return txID, nil
+}
+
+// entrySender commits and reveals an entry and returns its transaction ID
+type entrySender func(entry *factom.Entry) (string, error)
+
+// sendEntry commits and reveals entry, through the fleet server if it pays
+// for the vehicle's entries, retrying as policy allows
+func (vehicle *Vehicle) sendEntry(entry *factom.Entry, policy retryPolicy) (string, error) {
+	var txID string
+	var err error
+	if vehicle.anchorBackend != nil {
+		err = policy.do("Anchor", func() (err error) {
+			txID, err = vehicle.anchorBackend(entry)
+			return err
+		})
+	} else if vehicle.funder != nil {
+		err = policy.do("Fleet anchor", func() (err error) {
+			txID, err = vehicle.funder.anchor(entry)
+			return err
+		})
+	} else {
+		txID, err = commitRevealEntry(vehicle.chain, policy, entry, vehicle.owner.ecAddress)
+	}
+	if err != nil {
+		return "", err
+	}
+	vehicle.anchored.add(entry, txID)
+	return txID, nil
+}
+
+// sendFailed returns a queued entry to the queue after sending it failed,
+// logging its commit if only the reveal failed
+func (vehicle *Vehicle) sendFailed(id int64, err error) {
+	if revealErr, ok := err.(*revealError); ok {
+		if err := vehicle.anchors.committed(id, revealErr.txID); err != nil {
+			fmt.Println("Failed to log the commit of a queued entry", err)
+		}
+	}
+	vehicle.anchors.failed(id)
+}
+
+// resendEntry sends a queued entry again. One whose commit factomd accepted
+// is only revealed, so it isn't paid for twice, and one already revealed is
+// done. A commit factomd no longer knows is made again.
+func (vehicle *Vehicle) resendEntry(queued *queuedEntry, entry *factom.Entry) (string, error) {
+	if queued.CommitTxID == "" || vehicle.anchorBackend != nil || vehicle.funder != nil {
+		return vehicle.sendEntry(entry, queueRetry)
+	}
+	committed, revealed, err := vehicle.chain.commitAck(queued.CommitTxID)
+	if err != nil {
+		return "", fmt.Errorf("checking commit %s: %v", queued.CommitTxID, err)
+	}
+	if !committed {
+		fmt.Printf("Commit %s of a queued entry was lost, committing again\n", queued.CommitTxID)
+		return vehicle.sendEntry(entry, queueRetry)
+	}
+	if !revealed {
+		if _, err := vehicle.chain.revealEntry(entry); err != nil {
+			return "", &revealError{txID: queued.CommitTxID, err: err}
+		}
+	}
+	vehicle.anchored.add(entry, queued.CommitTxID)
+	return queued.CommitTxID, nil
+}
+
+// retryAnchors sends every queued entry again, coalesced while anchoring is
+// behind, once the clock can be trusted. Segments whose hash was in a retried
+// entry, alone or batched, get its txID.
+func (vehicle *Vehicle) retryAnchors() error {
+	if !vehicle.clock.certain() {
+		return nil
+	}
+	entries := vehicle.anchors.claim()
+	if vehicle.backlog.get() >= backlogBehind {
+		var err error
+		if entries, err = vehicle.coalesceAnchors(entries); err != nil {
+			for _, queued := range entries {
+				vehicle.anchors.failed(queued.ID)
+			}
+			return err
+		}
+	}
+	for i, queued := range entries {
+		entry := &factom.Entry{ChainID: queued.ChainID, ExtIDs: queued.ExtIDs, Content: queued.Content}
+		txID, err := vehicle.resendEntry(queued, entry)
+		if err != nil {
+			vehicle.sendFailed(queued.ID, err)
+			for _, unsent := range entries[i+1:] {
+				vehicle.anchors.failed(unsent.ID)
+			}
+			return err
+		}
+		if err := vehicle.anchors.done(queued.ID, txID); err != nil {
+			return err
+		}
+		fmt.Printf("Queued entry secured to factom. TxID: %s\n", txID)
+		for _, hash := range entryHashes(entry) {
+			if err := vehicle.setSegmentTxID(hex.EncodeToString(hash), txID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coalesceAnchors replaces the claimed hash entries of segments that share a
+// stream and compression by batch entries listing their hashes, so a backlog
+// costs fewer entries and round trips to clear. It returns the entries to send.
+func (vehicle *Vehicle) coalesceAnchors(entries []*queuedEntry) ([]*queuedEntry, error) {
+	groups := make(map[HashMeta][]*queuedEntry)
+	var send []*queuedEntry
+	for _, queued := range entries {
+		meta, ok := vehicle.coalescible(queued)
+		if !ok {
+			send = append(send, queued)
+			continue
+		}
+		groups[meta] = append(groups[meta], queued)
+	}
+	for meta, group := range groups {
+		if len(group) == 1 {
+			send = append(send, group[0])
+			continue
+		}
+		var hashes [][]byte
+		var ids []int64
+		for _, queued := range group {
+			hashes = append(hashes, entryHashes(&factom.Entry{ExtIDs: queued.ExtIDs, Content: queued.Content})...)
+			ids = append(ids, queued.ID)
+		}
+		for len(hashes) > 0 {
+			n := len(hashes)
+			if n > maxBatchHashes {
+				n = maxBatchHashes
+			}
+			batch := meta
+			if n > 1 {
+				batch.Hashes = n
+			}
+			entry, err := vehicle.hashEntry(bytes.Join(hashes[:n], nil), &batch)
+			if err != nil {
+				return append(send, group...), err
+			}
+			// the originals are replaced by the first batch, later batches
+			// of a big group are queued on their own
+			queued, err := vehicle.anchors.replace(ids, entry)
+			if err != nil {
+				return append(send, group...), err
+			}
+			send = append(send, queued)
+			hashes, ids = hashes[n:], nil
+		}
+		fmt.Printf("Coalesced %d queued %s entries\n", len(group), meta.Stream)
+	}
+	return send, nil
+}
+
+// coalescible returns the stream and compression of a queued entry that may
+// be merged into a batch: a segment hash entry the current owner signed
+func (vehicle *Vehicle) coalescible(queued *queuedEntry) (HashMeta, bool) {
+	var meta HashMeta
+	// a committed entry is paid for, it is revealed as it is
+	if queued.CommitTxID != "" || queued.ChainID != vehicle.chainID || len(queued.ExtIDs) != 3 || vehicle.owner == nil ||
+		!bytes.Equal(queued.ExtIDs[1], vehicle.owner.ecAddress.PubBytes()) {
+		return meta, false
+	}
+	if json.Unmarshal(queued.ExtIDs[2], &meta) != nil || (meta.Stream != telemetryStream && meta.Stream != "video") {
+		return meta, false
+	}
+	// merging would drop the driver's countersignature
+	if meta.Driver != "" {
+		return meta, false
+	}
+	meta.Hashes = 0
+	return meta, true
+}
+
+// setSegmentTxID records txID on segments with the given hash still missing one
+func (vehicle *Vehicle) setSegmentTxID(hash, txID string) error {
+	if vehicle.store == nil {
+		return nil
+	}
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.Hash == hash && segment.TxID == "" {
+			segment.TxID = txID
+			if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunAnchorRetries retries queued entries until stop is closed
+func (vehicle *Vehicle) RunAnchorRetries(stop <-chan struct{}) error {
+	for {
+		if err := vehicle.retryAnchors(); err != nil {
+			fmt.Println("Anchoring queued entries failed", err)
+		}
+		if !sleep(anchorRetryInterval, stop) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/FactomProject/factom"
+)
+
+// unrevealingChain is a memoryChain counting entry commits whose reveals
+// fail while failReveals is set
+type unrevealingChain struct {
+	*memoryChain
+	commits     int
+	failReveals bool
+}
+
+func (c *unrevealingChain) commitEntry(entry *factom.Entry, ecAddress *factom.ECAddress) (string, error) {
+	c.commits++
+	return c.memoryChain.commitEntry(entry, ecAddress)
+}
+
+func (c *unrevealingChain) revealEntry(entry *factom.Entry) (string, error) {
+	if c.failReveals {
+		return "", errors.New("factomd unreachable")
+	}
+	return c.memoryChain.revealEntry(entry)
+}
+
+func TestRetryAnchorsRevealsCommittedEntry(t *testing.T) {
+	vehicle, memory := testVehicle(t)
+	chain := &unrevealingChain{memoryChain: memory, failReveals: true}
+	vehicle.chain = chain
+	path := filepath.Join(t.TempDir(), anchorQueuePath)
+	queue, err := openAnchorQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehicle.anchors = queue
+	hash := sha256.Sum256([]byte("segment"))
+	entry, err := vehicle.hashEntry(hash[:], &HashMeta{Stream: telemetryStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vehicle.commitEntryRetrying(entry, queueRetry)
+	var revealErr *revealError
+	if !errors.As(err, &revealErr) {
+		t.Fatalf("got %v, want a reveal error", err)
+	}
+	// the commit survives a restart
+	queue.wal.Close()
+	if vehicle.anchors, err = openAnchorQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	chain.failReveals = false
+	if err := vehicle.retryAnchors(); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain.commits != 1 {
+		t.Errorf("entry committed %d times, want 1", chain.commits)
+	}
+	if vehicle.anchors.size() != 0 {
+		t.Errorf("%d entries still queued", vehicle.anchors.size())
+	}
+	result, err := findHashEntry(chain, vehicle, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Verified {
+		t.Error("the queued entry was not revealed")
+	}
+}
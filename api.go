@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// APIConfig enables the local HTTP API used to control the recorder from other
+// software, e.g. a kiosk display or a fleet agent. The API also serves the
+// owner's dashboard at /.
+type APIConfig struct {
+	Listen    string     `json:"listen"`    // address to serve on, e.g. "127.0.0.1:8080"
+	TLS       *TLSConfig `json:"tls"`       // require mutual TLS
+	RateLimit float64    `json:"rateLimit"` // requests per second per client, default 5
+	RateBurst int        `json:"rateBurst"` // requests allowed at once, default 20
+	Debug     bool       `json:"debug"`     // serve pprof, expvar and diagnostics dumps under /debug/
+}
+
+// Status is the device summary returned by GET /status
+type Status struct {
+	VIN            string                 `json:"vin"`
+	ChainID        string                 `json:"chainID"`
+	Recording      bool                   `json:"recording"`
+	Segment        *Segment               `json:"segment,omitempty"`
+	Storage        string                 `json:"storage"`
+	TimeSource     string                 `json:"timeSource"`
+	TimeConfidence string                 `json:"timeConfidence"`
+	PendingAnchors int                    `json:"pendingAnchors"`
+	Backlog        string                 `json:"backlog"`                  // "normal", "behind" or "shedding"
+	DroppedSamples uint64                 `json:"droppedSamples,omitempty"` // samples shed since the recorder started
+	Thermal        string                 `json:"thermal"`                  // "normal", "warm" or "throttled"
+	TemperatureC   float64                `json:"temperatureC,omitempty"`   // SoC temperature, 0 if unknown
+	Driver         string                 `json:"driver,omitempty"`         // name of the driver assigned, if any
+	PrivacyMode    bool                   `json:"privacyMode,omitempty"`    // location capture is suspended
+	Position       map[string]interface{} `json:"position,omitempty"`
+	Alerts         []Alert                `json:"alerts"`
+	Tasks          []TaskStatus           `json:"tasks,omitempty"` // recording tasks and their failures
+}
+
+// Telemetry is the latest sample returned by GET /telemetry
+type Telemetry struct {
+	Record   *OBDRecord             `json:"record"`
+	Position map[string]interface{} `json:"position,omitempty"`
+}
+
+// transferRequest is the body of POST /transfer
+type transferRequest struct {
+	NewOwner string `json:"newOwner"` // hex public key of the new owner
+}
+
+// verifyRequest is the body of POST /verify, naming a local file or an anchored hash
+type verifyRequest struct {
+	Path string `json:"path,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// apiHandler returns the API's routes. Once an API token is issued, every
+// route except the dashboard page and the API description requires a bearer
+// token granting the route's scope, and the routes returning data only reach
+// a token's recipient if the consent policy shares that data with them. Every
+// request is rate limited and audited.
+func (vehicle *Vehicle) apiHandler(config *APIConfig) http.Handler {
+	mux := http.NewServeMux()
+	tokens, consent := vehicle.tokens, vehicle.consent
+	dashboard := &dashboard{vehicle: vehicle}
+	mux.HandleFunc("/", dashboard.handlePage)
+	mux.HandleFunc("/dashboard", tokens.require(ScopeReadTelemetry, consent.require(dashboard.handleData, DataTelemetry)))
+	mux.HandleFunc("/status", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleStatus, DataTelemetry)))
+	mux.HandleFunc("/telemetry", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleTelemetry, DataTelemetry)))
+	mux.HandleFunc("/trouble-codes", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleTroubleCodes, DataTroubleCodes)))
+	mux.HandleFunc("/recording/start", tokens.require(ScopeControlRecording, vehicle.handleRecording(false)))
+	mux.HandleFunc("/recording/stop", tokens.require(ScopeControlRecording, vehicle.handleRecording(true)))
+	mux.HandleFunc("/privacy/start", tokens.require(ScopeControlRecording, vehicle.handlePrivacyMode(true)))
+	mux.HandleFunc("/privacy/stop", tokens.require(ScopeControlRecording, vehicle.handlePrivacyMode(false)))
+	mux.HandleFunc("/anchors", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleAnchors, DataAnchors)))
+	mux.HandleFunc("/verify", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleVerify, DataAnchors)))
+	mux.HandleFunc("/entries", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleEntries, DataAnchors)))
+	mux.HandleFunc("/entries/", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleEntries, DataAnchors)))
+	mux.HandleFunc("/evidence", tokens.require(ScopeExportEvidence, vehicle.handleEvidence))
+	mux.HandleFunc("/export", tokens.require(ScopeExportEvidence, vehicle.handleExport))
+	mux.HandleFunc("/transfer", tokens.require(ScopeTransferOwnership, vehicle.handleTransfer))
+	mux.HandleFunc("/driver", tokens.require(ScopeAssignDriver, vehicle.handleDriver))
+	mux.HandleFunc("/scores", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleScores, DataScores)))
+	mux.HandleFunc("/trips", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleTrips, DataTrips)))
+	mux.HandleFunc("/trips/tag", tokens.require(ScopeTagTrips, vehicle.handleTagTrip))
+	mux.HandleFunc("/hos", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleHOS, DataHOS)))
+	mux.HandleFunc("/hos/status", tokens.require(ScopeDutyStatus, vehicle.handleDutyStatus))
+	mux.HandleFunc("/hos/edit", tokens.require(ScopeDutyStatus, vehicle.handleDutyEdit))
+	mux.HandleFunc("/hos/logs", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleDailyLogs, DataHOS)))
+	mux.HandleFunc("/fuel", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleFuel, DataFuel)))
+	mux.HandleFunc("/fuel/record", tokens.require(ScopeRecordFuel, vehicle.handleRecordFuel))
+	mux.HandleFunc("/ifta", tokens.require(ScopeExportEvidence, consent.require(vehicle.handleIFTA, DataFuel)))
+	mux.HandleFunc("/leases", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleLeases, DataContracts)))
+	mux.HandleFunc("/leases/anchor", tokens.require(ScopeAnchorLease, vehicle.handleAnchorLease))
+	mux.HandleFunc("/policies", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handlePolicies, DataContracts)))
+	mux.HandleFunc("/policies/countersign", tokens.require(ScopeCountersignPolicy, vehicle.handleCountersignPolicy))
+	mux.HandleFunc("/mileage", tokens.require(ScopeExportEvidence, consent.require(vehicle.handleMileage, DataTrips)))
+	mux.HandleFunc("/credentials", tokens.require(ScopeReadTelemetry, consent.require(vehicle.handleCredentials, DataAnchors)))
+	mux.HandleFunc("/credentials/issue", tokens.require(ScopeTransferOwnership, vehicle.handleIssueCredential))
+	mux.HandleFunc("/1.0/identifiers/", tokens.require(ScopeReadTelemetry, vehicle.handleResolveDID))
+	if tokens != nil {
+		mux.HandleFunc("/tokens", tokens.require(ScopeManageKeys, tokens.handleTokens))
+		mux.HandleFunc("/tokens/", tokens.require(ScopeManageKeys, tokens.handleTokens))
+	}
+	if config.Debug {
+		vehicle.debugRoutes(mux, tokens)
+	}
+	mux.HandleFunc("/openapi.json", handleOpenAPI)
+	return guardAPI(mux, newRateLimiter(config.RateLimit, config.RateBurst), newAccessLog(vehicle))
+}
+
+// ServeAPI serves the API on config.Listen until it fails
+func (vehicle *Vehicle) ServeAPI(config *APIConfig) error {
+	server := &http.Server{
+		Addr:         config.Listen,
+		Handler:      vehicle.apiHandler(config),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 5 * time.Minute, // verification walks the chain
+	}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+		fmt.Printf("API listening on %s (mutual TLS)\n", config.Listen)
+		return server.ListenAndServeTLS("", "")
+	}
+	fmt.Printf("API listening on %s\n", config.Listen)
+	return server.ListenAndServe()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethod rejects requests not using method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s required", method))
+		return false
+	}
+	return true
+}
+
+// positionData returns the vehicle's position as the privacy mode allows, or nil.
+// In hash mode it is only marked private: the status is polled, and a
+// commitment to every fix shown would fill the preimage log with locations
+// nothing anchors.
+func (vehicle *Vehicle) positionData() map[string]interface{} {
+	fix := vehicle.position.latest()
+	if fix == nil {
+		return nil
+	}
+	if vehicle.privacy.Mode == LocationHash {
+		data := map[string]interface{}{"private": true}
+		if fix.Estimated {
+			data["estimated"] = true
+		}
+		return data
+	}
+	return vehicle.locationData(fix)
+}
+
+// status summarizes the recorder's current state
+func (vehicle *Vehicle) status() *Status {
+	source, confidence := vehicle.clock.status()
+	status := &Status{
+		VIN:            vehicle.vin,
+		ChainID:        vehicle.chainID,
+		Recording:      !vehicle.recorder.isPaused(),
+		Segment:        vehicle.recorder.segment(),
+		Storage:        storageLevelNames[vehicle.storage.get()],
+		Backlog:        backlogLevelNames[vehicle.backlog.get()],
+		DroppedSamples: vehicle.backlog.droppedSamples(),
+		Thermal:        thermalLevelNames[vehicle.thermal.get()],
+		TemperatureC:   vehicle.thermal.lastTemperature(),
+		TimeSource:     source,
+		TimeConfidence: confidence,
+		Position:       vehicle.positionData(),
+		Alerts:         vehicle.alerts.recent(),
+		Tasks:          vehicle.tasks.status(),
+		PrivacyMode:    vehicle.privacyMode.active(),
+	}
+	if assignment := vehicle.drivers.assignment(); assignment != nil {
+		status.Driver = assignment.Driver
+	}
+	if vehicle.anchors != nil {
+		status.PendingAnchors = vehicle.anchors.size()
+	}
+	return status
+}
+
+// sharedStatus returns the recorder's state as token may receive it, without
+// the vehicle's position unless the consent policy shares it
+func (vehicle *Vehicle) sharedStatus(token *APIToken) *Status {
+	status := vehicle.status()
+	if !vehicle.consent.permits(token, DataLocation) {
+		status.Position = nil
+	}
+	return status
+}
+
+// sharedTelemetry returns the latest sample as token may receive it, without
+// positions unless the consent policy shares them
+func (vehicle *Vehicle) sharedTelemetry(token *APIToken) Telemetry {
+	if !vehicle.consent.permits(token, DataLocation) {
+		return Telemetry{Record: withoutPosition(vehicle.recorder.latestRecord())}
+	}
+	return Telemetry{Record: vehicle.recorder.latestRecord(), Position: vehicle.positionData()}
+}
+
+// withoutPosition returns a copy of record without its position, nil for nil
+func withoutPosition(record *OBDRecord) *OBDRecord {
+	if record == nil {
+		return nil
+	}
+	copied := *record
+	copied.Position = ""
+	return &copied
+}
+
+func (vehicle *Vehicle) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, vehicle.sharedStatus(requestToken(r)))
+}
+
+func (vehicle *Vehicle) handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, vehicle.sharedTelemetry(requestToken(r)))
+}
+
+// handleTroubleCodes returns the diagnostic trouble codes stored as of the
+// last time they were read
+func (vehicle *Vehicle) handleTroubleCodes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	codes, err := troubleCodesAt(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"troubleCodes": codes})
+}
+
+// handleRecording pauses or resumes OBD recording
+func (vehicle *Vehicle) handleRecording(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		vehicle.setRecording(!pause, requestDetails(r))
+		writeJSON(w, http.StatusOK, map[string]bool{"recording": !pause})
+	}
+}
+
+// requestDetails describes who made an API request, for the audit log
+func requestDetails(r *http.Request) map[string]interface{} {
+	details := map[string]interface{}{"remote": r.RemoteAddr}
+	if name := peerName(r.TLS); name != "" {
+		details["client"] = name
+	}
+	if token := requestToken(r); token != nil {
+		details["token"] = token.ID
+	}
+	return details
+}
+
+// setRecording pauses or resumes OBD recording and audits who asked
+func (vehicle *Vehicle) setRecording(recording bool, details map[string]interface{}) {
+	vehicle.recorder.setPaused(!recording)
+	action := "recording-started"
+	if !recording {
+		action = "recording-stopped"
+	}
+	appendAudit(action, details)
+}
+
+// handlePrivacyMode turns privacy mode on or off
+func (vehicle *Vehicle) handlePrivacyMode(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		state, err := vehicle.SetPrivacyMode(active, "api", requestDetails(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+func (vehicle *Vehicle) handleAnchors(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, vehicle.anchored.recent())
+}
+
+// handleVerify checks a local file, given by path or by the hash it was
+// anchored with, against the chain
+func (vehicle *Vehicle) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	path := req.Path
+	if req.Hash != "" {
+		hash, err := hex.DecodeString(req.Hash)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var ok bool
+		if path, ok = findObject(hash); !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no local file has hash %s", req.Hash))
+			return
+		}
+	}
+	if path == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("path or hash required"))
+		return
+	}
+	result, err := vehicle.VerifyData(path)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleEvidence streams the evidence recorded between the from and to query
+// parameters (RFC3339, default the last two hours) as a tar.gz of the export
+// folder, with proofs and VERIFY.txt. The redact parameter lists fields to
+// redact, sharing less with a recipient than the whole of evidenceData. The
+// tar.gz is sealed to the key of the audience parameter, by default the
+// token's recipient if it is a registered audience.
+func (vehicle *Vehicle) handleEvidence(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	redact := parseRedaction(r.URL.Query().Get("redact"))
+	audience := r.URL.Query().Get("audience")
+	if token := requestToken(r); token != nil {
+		if err := vehicle.consent.allows(token.Recipient, redactedEvidenceData(redact)...); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		if audiences, err := loadAudiences(); err == nil && audience == "" {
+			if _, ok := audiences[token.Recipient]; ok {
+				audience = token.Recipient
+			}
+		}
+	}
+	var sealTo []byte
+	if audience != "" {
+		if sealTo, err = audiencePublicKey(vehicle.chain, audience); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	dir, err := ioutil.TempDir("", "blackbox-api")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path, manifest, err := vehicle.ExportRedacted(dir, start, end, redact)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	details := requestDetails(r)
+	details["from"], details["to"], details["files"] = start, end, len(manifest.Proofs)
+	if len(redact) > 0 {
+		details["redacted"] = redact
+	}
+	if sealTo != nil {
+		details["audience"] = audience
+	}
+	appendAudit("evidence-downloaded", details)
+	if info := requestAccess(r); info != nil {
+		info.data = redactedEvidenceData(redact)
+	}
+	if sealTo == nil {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)+".tar.gz"))
+		if err := tarDir(w, path); err != nil {
+			fmt.Println("Failed to send evidence", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)+".tar.gz"+sealedExt))
+	sealer, err := newAudienceSealer(w, sealTo)
+	if err == nil {
+		if err = tarDir(sealer, path); err == nil {
+			err = sealer.Close()
+		}
+	}
+	if err != nil {
+		fmt.Println("Failed to send evidence", err)
+	}
+}
+
+// queryRange parses the from and to query parameters (RFC3339), by default
+// the last defaultExportHours
+func queryRange(r *http.Request) (start, end time.Time, err error) {
+	end = time.Now()
+	start = end.Add(-defaultExportHours * time.Hour)
+	if from := r.URL.Query().Get("from"); from != "" {
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			return start, end, err
+		}
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			return start, end, err
+		}
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("from must be before to")
+	}
+	return start, end, nil
+}
+
+// handleExport sends the rows of the dataset query parameter (telemetry, trips,
+// ubi or nmea) recorded between from and to as csv, json, parquet, mf4, nmea or
+// torque, the format
+// parameter. The export's hash is anchored before it is sent and returned in
+// the X-Blackbox-Hash and X-Blackbox-TxID headers.
+func (vehicle *Vehicle) handleExport(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dataset, format := r.URL.Query().Get("dataset"), r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+	if err := checkExport(dataset, format); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if token := requestToken(r); token != nil {
+		if err := vehicle.consent.allows(token.Recipient, exportData[dataset]...); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	if vehicle.store == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no database is open"))
+		return
+	}
+	dir, err := ioutil.TempDir("", "blackbox-api")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export")
+	export, err := vehicle.ExportData(vehicle.store, dataset, format, start, end, path)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+	if info := requestAccess(r); info != nil {
+		info.data = exportData[dataset]
+	}
+	w.Header().Set("Content-Type", export.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.FileName()))
+	w.Header().Set("X-Blackbox-Hash", export.Hash)
+	w.Header().Set("X-Blackbox-TxID", export.TxID)
+	w.Header().Set("X-Blackbox-Rows", strconv.Itoa(export.Rows))
+	if _, err := io.Copy(w, file); err != nil {
+		fmt.Println("Failed to send export", err)
+	}
+}
+
+// handleTransfer initiates an ownership transfer to the key in the request
+func (vehicle *Vehicle) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	newOwner, err := hex.DecodeString(req.NewOwner)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(newOwner) != ed.PublicKeySize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("newOwner must be a %d byte public key", ed.PublicKeySize))
+		return
+	}
+	txID, err := vehicle.InitiateTransfer(newOwner, map[string]interface{}{"via": "api"})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	details := requestDetails(r)
+	details["to"], details["txID"] = req.NewOwner, txID
+	appendAudit("transfer-initiated", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
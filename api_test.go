@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatusCommitsNoLocationInHashMode(t *testing.T) {
+	vehicle, _ := testVehicle(t)
+	vehicle.privacy = LocationPrivacy{Mode: LocationHash}
+	vehicle.position.set(&Fix{Time: time.Now().UTC(), Lat: 51.5074321, Lon: -0.1278456})
+	for i := 0; i < 10; i++ {
+		status := vehicle.status()
+		if status.Position["private"] != true {
+			t.Fatalf("status position %v, want it marked private", status.Position)
+		}
+	}
+	if _, err := os.Stat(locationPreimagePath); !os.IsNotExist(err) {
+		t.Errorf("polling the status committed locations to %s", locationPreimagePath)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// archiveManifestName is the manifest's name inside an archive, written last
+const archiveManifestName = "manifest.json"
+
+// ArchivedSegment is one file in an archive and where its hash is anchored
+type ArchivedSegment struct {
+	File        string    `json:"file"`
+	Stream      string    `json:"stream"`
+	Seq         uint64    `json:"seq"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	SHA256      string    `json:"sha256"` // of the plaintext, as anchored
+	Compression string    `json:"compression,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	TxID        string    `json:"txID,omitempty"`
+	EntryHash   string    `json:"entryHash,omitempty"`
+}
+
+// ArchiveManifest lists an archive's segments. Its own hash is anchored, so one
+// chain lookup vouches for every hash it lists.
+type ArchiveManifest struct {
+	VIN      string            `json:"vin"`
+	ChainID  string            `json:"chainID"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Created  time.Time         `json:"created"`
+	Segments []ArchivedSegment `json:"segments"`
+}
+
+// ArchiveVerification is the result of VerifyArchive
+type ArchiveVerification struct {
+	Manifest *ArchiveManifest
+	Anchor   *VerifyResult // where the manifest's hash was found on chain
+	Failed   []string      // files missing or not matching the manifest
+}
+
+// Verified returns true if the manifest is anchored and every file matches it
+func (v *ArchiveVerification) Verified() bool {
+	return v.Anchor != nil && v.Anchor.Verified && len(v.Failed) == 0
+}
+
+// ArchiveSegments writes every stored segment that started in [from, to) to a
+// tar archive at out, followed by their manifest, and anchors the manifest's
+// hash. The archive is recorded as an "archive" segment. If remove is true the
+// archived files are deleted from the device afterwards.
+func (vehicle *Vehicle) ArchiveSegments(from, to time.Time, out string, remove bool) (*ArchiveManifest, string, error) {
+	segments, err := vehicle.store.Segments(vehicle.vin, from, to)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	archive := tar.NewWriter(file)
+	manifest := &ArchiveManifest{VIN: vehicle.vin, ChainID: vehicle.chainID, From: from, To: to, Created: time.Now().UTC()}
+	add := func(name string, data []byte) error {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created}); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	var archived []*Segment
+	for _, segment := range segments {
+		if segment.Stream == "archive" || segment.Pruned || segment.Path == "" || segment.Hash == "" || !segment.Start.Before(to) {
+			continue
+		}
+		// files are archived as stored, encrypted evidence stays encrypted
+		data, err := ioutil.ReadFile(segment.Path)
+		if err != nil {
+			return nil, "", err
+		}
+		entry := ArchivedSegment{
+			File:        "files/" + segment.FileName(),
+			Stream:      segment.Stream,
+			Seq:         segment.Seq,
+			Start:       segment.Start,
+			End:         segment.End,
+			SHA256:      segment.Hash,
+			Compression: segment.Compression,
+			Encrypted:   isEncrypted(data),
+			TxID:        segment.TxID,
+			EntryHash:   segment.EntryHash,
+		}
+		if entry.Encrypted {
+			entry.File += encryptedExt
+		}
+		if err := add(entry.File, data); err != nil {
+			return nil, "", err
+		}
+		manifest.Segments = append(manifest.Segments, entry)
+		archived = append(archived, segment)
+	}
+	if len(archived) == 0 {
+		os.Remove(out)
+		return nil, "", errors.New("no stored segments in that period")
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := add(archiveManifestName, data); err != nil {
+		return nil, "", err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.Sum256(data)
+	txID, err := vehicle.secureHashWithMeta(hash[:], &HashMeta{Stream: "archive"})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := vehicle.store.PutSegment(vehicle.vin, &Segment{
+		VIN:    vehicle.vin,
+		Stream: "archive",
+		Start:  from,
+		End:    to,
+		Path:   out,
+		Hash:   hex.EncodeToString(hash[:]),
+		TxID:   txID,
+	}); err != nil {
+		return nil, "", err
+	}
+	appendAudit("archive", map[string]interface{}{"path": out, "from": from, "to": to, "segments": len(archived), "manifest": hex.EncodeToString(hash[:])})
+
+	if remove {
+		for _, segment := range archived {
+			if isSegmentLocked(segment.Path) {
+				continue
+			}
+			if err := os.Remove(segment.Path); err != nil && !os.IsNotExist(err) {
+				return nil, "", err
+			}
+			segment.Pruned = true
+			if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	return manifest, txID, nil
+}
+
+// VerifyArchive checks an archive in one pass: the manifest's hash must be
+// anchored by the vehicle's owner, and every file must hash to its manifest
+// entry. Encrypted files need the device key.
+func (vehicle *Vehicle) VerifyArchive(r io.Reader, reader chainReader) (*ArchiveVerification, error) {
+	archive := tar.NewReader(r)
+	hashes := make(map[string]string)
+	var manifestData []byte
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == archiveManifestName {
+			manifestData = data
+			continue
+		}
+		if isEncrypted(data) {
+			if vehicle.key == nil {
+				hashes[header.Name] = "encrypted"
+				continue
+			}
+			if data, err = vehicle.key.open(data); err != nil {
+				hashes[header.Name] = "undecryptable"
+				continue
+			}
+		}
+		sum := sha256.Sum256(data)
+		hashes[header.Name] = hex.EncodeToString(sum[:])
+	}
+	if manifestData == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	result := &ArchiveVerification{Manifest: new(ArchiveManifest)}
+	if err := json.Unmarshal(manifestData, result.Manifest); err != nil {
+		return nil, err
+	}
+
+	manifestHash := sha256.Sum256(manifestData)
+	anchor, err := findHashEntry(reader, vehicle, manifestHash[:])
+	if err != nil {
+		return nil, err
+	}
+	result.Anchor = anchor
+	for _, segment := range result.Manifest.Segments {
+		if hashes[segment.File] != segment.SHA256 {
+			result.Failed = append(result.Failed, segment.File)
+		}
+	}
+	return result, nil
+}
+
+// monthRange parses a YYYY-MM month into its local start and end
+func monthRange(month string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// archiveName returns the default file name of a month's archive
+func archiveName(vin, month string) string {
+	return fmt.Sprintf("%s_archive_%s.tar", vin, month)
+}
@@ -0,0 +1,579 @@
+package main
+
+// Audience keys. Whoever receives exported evidence, an insurer, the police
+// or a mechanic, generates an X25519 key for that audience and publishes its
+// public half in a signed entry on their identity chain. The owner registers
+// the audience by that identity, and bundles exported for it are encrypted to
+// the latest key the chain holds, so only the audience can open them and a
+// rotated key takes effect without the owner doing anything.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+	"golang.org/x/crypto/curve25519"
+)
+
+// audiencesPath holds the audiences the owner exports to, by name
+const audiencesPath = "audiences.json"
+
+// audienceKeyEntry is the third ExtID of audience key entries
+const audienceKeyEntry = "audience-key"
+
+// sealedMagic prefixes every bundle sealed to an audience key
+var sealedMagic = []byte("BBAUD1")
+
+// sealedExt is appended to the name of bundles sealed to an audience key
+const sealedExt = ".sealed"
+
+// sealedChunk is the plaintext sealed at a time, so bundles of footage are
+// streamed rather than held in memory
+const sealedChunk = 64 << 10
+
+// AudienceKey is the public key of an audience as published on its identity
+// chain
+type AudienceKey struct {
+	Audience string    `json:"audience"`
+	Key      string    `json:"key"` // hex X25519 public key
+	Time     time.Time `json:"time"`
+}
+
+// Audience is an audience the owner exports to, identified by the key of its
+// identity chain
+type Audience struct {
+	Identity string    `json:"identity"` // hex public key of the audience's identity chain
+	ChainID  string    `json:"chainID"`
+	Added    time.Time `json:"added"`
+}
+
+// audienceKeyFile is the private key of an audience, kept by the audience
+type audienceKeyFile struct {
+	Audience string `json:"audience"`
+	Private  string `json:"private"` // hex X25519 private key
+	Public   string `json:"public"`
+}
+
+// identityChainID returns the identity chain of the person with the given
+// public key
+func identityChainID(identity []byte) string {
+	return constructChainID([][]byte{[]byte("Driver Identity Chain"), identity})
+}
+
+// generateAudienceKey returns a new X25519 key pair for audience
+func generateAudienceKey(audience string) (*audienceKeyFile, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &audienceKeyFile{Audience: audience, Private: hex.EncodeToString(private), Public: hex.EncodeToString(public)}, nil
+}
+
+// loadAudienceKey reads an audience's private key file
+func loadAudienceKey(path string) (*audienceKeyFile, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := new(audienceKeyFile)
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	private, err := hex.DecodeString(file.Private)
+	if err != nil || len(private) != curve25519.ScalarSize {
+		return nil, nil, fmt.Errorf("%s: malformed private key", path)
+	}
+	return file, private, nil
+}
+
+// PublishAudienceKey signs and anchors the public key of audience on the
+// person's identity chain and returns the txID
+// ExtIDs = [0]:signature, [1]:public key, [2]:"audience-key", [3]:audience
+func (person *Person) PublishAudienceKey(audience string, key []byte) (string, error) {
+	content, err := json.Marshal(AudienceKey{Audience: audience, Key: hex.EncodeToString(key), Time: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	signature := ed.Sign(person.ecAddress.Sec, content)
+	entry := &factom.Entry{
+		ChainID: person.chainID,
+		ExtIDs:  [][]byte{signature[:], person.ecAddress.PubBytes(), []byte(audienceKeyEntry), []byte(audience)},
+		Content: content,
+	}
+	return commitRevealEntry(person.chain, defaultRetry, entry, person.ecAddress)
+}
+
+// audienceKey returns the audience key an entry of an identity chain
+// publishes, nil if it isn't an audience key entry signed by identity
+func audienceKey(entry *factom.Entry, identity []byte) *AudienceKey {
+	ext := entry.ExtIDs
+	if len(ext) != 4 || string(ext[2]) != audienceKeyEntry || len(ext[0]) != ed.SignatureSize || entrySize(entry) > maxEntrySize {
+		return nil
+	}
+	if len(identity) != ed.PublicKeySize || !bytes.Equal(ext[1], identity) {
+		return nil
+	}
+	var key [ed.PublicKeySize]byte
+	var signature [ed.SignatureSize]byte
+	copy(key[:], identity)
+	copy(signature[:], ext[0])
+	if !ed.Verify(&key, entry.Content, &signature) {
+		return nil
+	}
+	published := new(AudienceKey)
+	if err := json.Unmarshal(entry.Content, published); err != nil || published.Audience != string(ext[3]) {
+		return nil
+	}
+	if public, err := hex.DecodeString(published.Key); err != nil || len(public) != curve25519.PointSize {
+		return nil
+	}
+	return published
+}
+
+// LookupAudienceKey walks the identity chain of identity and returns the
+// latest key it published for audience, by signed time
+func LookupAudienceKey(reader chainReader, identity []byte, audience string) (*AudienceKey, error) {
+	chainID := identityChainID(identity)
+	keyMR, err := reader.chainHead(chainID)
+	if err != nil {
+		return nil, err
+	}
+	var latest *AudienceKey
+	walked := make(map[string]bool)
+	for keyMR != "" && keyMR != zeroHash {
+		if walked[keyMR] {
+			return nil, fmt.Errorf("entry block %s links back to itself", keyMR)
+		}
+		walked[keyMR] = true
+		eblock, err := reader.entryBlock(keyMR)
+		if err != nil {
+			return nil, err
+		} else if eblock == nil {
+			return nil, fmt.Errorf("entry block %s not found", keyMR)
+		}
+		for _, listed := range eblock.EntryList {
+			entry, err := reader.entry(listed.EntryHash)
+			if err != nil {
+				return nil, err
+			} else if entry == nil {
+				return nil, fmt.Errorf("entry %s not found", listed.EntryHash)
+			}
+			key := audienceKey(entry, identity)
+			if key == nil || key.Audience != audience {
+				continue
+			}
+			if latest == nil || key.Time.After(latest.Time) {
+				latest = key
+			}
+		}
+		keyMR = eblock.Header.PrevKeyMR
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("chain %s publishes no key for %s", chainID, audience)
+	}
+	return latest, nil
+}
+
+var audiencesMu sync.Mutex
+
+// loadAudiences returns the audiences the owner exports to
+func loadAudiences() (map[string]Audience, error) {
+	data, err := ioutil.ReadFile(audiencesPath)
+	if os.IsNotExist(err) {
+		return map[string]Audience{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	audiences := make(map[string]Audience)
+	if err := json.Unmarshal(data, &audiences); err != nil {
+		return nil, fmt.Errorf("%s: %v", audiencesPath, err)
+	}
+	return audiences, nil
+}
+
+// addAudience registers the audience published by identity, checking its
+// chain has a key for it
+func addAudience(reader chainReader, name string, identity []byte) (*AudienceKey, error) {
+	key, err := LookupAudienceKey(reader, identity, name)
+	if err != nil {
+		return nil, err
+	}
+	audiencesMu.Lock()
+	defer audiencesMu.Unlock()
+	audiences, err := loadAudiences()
+	if err != nil {
+		return nil, err
+	}
+	audiences[name] = Audience{Identity: hex.EncodeToString(identity), ChainID: identityChainID(identity), Added: time.Now().UTC()}
+	return key, writeSynced(audiencesPath, audiences)
+}
+
+// removeAudience forgets an audience
+func removeAudience(name string) error {
+	audiencesMu.Lock()
+	defer audiencesMu.Unlock()
+	audiences, err := loadAudiences()
+	if err != nil {
+		return err
+	}
+	if _, ok := audiences[name]; !ok {
+		return fmt.Errorf("no audience %q", name)
+	}
+	delete(audiences, name)
+	return writeSynced(audiencesPath, audiences)
+}
+
+// audiencePublicKey returns the current key of a registered audience, read
+// from its identity chain
+func audiencePublicKey(reader chainReader, name string) ([]byte, error) {
+	audiencesMu.Lock()
+	audiences, err := loadAudiences()
+	audiencesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	audience, ok := audiences[name]
+	if !ok {
+		return nil, fmt.Errorf("no audience %q, add it with blackbox audience add", name)
+	}
+	identity, err := hex.DecodeString(audience.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("audience %s: malformed identity", name)
+	}
+	key, err := LookupAudienceKey(reader, identity, name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up the key of %s: %v", name, err)
+	}
+	return hex.DecodeString(key.Key)
+}
+
+// audienceAEAD derives the cipher of a bundle from the X25519 agreement of
+// the sender's ephemeral key and the audience's key
+func audienceAEAD(shared, ephemeral, public []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(sealedMagic)
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(public)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of the nth chunk of a bundle, marking the last one
+// so a truncated bundle fails to open
+func chunkNonce(size int, n uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// audienceSealer encrypts a stream to an audience key as magic | ephemeral
+// public key | chunks, each a 4 byte length and the AES-256-GCM sealed chunk
+type audienceSealer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte // magic and ephemeral key, authenticated with every chunk
+	buf    []byte
+	n      uint64
+}
+
+// newAudienceSealer returns a writer sealing what is written to w for the
+// holder of the private half of public. Close seals the last chunk.
+func newAudienceSealer(w io.Writer, public []byte) (io.WriteCloser, error) {
+	if len(public) != curve25519.PointSize {
+		return nil, fmt.Errorf("audience key is %d bytes, not %d", len(public), curve25519.PointSize)
+	}
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := audienceAEAD(shared, ephemeral, public)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(nil), sealedMagic...), ephemeral...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &audienceSealer{w: w, aead: aead, header: header, buf: make([]byte, 0, sealedChunk)}, nil
+}
+
+func (s *audienceSealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == sealedChunk {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sealedChunk], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush seals the buffered chunk
+func (s *audienceSealer) flush(last bool) error {
+	sealed := s.aead.Seal(nil, chunkNonce(s.aead.NonceSize(), s.n, last), s.buf, s.header)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := s.w.Write(append(length[:], sealed...)); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.n++
+	return nil
+}
+
+func (s *audienceSealer) Close() error {
+	return s.flush(true)
+}
+
+// openSealed decrypts a bundle sealed to the audience key private into w
+func openSealed(r io.Reader, w io.Writer, private []byte) error {
+	in := bufio.NewReader(r)
+	header := make([]byte, len(sealedMagic)+curve25519.PointSize)
+	if _, err := io.ReadFull(in, header); err != nil || !bytes.HasPrefix(header, sealedMagic) {
+		return errors.New("not a sealed bundle")
+	}
+	ephemeral := header[len(sealedMagic):]
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(private, ephemeral)
+	if err != nil {
+		return err
+	}
+	aead, err := audienceAEAD(shared, ephemeral, public)
+	if err != nil {
+		return err
+	}
+	for n := uint64(0); ; n++ {
+		var length [4]byte
+		if _, err := io.ReadFull(in, length[:]); err != nil {
+			return errors.New("the bundle is truncated")
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size < uint32(aead.Overhead()) || size > sealedChunk+uint32(aead.Overhead()) {
+			return fmt.Errorf("chunk %d is %d bytes", n, size)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(in, sealed); err != nil {
+			return errors.New("the bundle is truncated")
+		}
+		_, more := in.Peek(1)
+		last := more != nil
+		chunk, err := aead.Open(nil, chunkNonce(aead.NonceSize(), n, last), sealed, header)
+		if err != nil {
+			return fmt.Errorf("chunk %d does not open with this key, or was altered", n)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// sealDir writes the files under dir as a tar.gz sealed to public at path
+func sealDir(path, dir string, public []byte) error {
+	return writeFileWith(path, func(w io.Writer) error {
+		sealer, err := newAudienceSealer(w, public)
+		if err != nil {
+			return err
+		}
+		if err := tarDir(sealer, dir); err != nil {
+			return err
+		}
+		return sealer.Close()
+	})
+}
+
+// audienceCommand generates, publishes and opens audience keys, and manages
+// the audiences the owner exports to
+func audienceCommand(vehicle *Vehicle, person *Person, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox audience keygen|add|remove|list|open")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "keygen":
+		flags := flag.NewFlagSet("audience keygen", flag.ExitOnError)
+		name := flags.String("audience", "", "Audience the key is for, e.g. insurer, police or mechanic")
+		out := flags.String("o", "", "Private key file to write (default: <audience>.key)")
+		publish := flags.Bool("publish", false, "Publish the public key on your identity chain, registering it if needed")
+		flags.Parse(args[1:])
+		if *name == "" {
+			fmt.Println("An -audience is required")
+			os.Exit(2)
+		}
+		if *out == "" {
+			*out = *name + ".key"
+		}
+		if _, err := os.Stat(*out); err == nil {
+			fmt.Printf("%s exists, not overwriting it\n", *out)
+			os.Exit(1)
+		}
+		key, err := generateAudienceKey(*name)
+		if err != nil {
+			fmt.Println("Failed to generate the key", err)
+			os.Exit(1)
+		}
+		if err := writeSynced(*out, key); err != nil {
+			fmt.Println("Failed to write the key", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Private key for %s written to %s, keep it safe\n", *name, *out)
+		if !*publish {
+			return
+		}
+		publishAudienceKey(person, key)
+	case "add":
+		flags := flag.NewFlagSet("audience add", flag.ExitOnError)
+		name := flags.String("audience", "", "Audience to export to, as named when its key was published")
+		identity := flags.String("identity", "", "Hex public key of the audience's identity chain")
+		flags.Parse(args[1:])
+		key, err := hex.DecodeString(*identity)
+		if *name == "" || err != nil || len(key) != ed.PublicKeySize {
+			fmt.Println("An -audience and the -identity public key in hex are required")
+			os.Exit(2)
+		}
+		published, err := addAudience(vehicle.chain, *name, key)
+		if err != nil {
+			fmt.Println("Failed to add the audience", err)
+			os.Exit(1)
+		}
+		appendAudit("audience-added", map[string]interface{}{"audience": *name, "identity": *identity})
+		fmt.Printf("Exports for %s are now sealed to key %s, published %s\n", *name, published.Key, published.Time.Format(time.RFC3339))
+	case "remove":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox audience remove <audience>")
+			os.Exit(2)
+		}
+		if err := removeAudience(args[1]); err != nil {
+			fmt.Println("Failed to remove the audience", err)
+			os.Exit(1)
+		}
+		appendAudit("audience-removed", map[string]interface{}{"audience": args[1]})
+		fmt.Printf("Removed %s\n", args[1])
+	case "list":
+		audiences, err := loadAudiences()
+		if err != nil {
+			fmt.Println("Failed to read the audiences", err)
+			os.Exit(1)
+		}
+		if len(audiences) == 0 {
+			fmt.Println("No audiences")
+			return
+		}
+		names := make([]string, 0, len(audiences))
+		for name := range audiences {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s  %s\n", name, audiences[name].Identity)
+		}
+	case "open":
+		flags := flag.NewFlagSet("audience open", flag.ExitOnError)
+		keyPath := flags.String("key", "", "The audience's private key file")
+		out := flags.String("o", "", "Where to write the tar.gz (default: the bundle's name without "+sealedExt+")")
+		flags.Parse(args[1:])
+		if *keyPath == "" || flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox audience open -key <audience.key> [-o out.tar.gz] <bundle>")
+			os.Exit(2)
+		}
+		_, private, err := loadAudienceKey(*keyPath)
+		if err != nil {
+			fmt.Println("Failed to read the key", err)
+			os.Exit(1)
+		}
+		bundle := flags.Arg(0)
+		if *out == "" {
+			*out = strings.TrimSuffix(bundle, sealedExt)
+			if *out == bundle {
+				*out = bundle + ".tar.gz"
+			}
+		}
+		in, err := os.Open(bundle)
+		if err != nil {
+			fmt.Println("Failed to open the bundle", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+		err = writeFileWith(*out, func(w io.Writer) error { return openSealed(in, w, private) })
+		if err != nil {
+			fmt.Println("Failed to open the bundle:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Opened %s into %s\n", filepath.Base(bundle), *out)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown audience command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// publishAudienceKey publishes a generated key on the person's identity
+// chain, registering the chain first if it isn't yet
+func publishAudienceKey(person *Person, key *audienceKeyFile) {
+	state, err := person.RegistrationState()
+	if err != nil {
+		fmt.Println("Failed to check the identity chain", err)
+		os.Exit(1)
+	}
+	if state == ChainAbsent {
+		if _, err := person.Register(person.ecAddress); err != nil {
+			fmt.Println("Failed to register the identity chain", err)
+			os.Exit(1)
+		}
+	}
+	public, _ := hex.DecodeString(key.Public)
+	txID, err := person.PublishAudienceKey(key.Audience, public)
+	if err != nil {
+		fmt.Println("Failed to publish the key", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Key for %s published. TxID: %s\n", key.Audience, txID)
+	fmt.Printf("The owner adds it with: blackbox audience add -audience %s -identity %x\n", key.Audience, person.ecAddress.PubBytes())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLogPath is the local append-only record of actions taken on stored data
+const auditLogPath = "audit.log"
+
+// auditStream marks the anchored heads of the audit log in hash entry metadata
+const auditStream = "audit"
+
+// auditAnchorInterval is how often the head of the audit log is anchored, if
+// anything was appended since
+const auditAnchorInterval = time.Hour
+
+var (
+	auditLogMu   sync.Mutex
+	auditHead    []byte // SHA-256 of the last line
+	auditHeadSet bool   // auditHead was read from the log
+)
+
+// AuditRecord is one line of the audit log. Prev chains every line to the one
+// before it, so anchoring the hash of the last line covers the whole log.
+type AuditRecord struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Prev    string                 `json:"prev,omitempty"` // hex SHA-256 of the previous line
+}
+
+// appendAudit records an action, e.g. pruning a segment, in the audit log
+func appendAudit(action string, details map[string]interface{}) error {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	if err := loadAuditHeadLocked(); err != nil {
+		return err
+	}
+	record := AuditRecord{Time: time.Now().UTC(), Action: action, Details: details}
+	if auditHead != nil {
+		record.Prev = hex.EncodeToString(auditHead)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(line)
+	auditHead = sum[:]
+	return nil
+}
+
+// auditLogHead returns the SHA-256 of the audit log's last line, nil if it is empty
+func auditLogHead() ([]byte, error) {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	if err := loadAuditHeadLocked(); err != nil {
+		return nil, err
+	}
+	return auditHead, nil
+}
+
+// loadAuditHeadLocked hashes the last line of the audit log, once.
+// auditLogMu must be held.
+func loadAuditHeadLocked() error {
+	if auditHeadSet {
+		return nil
+	}
+	head, err := lastLineHash(auditLogPath)
+	if err != nil {
+		return err
+	}
+	auditHead, auditHeadSet = head, true
+	return nil
+}
+
+// lastLineHash returns the SHA-256 of the last line of the log at path, nil
+// if it is empty or doesn't exist
+func lastLineHash(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// lines are short, the tail of the file holds the last one
+	const tail = 64 << 10
+	offset := info.Size() - tail
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	sum := sha256.Sum256(data[bytes.LastIndexByte(data, '\n')+1:])
+	return sum[:], nil
+}
+
+// RunAuditAnchoring anchors the head of the audit log whenever it changed,
+// so no line can later be altered or removed without breaking the chain,
+// until stop is closed
+func (vehicle *Vehicle) RunAuditAnchoring(stop <-chan struct{}) error {
+	var anchored []byte
+	for {
+		head, err := auditLogHead()
+		if err != nil {
+			fmt.Println("Failed to read the audit log", err)
+		} else if head != nil && !bytes.Equal(head, anchored) {
+			if txID, err := vehicle.secureHashWithMeta(head, &HashMeta{Stream: auditStream}); err != nil {
+				fmt.Println("Failed to anchor the audit log", err)
+			} else {
+				anchored = head
+				fmt.Printf("Audit log anchored. TxID: %s\n", txID)
+			}
+		}
+		if !sleep(auditAnchorInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// AuditReport is the result of checking the audit log
+type AuditReport struct {
+	Lines        int       // lines in the log
+	Unchained    int       // leading lines not covered by the hash chain, written before it existed
+	BrokenAt     int       // first line not chained to the one before, 0 if none
+	AnchoredAt   int       // last line whose hash is anchored, 0 if none
+	AnchoredTime time.Time // block time of that anchor
+}
+
+// VerifyAuditLog checks the hash chain of the audit log at path and finds the
+// last line covered by an anchor. anchored holds the owner signed audit
+// anchors of the vehicle's chain, by hex hash.
+func VerifyAuditLog(path string, anchored map[string]*IndexedEntry) (*AuditReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	report := &AuditReport{}
+	var prev string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		report.Lines++
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", report.Lines, err)
+		}
+		switch {
+		case record.Prev == "" && report.Lines == report.Unchained+1:
+			// the first line, or written before chaining
+			report.Unchained++
+		case record.Prev != prev && report.BrokenAt == 0:
+			report.BrokenAt = report.Lines
+		}
+		sum := sha256.Sum256(line)
+		prev = hex.EncodeToString(sum[:])
+		if entry, ok := anchored[prev]; ok {
+			report.AnchoredAt, report.AnchoredTime = report.Lines, entry.BlockTime
+		}
+	}
+	if report.Unchained > 0 {
+		// the next line links to the last of them
+		report.Unchained--
+	}
+	return report, scanner.Err()
+}
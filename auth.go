@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiTokensPath holds the tokens accepted by the HTTP and gRPC APIs
+const apiTokensPath = "tokens.json"
+
+// API token scopes. A token only reaches the routes of its scopes, e.g. a
+// dashboard given read-telemetry cannot start an ownership transfer.
+const (
+	ScopeReadTelemetry     = "read-telemetry"     // status, telemetry, anchors, entries, verification
+	ScopeControlRecording  = "control-recording"  // pause and resume recording
+	ScopeExportEvidence    = "export-evidence"    // download evidence bundles
+	ScopeManageKeys        = "manage-keys"        // issue and revoke API tokens
+	ScopeTransferOwnership = "transfer-ownership" // initiate an ownership transfer, issue ownership credentials
+	ScopeDiagnostics       = "diagnostics"        // runtime profiles and dumps, when the API has debug enabled
+	ScopeAssignDriver      = "assign-driver"      // relay a driver's PIN or NFC tag, e.g. from a keypad or reader
+	ScopeTagTrips          = "tag-trips"          // tag trips business or personal for mileage reports
+	ScopeDutyStatus        = "duty-status"        // set and edit the driver's hours-of-service duty status
+	ScopeRecordFuel        = "record-fuel"        // record fuel purchases for IFTA reports
+	ScopeAnchorLease       = "anchor-lease"       // anchor leases co-signed by lessor and lessee
+	ScopeCountersignPolicy = "countersign-policy" // countersign insurance policies bound by insurers
+)
+
+var apiScopes = []string{ScopeReadTelemetry, ScopeControlRecording, ScopeExportEvidence, ScopeManageKeys, ScopeTransferOwnership, ScopeDiagnostics, ScopeAssignDriver, ScopeTagTrips, ScopeDutyStatus, ScopeRecordFuel, ScopeAnchorLease, ScopeCountersignPolicy}
+
+// APIToken is an issued token. Only the SHA-256 of the secret is stored, the
+// secret itself is shown once when the token is issued.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"` // hex SHA-256 of the secret
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+
+	// Recipient names who the token was issued to, e.g. "insurer", limiting
+	// it to the data the consent policy shares with them. Empty for the
+	// owner's own tokens.
+	Recipient string `json:"recipient,omitempty"`
+
+	// Revoked is when the token was revoked. Revoked tokens stay in the file
+	// so revoking the last one doesn't leave the API open.
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// allows reports whether the token grants scope
+func (t *APIToken) allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore is the API token file, reloaded when another process changes it,
+// e.g. the api-token command while recording
+type tokenStore struct {
+	path string
+
+	mu       sync.Mutex
+	modified time.Time
+	tokens   []APIToken
+}
+
+// loadTokenStore opens the token file at path, which need not exist yet
+func loadTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s, s.reloadLocked()
+}
+
+// reloadLocked rereads the token file if it changed. s.mu must be held.
+func (s *tokenStore) reloadLocked() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.tokens, s.modified = nil, time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modified) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.tokens, s.modified = tokens, info.ModTime()
+	return nil
+}
+
+// list returns the issued tokens that weren't revoked
+func (s *tokenStore) list() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	tokens := []APIToken{}
+	for _, token := range s.tokens {
+		if token.Revoked == nil {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// issue creates a token with the given scopes, for recipient if not empty,
+// and returns it with its secret
+func (s *tokenStore) issue(name string, scopes []string, recipient string) (*APIToken, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(apiScopes, ", "))
+		}
+	}
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := APIToken{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		Created:   time.Now().UTC(),
+		Recipient: recipient,
+	}
+	// the ID prefix finds the token without comparing against every hash
+	plain := "bb_" + token.ID + "_" + hex.EncodeToString(secret)
+	token.Hash = hashToken(plain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, "", err
+	}
+	if err := s.saveLocked(append(append([]APIToken{}, s.tokens...), token)); err != nil {
+		return nil, "", err
+	}
+	return &token, plain, nil
+}
+
+// revoke marks the token with the ID revoked, keeping it as a tombstone
+func (s *tokenStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return err
+	}
+	tokens := append([]APIToken{}, s.tokens...)
+	for i := range tokens {
+		if tokens[i].ID == id && tokens[i].Revoked == nil {
+			now := time.Now().UTC()
+			tokens[i].Revoked = &now
+			return s.saveLocked(tokens)
+		}
+	}
+	return fmt.Errorf("no token %q", id)
+}
+
+// saveLocked replaces the token file. s.mu must be held.
+func (s *tokenStore) saveLocked(tokens []APIToken) error {
+	if err := writeSynced(s.path, tokens); err != nil {
+		return err
+	}
+	s.tokens = tokens
+	if info, err := os.Stat(s.path); err == nil {
+		s.modified = info.ModTime()
+	}
+	return nil
+}
+
+// authenticate returns the token with the plaintext secret. open is true when
+// no token was ever issued, in which case the API is not protected. Once one
+// was, the API stays closed even after every token is revoked.
+func (s *tokenStore) authenticate(plain string) (token *APIToken, open bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, false, err
+	}
+	if len(s.tokens) == 0 {
+		return nil, true, nil
+	}
+	parts := strings.Split(plain, "_")
+	if len(parts) != 3 || parts[0] != "bb" {
+		return nil, false, nil
+	}
+	hash := hashToken(plain)
+	for i := range s.tokens {
+		if s.tokens[i].ID == parts[1] && s.tokens[i].Revoked == nil && subtle.ConstantTimeCompare([]byte(s.tokens[i].Hash), []byte(hash)) == 1 {
+			found := s.tokens[i]
+			return &found, false, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the bearer token of a request grants scope. It
+// returns the token, nil if the API is open, and an HTTP status on failure.
+func (s *tokenStore) authorize(authorization, scope string) (*APIToken, int, error) {
+	if s == nil {
+		return nil, 0, nil
+	}
+	token, open, err := s.authenticate(strings.TrimPrefix(authorization, "Bearer "))
+	switch {
+	case err != nil:
+		return nil, http.StatusInternalServerError, err
+	case open:
+		return nil, 0, nil
+	case token == nil:
+		return nil, http.StatusUnauthorized, fmt.Errorf("a valid API token is required")
+	case !token.allows(scope):
+		return nil, http.StatusForbidden, fmt.Errorf("token %q lacks the %s scope", token.Name, scope)
+	}
+	return token, 0, nil
+}
+
+// require wraps an API route so only tokens granting scope reach it
+func (s *tokenStore) require(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, status, err := s.authorize(r.Header.Get("Authorization"), scope)
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="blackbox"`)
+			}
+			writeError(w, status, err)
+			return
+		}
+		if info := requestAccess(r); info != nil {
+			info.token = token
+		}
+		handler(w, r)
+	}
+}
+
+// requestToken returns the token that authorized a request, nil if the API is open
+func requestToken(r *http.Request) *APIToken {
+	if info := requestAccess(r); info != nil {
+		return info.token
+	}
+	return nil
+}
+
+// tokenRequest is the body of POST /tokens
+type tokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Recipient string   `json:"recipient,omitempty"`
+}
+
+// issuedToken is returned once when a token is issued
+type issuedToken struct {
+	APIToken
+	Token string `json:"token"` // the secret, send as "Authorization: Bearer <token>"
+}
+
+// handleTokens lists and issues API tokens:
+//
+//	GET    /tokens        issued tokens, without their secrets
+//	POST   /tokens        issue a token, its secret is only returned here
+//	DELETE /tokens/<id>   revoke a token
+func (s *tokenStore) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if id := strings.TrimPrefix(r.URL.Path, "/tokens/"); id != r.URL.Path {
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		if err := s.revoke(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		appendAudit("api-token-revoked", map[string]interface{}{"id": id, "remote": r.RemoteAddr})
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := s.list()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	case http.MethodPost:
+		if requestToken(r) == nil {
+			// otherwise anyone reaching an open API could lock the owner out
+			writeError(w, http.StatusForbidden, fmt.Errorf("issue the first token with the api-token command"))
+			return
+		}
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		token, plain, err := s.issue(req.Name, req.Scopes, req.Recipient)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		appendAudit("api-token-issued", map[string]interface{}{"id": token.ID, "name": token.Name, "scopes": token.Scopes, "recipient": token.Recipient, "remote": r.RemoteAddr})
+		writeJSON(w, http.StatusOK, issuedToken{APIToken: *token, Token: plain})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("GET or POST required"))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Backlog levels, each shedding more work as anchoring falls behind recording
+const (
+	backlogNormal   = iota
+	backlogBehind   // segments are coalesced into batch entries, and so are queued entries
+	backlogShedding // hash-only: raw data is hashed and anchored but not kept, samples the pipeline can't take are dropped
+)
+
+var backlogLevelNames = []string{"normal", "behind", "shedding"}
+
+// Backlog thresholds, in entries waiting to be anchored plus segments waiting
+// in the pipeline. A level is left once the backlog falls below half its
+// threshold, so it doesn't flap around it.
+const (
+	backlogBehindAt      = 32
+	backlogSheddingAt    = 256
+	backlogCheckInterval = 10 * time.Second
+	coalesceWindow       = 60 // seconds coalesced batches stay open
+)
+
+// backlogMonitor tracks the current backlog level, shared between recorders
+type backlogMonitor struct {
+	mu      sync.Mutex
+	level   int
+	dropped uint64 // samples dropped while shedding
+}
+
+func (m *backlogMonitor) get() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.level
+}
+
+func (m *backlogMonitor) set(level int) (changed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed = level != m.level
+	m.level = level
+	return changed
+}
+
+// drop counts a sample dropped while shedding
+func (m *backlogMonitor) drop() {
+	m.mu.Lock()
+	m.dropped++
+	m.mu.Unlock()
+}
+
+// droppedSamples returns the number of samples dropped since the recorder started
+func (m *backlogMonitor) droppedSamples() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
+// backlogLevel classifies the backlog given the current level
+func backlogLevel(waiting, current int) int {
+	switch {
+	case waiting >= backlogSheddingAt, current == backlogShedding && waiting >= backlogSheddingAt/2:
+		return backlogShedding
+	case waiting >= backlogBehindAt, current >= backlogBehind && waiting >= backlogBehindAt/2:
+		return backlogBehind
+	}
+	return backlogNormal
+}
+
+// hashOnly returns true if raw data should not be kept, because storage is
+// running out or anchoring is too far behind to keep up with it
+func (vehicle *Vehicle) hashOnly() bool {
+	return vehicle.storage.hashOnly() || vehicle.backlog.get() >= backlogShedding
+}
+
+// waitingToAnchor returns the number of entries waiting to be anchored and
+// segments waiting in the pipeline, or being anchored
+func (vehicle *Vehicle) waitingToAnchor() int {
+	waiting := 0
+	if vehicle.anchors != nil {
+		waiting += vehicle.anchors.size()
+	}
+	if p := vehicle.pipeline; p != nil {
+		waiting += len(p.segments) + len(p.hashed) + len(p.batched) + len(p.anchoring)
+	}
+	return waiting
+}
+
+// MonitorBacklog measures the backlog every backlogCheckInterval and moves
+// the vehicle between backlog levels, alerting the owner on every change,
+// until stop is closed
+func (vehicle *Vehicle) MonitorBacklog(stop <-chan struct{}) error {
+	for {
+		waiting := vehicle.waitingToAnchor()
+		level := backlogLevel(waiting, vehicle.backlog.get())
+		if vehicle.backlog.set(level) {
+			dropped := vehicle.backlog.droppedSamples()
+			vehicle.raiseAlert("backlog-"+backlogLevelNames[level],
+				fmt.Sprintf("anchoring is %s, %d entries and segments waiting, %d samples dropped", backlogLevelNames[level], waiting, dropped),
+				map[string]interface{}{"waiting": waiting, "droppedSamples": dropped})
+			appendAudit("backlog-level", map[string]interface{}{"level": backlogLevelNames[level], "waiting": waiting, "droppedSamples": dropped})
+		}
+		if !sleep(backlogCheckInterval, stop) {
+			return nil
+		}
+	}
+}
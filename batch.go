@@ -0,0 +1,110 @@
+package main
+
+import "time"
+
+// Hashes per batch entry. An entry costs one entry credit per KiB, the
+// default keeps a batch with its signature and metadata within one, the
+// maximum within factomd's 10 KiB limit.
+const (
+	defaultBatchHashes = 24
+	maxBatchHashes     = 256
+)
+
+// BatchConfig groups the hashes of segments into shared entries instead of
+// anchoring each in its own, saving entry credits and factomd round trips at
+// the cost of anchoring up to Window seconds later. Locked segments, e.g.
+// those of an incident, are always anchored on their own.
+type BatchConfig struct {
+	Window  int      `json:"window"`  // seconds the first hash of a batch waits for others
+	Max     int      `json:"max"`     // hashes per entry, defaultBatchHashes if 0
+	Streams []string `json:"streams"` // streams batched, all if empty
+}
+
+// batches returns whether segment's hash may wait to be anchored with others
+func (config *BatchConfig) batches(segment *Segment) bool {
+	if config == nil || (len(config.Streams) > 0 && !contains(config.Streams, segment.Stream)) {
+		return false
+	}
+	return !isSegmentLocked(segment.Path)
+}
+
+// size returns the number of hashes that fill a batch
+func (config *BatchConfig) size() int {
+	if config != nil && config.Max > 0 {
+		return config.Max
+	}
+	return defaultBatchHashes
+}
+
+// window returns how long a batch stays open, none without batching
+func (config *BatchConfig) window() time.Duration {
+	if config == nil {
+		return 0
+	}
+	return time.Duration(config.Window) * time.Second
+}
+
+// batchConfig returns how segments are batched: as configured or, while
+// anchoring is behind, every segment not locked in batches as big as entries
+// allow, coalescing what would otherwise queue up as separate entries
+func (p *pipeline) batchConfig() *BatchConfig {
+	if p.vehicle.backlog.get() < backlogBehind {
+		return p.batching
+	}
+	coalesced := &BatchConfig{Window: coalesceWindow, Max: maxBatchHashes}
+	if p.batching != nil && p.batching.Window > coalesced.Window {
+		coalesced.Window = p.batching.Window
+	}
+	return coalesced
+}
+
+// openBatch is a batch of hashed segments waiting for its entry
+type openBatch struct {
+	opened   time.Time
+	segments []hashedSegment
+}
+
+// batch collects hashed segments of the same stream, compression and driver and
+// anchors each batch once it is full or its window has passed. Batches still
+// open when the pipeline closes are anchored before it drains.
+func (p *pipeline) batch() {
+	defer func() {
+		p.confirming.Wait()
+		close(p.results)
+	}()
+	open := make(map[HashMeta]*openBatch)
+	flush := func(meta HashMeta) {
+		p.confirm(open[meta].segments)
+		delete(open, meta)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case hashed, ok := <-p.batched:
+			if !ok {
+				for meta := range open {
+					flush(meta)
+				}
+				return
+			}
+			meta := HashMeta{Stream: hashed.segment.Stream, Compression: hashed.segment.Compression, Driver: hashed.segment.Driver, ClockUncertain: hashed.segment.ClockUncertain}
+			batch := open[meta]
+			if batch == nil {
+				batch = &openBatch{opened: time.Now()}
+				open[meta] = batch
+			}
+			batch.segments = append(batch.segments, hashed)
+			if len(batch.segments) >= p.batchConfig().size() {
+				flush(meta)
+			}
+		case now := <-ticker.C:
+			window := p.batchConfig().window()
+			for meta, batch := range open {
+				if now.Sub(batch.opened) >= window {
+					flush(meta)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "fmt"
+
+// Battery voltage thresholds, for a 12V lead acid system
+const (
+	chargingMinVolts    = 13.0 // below this with the engine running, the alternator isn't charging
+	batteryLowVolts     = 12.0 // resting voltage of a ~25% charged battery
+	batteryCriticalVolt = 11.5 // the recorder and the starter are both at risk
+)
+
+// Battery states reported by batteryMonitor
+const (
+	batteryOK          = "ok"
+	batteryNotCharging = "not-charging"
+	batteryLow         = "low"
+	batteryCritical    = "critical"
+)
+
+// batteryMonitor classifies control module voltage and remembers the last state
+// so each problem is only alerted once
+type batteryMonitor struct {
+	state string
+}
+
+func newBatteryMonitor() *batteryMonitor {
+	return &batteryMonitor{state: batteryOK}
+}
+
+// update returns the battery state for a voltage reading and whether it changed
+func (m *batteryMonitor) update(volts float64, engineRunning bool) (string, bool) {
+	state := batteryOK
+	switch {
+	case volts <= 0:
+		return m.state, false // no reading
+	case volts < batteryCriticalVolt:
+		state = batteryCritical
+	case engineRunning && volts < chargingMinVolts:
+		state = batteryNotCharging
+	case !engineRunning && volts < batteryLowVolts:
+		state = batteryLow
+	}
+	changed := state != m.state
+	m.state = state
+	return state, changed
+}
+
+// checkBattery raises an alert whenever the battery enters a problem state
+func (vehicle *Vehicle) checkBattery(monitor *batteryMonitor, volts float64, engineRunning bool) {
+	state, changed := monitor.update(volts, engineRunning)
+	if !changed || state == batteryOK {
+		return
+	}
+	messages := map[string]string{
+		batteryNotCharging: "charging system is not charging the battery",
+		batteryLow:         "battery is low",
+		batteryCritical:    "battery is critically low, recording may stop",
+	}
+	vehicle.raiseAlert("battery-"+state,
+		fmt.Sprintf("%s (%.1f V)", messages[state], volts),
+		map[string]interface{}{"volts": volts, "engineRunning": engineRunning})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// benchVIN is the made up vehicle the bench and load test commands record
+const benchVIN = "1M8GDM9AXKP042788"
+
+// benchRecord returns a record like the OBD loop takes every sample
+func benchRecord() *OBDRecord {
+	record := &OBDRecord{Time: time.Date(2020, 1, 2, 15, 4, 5, 123456789, time.UTC), Position: "51.507400,-0.127800"}
+	names := []string{
+		"Runtime Since Start", "Vehicle Speed", "Engine RPM", "Throttle Position", "Fuel Pressure",
+		"Timing Advance", "Coolant Temp", "Engine Load", "Intake Manifold Pressure", "MAF Air Flow Rate",
+		"Short Term Fuel Trim 1", "Short Term Fuel Trim 2", "Long Term Fuel Trim 1", "Long Term Fuel Trim 2",
+		"Ambient Air Temp", "Control Module Voltage",
+	}
+	for i, name := range names {
+		record.Readings = append(record.Readings, Reading{Name: name, Value: fmt.Sprintf("%f", float32(i)*12.5), Units: "%"})
+	}
+	record.Readings = append(record.Readings, Reading{Name: "Oil Temp", Value: "0", Units: "C", Error: "NO DATA"})
+	return record
+}
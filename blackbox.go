@@ -3,17 +3,20 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	ed "github.com/FactomProject/ed25519"
 	"github.com/FactomProject/factom"
 	"github.com/dhowden/raspicam"
-	"github.com/sambarnes/elmobd"
 )
 
 // Types
@@ -21,15 +24,53 @@ import (
 type Person struct {
 	ecAddress *factom.ECAddress // the identity of a user (also used for chain payments)
 	chainID   string            // their identity chain to hold vehicle registrations
+	chain     ChainClient       // where the identity chain is registered
 	vehicles  []Vehicle
 	tickets   []Ticket
 }
 
 type Vehicle struct {
-	vin            string   // the VIN number used as the vehicle's ID
-	chainID        string   // the chain holding all dataPointEntries
-	owner          *Person  // current owner
-	previousOwners [][]byte // public keys of previous owners
+	vin            string           // the VIN number used as the vehicle's ID
+	chainID        string           // the chain holding all dataPointEntries
+	owner          *Person          // current owner
+	previousOwners [][]byte         // public keys of previous owners
+	position       *positionTracker // latest GPS fix, shared between recorders
+	recorder       *recorderState   // segment and sampling state, shared between recorders
+	sensors        []Sensor         // extra sensors logged with every OBD record
+	store          *Store           // local telemetry database
+	clock          *timeSync        // system clock discipline and time confidence
+	alerts         *alertLog        // recent alerts for the owner
+	privacy        LocationPrivacy  // how positions appear in evidence
+	compression    string           // method used for OBD segment files
+	obdErrors      *obdErrorCounts  // commands the vehicle failed to answer, for diagnostics
+	obd            OBDDevice        // adapter RecordOBD samples, nil outside the record command
+	key            *deviceKey       // encrypts evidence files at rest, nil for plaintext
+	storage        *storageMonitor  // free space level, degrades recording when low
+	backlog        *backlogMonitor  // anchoring backlog level, sheds work when anchoring falls behind
+	thermal        *thermalMonitor  // SoC temperature level, lightens recording when hot
+	drivers        *driverRoster    // drivers of the vehicle and the one assigned
+	scoring        ScoringConfig    // weighs trips into driving scores
+	hos            *hosTracker      // hours-of-service duty status, nil outside commercial-driver mode
+	ifta           *IFTAConfig      // fuel-tax reporting settings, nil if not configured
+	jurisdictions  []Jurisdiction   // IFTA state and province boundaries
+	info           *VehicleInfo     // make, model and year decoded from the VIN, nil if not decoded
+	anchors        *anchorQueue     // entries waiting to be anchored, nil to send directly
+	anchored       *anchorLog       // recently anchored entries
+	tokens         *tokenStore      // tokens accepted by the APIs, nil leaves them open
+	consent        *consentStore    // data the APIs share with each token's recipient
+	funder         *fleetAgent      // fleet server paying for entries, nil to pay with the owner's credits
+	anchorBackend  entrySender      // sends entries in place of factomd, e.g. the load test's mock
+	tasks          *supervisor      // recording tasks, nil outside the record command
+	pipeline       *pipeline        // stores, segments, hashes and anchors recorded data
+	videoGap       *CoverageGap     // footage missing since the camera failed, logged when it restarts
+	chain          ChainClient      // reads and writes the vehicle's chain
+
+	// speedProofs commits to the speeds recorded so the owner can prove a
+	// speed limit was kept, nil if not configured
+	speedProofs *SpeedProofConfig
+
+	// privacyMode suspends location capture while on, nil unless recording
+	privacyMode *privacyMode
 }
 
 type Ticket struct {
@@ -53,37 +94,30 @@ func constructChainID(chainName [][]byte) string {
  * Person functions
  */
 
-// NewPerson creates a new Person using the ecAddress as payment and identity
-func NewPerson(ecAddress *factom.ECAddress) *Person {
+// NewPerson creates a new Person using the ecAddress as payment and identity,
+// with their chain on chain
+func NewPerson(ecAddress *factom.ECAddress, chain ChainClient) *Person {
 	var p Person
 	p.ecAddress = ecAddress
+	p.chain = chain
 	chainName := [][]byte{[]byte("Driver Identity Chain"), ecAddress.PubBytes()}
 	p.chainID = constructChainID(chainName)
 	return &p
 }
 
-// IsRegistered returns true if the person's chainID has been registered
-func (person *Person) IsRegistered() bool {
-	return factom.ChainExists(person.chainID)
+// RegistrationState returns whether the person's chain is confirmed, pending
+// or absent, or ChainUnknown and why it couldn't be told
+func (person *Person) RegistrationState() (ChainState, error) {
+	return chainState(person.chain, person.chainID)
 }
 
-// Register will try to create a factom chain for the person and return the txID
+// Register will try to create a factom chain for the person and return the
+// txID, "" if it exists. It is safe to call again, see registerChain.
 // ExtIDs = [0]:"Driver Identity Chain", [1]:public key in binary
 func (person *Person) Register(ecAddress *factom.ECAddress) (string, error) {
-	if person.IsRegistered() {
-		return "", nil
-	}
 	chainEntry := factom.Entry{}
 	chainEntry.ExtIDs = [][]byte{[]byte("Driver Identity Chain"), person.ecAddress.PubBytes()}
-	chain := factom.NewChain(&chainEntry)
-	txID, err := factom.CommitChain(chain, ecAddress)
-	if err != nil {
-		return "", err
-	}
-	if _, err := factom.RevealChain(chain); err != nil {
-		return "", err
-	}
-	return txID, nil
+	return registerChainPaid(person.chain, factom.NewChain(&chainEntry), ecAddress)
 }
 
 // InitiateVehicleTransaction lets person sign a message saying that they would like to
@@ -98,196 +132,416 @@ func (person *Person) ConfirmVehicleTransaction(vehicle Vehicle) {
 	// TODO
 }
 
+// InitiateTransfer signs and anchors a transfer event offering the vehicle to
+// the owner with the given public key, and returns the txID. details, e.g. who
+// asked for the transfer, are included in the event.
+func (vehicle *Vehicle) InitiateTransfer(newOwner []byte, details map[string]interface{}) (string, error) {
+	if len(newOwner) != ed.PublicKeySize {
+		return "", fmt.Errorf("new owner key must be %d bytes, got %d", ed.PublicKeySize, len(newOwner))
+	}
+	if vehicle.owner == nil {
+		return "", fmt.Errorf("vehicle has no owner to transfer from")
+	}
+	data := map[string]interface{}{
+		"from": hex.EncodeToString(vehicle.owner.ecAddress.PubBytes()),
+		"to":   hex.EncodeToString(newOwner),
+	}
+	for k, v := range details {
+		data[k] = v
+	}
+	return vehicle.LogEvent(vehicle.NewEvent("transfer", data), true)
+}
+
 /*
  * Vehicle functions
  */
 
-// NewVehicle creates a Vehicle using the given VIN number
-func NewVehicle(vin string) *Vehicle {
-	if len(vin) != 17 {
-		return nil
+// NewVehicle creates a Vehicle using the given VIN number, with its chain on
+// chain, or returns why the VIN isn't valid
+func NewVehicle(vin string, chain ChainClient) (*Vehicle, error) {
+	if err := ValidateVIN(vin); err != nil {
+		return nil, err
 	}
 
 	var v Vehicle
 	v.vin = vin
-	chainName := [][]byte{[]byte("Vehicle Identity Chain"), []byte(vin)}
-	v.chainID = constructChainID(chainName)
-	return &v
+	v.position = &positionTracker{}
+	v.recorder = &recorderState{}
+	v.obdErrors = &obdErrorCounts{}
+	v.clock = newTimeSync("")
+	v.alerts = &alertLog{}
+	v.storage = &storageMonitor{}
+	v.backlog = &backlogMonitor{}
+	v.thermal = &thermalMonitor{}
+	v.drivers = &driverRoster{}
+	v.anchored = &anchorLog{}
+	v.chainID = vehicleChainID(vin)
+	v.chain = chain
+	return &v, nil
+}
+
+// vehicleChainID returns the ChainID of the vehicle with the given VIN
+func vehicleChainID(vin string) string {
+	return constructChainID([][]byte{[]byte("Vehicle Identity Chain"), []byte(vin)})
 }
 
-// IsRegistered returns true if the vehicle's chainID has been registered
-func (vehicle *Vehicle) IsRegistered() bool {
-	return factom.ChainExists(vehicle.chainID)
+// RegistrationState returns the state of the vehicle's chain like
+// Person.RegistrationState
+func (vehicle *Vehicle) RegistrationState() (ChainState, error) {
+	return chainState(vehicle.chain, vehicle.chainID)
 }
 
-// Register will try to create a factom chain for the vehicle and return the txID
+// Register will try to create a factom chain for the vehicle and return the
+// txID, "" if it exists. It is safe to call again, see registerChain.
 // ExtIDs = [0]:"Vehicle Identity Chain", [1]:string of vin number
+// Content = the decoded VIN as JSON VehicleInfo, if it was decoded
 func (vehicle *Vehicle) Register(ecAddress *factom.ECAddress) (string, error) {
-	if vehicle.IsRegistered() {
-		return "", nil
-	}
 	chainEntry := factom.Entry{}
 	chainEntry.ExtIDs = [][]byte{[]byte("Vehicle Identity Chain"), []byte(vehicle.vin)}
-	chain := factom.NewChain(&chainEntry)
-	txID, err := factom.CommitChain(chain, ecAddress)
-	if err != nil {
-		return "", err
+	chainEntry.ChainID = vehicle.chainID
+	if vehicle.info != nil {
+		content, err := json.Marshal(vehicle.info)
+		if err != nil {
+			return "", err
+		}
+		chainEntry.Content = content
 	}
-	if _, err := factom.RevealChain(chain); err != nil {
-		return "", err
+	if vehicle.funder != nil {
+		// the fleet server commits and reveals the chain
+		return registerChain(vehicle.chain, vehicle.chainID, func() (string, error) {
+			var txID string
+			err := defaultRetry.do("Fleet chain creation", func() (err error) {
+				txID, err = vehicle.funder.createChain(&chainEntry)
+				return err
+			})
+			return txID, err
+		}, nil)
 	}
-	return txID, nil
+	return registerChainPaid(vehicle.chain, factom.NewChain(&chainEntry), ecAddress)
+}
+
+// VideoConfig enables recording with the Raspberry Pi camera module
+type VideoConfig struct {
+	Interval int `json:"interval"` // seconds of footage per anchored segment
 }
 
-func (vehicle *Vehicle) StartRecording() {
-	vehicle.RecordOBD()
-	// go vehicle.RecordVideo()
+// StartRecording records OBD data, and video if configured, as tasks of the
+// vehicle's supervisor and returns once every task has ended
+func (vehicle *Vehicle) StartRecording(video *VideoConfig) {
+	vehicle.tasks.Go("obd", vehicle.RecordOBD)
+	if video != nil {
+		vehicle.tasks.Go("video", func(stop <-chan struct{}) error {
+			return vehicle.RecordVideo(video.Interval, stop)
+		})
+	}
+	vehicle.tasks.Wait()
+}
+
+// shutdownTimeout bounds how long Shutdown waits for the last segments to be
+// anchored. Entries it gives up on stay in the anchor queue, and segments not
+// yet hashed are finished by recoverSegments at the next start.
+const shutdownTimeout = 30 * time.Second
+
+// stopOnSignal stops the recording tasks on SIGINT or SIGTERM, e.g. when the
+// ignition cuts the recorder's power supply and it is shut down
+func (vehicle *Vehicle) stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals) // a second signal kills the recorder at once
+		fmt.Println("Received", sig, "stopping recording")
+		vehicle.tasks.Stop()
+	}()
+}
+
+// Shutdown finishes recording once the tasks have stopped: the open telemetry
+// segment is closed, and it and the last video segment are hashed and their
+// anchors enqueued, waiting up to shutdownTimeout for them to be sent
+func (vehicle *Vehicle) Shutdown() {
+	vehicle.logCoverageGap()
+	drained := make(chan struct{})
+	go func() {
+		vehicle.pipeline.close()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		fmt.Println("Recording stopped, every segment anchored")
+	case <-time.After(shutdownTimeout):
+		fmt.Println("Recording stopped with segments still being anchored, they are resumed at the next start")
+	}
+}
+
+// reportTaskFailure alerts the owner that a recording task failed and is
+// being restarted
+func (vehicle *Vehicle) reportTaskFailure(name string, err error) {
+	vehicle.raiseAlert("task-failed", fmt.Sprintf("%s failed, restarting: %v", name, err), map[string]interface{}{"task": name})
+}
+
+// CoverageGap is the content of a "coverage-gap" event, logged and anchored
+// when the camera is restarted after failing. It accounts for the footage
+// missing between Start and End, which was never recorded rather than deleted.
+type CoverageGap struct {
+	Stream string    `json:"stream"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Error  string    `json:"error"` // why the camera stopped
+}
+
+// logCoverageGap logs and anchors the outage since the camera failed, if any
+func (vehicle *Vehicle) logCoverageGap() {
+	gap := vehicle.videoGap
+	if gap == nil {
+		return
+	}
+	vehicle.videoGap = nil
+	gap.End = time.Now().UTC()
+	fmt.Printf("No footage from %s to %s: %s\n", gap.Start.Format(time.RFC3339), gap.End.Format(time.RFC3339), gap.Error)
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("coverage-gap", toEventData(gap)), true); err != nil {
+		fmt.Println("Failed to log the coverage gap", err)
+	}
 }
 
 // RecordVideo begins recording with the raspberry pi camera module,
 // hashes segments of video at the given interval in seconds,
-// and commits that hash to the camera's chain
-func (vehicle *Vehicle) RecordVideo(interval int) {
+// and commits that hash to the camera's chain until stop is closed.
+// If the camera fails the footage being captured is dropped and the error
+// returned, and the outage is logged as a coverage gap once it is restarted.
+func (vehicle *Vehicle) RecordVideo(interval int, stop <-chan struct{}) error {
 	fmt.Println("Recording started...")
+	vehicle.logCoverageGap()
 
-	for i := 0; i < 5; i++ {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
 		fmt.Println("Capturing video...")
 
-		videoPath, _ := vehicle.captureVideoSegment(interval)
-		hash, _ := vehicle.getFileHash(videoPath)
-
-		fmt.Printf("Video saved at %s with hash %s", videoPath, hash)
+		segment, err := vehicle.newSegment("video", time.Now())
+		if err != nil {
+			return err
+		}
+		if vehicle.hashOnly() {
+			// out of space, keep only the hash of the footage
+			hash, err := vehicle.captureVideoHash(interval)
+			if err != nil {
+				return vehicle.cameraFailed(segment, err)
+			}
+			segment.Path, segment.Pruned = "", true
+			segment.Hash = hex.EncodeToString(hash)
+			fmt.Printf("Video hashed but not saved, hash %x\n", hash)
+		} else {
+			hash, err := vehicle.captureVideoSegment(segment.Path, interval)
+			if err != nil {
+				return vehicle.cameraFailed(segment, err)
+			}
+			segment.Hash = hex.EncodeToString(hash)
+		}
+		segment.End = time.Now()
+		vehicle.pipeline.submitSegment(segment)
+	}
+}
 
-		vehicle.secureHashOnChain(hash)
+// cameraFailed opens a coverage gap at the start of the segment whose capture
+// failed, and returns the error for the supervisor to restart the camera
+func (vehicle *Vehicle) cameraFailed(segment *Segment, err error) error {
+	if vehicle.videoGap == nil {
+		vehicle.videoGap = &CoverageGap{Stream: "video", Start: segment.Start.UTC()}
 	}
+	vehicle.videoGap.Error = err.Error()
+	return fmt.Errorf("camera: %v", err)
 }
 
-// RecordOBD begins logging
-func (vehicle *Vehicle) RecordOBD() {
-	// TODO: use a real device, not just a mock
-	serialPath := flag.String(
-		"serial",
-		"/dev/ttyUSB0",
-		"Path to the serial device to use",
-	)
-	flag.Parse()
+// hashVideoSegment moves captured footage to the object store under its hash
+// and records the segment
+func (vehicle *Vehicle) hashVideoSegment(segment *Segment) ([]byte, error) {
+	var hash []byte
+	var err error
+	if segment.Pruned {
+		if hash, err = hex.DecodeString(segment.Hash); err != nil {
+			return nil, err
+		}
+	} else if segment.Hash != "" {
+		// hashed while it was captured, the footage needn't be read again
+		if hash, err = hex.DecodeString(segment.Hash); err != nil {
+			return nil, err
+		}
+		if segment.Path, err = vehicle.renameToObject(segment.Path, hash); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Video saved at %s with hash %x\n", segment.Path, hash)
+	} else {
+		if hash, segment.Path, err = vehicle.moveToObjects(segment.Path); err != nil {
+			return nil, err
+		}
+		segment.Hash = hex.EncodeToString(hash)
+		fmt.Printf("Video saved at %s with hash %x\n", segment.Path, hash)
+	}
+	if vehicle.store != nil {
+		if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
 
-	dev, err := elmobd.NewTestDevice(*serialPath, false)
+// RecordOBD samples the OBD adapter into the vehicle's pipeline until stop is closed
+func (vehicle *Vehicle) RecordOBD(stop <-chan struct{}) error {
+	if vehicle.obd == nil {
+		return errors.New("no OBD device configured")
+	}
+	cmds, odometerCmds := obdCommands(), odometerCommands()
+	dev, err := vehicle.obd.Open(append(obdCommands(), odometerCmds...))
 	if err != nil {
-		fmt.Println("Failed to create new device", err)
-		return
+		return err
+	}
+	defer dev.Close()
+	odometer, err := loadOdometerState()
+	if err != nil {
+		fmt.Println("Failed to read the odometer state, starting afresh", err)
+		odometer = new(odometerState)
 	}
 
-	for i := 0; i < 1; i++ {
-		now := time.Now().Format("20060102150405")
-		filepath := fmt.Sprintf("%s.txt", now)
-		for j := 0; j < 60; j++ {
-			// Run all commands
-			timeSinceStart, err := dev.RunOBDCommand(elmobd.NewRuntimeSinceStart())
-			speed, err := dev.RunOBDCommand(elmobd.NewVehicleSpeed())
-			rpm, err := dev.RunOBDCommand(elmobd.NewEngineRPM())
-			throttle, err := dev.RunOBDCommand(elmobd.NewThrottlePosition())
-			fuelPressure, err := dev.RunOBDCommand(elmobd.NewFuelPressure())
-			timingAdvance, err := dev.RunOBDCommand(elmobd.NewTimingAdvance())
-			coolant, err := dev.RunOBDCommand(elmobd.NewCoolantTemperature())
-			engineLoad, err := dev.RunOBDCommand(elmobd.NewEngineLoad())
-			manifoldPressure, err := dev.RunOBDCommand(elmobd.NewIntakeManifoldPressure())
-			maf, err := dev.RunOBDCommand(elmobd.NewMafAirFlowRate())
-			shortterm1, err := dev.RunOBDCommand(elmobd.NewShortFuelTrim1())
-			shortterm2, err := dev.RunOBDCommand(elmobd.NewShortFuelTrim2())
-			longterm1, _ := dev.RunOBDCommand(elmobd.NewLongFuelTrim1())
-			longterm2, _ := dev.RunOBDCommand(elmobd.NewLongFuelTrim2())
-
-			// Compile command results
-			results := strings.Join([]string{
-				fmt.Sprintf("%s/n", time.Now().String()),
-				fmt.Sprintf("Runtime Since Start: %s sec", timeSinceStart.ValueAsLit()),
-				fmt.Sprintf("Vehichle Speed: %s km/h", speed.ValueAsLit()),
-				fmt.Sprintf("Engine RPM: %s", rpm.ValueAsLit()),
-				fmt.Sprintf("Throttle Position: %s%%", throttle.ValueAsLit()),
-				fmt.Sprintf("Fuel Pressure: %s kPa", fuelPressure.ValueAsLit()),
-				fmt.Sprintf("Timing Advance: %s deg before TDC", timingAdvance.ValueAsLit()),
-				fmt.Sprintf("Coolant Temp: %s C", coolant.ValueAsLit()),
-				fmt.Sprintf("Engine Load: %s%%", engineLoad.ValueAsLit()),
-				fmt.Sprintf("Intake Manifold Pressure: %s kPa", manifoldPressure.ValueAsLit()),
-				fmt.Sprintf("MAF Air Flow Rate: %s grams/sec", maf.ValueAsLit()),
-				fmt.Sprintf("Short Term Fuel Trim 1: %s%%", shortterm1.ValueAsLit()),
-				fmt.Sprintf("Short Term Fuel Trim 2: %s%%", shortterm2.ValueAsLit()),
-				fmt.Sprintf("Long Term Fuel Trim 1: %s%%", longterm1.ValueAsLit()),
-				fmt.Sprintf("Long Term Fuel Trim 2: %s%%", longterm2.ValueAsLit()),
-				"------------------------------------------------------------------\n",
-			}, "\n")
-
-			// Try to open the current working file
-			file, err := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0600)
-			if err != nil {
-				// File doesn't exist, create it
-				file, err = os.Create(filepath)
-				if err != nil {
-					panic(err)
-				}
-
-				// Write the OBD results
-				if _, err = file.WriteString(results); err != nil {
-					panic(err)
-				}
-
-				file.Close()
-				fmt.Println("File created.")
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			// File exists
-			if _, err = file.WriteString(results); err != nil {
-				panic(err)
+	trips := NewTripDetector(vehicle.vin)
+	trips.speeding = vehicle.scoring.SpeedingKmh
+	var codes []string
+	var codesRead time.Time
+	speeds := newSpeedValidator()
+	committer := vehicle.newSpeedCommitter()
+	defer committer.flush()
+	battery := newBatteryMonitor()
+	running := false // the engine, as of the last sample answering RPM
+	for {
+		if vehicle.recorder.isPaused() {
+			if !sleep(vehicle.sampleInterval(), stop) {
+				return nil
 			}
-
-			file.Close()
-			fmt.Println("File has been updated.")
-			time.Sleep(1 * time.Second)
+			continue
 		}
-		hash, err := vehicle.getFileHash(filepath)
+		// Run all commands, as few requests as the adapter allows
+		results, errs, err := dev.sample(cmds)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		txID, err := vehicle.secureHashOnChain(hash)
-		if err != nil {
-			panic(err)
+		vehicle.obdErrors.add(errs)
+		if time.Since(codesRead) >= dtcInterval {
+			codes, codesRead = vehicle.checkTroubleCodes(dev, codes), time.Now()
+		}
+
+		// Compile command results
+		record := &OBDRecord{
+			Time:     time.Now(),
+			Position: vehicle.describePosition(vehicle.position.latest()),
+			Readings: make([]Reading, 0, len(obdReadings)+len(vehicle.sensors)),
+		}
+		for i, reading := range obdReadings {
+			record.add(reading.name, results[i], errs[i], reading.units)
+		}
+		record.Readings = vehicle.sampleSensors(record.Readings)
+
+		// At ignition off the segment is closed, anchoring the minute before
+		// the engine stopped even if the power is cut soon after
+		ignition := obdValue(results[obdRPM]) > 0
+		engineOff := false
+		if errs[obdRPM] == nil {
+			engineOff, running = running && !ignition, ignition
 		}
-		fmt.Printf("File secured to factom. TxID: %s\n", txID)
+		vehicle.pipeline.submit(Sample{Source: "obd", Record: record, Flush: engineOff})
+		vehicle.recorder.setLatest(record)
+
+		// Detect trip boundaries, the engine is running whenever RPM is
+		// reported. A sample missing either is skipped rather than read as 0.
+		if errs[obdSpeed] == nil && errs[obdRPM] == nil {
+			sample := TripSample{Time: record.Time, Speed: obdValue(results[obdSpeed]), Ignition: ignition}
+			vehicle.trackSample(trips, speeds, sample)
+			committer.add(sample)
+		}
+		if errs[obdVoltage] == nil {
+			vehicle.checkBattery(battery, obdValue(results[obdVoltage]), ignition)
+		}
+
+		// Attest the odometer daily, after the sample's results are used as
+		// sampling again reuses them
+		if odometer.due() {
+			if err := vehicle.attestOdometer(dev, odometerCmds, odometer); err != nil {
+				fmt.Println("Failed to attest the odometer", err)
+			}
+		}
+
+		if !sleep(vehicle.sampleInterval(), stop) {
+			return nil
+		}
+	}
+}
+
+// trackSample advances the position estimate, trips, hours of service and the
+// speed sensor cross-check with a sample the vehicle answered speed and RPM in
+func (vehicle *Vehicle) trackSample(trips *TripDetector, speeds *speedValidator, sample TripSample) {
+	if estimate := vehicle.position.advance(sample.Speed, sample.Time); estimate != nil {
+		appendTrackPoint(estimate)
+	}
+	trips.imu = vehicle.recorder.imuRecording()
+	for n := vehicle.recorder.takeHarshEvents(); n > 0; n-- {
+		trips.RecordHarshEvent()
+	}
+	inTrip := trips.InProgress()
+	trip := trips.Update(sample)
+	if !inTrip && trips.InProgress() {
+		vehicle.startTrip()
+	}
+	if trip != nil {
+		vehicle.anchorTrip(trip)
+	}
+	if inTrip && !trips.InProgress() {
+		vehicle.endTrip()
+	}
+	if vehicle.hos != nil {
+		vehicle.hos.update(vehicle, sample)
+	}
+
+	// Cross-check the speed sensor against GPS
+	if discrepancy := speeds.compare(sample.Time, sample.Speed, vehicle.position.latest()); discrepancy != nil {
+		vehicle.logSpeedDiscrepancy(discrepancy)
 	}
 }
 
-// VerifyData will check the integrity of a local file
-func (vehicle *Vehicle) VerifyData(filepath string) (bool, error) {
+// VerifyData will check the integrity of a local file, returning where on chain
+// its hash was found. result.Verified is false if no matching entry exists.
+func (vehicle *Vehicle) VerifyData(filepath string) (*VerifyResult, error) {
 	fmt.Println("Verifying started...")
-	entries, err := factom.GetAllChainEntries(vehicle.chainID)
+	localHash, err := vehicle.getFileHash(filepath)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	return findHashEntry(vehicle.chain, vehicle, localHash)
+}
+
+// entryMatchesHash returns true if entry is a hash entry signed by the vehicle's
+// owner anchoring hash, alone or in a batch. It returns why if entry is shaped
+// like a hash entry but breaks the schema parseHashEntry checks.
+func (vehicle *Vehicle) entryMatchesHash(entry *factom.Entry, hash []byte) (bool, error) {
+	fields, err := parseHashEntry(entry)
+	if err == errNotHashEntry {
+		return false, nil
 	}
-	localHash, err := vehicle.getFileHash(filepath)
 	if err != nil {
 		return false, err
 	}
-	for _, entry := range entries {
-		if len(entry.ExtIDs) != 2 {
-			continue // invalid ExtID structure
-		}
-		// check if the pub key matches
-		pubKey := entry.ExtIDs[1]
-		if bytes.Compare(pubKey, vehicle.owner.ecAddress.PubBytes()) != 0 {
-			continue
-		}
-		// check if the signature is valid
-		var signature [64]byte
-		copy(signature[:], entry.ExtIDs[0])
-		if !ed.Verify(vehicle.owner.ecAddress.PubFixed(), entry.Content, &signature) {
-			continue
-		}
+	// check if the pub key matches
+	if !bytes.Equal(fields.key[:], vehicle.owner.ecAddress.PubBytes()) {
+		return false, nil
+	}
+	// check if the signature is valid
+	if !ed.Verify(&fields.key, fields.signed, &fields.signature) {
+		return false, nil
+	}
 
-		// check if localHash is found on-chain
-		if bytes.Compare(localHash, entry.Content) == 0 {
+	// check if hash is found on-chain
+	for _, anchored := range fields.hashes {
+		if bytes.Equal(hash, anchored) {
 			return true, nil
 		}
 	}
@@ -295,38 +549,86 @@ func (vehicle *Vehicle) VerifyData(filepath string) (bool, error) {
 }
 
 // captureVideoSegment uses the raspicam package to capture a video
-// of length <interval> seconds and return its filepath
-func (vehicle *Vehicle) captureVideoSegment(interval int) (string, error) {
+// of length <interval> seconds to path and returns its hash, computed from
+// the bytes as they are written
+func (vehicle *Vehicle) captureVideoSegment(path string, interval int) ([]byte, error) {
 	// create file for the video
-	now := time.Now().Format("20060102150405")
-	path := fmt.Sprintf("%s.h264", now)
+	tmp := path + tempExt
 
-	f, err := os.Create(path)
+	f, err := os.Create(tmp)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "create file: %v", err)
-		return "", err
+		return nil, err
 	}
 	defer f.Close()
 
-	// capture 10 seconds of video
-	s := raspicam.NewVid()
-	s.Args = append(s.Args, "-o", path, "-t", "10000")
+	// capture 10 seconds of video, streamed through the hash to the file
+	s := vehicle.videoCommand()
+	s.Args = append(s.Args, "-t", "10000")
+	sha := sha256.New()
+	if err := runCapture(s, io.MultiWriter(f, sha)); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	// only a complete capture gets the final name
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return sha.Sum(nil), nil
+}
+
+// captureVideoHash captures a video like captureVideoSegment but only returns
+// its hash, nothing is written to disk
+func (vehicle *Vehicle) captureVideoHash(interval int) ([]byte, error) {
+	sha := sha256.New()
+	s := vehicle.videoCommand()
+	s.Args = append(s.Args, "-o", "-", "-t", "10000")
+	if err := runCapture(s, sha); err != nil {
+		return nil, err
+	}
+	return sha.Sum(nil), nil
+}
+
+// runCapture runs the camera command, streaming its footage to w, and returns
+// the last error it reported, e.g. raspivid exiting abnormally
+func runCapture(s *raspicam.Vid, w io.Writer) error {
 	errCh := make(chan error)
+	failed := make(chan error, 1)
 	go func() {
-		for x := range errCh {
-			fmt.Fprintf(os.Stderr, "%v\n", x)
+		var last error
+		// Capture closes errCh once the command has exited
+		for err := range errCh {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			last = err
 		}
+		failed <- last
 	}()
+	raspicam.Capture(s, w, errCh)
+	return <-failed
+}
 
-	raspicam.Capture(s, f, errCh)
-
-	return path, nil
+// videoCommand returns the camera command, at reduced quality when storage is
+// low or the SoC is warm, and at minimum quality while it is throttling
+func (vehicle *Vehicle) videoCommand() *raspicam.Vid {
+	s := raspicam.NewVid()
+	switch thermal := vehicle.thermal.get(); {
+	case thermal >= thermalThrottled:
+		s.Args = append(s.Args, "-w", "960", "-h", "540", "-b", "2000000", "-fps", "15")
+	case thermal >= thermalWarm, vehicle.storage.get() >= storageLow:
+		s.Args = append(s.Args, "-w", "1280", "-h", "720", "-b", "4000000")
+	}
+	return s
 }
 
-// getFileHash returns the hash of a file located at path
+// getFileHash returns the hash of a file located at path. Encrypted evidence
+// files are hashed by their plaintext.
 func (vehicle *Vehicle) getFileHash(path string) ([]byte, error) {
 	// get file as a byte array
-	file, err := ioutil.ReadFile(path)
+	file, err := vehicle.readEvidence(path)
 	if err != nil {
 		return nil, err
 	}
@@ -339,25 +641,123 @@ func (vehicle *Vehicle) getFileHash(path string) ([]byte, error) {
 	return hash, nil
 }
 
-// secureHashOnChain writes the input hash to the Vehicle's chainID along with a
-// signature produced by the same entry credit private key used for payment
+// AnchorResult is the outcome of anchoring a hash
+type AnchorResult struct {
+	TxID      string // commit transaction, empty if Err is set
+	EntryHash string // hex hash of the entry, to look it up or fetch its receipt once confirmed
+	Err       error
+}
+
+// AnchorAsync writes the input hash to the Vehicle's chainID along with a
+// signature produced by the same entry credit private key used for payment.
+// It returns at once, the result is sent on the channel when the entry is
+// committed and the channel is then closed.
+func (vehicle *Vehicle) AnchorAsync(hash []byte) <-chan AnchorResult {
+	return vehicle.AnchorAsyncWithMeta(hash, nil)
+}
+
+// AnchorAsyncWithMeta anchors hash like AnchorAsync, with meta as described
+// by secureHashWithMeta
+func (vehicle *Vehicle) AnchorAsyncWithMeta(hash []byte, meta *HashMeta) <-chan AnchorResult {
+	results := make(chan AnchorResult, 1)
+	entry, err := vehicle.hashEntry(hash, meta)
+	if err != nil {
+		results <- AnchorResult{Err: err}
+		close(results)
+		return results
+	}
+	go func() {
+		defer close(results)
+		txID, err := vehicle.commitEntry(entry)
+		results <- AnchorResult{TxID: txID, EntryHash: hex.EncodeToString(entry.Hash()), Err: err}
+	}()
+	return results
+}
+
+// secureHashOnChain anchors hash like AnchorAsync and waits for the result
 func (vehicle *Vehicle) secureHashOnChain(hash []byte) (string, error) {
+	return vehicle.secureHashWithMeta(hash, nil)
+}
+
+// HashMeta describes how an anchored file was produced, e.g. its compression
+type HashMeta struct {
+	Stream      string `json:"stream,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Hashes      int    `json:"hashes,omitempty"`    // hashes in a batch entry's content, 0 for one hash
+	Driver      string `json:"driver,omitempty"`    // hex identity key of the driver assigned when recording started
+	DriverSig   string `json:"driverSig,omitempty"` // the driver's signature of the content and the rest of the metadata
+	Version     int    `json:"version,omitempty"`   // hashEntryVersion, none in entries written before versioning
+
+	// ClockUncertain marks hashes of data timestamped before the recorder's
+	// clock was synced or across a step of it
+	ClockUncertain bool `json:"clockUncertain,omitempty"`
+
+	// Fields is the hex root over the field trees of the telemetry segments
+	// hashed, for exports redacting some of their lines
+	Fields string `json:"fields,omitempty"`
+}
+
+// entryHashes returns the hashes anchored by a hash entry: its content, or the
+// SHA-256 hashes a batch entry's content lists
+func entryHashes(entry *factom.Entry) [][]byte {
+	if len(entry.ExtIDs) == 3 {
+		var meta HashMeta
+		if json.Unmarshal(entry.ExtIDs[2], &meta) == nil && meta.Hashes > 0 && meta.Hashes <= maxBatchHashes &&
+			len(entry.Content) == meta.Hashes*sha256.Size {
+			hashes := make([][]byte, meta.Hashes)
+			for i := range hashes {
+				hashes[i] = entry.Content[i*sha256.Size : (i+1)*sha256.Size]
+			}
+			return hashes
+		}
+	}
+	return [][]byte{entry.Content}
+}
+
+// secureHashWithMeta anchors hash like secureHashOnChain. If meta is not nil it
+// is written as a third ExtID and covered by the signature.
+// ExtIDs = [0]:signature of hash+meta, [1]:public key, [2]:JSON meta
+func (vehicle *Vehicle) secureHashWithMeta(hash []byte, meta *HashMeta) (string, error) {
+	result := <-vehicle.AnchorAsyncWithMeta(hash, meta)
+	return result.TxID, result.Err
+}
+
+// hashEntry builds the signed entry anchoring hash
+func (vehicle *Vehicle) hashEntry(hash []byte, meta *HashMeta) (*factom.Entry, error) {
+	signed := hash
+	var metaJSON []byte
+	if meta != nil {
+		versioned := *meta
+		versioned.Version = hashEntryVersion
+		meta = &versioned
+		if meta.Driver != "" {
+			countersigned := *meta
+			sig, err := vehicle.drivers.countersign(meta.Driver, driverSigned(hash, countersigned))
+			if err != nil {
+				fmt.Println("Anchoring without the driver's countersignature", err)
+				countersigned.Driver = ""
+			} else {
+				countersigned.DriverSig = hex.EncodeToString(sig)
+			}
+			meta = &countersigned
+		}
+		var err error
+		if metaJSON, err = json.Marshal(meta); err != nil {
+			return nil, err
+		}
+		signed = append(append([]byte(nil), hash...), metaJSON...)
+	}
 	// signature of the hash will be ExtIDs[0], used for later validation
-	signature := ed.Sign(vehicle.owner.ecAddress.Sec, hash)
+	signature := ed.Sign(vehicle.owner.ecAddress.Sec, signed)
 
 	entry := factom.Entry{}
 	entry.ChainID = vehicle.chainID
 	entry.ExtIDs = [][]byte{signature[:], vehicle.owner.ecAddress.PubBytes()}
-	entry.Content = []byte(hash)
-
-	txID, err := factom.CommitEntry(&entry, vehicle.owner.ecAddress)
-	if err != nil {
-		return "", err
-	}
-	if _, err := factom.RevealEntry(&entry); err != nil {
-		return "", err
+	if meta != nil {
+		entry.ExtIDs = append(entry.ExtIDs, metaJSON)
 	}
-	return txID, nil
+	entry.Content = []byte(hash)
+	return &entry, nil
 }
 
 // checkFileIntegrity returns true if the file located at filepath hashes
@@ -368,21 +768,16 @@ func (vehicle *Vehicle) checkFileIntegrity(filepath string, entryHash string) (b
 		return false, err
 	}
 
-	entry, err := factom.GetEntry(entryHash)
+	entry, err := vehicle.chain.entry(entryHash)
 	if err != nil {
 		return false, err
 	}
 
-	onChainHash := entry.Content
-	var signature [64]byte
-	copy(signature[:], entry.ExtIDs[0])
-
-	validSig := ed.Verify(vehicle.owner.ecAddress.Pub, onChainHash, &signature)
-	hashComparison := bytes.Compare(onDiskHash, onChainHash)
-	if !validSig || hashComparison != 0 {
-		return false, nil
+	matches, err := vehicle.entryMatchesHash(entry, onDiskHash)
+	if err != nil {
+		return false, fmt.Errorf("entry %s is malformed: %v", entryHash, err)
 	}
-	return true, nil
+	return matches, nil
 }
 
 // Program Entry Point
@@ -392,29 +787,140 @@ func init() {
 }
 
 func main() {
+	configPath := flag.String("config", "blackbox.json", "Path to the JSON config file")
+	serial := flag.String("serial", "", "Path to the OBD adapter's serial device, overriding the config")
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 && args[0] == "fleet-server" {
+		fleetServerCommand(args[1:])
+		return
+	}
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		panic(err)
+	}
+	if *serial != "" {
+		config.Serial = *serial
+	}
+	factomdTimeout = time.Duration(config.Timeouts.Factomd) * time.Second
+
 	// TODO: use proper key management
 	ecKey := "PRIVATE KEY HERE"
 	ecAddress, err := factom.GetECAddress(ecKey)
 	if err != nil {
 		panic(err)
 	}
-
-	vehicle := NewVehicle("1234567890ABCDEFH")
-	if txID, err := vehicle.Register(ecAddress); err != nil {
-		panic(err)
-	} else if txID == "" {
-		fmt.Printf("Vehicle already registered. ChainID: %s\n", vehicle.chainID)
-	} else {
-		fmt.Printf("Vehicle registered. TxID: %s\n", txID)
+	vin := config.VIN
+	if vin == autoVIN {
+		if vin, err = detectVIN(config.Serial); err != nil {
+			fmt.Println("Failed to detect the connected vehicle", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Connected to vehicle %s\n", vin)
+		if err := usePartition(vin); err != nil {
+			panic(err)
+		}
 	}
-
-	person := NewPerson(ecAddress)
-	if txID, err := person.Register(ecAddress); err != nil {
+	chain := factomdClient{}
+	vehicle, err := NewVehicle(vin, chain)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	person := NewPerson(ecAddress, chain)
+	if org, err := config.openOrganization(chain); err != nil {
 		panic(err)
-	} else if txID == "" {
-		fmt.Printf("Person already registered. ChainID: %s\n", person.chainID)
-	} else {
-		fmt.Printf("Person registered. TxID: %s\n", txID)
+	} else if org != nil {
+		// the organization signs and pays for the vehicle's entries
+		person, ecAddress = org.owner, org.ecAddress
 	}
 	vehicle.owner = person
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"record"}
+	}
+	switch args[0] {
+	case "record":
+		if err := recordCommand(vehicle, person, ecAddress, config); err != nil {
+			fmt.Println("Failed to start recording", err)
+			os.Exit(1)
+		}
+	case "export-gpx":
+		exportGPXCommand(vehicle, args[1:])
+	case "export-data":
+		exportDataCommand(vehicle, config, args[1:])
+	case "reveal-location":
+		revealLocationCommand(args[1:])
+	case "query":
+		queryCommand(vehicle, config, args[1:])
+	case "decrypt":
+		decryptCommand(vehicle, config, args[1:])
+	case "export-state":
+		exportStateCommand(vehicle, config, args[1:])
+	case "import-state":
+		importStateCommand(config, args[1:])
+	case "import-torque":
+		importTorqueCommand(vehicle, config, args[1:])
+	case "archive":
+		archiveCommand(vehicle, config, args[1:])
+	case "verify-archive":
+		verifyArchiveCommand(vehicle, config, args[1:])
+	case "lookup":
+		lookupCommand(args[1:])
+	case "usb-export":
+		usbExportCommand(vehicle, config, args[1:])
+	case "api-token":
+		apiTokenCommand(args[1:])
+	case "consent":
+		consentCommand(args[1:])
+	case "speed-proof":
+		speedProofCommand(vehicle, args[1:])
+	case "verify-redaction":
+		verifyRedactionCommand(vehicle, args[1:])
+	case "audience":
+		audienceCommand(vehicle, person, args[1:])
+	case "bench":
+		benchCommand(vehicle, args[1:])
+	case "selftest":
+		selftestCommand(vehicle, args[1:])
+	case "verify-audit":
+		verifyAuditCommand(vehicle, config, args[1:])
+	case "verify-access":
+		verifyAccessCommand(vehicle, config, args[1:])
+	case "debug":
+		debugCommand(config, args[1:])
+	case "org":
+		orgCommand(config, args[1:])
+	case "privacy":
+		privacyCommand(vehicle, config, args[1:])
+	case "driver":
+		driverCommand(args[1:])
+	case "edr":
+		edrCommand(vehicle, args[1:])
+	case "research":
+		researchCommand(config, args[1:])
+	case "claim":
+		claimCommand(vehicle, config, args[1:])
+	case "policy":
+		policyCommand(vehicle, config, args[1:])
+	case "warranty":
+		warrantyCommand(vehicle, config, args[1:])
+	case "odometer":
+		odometerCommand(vehicle, config, args[1:])
+	case "mileage":
+		mileageCommand(vehicle, args[1:])
+	case "hos":
+		hosCommand(vehicle, config, args[1:])
+	case "ifta":
+		iftaCommand(vehicle, config, args[1:])
+	case "lease":
+		leaseCommand(vehicle, args[1:])
+	case "credential":
+		credentialCommand(vehicle, config, args[1:])
+	case "did":
+		didCommand(vehicle, person, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"tinygo.org/x/bluetooth"
+)
+
+// BLEConfig enables the Bluetooth LE companion service used by the phone app.
+// Phones pair by presenting the PIN printed on the device; after that every
+// command they send must be signed with the key they paired with.
+type BLEConfig struct {
+	Name string `json:"name"` // advertised name, default "Blackbox <last 6 of VIN>"
+	PIN  string `json:"pin"`  // pairing PIN
+}
+
+// pairedPhonesPath holds the phones allowed to send commands
+const pairedPhonesPath = "phones.json"
+
+// BLE companion protocol settings
+const (
+	bleStatusInterval   = 5 * time.Second // how often the status characteristic is refreshed
+	bleCommandMaxAge    = time.Minute     // older signed commands are rejected as replays
+	blePairingAttempts  = 5               // wrong PINs allowed before pairing locks
+	blePairingLockout   = 5 * time.Minute // how long pairing stays locked
+	bleMaxNotifyPayload = 180             // fits the default ATT MTU negotiated by most phones
+)
+
+// GATT layout of the companion service. Every value is JSON.
+//
+//	status    read, notify  compact Status, refreshed every bleStatusInterval
+//	alerts    notify        each new Alert, including crash notifications
+//	pair      write         PairRequest
+//	command   write         SignedCommand
+//	response  notify        CommandResponse to the last pair or command write
+var (
+	bleServiceUUID  = mustParseUUID("6b1a0001-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+	bleStatusUUID   = mustParseUUID("6b1a0002-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+	bleAlertsUUID   = mustParseUUID("6b1a0003-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+	blePairUUID     = mustParseUUID("6b1a0004-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+	bleCommandUUID  = mustParseUUID("6b1a0005-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+	bleResponseUUID = mustParseUUID("6b1a0006-8f5c-4a8e-9f3b-1d2c3e4f5a60")
+)
+
+func mustParseUUID(s string) bluetooth.UUID {
+	uuid, err := bluetooth.ParseUUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return uuid
+}
+
+// PairedPhone is a phone allowed to send commands
+type PairedPhone struct {
+	Name   string    `json:"name"`
+	Key    string    `json:"key"` // hex ed25519 public key
+	Paired time.Time `json:"paired"`
+}
+
+// PairRequest is written by a phone to pair with the device
+type PairRequest struct {
+	PIN  string `json:"pin"`
+	Key  string `json:"key"` // hex ed25519 public key the phone signs commands with
+	Name string `json:"name"`
+}
+
+// SignedCommand is written by a paired phone. Sig is the phone's signature of
+// the Command bytes exactly as sent.
+type SignedCommand struct {
+	Command json.RawMessage `json:"command"`
+	Key     string          `json:"key"`
+	Sig     string          `json:"sig"`
+}
+
+// PhoneCommand asks the device to act:
+//
+//	driver       identify the driver of the vehicle from now on, assigning the
+//	             driver whose phone it is if it is a registered driver's
+//	export       export the last Hours of evidence to the inserted USB stick
+//	pause        pause OBD recording
+//	resume       resume OBD recording
+//	tag-trip     tag the trip starting at Trip with Purpose and Note
+//	duty-status  set the driver's hours-of-service Status, with Note
+//	duty-edit    change the duty status recorded at Record to Status, Note
+//	             giving the reason
+type PhoneCommand struct {
+	Command string    `json:"command"`
+	Driver  string    `json:"driver,omitempty"`
+	Hours   int       `json:"hours,omitempty"`
+	Trip    time.Time `json:"trip,omitempty"` // start of the trip to tag
+	Purpose string    `json:"purpose,omitempty"`
+	Note    string    `json:"note,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Record  time.Time `json:"record,omitempty"`
+	Time    time.Time `json:"time"` // when the phone signed the command
+}
+
+// CommandResponse is notified after every pair or command write
+type CommandResponse struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bleStatus is the compact status that fits in one notification
+type bleStatus struct {
+	Recording      bool   `json:"rec"`
+	Storage        string `json:"storage"`
+	PendingAnchors int    `json:"pending"`
+	TimeConfidence string `json:"time"`
+	Alerts         int    `json:"alerts"`
+}
+
+// bleService serves the companion protocol for a vehicle
+type bleService struct {
+	vehicle *Vehicle
+	config  *BLEConfig
+
+	status, alerts, response bluetooth.Characteristic
+
+	mu             sync.Mutex
+	phones         []PairedPhone
+	failedAttempts int
+	lockedUntil    time.Time
+}
+
+// loadPairedPhones returns the paired phones, none if nothing was ever paired
+func loadPairedPhones() ([]PairedPhone, error) {
+	data, err := ioutil.ReadFile(pairedPhonesPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var phones []PairedPhone
+	return phones, json.Unmarshal(data, &phones)
+}
+
+// StartBLE advertises the companion service. Its status and alerts are kept
+// current by the returned service's notifyLoop.
+func (vehicle *Vehicle) StartBLE(config *BLEConfig) (*bleService, error) {
+	if config.PIN == "" {
+		return nil, fmt.Errorf("ble: a pairing PIN is required")
+	}
+	phones, err := loadPairedPhones()
+	if err != nil {
+		return nil, err
+	}
+	s := &bleService{vehicle: vehicle, config: config, phones: phones}
+
+	adapter := bluetooth.DefaultAdapter
+	if err := adapter.Enable(); err != nil {
+		return nil, err
+	}
+	err = adapter.AddService(&bluetooth.Service{
+		UUID: bleServiceUUID,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{Handle: &s.status, UUID: bleStatusUUID, Value: s.statusValue(),
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission},
+			{Handle: &s.alerts, UUID: bleAlertsUUID,
+				Flags: bluetooth.CharacteristicNotifyPermission},
+			{UUID: blePairUUID, WriteEvent: s.handlePair,
+				Flags: bluetooth.CharacteristicWritePermission},
+			{UUID: bleCommandUUID, WriteEvent: s.handleCommand,
+				Flags: bluetooth.CharacteristicWritePermission},
+			{Handle: &s.response, UUID: bleResponseUUID,
+				Flags: bluetooth.CharacteristicNotifyPermission},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.Name
+	if name == "" {
+		name = "Blackbox " + vehicle.vin[len(vehicle.vin)-6:]
+	}
+	adv := adapter.DefaultAdvertisement()
+	if err := adv.Configure(bluetooth.AdvertisementOptions{LocalName: name, ServiceUUIDs: []bluetooth.UUID{bleServiceUUID}}); err != nil {
+		return nil, err
+	}
+	if err := adv.Start(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("BLE companion service advertising as %q\n", name)
+	return s, nil
+}
+
+// notifyLoop refreshes the status and forwards new alerts to subscribed phones
+// until stop is closed
+func (s *bleService) notifyLoop(stop <-chan struct{}) error {
+	var lastAlert time.Time
+	for _, alert := range s.vehicle.alerts.recent() {
+		lastAlert = alert.Time
+	}
+	ticker := time.NewTicker(bleStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		if _, err := s.status.Write(s.statusValue()); err != nil {
+			return err
+		}
+		for _, alert := range s.vehicle.alerts.recent() {
+			if !alert.Time.After(lastAlert) {
+				continue
+			}
+			lastAlert = alert.Time
+			if _, err := s.alerts.Write(bleValue(alert)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// statusValue encodes the part of the status phones are shown, read without
+// the rest of it, e.g. the position
+func (s *bleService) statusValue() []byte {
+	vehicle := s.vehicle
+	_, confidence := vehicle.clock.status()
+	status := bleStatus{
+		Recording:      !vehicle.recorder.isPaused(),
+		Storage:        storageLevelNames[vehicle.storage.get()],
+		TimeConfidence: confidence,
+		Alerts:         len(vehicle.alerts.recent()),
+	}
+	if vehicle.anchors != nil {
+		status.PendingAnchors = vehicle.anchors.size()
+	}
+	return bleValue(status)
+}
+
+// bleValue encodes v for a characteristic, cutting long alert messages to fit
+func bleValue(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	if alert, ok := v.(Alert); ok && len(data) > bleMaxNotifyPayload {
+		cut := len(alert.Message) - (len(data) - bleMaxNotifyPayload) - 3
+		if cut < 0 {
+			cut = 0
+		}
+		alert.Message = alert.Message[:cut] + "..."
+		data, _ = json.Marshal(alert)
+	}
+	return data
+}
+
+func (s *bleService) respond(command string, err error) {
+	response := CommandResponse{Command: command, OK: err == nil}
+	if err != nil {
+		response.Error = err.Error()
+		fmt.Printf("BLE %s rejected: %v\n", command, err)
+	}
+	if _, err := s.response.Write(bleValue(response)); err != nil {
+		fmt.Println("Failed to notify BLE response", err)
+	}
+}
+
+// handlePair pairs the phone presenting the right PIN. Too many wrong PINs
+// lock pairing for a while.
+func (s *bleService) handlePair(client bluetooth.Connection, offset int, value []byte) {
+	s.respond("pair", s.pair(value))
+}
+
+func (s *bleService) pair(value []byte) error {
+	var req PairRequest
+	if err := json.Unmarshal(value, &req); err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(req.Key)
+	if err != nil || len(key) != ed.PublicKeySize {
+		return fmt.Errorf("key must be a hex ed25519 public key")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.lockedUntil) {
+		return fmt.Errorf("pairing locked until %s", s.lockedUntil.Format(time.Kitchen))
+	}
+	if req.PIN != s.config.PIN {
+		s.failedAttempts++
+		if s.failedAttempts >= blePairingAttempts {
+			s.failedAttempts = 0
+			s.lockedUntil = time.Now().Add(blePairingLockout)
+			appendAudit("ble-pairing-locked", map[string]interface{}{"name": req.Name})
+		}
+		return fmt.Errorf("wrong PIN")
+	}
+	s.failedAttempts = 0
+
+	phones := []PairedPhone{{Name: req.Name, Key: hex.EncodeToString(key), Paired: time.Now().UTC()}}
+	for _, phone := range s.phones {
+		if phone.Key != phones[0].Key {
+			phones = append(phones, phone)
+		}
+	}
+	if err := writeSynced(pairedPhonesPath, phones); err != nil {
+		return err
+	}
+	s.phones = phones
+	appendAudit("ble-paired", map[string]interface{}{"name": req.Name, "key": phones[0].Key})
+	return nil
+}
+
+// paired returns the paired phone with the hex key, or nil
+func (s *bleService) paired(key string) *PairedPhone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.phones {
+		if s.phones[i].Key == key {
+			phone := s.phones[i]
+			return &phone
+		}
+	}
+	return nil
+}
+
+// handleCommand runs a command signed by a paired phone
+func (s *bleService) handleCommand(client bluetooth.Connection, offset int, value []byte) {
+	command, phone, err := s.verifyCommand(value)
+	if err != nil {
+		s.respond("command", err)
+		return
+	}
+	s.respond(command.Command, s.run(command, phone))
+}
+
+// verifyCommand checks that value is a fresh command signed by a paired phone
+func (s *bleService) verifyCommand(value []byte) (*PhoneCommand, *PairedPhone, error) {
+	var signed SignedCommand
+	if err := json.Unmarshal(value, &signed); err != nil {
+		return nil, nil, err
+	}
+	phone := s.paired(signed.Key)
+	if phone == nil {
+		return nil, nil, fmt.Errorf("phone is not paired")
+	}
+	var key [ed.PublicKeySize]byte
+	var sig [ed.SignatureSize]byte
+	keyBytes, _ := hex.DecodeString(phone.Key)
+	sigBytes, err := hex.DecodeString(signed.Sig)
+	if err != nil || len(sigBytes) != len(sig) {
+		return nil, nil, fmt.Errorf("malformed signature")
+	}
+	copy(key[:], keyBytes)
+	copy(sig[:], sigBytes)
+	if !ed.Verify(&key, signed.Command, &sig) {
+		return nil, nil, fmt.Errorf("bad signature")
+	}
+
+	command := new(PhoneCommand)
+	if err := json.Unmarshal(signed.Command, command); err != nil {
+		return nil, nil, err
+	}
+	if age := time.Since(command.Time); age > bleCommandMaxAge || age < -bleCommandMaxAge {
+		return nil, nil, fmt.Errorf("command is stale, check the phone's clock")
+	}
+	return command, phone, nil
+}
+
+func (s *bleService) run(command *PhoneCommand, phone *PairedPhone) error {
+	vehicle := s.vehicle
+	details := map[string]interface{}{"via": "ble", "phone": phone.Name}
+	switch command.Command {
+	case "driver":
+		// a registered driver's own phone assigns them, countersigning their trips
+		if _, _, err := vehicle.AssignDriver(DriverAuthBLE, "", phone.Key, details); err == nil {
+			return nil
+		}
+		if command.Driver == "" {
+			return fmt.Errorf("driver required")
+		}
+		appendAudit("driver-identified", map[string]interface{}{"driver": command.Driver, "phone": phone.Name})
+		data := map[string]interface{}{"driver": command.Driver, "phone": phone.Key}
+		if _, err := vehicle.LogEvent(vehicle.NewEvent("driver", data), true); err != nil {
+			return err
+		}
+	case "export":
+		hours := command.Hours
+		if hours <= 0 {
+			hours = defaultExportHours
+		}
+		appendAudit("ble-export", details)
+		go vehicle.exportToUSB(hours, map[string]interface{}{"via": "ble", "phone": phone.Name}) // progress arrives as alerts
+	case "pause", "resume":
+		vehicle.setRecording(command.Command == "resume", details)
+	case "tag-trip":
+		if _, err := vehicle.TagTrip(command.Trip, command.Purpose, command.Note); err != nil {
+			return err
+		}
+		details["trip"], details["purpose"] = command.Trip, command.Purpose
+		appendAudit("trip-tagged", details)
+	case "duty-status", "duty-edit":
+		if vehicle.hos == nil {
+			return fmt.Errorf("hours-of-service mode is off")
+		}
+		var err error
+		if command.Command == "duty-status" {
+			_, err = vehicle.hos.SetStatus(vehicle, command.Status, command.Note)
+		} else {
+			_, err = vehicle.hos.Edit(vehicle, command.Record, command.Status, command.Note, hosEditor(details))
+		}
+		if err != nil {
+			return err
+		}
+		details["status"] = command.Status
+		appendAudit(command.Command, details)
+	default:
+		return fmt.Errorf("unknown command %q", command.Command)
+	}
+	return nil
+}
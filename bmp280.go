@@ -0,0 +1,95 @@
+package main
+
+// BMP280 registers
+const (
+	bmpCalibration = 0x88
+	bmpCtrlMeas    = 0xF4
+	bmpConfig      = 0xF5
+	bmpPressMSB    = 0xF7
+	bmpNormalMode  = 0x27 // temperature x1, pressure x1 oversampling, normal mode
+	bmpStandby     = 0xA0 // 1000ms standby, filter off
+)
+
+// EnvironmentConfig selects the I2C barometer/temperature sensor
+type EnvironmentConfig struct {
+	Device  string `json:"device"`  // I2C bus, e.g. /dev/i2c-1
+	Address int    `json:"address"` // 0x76 or 0x77
+}
+
+// BMP280 is a Bosch BMP280 barometric pressure and temperature sensor
+type BMP280 struct {
+	dev *i2cDevice
+	t1  float64
+	t2  float64
+	t3  float64
+	p   [9]float64 // dig_P1..dig_P9
+}
+
+// OpenBMP280 configures the sensor at addr on the I2C bus at path for continuous
+// measurement and reads its factory calibration
+func OpenBMP280(path string, addr int) (*BMP280, error) {
+	dev, err := openI2C(path, addr)
+	if err != nil {
+		return nil, err
+	}
+	var cal [24]byte
+	if err := dev.readRegs(bmpCalibration, cal[:]); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.writeReg(bmpConfig, bmpStandby); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.writeReg(bmpCtrlMeas, bmpNormalMode); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	// calibration words are little endian, dig_T1 and dig_P1 unsigned
+	unsigned := func(i int) float64 { return float64(uint16(cal[i]) | uint16(cal[i+1])<<8) }
+	signed := func(i int) float64 { return float64(int16(uint16(cal[i]) | uint16(cal[i+1])<<8)) }
+	bmp := &BMP280{dev: dev, t1: unsigned(0), t2: signed(2), t3: signed(4)}
+	bmp.p[0] = unsigned(6)
+	for i := 1; i < 9; i++ {
+		bmp.p[i] = signed(6 + i*2)
+	}
+	return bmp, nil
+}
+
+// Read returns the temperature in C and pressure in hPa, using the floating
+// point compensation formulas from the BMP280 datasheet
+func (bmp *BMP280) Read() (temperature, pressure float64, err error) {
+	var buf [6]byte
+	if err := bmp.dev.readRegs(bmpPressMSB, buf[:]); err != nil {
+		return 0, 0, err
+	}
+	adcP := float64(uint32(buf[0])<<12 | uint32(buf[1])<<4 | uint32(buf[2])>>4)
+	adcT := float64(uint32(buf[3])<<12 | uint32(buf[4])<<4 | uint32(buf[5])>>4)
+
+	v1 := (adcT/16384 - bmp.t1/1024) * bmp.t2
+	v2 := (adcT/131072 - bmp.t1/8192) * (adcT/131072 - bmp.t1/8192) * bmp.t3
+	tFine := v1 + v2
+	temperature = tFine / 5120
+
+	p := bmp.p
+	v1 = tFine/2 - 64000
+	v2 = v1 * v1 * p[5] / 32768
+	v2 = v2 + v1*p[4]*2
+	v2 = v2/4 + p[3]*65536
+	v1 = (p[2]*v1*v1/524288 + p[1]*v1) / 524288
+	v1 = (1 + v1/32768) * p[0]
+	if v1 == 0 {
+		return temperature, 0, nil // avoid division by zero on a bad calibration
+	}
+	pa := 1048576 - adcP
+	pa = (pa - v2/4096) * 6250 / v1
+	v1 = p[8] * pa * pa / 2147483648
+	v2 = pa * p[7] / 32768
+	pa = pa + (v1+v2+p[6])/16
+	return temperature, pa / 100, nil
+}
+
+func (bmp *BMP280) Close() error {
+	return bmp.dev.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// objectsDir holds evidence files named by the SHA-256 anchored on chain:
+// objects/<first two hex digits>/<hex hash>, plus encryptedExt if encrypted
+const objectsDir = "objects"
+
+// objectPath returns where the file with the given hex hash is stored
+func (vehicle *Vehicle) objectPath(hash string) string {
+	path := filepath.Join(objectsDir, hash[:2], hash)
+	if vehicle.key != nil {
+		path += encryptedExt
+	}
+	return path
+}
+
+// findObject returns the stored file whose plaintext hashes to hash, checking
+// both the plain and encrypted names
+func findObject(hash []byte) (string, bool) {
+	name := hex.EncodeToString(hash)
+	path := filepath.Join(objectsDir, name[:2], name)
+	for _, candidate := range []string{path, path + encryptedExt} {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// putObject stores data under its hash, encrypted if the vehicle has a device
+// key. Identical data is only stored once. It returns the hash and the path.
+func (vehicle *Vehicle) putObject(data []byte) ([]byte, string, error) {
+	sum := sha256.Sum256(data)
+	path := vehicle.objectPath(hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(path); err == nil {
+		return sum[:], path, nil // already stored
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, "", err
+	}
+	if vehicle.key != nil {
+		sealed, err := vehicle.key.seal(data)
+		if err != nil {
+			return nil, "", err
+		}
+		data = sealed
+	}
+	if err := writeAtomic(path, data); err != nil {
+		return nil, "", err
+	}
+	return sum[:], path, nil
+}
+
+// moveToObjects stores the file at path as an object and removes the original
+func (vehicle *Vehicle) moveToObjects(path string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	hash, object, err := vehicle.putObject(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return hash, object, os.Remove(path)
+}
+
+// renameToObject stores the file at path, whose plaintext hashes to hash, as
+// an object by renaming it, so a file hashed while it was written is never
+// read back. Encrypted objects are sealed whole, so their file is read, as is
+// one on another filesystem than the objects.
+func (vehicle *Vehicle) renameToObject(path string, hash []byte) (string, error) {
+	if vehicle.key != nil {
+		_, object, err := vehicle.moveToObjects(path)
+		return object, err
+	}
+	object := vehicle.objectPath(hex.EncodeToString(hash))
+	if _, err := os.Stat(object); err == nil {
+		return object, os.Remove(path) // already stored
+	}
+	if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, object); err != nil {
+		_, object, err = vehicle.moveToObjects(path)
+		return object, err
+	}
+	return object, syncDir(filepath.Dir(object))
+}
+
+// segmentExt returns the file extension matching a segment's content, objects
+// themselves are stored without one
+func segmentExt(segment *Segment) string {
+	switch segment.Stream {
+	case "obd":
+		return ".txt" + compressionExt[segment.Compression]
+	case "video":
+		return ".h264"
+	case torqueStream:
+		return ".txt"
+	}
+	return ""
+}
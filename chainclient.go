@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// ChainClient is the Factom API persons, vehicles and organizations read and
+// write their chains through: factomdClient on the network, or memoryChain
+// to run without factomd
+type ChainClient interface {
+	chainReader
+	commitChain(chain *factom.Chain, ecAddress *factom.ECAddress) (string, error)
+	revealChain(chain *factom.Chain) (string, error)
+	commitEntry(entry *factom.Entry, ecAddress *factom.ECAddress) (string, error)
+	revealEntry(entry *factom.Entry) (string, error)
+	receipt(entryHash string) (*factom.Receipt, error)
+	ecBalance(address string) (int64, error)
+
+	// chainState reports whether chainID is on chain or waiting for its
+	// block, ChainAbsent if the client doesn't know it
+	chainState(chainID string) (ChainState, error)
+
+	// commitAck reports whether the commit txID was accepted, and whether its
+	// reveal was too
+	commitAck(txID string) (committed, revealed bool, err error)
+}
+
+// memoryECBalance is the balance memoryChain reports for every address.
+// Commits to it are free.
+const memoryECBalance = 1000000
+
+// errNoReceipts is returned for receipts by memoryChain, which has no
+// directory blocks to prove entries against
+var errNoReceipts = errors.New("receipts are not available without factomd")
+
+// memoryChain is a ChainClient keeping chains in memory. A revealed entry is
+// confirmed at once, in an entry block of its own.
+type memoryChain struct {
+	mu      sync.Mutex
+	commits map[string]string        // committed entry hash → txID, until revealed
+	acks    map[string]bool          // txID → whether its entry was revealed
+	entries map[string]*factom.Entry // by entry hash
+	blocks  map[string]*factom.EBlock
+	heads   map[string]string // chain ID → KeyMR of its latest entry block
+	height  int64             // directory block height given to the next entry block
+}
+
+// newMemoryChain returns an empty memoryChain
+func newMemoryChain() *memoryChain {
+	return &memoryChain{
+		commits: make(map[string]string),
+		acks:    make(map[string]bool),
+		entries: make(map[string]*factom.Entry),
+		blocks:  make(map[string]*factom.EBlock),
+		heads:   make(map[string]string),
+	}
+}
+
+// commit records the commit of the entry with the given hash and returns its txID
+func (m *memoryChain) commit(entryHash string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum := sha256.Sum256([]byte(entryHash + strconv.Itoa(len(m.acks))))
+	txID := hex.EncodeToString(sum[:])
+	m.commits[entryHash] = txID
+	m.acks[txID] = false
+	return txID
+}
+
+// reveal appends entry to its chain, newChain creating it, and returns its hash
+func (m *memoryChain) reveal(entry *factom.Entry, newChain bool) (string, error) {
+	entryHash := hex.EncodeToString(entry.Hash())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txID, ok := m.commits[entryHash]
+	if !ok {
+		return "", fmt.Errorf("entry %s was not committed", entryHash)
+	}
+	prev, exists := m.heads[entry.ChainID]
+	if newChain && exists {
+		return "", fmt.Errorf("chain %s already exists", entry.ChainID)
+	} else if !newChain && !exists {
+		return "", fmt.Errorf("chain %s not found", entry.ChainID)
+	}
+	delete(m.commits, entryHash)
+	m.acks[txID] = true
+
+	now := time.Now().Unix()
+	eblock := new(factom.EBlock)
+	eblock.Header.ChainID = entry.ChainID
+	eblock.Header.PrevKeyMR = prev
+	eblock.Header.Timestamp = now
+	eblock.Header.DBHeight = m.height
+	eblock.EntryList = []factom.EBEntry{{EntryHash: entryHash, Timestamp: now}}
+	if prev != "" {
+		eblock.Header.BlockSequenceNumber = m.blocks[prev].Header.BlockSequenceNumber + 1
+	}
+	sum := sha256.Sum256([]byte(prev + entryHash))
+	keyMR := hex.EncodeToString(sum[:])
+	m.blocks[keyMR] = eblock
+	m.heads[entry.ChainID] = keyMR
+	m.entries[entryHash] = entry
+	m.height++
+	return entryHash, nil
+}
+
+func (m *memoryChain) commitChain(chain *factom.Chain, ecAddress *factom.ECAddress) (string, error) {
+	return m.commit(hex.EncodeToString(chain.FirstEntry.Hash())), nil
+}
+
+func (m *memoryChain) revealChain(chain *factom.Chain) (string, error) {
+	return m.reveal(chain.FirstEntry, true)
+}
+
+func (m *memoryChain) commitEntry(entry *factom.Entry, ecAddress *factom.ECAddress) (string, error) {
+	return m.commit(hex.EncodeToString(entry.Hash())), nil
+}
+
+func (m *memoryChain) revealEntry(entry *factom.Entry) (string, error) {
+	return m.reveal(entry, false)
+}
+
+func (m *memoryChain) chainHead(chainID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keyMR, ok := m.heads[chainID]
+	if !ok {
+		return "", fmt.Errorf("missing chain head for %s", chainID)
+	}
+	return keyMR, nil
+}
+
+func (m *memoryChain) entryBlock(keyMR string) (*factom.EBlock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	eblock, ok := m.blocks[keyMR]
+	if !ok {
+		return nil, fmt.Errorf("entry block %s not found", keyMR)
+	}
+	return eblock, nil
+}
+
+func (m *memoryChain) entry(entryHash string) (*factom.Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[entryHash]
+	if !ok {
+		return nil, fmt.Errorf("entry %s not found", entryHash)
+	}
+	return entry, nil
+}
+
+func (m *memoryChain) receipt(entryHash string) (*factom.Receipt, error) {
+	return nil, errNoReceipts
+}
+
+func (m *memoryChain) ecBalance(address string) (int64, error) {
+	return memoryECBalance, nil
+}
+
+func (m *memoryChain) chainState(chainID string) (ChainState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.heads[chainID]; ok {
+		return ChainConfirmed, nil
+	}
+	return ChainAbsent, nil
+}
+
+func (m *memoryChain) commitAck(txID string) (committed, revealed bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revealed, committed = m.acks[txID]
+	return committed, revealed, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+	bolt "go.etcd.io/bbolt"
+)
+
+// chainIndexInterval is how often the vehicle's chain is synced into the local index
+const chainIndexInterval = 10 * time.Minute
+
+// Kinds of indexed entries
+const (
+	EntryKindHash  = "hash"  // hash of a segment or file, ExtIDs [sig, key] or [sig, key, meta], or a batch of hashes
+	EntryKindEvent = "event" // signed event, ExtIDs [sig, key, "event", type]
+	EntryKindOther = "other" // anything else, e.g. the chain's first entry
+)
+
+// IndexedEntry is an entry of a vehicle's chain as kept in the local index
+type IndexedEntry struct {
+	EntryHash       string          `json:"entryHash"`
+	BlockHeight     int64           `json:"blockHeight"`
+	BlockTime       time.Time       `json:"blockTime"`
+	EntryBlockKeyMR string          `json:"entryBlockKeyMR"`
+	EntrySequence   int64           `json:"entrySequence"`
+	EntryPosition   int             `json:"entryPosition"`
+	Kind            string          `json:"kind"`
+	EventType       string          `json:"eventType,omitempty"`
+	Stream          string          `json:"stream,omitempty"` // for hash entries anchored with metadata
+	Hash            string          `json:"hash,omitempty"`   // hex, for hash entries
+	Hashes          []string        `json:"hashes,omitempty"` // hex, for batch entries instead of Hash
+	Event           json.RawMessage `json:"event,omitempty"`  // for event entries
+	SigningKey      string          `json:"signingKey,omitempty"`
+	Verified        bool            `json:"verified"`      // the signature is valid for SigningKey
+	SignedByOwner   bool            `json:"signedByOwner"` // SigningKey is the current owner's
+	// identity key of the driver countersigning a hash entry, and whether their signature is valid
+	Driver         string `json:"driver,omitempty"`
+	DriverVerified bool   `json:"driverVerified,omitempty"`
+	// hash entries of data timestamped while the recorder's clock was uncertain
+	ClockUncertain bool `json:"clockUncertain,omitempty"`
+}
+
+// key orders indexed entries by block time, then by position on chain
+func (e *IndexedEntry) key() []byte {
+	key := make([]byte, 16)
+	copy(key, timeKey(e.BlockTime))
+	binary.BigEndian.PutUint32(key[8:], uint32(e.EntrySequence))
+	binary.BigEndian.PutUint32(key[12:], uint32(e.EntryPosition))
+	return key
+}
+
+// indexEntry classifies entry and checks its signature
+func (vehicle *Vehicle) indexEntry(entry *factom.Entry) *IndexedEntry {
+	indexed := &IndexedEntry{Kind: EntryKindOther}
+	if entrySize(entry) > maxEntrySize {
+		return indexed
+	}
+	ext := entry.ExtIDs
+	var signed []byte
+	switch {
+	case len(ext) == 4 && string(ext[2]) == "event":
+		indexed.Kind = EntryKindEvent
+		indexed.EventType = string(ext[3])
+		if json.Valid(entry.Content) {
+			indexed.Event = entry.Content
+		}
+		signed = entry.Content
+	case len(ext) == 2 || len(ext) == 3:
+		fields, err := parseHashEntry(entry)
+		if err != nil {
+			// the chain's first entry, or spam shaped like a hash entry that
+			// mustn't show up in searches as one
+			return indexed
+		}
+		indexed.Kind = EntryKindHash
+		if meta := fields.meta; meta != nil {
+			indexed.Stream = meta.Stream
+			indexed.Driver = meta.Driver
+			indexed.ClockUncertain = meta.ClockUncertain
+			indexed.DriverVerified = meta.Driver != "" && verifyDriverSig(meta.Driver, meta.DriverSig, driverSigned(entry.Content, *meta))
+		}
+		if fields.meta != nil && fields.meta.Hashes > 0 {
+			for _, hash := range fields.hashes {
+				indexed.Hashes = append(indexed.Hashes, hex.EncodeToString(hash))
+			}
+		} else {
+			indexed.Hash = hex.EncodeToString(entry.Content)
+		}
+		signed = fields.signed
+	default:
+		return indexed
+	}
+	if len(ext[0]) != ed.SignatureSize || len(ext[1]) != ed.PublicKeySize {
+		return indexed
+	}
+	var key [ed.PublicKeySize]byte
+	var signature [ed.SignatureSize]byte
+	copy(key[:], ext[1])
+	copy(signature[:], ext[0])
+	indexed.SigningKey = hex.EncodeToString(key[:])
+	indexed.Verified = ed.Verify(&key, signed, &signature)
+	indexed.SignedByOwner = vehicle.owner != nil && bytes.Equal(key[:], vehicle.owner.ecAddress.PubBytes())
+	return indexed
+}
+
+// SyncChainIndex adds the entries written to vin's chain since the last sync to
+// the local index and returns how many were added
+func (vehicle *Vehicle) SyncChainIndex(reader chainReader, vin string) (int, error) {
+	var known string
+	err := vehicle.store.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, chainHeadBucket)
+		if b != nil {
+			known = string(b.Get(chainHeadKey))
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	head, err := reader.chainHead(vehicleChainID(vin))
+	if err != nil {
+		return 0, err
+	}
+	var entries []*IndexedEntry
+	walked := make(map[string]bool)
+	for keyMR := head; keyMR != "" && keyMR != zeroHash && keyMR != known; {
+		if walked[keyMR] {
+			return 0, fmt.Errorf("entry block %s links back to itself", keyMR)
+		}
+		walked[keyMR] = true
+		eblock, err := reader.entryBlock(keyMR)
+		if err != nil {
+			return 0, err
+		} else if eblock == nil {
+			return 0, fmt.Errorf("entry block %s not found", keyMR)
+		}
+		for i, ebEntry := range eblock.EntryList {
+			entry, err := reader.entry(ebEntry.EntryHash)
+			if err != nil {
+				return 0, err
+			} else if entry == nil {
+				return 0, fmt.Errorf("entry %s not found", ebEntry.EntryHash)
+			}
+			indexed := vehicle.indexEntry(entry)
+			indexed.EntryHash = ebEntry.EntryHash
+			indexed.BlockHeight = eblock.Header.DBHeight
+			indexed.BlockTime = time.Unix(eblock.Header.Timestamp, 0).UTC()
+			indexed.EntryBlockKeyMR = keyMR
+			indexed.EntrySequence = eblock.Header.BlockSequenceNumber
+			indexed.EntryPosition = i
+			entries = append(entries, indexed)
+		}
+		keyMR = eblock.Header.PrevKeyMR
+	}
+	if head == known {
+		return 0, nil
+	}
+
+	err = vehicle.store.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, chainBucket)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(entry.key(), value); err != nil {
+				return err
+			}
+		}
+		meta, err := bucket(tx, vin, chainHeadBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(chainHeadKey, []byte(head))
+	})
+	return len(entries), err
+}
+
+// ChainEntries returns the indexed entries of vin's chain in blocks between
+// start and end, inclusive, oldest first, that match filter
+func (s *Store) ChainEntries(vin string, start, end time.Time, filter func(*IndexedEntry) bool) ([]*IndexedEntry, error) {
+	var entries []*IndexedEntry
+	min := timeKey(start)
+	max := append(timeKey(end), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, chainBucket)
+		if err != nil || b == nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			entry := new(IndexedEntry)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			if filter == nil || filter(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// RunChainIndex keeps the vehicle's chain index up to date until stop is closed
+func (vehicle *Vehicle) RunChainIndex(stop <-chan struct{}) error {
+	for {
+		if n, err := vehicle.SyncChainIndex(vehicle.chain, vehicle.vin); err != nil {
+			fmt.Println("Failed to sync chain index", err)
+		} else if n > 0 {
+			fmt.Printf("Indexed %d new chain entries\n", n)
+		}
+		if !sleep(chainIndexInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// handleEntries answers queries over the chain index:
+//
+//	GET /entries?vin=&from=&to=&kind=&type=&stream=&sync=1
+//	GET /entries/incidents   anchored incident records
+//	GET /entries/transfers   ownership transfer events
+//
+// vin defaults to the vehicle's, from and to are RFC3339 and default to all
+// time. sync=1 syncs the index with the chain before answering.
+func (vehicle *Vehicle) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	vin := query.Get("vin")
+	if vin == "" {
+		vin = vehicle.vin
+	} else if err := ValidateVIN(vin); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/entries") {
+	case "":
+	case "/incidents":
+		query.Set("kind", EntryKindHash)
+		query.Set("stream", incidentStream)
+	case "/transfers":
+		query.Set("kind", EntryKindEvent)
+		query.Set("type", "transfer")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	start, end, filter, err := parseEntryQuery(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if query.Get("sync") == "1" {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, vin); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+	entries, err := vehicle.store.ChainEntries(vin, start, end, filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []*IndexedEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// parseEntryQuery reads the from, to, kind, type and stream parameters of a
+// chain index query. from and to are RFC3339 and default to all time.
+func parseEntryQuery(query url.Values) (start, end time.Time, filter func(*IndexedEntry) bool, err error) {
+	end = time.Now()
+	if from := query.Get("from"); from != "" {
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			return
+		}
+	}
+	kind, eventType, stream := query.Get("kind"), query.Get("type"), query.Get("stream")
+	filter = func(e *IndexedEntry) bool {
+		return (kind == "" || e.Kind == kind) &&
+			(eventType == "" || e.EventType == eventType) &&
+			(stream == "" || e.Stream == stream)
+	}
+	return
+}
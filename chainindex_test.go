@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncChainIndexLoops(t *testing.T) {
+	for _, loop := range chainLoops {
+		t.Run(loop.name, func(t *testing.T) {
+			vehicle, chain := testVehicle(t)
+			store, err := OpenStore(filepath.Join(t.TempDir(), "index.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			vehicle.store = store
+			hash := sha256.Sum256([]byte("segment"))
+			anchorTestHash(t, vehicle, vehicle.owner, hash[:])
+			loopChain(chain, vehicle.chainID, loop.link)
+
+			if _, err := vehicle.SyncChainIndex(chain, vehicle.vin); err == nil {
+				t.Fatal("indexed a looping chain without an error")
+			}
+		})
+	}
+}
+
+func TestSyncChainIndexMalformed(t *testing.T) {
+	vehicle, chain := testVehicle(t)
+	store, err := OpenStore(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	vehicle.store = store
+	hash := sha256.Sum256([]byte("segment"))
+	anchorTestHash(t, vehicle, vehicle.owner, hash[:])
+	spam, err := vehicle.hashEntry(hash[:], &HashMeta{Stream: "obd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam.ExtIDs[2] = []byte(`{"stream":"obd","hashes":1000}`)
+	if _, err := commitRevealEntry(chain, defaultRetry, spam, vehicle.owner.ecAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vehicle.SyncChainIndex(chain, vehicle.vin); err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := store.ChainEntries(vehicle.vin, time.Time{}, time.Now().Add(time.Minute), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindHash
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || !hashes[0].Verified || !hashes[0].SignedByOwner {
+		t.Errorf("indexed %d hash entries, want the one well formed entry signed by the owner", len(hashes))
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// claimStream marks the anchored hashes of claim packages in hash entry metadata
+const claimStream = "claim"
+
+// Default window of a claim package around the incident
+const (
+	defaultClaimBefore = 2 * time.Minute
+	defaultClaimAfter  = time.Minute
+)
+
+// ClaimConfig sets the window of claim packages and the insurer endpoint
+// they are pushed to
+type ClaimConfig struct {
+	URL    string     `json:"url"`    // endpoint packages are POSTed to, none to only build them
+	Token  string     `json:"token"`  // sent as a bearer token
+	TLS    *TLSConfig `json:"tls"`    // present a device certificate, trusting only TLS.CA for the insurer
+	Before int        `json:"before"` // seconds of evidence before the incident, default 120
+	After  int        `json:"after"`  // seconds of evidence after the incident, default 60
+
+	// Recipient is who the consent policy knows the insurer as. Packages are
+	// only submitted if it shares their data with them.
+	Recipient string `json:"recipient"`
+}
+
+// ClaimManifest describes what a claim package holds, written as claim.json
+// next to the evidence export's manifest.json
+type ClaimManifest struct {
+	VIN          string    `json:"vin"`
+	ChainID      string    `json:"chainID"`
+	Incident     time.Time `json:"incident"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Created      time.Time `json:"created"`
+	Files        int       `json:"files"`       // video and OBD segments, with proofs
+	OBDReadings  int       `json:"obdReadings"` // rows of obd.csv
+	TrackPoints  int       `json:"trackPoints"` // points of track.gpx
+	TroubleCodes []string  `json:"troubleCodes"`
+	Incidents    []string  `json:"incidents,omitempty"`
+	Events       int       `json:"events"`
+}
+
+// ClaimPackage is a built claim package and the anchor of its hash
+type ClaimPackage struct {
+	Path     string         `json:"path"` // the .tar.gz
+	Hash     string         `json:"hash"` // hex SHA-256 of the .tar.gz
+	TxID     string         `json:"txID"`
+	Manifest *ClaimManifest `json:"manifest"`
+}
+
+// claimWindow returns the configured evidence window around an incident
+func (config *ClaimConfig) claimWindow() (before, after time.Duration) {
+	before, after = defaultClaimBefore, defaultClaimAfter
+	if config != nil && config.Before > 0 {
+		before = time.Duration(config.Before) * time.Second
+	}
+	if config != nil && config.After > 0 {
+		after = time.Duration(config.After) * time.Second
+	}
+	return before, after
+}
+
+// BuildClaim gathers everything an insurer needs about the incident at into a
+// tar.gz under dir: the evidence export of the window around it (video and OBD
+// segments with their proofs, incident records, signed events), the OBD
+// readings as obd.csv, the GPS trace as track.gpx, the trouble codes stored
+// at the time and, as coverage.json, the countersigned insurance policies
+// bound on the vehicle's chain that cover it. The package's hash is anchored so the insurer can check nothing
+// was added or removed after it was built.
+func (vehicle *Vehicle) BuildClaim(dir string, at time.Time, before, after time.Duration) (*ClaimPackage, error) {
+	from, to := at.Add(-before), at.Add(after)
+	root, evidence, err := vehicle.ExportEvidence(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ClaimManifest{
+		VIN:       vehicle.vin,
+		ChainID:   vehicle.chainID,
+		Incident:  at.UTC(),
+		From:      from.UTC(),
+		To:        to.UTC(),
+		Created:   time.Now().UTC(),
+		Files:     len(evidence.Proofs),
+		Incidents: evidence.Incidents,
+		Events:    evidence.Events,
+	}
+
+	rows, err := vehicle.exportRows(vehicle.store, DatasetTelemetry, from, to)
+	if err != nil {
+		return nil, err
+	}
+	manifest.OBDReadings = len(rows)
+	if err := writeFileWith(filepath.Join(root, "obd.csv"), func(w io.Writer) error {
+		return writeRows(w, DatasetTelemetry, FormatCSV, rows)
+	}); err != nil {
+		return nil, err
+	}
+
+	track, err := readTrack(from, to)
+	if err != nil {
+		return nil, err
+	}
+	manifest.TrackPoints = len(track)
+	if len(track) > 0 {
+		name := fmt.Sprintf("%s incident %s", vehicle.vin, at.UTC().Format(time.RFC3339))
+		if err := writeGPX(filepath.Join(root, "track.gpx"), name, "", track); err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest.TroubleCodes, err = troubleCodesAt(to); err != nil {
+		return nil, err
+	}
+	// the policies on the chain covering the incident, as of the last index sync
+	if coverage, err := vehicle.coverageAt(at); err == nil && len(coverage) > 0 {
+		data, err := json.MarshalIndent(coverage, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeAtomic(filepath.Join(root, "coverage.json"), data); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(filepath.Join(root, "claim.json"), data); err != nil {
+		return nil, err
+	}
+
+	claim := &ClaimPackage{Path: root + ".tar.gz", Manifest: manifest}
+	sha := sha256.New()
+	if err := writeFileWith(claim.Path, func(w io.Writer) error {
+		return tarDir(io.MultiWriter(w, sha), root)
+	}); err != nil {
+		return nil, err
+	}
+	os.RemoveAll(root)
+	claim.Hash = hex.EncodeToString(sha.Sum(nil))
+	if claim.TxID, err = vehicle.secureHashWithMeta(sha.Sum(nil), &HashMeta{Stream: claimStream}); err != nil {
+		return nil, err
+	}
+	appendAudit("claim-built", map[string]interface{}{
+		"incident": manifest.Incident, "from": from, "to": to,
+		"path": claim.Path, "hash": claim.Hash, "txID": claim.TxID,
+	})
+	return claim, nil
+}
+
+// writeFileWith creates path and fills it with write, removing it on failure
+func writeFileWith(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// troubleCodesAt returns the trouble codes last logged before t
+func troubleCodesAt(t time.Time) ([]string, error) {
+	codes := []string{}
+	err := readEvents("trouble-codes", func() interface{} { return new(TroubleCodes) }, func(data interface{}, _ *SignedEvent) {
+		if logged := data.(*TroubleCodes); !logged.Time.After(t) {
+			codes = append(codes[:0], logged.Codes...)
+		}
+	})
+	return codes, err
+}
+
+// latestIncident returns the time of the most recent crash incident record
+func latestIncident() (time.Time, error) {
+	incidents, err := filepath.Glob("incident_*.json")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(incidents) == 0 {
+		return time.Time{}, fmt.Errorf("no incidents recorded")
+	}
+	// the names sort by time
+	sort.Strings(incidents)
+	return time.ParseInLocation("incident_20060102150405.json", incidents[len(incidents)-1], time.Local)
+}
+
+// SubmitClaim POSTs a built claim package to the insurer endpoint and returns
+// the body of its reply, e.g. a claim reference
+func (vehicle *Vehicle) SubmitClaim(config *ClaimConfig, claim *ClaimPackage) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.clientConfig()
+		if err != nil {
+			return "", err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	file, err := os.Open(claim.Path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	req, err := http.NewRequest(http.MethodPost, config.URL, file)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Blackbox-VIN", vehicle.vin)
+	req.Header.Set("X-Blackbox-Incident", claim.Manifest.Incident.Format(time.RFC3339))
+	req.Header.Set("X-Blackbox-Hash", claim.Hash)
+	req.Header.Set("X-Blackbox-TxID", claim.TxID)
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("insurer replied %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	appendAudit("claim-submitted", map[string]interface{}{"url": config.URL, "hash": claim.Hash, "txID": claim.TxID})
+	return strings.TrimSpace(string(reply)), nil
+}
+
+// claimCommand builds the claim package of an incident and optionally pushes
+// it to the configured insurer endpoint
+func claimCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("claim", flag.ExitOnError)
+	at := flags.String("at", "", "Time of the incident, RFC3339 (default: the latest crash recorded)")
+	dir := flags.String("o", ".", "Directory to write the package to")
+	submit := flags.Bool("submit", false, "Push the package to the configured insurer endpoint")
+	recipient := flags.String("recipient", "", "Who the package is for, refusing unless the consent policy shares its data with them (default: claims.recipient when submitting)")
+	flags.Parse(args)
+	if *submit && (config.Claims == nil || config.Claims.URL == "") {
+		fmt.Println("No insurer endpoint configured, set claims.url")
+		os.Exit(2)
+	}
+	if *submit && *recipient == "" {
+		*recipient = config.Claims.Recipient
+	}
+	checkConsent(*recipient, evidenceData...)
+
+	var incident time.Time
+	var err error
+	if *at != "" {
+		incident, err = time.Parse(time.RFC3339, *at)
+	} else {
+		incident, err = latestIncident()
+	}
+	if err != nil {
+		fmt.Println("Invalid incident time", err)
+		os.Exit(2)
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			fmt.Println("Failed to load device key", err)
+			os.Exit(1)
+		}
+	}
+
+	before, after := config.Claims.claimWindow()
+	claim, err := vehicle.BuildClaim(*dir, incident, before, after)
+	if err != nil {
+		fmt.Println("Failed to build claim package", err)
+		os.Exit(1)
+	}
+	vehicle.logAccess("claim-export", claim.Path, evidenceData, cliWho(*recipient))
+	m := claim.Manifest
+	fmt.Printf("Claim package %s: %d files, %d OBD readings, %d track points, trouble codes [%s]\n",
+		claim.Path, m.Files, m.OBDReadings, m.TrackPoints, strings.Join(m.TroubleCodes, " "))
+	fmt.Printf("SHA-256 %s secured to factom. TxID: %s\n", claim.Hash, claim.TxID)
+	if !*submit {
+		return
+	}
+	reply, err := vehicle.SubmitClaim(config.Claims, claim)
+	if err != nil {
+		fmt.Println("Failed to submit claim package", err)
+		os.Exit(1)
+	}
+	vehicle.logAccess("claim-submit", config.Claims.URL, evidenceData, cliWho(*recipient))
+	fmt.Println("Claim submitted.", reply)
+}
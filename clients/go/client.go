@@ -0,0 +1,990 @@
+// Package client is a Go client of the blackbox device API described at
+// /openapi.json on the device.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of one device
+type Client struct {
+	BaseURL    string // e.g. "http://127.0.0.1:8080"
+	Token      string // API token, needed once the device has issued any
+	HTTPClient *http.Client
+}
+
+// New returns a client of the device API at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+// Error is returned when the device answers with an error
+type Error struct {
+	StatusCode int
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("blackbox: %d: %s", e.StatusCode, e.Message)
+}
+
+type Status struct {
+	VIN            string                 `json:"vin"`
+	ChainID        string                 `json:"chainID"`
+	Recording      bool                   `json:"recording"`
+	Segment        *Segment               `json:"segment,omitempty"`
+	Storage        string                 `json:"storage"`
+	TimeSource     string                 `json:"timeSource"`
+	TimeConfidence string                 `json:"timeConfidence"`
+	PendingAnchors int                    `json:"pendingAnchors"`
+	Backlog        string                 `json:"backlog"`
+	DroppedSamples uint64                 `json:"droppedSamples,omitempty"`
+	Thermal        string                 `json:"thermal"`
+	TemperatureC   float64                `json:"temperatureC,omitempty"`
+	Driver         string                 `json:"driver,omitempty"`
+	PrivacyMode    bool                   `json:"privacyMode,omitempty"`
+	Position       map[string]interface{} `json:"position,omitempty"`
+	Alerts         []Alert                `json:"alerts"`
+	Tasks          []TaskStatus           `json:"tasks,omitempty"`
+}
+
+type Segment struct {
+	VIN         string    `json:"vin"`
+	Seq         uint64    `json:"seq"`
+	Stream      string    `json:"stream"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end,omitempty"`
+	Header      string    `json:"header"`
+	Path        string    `json:"path"`
+	Records     int       `json:"records"`
+	Hash        string    `json:"hash,omitempty"`
+	TxID        string    `json:"txID,omitempty"`
+	Compression string    `json:"compression,omitempty"`
+	EntryHash   string    `json:"entryHash,omitempty"`
+	UploadURL   string    `json:"uploadURL,omitempty"`
+	UploadedAt  time.Time `json:"uploadedAt,omitempty"`
+	Pruned      bool      `json:"pruned,omitempty"`
+	Driver      string    `json:"driver,omitempty"`
+
+	ClockUncertain bool `json:"clockUncertain,omitempty"`
+}
+
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type TaskStatus struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"lastError,omitempty"`
+	Failed    time.Time `json:"failed,omitempty"`
+}
+
+type QueueDepth struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity,omitempty"`
+}
+
+type MemoryStats struct {
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapSys      uint64 `json:"heapSys"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	Sys          uint64 `json:"sys"`
+	TotalAlloc   uint64 `json:"totalAlloc"`
+	NumGC        uint32 `json:"numGC"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+}
+
+type Diagnostics struct {
+	Time       time.Time             `json:"time"`
+	Goroutines int                   `json:"goroutines"`
+	Queues     map[string]QueueDepth `json:"queues"`
+	Memory     MemoryStats           `json:"memory"`
+	OBDErrors  map[string]int        `json:"obdErrors,omitempty"`
+	Tasks      []TaskStatus          `json:"tasks,omitempty"`
+	Stacks     string                `json:"stacks,omitempty"`
+}
+
+type Telemetry struct {
+	Record   *OBDRecord             `json:"record"`
+	Position map[string]interface{} `json:"position,omitempty"`
+}
+
+type OBDRecord struct {
+	Time     time.Time `json:"time"`
+	Position string    `json:"position"`
+	Readings []Reading `json:"readings"`
+}
+
+type Reading struct {
+	Name  string `json:"name"`
+	Value string `json:"value"` // "n/a" when the PID did not answer
+	Units string `json:"units,omitempty"`
+	Error string `json:"error,omitempty"` // why the PID did not answer
+}
+
+type Anchor struct {
+	Time time.Time `json:"time"`
+	TxID string    `json:"txID"`
+	Kind string    `json:"kind"`
+	Hash string    `json:"hash,omitempty"`
+}
+
+// VerifyRequest names either a local path or the hex SHA-256 a file was anchored with
+type VerifyRequest struct {
+	Path string `json:"path,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+type VerifyResult struct {
+	Verified        bool      `json:"verified"`
+	EntryHash       string    `json:"entryHash"`
+	BlockHeight     int64     `json:"blockHeight"`
+	BlockTime       time.Time `json:"blockTime"`
+	SigningKey      []byte    `json:"signingKey"`
+	EntryBlockKeyMR string    `json:"entryBlockKeyMR"`
+	EntrySequence   int64     `json:"entrySequence"`
+	EntryPosition   int       `json:"entryPosition"`
+
+	Duplicates int              `json:"duplicates,omitempty"` // later entries anchoring the same hash
+	Malformed  []MalformedEntry `json:"malformed,omitempty"`
+}
+
+type MalformedEntry struct {
+	EntryHash string `json:"entryHash"`
+	Reason    string `json:"reason"`
+}
+
+type IndexedEntry struct {
+	EntryHash       string          `json:"entryHash"`
+	BlockHeight     int64           `json:"blockHeight"`
+	BlockTime       time.Time       `json:"blockTime"`
+	EntryBlockKeyMR string          `json:"entryBlockKeyMR"`
+	EntrySequence   int64           `json:"entrySequence"`
+	EntryPosition   int             `json:"entryPosition"`
+	Kind            string          `json:"kind"`
+	EventType       string          `json:"eventType,omitempty"`
+	Stream          string          `json:"stream,omitempty"`
+	Hash            string          `json:"hash,omitempty"`
+	Hashes          []string        `json:"hashes,omitempty"`
+	Event           json.RawMessage `json:"event,omitempty"`
+	SigningKey      string          `json:"signingKey,omitempty"`
+	Verified        bool            `json:"verified"`
+	SignedByOwner   bool            `json:"signedByOwner"`
+	Driver          string          `json:"driver,omitempty"`
+	DriverVerified  bool            `json:"driverVerified,omitempty"`
+	ClockUncertain  bool            `json:"clockUncertain,omitempty"`
+}
+
+type TripSummary struct {
+	VIN         string    `json:"vin"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Duration    float64   `json:"duration"`
+	Distance    float64   `json:"distance"`
+	MaxSpeed    float64   `json:"maxSpeed"`
+	HarshEvents int       `json:"harshEvents"`
+	Speeding    float64   `json:"speeding"`
+	Driver      string    `json:"driver,omitempty"`
+	DriverKey   string    `json:"driverKey,omitempty"`
+}
+
+// TaggedTrip is a trip summary with the purpose it was tagged with and the
+// hash of the chain entry anchoring it
+type TaggedTrip struct {
+	TripSummary
+	Purpose   string `json:"purpose,omitempty"`
+	Note      string `json:"note,omitempty"`
+	EntryHash string `json:"entryHash"`
+}
+
+// DutyRecord is a change of the driver's hours-of-service duty status
+type DutyRecord struct {
+	Time      time.Time `json:"time"`
+	Status    string    `json:"status"`
+	Origin    string    `json:"origin"`
+	Driver    string    `json:"driver,omitempty"`
+	DriverKey string    `json:"driverKey,omitempty"`
+	Location  string    `json:"location"`
+	Note      string    `json:"note,omitempty"`
+	Edited    bool      `json:"edited,omitempty"`
+}
+
+// DutyEdit is an annotated change of a duty record's status
+type DutyEdit struct {
+	Time       time.Time `json:"time"`
+	Record     time.Time `json:"record"`
+	From       string    `json:"from"`
+	Status     string    `json:"status"`
+	Annotation string    `json:"annotation"`
+	Editor     string    `json:"editor"`
+}
+
+// HOSViolation is an hours-of-service limit exceeded while driving
+type HOSViolation struct {
+	Time  time.Time `json:"time"`
+	Limit string    `json:"limit"`
+	Hours float64   `json:"hours"`
+}
+
+// DailyLog is the anchored hours-of-service log of one day
+type DailyLog struct {
+	VIN        string             `json:"vin"`
+	Date       string             `json:"date"`
+	Records    []DutyRecord       `json:"records"`
+	Edits      []DutyEdit         `json:"edits"`
+	Hours      map[string]float64 `json:"hours"`
+	Violations []HOSViolation     `json:"violations"`
+	Amended    bool               `json:"amended"`
+	Created    time.Time          `json:"created"`
+}
+
+// HOSStatus is the driver's duty status and the hours they have left
+type HOSStatus struct {
+	Status     string       `json:"status"`
+	Since      time.Time    `json:"since"`
+	Driver     string       `json:"driver,omitempty"`
+	DriveLeft  float64      `json:"driveLeft"`
+	WindowLeft float64      `json:"windowLeft"`
+	CycleLeft  float64      `json:"cycleLeft"`
+	Today      []DutyRecord `json:"today"`
+}
+
+// FuelPurchase is fuel bought in an IFTA jurisdiction
+type FuelPurchase struct {
+	Time         time.Time `json:"time"`
+	Jurisdiction string    `json:"jurisdiction"`
+	Gallons      float64   `json:"gallons"`
+	Fuel         string    `json:"fuel,omitempty"`
+	Vendor       string    `json:"vendor,omitempty"`
+	Invoice      string    `json:"invoice,omitempty"`
+	Amount       float64   `json:"amount,omitempty"`
+	ReceiptHash  string    `json:"receiptHash,omitempty"`
+	EntryHash    string    `json:"entryHash,omitempty"`
+}
+
+// LeaseTerms are the terms of a lease of the vehicle, signed by lessor and
+// lessee as their JSON encoding
+type LeaseTerms struct {
+	ID           string    `json:"id"`
+	VIN          string    `json:"vin"`
+	ContractHash string    `json:"contractHash"`
+	Lessor       string    `json:"lessor"`
+	Lessee       string    `json:"lessee"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	AllowanceKm  float64   `json:"allowanceKm"`
+	ExcessPerKm  float64   `json:"excessPerKm,omitempty"`
+	Currency     string    `json:"currency,omitempty"`
+}
+
+// SignedLease is lease terms co-signed by lessor and lessee
+type SignedLease struct {
+	Terms     LeaseTerms `json:"terms"`
+	LessorSig string     `json:"lessorSig"`
+	LesseeSig string     `json:"lesseeSig"`
+	EntryHash string     `json:"entryHash,omitempty"`
+}
+
+// LeaseStatement is the anchored mileage of one month of a lease against its
+// allowance
+type LeaseStatement struct {
+	Lease       string    `json:"lease"`
+	LeaseEntry  string    `json:"leaseEntry"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	DrivenKm    float64   `json:"drivenKm"`
+	TotalKm     float64   `json:"totalKm"`
+	AllowedKm   float64   `json:"allowedKm"`
+	OverKm      float64   `json:"overKm"`
+	ProjectedKm float64   `json:"projectedKm"`
+	ExcessCost  float64   `json:"excessCost"`
+	Final       bool      `json:"final,omitempty"`
+}
+
+// LeaseStatus is an anchored lease with its monthly statements
+type LeaseStatus struct {
+	Lease      SignedLease      `json:"lease"`
+	Statements []LeaseStatement `json:"statements"`
+}
+
+// Credential kinds
+const (
+	CredentialRegistration = "registration"
+	CredentialOwnership    = "ownership"
+	CredentialTransfer     = "transfer"
+)
+
+// IssuedCredential is a W3C Verifiable Credential of the vehicle's
+// registration, ownership or a transfer, as a VC-JWT signed with the owner's
+// did:key, and the anchor of its hash
+type IssuedCredential struct {
+	Kind   string    `json:"kind"`
+	ID     string    `json:"id"`
+	JWT    string    `json:"jwt"`
+	Hash   string    `json:"hash"` // hex SHA-256 of JWT
+	TxID   string    `json:"txID"`
+	Issued time.Time `json:"issued"`
+}
+
+// DIDResolution is a DID document of a person's or vehicle's identity chain,
+// as resolved by the device
+type DIDResolution struct {
+	DIDDocument *struct {
+		ID                 string   `json:"id"`
+		AlsoKnownAs        []string `json:"alsoKnownAs"`
+		Controller         string   `json:"controller"`
+		VerificationMethod []struct {
+			ID                 string `json:"id"`
+			Type               string `json:"type"`
+			Controller         string `json:"controller"`
+			PublicKeyMultibase string `json:"publicKeyMultibase"`
+		} `json:"verificationMethod"`
+		Authentication  []string `json:"authentication"`
+		AssertionMethod []string `json:"assertionMethod"`
+		KeyAgreement    []string `json:"keyAgreement"`
+		Service         []struct {
+			ID              string `json:"id"`
+			Type            string `json:"type"`
+			ServiceEndpoint string `json:"serviceEndpoint"`
+		} `json:"service"`
+	} `json:"didDocument"`
+	ResolutionMetadata struct {
+		ContentType string `json:"contentType"`
+		Error       string `json:"error"`
+	} `json:"didResolutionMetadata"`
+	DocumentMetadata struct {
+		Created   time.Time `json:"created"`
+		Updated   time.Time `json:"updated"`
+		VersionID string    `json:"versionId"`
+	} `json:"didDocumentMetadata"`
+}
+
+// PolicyBinding is an insurance policy an insurer bound to the vehicle's chain
+type PolicyBinding struct {
+	Insurer    string    `json:"insurer"`
+	PolicyHash string    `json:"policyHash"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// PolicyCoverage is a policy binding on the vehicle's chain and whether the
+// owner countersigned it
+type PolicyCoverage struct {
+	Entry            string        `json:"entry"`
+	Bound            time.Time     `json:"bound"`
+	InsurerKey       string        `json:"insurerKey"`
+	Binding          PolicyBinding `json:"binding"`
+	Countersigned    bool          `json:"countersigned"`
+	CountersignEntry string        `json:"countersignEntry,omitempty"`
+}
+
+// DrivingScore is the anchored score of a trip or a month of trips
+type DrivingScore struct {
+	VIN           string    `json:"vin"`
+	Period        string    `json:"period"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Trips         int       `json:"trips"`
+	Distance      float64   `json:"distance"`
+	SpeedingRatio float64   `json:"speedingRatio"`
+	HarshPer100Km float64   `json:"harshPer100Km"`
+	NightShare    float64   `json:"nightShare"`
+	Score         float64   `json:"score"`
+	Driver        string    `json:"driver,omitempty"`
+}
+
+type DriverAssignment struct {
+	VIN    string    `json:"vin"`
+	Driver string    `json:"driver"`
+	Key    string    `json:"key"`
+	Method string    `json:"method"`
+	Since  time.Time `json:"since"`
+}
+
+type StorageUsage struct {
+	FreeBytes     uint64 `json:"freeBytes"`
+	EvidenceBytes int64  `json:"evidenceBytes"`
+}
+
+type Dashboard struct {
+	Status    *Status        `json:"status"`
+	Telemetry Telemetry      `json:"telemetry"`
+	Trips     []*TripSummary `json:"trips"`
+	Anchors   []Anchor       `json:"anchors"`
+	ECBalance *int64         `json:"ecBalance,omitempty"`
+	Storage   StorageUsage   `json:"storage"`
+	Vehicle   *VehicleInfo   `json:"vehicle,omitempty"`
+	Recalls   []Recall       `json:"recalls,omitempty"`
+}
+
+// VehicleInfo is the VIN decoded by NHTSA vPIC
+type VehicleInfo struct {
+	VIN       string `json:"vin"`
+	Make      string `json:"make"`
+	Model     string `json:"model"`
+	Year      string `json:"year"`
+	Trim      string `json:"trim,omitempty"`
+	BodyClass string `json:"bodyClass,omitempty"`
+}
+
+// Recall is an open NHTSA recall campaign covering the vehicle
+type Recall struct {
+	Campaign    string    `json:"campaign"`
+	Component   string    `json:"component"`
+	Summary     string    `json:"summary"`
+	Consequence string    `json:"consequence,omitempty"`
+	Remedy      string    `json:"remedy,omitempty"`
+	Reported    string    `json:"reported,omitempty"`
+	Seen        time.Time `json:"seen"`
+}
+
+// Datasets and formats of data exports
+const (
+	DatasetTelemetry = "telemetry"
+	DatasetTrips     = "trips"
+	DatasetUBI       = "ubi"  // daily mileage, time-of-day and harsh event aggregates
+	DatasetNMEA      = "nmea" // raw GPS sentences, if the device logs them
+
+	FormatCSV     = "csv"
+	FormatJSON    = "json" // one object per line
+	FormatParquet = "parquet"
+	FormatMDF     = "mf4"    // ASAM MDF 4, telemetry only
+	FormatNMEA    = "nmea"   // the original sentences, DatasetNMEA only
+	FormatTorque  = "torque" // Torque Pro's CSV layout, telemetry only
+)
+
+// Scopes of API tokens
+const (
+	ScopeReadTelemetry     = "read-telemetry"
+	ScopeControlRecording  = "control-recording"
+	ScopeExportEvidence    = "export-evidence"
+	ScopeManageKeys        = "manage-keys"
+	ScopeTransferOwnership = "transfer-ownership"
+	ScopeDiagnostics       = "diagnostics"
+	ScopeAssignDriver      = "assign-driver"
+	ScopeTagTrips          = "tag-trips"
+	ScopeDutyStatus        = "duty-status"
+	ScopeRecordFuel        = "record-fuel"
+	ScopeAnchorLease       = "anchor-lease"
+	ScopeCountersignPolicy = "countersign-policy"
+)
+
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+
+	// Recipient is who the token was issued to, limiting it to the data the
+	// device's consent policy shares with them. Empty for the owner's tokens.
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// IssuedToken is an APIToken with its secret, only returned when issued
+type IssuedToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// EntryQuery filters ListEntries. Zero fields are not filtered on.
+type EntryQuery struct {
+	VIN    string
+	From   time.Time
+	To     time.Time
+	Kind   string // "hash", "event" or "other"
+	Type   string // event type
+	Stream string
+	Sync   bool // sync the device's index with the chain first
+}
+
+func (q *EntryQuery) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("vin", q.VIN)
+	if !q.From.IsZero() {
+		v.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.Format(time.RFC3339))
+	}
+	set("kind", q.Kind)
+	set("type", q.Type)
+	set("stream", q.Stream)
+	if q.Sync {
+		v.Set("sync", "1")
+	}
+	return v
+}
+
+// send makes a request and returns the response if its status is 200 OK
+func (c *Client) send(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func (c *Client) do(method, path string, query url.Values, body, out interface{}) error {
+	resp, err := c.send(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GetStatus returns the current recorder state
+func (c *Client) GetStatus() (*Status, error) {
+	out := new(Status)
+	return out, c.do(http.MethodGet, "/status", nil, nil, out)
+}
+
+// GetTelemetry returns the latest OBD sample and position
+func (c *Client) GetTelemetry() (*Telemetry, error) {
+	out := new(Telemetry)
+	return out, c.do(http.MethodGet, "/telemetry", nil, nil, out)
+}
+
+// GetTroubleCodes returns the diagnostic trouble codes stored as of the last
+// time the device read them
+func (c *Client) GetTroubleCodes() ([]string, error) {
+	var out struct {
+		TroubleCodes []string `json:"troubleCodes"`
+	}
+	return out.TroubleCodes, c.do(http.MethodGet, "/trouble-codes", nil, nil, &out)
+}
+
+// SetRecording resumes or pauses OBD recording
+func (c *Client) SetRecording(recording bool) error {
+	path := "/recording/stop"
+	if recording {
+		path = "/recording/start"
+	}
+	var out struct {
+		Recording bool `json:"recording"`
+	}
+	return c.do(http.MethodPost, path, nil, nil, &out)
+}
+
+// PrivacyMode is whether the device captures the location
+type PrivacyMode struct {
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since,omitempty"`
+	Source string    `json:"source,omitempty"`
+}
+
+// SetPrivacyMode suspends or resumes capturing the location. OBD recording
+// carries on either way and the device anchors a marker of each switch.
+func (c *Client) SetPrivacyMode(active bool) (*PrivacyMode, error) {
+	path := "/privacy/stop"
+	if active {
+		path = "/privacy/start"
+	}
+	out := new(PrivacyMode)
+	return out, c.do(http.MethodPost, path, nil, nil, out)
+}
+
+// ListAnchors returns the most recently anchored entries, oldest first
+func (c *Client) ListAnchors() ([]Anchor, error) {
+	var out []Anchor
+	return out, c.do(http.MethodGet, "/anchors", nil, nil, &out)
+}
+
+// Verify checks a local file on the device against the chain
+func (c *Client) Verify(req VerifyRequest) (*VerifyResult, error) {
+	out := new(VerifyResult)
+	return out, c.do(http.MethodPost, "/verify", nil, req, out)
+}
+
+// ListEntries queries the device's index of a vehicle's chain
+func (c *Client) ListEntries(q EntryQuery) ([]IndexedEntry, error) {
+	var out []IndexedEntry
+	return out, c.do(http.MethodGet, "/entries", q.values(), nil, &out)
+}
+
+// ListIncidents returns anchored incident records. Kind, Type and Stream of q are ignored.
+func (c *Client) ListIncidents(q EntryQuery) ([]IndexedEntry, error) {
+	var out []IndexedEntry
+	return out, c.do(http.MethodGet, "/entries/incidents", q.values(), nil, &out)
+}
+
+// ListTransfers returns ownership transfer events. Kind, Type and Stream of q are ignored.
+func (c *Client) ListTransfers(q EntryQuery) ([]IndexedEntry, error) {
+	var out []IndexedEntry
+	return out, c.do(http.MethodGet, "/entries/transfers", q.values(), nil, &out)
+}
+
+// GetDashboard returns everything shown on the owner's dashboard
+func (c *Client) GetDashboard() (*Dashboard, error) {
+	out := new(Dashboard)
+	return out, c.do(http.MethodGet, "/dashboard", nil, nil, out)
+}
+
+// ExportEvidence downloads the evidence recorded between from and to, with
+// proofs, as a tar.gz. The caller must close the returned reader.
+func (c *Client) ExportEvidence(from, to time.Time) (io.ReadCloser, error) {
+	return c.ExportRedactedEvidence(from, to)
+}
+
+// ExportSealedEvidence is ExportRedactedEvidence sealed to the key audience
+// published on its identity chain, for only the audience to open
+func (c *Client) ExportSealedEvidence(from, to time.Time, audience string, redact ...string) (io.ReadCloser, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}, "audience": {audience}}
+	if len(redact) > 0 {
+		query.Set("redact", strings.Join(redact, ","))
+	}
+	resp, err := c.send(http.MethodGet, "/evidence", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ExportRedactedEvidence is ExportEvidence redacting fields from telemetry
+// files, e.g. "position", and with "video" withholding footage
+func (c *Client) ExportRedactedEvidence(from, to time.Time, redact ...string) (io.ReadCloser, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	if len(redact) > 0 {
+		query.Set("redact", strings.Join(redact, ","))
+	}
+	resp, err := c.send(http.MethodGet, "/evidence", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Export is a data export being downloaded
+type Export struct {
+	Hash string // hex SHA-256 of the file, anchored before it was sent
+	TxID string // transaction of the anchor
+	Rows int
+	Body io.ReadCloser
+}
+
+// ExportData downloads the dataset (DatasetTelemetry, DatasetTrips, DatasetUBI
+// or DatasetNMEA) recorded between from and to in format (FormatCSV,
+// FormatJSON, FormatParquet, FormatMDF, FormatNMEA or FormatTorque). The
+// caller must close the export's Body.
+func (c *Client) ExportData(dataset, format string, from, to time.Time) (*Export, error) {
+	query := url.Values{
+		"dataset": {dataset},
+		"format":  {format},
+		"from":    {from.Format(time.RFC3339)},
+		"to":      {to.Format(time.RFC3339)},
+	}
+	resp, err := c.send(http.MethodGet, "/export", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, _ := strconv.Atoi(resp.Header.Get("X-Blackbox-Rows"))
+	return &Export{
+		Hash: resp.Header.Get("X-Blackbox-Hash"),
+		TxID: resp.Header.Get("X-Blackbox-TxID"),
+		Rows: rows,
+		Body: resp.Body,
+	}, nil
+}
+
+// InitiateTransfer offers the vehicle to the owner with the hex public key and
+// returns the txID of the anchored transfer event
+func (c *Client) InitiateTransfer(newOwner string) (string, error) {
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	err := c.do(http.MethodPost, "/transfer", nil, map[string]string{"newOwner": newOwner}, &out)
+	return out.TxID, err
+}
+
+// AssignDriverByPIN authenticates the named driver by PIN and assigns them to
+// the vehicle until the trip ends, returning the assignment and the txID of its event
+func (c *Client) AssignDriverByPIN(driver, pin string) (*DriverAssignment, string, error) {
+	return c.assignDriver(map[string]string{"driver": driver, "pin": pin})
+}
+
+// AssignDriverByNFC is AssignDriverByPIN for the UID of a driver's NFC tag
+func (c *Client) AssignDriverByNFC(uid string) (*DriverAssignment, string, error) {
+	return c.assignDriver(map[string]string{"nfc": uid})
+}
+
+func (c *Client) assignDriver(req map[string]string) (*DriverAssignment, string, error) {
+	var out struct {
+		Assignment *DriverAssignment `json:"assignment"`
+		TxID       string            `json:"txID"`
+	}
+	err := c.do(http.MethodPost, "/driver", nil, req, &out)
+	return out.Assignment, out.TxID, err
+}
+
+// ListScores returns the anchored driving scores of period ("trip", "month" or
+// "" for both) starting between from and to
+func (c *Client) ListScores(period string, from, to time.Time) ([]DrivingScore, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	if period != "" {
+		query.Set("period", period)
+	}
+	var out []DrivingScore
+	return out, c.do(http.MethodGet, "/scores", query, nil, &out)
+}
+
+// ListTrips returns the anchored trips starting between from and to with
+// their purposes
+func (c *Client) ListTrips(from, to time.Time) ([]TaggedTrip, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	var out []TaggedTrip
+	return out, c.do(http.MethodGet, "/trips", query, nil, &out)
+}
+
+// TagTrip tags the trip starting at start, exactly as listed by ListTrips,
+// with purpose ("business", "personal", "medical" or "charity") and returns
+// the txID of the anchored tag
+func (c *Client) TagTrip(start time.Time, purpose, note string) (string, error) {
+	req := map[string]interface{}{"trip": start, "purpose": purpose, "note": note}
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/trips/tag", nil, req, &out)
+}
+
+// MileageReport downloads the mileage report of style ("irs" or "hmrc") for
+// the trips starting between from and to in format (FormatCSV or FormatJSON).
+// The caller must close the export's Body.
+func (c *Client) MileageReport(style, format string, from, to time.Time) (*Export, error) {
+	query := url.Values{
+		"style":  {style},
+		"format": {format},
+		"from":   {from.Format(time.RFC3339)},
+		"to":     {to.Format(time.RFC3339)},
+	}
+	resp, err := c.send(http.MethodGet, "/mileage", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, _ := strconv.Atoi(resp.Header.Get("X-Blackbox-Rows"))
+	return &Export{
+		Hash: resp.Header.Get("X-Blackbox-Hash"),
+		TxID: resp.Header.Get("X-Blackbox-TxID"),
+		Rows: rows,
+		Body: resp.Body,
+	}, nil
+}
+
+// HOSStatus returns the driver's hours-of-service duty status
+func (c *Client) HOSStatus() (*HOSStatus, error) {
+	var out HOSStatus
+	return &out, c.do(http.MethodGet, "/hos", nil, nil, &out)
+}
+
+// SetDutyStatus sets the driver's duty status ("off-duty", "sleeper" or
+// "on-duty") and returns the txID of the anchored record
+func (c *Client) SetDutyStatus(status, note string) (string, error) {
+	req := map[string]string{"status": status, "note": note}
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/hos/status", nil, req, &out)
+}
+
+// EditDutyStatus changes the status of the duty record logged at record,
+// giving the reason in annotation, and returns the txID of the anchored edit
+func (c *Client) EditDutyStatus(record time.Time, status, annotation string) (string, error) {
+	req := map[string]interface{}{"record": record, "status": status, "annotation": annotation}
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/hos/edit", nil, req, &out)
+}
+
+// ListDailyLogs returns the anchored hours-of-service logs of the days
+// between from and to
+func (c *Client) ListDailyLogs(from, to time.Time) ([]DailyLog, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	var out []DailyLog
+	return out, c.do(http.MethodGet, "/hos/logs", query, nil, &out)
+}
+
+// ListFuelPurchases returns the anchored fuel purchases made between from and to
+func (c *Client) ListFuelPurchases(from, to time.Time) ([]FuelPurchase, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	var out []FuelPurchase
+	return out, c.do(http.MethodGet, "/fuel", query, nil, &out)
+}
+
+// RecordFuelPurchase records a fuel purchase and returns the txID of its
+// anchored event. A zero Time is now and an empty Jurisdiction the one the
+// vehicle is in.
+func (c *Client) RecordFuelPurchase(purchase FuelPurchase) (string, error) {
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/fuel/record", nil, purchase, &out)
+}
+
+// IFTAReport downloads the IFTA report of quarter (e.g. "2025Q3", "" for the
+// last one) in format (FormatCSV or FormatJSON). The caller must close the
+// export's Body.
+func (c *Client) IFTAReport(quarter, format string) (*Export, error) {
+	query := url.Values{"format": {format}}
+	if quarter != "" {
+		query.Set("quarter", quarter)
+	}
+	resp, err := c.send(http.MethodGet, "/ifta", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, _ := strconv.Atoi(resp.Header.Get("X-Blackbox-Rows"))
+	return &Export{
+		Hash: resp.Header.Get("X-Blackbox-Hash"),
+		TxID: resp.Header.Get("X-Blackbox-TxID"),
+		Rows: rows,
+		Body: resp.Body,
+	}, nil
+}
+
+// ListLeases returns the anchored leases with their monthly mileage statements
+func (c *Client) ListLeases() ([]LeaseStatus, error) {
+	var out []LeaseStatus
+	return out, c.do(http.MethodGet, "/leases", nil, nil, &out)
+}
+
+// AnchorLease anchors lease terms co-signed by lessor and lessee and returns
+// the txID
+func (c *Client) AnchorLease(lease SignedLease) (string, error) {
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/leases/anchor", nil, lease, &out)
+}
+
+// ListPolicies returns the policy bindings on the vehicle's chain or, if at
+// is not zero, the countersigned ones covering at
+func (c *Client) ListPolicies(at time.Time) ([]PolicyCoverage, error) {
+	query := url.Values{}
+	if !at.IsZero() {
+		query.Set("at", at.Format(time.RFC3339))
+	}
+	var out []PolicyCoverage
+	return out, c.do(http.MethodGet, "/policies", query, nil, &out)
+}
+
+// CountersignPolicy countersigns the policy binding in entry with the owner's
+// key and returns the txID
+func (c *Client) CountersignPolicy(entry string) (string, error) {
+	var out struct {
+		TxID string `json:"txID"`
+	}
+	return out.TxID, c.do(http.MethodPost, "/policies/countersign", nil, map[string]string{"entry": entry}, &out)
+}
+
+// ListCredentials returns the Verifiable Credentials the owner issued
+func (c *Client) ListCredentials() ([]IssuedCredential, error) {
+	var out []IssuedCredential
+	return out, c.do(http.MethodGet, "/credentials", nil, nil, &out)
+}
+
+// IssueCredential issues a Verifiable Credential of kind and anchors its
+// hash. entry picks the transfer event of a transfer credential, the latest
+// if "".
+func (c *Client) IssueCredential(kind, entry string) (*IssuedCredential, error) {
+	out := new(IssuedCredential)
+	req := map[string]string{"type": kind}
+	if entry != "" {
+		req["entry"] = entry
+	}
+	return out, c.do(http.MethodPost, "/credentials/issue", nil, req, out)
+}
+
+// ResolveDID returns the DID document of a did:blackbox, or of a VIN's
+// vehicle
+func (c *Client) ResolveDID(did string) (*DIDResolution, error) {
+	out := new(DIDResolution)
+	return out, c.do(http.MethodGet, "/1.0/identifiers/"+url.PathEscape(did), nil, nil, out)
+}
+
+// ListTokens returns the device's API tokens, without their secrets
+func (c *Client) ListTokens() ([]APIToken, error) {
+	var out []APIToken
+	return out, c.do(http.MethodGet, "/tokens", nil, nil, &out)
+}
+
+// IssueToken issues an API token with the given scopes
+func (c *Client) IssueToken(name string, scopes ...string) (*IssuedToken, error) {
+	out := new(IssuedToken)
+	return out, c.do(http.MethodPost, "/tokens", nil, map[string]interface{}{"name": name, "scopes": scopes}, out)
+}
+
+// IssueRecipientToken issues an API token with the given scopes to recipient,
+// e.g. "insurer", which only receives the data the consent policy shares with it
+func (c *Client) IssueRecipientToken(name, recipient string, scopes ...string) (*IssuedToken, error) {
+	out := new(IssuedToken)
+	return out, c.do(http.MethodPost, "/tokens", nil, map[string]interface{}{"name": name, "scopes": scopes, "recipient": recipient}, out)
+}
+
+// RevokeToken revokes the API token with the ID
+func (c *Client) RevokeToken(id string) error {
+	var out struct {
+		OK bool `json:"ok"`
+	}
+	return c.do(http.MethodDelete, "/tokens/"+url.PathEscape(id), nil, nil, &out)
+}
+
+// GetDiagnostics returns the recorder's goroutine stacks, if stacks, queue
+// depths and memory statistics. The API must have debug enabled.
+func (c *Client) GetDiagnostics(stacks bool) (*Diagnostics, error) {
+	query := url.Values{}
+	if !stacks {
+		query.Set("stacks", "0")
+	}
+	out := new(Diagnostics)
+	return out, c.do(http.MethodGet, "/debug/dump", query, nil, out)
+}
@@ -0,0 +1,707 @@
+// TypeScript client of the blackbox device API described at /openapi.json on
+// the device. Uses the global fetch of browsers and Node 18+.
+
+export interface Status {
+  vin: string;
+  chainID: string;
+  recording: boolean;
+  segment?: Segment;
+  storage: "normal" | "low" | "critical" | "emergency";
+  timeSource: string;
+  timeConfidence: string;
+  pendingAnchors: number;
+  backlog: "normal" | "behind" | "shedding";
+  droppedSamples?: number;
+  thermal: "normal" | "warm" | "throttled";
+  temperatureC?: number;
+  driver?: string;
+  privacyMode?: boolean;
+  position?: Record<string, unknown>;
+  alerts: Alert[] | null;
+  tasks?: TaskStatus[];
+}
+
+export interface PrivacyMode {
+  active: boolean;
+  since?: string;
+  source?: "button" | "api" | "grpc" | "schedule";
+}
+
+export interface Segment {
+  vin: string;
+  seq: number;
+  stream: string;
+  start: string;
+  end?: string;
+  header: string;
+  path: string;
+  records: number;
+  hash?: string;
+  txID?: string;
+  compression?: string;
+  entryHash?: string;
+  uploadURL?: string;
+  uploadedAt?: string;
+  pruned?: boolean;
+  driver?: string; // hex identity key of the driver assigned when the segment started
+  clockUncertain?: boolean; // recorded before the clock was synced, timestamps may be wrong
+}
+
+export interface Alert {
+  kind: string;
+  message: string;
+  time: string;
+}
+
+export interface TaskStatus {
+  name: string;
+  running: boolean;
+  restarts: number;
+  lastError?: string;
+  failed?: string;
+}
+
+export interface QueueDepth {
+  length: number;
+  capacity?: number;
+}
+
+export interface MemoryStats {
+  heapAlloc: number;
+  heapSys: number;
+  heapObjects: number;
+  sys: number;
+  totalAlloc: number;
+  numGC: number;
+  pauseTotalNs: number;
+}
+
+export interface Diagnostics {
+  time: string;
+  goroutines: number;
+  queues: Record<string, QueueDepth>;
+  memory: MemoryStats;
+  obdErrors?: Record<string, number>;
+  tasks?: TaskStatus[];
+  stacks?: string;
+}
+
+export interface Telemetry {
+  record: OBDRecord | null;
+  position?: Record<string, unknown>;
+}
+
+export interface OBDRecord {
+  time: string;
+  position: string;
+  readings: Reading[];
+}
+
+export interface Reading {
+  name: string;
+  value: string; // "n/a" when the PID did not answer
+  units?: string;
+  error?: string; // why the PID did not answer
+}
+
+export interface Anchor {
+  time: string;
+  txID: string;
+  kind: string;
+  hash?: string;
+}
+
+// Name either a local path or the hex SHA-256 the file was anchored with
+export interface VerifyRequest {
+  path?: string;
+  hash?: string;
+}
+
+export interface VerifyResult {
+  verified: boolean;
+  entryHash: string;
+  blockHeight: number;
+  blockTime: string;
+  signingKey: string; // base64
+  entryBlockKeyMR: string;
+  entrySequence: number;
+  entryPosition: number;
+  duplicates?: number; // later entries anchoring the same hash, e.g. replays
+  malformed?: MalformedEntry[];
+}
+
+export interface MalformedEntry {
+  entryHash: string;
+  reason: string;
+}
+
+export interface IndexedEntry {
+  entryHash: string;
+  blockHeight: number;
+  blockTime: string;
+  entryBlockKeyMR: string;
+  entrySequence: number;
+  entryPosition: number;
+  kind: "hash" | "event" | "other";
+  eventType?: string;
+  stream?: string;
+  hash?: string;
+  hashes?: string[];
+  event?: Record<string, unknown>;
+  signingKey?: string;
+  verified: boolean;
+  signedByOwner: boolean;
+  driver?: string; // hex identity key of the driver countersigning a hash entry
+  driverVerified?: boolean;
+  clockUncertain?: boolean; // the hashed data was timestamped while the recorder's clock was uncertain
+}
+
+export interface TripSummary {
+  vin: string;
+  start: string;
+  end: string;
+  duration: number; // seconds
+  distance: number; // km
+  maxSpeed: number; // km/h
+  harshEvents: number;
+  speeding: number; // seconds above the scoring speed limit
+  driver?: string;
+  driverKey?: string;
+}
+
+export type TripPurpose = "business" | "personal" | "medical" | "charity";
+
+export interface TaggedTrip extends TripSummary {
+  purpose?: TripPurpose;
+  note?: string;
+  entryHash: string; // chain entry anchoring the summary
+}
+
+export type DutyStatus = "off-duty" | "sleeper" | "driving" | "on-duty";
+
+export interface DutyRecord {
+  time: string;
+  status: DutyStatus;
+  origin: "auto" | "driver";
+  driver?: string;
+  driverKey?: string;
+  location: string;
+  note?: string;
+  edited?: boolean;
+}
+
+export interface DutyEdit {
+  time: string;
+  record: string;
+  from: DutyStatus;
+  status: DutyStatus;
+  annotation: string;
+  editor: string;
+}
+
+export interface HOSViolation {
+  time: string;
+  limit: "drive" | "window" | "cycle";
+  hours: number;
+}
+
+export interface DailyLog {
+  vin: string;
+  date: string; // local date, YYYY-MM-DD
+  records: DutyRecord[];
+  edits: DutyEdit[];
+  hours: Record<string, number>; // per duty status
+  violations: HOSViolation[];
+  amended: boolean;
+  created: string;
+}
+
+export interface HOSStatus {
+  status: DutyStatus;
+  since: string;
+  driver?: string;
+  driveLeft: number; // hours
+  windowLeft: number;
+  cycleLeft: number;
+  today: DutyRecord[];
+}
+
+export interface FuelPurchase {
+  time?: string; // default now
+  jurisdiction?: string; // default the one the vehicle is in
+  gallons: number;
+  fuel?: string;
+  vendor?: string;
+  invoice?: string;
+  amount?: number; // total paid
+  receiptHash?: string; // hex SHA-256 of the receipt image or PDF
+  entryHash?: string; // chain entry anchoring the purchase
+}
+
+// Lessor and lessee sign the JSON encoding of the terms, in this field order
+export interface LeaseTerms {
+  id: string; // the lessor's contract number
+  vin: string;
+  contractHash: string; // hex SHA-256 of the signed contract document
+  lessor: string; // hex ed25519 public key
+  lessee: string; // hex ed25519 public key
+  start: string;
+  end: string;
+  allowanceKm: number; // over the whole term
+  excessPerKm?: number;
+  currency?: string;
+}
+
+export interface SignedLease {
+  terms: LeaseTerms;
+  lessorSig: string;
+  lesseeSig: string;
+  entryHash?: string; // chain entry anchoring the lease
+}
+
+export interface LeaseStatement {
+  lease: string;
+  leaseEntry: string;
+  start: string;
+  end: string;
+  drivenKm: number; // in the month
+  totalKm: number; // since the lease started
+  allowedKm: number; // the allowance pro rata up to end
+  overKm: number; // negative while under
+  projectedKm: number;
+  excessCost: number;
+  final?: boolean;
+}
+
+export interface LeaseStatus {
+  lease: SignedLease;
+  statements: LeaseStatement[];
+}
+
+export type CredentialKind = "registration" | "ownership" | "transfer";
+
+// A W3C Verifiable Credential as a VC-JWT signed with the owner's did:key
+export interface IssuedCredential {
+  kind: CredentialKind;
+  id: string; // urn:uuid
+  jwt: string;
+  hash: string; // hex SHA-256 of jwt, anchored on the vehicle's chain
+  txID: string;
+  issued: string;
+}
+
+export interface VerificationMethod {
+  id: string;
+  type: "Ed25519VerificationKey2020" | "X25519KeyAgreementKey2020";
+  controller: string;
+  publicKeyMultibase: string;
+}
+
+// A DID document of a person's or vehicle's identity chain
+export interface DIDResolution {
+  didDocument: {
+    "@context": string[];
+    id: string; // did:blackbox:<chain ID>
+    alsoKnownAs?: string[]; // urn:vin of a vehicle, did:key of a person
+    controller?: string; // DID of the vehicle's owner
+    verificationMethod: VerificationMethod[];
+    authentication: string[];
+    assertionMethod: string[];
+    keyAgreement?: string[]; // audience keys
+    service?: { id: string; type: string; serviceEndpoint: string }[];
+  } | null;
+  didResolutionMetadata: { contentType?: string; error?: "invalidDid" | "notFound" | "internalError"; message?: string };
+  didDocumentMetadata: { created?: string; updated?: string; versionId?: string; chainHead?: string };
+}
+
+export interface PolicyCoverage {
+  entry: string; // hash of the insurer's binding entry
+  bound: string; // block time of the binding entry
+  insurerKey: string; // hex public key that signed the binding
+  binding: {
+    insurer: string;
+    policyHash: string; // hex SHA-256 of the policy ID, a colon and the VIN
+    start: string;
+    end: string;
+  };
+  countersigned: boolean;
+  countersignEntry?: string;
+}
+
+export interface DrivingScore {
+  vin: string;
+  period: "trip" | "month";
+  start: string;
+  end: string;
+  trips: number;
+  distance: number;
+  speedingRatio: number;
+  harshPer100Km: number;
+  nightShare: number;
+  score: number; // 0 to 100, higher is safer
+  driver?: string;
+}
+
+export interface DriverAssignment {
+  vin: string;
+  driver: string;
+  key: string; // hex ed25519 identity key
+  method: "pin" | "nfc" | "ble";
+  since: string;
+}
+
+export interface StorageUsage {
+  freeBytes: number;
+  evidenceBytes: number;
+}
+
+export interface Dashboard {
+  status: Status;
+  telemetry: Telemetry;
+  trips: TripSummary[] | null;
+  anchors: Anchor[] | null;
+  ecBalance?: number;
+  storage: StorageUsage;
+  vehicle?: VehicleInfo;
+  recalls?: Recall[];
+}
+
+// the VIN decoded by NHTSA vPIC
+export interface VehicleInfo {
+  vin: string;
+  make: string;
+  model: string;
+  year: string;
+  trim?: string;
+  bodyClass?: string;
+}
+
+export interface Recall {
+  campaign: string; // NHTSA campaign number
+  component: string;
+  summary: string;
+  consequence?: string;
+  remedy?: string;
+  reported?: string;
+  seen: string;
+}
+
+// ubi exports hold one row of usage-based insurance aggregates per day, nmea
+// one raw GPS sentence per row
+export type Dataset = "telemetry" | "trips" | "ubi" | "nmea";
+
+// json exports hold one object per line, mf4 (ASAM MDF 4) and torque (Torque
+// Pro's CSV layout) export telemetry only and nmea the original sentences of
+// the nmea dataset
+export type ExportFormat = "csv" | "json" | "parquet" | "mf4" | "nmea" | "torque";
+
+export interface Export {
+  hash: string;
+  txID: string;
+  rows: number;
+  data: Blob;
+}
+
+export type Scope = "read-telemetry" | "control-recording" | "export-evidence" | "manage-keys" | "transfer-ownership" | "diagnostics" | "assign-driver" | "tag-trips" | "duty-status" | "record-fuel" | "anchor-lease" | "countersign-policy";
+
+export interface APIToken {
+  id: string;
+  name: string;
+  hash: string; // hex SHA-256 of the secret
+  scopes: Scope[];
+  created: string;
+  recipient?: string; // limits the token to the data the consent policy shares with them, absent for the owner's
+}
+
+// Only returned when the token is issued
+export interface IssuedToken extends APIToken {
+  token: string;
+}
+
+// Filters of listEntries. Unset fields are not filtered on.
+export interface EntryQuery {
+  vin?: string;
+  from?: Date;
+  to?: Date;
+  kind?: "hash" | "event" | "other";
+  type?: string;
+  stream?: string;
+  sync?: boolean; // sync the device's index with the chain first
+}
+
+export class BlackboxError extends Error {
+  constructor(public status: number, message: string) {
+    super(`blackbox: ${status}: ${message}`);
+  }
+}
+
+export class BlackboxClient {
+  private baseURL: string;
+  private token?: string;
+
+  // token is needed once the device has issued any API token
+  constructor(baseURL: string, token?: string) {
+    this.baseURL = baseURL.replace(/\/+$/, "");
+    this.token = token;
+  }
+
+  private async send(method: string, path: string, query?: URLSearchParams, body?: unknown): Promise<Response> {
+    let url = this.baseURL + path;
+    if (query && [...query].length > 0) {
+      url += "?" + query.toString();
+    }
+    const headers: Record<string, string> = {};
+    if (body !== undefined) headers["Content-Type"] = "application/json";
+    if (this.token) headers["Authorization"] = "Bearer " + this.token;
+    const resp = await fetch(url, {
+      method,
+      headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!resp.ok) {
+      const text = await resp.text();
+      let message = text.trim();
+      try {
+        message = JSON.parse(text).error || message;
+      } catch {
+        // not JSON, keep the text
+      }
+      throw new BlackboxError(resp.status, message);
+    }
+    return resp;
+  }
+
+  private async request<T>(method: string, path: string, query?: URLSearchParams, body?: unknown): Promise<T> {
+    const resp = await this.send(method, path, query, body);
+    return (await resp.json()) as T;
+  }
+
+  private static entryQuery(q: EntryQuery = {}): URLSearchParams {
+    const params = new URLSearchParams();
+    if (q.vin) params.set("vin", q.vin);
+    if (q.from) params.set("from", q.from.toISOString());
+    if (q.to) params.set("to", q.to.toISOString());
+    if (q.kind) params.set("kind", q.kind);
+    if (q.type) params.set("type", q.type);
+    if (q.stream) params.set("stream", q.stream);
+    if (q.sync) params.set("sync", "1");
+    return params;
+  }
+
+  getStatus(): Promise<Status> {
+    return this.request("GET", "/status");
+  }
+
+  getTelemetry(): Promise<Telemetry> {
+    return this.request("GET", "/telemetry");
+  }
+
+  async getTroubleCodes(): Promise<string[]> {
+    const out = await this.request<{ troubleCodes: string[] }>("GET", "/trouble-codes");
+    return out.troubleCodes;
+  }
+
+  async setRecording(recording: boolean): Promise<void> {
+    await this.request("POST", recording ? "/recording/start" : "/recording/stop");
+  }
+
+  setPrivacyMode(active: boolean): Promise<PrivacyMode> {
+    return this.request("POST", active ? "/privacy/start" : "/privacy/stop");
+  }
+
+  listAnchors(): Promise<Anchor[]> {
+    return this.request("GET", "/anchors");
+  }
+
+  verify(req: VerifyRequest): Promise<VerifyResult> {
+    return this.request("POST", "/verify", undefined, req);
+  }
+
+  listEntries(q?: EntryQuery): Promise<IndexedEntry[]> {
+    return this.request("GET", "/entries", BlackboxClient.entryQuery(q));
+  }
+
+  listIncidents(q?: EntryQuery): Promise<IndexedEntry[]> {
+    return this.request("GET", "/entries/incidents", BlackboxClient.entryQuery(q));
+  }
+
+  listTransfers(q?: EntryQuery): Promise<IndexedEntry[]> {
+    return this.request("GET", "/entries/transfers", BlackboxClient.entryQuery(q));
+  }
+
+  getDashboard(): Promise<Dashboard> {
+    return this.request("GET", "/dashboard");
+  }
+
+  // Evidence recorded between from and to, with proofs, as a tar.gz. Fields
+  // in redact, e.g. "position", are redacted from telemetry files and "video"
+  // withholds footage. With an audience the tar.gz is sealed to the key it
+  // published, for only the audience to open.
+  async exportEvidence(from: Date, to: Date, redact?: string[], audience?: string): Promise<Blob> {
+    const query = new URLSearchParams({ from: from.toISOString(), to: to.toISOString() });
+    if (redact && redact.length > 0) {
+      query.set("redact", redact.join(","));
+    }
+    if (audience) {
+      query.set("audience", audience);
+    }
+    const resp = await this.send("GET", "/evidence", query);
+    return resp.blob();
+  }
+
+  // Telemetry or trips recorded between from and to. The hash of the file is
+  // anchored before it is sent.
+  async exportData(dataset: Dataset, format: ExportFormat, from: Date, to: Date): Promise<Export> {
+    const query = new URLSearchParams({ dataset, format, from: from.toISOString(), to: to.toISOString() });
+    const resp = await this.send("GET", "/export", query);
+    return {
+      hash: resp.headers.get("X-Blackbox-Hash") ?? "",
+      txID: resp.headers.get("X-Blackbox-TxID") ?? "",
+      rows: Number(resp.headers.get("X-Blackbox-Rows") ?? 0),
+      data: await resp.blob(),
+    };
+  }
+
+  // Offer the vehicle to the owner with the hex public key, returns the txID
+  async initiateTransfer(newOwner: string): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/transfer", undefined, { newOwner });
+    return out.txID;
+  }
+
+  // Authenticate a driver by name and PIN, or by NFC tag UID, and assign them
+  // to the vehicle until the trip ends
+  assignDriver(req: { driver?: string; pin?: string; nfc?: string }): Promise<{ assignment: DriverAssignment; txID: string }> {
+    return this.request("POST", "/driver", undefined, req);
+  }
+
+  listScores(from: Date, to: Date, period?: "trip" | "month"): Promise<DrivingScore[]> {
+    const query = new URLSearchParams({ from: from.toISOString(), to: to.toISOString() });
+    if (period) query.set("period", period);
+    return this.request("GET", "/scores", query);
+  }
+
+  listTrips(from: Date, to: Date): Promise<TaggedTrip[]> {
+    const query = new URLSearchParams({ from: from.toISOString(), to: to.toISOString() });
+    return this.request("GET", "/trips", query);
+  }
+
+  // Tag the trip starting at start, exactly as listed by listTrips, returns the txID
+  async tagTrip(start: string, purpose: TripPurpose, note?: string): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/trips/tag", undefined, { trip: start, purpose, note });
+    return out.txID;
+  }
+
+  // IRS or HMRC style mileage report of the trips starting between from and
+  // to. The hash of the file is anchored before it is sent.
+  async mileageReport(style: "irs" | "hmrc", format: "csv" | "json", from: Date, to: Date): Promise<Export> {
+    const query = new URLSearchParams({ style, format, from: from.toISOString(), to: to.toISOString() });
+    const resp = await this.send("GET", "/mileage", query);
+    return {
+      hash: resp.headers.get("X-Blackbox-Hash") ?? "",
+      txID: resp.headers.get("X-Blackbox-TxID") ?? "",
+      rows: Number(resp.headers.get("X-Blackbox-Rows") ?? 0),
+      data: await resp.blob(),
+    };
+  }
+
+  getHOSStatus(): Promise<HOSStatus> {
+    return this.request("GET", "/hos");
+  }
+
+  // Set the driver's duty status, returns the txID
+  async setDutyStatus(status: Exclude<DutyStatus, "driving">, note?: string): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/hos/status", undefined, { status, note });
+    return out.txID;
+  }
+
+  // Change the status of the duty record logged at record, returns the txID
+  async editDutyStatus(record: string, status: Exclude<DutyStatus, "driving">, annotation: string): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/hos/edit", undefined, { record, status, annotation });
+    return out.txID;
+  }
+
+  listDailyLogs(from: Date, to: Date): Promise<DailyLog[]> {
+    const query = new URLSearchParams({ from: from.toISOString(), to: to.toISOString() });
+    return this.request("GET", "/hos/logs", query);
+  }
+
+  listFuelPurchases(from: Date, to: Date): Promise<FuelPurchase[]> {
+    const query = new URLSearchParams({ from: from.toISOString(), to: to.toISOString() });
+    return this.request("GET", "/fuel", query);
+  }
+
+  // Record a fuel purchase, returns the txID
+  async recordFuelPurchase(purchase: FuelPurchase): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/fuel/record", undefined, purchase);
+    return out.txID;
+  }
+
+  // Quarterly IFTA report, e.g. quarter "2025Q3", by default the last one.
+  // The hash of the file is anchored before it is sent.
+  async iftaReport(format: "csv" | "json", quarter?: string): Promise<Export> {
+    const query = new URLSearchParams({ format });
+    if (quarter) query.set("quarter", quarter);
+    const resp = await this.send("GET", "/ifta", query);
+    return {
+      hash: resp.headers.get("X-Blackbox-Hash") ?? "",
+      txID: resp.headers.get("X-Blackbox-TxID") ?? "",
+      rows: Number(resp.headers.get("X-Blackbox-Rows") ?? 0),
+      data: await resp.blob(),
+    };
+  }
+
+  // Anchored leases with their monthly mileage statements
+  listLeases(): Promise<LeaseStatus[]> {
+    return this.request("GET", "/leases");
+  }
+
+  // Anchor lease terms co-signed by lessor and lessee, returns the txID
+  async anchorLease(lease: SignedLease): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/leases/anchor", undefined, lease);
+    return out.txID;
+  }
+
+  // Policy bindings on the vehicle's chain, or with at only the countersigned
+  // ones covering that time
+  listPolicies(at?: Date): Promise<PolicyCoverage[]> {
+    return this.request("GET", "/policies", at ? new URLSearchParams({ at: at.toISOString() }) : undefined);
+  }
+
+  // Countersign an insurer's policy binding with the owner's key, returns the txID
+  async countersignPolicy(entry: string): Promise<string> {
+    const out = await this.request<{ txID: string }>("POST", "/policies/countersign", undefined, { entry });
+    return out.txID;
+  }
+
+  listCredentials(): Promise<IssuedCredential[]> {
+    return this.request("GET", "/credentials");
+  }
+
+  // Issue a Verifiable Credential and anchor its hash. entry picks the
+  // transfer event of a transfer credential, the latest if omitted.
+  issueCredential(type: CredentialKind, entry?: string): Promise<IssuedCredential> {
+    return this.request("POST", "/credentials/issue", undefined, { type, entry });
+  }
+
+  // Resolve a did:blackbox, or a VIN to its vehicle's DID document
+  resolveDID(did: string): Promise<DIDResolution> {
+    return this.request("GET", "/1.0/identifiers/" + encodeURIComponent(did));
+  }
+
+  listTokens(): Promise<APIToken[]> {
+    return this.request("GET", "/tokens");
+  }
+
+  // A recipient, e.g. "insurer", only receives the data the consent policy shares with it
+  issueToken(name: string, scopes: Scope[], recipient?: string): Promise<IssuedToken> {
+    return this.request("POST", "/tokens", undefined, { name, scopes, recipient });
+  }
+
+  async revokeToken(id: string): Promise<void> {
+    await this.request("DELETE", "/tokens/" + encodeURIComponent(id));
+  }
+
+  getDiagnostics(stacks = true): Promise<Diagnostics> {
+    return this.request("GET", "/debug/dump", stacks ? undefined : new URLSearchParams({ stacks: "0" }));
+  }
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func setSystemTime(t time.Time) error {
+	return errors.New("setting the system clock is only supported on linux")
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// recordCommand registers the vehicle and person if needed, then records from
+// every configured sensor until the process is stopped. It returns an error if
+// recording can't start, failures while recording are the supervisor's.
+func recordCommand(vehicle *Vehicle, person *Person, ecAddress *factom.ECAddress, config *Config) error {
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		return fmt.Errorf("opening the database: %v", err)
+	}
+	defer store.Close()
+	vehicle.store = store
+	vehicle.privacy = config.LocationPrivacy
+	vehicle.compression = config.Compression
+	vehicle.scoring = config.Scoring
+	vehicle.speedProofs = config.SpeedProofs
+	if vehicle.privacyMode, err = loadPrivacyMode(); err != nil {
+		return fmt.Errorf("loading the privacy mode: %v", err)
+	}
+	if vehicle.privacyMode.active() {
+		fmt.Println("Privacy mode is on, the location is not captured")
+	}
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			return fmt.Errorf("loading the device key: %v", err)
+		}
+	}
+	vehicle.clock = newTimeSync(config.PPSPath)
+	last, err := store.LastSegment(vehicle.vin)
+	if err != nil {
+		return fmt.Errorf("reading the last segment: %v", err)
+	}
+	var latest time.Time
+	if last != nil {
+		latest = last.Start
+		if last.End.After(latest) {
+			latest = last.End
+		}
+	}
+	vehicle.clock.checkStartup(latest)
+	vehicle.obd = NewSerialOBD(config.Serial, time.Duration(config.Timeouts.OBD)*time.Second)
+	vehicle.tasks = newSupervisor(vehicle.reportTaskFailure)
+	if vehicle.drivers.drivers, err = loadDrivers(); err != nil {
+		return fmt.Errorf("loading drivers: %v", err)
+	}
+	if config.HOS != nil {
+		if vehicle.hos, err = newHOSTracker(config.HOS.withDefaults()); err != nil {
+			return fmt.Errorf("loading hours of service: %v", err)
+		}
+	}
+	if config.IFTA != nil {
+		if vehicle.jurisdictions, err = loadJurisdictions(config.IFTA.Jurisdictions, config.IFTA.Property); err != nil {
+			return fmt.Errorf("loading IFTA jurisdictions: %v", err)
+		}
+		vehicle.ifta = config.IFTA
+	}
+	vehicle.pipeline = newPipeline(vehicle, config.Batch)
+	go vehicle.reportSegmentResults(vehicle.pipeline.SubscribeSegments())
+	if config.OTel != nil {
+		exporter, err := vehicle.newOTelExporter(config.OTel, config.Residency)
+		if err != nil {
+			return fmt.Errorf("setting up the OpenTelemetry export: %v", err)
+		}
+		go exporter.collect(vehicle.pipeline.SubscribeRecords(), vehicle.pipeline.SubscribeSegments())
+		vehicle.tasks.Go("otel", exporter.Run)
+	}
+	vehicle.tasks.Go("retention", func(stop <-chan struct{}) error {
+		return vehicle.RunRetention(config.Retention, stop)
+	})
+	vehicle.tasks.Go("disk", func(stop <-chan struct{}) error {
+		return vehicle.MonitorDisk(config.Disk, config.Retention, stop)
+	})
+	vehicle.tasks.Go("lease-statements", vehicle.RunLeaseStatements)
+	if config.USBExport != nil {
+		vehicle.tasks.Go("usb-export", func(stop <-chan struct{}) error {
+			return vehicle.WatchUSBExport(config.USBExport, stop)
+		})
+	}
+	if config.Research != nil {
+		vehicle.tasks.Go("research", func(stop <-chan struct{}) error {
+			return vehicle.RunResearch(config.Research, config.Residency, stop)
+		})
+	}
+	if config.Privacy != nil {
+		vehicle.tasks.Go("privacy", func(stop <-chan struct{}) error {
+			return vehicle.WatchPrivacy(config.Privacy, stop)
+		})
+	}
+	if config.Upload != nil {
+		uploader, err := NewUploader(config.Upload, config.Residency)
+		if err != nil {
+			return fmt.Errorf("setting up uploads: %v", err)
+		}
+		interval := 300
+		if config.Upload.Interval > 0 {
+			interval = config.Upload.Interval
+		}
+		vehicle.tasks.Go("uploads", func(stop <-chan struct{}) error {
+			return vehicle.RunUploads(uploader, time.Duration(interval)*time.Second, stop)
+		})
+	}
+	vehicle.tasks.Go("clock", func(stop <-chan struct{}) error {
+		return vehicle.clock.run(config.NTPServers, stop)
+	})
+	if config.Fleet != nil {
+		agent, err := vehicle.NewFleetAgent(config.Fleet, config.path, config.Residency)
+		if err != nil {
+			return fmt.Errorf("setting up the fleet agent: %v", err)
+		}
+		if config.Fleet.Funded {
+			vehicle.funder = agent
+		}
+		vehicle.tasks.Go("fleet", agent.Run)
+		if config.Fleet.Push > 0 {
+			vehicle.tasks.Go("fleet-telemetry", func(stop <-chan struct{}) error {
+				return agent.RunTelemetry(time.Duration(config.Fleet.Push)*time.Second, stop)
+			})
+		}
+	}
+	if config.NHTSA != nil {
+		vehicle.info = newNHTSAClient(config.NHTSA).vehicleInfo(vehicle.vin)
+	}
+	txID, err := vehicle.Register(ecAddress)
+	if err != nil {
+		return fmt.Errorf("registering the vehicle: %v", err)
+	}
+	printRegistration(vehicle.chain, "Vehicle", vehicle.chainID, txID)
+	if txID, err = person.Register(ecAddress); err != nil {
+		return fmt.Errorf("registering the owner: %v", err)
+	}
+	printRegistration(person.chain, "Person", person.chainID, txID)
+	anchors, err := openAnchorQueue(anchorQueuePath)
+	if err != nil {
+		return fmt.Errorf("opening the anchor queue: %v", err)
+	}
+	vehicle.anchors = anchors
+	vehicle.tasks.Go("anchor-retries", vehicle.RunAnchorRetries)
+	vehicle.tasks.Go("audit-anchoring", vehicle.RunAuditAnchoring)
+	vehicle.tasks.Go("access-anchoring", vehicle.RunAccessAnchoring)
+	vehicle.tasks.Go("backlog", vehicle.MonitorBacklog)
+	vehicle.tasks.Go("thermal", func(stop <-chan struct{}) error {
+		return vehicle.MonitorThermal(config.Thermal, stop)
+	})
+	if config.NHTSA != nil {
+		vehicle.tasks.Go("recalls", func(stop <-chan struct{}) error {
+			return vehicle.RunRecallChecks(config.NHTSA, stop)
+		})
+	}
+	if err := vehicle.recoverSegments(); err != nil {
+		fmt.Println("Failed to recover interrupted segments", err)
+	}
+
+	if config.IMU != nil {
+		imu, err := OpenMPU6050(config.IMU.Device, config.IMU.Address)
+		if err != nil {
+			fmt.Println("IMU unavailable, recording without harsh event detection", err)
+		} else {
+			defer imu.Close()
+			vehicle.tasks.Go("imu", func(stop <-chan struct{}) error {
+				return vehicle.RecordIMU(imu, config.IMU.Rate, stop)
+			})
+		}
+	}
+	if config.Environment != nil {
+		barometer, err := OpenBMP280(config.Environment.Device, config.Environment.Address)
+		if err != nil {
+			fmt.Println("Barometer unavailable, recording without cabin conditions", err)
+		} else {
+			defer barometer.Close()
+			for _, sensor := range barometer.Sensors() {
+				vehicle.RegisterSensor(sensor)
+			}
+		}
+	}
+	for _, sensorConfig := range config.Sensors {
+		sensors, err := NewSensors(sensorConfig)
+		if err != nil {
+			fmt.Printf("Sensor %q unavailable: %v\n", sensorConfig.Name, err)
+			continue
+		}
+		for _, sensor := range sensors {
+			vehicle.RegisterSensor(sensor)
+		}
+	}
+	if config.GPSPath != "" {
+		gpsTimeout := time.Duration(config.Timeouts.GPS) * time.Second
+		gps, err := OpenGPS(config.GPSPath, gpsTimeout)
+		if err != nil {
+			fmt.Println("GPS unavailable, recording without position", err)
+		} else {
+			vehicle.tasks.Go("gps", func(stop <-chan struct{}) error {
+				// the receiver is reopened after a failed read
+				if gps == nil {
+					if gps, err = OpenGPS(config.GPSPath, gpsTimeout); err != nil {
+						return err
+					}
+				}
+				defer func() {
+					gps.Close()
+					gps = nil
+				}()
+				defer closeOnStop(stop, gps)()
+				if config.NMEALog {
+					gps.raw = vehicle.logNMEA
+				}
+				return vehicle.RecordGPS(gps, config.Geofences)
+			})
+		}
+	}
+	if config.API != nil || config.GRPC != nil {
+		if vehicle.tokens, err = loadTokenStore(apiTokensPath); err != nil {
+			return fmt.Errorf("loading API tokens: %v", err)
+		}
+		if vehicle.consent, err = loadConsentStore(consentPath); err != nil {
+			return fmt.Errorf("loading the consent policy: %v", err)
+		}
+	}
+	if config.API != nil {
+		vehicle.tasks.Go("chain-index", vehicle.RunChainIndex)
+		go func() {
+			if err := vehicle.ServeAPI(config.API); err != nil {
+				fmt.Println("API stopped", err)
+			}
+		}()
+	}
+	if config.GRPC != nil {
+		go func() {
+			if err := vehicle.ServeGRPC(config.GRPC); err != nil {
+				fmt.Println("gRPC API stopped", err)
+			}
+		}()
+	}
+	if config.BLE != nil {
+		ble, err := vehicle.StartBLE(config.BLE)
+		if err != nil {
+			fmt.Println("BLE companion service unavailable", err)
+		} else {
+			vehicle.tasks.Go("ble", ble.notifyLoop)
+		}
+	}
+	vehicle.stopOnSignal()
+	vehicle.StartRecording(config.Video)
+	vehicle.Shutdown()
+	return nil
+}
+
+// exportGPXCommand writes the GPS track of a recorded trip to a GPX file and
+// anchors the file's hash
+func exportGPXCommand(vehicle *Vehicle, args []string) {
+	flags := flag.NewFlagSet("export-gpx", flag.ExitOnError)
+	tripIndex := flags.Int("trip", 0, "Trip to export, counting back from the most recent (0)")
+	out := flags.String("o", "", "Output path (default: trip_<start>.gpx)")
+	list := flags.Bool("list", false, "List recorded trips instead of exporting")
+	recipient := flags.String("recipient", "", "Who the track is for, refusing unless the consent policy shares locations with them")
+	flags.Parse(args)
+	if !*list {
+		checkConsent(*recipient, DataLocation)
+	}
+
+	trips, err := loadTrips()
+	if err != nil {
+		fmt.Println("Failed to read trips", err)
+		os.Exit(1)
+	}
+	if *list {
+		for i := range trips {
+			trip := trips[len(trips)-1-i]
+			fmt.Printf("%d: %s  %.1f km  %.0f min\n", i, trip.Start.Local().Format("2006-01-02 15:04"), trip.Distance, trip.Duration/60)
+		}
+		return
+	}
+	if *tripIndex < 0 || *tripIndex >= len(trips) {
+		fmt.Printf("No trip %d, %d trips recorded\n", *tripIndex, len(trips))
+		os.Exit(1)
+	}
+	trip := trips[len(trips)-1-*tripIndex]
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("trip_%s.gpx", trip.Start.Format("20060102150405"))
+	}
+
+	txID, err := vehicle.ExportTripGPX(trip, path)
+	if err != nil {
+		fmt.Println("Failed to export trip", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Trip exported to %s and secured to factom. TxID: %s\n", path, txID)
+}
+
+// exportDataCommand writes telemetry or trips recorded in a time range to a
+// CSV, JSON or Parquet file for analysis and anchors the file's hash
+func exportDataCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("export-data", flag.ExitOnError)
+	dataset := flags.String("dataset", DatasetTelemetry, "Data to export: "+strings.Join(exportDatasets, ", "))
+	format := flags.String("format", FormatCSV, "File format: "+strings.Join(exportFormats, ", "))
+	from := flags.String("from", "", "Start of the range, RFC3339 (default: two hours ago)")
+	to := flags.String("to", "", "End of the range, RFC3339 (default: now)")
+	out := flags.String("o", "", "Output path (default: <dataset>_<from>.<format>)")
+	recipient := flags.String("recipient", "", "Who the export is for, refusing unless the consent policy shares the dataset with them")
+	flags.Parse(args)
+	if err := checkExport(*dataset, *format); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	checkConsent(*recipient, exportData[*dataset]...)
+
+	end := time.Now()
+	start := end.Add(-defaultExportHours * time.Hour)
+	var err error
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			fmt.Println("Invalid -from", err)
+			os.Exit(2)
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			fmt.Println("Invalid -to", err)
+			os.Exit(2)
+		}
+	}
+	path := *out
+	if path == "" {
+		path = (&DataExport{Dataset: *dataset, Format: *format, From: start}).FileName()
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	export, err := vehicle.ExportData(store, *dataset, *format, start, end, path)
+	if err != nil {
+		fmt.Println("Failed to export data", err)
+		os.Exit(1)
+	}
+	vehicle.logAccess("data-export", path, exportData[*dataset], cliWho(*recipient))
+	fmt.Printf("%d rows exported to %s\nSHA-256 %s secured to factom. TxID: %s\n", export.Rows, path, export.Hash, export.TxID)
+}
+
+// revealLocationCommand prints the preimage of a hash-only location so it can be
+// handed to whoever needs to verify where the vehicle was
+func revealLocationCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox reveal-location <commitment>")
+		os.Exit(2)
+	}
+	preimage, err := RevealLocation(args[0])
+	if err != nil {
+		fmt.Println("Failed to reveal location", err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(preimage, "", "  ")
+	fmt.Println(string(out))
+}
+
+// queryCommand prints the OBD records taken in a time range
+func queryCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	from := flags.String("from", "", "Start of the range, RFC3339 (default: one hour ago)")
+	to := flags.String("to", "", "End of the range, RFC3339 (default: now)")
+	flags.Parse(args)
+
+	end := time.Now()
+	start := end.Add(-time.Hour)
+	var err error
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			fmt.Println("Invalid -from", err)
+			os.Exit(2)
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			fmt.Println("Invalid -to", err)
+			os.Exit(2)
+		}
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	records, err := store.Records(vehicle.vin, start, end)
+	if err != nil {
+		fmt.Println("Failed to query records", err)
+		os.Exit(1)
+	}
+	for _, record := range records {
+		fmt.Print(record.Text())
+	}
+}
+
+// decryptCommand writes the plaintext of an encrypted evidence file so it can be
+// viewed or handed over
+func decryptCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	out := flags.String("o", "", "Output path (default: input without "+encryptedExt+")")
+	flags.Parse(args)
+	if flags.NArg() != 1 || config.Encryption == nil {
+		fmt.Fprintln(os.Stderr, "usage: blackbox decrypt [-o path] <file>, with encryption configured")
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(path, encryptedExt)
+	}
+	if *out == path {
+		fmt.Fprintln(os.Stderr, "Refusing to overwrite the input, use -o")
+		os.Exit(2)
+	}
+
+	key, err := loadDeviceKey(config.Encryption)
+	if err != nil {
+		fmt.Println("Failed to load device key", err)
+		os.Exit(1)
+	}
+	vehicle.key = key
+	data, err := vehicle.readEvidence(path)
+	if err != nil {
+		fmt.Println("Failed to decrypt", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		fmt.Println("Failed to write", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Decrypted to %s\n", *out)
+}
+
+// exportStateCommand archives the device's local state for migration to a
+// replacement device
+func exportStateCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("export-state", flag.ExitOnError)
+	out := flags.String("o", "", "Output path (default: state_<vin>_<time>.tar.gz)")
+	flags.Parse(args)
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("state_%s_%s.tar.gz", vehicle.vin, time.Now().Format("20060102150405"))
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("Failed to create archive", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	manifest, err := vehicle.ExportState(file, config)
+	if err != nil {
+		fmt.Println("Failed to export state", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d files and %d receipts to %s\n", len(manifest.Files), manifest.Receipts, path)
+	if manifest.KeyFile && !manifest.Wrapped {
+		fmt.Println("Warning: the archive holds an unwrapped device key, keep it safe")
+	}
+}
+
+// importStateCommand restores an archive written by export-state
+func importStateCommand(config *Config, args []string) {
+	flags := flag.NewFlagSet("import-state", flag.ExitOnError)
+	force := flags.Bool("force", false, "Replace existing local state")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox import-state [-force] <archive>")
+		os.Exit(2)
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Println("Failed to open archive", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	manifest, err := ImportState(file, config, *force)
+	if err != nil {
+		fmt.Println("Failed to import state", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported state of %s exported %s\n", manifest.VIN, manifest.Created.Local().Format(time.RFC3339))
+}
+
+// usbExportCommand copies evidence from a time range, with proofs and a
+// verification manual, to a USB stick or any other directory
+func usbExportCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("usb-export", flag.ExitOnError)
+	from := flags.String("from", "", "Start of the range, RFC3339 (default: two hours ago)")
+	to := flags.String("to", "", "End of the range, RFC3339 (default: now)")
+	dest := flags.String("dest", "", "Destination directory (default: the first USB stick found)")
+	redact := flags.String("redact", "", "Comma separated fields to redact from telemetry files, e.g. \"position,Vehicle Speed\", and \"video\" to withhold footage")
+	audience := flags.String("audience", "", "Seal the export to the key this audience published, see blackbox audience")
+	flags.Parse(args)
+
+	end := time.Now()
+	start := end.Add(-2 * time.Hour)
+	var err error
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			fmt.Println("Invalid -from", err)
+			os.Exit(2)
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			fmt.Println("Invalid -to", err)
+			os.Exit(2)
+		}
+	}
+	if *dest == "" {
+		mounts, err := findUSBMounts()
+		if err != nil || len(mounts) == 0 {
+			fmt.Println("No USB stick found, insert one or use -dest")
+			os.Exit(1)
+		}
+		*dest = mounts[0]
+		fmt.Printf("Exporting to USB stick at %s\n", *dest)
+	}
+
+	var sealTo []byte
+	if *audience != "" {
+		if sealTo, err = audiencePublicKey(vehicle.chain, *audience); err != nil {
+			fmt.Println("Failed to find the audience's key", err)
+			os.Exit(1)
+		}
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			fmt.Println("Failed to load device key", err)
+			os.Exit(1)
+		}
+	}
+
+	path, manifest, err := vehicle.ExportRedacted(*dest, start, end, parseRedaction(*redact))
+	if err != nil {
+		fmt.Println("Failed to export evidence", err)
+		os.Exit(1)
+	}
+	if len(manifest.Redacted) > 0 {
+		fmt.Printf("Redacted %s\n", strings.Join(manifest.Redacted, ", "))
+	}
+	who := cliWho("")
+	if *audience != "" {
+		who["audience"] = *audience
+	}
+	vehicle.logAccess("evidence-export", path, redactedEvidenceData(parseRedaction(*redact)), who)
+	if sealTo != nil {
+		sealed := path + ".tar.gz" + sealedExt
+		if err := sealDir(sealed, path, sealTo); err != nil {
+			fmt.Println("Failed to seal the export", err)
+			os.Exit(1)
+		}
+		os.RemoveAll(path)
+		appendAudit("evidence-sealed", map[string]interface{}{"audience": *audience, "bundle": sealed})
+		fmt.Printf("Exported %d files, %d incidents, and %d events sealed for %s to %s\n", len(manifest.Proofs), len(manifest.Incidents), manifest.Events, *audience, sealed)
+		fmt.Printf("Only %s can open it, with blackbox audience open\n", *audience)
+		return
+	}
+	fmt.Printf("Exported %d files, %d incidents, and %d events to %s\n", len(manifest.Proofs), len(manifest.Incidents), manifest.Events, path)
+	fmt.Println("Hand over the whole folder, VERIFY.txt explains how to check it")
+}
+
+// lookupCommand prints the local file holding the data anchored with a hash
+func lookupCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox lookup <sha256>")
+		os.Exit(2)
+	}
+	hash, err := hex.DecodeString(args[0])
+	if err != nil || len(hash) != sha256.Size {
+		fmt.Fprintln(os.Stderr, "Not a hex SHA-256 hash:", args[0])
+		os.Exit(2)
+	}
+	path, ok := findObject(hash)
+	if !ok {
+		fmt.Println("No local file has that hash")
+		os.Exit(1)
+	}
+	fmt.Println(path)
+}
+
+// archiveCommand bundles a month of segments into an anchored archive for cold storage
+func archiveCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	month := flags.String("month", time.Now().AddDate(0, -1, 0).Format("2006-01"), "Month to archive, YYYY-MM (default: last month)")
+	out := flags.String("o", "", "Output path (default: <vin>_archive_<month>.tar)")
+	remove := flags.Bool("remove", false, "Delete the archived files from the device afterwards")
+	flags.Parse(args)
+
+	start, end, err := monthRange(*month)
+	if err != nil {
+		fmt.Println("Invalid -month", err)
+		os.Exit(2)
+	}
+	if *out == "" {
+		*out = archiveName(vehicle.vin, *month)
+	}
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+
+	manifest, txID, err := vehicle.ArchiveSegments(start, end, *out, *remove)
+	if err != nil {
+		fmt.Println("Failed to archive", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Archived %d segments to %s, manifest secured to factom. TxID: %s\n", len(manifest.Segments), *out, txID)
+}
+
+// verifyArchiveCommand checks an archive's manifest against the chain and its files against the manifest
+func verifyArchiveCommand(vehicle *Vehicle, config *Config, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox verify-archive <archive>")
+		os.Exit(2)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Println("Failed to open archive", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			fmt.Println("Failed to load device key", err)
+			os.Exit(1)
+		}
+	}
+
+	result, err := vehicle.VerifyArchive(file, vehicle.chain)
+	if err != nil {
+		fmt.Println("Failed to verify archive", err)
+		os.Exit(1)
+	}
+	if result.Anchor.Verified {
+		fmt.Printf("Manifest anchored in entry %s at %s\n", result.Anchor.EntryHash, result.Anchor.BlockTime.Format(time.RFC3339))
+		if result.Anchor.Duplicates > 0 {
+			fmt.Printf("Manifest hash anchored again in %d later entries\n", result.Anchor.Duplicates)
+		}
+	} else {
+		fmt.Println("Manifest hash NOT found on chain")
+	}
+	for _, malformed := range result.Anchor.Malformed {
+		fmt.Printf("MALFORMED entry %s: %s\n", malformed.EntryHash, malformed.Reason)
+	}
+	for _, name := range result.Failed {
+		fmt.Printf("MISMATCH %s\n", name)
+	}
+	if !result.Verified() {
+		os.Exit(1)
+	}
+	fmt.Printf("All %d files verified\n", len(result.Manifest.Segments))
+}
+
+// fleetServerCommand runs the reference fleet management server. It needs no
+// vehicle and is dispatched before one is set up.
+func fleetServerCommand(args []string) {
+	flags := flag.NewFlagSet("fleet-server", flag.ExitOnError)
+	configPath := flags.String("config", "fleet.json", "Path to the fleet server's JSON config file")
+	flags.Parse(args)
+
+	config, err := LoadFleetServerConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load fleet server config:", err)
+		os.Exit(1)
+	}
+	if err := ServeFleet(config); err != nil {
+		fmt.Fprintln(os.Stderr, "Fleet server stopped:", err)
+		os.Exit(1)
+	}
+}
+
+// apiTokenCommand issues, lists and revokes the tokens accepted by the APIs.
+// Until the first token is issued the APIs are open to anyone who can reach them.
+func apiTokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox api-token create|list|revoke")
+		os.Exit(2)
+	}
+	tokens, err := loadTokenStore(apiTokensPath)
+	if err != nil {
+		fmt.Println("Failed to load API tokens", err)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("api-token create", flag.ExitOnError)
+		name := flags.String("name", "", "What the token is for, e.g. \"kitchen dashboard\"")
+		scopes := flags.String("scopes", ScopeReadTelemetry, "Comma separated scopes: "+strings.Join(apiScopes, ", "))
+		recipient := flags.String("recipient", "", "Who the token is for, limiting it to the data the consent policy shares with them (default: the owner)")
+		flags.Parse(args[1:])
+		token, plain, err := tokens.issue(*name, strings.Split(*scopes, ","), *recipient)
+		if err != nil {
+			fmt.Println("Failed to issue token", err)
+			os.Exit(1)
+		}
+		appendAudit("api-token-issued", map[string]interface{}{"id": token.ID, "name": token.Name, "scopes": token.Scopes, "recipient": token.Recipient})
+		fmt.Printf("Issued token %s with scopes %s\n", token.ID, strings.Join(token.Scopes, ", "))
+		if token.Recipient != "" {
+			fmt.Printf("It receives only the data the consent policy shares with %s\n", token.Recipient)
+		}
+		fmt.Println("Send it as \"Authorization: Bearer <token>\", it is not shown again:")
+		fmt.Println(plain)
+	case "list":
+		list, err := tokens.list()
+		if err != nil {
+			fmt.Println("Failed to list tokens", err)
+			os.Exit(1)
+		}
+		for _, token := range list {
+			recipient := token.Recipient
+			if recipient == "" {
+				recipient = "owner"
+			}
+			fmt.Printf("%s  %-20s  %-12s  %s  %s\n", token.ID, token.Name, recipient, token.Created.Local().Format("2006-01-02"), strings.Join(token.Scopes, ","))
+		}
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox api-token revoke <id>")
+			os.Exit(2)
+		}
+		if err := tokens.revoke(args[1]); err != nil {
+			fmt.Println("Failed to revoke token", err)
+			os.Exit(1)
+		}
+		appendAudit("api-token-revoked", map[string]interface{}{"id": args[1]})
+		fmt.Printf("Revoked token %s\n", args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown api-token command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// verifyAuditCommand checks that the audit log is intact and reports how much
+// of it is covered by anchors on the vehicle's chain
+func verifyAuditCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	path := flags.String("log", auditLogPath, "Audit log to check")
+	offline := flags.Bool("offline", false, "Use the local chain index without syncing it")
+	flags.Parse(args)
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if !*offline {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, vehicle.vin); err != nil {
+			fmt.Println("Failed to sync the chain index, use -offline to skip", err)
+			os.Exit(1)
+		}
+	}
+	entries, err := store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindHash && e.Stream == auditStream && e.Verified && e.SignedByOwner
+	})
+	if err != nil {
+		fmt.Println("Failed to query the chain index", err)
+		os.Exit(1)
+	}
+	anchored := make(map[string]*IndexedEntry, len(entries))
+	for _, entry := range entries {
+		anchored[entry.Hash] = entry
+	}
+	report, err := VerifyAuditLog(*path, anchored)
+	if err != nil {
+		fmt.Println("Failed to read the audit log", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d lines, %d written before the log was chained\n", report.Lines, report.Unchained)
+	if report.AnchoredAt > 0 {
+		fmt.Printf("Lines up to %d are covered by the anchor of %s\n", report.AnchoredAt, report.AnchoredTime.Local().Format(time.RFC3339))
+	} else {
+		fmt.Println("No anchor covers the log yet")
+	}
+	if report.BrokenAt > 0 {
+		fmt.Printf("FAILED: line %d does not follow the line before it, the log was altered\n", report.BrokenAt)
+		os.Exit(1)
+	}
+	fmt.Println("OK: the hash chain is intact")
+}
+
+// benchCommand measures the cost of recording on the current hardware: how
+// fast the pipeline takes synthetic data when anchoring against a mock
+// backend. Record serialization is benchmarked by go test -bench.
+func benchCommand(vehicle *Vehicle, args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	rate := flags.Float64("rate", 10, "Samples per second of the first load step, doubled every step")
+	maxRate := flags.Float64("max-rate", 10000, "Highest sample rate tried")
+	step := flags.Duration("step", 10*time.Second, "How long each rate is held")
+	latency := flags.Duration("latency", 200*time.Millisecond, "Round trip of the mock anchor backend")
+	videoKB := flags.Int("video-kb", 5000, "Footage per video segment in kilobytes, 0 for no video")
+	videoInterval := flags.Duration("video-interval", 10*time.Second, "Time between video segments")
+	flags.Parse(args)
+	config := LoadTestConfig{Rate: *rate, MaxRate: *maxRate, Step: *step, Latency: *latency, VideoKB: *videoKB, VideoInterval: *videoInterval}
+	if config.Rate <= 0 || config.Step <= 0 || config.VideoInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "rate, step and video-interval must be positive")
+		os.Exit(2)
+	}
+	fmt.Printf("Pipeline load, anchoring latency %s, %s per rate:\n", config.Latency, config.Step)
+	steps, err := RunLoadTest(vehicle.owner, config)
+	if err != nil {
+		fmt.Println("Load test failed", err)
+		os.Exit(1)
+	}
+	printLoadTest(steps, config)
+}
+
+// selftestCommand runs a scripted drive through recording, anchoring and
+// verification against a chain in memory, exiting 1 if any step failed:
+//
+//	blackbox selftest [-samples n] [-video-kb kb] [-video-interval d]
+func selftestCommand(vehicle *Vehicle, args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	samples := flags.Int("samples", 30, "OBD samples of the scripted drive")
+	videoKB := flags.Int("video-kb", 512, "Footage per synthetic video segment in kilobytes, 0 for no video")
+	videoInterval := flags.Duration("video-interval", 2*time.Second, "Time between video segments")
+	flags.Parse(args)
+	if *videoInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "video-interval must be positive")
+		os.Exit(2)
+	}
+	config := SelfTestConfig{Samples: *samples, VideoKB: *videoKB, VideoInterval: *videoInterval}
+	report, err := RunSelfTest(vehicle.owner, config)
+	if err != nil {
+		fmt.Println("Self test failed to start", err)
+		os.Exit(1)
+	}
+	printSelfTest(report)
+	if len(report.Failures) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Config holds the device settings read once at startup
+type Config struct {
+	GPSPath         string             `json:"gps"`             // serial device of the NMEA GPS receiver
+	Geofences       []Geofence         `json:"geofences"`       // areas that emit enter/exit events
+	IMU             *IMUConfig         `json:"imu"`             // optional accelerometer/gyroscope
+	Environment     *EnvironmentConfig `json:"environment"`     // optional barometer/temperature sensor
+	LocationPrivacy LocationPrivacy    `json:"locationPrivacy"` // how positions appear in evidence
+	Sensors         []SensorConfig     `json:"sensors"`         // extra sensors logged with OBD data
+	PPSPath         string             `json:"pps"`             // sysfs assert file of the GPS PPS signal
+	NTPServers      []string           `json:"ntp"`             // fallback time servers when GPS is unavailable
+	Database        string             `json:"database"`        // embedded telemetry database
+	Retention       RetentionConfig    `json:"retention"`       // how long raw data is kept
+	Compression     string             `json:"compression"`     // "gzip" or "zstd" to compress OBD segment files
+	Encryption      *EncryptionConfig  `json:"encryption"`      // optional encryption at rest of evidence files
+	Upload          *UploadConfig      `json:"upload"`          // optional off-device copy of anchored evidence
+	Disk            DiskConfig         `json:"disk"`            // free space thresholds for degraded recording
+	Thermal         ThermalConfig      `json:"thermal"`         // SoC temperature thresholds for degraded recording
+	USBExport       *USBExportConfig   `json:"usbExport"`       // optional roadside export button
+	VIN             string             `json:"vin"`             // vehicle recorded, "auto" to detect it over OBD and keep its data apart
+	Serial          string             `json:"serial"`          // serial device of the ELM327 OBD adapter
+	API             *APIConfig         `json:"api"`             // optional local HTTP API
+	GRPC            *GRPCConfig        `json:"grpc"`            // optional gRPC API, see proto/blackbox.proto
+	BLE             *BLEConfig         `json:"ble"`             // optional Bluetooth LE service for the phone app
+	Fleet           *FleetConfig       `json:"fleet"`           // optional connection to a fleet management server
+	Video           *VideoConfig       `json:"video"`           // optional Raspberry Pi camera recording
+	Batch           *BatchConfig       `json:"batch"`           // optional grouping of segment hashes into shared entries
+	Organization    *OrgConfig         `json:"organization"`    // optional organization owning the vehicle and paying for its entries
+	Scoring         ScoringConfig      `json:"scoring"`         // driving score speed limit and penalties
+	Claims          *ClaimConfig       `json:"claims"`          // optional insurer endpoint and window of claim packages
+	NHTSA           *NHTSAConfig       `json:"nhtsa"`           // optional VIN decoding and recall checks
+	HOS             *HOSConfig         `json:"hos"`             // optional commercial-driver hours-of-service mode
+	IFTA            *IFTAConfig        `json:"ifta"`            // optional IFTA fuel-tax reporting
+	SpeedProofs     *SpeedProofConfig  `json:"speedProofs"`     // optional experimental commitments to prove speed limits were kept
+	Privacy         *PrivacyConfig     `json:"privacy"`         // optional button and schedule switching privacy mode
+	Residency       *ResidencyConfig   `json:"residency"`       // optional regions and endpoints uploads and fleet sync are pinned to
+	Research        *ResearchConfig    `json:"research"`        // optional contribution of anonymized, noisy statistics to researchers
+	OTel            *OTelConfig        `json:"otel"`            // optional OTLP export of pipeline traces and recorder metrics
+	Timeouts        TimeoutConfig      `json:"timeouts"`        // how long factomd and serial devices may take to answer
+
+	// NMEALog keeps the GPS receiver's raw sentences alongside the parsed
+	// positions, for export as the original sentences
+	NMEALog bool `json:"nmeaLog"`
+
+	path string // file the config was read from, rewritten by fleet config pushes
+}
+
+// TimeoutConfig bounds, in seconds, how long the recorder waits on the network
+// and its serial devices, so a hung node or wedged adapter fails a request
+// instead of stalling recording
+type TimeoutConfig struct {
+	Factomd int `json:"factomd"` // for a factomd request
+	OBD     int `json:"obd"`     // for the OBD adapter to answer a request
+	GPS     int `json:"gps"`     // for the GPS receiver's next sentence, it is reopened after
+}
+
+// DefaultConfig returns the settings used when no config file is present
+func DefaultConfig() *Config {
+	return &Config{
+		VIN:             "1M8GDM9AXKP042788",
+		Serial:          "/dev/ttyUSB0",
+		Database:        "blackbox.db",
+		GPSPath:         "/dev/ttyAMA0",
+		PPSPath:         "/sys/class/pps/pps0/assert",
+		NTPServers:      []string{"pool.ntp.org"},
+		Retention:       RetentionConfig{VideoDays: 7, OBDDays: 90},
+		Disk:            DiskConfig{LowMB: 2048, CriticalMB: 1024, EmergencyMB: 256},
+		Thermal:         ThermalConfig{WarmC: 70, ThrottledC: 80},
+		LocationPrivacy: LocationPrivacy{Mode: LocationFull},
+		Scoring:         ScoringConfig{SpeedingKmh: 120, SpeedingPenalty: 1, HarshPenalty: 5, NightPenalty: 0.5},
+		Timeouts:        TimeoutConfig{Factomd: 30, OBD: 2, GPS: 10},
+	}
+}
+
+// LoadConfig reads a JSON config file at path on top of the defaults.
+// A missing file is not an error, the defaults are returned instead.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		config := DefaultConfig()
+		config.path = path
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	config.path = path
+	return config, nil
+}
+
+// ParseConfig reads JSON config data on top of the defaults and validates it
+func ParseConfig(data []byte) (*Config, error) {
+	config := DefaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if _, ok := compressionExt[config.Compression]; !ok {
+		return nil, fmt.Errorf("unknown compression %q", config.Compression)
+	}
+	if s := config.Scoring; s.SpeedingKmh < 0 || s.SpeedingPenalty < 0 || s.HarshPenalty < 0 || s.NightPenalty < 0 {
+		return nil, fmt.Errorf("scoring speedingKmh and penalties must not be negative")
+	}
+	if t := config.Timeouts; t.Factomd <= 0 || t.OBD <= 0 || t.GPS <= 0 {
+		return nil, fmt.Errorf("timeouts must be positive")
+	}
+	if config.Thermal.WarmC > config.Thermal.ThrottledC {
+		return nil, fmt.Errorf("thermal warmC must not be above throttledC")
+	}
+	if batch := config.Batch; batch != nil {
+		if batch.Window <= 0 {
+			return nil, fmt.Errorf("batch window must be positive")
+		}
+		if batch.Max < 0 || batch.Max > maxBatchHashes {
+			return nil, fmt.Errorf("batch max must be at most %d", maxBatchHashes)
+		}
+	}
+	if claims := config.Claims; claims != nil && (claims.Before < 0 || claims.After < 0) {
+		return nil, fmt.Errorf("claims before and after must not be negative")
+	}
+	if hos := config.HOS; hos != nil && (hos.DriveHours < 0 || hos.WindowHours < 0 || hos.RestHours < 0 || hos.CycleHours < 0 || hos.CycleDays < 0) {
+		return nil, fmt.Errorf("hos limits must not be negative")
+	}
+	if ifta := config.IFTA; ifta != nil && ifta.Jurisdictions == "" {
+		return nil, fmt.Errorf("ifta jurisdictions is required")
+	}
+	if speedProofs := config.SpeedProofs; speedProofs != nil {
+		if err := speedProofs.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if privacy := config.Privacy; privacy != nil {
+		if err := privacy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.NMEALog && config.LocationPrivacy.Mode != LocationFull {
+		return nil, fmt.Errorf("nmeaLog keeps precise positions, it needs locationPrivacy mode %q", LocationFull)
+	}
+	if research := config.Research; research != nil {
+		if err := research.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if otel := config.OTel; otel != nil {
+		if err := otel.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if residency := config.Residency; residency != nil {
+		if err := residency.validate(); err != nil {
+			return nil, err
+		}
+		if err := residency.check(config); err != nil {
+			return nil, err
+		}
+	}
+	if org := config.Organization; org != nil && org.ECKey == "" {
+		return nil, fmt.Errorf("organization ecKey is required")
+	}
+	return config, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consentPath holds the owner's consent policy: which data each recipient may
+// receive
+const consentPath = "consent.json"
+
+// Categories of data the consent policy shares with recipients. An API route
+// or export discloses one or more of them and only reaches a recipient granted
+// all of them.
+const (
+	DataTrips        = "trips"            // trip summaries and mileage reports
+	DataScores       = "scores"           // driving scores and usage-based insurance aggregates
+	DataTroubleCodes = "trouble-codes"    // diagnostic trouble codes and freeze frames
+	DataTelemetry    = "telemetry"        // OBD readings and the recorder's state
+	DataLocation     = "location"         // raw positions and GPS tracks
+	DataVideo        = "video"            // camera footage
+	DataHOS          = "hours-of-service" // duty status and daily logs
+	DataFuel         = "fuel"             // fuel purchases and IFTA reports
+	DataAnchors      = "anchors"          // anchors, chain entries and verification results
+	DataContracts    = "contracts"        // leases and insurance policies
+)
+
+var dataCategories = []string{DataTrips, DataScores, DataTroubleCodes, DataTelemetry, DataLocation, DataVideo, DataHOS, DataFuel, DataAnchors, DataContracts}
+
+// evidenceData is what an evidence export discloses: segments of video and
+// OBD readings with their positions, and the events logged alongside them
+var evidenceData = []string{DataTelemetry, DataLocation, DataVideo, DataTroubleCodes}
+
+// exportData is what each dataset of a data export discloses
+var exportData = map[string][]string{
+	DatasetTelemetry: {DataTelemetry, DataLocation},
+	DatasetTrips:     {DataTrips},
+	DatasetUBI:       {DataScores},
+	DatasetNMEA:      {DataLocation},
+}
+
+func validDataCategory(category string) bool {
+	return contains(dataCategories, category)
+}
+
+// consentStore is the consent policy file, reloaded when another process
+// changes it, e.g. the consent command while recording. Tokens issued to a
+// recipient only receive the data categories the policy grants it; tokens
+// without a recipient are the owner's own and receive everything their scopes
+// allow. A recipient the policy doesn't name receives nothing.
+type consentStore struct {
+	path string
+
+	mu       sync.Mutex
+	modified time.Time
+	grants   map[string][]string // recipient → data categories
+}
+
+// loadConsentStore opens the consent policy at path, which need not exist yet
+func loadConsentStore(path string) (*consentStore, error) {
+	s := &consentStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s, s.reloadLocked()
+}
+
+// reloadLocked rereads the policy if it changed. s.mu must be held.
+func (s *consentStore) reloadLocked() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.grants, s.modified = nil, time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modified) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var grants map[string][]string
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.grants, s.modified = grants, info.ModTime()
+	return nil
+}
+
+// policy returns the data categories granted to each recipient
+func (s *consentStore) policy() (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	grants := make(map[string][]string, len(s.grants))
+	for recipient, categories := range s.grants {
+		grants[recipient] = append([]string{}, categories...)
+	}
+	return grants, nil
+}
+
+// grant adds categories to those recipient may receive and returns the ones
+// it didn't have yet
+func (s *consentStore) grant(recipient string, categories []string) ([]string, error) {
+	if recipient == "" {
+		return nil, fmt.Errorf("a recipient is required")
+	}
+	if len(categories) == 0 {
+		return nil, fmt.Errorf("at least one data category is required")
+	}
+	for _, category := range categories {
+		if !validDataCategory(category) {
+			return nil, fmt.Errorf("unknown data category %q, expected one of %s", category, strings.Join(dataCategories, ", "))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	grants := s.copyLocked()
+	var added []string
+	for _, category := range categories {
+		if !contains(grants[recipient], category) && !contains(added, category) {
+			added = append(added, category)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	grants[recipient] = append(grants[recipient], added...)
+	sort.Strings(grants[recipient])
+	return added, s.saveLocked(grants)
+}
+
+// revoke removes categories from those recipient may receive, all of them if
+// categories is empty, and returns the ones it had
+func (s *consentStore) revoke(recipient string, categories []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	grants := s.copyLocked()
+	granted, ok := grants[recipient]
+	if !ok {
+		return nil, fmt.Errorf("no consent was given to %q", recipient)
+	}
+	var kept, removed []string
+	for _, category := range granted {
+		if len(categories) == 0 || contains(categories, category) {
+			removed = append(removed, category)
+		} else {
+			kept = append(kept, category)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if len(kept) == 0 {
+		delete(grants, recipient)
+	} else {
+		grants[recipient] = kept
+	}
+	return removed, s.saveLocked(grants)
+}
+
+// copyLocked returns a copy of the grants to modify. s.mu must be held.
+func (s *consentStore) copyLocked() map[string][]string {
+	grants := make(map[string][]string, len(s.grants)+1)
+	for recipient, categories := range s.grants {
+		grants[recipient] = append([]string{}, categories...)
+	}
+	return grants
+}
+
+// saveLocked replaces the policy file. s.mu must be held.
+func (s *consentStore) saveLocked(grants map[string][]string) error {
+	if err := writeSynced(s.path, grants); err != nil {
+		return err
+	}
+	s.grants = grants
+	if info, err := os.Stat(s.path); err == nil {
+		s.modified = info.ModTime()
+	}
+	return nil
+}
+
+// allows returns an error unless recipient may receive every one of
+// categories. The owner, an empty recipient, may receive anything.
+func (s *consentStore) allows(recipient string, categories ...string) error {
+	if recipient == "" {
+		return nil
+	}
+	var granted []string
+	if s != nil {
+		s.mu.Lock()
+		err := s.reloadLocked()
+		granted = s.grants[recipient]
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	var missing []string
+	for _, category := range categories {
+		if !contains(granted, category) {
+			missing = append(missing, category)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the owner has not consented to share %s with %s", strings.Join(missing, ", "), recipient)
+	}
+	return nil
+}
+
+// permits reports whether the token that authorized a request, nil if the
+// API is open, may receive category
+func (s *consentStore) permits(token *APIToken, category string) bool {
+	return token == nil || s.allows(token.Recipient, category) == nil
+}
+
+// require wraps an API route so tokens issued to a recipient only reach it if
+// the consent policy grants every one of categories. It goes inside the
+// tokenStore's require, which identifies the token.
+func (s *consentStore) require(handler http.HandlerFunc, categories ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := requestToken(r); token != nil {
+			if err := s.allows(token.Recipient, categories...); err != nil {
+				writeError(w, http.StatusForbidden, err)
+				return
+			}
+		}
+		if info := requestAccess(r); info != nil {
+			info.data = categories
+		}
+		handler(w, r)
+	}
+}
+
+// checkConsent exits unless recipient may receive categories, for commands
+// exporting data to hand over. An empty recipient is the owner.
+func checkConsent(recipient string, categories ...string) {
+	if recipient == "" {
+		return
+	}
+	consent, err := loadConsentStore(consentPath)
+	if err != nil {
+		fmt.Println("Failed to load the consent policy", err)
+		os.Exit(1)
+	}
+	if err := consent.allows(recipient, categories...); err != nil {
+		fmt.Println("Refusing to export:", err)
+		os.Exit(1)
+	}
+}
+
+// consentCommand grants, revokes and lists the data each recipient may
+// receive. Every change is recorded in the audit log.
+func consentCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox consent grant|revoke|list")
+		os.Exit(2)
+	}
+	consent, err := loadConsentStore(consentPath)
+	if err != nil {
+		fmt.Println("Failed to load the consent policy", err)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "grant", "revoke":
+		flags := flag.NewFlagSet("consent "+args[0], flag.ExitOnError)
+		recipient := flags.String("recipient", "", "Who receives the data, e.g. \"insurer\", as given to api-token create")
+		data := flags.String("data", "", "Comma separated data categories: "+strings.Join(dataCategories, ", "))
+		flags.Parse(args[1:])
+		var categories []string
+		if *data != "" {
+			categories = strings.Split(*data, ",")
+		}
+		if args[0] == "grant" {
+			added, err := consent.grant(*recipient, categories)
+			if err != nil {
+				fmt.Println("Failed to grant consent", err)
+				os.Exit(1)
+			}
+			if len(added) == 0 {
+				fmt.Printf("%s may already receive %s\n", *recipient, *data)
+				return
+			}
+			appendAudit("consent-granted", map[string]interface{}{"recipient": *recipient, "data": added})
+			fmt.Printf("%s may now receive %s\n", *recipient, strings.Join(added, ", "))
+			return
+		}
+		removed, err := consent.revoke(*recipient, categories)
+		if err != nil {
+			fmt.Println("Failed to revoke consent", err)
+			os.Exit(1)
+		}
+		if len(removed) == 0 {
+			fmt.Printf("%s was not granted %s\n", *recipient, *data)
+			return
+		}
+		appendAudit("consent-revoked", map[string]interface{}{"recipient": *recipient, "data": removed})
+		fmt.Printf("%s may no longer receive %s\n", *recipient, strings.Join(removed, ", "))
+	case "list":
+		grants, err := consent.policy()
+		if err != nil {
+			fmt.Println("Failed to read the consent policy", err)
+			os.Exit(1)
+		}
+		if len(grants) == 0 {
+			fmt.Println("No recipient may receive any data")
+			return
+		}
+		recipients := make([]string, 0, len(grants))
+		for recipient := range grants {
+			recipients = append(recipients, recipient)
+		}
+		sort.Strings(recipients)
+		for _, recipient := range recipients {
+			fmt.Printf("%-20s  %s\n", recipient, strings.Join(grants[recipient], ", "))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown consent command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Crash detection settings
+const (
+	crashG            = 4.0              // impacts at least this strong are treated as crashes
+	preEventWindow    = 10 * time.Second // IMU history kept for incident records
+	recentOBDRecords  = 30               // OBD records kept for incident records
+	priorityAttempts  = 5                // commit attempts on the priority path
+	priorityRetryWait = 500 * time.Millisecond
+	incidentStream    = "incident" // stream named in the metadata of anchored incident records
+)
+
+// Incident is the record written when a crash is detected
+type Incident struct {
+	VIN      string                 `json:"vin"`
+	Time     time.Time              `json:"time"`
+	Trigger  HarshEvent             `json:"trigger"`
+	Position map[string]interface{} `json:"position,omitempty"` // as the location privacy mode allows
+	Segment  string                 `json:"segment,omitempty"`  // OBD segment being written at the time
+	PreEvent []IMUSample            `json:"preEvent"`           // IMU history leading up to the impact
+	OBD      []string               `json:"obd"`                // most recent OBD records
+}
+
+// imuRing keeps the most recent IMU samples
+type imuRing struct {
+	samples []IMUSample
+	next    int
+	full    bool
+}
+
+func newIMURing(size int) *imuRing {
+	return &imuRing{samples: make([]IMUSample, size)}
+}
+
+func (r *imuRing) add(sample IMUSample) {
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns a copy of the buffered samples, oldest first
+func (r *imuRing) snapshot() []IMUSample {
+	if !r.full {
+		return append([]IMUSample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]IMUSample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// handleCrash writes an incident record from the pre-event buffer, locks the
+// current OBD segment, and anchors the record's hash on the priority path. The
+// record is synced to disk before anything touches the network, since the device
+// may lose power at any moment after a crash.
+func (vehicle *Vehicle) handleCrash(event *HarshEvent, preEvent []IMUSample) {
+	fmt.Printf("Crash detected (%.2fg), securing incident record\n", event.Peak)
+	vehicle.recorder.boost(harshHighRateTime)
+	vehicle.recorder.addHarshEvent()
+
+	incident := Incident{
+		VIN:      vehicle.vin,
+		Time:     event.Time,
+		Trigger:  *event,
+		Position: vehicle.locationData(vehicle.position.latest()),
+		PreEvent: preEvent,
+		OBD:      vehicle.recorder.recentRecords(),
+	}
+	if segment := vehicle.recorder.segment(); segment != nil {
+		incident.Segment = segment.Path
+		if err := lockSegment(segment.Path); err != nil {
+			fmt.Println("Failed to lock segment", err)
+		}
+	}
+
+	path := fmt.Sprintf("incident_%s.json", event.Time.Format("20060102150405"))
+	if err := writeSynced(path, incident); err != nil {
+		fmt.Println("Failed to write incident record", err)
+		return
+	}
+	lockSegment(path)
+	vehicle.raiseAlert("crash", fmt.Sprintf("crash detected (%.2fg), incident recorded", event.Peak),
+		map[string]interface{}{"incident": path})
+
+	hash, err := vehicle.getFileHash(path)
+	if err != nil {
+		fmt.Println("Failed to hash incident record", err)
+		return
+	}
+	txID, err := vehicle.anchorPriority(hash)
+	if err != nil {
+		fmt.Println("Failed to anchor incident record", err)
+		return
+	}
+	fmt.Printf("Incident %s secured to factom. TxID: %s\n", path, txID)
+
+	data := toEventData(event)
+	data["incident"] = path
+	data["txID"] = txID
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("crash", data), false); err != nil {
+		fmt.Println("Failed to log crash event", err)
+	}
+}
+
+// writeSynced writes v as JSON to a new file at path and fsyncs it
+func writeSynced(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, data)
+}
+
+// anchorPriority commits hash immediately on the calling goroutine, retrying a
+// few times on failure. It never waits behind any other anchoring work.
+func (vehicle *Vehicle) anchorPriority(hash []byte) (string, error) {
+	entry, err := vehicle.hashEntry(hash, &HashMeta{Stream: incidentStream})
+	if err != nil {
+		return "", err
+	}
+	return vehicle.commitEntryRetrying(entry, retryPolicy{attempts: priorityAttempts, base: priorityRetryWait, max: 4 * priorityRetryWait})
+}
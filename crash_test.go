@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestHandleCrashHidesPositionInHashMode(t *testing.T) {
+	vehicle, _ := testVehicle(t)
+	vehicle.privacy = LocationPrivacy{Mode: LocationHash}
+	fix := &Fix{Time: time.Now().UTC(), Lat: 51.5074321, Lon: -0.1278456}
+	vehicle.position.set(fix)
+	event := &HarshEvent{Kind: "impact", Time: time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC), Peak: 6}
+	vehicle.handleCrash(event, nil)
+
+	data, err := ioutil.ReadFile("incident_20200102150405.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, coordinate := range []float64{fix.Lat, fix.Lon} {
+		if bytes.Contains(data, []byte(fmt.Sprint(coordinate))) {
+			t.Errorf("incident record holds the coordinate %v", coordinate)
+		}
+	}
+	var incident struct {
+		Position map[string]interface{} `json:"position"`
+	}
+	if err := json.Unmarshal(data, &incident); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := incident.Position["lat"]; ok {
+		t.Errorf("incident position %v has a latitude", incident.Position)
+	}
+	if _, ok := incident.Position["lon"]; ok {
+		t.Errorf("incident position %v has a longitude", incident.Position)
+	}
+	if incident.Position["locationCommitment"] == nil {
+		t.Errorf("incident position %v has no location commitment", incident.Position)
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// credentialsPath is the local log of the credentials issued, one JSON
+// IssuedCredential per line
+const credentialsPath = "credentials.log"
+
+// credentialStream marks the anchored hashes of issued credentials in hash
+// entry metadata
+const credentialStream = "credential"
+
+// credentialVocab defines the terms of the credential subjects, which the
+// base W3C context doesn't
+const credentialVocab = "https://github.com/sambarnes/blackbox/blob/master/credential.go#"
+
+// Credential kinds, each issued as the W3C Verifiable Credential type below
+const (
+	CredentialRegistration = "registration" // the vehicle's identity chain and when it was registered
+	CredentialOwnership    = "ownership"    // the current owner's key and the previous owners'
+	CredentialTransfer     = "transfer"     // a transfer event offering the vehicle to a new owner
+)
+
+var credentialTypes = map[string]string{
+	CredentialRegistration: "VehicleRegistrationCredential",
+	CredentialOwnership:    "VehicleOwnershipCredential",
+	CredentialTransfer:     "VehicleTransferCredential",
+}
+
+var credentialsMu sync.Mutex
+
+// VerifiableCredential is a W3C Verifiable Credential (data model 1.1) of a
+// fact on the vehicle's chain, so systems that don't read Factom entries can
+// consume it. It is issued as a JWT signed with the owner's key, whose
+// did:key is the issuer, and the JWT's hash is anchored on the chain.
+type VerifiableCredential struct {
+	Context           []interface{}          `json:"@context"`
+	ID                string                 `json:"id"` // urn:uuid
+	Type              []string               `json:"type"`
+	Issuer            string                 `json:"issuer"`
+	IssuanceDate      time.Time              `json:"issuanceDate"`
+	CredentialSubject map[string]interface{} `json:"credentialSubject"` // "id" is the vehicle's urn:vin
+	Evidence          []CredentialEvidence   `json:"evidence,omitempty"`
+}
+
+// CredentialEvidence is the chain entry a credential's fact was read from
+type CredentialEvidence struct {
+	Type      []string  `json:"type"` // "FactomEntry"
+	ChainID   string    `json:"chainId"`
+	EntryHash string    `json:"entryHash"`
+	BlockTime time.Time `json:"blockTime"`
+}
+
+// credentialClaims are the JWT claims of a credential, as the VC-JWT encoding
+// of the data model maps them
+type credentialClaims struct {
+	Issuer    string               `json:"iss"`
+	Subject   string               `json:"sub"`
+	ID        string               `json:"jti"`
+	NotBefore int64                `json:"nbf"`
+	IssuedAt  int64                `json:"iat"`
+	VC        VerifiableCredential `json:"vc"`
+}
+
+// jwtHeader is the JOSE header of a credential
+type jwtHeader struct {
+	Alg string `json:"alg"` // always "EdDSA"
+	Typ string `json:"typ"`
+	Kid string `json:"kid"` // the issuer's did:key verification method
+}
+
+// IssuedCredential is a credential as issued and anchored
+type IssuedCredential struct {
+	Kind   string    `json:"kind"`
+	ID     string    `json:"id"`
+	JWT    string    `json:"jwt"`
+	Hash   string    `json:"hash"` // hex SHA-256 of JWT, anchored on the vehicle's chain
+	TxID   string    `json:"txID"`
+	Issued time.Time `json:"issued"`
+}
+
+// base58Alphabet is Bitcoin's, used by the base58btc multibase of did:key
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Encode encodes b in base58btc, keeping leading zero bytes as '1's
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	base, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// base58Decode decodes base58btc
+func base58Decode(s string) ([]byte, error) {
+	n, base := new(big.Int), big.NewInt(58)
+	zeros := 0
+	for i, c := range s {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		if digit == 0 && i == zeros {
+			zeros++
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// ed25519Multicodec prefixes an Ed25519 public key in a did:key
+var ed25519Multicodec = []byte{0xed, 0x01}
+
+// didKey returns the did:key of an Ed25519 public key
+func didKey(pub []byte) string {
+	return "did:key:" + multibaseKey(ed25519Multicodec, pub)
+}
+
+// didKeyPublic returns the Ed25519 public key of a did:key
+func didKeyPublic(did string) ([]byte, error) {
+	encoded := strings.TrimPrefix(did, "did:key:z")
+	if encoded == did {
+		return nil, fmt.Errorf("%q is not a base58btc did:key", did)
+	}
+	decoded, err := base58Decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(decoded, ed25519Multicodec) || len(decoded) != len(ed25519Multicodec)+ed.PublicKeySize {
+		return nil, fmt.Errorf("%q is not an Ed25519 did:key", did)
+	}
+	return decoded[len(ed25519Multicodec):], nil
+}
+
+// didKeyHex returns the did:key of a hex public key, "" if it isn't one
+func didKeyHex(key string) string {
+	pub, err := hex.DecodeString(key)
+	if err != nil || len(pub) != ed.PublicKeySize {
+		return ""
+	}
+	return didKey(pub)
+}
+
+// vinURN identifies the vehicle as a credential subject
+func vinURN(vin string) string {
+	return "urn:vin:" + vin
+}
+
+// newUUID returns a random (version 4) UUID URN
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// entryEvidence returns the evidence of a fact read from entry
+func (vehicle *Vehicle) entryEvidence(entry *IndexedEntry) []CredentialEvidence {
+	return []CredentialEvidence{{Type: []string{"FactomEntry"}, ChainID: vehicle.chainID, EntryHash: entry.EntryHash, BlockTime: entry.BlockTime}}
+}
+
+// transfers returns the transfer events on the vehicle's chain signed by the
+// key they transfer from, as of the last index sync
+func (vehicle *Vehicle) transfers() ([]*IndexedEntry, []map[string]interface{}, error) {
+	entries, err := vehicle.store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindEvent && e.EventType == "transfer" && e.Verified
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var found []*IndexedEntry
+	var data []map[string]interface{}
+	for _, entry := range entries {
+		var event Event
+		if json.Unmarshal(entry.Event, &event) != nil || event.VIN != vehicle.vin || event.Data["from"] != entry.SigningKey {
+			continue
+		}
+		event.Data["initiated"] = event.Time
+		found, data = append(found, entry), append(data, event.Data)
+	}
+	return found, data, nil
+}
+
+// credentialSubject returns the subject and evidence of a credential of kind,
+// read from the chain index. entry picks the transfer event of a transfer
+// credential, the latest if "".
+func (vehicle *Vehicle) credentialSubject(kind, entry string) (map[string]interface{}, []CredentialEvidence, error) {
+	subject := map[string]interface{}{
+		"id":      vinURN(vehicle.vin),
+		"vin":     vehicle.vin,
+		"chainId": vehicle.chainID,
+	}
+	switch kind {
+	case CredentialRegistration:
+		first, err := vehicle.store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool { return true })
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(first) == 0 {
+			return nil, nil, errors.New("the vehicle's chain is not in the index, sync it once its registration is confirmed")
+		}
+		subject["registered"] = first[0].BlockTime
+		if info := vehicle.info; info != nil {
+			subject["make"], subject["model"], subject["year"] = info.Make, info.Model, info.Year
+		}
+		return subject, vehicle.entryEvidence(first[0]), nil
+	case CredentialOwnership:
+		owner := hex.EncodeToString(vehicle.owner.ecAddress.PubBytes())
+		subject["owner"] = didKey(vehicle.owner.ecAddress.PubBytes())
+		subject["ownerChainId"] = vehicle.owner.chainID
+		var previous []string
+		for _, key := range vehicle.previousOwners {
+			previous = append(previous, didKey(key))
+		}
+		if len(previous) > 0 {
+			subject["previousOwners"] = previous
+		}
+		// the transfer to the owner, if the vehicle changed hands
+		entries, data, err := vehicle.transfers()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if data[i]["to"] == owner {
+				return subject, vehicle.entryEvidence(entries[i]), nil
+			}
+		}
+		return subject, nil, nil
+	case CredentialTransfer:
+		entries, data, err := vehicle.transfers()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entry != "" && entries[i].EntryHash != entry {
+				continue
+			}
+			from, _ := data[i]["from"].(string)
+			to, _ := data[i]["to"].(string)
+			subject["from"], subject["to"] = didKeyHex(from), didKeyHex(to)
+			subject["initiated"] = data[i]["initiated"]
+			return subject, vehicle.entryEvidence(entries[i]), nil
+		}
+		if entry != "" {
+			return nil, nil, fmt.Errorf("no transfer event %s on the vehicle's chain, sync the chain index first", entry)
+		}
+		return nil, nil, errors.New("no transfer event on the vehicle's chain, sync the chain index first")
+	}
+	return nil, nil, fmt.Errorf("unknown credential type %q, expected registration, ownership or transfer", kind)
+}
+
+// signJWT returns claims as a compact JWT signed by the owner with EdDSA
+func (vehicle *Vehicle) signJWT(claims *credentialClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "EdDSA", Typ: "JWT", Kid: claims.Issuer + "#" + strings.TrimPrefix(claims.Issuer, "did:key:")})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed.Sign(vehicle.owner.ecAddress.Sec, []byte(signing))
+	return signing + "." + base64.RawURLEncoding.EncodeToString(signature[:]), nil
+}
+
+// IssueCredential issues a credential of kind signed by the owner, anchors
+// its hash and keeps it in the credentials log. entry picks the transfer
+// event of a transfer credential, the latest if "".
+func (vehicle *Vehicle) IssueCredential(kind, entry string) (*IssuedCredential, error) {
+	if vehicle.owner == nil {
+		return nil, errors.New("vehicle has no owner to issue credentials")
+	}
+	subject, evidence, err := vehicle.credentialSubject(kind, entry)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	issuer := didKey(vehicle.owner.ecAddress.PubBytes())
+	now := time.Now().UTC().Truncate(time.Second)
+	claims := &credentialClaims{
+		Issuer:    issuer,
+		Subject:   vinURN(vehicle.vin),
+		ID:        id,
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		VC: VerifiableCredential{
+			Context:           []interface{}{"https://www.w3.org/2018/credentials/v1", map[string]string{"@vocab": credentialVocab}},
+			ID:                id,
+			Type:              []string{"VerifiableCredential", credentialTypes[kind]},
+			Issuer:            issuer,
+			IssuanceDate:      now,
+			CredentialSubject: subject,
+			Evidence:          evidence,
+		},
+	}
+	jwt, err := vehicle.signJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(jwt))
+	txID, err := vehicle.secureHashWithMeta(sum[:], &HashMeta{Stream: credentialStream})
+	if err != nil {
+		return nil, err
+	}
+	issued := &IssuedCredential{Kind: kind, ID: id, JWT: jwt, Hash: hex.EncodeToString(sum[:]), TxID: txID, Issued: now}
+	line, err := json.Marshal(issued)
+	if err != nil {
+		return nil, err
+	}
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	file, err := os.OpenFile(credentialsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+// loadCredentials returns the credentials issued, oldest first
+func loadCredentials() ([]*IssuedCredential, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	file, err := os.Open(credentialsPath)
+	if os.IsNotExist(err) {
+		return []*IssuedCredential{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	credentials := []*IssuedCredential{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var issued IssuedCredential
+		if json.Unmarshal(scanner.Bytes(), &issued) == nil {
+			credentials = append(credentials, &issued)
+		}
+	}
+	return credentials, scanner.Err()
+}
+
+// ParseCredential checks the signature of a credential JWT against its
+// issuer's did:key and returns the credential and the issuer's public key
+func ParseCredential(jwt string) (*VerifiableCredential, []byte, error) {
+	parts := strings.Split(strings.TrimSpace(jwt), ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("not a compact JWT")
+	}
+	var header jwtHeader
+	var claims credentialClaims
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "EdDSA" {
+		return nil, nil, errors.New("not an EdDSA signed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding the claims: %v", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil, fmt.Errorf("decoding the claims: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != ed.SignatureSize {
+		return nil, nil, errors.New("invalid signature encoding")
+	}
+	pub, err := didKeyPublic(claims.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key [ed.PublicKeySize]byte
+	var sig [ed.SignatureSize]byte
+	copy(key[:], pub)
+	copy(sig[:], signature)
+	if !ed.Verify(&key, []byte(parts[0]+"."+parts[1]), &sig) {
+		return nil, nil, errors.New("the signature does not verify against the issuer's key")
+	}
+	if claims.VC.Issuer != claims.Issuer || claims.VC.ID != claims.ID {
+		return nil, nil, errors.New("the JWT claims don't match the credential")
+	}
+	return &claims.VC, pub, nil
+}
+
+// credentialAnchor returns the entry on the vehicle's chain anchoring the
+// credential JWT, signed by its issuer, nil if the index has none
+func (vehicle *Vehicle) credentialAnchor(jwt string, issuer []byte) (*IndexedEntry, error) {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(jwt)))
+	hash, key := hex.EncodeToString(sum[:]), hex.EncodeToString(issuer)
+	entries, err := vehicle.store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindHash && e.Stream == credentialStream && e.Verified && e.Hash == hash && e.SigningKey == key
+	})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// handleCredentials lists the credentials issued
+func (vehicle *Vehicle) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	credentials, err := loadCredentials()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, credentials)
+}
+
+// credentialRequest is the body of POST /credentials/issue
+type credentialRequest struct {
+	Type  string `json:"type"`            // registration, ownership or transfer
+	Entry string `json:"entry,omitempty"` // transfer event, the latest if empty
+}
+
+// handleIssueCredential issues and anchors a credential
+func (vehicle *Vehicle) handleIssueCredential(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req credentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := credentialTypes[req.Type]; !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown credential type %q", req.Type))
+		return
+	}
+	issued, err := vehicle.IssueCredential(req.Type, strings.ToLower(req.Entry))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	details := requestDetails(r)
+	details["type"], details["id"], details["hash"], details["txID"] = req.Type, issued.ID, issued.Hash, issued.TxID
+	appendAudit("credential-issued", details)
+	writeJSON(w, http.StatusOK, issued)
+}
+
+// credentialCommand issues and checks Verifiable Credentials of the vehicle's
+// registration, ownership and transfers:
+//
+//	blackbox credential issue -type registration|ownership|transfer [-entry <transfer entry hash>] [-o file] [-offline]
+//	blackbox credential list
+//	blackbox credential verify [-offline] <file or JWT>
+func credentialCommand(vehicle *Vehicle, config *Config, args []string) {
+	usage := "usage: blackbox credential issue|list|verify"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if args[0] == "list" {
+		credentials, err := loadCredentials()
+		if err != nil {
+			fmt.Println("Failed to read the credentials", err)
+			os.Exit(1)
+		}
+		for _, issued := range credentials {
+			fmt.Printf("%s  %-12s %s  hash %.16s  TxID: %s\n", issued.Issued.Local().Format(time.RFC3339), issued.Kind, issued.ID, issued.Hash, issued.TxID)
+		}
+		return
+	}
+
+	flags := flag.NewFlagSet("credential "+args[0], flag.ExitOnError)
+	kind := flags.String("type", "", "Credential to issue: registration, ownership or transfer")
+	entry := flags.String("entry", "", "Transfer event entry hash (default: the latest transfer)")
+	out := flags.String("o", "", "Write the credential JWT to this file instead of printing it")
+	offline := flags.Bool("offline", false, "Use the local chain index without syncing it")
+	flags.Parse(args[1:])
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if !*offline {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, vehicle.vin); err != nil {
+			fmt.Println("Failed to sync the chain index, use -offline to skip", err)
+			os.Exit(1)
+		}
+	}
+
+	switch args[0] {
+	case "issue":
+		if _, ok := credentialTypes[*kind]; !ok {
+			fmt.Fprintln(os.Stderr, "usage: blackbox credential issue -type registration|ownership|transfer [-entry <hash>] [-o file]")
+			os.Exit(2)
+		}
+		if *kind == CredentialRegistration && config.NHTSA != nil {
+			vehicle.info = newNHTSAClient(config.NHTSA).vehicleInfo(vehicle.vin)
+		}
+		issued, err := vehicle.IssueCredential(*kind, strings.ToLower(*entry))
+		if err != nil {
+			fmt.Println("Failed to issue the credential", err)
+			os.Exit(1)
+		}
+		appendAudit("credential-issued", map[string]interface{}{"via": "cli", "type": *kind, "id": issued.ID, "hash": issued.Hash, "txID": issued.TxID})
+		if *out == "" {
+			fmt.Println(issued.JWT)
+		} else if err := ioutil.WriteFile(*out, []byte(issued.JWT+"\n"), 0644); err != nil {
+			fmt.Println("Failed to write the credential", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Credential %s issued, its hash %s anchored. TxID: %s\n", issued.ID, issued.Hash, issued.TxID)
+	case "verify":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox credential verify [-offline] <file or JWT>")
+			os.Exit(2)
+		}
+		jwt := flags.Arg(0)
+		if data, err := ioutil.ReadFile(jwt); err == nil {
+			jwt = string(data)
+		}
+		credential, issuer, err := ParseCredential(jwt)
+		if err != nil {
+			fmt.Println("FAILED:", err)
+			os.Exit(1)
+		}
+		subject, _ := json.MarshalIndent(credential.CredentialSubject, "", "  ")
+		fmt.Printf("%s %s\nIssued %s by %s\n%s\n", strings.Join(credential.Type, " "), credential.ID,
+			credential.IssuanceDate.Local().Format(time.RFC3339), credential.Issuer, subject)
+		if credential.CredentialSubject["vin"] != vehicle.vin {
+			fmt.Printf("FAILED: the credential is not about %s, its anchor can't be checked on this vehicle's chain\n", vehicle.vin)
+			os.Exit(1)
+		}
+		anchor, err := vehicle.credentialAnchor(jwt, issuer)
+		if err != nil {
+			fmt.Println("Failed to query the chain index", err)
+			os.Exit(1)
+		}
+		if anchor == nil {
+			fmt.Println("FAILED: no entry signed by the issuer anchors the credential")
+			os.Exit(1)
+		}
+		fmt.Printf("Anchored in entry %s at %s\n", anchor.EntryHash, anchor.BlockTime.Local().Format(time.RFC3339))
+		if vehicle.owner != nil && !bytes.Equal(issuer, vehicle.owner.ecAddress.PubBytes()) {
+			fmt.Println("Note: the issuer is not the vehicle's current owner")
+		}
+		fmt.Println("OK: the signature verifies and the credential is anchored")
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
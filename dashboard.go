@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Dashboard settings
+const (
+	dashboardTrips        = 10          // most recent trips shown
+	dashboardSlowRefresh  = time.Minute // how long the EC balance and evidence size are reused
+	dashboardPollInterval = 2000        // milliseconds between page refreshes
+)
+
+// Dashboard is everything shown on the dashboard page, returned by GET /dashboard
+type Dashboard struct {
+	Status    *Status        `json:"status"`
+	Telemetry Telemetry      `json:"telemetry"`
+	Trips     []*TripSummary `json:"trips"`   // most recent first
+	Anchors   []Anchor       `json:"anchors"` // most recent first
+	ECBalance *int64         `json:"ecBalance,omitempty"`
+	Storage   StorageUsage   `json:"storage"`
+	Vehicle   *VehicleInfo   `json:"vehicle,omitempty"` // decoded VIN
+	Recalls   []Recall       `json:"recalls,omitempty"` // open recalls as of the last check
+}
+
+// StorageUsage is how much space evidence takes and how much is left
+type StorageUsage struct {
+	FreeBytes     uint64 `json:"freeBytes"`
+	EvidenceBytes int64  `json:"evidenceBytes"`
+}
+
+// dashboard serves the dashboard page and its data. The EC balance and the
+// evidence size are slow to get, so they are refreshed at most once a minute.
+type dashboard struct {
+	vehicle *Vehicle
+
+	mu            sync.Mutex
+	refreshed     time.Time
+	balance       *int64
+	evidenceBytes int64
+}
+
+func (d *dashboard) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, dashboardHTML, dashboardPollInterval)
+}
+
+func (d *dashboard) handleData(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	vehicle := d.vehicle
+	token := requestToken(r)
+	data := Dashboard{
+		Status:    vehicle.sharedStatus(token),
+		Telemetry: vehicle.sharedTelemetry(token),
+		Anchors:   vehicle.anchored.recent(),
+		Storage:   StorageUsage{FreeBytes: vehicle.storage.lastFree()},
+	}
+	if !vehicle.consent.permits(token, DataAnchors) {
+		data.Anchors = nil
+	}
+	for i, j := 0, len(data.Anchors)-1; i < j; i, j = i+1, j-1 {
+		data.Anchors[i], data.Anchors[j] = data.Anchors[j], data.Anchors[i]
+	}
+	trips, err := loadTrips()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !vehicle.consent.permits(token, DataTrips) {
+		trips = nil
+	}
+	for i := len(trips) - 1; i >= 0 && len(data.Trips) < dashboardTrips; i-- {
+		data.Trips = append(data.Trips, trips[i])
+	}
+	data.Vehicle = vehicle.info
+	if data.Recalls, err = loadRecalls(); err != nil {
+		fmt.Println("Failed to read recalls", err)
+	}
+	data.ECBalance, data.Storage.EvidenceBytes = d.slowData()
+	writeJSON(w, http.StatusOK, data)
+}
+
+// slowData returns the owner's EC balance, nil if unavailable, and the bytes
+// taken by stored evidence
+func (d *dashboard) slowData() (*int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.refreshed) < dashboardSlowRefresh {
+		return d.balance, d.evidenceBytes
+	}
+	d.balance = nil
+	if balance, err := d.vehicle.chain.ecBalance(d.vehicle.owner.ecAddress.String()); err == nil {
+		d.balance = &balance
+	} else {
+		fmt.Println("Failed to get EC balance", err)
+	}
+	d.evidenceBytes = dirSize(objectsDir)
+	d.refreshed = time.Now()
+	return d.balance, d.evidenceBytes
+}
+
+// dirSize returns the total size of the files under dir, skipping unreadable ones
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// dashboardHTML is the dashboard page. It polls GET /dashboard; %d is the poll interval.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Blackbox</title>
+<style>
+body { font-family: sans-serif; margin: 0; background: #f4f4f4; color: #222; }
+header { background: #222; color: #fff; padding: 12px 16px; display: flex; justify-content: space-between; }
+main { padding: 16px; display: grid; gap: 16px; grid-template-columns: repeat(auto-fit, minmax(320px, 1fr)); }
+section { background: #fff; border-radius: 6px; padding: 12px 16px; }
+h2 { font-size: 1em; margin: 0 0 8px; color: #666; text-transform: uppercase; }
+.gauges { display: grid; gap: 8px; grid-template-columns: repeat(auto-fill, minmax(90px, 1fr)); }
+.gauge { text-align: center; border: 1px solid #ddd; border-radius: 4px; padding: 6px; }
+.gauge b { display: block; font-size: 1.4em; }
+.gauge small { color: #666; }
+table { width: 100%%; border-collapse: collapse; font-size: 0.9em; }
+td { padding: 3px 4px; border-bottom: 1px solid #eee; }
+.ok { color: #2a7d2a; } .warn { color: #b07400; } .bad { color: #b00020; }
+.bar { height: 10px; background: #ddd; border-radius: 5px; overflow: hidden; }
+.bar div { height: 100%%; background: #2a7d2a; }
+</style>
+</head>
+<body>
+<header><span id="vin">Blackbox</span><span id="recording"></span></header>
+<main>
+<section><h2>Live</h2><div class="gauges" id="gauges">Waiting for data&hellip;</div></section>
+<section><h2>Anchoring</h2><p id="anchoring"></p><table id="anchors"></table></section>
+<section><h2>Recent trips</h2><table id="trips"></table></section>
+<section><h2>Device</h2><table id="device"></table></section>
+</main>
+<script>
+function esc(s) { return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"})[c]); }
+function when(t) { return new Date(t).toLocaleString(); }
+function mb(bytes) { return (bytes / 1048576).toFixed(0) + " MB"; }
+function rows(items) { return items.map(r => "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>").join(""); }
+
+function render(d) {
+  var s = d.status;
+  document.getElementById("vin").textContent = "Blackbox " + s.vin + (d.vehicle ? " · " + d.vehicle.year + " " + d.vehicle.make + " " + d.vehicle.model : "");
+  var rec = document.getElementById("recording");
+  rec.textContent = s.recording ? "● Recording" : "Paused";
+  rec.className = s.recording ? "ok" : "warn";
+
+  var record = d.telemetry.record;
+  if (record) {
+    document.getElementById("gauges").innerHTML = record.readings.map(r =>
+      '<div class="gauge"><small>' + esc(r.name) + "</small><b>" + esc(r.value) + "</b><small>" + esc(r.units || "") + "</small></div>").join("");
+  }
+
+  var anchoring = document.getElementById("anchoring");
+  anchoring.className = s.pendingAnchors > 0 ? "warn" : "ok";
+  anchoring.textContent = s.pendingAnchors > 0 ? s.pendingAnchors + " entries waiting to be anchored" : "Everything recorded is anchored";
+  document.getElementById("anchors").innerHTML = rows((d.anchors || []).slice(0, 8).map(a =>
+    [when(a.time), esc(a.kind), '<code title="' + esc(a.txID) + '">' + esc(a.txID.slice(0, 12)) + "&hellip;</code>"]));
+
+  document.getElementById("trips").innerHTML = d.trips ? rows(d.trips.map(t =>
+    [when(t.start), t.distance.toFixed(1) + " km", Math.round(t.duration / 60) + " min", t.harshEvents + " harsh events"])) : "<tr><td>No trips yet</td></tr>";
+
+  var level = {normal: "ok", low: "warn"}[s.storage] || "bad";
+  var free = d.storage.freeBytes, used = d.storage.evidenceBytes;
+  var balance = d.ecBalance === undefined ? '<span class="bad">unavailable</span>' : d.ecBalance + " EC";
+  document.getElementById("device").innerHTML = rows([
+    ["Storage", '<span class="' + level + '">' + esc(s.storage) + "</span>, " + mb(free) + " free, " + mb(used) + " of evidence"],
+    ["", '<div class="bar"><div style="width:' + (free + used ? 100 * used / (free + used) : 0).toFixed(0) + '%%"></div></div>'],
+    ["Entry credits", balance],
+    ["Clock", esc(s.timeSource) + " (" + esc(s.timeConfidence) + ")"],
+    ["Alerts", s.alerts ? s.alerts.slice(-3).map(a => esc(a.message)).join("<br>") : "None"],
+    ["Recalls", d.recalls ? '<span class="bad">' + d.recalls.map(r => esc(r.campaign) + ": " + esc(r.component)).join("<br>") + "</span>" : "None open"],
+  ]);
+}
+
+// once API tokens are issued, open the dashboard as /#token=<read-telemetry token>
+const params = new URLSearchParams(location.hash.slice(1));
+if (params.get("token")) {
+  localStorage.setItem("blackboxToken", params.get("token"));
+  history.replaceState(null, "", location.pathname);
+}
+const token = localStorage.getItem("blackboxToken");
+
+function poll() {
+  fetch("/dashboard", {headers: token ? {Authorization: "Bearer " + token} : {}}).then(r => r.json()).then(render).catch(e => console.log(e)).finally(() => setTimeout(poll, %d));
+}
+poll();
+</script>
+</body>
+</html>
+`
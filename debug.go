@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueDepth is how full one of the recorder's queues is
+type QueueDepth struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity,omitempty"` // 0 for unbounded queues
+}
+
+// MemoryStats is the part of runtime.MemStats worth looking at in the field
+type MemoryStats struct {
+	HeapAlloc    uint64 `json:"heapAlloc"`    // bytes of live heap objects
+	HeapSys      uint64 `json:"heapSys"`      // bytes of heap obtained from the OS
+	HeapObjects  uint64 `json:"heapObjects"`  // live heap objects
+	Sys          uint64 `json:"sys"`          // bytes obtained from the OS in total
+	TotalAlloc   uint64 `json:"totalAlloc"`   // bytes allocated since start
+	NumGC        uint32 `json:"numGC"`        // completed collections
+	PauseTotalNs uint64 `json:"pauseTotalNs"` // time stopped for collections
+}
+
+// Diagnostics is a snapshot of the recorder's runtime state returned by
+// GET /debug/dump. OBDErrors counts the OBD commands the vehicle failed to
+// answer since startup, by reading and error.
+type Diagnostics struct {
+	Time       time.Time             `json:"time"`
+	Goroutines int                   `json:"goroutines"`
+	Queues     map[string]QueueDepth `json:"queues"`
+	Memory     MemoryStats           `json:"memory"`
+	OBDErrors  map[string]int        `json:"obdErrors,omitempty"`
+	Tasks      []TaskStatus          `json:"tasks,omitempty"`
+	Stacks     string                `json:"stacks,omitempty"` // every goroutine's stack
+}
+
+// queueDepths returns the depth of the pipeline's channels and the anchor queue
+func (vehicle *Vehicle) queueDepths() map[string]QueueDepth {
+	queues := make(map[string]QueueDepth)
+	if p := vehicle.pipeline; p != nil {
+		queues["samples"] = QueueDepth{len(p.samples), cap(p.samples)}
+		queues["footage"] = QueueDepth{len(p.footage), cap(p.footage)}
+		queues["segments"] = QueueDepth{len(p.segments), cap(p.segments)}
+		queues["hashed"] = QueueDepth{len(p.hashed), cap(p.hashed)}
+		queues["batched"] = QueueDepth{len(p.batched), cap(p.batched)}
+		queues["anchoring"] = QueueDepth{len(p.anchoring), cap(p.anchoring)}
+		queues["results"] = QueueDepth{len(p.results), cap(p.results)}
+	}
+	if vehicle.anchors != nil {
+		queues["anchorQueue"] = QueueDepth{Length: vehicle.anchors.size()}
+	}
+	return queues
+}
+
+// diagnostics returns the recorder's runtime state, with goroutine stacks if asked
+func (vehicle *Vehicle) diagnostics(stacks bool) *Diagnostics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	d := &Diagnostics{
+		Time:       time.Now().UTC(),
+		Goroutines: runtime.NumGoroutine(),
+		Queues:     vehicle.queueDepths(),
+		Memory: MemoryStats{
+			HeapAlloc:    mem.HeapAlloc,
+			HeapSys:      mem.HeapSys,
+			HeapObjects:  mem.HeapObjects,
+			Sys:          mem.Sys,
+			TotalAlloc:   mem.TotalAlloc,
+			NumGC:        mem.NumGC,
+			PauseTotalNs: mem.PauseTotalNs,
+		},
+		Tasks:     vehicle.tasks.status(),
+		OBDErrors: vehicle.obdErrors.snapshot(),
+	}
+	if stacks {
+		var buf strings.Builder
+		rpprof.Lookup("goroutine").WriteTo(&buf, 2)
+		d.Stacks = buf.String()
+	}
+	return d
+}
+
+// publishVars exposes the recorder's queues, tasks and OBD errors on /debug/vars, once
+// per process as expvar names can't be published twice
+var publishVars sync.Once
+
+// debugRoutes adds pprof, expvar and the diagnostics dump under /debug/ to mux
+func (vehicle *Vehicle) debugRoutes(mux *http.ServeMux, tokens *tokenStore) {
+	publishVars.Do(func() {
+		expvar.Publish("queues", expvar.Func(func() interface{} { return vehicle.queueDepths() }))
+		expvar.Publish("tasks", expvar.Func(func() interface{} { return vehicle.tasks.status() }))
+		expvar.Publish("obdErrors", expvar.Func(func() interface{} { return vehicle.obdErrors.snapshot() }))
+	})
+	mux.HandleFunc("/debug/pprof/", tokens.require(ScopeDiagnostics, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", tokens.require(ScopeDiagnostics, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", tokens.require(ScopeDiagnostics, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", tokens.require(ScopeDiagnostics, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", tokens.require(ScopeDiagnostics, pprof.Trace))
+	mux.HandleFunc("/debug/vars", tokens.require(ScopeDiagnostics, expvar.Handler().ServeHTTP))
+	mux.HandleFunc("/debug/dump", tokens.require(ScopeDiagnostics, vehicle.handleDump))
+}
+
+// handleDump returns the recorder's diagnostics, with goroutine stacks
+// unless stacks=0
+func (vehicle *Vehicle) handleDump(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, vehicle.diagnostics(r.URL.Query().Get("stacks") != "0"))
+}
+
+// debugCommand inspects a running recorder through its API:
+//
+//	blackbox debug dump [-url http://127.0.0.1:8080] [-token <token>] [-o dump.json]
+//
+// The recorder's API must have debug enabled.
+func debugCommand(config *Config, args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: blackbox debug dump")
+		os.Exit(2)
+	}
+	url := "http://127.0.0.1:8080"
+	if config.API != nil && config.API.Listen != "" {
+		url = "http://" + config.API.Listen
+		if strings.HasPrefix(config.API.Listen, ":") {
+			url = "http://127.0.0.1" + config.API.Listen
+		}
+	}
+	flags := flag.NewFlagSet("debug dump", flag.ExitOnError)
+	base := flags.String("url", url, "Address of the recorder's API")
+	token := flags.String("token", os.Getenv("BLACKBOX_TOKEN"), "API token with the diagnostics scope, default $BLACKBOX_TOKEN")
+	out := flags.String("o", "", "File to write the dump to, default standard output")
+	flags.Parse(args[1:])
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*base, "/")+"/debug/dump", nil)
+	if err != nil {
+		fmt.Println("Invalid API address", err)
+		os.Exit(2)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Failed to reach the recorder", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Printf("The recorder answered %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+	var dump Diagnostics
+	if err := json.NewDecoder(resp.Body).Decode(&dump); err != nil {
+		fmt.Println("Failed to read the dump", err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		fmt.Println("Failed to encode the dump", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		fmt.Println("Failed to write the dump", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d goroutines, %d MB heap, written to %s\n", dump.Goroutines, dump.Memory.HeapAlloc>>20, *out)
+}
@@ -0,0 +1,537 @@
+package main
+
+// DID documents. Every identity chain is a DID, did:blackbox:<chain ID>, whose
+// document is built from the chain alone, so any resolver reading the chain
+// arrives at the same document:
+//
+//   - a person's chain, "Driver Identity Chain" and their key, is controlled
+//     by that key. The audience keys it publishes are its key agreement keys.
+//   - a vehicle's chain, "Vehicle Identity Chain" and its VIN, is controlled
+//     by the key signing its first signed entry, the first owner, until a
+//     transfer event signed by the controller hands it to the new owner.
+//
+// Either controller may publish service endpoints in signed "did-service"
+// entries on its chain.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// didPrefix starts the DID of an identity chain
+const didPrefix = "did:blackbox:"
+
+// didServiceEntry is the third ExtID of service endpoint entries
+// ExtIDs = [0]:signature, [1]:public key, [2]:"did-service", [3]:service id
+const didServiceEntry = "did-service"
+
+// Contexts and media type of DID documents and resolution results
+const (
+	didContext           = "https://www.w3.org/ns/did/v1"
+	didEd25519Context    = "https://w3id.org/security/suites/ed25519-2020/v1"
+	didX25519Context     = "https://w3id.org/security/suites/x25519-2020/v1"
+	didResolutionContext = "https://w3id.org/did-resolution/v1"
+	didResolutionType    = `application/ld+json;profile="https://w3id.org/did-resolution"`
+	didDocumentType      = "application/did+ld+json"
+)
+
+// x25519Multicodec prefixes an X25519 public key in a multibase key
+var x25519Multicodec = []byte{0xec, 0x01}
+
+// Resolution errors, as DID resolution metadata names them
+var (
+	errInvalidDID  = errors.New("invalidDid")
+	errDIDNotFound = errors.New("notFound")
+)
+
+// DIDDocument is a W3C DID document
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs,omitempty"` // urn:vin of a vehicle, did:key of a person
+	Controller         string               `json:"controller,omitempty"`  // the owner's DID, for a vehicle
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []string             `json:"authentication"`
+	AssertionMethod    []string             `json:"assertionMethod"`
+	KeyAgreement       []string             `json:"keyAgreement,omitempty"` // audience keys
+	Service            []DIDService         `json:"service,omitempty"`
+}
+
+// VerificationMethod is a public key of a DID document
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"` // Ed25519VerificationKey2020 or X25519KeyAgreementKey2020
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// DIDService is a service endpoint of a DID document, e.g. a fleet server
+// or the vehicle's API
+type DIDService struct {
+	ID              string `json:"id"` // fragment, e.g. "#api"
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// didServiceRecord is the content of a did-service entry, removing the
+// service with its ID if Removed is set
+type didServiceRecord struct {
+	DIDService
+	Time    time.Time `json:"time"`
+	Removed bool      `json:"removed,omitempty"`
+}
+
+// DIDResolution is the result of resolving a DID, as the DID resolution spec
+// and universal resolver drivers return it
+type DIDResolution struct {
+	Context            string              `json:"@context"`
+	DIDDocument        *DIDDocument        `json:"didDocument"`
+	ResolutionMetadata DIDResolutionMeta   `json:"didResolutionMetadata"`
+	DocumentMetadata   DIDDocumentMetadata `json:"didDocumentMetadata"`
+}
+
+// DIDResolutionMeta describes how a DID was resolved
+type DIDResolutionMeta struct {
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// DIDDocumentMetadata is the block times of the chain's first entry and of
+// the last entry changing the document
+type DIDDocumentMetadata struct {
+	Created   *time.Time `json:"created,omitempty"`
+	Updated   *time.Time `json:"updated,omitempty"`
+	VersionID string     `json:"versionId,omitempty"` // hash of that entry
+	ChainHead string     `json:"chainHead,omitempty"` // entry block the document was built as of
+}
+
+// chainDID returns the DID of an identity chain
+func chainDID(chainID string) string {
+	return didPrefix + chainID
+}
+
+// personDID returns the DID of the person with the given public key
+func personDID(identity []byte) string {
+	return chainDID(identityChainID(identity))
+}
+
+// parseDID returns the chain of a DID, also accepting a VIN for the
+// vehicle's
+func parseDID(did string) (string, error) {
+	if ValidateVIN(did) == nil {
+		return vehicleChainID(did), nil
+	}
+	chainID := strings.TrimPrefix(did, didPrefix)
+	if chainID == did {
+		return "", errInvalidDID
+	}
+	if raw, err := hex.DecodeString(chainID); err != nil || len(raw) != 32 || chainID != strings.ToLower(chainID) {
+		return "", errInvalidDID
+	}
+	return chainID, nil
+}
+
+// multibaseKey encodes a public key with its multicodec prefix as base58btc
+func multibaseKey(codec, pub []byte) string {
+	return "z" + base58Encode(append(append([]byte(nil), codec...), pub...))
+}
+
+// walkedEntry is an entry of a chain walked oldest first, with its block
+type walkedEntry struct {
+	entry *factom.Entry
+	hash  string
+	time  time.Time
+}
+
+// readChain returns every entry of a chain, oldest first, and its head. A
+// chain the reader doesn't know is errDIDNotFound.
+func readChain(reader chainReader, chainID string) ([]walkedEntry, string, error) {
+	head, err := reader.chainHead(chainID)
+	if err != nil {
+		return nil, "", err
+	}
+	if head == "" || head == zeroHash {
+		return nil, "", errDIDNotFound
+	}
+	var blocks [][]walkedEntry
+	walked := make(map[string]bool)
+	for keyMR := head; keyMR != "" && keyMR != zeroHash; {
+		if walked[keyMR] {
+			return nil, "", fmt.Errorf("entry block %s links back to itself", keyMR)
+		}
+		walked[keyMR] = true
+		eblock, err := reader.entryBlock(keyMR)
+		if err != nil {
+			return nil, "", err
+		} else if eblock == nil {
+			return nil, "", fmt.Errorf("entry block %s not found", keyMR)
+		}
+		block := make([]walkedEntry, 0, len(eblock.EntryList))
+		for _, listed := range eblock.EntryList {
+			entry, err := reader.entry(listed.EntryHash)
+			if err != nil {
+				return nil, "", err
+			} else if entry == nil {
+				return nil, "", fmt.Errorf("entry %s not found", listed.EntryHash)
+			}
+			block = append(block, walkedEntry{entry: entry, hash: listed.EntryHash, time: time.Unix(eblock.Header.Timestamp, 0).UTC()})
+		}
+		blocks = append(blocks, block)
+		keyMR = eblock.Header.PrevKeyMR
+	}
+	var entries []walkedEntry
+	for i := len(blocks) - 1; i >= 0; i-- {
+		entries = append(entries, blocks[i]...)
+	}
+	return entries, head, nil
+}
+
+// didService returns the service record an entry publishes, nil if it isn't a
+// did-service entry signed by key
+func didService(entry *factom.Entry, key []byte) *didServiceRecord {
+	ext := entry.ExtIDs
+	if len(ext) != 4 || string(ext[2]) != didServiceEntry || len(ext[0]) != ed.SignatureSize || entrySize(entry) > maxEntrySize {
+		return nil
+	}
+	if len(key) != ed.PublicKeySize || !bytes.Equal(ext[1], key) {
+		return nil
+	}
+	var public [ed.PublicKeySize]byte
+	var signature [ed.SignatureSize]byte
+	copy(public[:], key)
+	copy(signature[:], ext[0])
+	if !ed.Verify(&public, entry.Content, &signature) {
+		return nil
+	}
+	record := new(didServiceRecord)
+	if err := json.Unmarshal(entry.Content, record); err != nil || record.ID != string(ext[3]) || !strings.HasPrefix(record.ID, "#") {
+		return nil
+	}
+	return record
+}
+
+// didDocumentState accumulates a DID document while its chain is walked
+type didDocumentState struct {
+	doc      *DIDDocument
+	meta     DIDDocumentMetadata
+	services map[string]DIDService
+	order    []string // service IDs as first published
+}
+
+// changed records that entry changed the document
+func (s *didDocumentState) changed(entry walkedEntry) {
+	s.meta.Updated, s.meta.VersionID = &entry.time, entry.hash
+}
+
+// addService applies a service record
+func (s *didDocumentState) addService(record *didServiceRecord) {
+	if record.Removed {
+		delete(s.services, record.ID)
+		return
+	}
+	if _, ok := s.services[record.ID]; !ok {
+		s.order = append(s.order, record.ID)
+	}
+	s.services[record.ID] = record.DIDService
+}
+
+// setController makes key the document's Ed25519 verification method,
+// controlled by controller
+func (s *didDocumentState) setController(key []byte, controller string) {
+	id := s.doc.ID + "#" + multibaseKey(ed25519Multicodec, key)
+	s.doc.VerificationMethod = []VerificationMethod{{ID: id, Type: "Ed25519VerificationKey2020", Controller: controller, PublicKeyMultibase: multibaseKey(ed25519Multicodec, key)}}
+	s.doc.Authentication, s.doc.AssertionMethod = []string{id}, []string{id}
+}
+
+// finish returns the resolution of the document
+func (s *didDocumentState) finish(head string) *DIDResolution {
+	for _, id := range s.order {
+		if service, ok := s.services[id]; ok {
+			service.ID = s.doc.ID + service.ID
+			s.doc.Service = append(s.doc.Service, service)
+		}
+	}
+	s.meta.ChainHead = head
+	return &DIDResolution{
+		Context:            didResolutionContext,
+		DIDDocument:        s.doc,
+		ResolutionMetadata: DIDResolutionMeta{ContentType: didDocumentType},
+		DocumentMetadata:   s.meta,
+	}
+}
+
+// resolvePerson builds the document of a person's identity chain
+func resolvePerson(did string, entries []walkedEntry) (*didDocumentState, error) {
+	identity := entries[0].entry.ExtIDs[1]
+	if len(identity) != ed.PublicKeySize || identityChainID(identity) != strings.TrimPrefix(did, didPrefix) {
+		return nil, errors.New("the chain's first entry doesn't name the key its ID is derived from")
+	}
+	s := &didDocumentState{
+		doc:      &DIDDocument{Context: []string{didContext, didEd25519Context, didX25519Context}, ID: did, AlsoKnownAs: []string{didKey(identity)}},
+		services: make(map[string]DIDService),
+	}
+	s.setController(identity, did)
+	audiences := make(map[string]*AudienceKey)
+	var order []string
+	for _, e := range entries[1:] {
+		if key := audienceKey(e.entry, identity); key != nil {
+			if latest, ok := audiences[key.Audience]; !ok || key.Time.After(latest.Time) {
+				if !ok {
+					order = append(order, key.Audience)
+				}
+				audiences[key.Audience] = key
+				s.changed(e)
+			}
+		} else if record := didService(e.entry, identity); record != nil {
+			s.addService(record)
+			s.changed(e)
+		}
+	}
+	for _, audience := range order {
+		public, _ := hex.DecodeString(audiences[audience].Key)
+		id := did + "#audience-" + audience
+		s.doc.VerificationMethod = append(s.doc.VerificationMethod, VerificationMethod{
+			ID: id, Type: "X25519KeyAgreementKey2020", Controller: did, PublicKeyMultibase: multibaseKey(x25519Multicodec, public),
+		})
+		s.doc.KeyAgreement = append(s.doc.KeyAgreement, id)
+	}
+	return s, nil
+}
+
+// resolveVehicle builds the document of a vehicle's identity chain, following
+// its transfers to the current owner
+func resolveVehicle(did string, entries []walkedEntry) (*didDocumentState, error) {
+	vin := string(entries[0].entry.ExtIDs[1])
+	if vehicleChainID(vin) != strings.TrimPrefix(did, didPrefix) {
+		return nil, errors.New("the chain's first entry doesn't name the VIN its ID is derived from")
+	}
+	s := &didDocumentState{
+		doc:      &DIDDocument{Context: []string{didContext, didEd25519Context}, ID: did, AlsoKnownAs: []string{vinURN(vin)}},
+		services: make(map[string]DIDService),
+	}
+	// only reads entries, the owner it would compare signing keys to is unset
+	indexer := &Vehicle{vin: vin}
+	var owner []byte
+	for _, e := range entries[1:] {
+		if owner != nil {
+			if record := didService(e.entry, owner); record != nil {
+				s.addService(record)
+				s.changed(e)
+				continue
+			}
+		}
+		indexed := indexer.indexEntry(e.entry)
+		if !indexed.Verified || (indexed.Kind != EntryKindHash && indexed.Kind != EntryKindEvent) {
+			continue
+		}
+		key, _ := hex.DecodeString(indexed.SigningKey)
+		if owner == nil {
+			// the first signed entry is the first owner's
+			owner = key
+			s.changed(e)
+			continue
+		}
+		if indexed.EventType != "transfer" || !bytes.Equal(key, owner) {
+			continue
+		}
+		var event Event
+		if json.Unmarshal(indexed.Event, &event) != nil || event.VIN != vin || event.Data["from"] != indexed.SigningKey {
+			continue
+		}
+		to, _ := event.Data["to"].(string)
+		if next, err := hex.DecodeString(to); err == nil && len(next) == ed.PublicKeySize {
+			owner = next
+			// services were the previous owner's
+			s.services, s.order = make(map[string]DIDService), nil
+			s.changed(e)
+		}
+	}
+	if owner == nil {
+		// registered, but nothing was signed on it yet
+		s.doc.VerificationMethod, s.doc.Authentication, s.doc.AssertionMethod = []VerificationMethod{}, []string{}, []string{}
+		return s, nil
+	}
+	s.doc.Controller = personDID(owner)
+	s.setController(owner, s.doc.Controller)
+	return s, nil
+}
+
+// didCache holds resolved documents by chain head, so a chain is only walked
+// again once it has grown
+type didCache struct {
+	mu       sync.Mutex
+	resolved map[string]*DIDResolution // by DID
+}
+
+var resolvedDIDs = &didCache{resolved: make(map[string]*DIDResolution)}
+
+// ResolveDID returns the DID document of an identity chain read through
+// reader. did may also be a VIN, resolving the vehicle's DID.
+func ResolveDID(reader chainReader, did string) (*DIDResolution, error) {
+	chainID, err := parseDID(did)
+	if err != nil {
+		return nil, err
+	}
+	did = chainDID(chainID)
+	head, err := reader.chainHead(chainID)
+	if err != nil {
+		return nil, err
+	}
+	resolvedDIDs.mu.Lock()
+	cached := resolvedDIDs.resolved[did]
+	resolvedDIDs.mu.Unlock()
+	if cached != nil && head != "" && cached.DocumentMetadata.ChainHead == head {
+		return cached, nil
+	}
+
+	entries, head, err := readChain(reader, chainID)
+	if err != nil {
+		return nil, err
+	}
+	first := entries[0].entry.ExtIDs
+	var s *didDocumentState
+	switch {
+	case len(first) == 2 && string(first[0]) == "Driver Identity Chain":
+		s, err = resolvePerson(did, entries)
+	case len(first) == 2 && string(first[0]) == "Vehicle Identity Chain":
+		s, err = resolveVehicle(did, entries)
+	default:
+		return nil, errDIDNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.meta.Created = &entries[0].time
+	if s.meta.Updated == nil {
+		s.changed(entries[0])
+	}
+	resolution := s.finish(head)
+	resolvedDIDs.mu.Lock()
+	resolvedDIDs.resolved[did] = resolution
+	resolvedDIDs.mu.Unlock()
+	return resolution, nil
+}
+
+// PublishDIDService signs and anchors a service record on chainID, the
+// person's identity chain or that of a vehicle they own, and returns the txID
+// ExtIDs = [0]:signature, [1]:public key, [2]:"did-service", [3]:service id
+func (person *Person) PublishDIDService(chainID string, record didServiceRecord) (string, error) {
+	if !strings.HasPrefix(record.ID, "#") || len(record.ID) < 2 {
+		return "", fmt.Errorf("service id %q must be a fragment, e.g. #api", record.ID)
+	}
+	if !record.Removed && (record.Type == "" || record.ServiceEndpoint == "") {
+		return "", errors.New("a service needs a type and an endpoint")
+	}
+	record.Time = time.Now().UTC()
+	content, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	signature := ed.Sign(person.ecAddress.Sec, content)
+	entry := &factom.Entry{
+		ChainID: chainID,
+		ExtIDs:  [][]byte{signature[:], person.ecAddress.PubBytes(), []byte(didServiceEntry), []byte(record.ID)},
+		Content: content,
+	}
+	return commitRevealEntry(person.chain, defaultRetry, entry, person.ecAddress)
+}
+
+// handleResolveDID resolves the DID in the path, like a universal resolver
+// driver: GET /1.0/identifiers/{did}
+func (vehicle *Vehicle) handleResolveDID(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	did := strings.TrimPrefix(r.URL.Path, "/1.0/identifiers/")
+	resolution, err := ResolveDID(vehicle.chain, did)
+	status := http.StatusOK
+	switch err {
+	case nil:
+	case errInvalidDID:
+		status = http.StatusBadRequest
+	case errDIDNotFound:
+		status = http.StatusNotFound
+	default:
+		status = http.StatusBadGateway
+	}
+	if err != nil {
+		resolution = &DIDResolution{Context: didResolutionContext, ResolutionMetadata: DIDResolutionMeta{Error: err.Error()}}
+		if status == http.StatusBadGateway {
+			resolution.ResolutionMetadata = DIDResolutionMeta{Error: "internalError", Message: err.Error()}
+		}
+	}
+	w.Header().Set("Content-Type", didResolutionType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resolution)
+}
+
+// didCommand shows, resolves and publishes services of DIDs:
+//
+//	blackbox did show
+//	blackbox did resolve <did or VIN>
+//	blackbox did add-service -person|-vehicle -id #name -type <type> -endpoint <url>
+//	blackbox did remove-service -person|-vehicle -id #name
+func didCommand(vehicle *Vehicle, person *Person, args []string) {
+	usage := "usage: blackbox did show|resolve|add-service|remove-service"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "show":
+		fmt.Printf("Vehicle %s: %s\n", vehicle.vin, chainDID(vehicle.chainID))
+		fmt.Printf("Owner: %s\n", chainDID(person.chainID))
+	case "resolve":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox did resolve <did or VIN>")
+			os.Exit(2)
+		}
+		resolution, err := ResolveDID(vehicle.chain, args[1])
+		if err != nil {
+			fmt.Println("Failed to resolve", args[1], err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(resolution, "", "  ")
+		fmt.Println(string(out))
+	case "add-service", "remove-service":
+		flags := flag.NewFlagSet("did "+args[0], flag.ExitOnError)
+		onPerson := flags.Bool("person", false, "Publish on the owner's identity chain")
+		onVehicle := flags.Bool("vehicle", false, "Publish on the vehicle's chain")
+		id := flags.String("id", "", "Service id, a fragment, e.g. #api")
+		kind := flags.String("type", "", "Service type, e.g. BlackboxAPI or FleetServer")
+		endpoint := flags.String("endpoint", "", "Service endpoint URL")
+		flags.Parse(args[1:])
+		if *onPerson == *onVehicle {
+			fmt.Fprintln(os.Stderr, "usage: blackbox did "+args[0]+" -person|-vehicle -id #name [-type <type> -endpoint <url>]")
+			os.Exit(2)
+		}
+		record := didServiceRecord{DIDService: DIDService{ID: *id, Type: *kind, ServiceEndpoint: *endpoint}, Removed: args[0] == "remove-service"}
+		chainID, did := person.chainID, chainDID(person.chainID)
+		if *onVehicle {
+			chainID, did = vehicle.chainID, chainDID(vehicle.chainID)
+		}
+		txID, err := person.PublishDIDService(chainID, record)
+		if err != nil {
+			fmt.Println("Failed to publish the service", err)
+			os.Exit(1)
+		}
+		appendAudit("did-service", map[string]interface{}{"via": "cli", "did": did, "id": *id, "type": *kind, "endpoint": *endpoint, "removed": record.Removed, "txID": txID})
+		fmt.Printf("Service %s of %s published. TxID: %s\n", *id, did, txID)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Storage levels, each degrading recording further to keep it running
+const (
+	storageNormal    = iota
+	storageLow       // video is captured at reduced quality
+	storageCritical  // retention periods are shortened and pruning runs now
+	storageEmergency // hash-only: raw data is hashed and anchored but not kept
+)
+
+var storageLevelNames = []string{"normal", "low", "critical", "emergency"}
+
+// diskCheckInterval is how often free space is measured
+const diskCheckInterval = time.Minute
+
+// errDiskUnsupported is returned by freeBytes where free space can't be measured
+var errDiskUnsupported = errors.New("disk space monitoring is only supported on linux")
+
+// DiskConfig sets the free space thresholds, in megabytes, of each storage level
+type DiskConfig struct {
+	Path        string `json:"path"` // filesystem to watch, default the working directory
+	LowMB       uint64 `json:"lowMB"`
+	CriticalMB  uint64 `json:"criticalMB"`
+	EmergencyMB uint64 `json:"emergencyMB"`
+}
+
+// storageMonitor tracks the current storage level, shared between recorders
+type storageMonitor struct {
+	mu    sync.Mutex
+	level int
+	free  uint64 // bytes free at the last measurement
+}
+
+func (m *storageMonitor) get() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.level
+}
+
+func (m *storageMonitor) set(level int, free uint64) (changed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed = level != m.level
+	m.level = level
+	m.free = free
+	return changed
+}
+
+// lastFree returns the bytes free at the last measurement, 0 if never measured
+func (m *storageMonitor) lastFree() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.free
+}
+
+// hashOnly returns true if raw data should not be written to disk
+func (m *storageMonitor) hashOnly() bool {
+	return m.get() >= storageEmergency
+}
+
+// storageLevel classifies free bytes against the configured thresholds
+func storageLevel(free uint64, config DiskConfig) int {
+	const mb = 1 << 20
+	switch {
+	case free < config.EmergencyMB*mb:
+		return storageEmergency
+	case free < config.CriticalMB*mb:
+		return storageCritical
+	case free < config.LowMB*mb:
+		return storageLow
+	}
+	return storageNormal
+}
+
+// shortenRetention halves every limited retention period, keeping at least a day
+func shortenRetention(config RetentionConfig) RetentionConfig {
+	shorten := func(days int) int {
+		if days > 1 {
+			days /= 2
+		}
+		return days
+	}
+	return RetentionConfig{VideoDays: shorten(config.VideoDays), OBDDays: shorten(config.OBDDays)}
+}
+
+// MonitorDisk measures free space every diskCheckInterval and moves the vehicle
+// between storage levels, alerting the owner on every change, until stop is
+// closed
+func (vehicle *Vehicle) MonitorDisk(config DiskConfig, retention RetentionConfig, stop <-chan struct{}) error {
+	path := config.Path
+	if path == "" {
+		path = "."
+	}
+	for {
+		free, err := freeBytes(path)
+		if err == errDiskUnsupported {
+			fmt.Println("Disk space monitoring stopped", err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("measuring free space of %s: %v", path, err)
+		}
+		level := storageLevel(free, config)
+		if vehicle.storage.set(level, free) {
+			vehicle.raiseAlert("storage-"+storageLevelNames[level],
+				fmt.Sprintf("storage is %s, %d MB free", storageLevelNames[level], free>>20),
+				map[string]interface{}{"freeBytes": free})
+			appendAudit("storage-level", map[string]interface{}{"level": storageLevelNames[level], "freeBytes": free})
+		}
+		if level >= storageCritical {
+			if err := vehicle.Prune(shortenRetention(retention), time.Now()); err != nil {
+				fmt.Println("Emergency pruning failed", err)
+			}
+		}
+		if !sleep(diskCheckInterval, stop) {
+			return nil
+		}
+	}
+}
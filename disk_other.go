@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errDiskUnsupported
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// driversPath holds the drivers who may be assigned to the vehicle, with
+// their identity keys
+const driversPath = "drivers.json"
+
+// Driver authentication settings
+const (
+	driverAuthAttempts = 5               // wrong credentials allowed before authentication locks
+	driverAuthLockout  = 5 * time.Minute // how long it stays locked
+)
+
+// Ways a driver authenticates at the start of a trip
+const (
+	DriverAuthPIN = "pin"
+	DriverAuthNFC = "nfc" // tag UID passed on by the reader
+	DriverAuthBLE = "ble" // command signed by the driver's paired phone
+)
+
+// Driver may drive the vehicle. Their identity key is kept on the device and
+// countersigns the entries recorded while they are assigned to the vehicle,
+// which they are once they authenticate.
+type Driver struct {
+	Name    string    `json:"name"`
+	Key     string    `json:"key"`               // hex ed25519 public identity key
+	Secret  string    `json:"secret"`            // hex ed25519 private key
+	PINHash string    `json:"pinHash,omitempty"` // hex SHA-256 of Salt and the PIN
+	Salt    string    `json:"salt,omitempty"`
+	NFC     string    `json:"nfc,omitempty"`   // UID of the driver's NFC tag
+	Phone   string    `json:"phone,omitempty"` // hex key of the driver's paired phone
+	Added   time.Time `json:"added"`
+}
+
+// DriverAssignment is the driver of the vehicle from Since
+type DriverAssignment struct {
+	VIN    string    `json:"vin"`
+	Driver string    `json:"driver"`
+	Key    string    `json:"key"`    // the driver's public identity key
+	Method string    `json:"method"` // how they authenticated
+	Since  time.Time `json:"since"`
+}
+
+// driverRoster holds the vehicle's drivers and the one assigned, shared
+// between recorders
+type driverRoster struct {
+	mu          sync.Mutex
+	drivers     []Driver
+	active      *DriverAssignment
+	failed      int
+	lockedUntil time.Time
+}
+
+// loadDrivers returns the vehicle's drivers, none if nobody was ever added
+func loadDrivers() ([]Driver, error) {
+	data, err := ioutil.ReadFile(driversPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var drivers []Driver
+	return drivers, json.Unmarshal(data, &drivers)
+}
+
+func saveDrivers(drivers []Driver) error {
+	data, err := json.MarshalIndent(drivers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(driversPath, data)
+}
+
+// pinHash returns the hex SHA-256 of salt and pin
+func pinHash(salt, pin string) string {
+	sum := sha256.Sum256([]byte(salt + pin))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the driver the credential identifies: the PIN of the
+// named driver, an NFC tag UID or a paired phone's key. Wrong credentials
+// lock authentication for driverAuthLockout after driverAuthAttempts.
+func (r *driverRoster) authenticate(method, name, credential string) (*Driver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.lockedUntil) {
+		return nil, fmt.Errorf("driver authentication locked, try again later")
+	}
+	for i := range r.drivers {
+		d := &r.drivers[i]
+		var ok bool
+		switch method {
+		case DriverAuthPIN:
+			ok = d.Name == name && d.PINHash != "" &&
+				subtle.ConstantTimeCompare([]byte(pinHash(d.Salt, credential)), []byte(d.PINHash)) == 1
+		case DriverAuthNFC:
+			ok = d.NFC != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(d.NFC)) == 1
+		case DriverAuthBLE:
+			ok = d.Phone != "" && d.Phone == credential
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+		if ok {
+			r.failed = 0
+			driver := *d
+			return &driver, nil
+		}
+	}
+	if r.failed++; r.failed >= driverAuthAttempts {
+		r.failed = 0
+		r.lockedUntil = time.Now().Add(driverAuthLockout)
+	}
+	return nil, fmt.Errorf("unknown driver or credential")
+}
+
+// assign makes assignment the vehicle's from now on
+func (r *driverRoster) assign(assignment *DriverAssignment) {
+	r.mu.Lock()
+	r.active = assignment
+	r.mu.Unlock()
+}
+
+// assignment returns the driver assigned to the vehicle, nil if none is
+func (r *driverRoster) assignment() *DriverAssignment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		return nil
+	}
+	assignment := *r.active
+	return &assignment
+}
+
+// release ends the assignment, if any, and returns it
+func (r *driverRoster) release() *DriverAssignment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assignment := r.active
+	r.active = nil
+	return assignment
+}
+
+// activeKey returns the public key of the driver assigned, "" if none is
+func (r *driverRoster) activeKey() string {
+	if assignment := r.assignment(); assignment != nil {
+		return assignment.Key
+	}
+	return ""
+}
+
+// registered returns true if any driver was added to the vehicle
+func (r *driverRoster) registered() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.drivers) > 0
+}
+
+// countersign signs message with the identity key of the driver whose public
+// key is given. Entries are countersigned when they are anchored, which may
+// be after the driver's assignment has ended, so any of the vehicle's
+// drivers can sign.
+func (r *driverRoster) countersign(key string, message []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.drivers {
+		if d.Key != key {
+			continue
+		}
+		secret, err := hex.DecodeString(d.Secret)
+		if err != nil || len(secret) != ed.PrivateKeySize {
+			return nil, fmt.Errorf("driver %s has an invalid key", d.Name)
+		}
+		var private [ed.PrivateKeySize]byte
+		copy(private[:], secret)
+		return ed.Sign(&private, message)[:], nil
+	}
+	return nil, fmt.Errorf("no driver with key %s", key)
+}
+
+// verifyDriverSig checks the hex signature sig of message by the driver with
+// the hex public key
+func verifyDriverSig(key, sig string, message []byte) bool {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil || len(keyBytes) != ed.PublicKeySize {
+		return false
+	}
+	sigBytes, err := hex.DecodeString(sig)
+	if err != nil || len(sigBytes) != ed.SignatureSize {
+		return false
+	}
+	var public [ed.PublicKeySize]byte
+	var signature [ed.SignatureSize]byte
+	copy(public[:], keyBytes)
+	copy(signature[:], sigBytes)
+	return ed.Verify(&public, message, &signature)
+}
+
+// driverSigned returns what the driver of a hash entry countersigns: its
+// content followed by its metadata without the countersignature
+func driverSigned(content []byte, meta HashMeta) []byte {
+	meta.DriverSig = ""
+	metaJSON, _ := json.Marshal(meta)
+	return append(append([]byte(nil), content...), metaJSON...)
+}
+
+// AssignDriver authenticates a driver and assigns them to the vehicle until
+// the trip ends, anchoring a "driver-assigned" event the driver countersigns,
+// and returns its txID. details, e.g. who relayed the credential, are audited.
+func (vehicle *Vehicle) AssignDriver(method, name, credential string, details map[string]interface{}) (*DriverAssignment, string, error) {
+	driver, err := vehicle.drivers.authenticate(method, name, credential)
+	audit := map[string]interface{}{"method": method, "driver": name}
+	for k, v := range details {
+		audit[k] = v
+	}
+	if err != nil {
+		audit["error"] = err.Error()
+		appendAudit("driver-auth-failed", audit)
+		return nil, "", err
+	}
+	assignment := &DriverAssignment{VIN: vehicle.vin, Driver: driver.Name, Key: driver.Key, Method: method, Since: time.Now().UTC()}
+	statement, err := json.Marshal(assignment)
+	if err != nil {
+		return nil, "", err
+	}
+	sig, err := vehicle.drivers.countersign(driver.Key, statement)
+	if err != nil {
+		return nil, "", err
+	}
+	vehicle.drivers.assign(assignment)
+	audit["driver"] = driver.Name
+	appendAudit("driver-assigned", audit)
+
+	data := toEventData(assignment)
+	data["driverSig"] = hex.EncodeToString(sig)
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("driver-assigned", data), true)
+	return assignment, txID, err
+}
+
+// startTrip alerts the owner when a trip starts without a driver assigned
+// while the vehicle has drivers who could have authenticated
+func (vehicle *Vehicle) startTrip() {
+	if vehicle.drivers.assignment() == nil && vehicle.drivers.registered() {
+		vehicle.raiseAlert("unidentified-driver", "trip started without a driver authenticating", nil)
+	}
+}
+
+// endTrip releases the driver assigned for the trip that just ended
+func (vehicle *Vehicle) endTrip() {
+	if assignment := vehicle.drivers.release(); assignment != nil {
+		appendAudit("driver-released", map[string]interface{}{"driver": assignment.Driver, "since": assignment.Since})
+	}
+}
+
+// driverCommand manages the drivers who may be assigned to the vehicle:
+//
+//	blackbox driver add -name <name> [-pin <pin>] [-nfc <uid>] [-phone <key>]
+//	blackbox driver remove -name <name>
+//	blackbox driver list
+func driverCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox driver add|remove|list")
+		os.Exit(2)
+	}
+	drivers, err := loadDrivers()
+	if err != nil {
+		fmt.Println("Failed to read drivers", err)
+		os.Exit(1)
+	}
+	flags := flag.NewFlagSet("driver "+args[0], flag.ExitOnError)
+	name := flags.String("name", "", "Name of the driver")
+	pin := flags.String("pin", "", "PIN the driver authenticates with")
+	nfc := flags.String("nfc", "", "UID of the driver's NFC tag")
+	phone := flags.String("phone", "", "Hex key of the driver's paired phone")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "add":
+		if *name == "" || (*pin == "" && *nfc == "" && *phone == "") {
+			fmt.Fprintln(os.Stderr, "usage: blackbox driver add -name <name> [-pin <pin>] [-nfc <uid>] [-phone <key>]")
+			os.Exit(2)
+		}
+		for _, d := range drivers {
+			if d.Name == *name {
+				fmt.Printf("Driver %s already exists\n", *name)
+				os.Exit(1)
+			}
+		}
+		public, private, err := ed.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Println("Failed to generate the driver's key", err)
+			os.Exit(1)
+		}
+		driver := Driver{
+			Name:   *name,
+			Key:    hex.EncodeToString(public[:]),
+			Secret: hex.EncodeToString(private[:]),
+			NFC:    *nfc,
+			Phone:  *phone,
+			Added:  time.Now().UTC(),
+		}
+		if *pin != "" {
+			salt := make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				fmt.Println("Failed to generate a salt", err)
+				os.Exit(1)
+			}
+			driver.Salt = hex.EncodeToString(salt)
+			driver.PINHash = pinHash(driver.Salt, *pin)
+		}
+		if err := saveDrivers(append(drivers, driver)); err != nil {
+			fmt.Println("Failed to save drivers", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Driver %s added, identity key %s\n", driver.Name, driver.Key)
+	case "remove":
+		kept := drivers[:0]
+		for _, d := range drivers {
+			if d.Name != *name {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) == len(drivers) {
+			fmt.Printf("No driver %q\n", *name)
+			os.Exit(1)
+		}
+		if err := saveDrivers(kept); err != nil {
+			fmt.Println("Failed to save drivers", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Driver %s removed\n", *name)
+	case "list":
+		for _, d := range drivers {
+			var methods []string
+			if d.PINHash != "" {
+				methods = append(methods, DriverAuthPIN)
+			}
+			if d.NFC != "" {
+				methods = append(methods, DriverAuthNFC)
+			}
+			if d.Phone != "" {
+				methods = append(methods, DriverAuthBLE)
+			}
+			fmt.Printf("%s  %s  %v\n", d.Name, d.Key, methods)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown driver command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// driverRequest is the body of POST /driver, the credential a driver entered
+// or a reader read
+type driverRequest struct {
+	Driver string `json:"driver,omitempty"` // name, with pin
+	PIN    string `json:"pin,omitempty"`
+	NFC    string `json:"nfc,omitempty"` // tag UID
+}
+
+// handleDriver assigns the driver a credential identifies to the vehicle
+func (vehicle *Vehicle) handleDriver(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req driverRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	method, credential := DriverAuthPIN, req.PIN
+	if req.NFC != "" {
+		method, credential = DriverAuthNFC, req.NFC
+	} else if req.PIN == "" {
+		writeError(w, http.StatusBadRequest, errors.New("pin with driver, or nfc required"))
+		return
+	}
+	assignment, txID, err := vehicle.AssignDriver(method, req.Driver, credential, requestDetails(r))
+	if assignment == nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		// assigned, only the event failed to anchor
+		fmt.Println("Failed to anchor driver assignment", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"assignment": assignment, "txID": txID})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EDR data set settings, after the data elements, recording intervals and sign
+// conventions of 49 CFR Part 563. Time zero is the start of the crash pulse.
+const (
+	edrPreCrash         = 5 * time.Second        // pre-crash data recorded before time zero
+	edrPreCrashInterval = 500 * time.Millisecond // pre-crash data is recorded at 2 samples per second
+	edrDeltaVWindow     = 250 * time.Millisecond // delta-V and accelerations recorded after time zero
+	edrDeltaVInterval   = 10 * time.Millisecond  // delta-V is recorded every 10 ms
+	edrMaxDeltaVWindow  = 300 * time.Millisecond // maximum delta-V is looked for until then
+	edrRecordingTime    = 350 * time.Millisecond // IMU samples kept after the trigger before the report is made
+	edrMultiEvent       = 5 * time.Second        // a crash this soon after another is its second event
+	edrTimeZeroDeltaV   = 0.8                    // km/h of longitudinal delta-V within 20 ms starting the crash pulse
+	edrTimeZeroWindow   = 20 * time.Millisecond
+	edrTimeZeroSearch   = time.Second // how long before the trigger time zero is looked for
+	edrSaturationG      = 7.9         // the IMU's ±8g range clips accelerations this strong
+	edrOBDHistory       = edrPreCrash + 2*normalSampleInterval
+	standardGravity     = 9.80665 // m/s² in 1g
+)
+
+// Status of an EDR data element
+const (
+	edrRecorded    = "recorded"
+	edrReducedRate = "recorded below the mandated rate"
+	edrUnavailable = "not available"
+)
+
+// obdUnavailable explains elements the vehicle's ECUs hold but don't report
+// over OBD-II
+const obdUnavailable = "not reported over OBD-II"
+
+// EDRReport is the crash data set recorded for each crash, its elements named
+// and sampled as 49 CFR Part 563 requires where this device can measure them.
+// It is anchored like the incident record it accompanies, whose anchored IMU
+// history and OBD segment hold the raw data it is computed from.
+type EDRReport struct {
+	VIN          string       `json:"vin"`
+	TimeZero     time.Time    `json:"timeZero"` // start of the crash pulse, elements are timed from it
+	Trigger      HarshEvent   `json:"trigger"`
+	Event        int          `json:"event"`                  // 1, or 2 for a crash within 5 s of another
+	Incident     string       `json:"incident"`               // incident record of the same crash
+	IncidentHash string       `json:"incidentHash,omitempty"` // sha256 of the incident record as anchored
+	Segment      string       `json:"segment,omitempty"`      // OBD segment holding the pre-crash readings
+	Complete     bool         `json:"complete"`               // both the pre-crash and the delta-V windows were fully recorded
+	Saturated    bool         `json:"saturated,omitempty"`    // the pulse exceeded the IMU's range, delta-V is understated
+	Elements     []EDRElement `json:"elements"`
+	IMU          []IMUSample  `json:"imu"` // raw samples around time zero, earlier ones are in the incident record
+}
+
+// EDRElement is one data element of the EDR data set
+type EDRElement struct {
+	Name     string     `json:"name"`               // as named in Part 563
+	Required bool       `json:"required,omitempty"` // in Table I, recorded by every EDR
+	Status   string     `json:"status"`
+	Units    string     `json:"units,omitempty"`
+	Source   string     `json:"source,omitempty"`   // "obd", "imu" or "obd+imu"
+	Interval int        `json:"interval,omitempty"` // ms between values, the longest for held OBD readings
+	Value    *float64   `json:"value,omitempty"`    // single-valued elements
+	Values   []EDRValue `json:"values,omitempty"`   // time series
+	Note     string     `json:"note,omitempty"`
+}
+
+// EDRValue is one value of a time series, Ms milliseconds from time zero
+type EDRValue struct {
+	Ms    int     `json:"ms"`
+	Value float64 `json:"value"`
+}
+
+// edrCrash is a crash awaiting its post-impact IMU samples
+type edrCrash struct {
+	trigger  *HarshEvent
+	previous time.Time // trigger of a crash edrMultiEvent before, if any
+	interval time.Duration
+}
+
+// readingValue returns reading index of record as a number, false if it
+// failed or isn't one
+func readingValue(record *OBDRecord, index int) (float64, bool) {
+	if record == nil || index >= len(record.Readings) || record.Readings[index].Error != "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(record.Readings[index].Value, 64)
+	return value, err == nil
+}
+
+// integrate returns the velocity change, in km/h, of the acceleration accel
+// picks from each sample, at each sample after zero
+func integrate(samples []IMUSample, zero time.Time, accel func(IMUSample) float64) ([]time.Duration, []float64) {
+	times, velocities := []time.Duration{0}, []float64{0}
+	for i := 1; i < len(samples); i++ {
+		if !samples[i].Time.After(zero) {
+			continue
+		}
+		from := samples[i-1].Time
+		if from.Before(zero) {
+			from = zero
+		}
+		dt := samples[i].Time.Sub(from).Seconds()
+		mean := (accel(samples[i-1]) + accel(samples[i])) / 2
+		times = append(times, samples[i].Time.Sub(zero))
+		velocities = append(velocities, velocities[len(velocities)-1]+mean*standardGravity*dt*3.6)
+	}
+	return times, velocities
+}
+
+// resample interpolates values at times every interval up to window, stopping
+// early where the values end
+func resample(times []time.Duration, values []float64, interval, window time.Duration) []EDRValue {
+	var series []EDRValue
+	j := 0
+	for t := time.Duration(0); t <= window; t += interval {
+		for j+1 < len(times) && times[j+1] < t {
+			j++
+		}
+		if j+1 >= len(times) {
+			if times[j] == t {
+				series = append(series, EDRValue{Ms: int(t / time.Millisecond), Value: round(values[j], 2)})
+			}
+			break
+		}
+		f := float64(t-times[j]) / float64(times[j+1]-times[j])
+		series = append(series, EDRValue{Ms: int(t / time.Millisecond), Value: round(values[j]+f*(values[j+1]-values[j]), 2)})
+	}
+	return series
+}
+
+// round rounds v to digits decimals
+func round(v float64, digits int) float64 {
+	scale := math.Pow(10, float64(digits))
+	return math.Round(v*scale)/scale + 0 // no "-0"
+}
+
+// edrTimeZero finds the start of the crash pulse: the first sample within a
+// second before the trigger from which longitudinal delta-V exceeds 0.8 km/h
+// within 20 ms, or the sample after it. It is the trigger if none does.
+func edrTimeZero(samples []IMUSample, trigger time.Time) time.Time {
+	longitudinal := func(s IMUSample) float64 { return s.Accel[0] }
+	for i := range samples {
+		if samples[i].Time.Before(trigger.Add(-edrTimeZeroSearch)) {
+			continue
+		}
+		if samples[i].Time.After(trigger) {
+			break
+		}
+		window := samples[i:]
+		for j := 1; j < len(window); j++ {
+			if j > 1 && window[j].Time.Sub(window[0].Time) > edrTimeZeroWindow {
+				window = window[:j]
+				break
+			}
+		}
+		_, velocities := integrate(window, window[0].Time, longitudinal)
+		if math.Abs(velocities[len(velocities)-1]) >= edrTimeZeroDeltaV {
+			return samples[i].Time
+		}
+	}
+	return trigger
+}
+
+// deltaVElements returns the delta-V series, its maximum and the time of the
+// maximum along one axis
+func deltaVElements(samples []IMUSample, zero time.Time, axis string, interval time.Duration, accel func(IMUSample) float64, required bool) []EDRElement {
+	times, velocities := integrate(samples, zero, accel)
+	series := resample(times, velocities, edrDeltaVInterval, edrDeltaVWindow)
+	status := edrRecorded
+	if interval > edrDeltaVInterval {
+		status = edrReducedRate
+	}
+	elements := []EDRElement{{
+		Name: "Delta-V, " + axis, Required: required, Status: status, Units: "km/h", Source: "imu",
+		Interval: int(edrDeltaVInterval / time.Millisecond), Values: series,
+		Note: fmt.Sprintf("integrated from %d ms IMU samples and interpolated", interval/time.Millisecond),
+	}}
+	var max, at float64
+	for _, value := range resample(times, velocities, edrDeltaVInterval, edrMaxDeltaVWindow) {
+		if math.Abs(value.Value) > math.Abs(max) {
+			max, at = value.Value, float64(value.Ms)
+		}
+	}
+	return append(elements,
+		EDRElement{Name: "Maximum delta-V, " + axis, Required: required, Status: status, Units: "km/h", Source: "imu", Value: &max},
+		EDRElement{Name: "Time, maximum delta-V, " + axis, Required: required, Status: status, Units: "ms", Source: "imu", Value: &at},
+	)
+}
+
+// accelerationElement returns the acceleration along one axis at each IMU
+// sample within the delta-V window
+func accelerationElement(samples []IMUSample, zero time.Time, axis string, interval time.Duration, accel func(IMUSample) float64) EDRElement {
+	element := EDRElement{Name: "Acceleration, " + axis, Status: edrReducedRate, Units: "g", Source: "imu", Interval: int(interval / time.Millisecond),
+		Note: "Part 563 asks for 500 samples per second"}
+	for _, sample := range samples {
+		if offset := sample.Time.Sub(zero); offset >= 0 && offset <= edrDeltaVWindow {
+			element.Values = append(element.Values, EDRValue{Ms: int(offset / time.Millisecond), Value: round(accel(sample), 2)})
+		}
+	}
+	return element
+}
+
+// preCrashElement returns reading index of the OBD records every 500 ms of the
+// 5 s before time zero, each the latest reading at the time. It returns the
+// longest the readings were held and whether the whole window is covered.
+func preCrashElement(name string, required bool, records []*OBDRecord, index int, zero time.Time, units string) (EDRElement, bool) {
+	element := EDRElement{Name: name, Required: required, Units: units, Source: "obd"}
+	complete := true
+	var held time.Duration
+	for t := -edrPreCrash; t <= 0; t += edrPreCrashInterval {
+		at := zero.Add(t)
+		var latest *OBDRecord
+		for _, record := range records {
+			if _, ok := readingValue(record, index); ok && !record.Time.After(at) {
+				latest = record
+			}
+		}
+		if latest == nil {
+			complete = false
+			continue
+		}
+		if age := at.Sub(latest.Time); age > held {
+			held = age
+		}
+		value, _ := readingValue(latest, index)
+		element.Values = append(element.Values, EDRValue{Ms: int(t / time.Millisecond), Value: value})
+	}
+	element.Interval, element.Status = int(edrPreCrashInterval/time.Millisecond), edrRecorded
+	if held >= edrPreCrashInterval {
+		element.Interval, element.Status = int((held+time.Millisecond-1)/time.Millisecond), edrReducedRate
+		element.Note = "OBD readings held between samples"
+	}
+	if len(element.Values) == 0 {
+		element.Status, element.Note = edrUnavailable, "no OBD readings before the crash"
+	}
+	return element, complete
+}
+
+// advanceSpeed refines a pre-crash speed series held between OBD samples by
+// integrating the IMU's longitudinal acceleration since the reading held,
+// where the IMU history reaches back to it
+func advanceSpeed(element *EDRElement, records []*OBDRecord, samples []IMUSample, zero time.Time) {
+	if element.Status != edrReducedRate || len(samples) == 0 {
+		return
+	}
+	longitudinal := func(s IMUSample) float64 { return s.Accel[0] }
+	advanced := make([]EDRValue, len(element.Values))
+	held := 0
+	for i, value := range element.Values {
+		at := zero.Add(time.Duration(value.Ms) * time.Millisecond)
+		var latest *OBDRecord
+		for _, record := range records {
+			if _, ok := readingValue(record, obdSpeed); ok && !record.Time.After(at) {
+				latest = record
+			}
+		}
+		if latest == nil || latest.Time.Before(samples[0].Time) {
+			advanced[i] = value
+			held++
+			continue
+		}
+		var window []IMUSample
+		for _, sample := range samples {
+			if !sample.Time.After(at) {
+				window = append(window, sample)
+			}
+		}
+		_, velocities := integrate(window, latest.Time, longitudinal)
+		advanced[i] = EDRValue{Ms: value.Ms, Value: round(math.Max(0, value.Value+velocities[len(velocities)-1]), 1)}
+	}
+	if held == len(advanced) {
+		return
+	}
+	element.Values, element.Source = advanced, "obd+imu"
+	element.Note = "OBD speed advanced between samples by the IMU's longitudinal acceleration"
+	if held == 0 {
+		element.Status, element.Interval = edrRecorded, int(edrPreCrashInterval/time.Millisecond)
+	} else {
+		element.Note += fmt.Sprintf(", %d of %d values held", held, len(advanced))
+	}
+}
+
+// unavailableElement is a data element this device cannot record
+func unavailableElement(name string, required bool, note string) EDRElement {
+	return EDRElement{Name: name, Required: required, Status: edrUnavailable, Note: note}
+}
+
+// buildEDRReport computes the EDR data set of a crash from the IMU samples
+// around it and the OBD records before it
+func (vehicle *Vehicle) buildEDRReport(crash edrCrash, samples []IMUSample, records []*OBDRecord) *EDRReport {
+	trigger := crash.trigger
+	zero := edrTimeZero(samples, trigger.Time)
+	report := &EDRReport{
+		VIN:      vehicle.vin,
+		TimeZero: zero.UTC(),
+		Trigger:  *trigger,
+		Event:    1,
+		Incident: fmt.Sprintf("incident_%s.json", trigger.Time.Format("20060102150405")),
+		Complete: len(samples) > 0 && !samples[len(samples)-1].Time.Before(zero.Add(edrDeltaVWindow)),
+	}
+	if segment := vehicle.recorder.segment(); segment != nil {
+		report.Segment = segment.Path
+	}
+	for _, sample := range samples {
+		if offset := sample.Time.Sub(zero); offset >= -edrTimeZeroSearch && offset <= edrMaxDeltaVWindow {
+			report.IMU = append(report.IMU, sample)
+			for _, g := range sample.Accel {
+				report.Saturated = report.Saturated || math.Abs(g) >= edrSaturationG
+			}
+		}
+	}
+
+	// Table I, then the Table II elements this device measures
+	longitudinal := func(s IMUSample) float64 { return s.Accel[0] }
+	lateral := func(s IMUSample) float64 { return -s.Accel[1] }   // positive left to right
+	normal := func(s IMUSample) float64 { return 1 - s.Accel[2] } // positive downward, without gravity
+	report.Elements = deltaVElements(samples, zero, "longitudinal", crash.interval, longitudinal, true)
+	speed, speedComplete := preCrashElement("Speed, vehicle indicated", true, records, obdSpeed, zero, "km/h")
+	advanceSpeed(&speed, records, samples, zero)
+	throttle, throttleComplete := preCrashElement("Engine throttle, % full", true, records, obdThrottle, zero, "%")
+	report.Complete = report.Complete && speedComplete && throttleComplete
+	report.Elements = append(report.Elements, speed, throttle,
+		unavailableElement("Service brake, on/off", true, obdUnavailable),
+		unavailableElement("Ignition cycle, crash", true, obdUnavailable),
+		unavailableElement("Ignition cycle, download", true, obdUnavailable),
+		unavailableElement("Safety belt status, driver", true, obdUnavailable),
+		unavailableElement("Frontal air bag warning lamp, on/off", true, obdUnavailable),
+		unavailableElement("Frontal air bag deployment, time to deploy", true, obdUnavailable),
+	)
+	events := float64(1)
+	if !crash.previous.IsZero() {
+		report.Event, events = 2, 2
+	}
+	report.Elements = append(report.Elements, EDRElement{Name: "Multi-event, number of events", Required: true, Status: edrRecorded, Source: "imu", Value: &events})
+	if !crash.previous.IsZero() {
+		since := round(trigger.Time.Sub(crash.previous).Seconds()*1000, 0)
+		report.Elements = append(report.Elements, EDRElement{Name: "Time from event 1 to 2", Required: true, Status: edrRecorded, Units: "ms", Source: "imu", Value: &since})
+	}
+	complete := float64(0)
+	if report.Complete {
+		complete = 1
+	}
+	report.Elements = append(report.Elements, EDRElement{Name: "Complete file recorded", Required: true, Status: edrRecorded, Units: "yes=1", Value: &complete})
+
+	report.Elements = append(report.Elements, deltaVElements(samples, zero, "lateral", crash.interval, lateral, false)...)
+	report.Elements = append(report.Elements,
+		accelerationElement(samples, zero, "longitudinal", crash.interval, longitudinal),
+		accelerationElement(samples, zero, "lateral", crash.interval, lateral),
+		accelerationElement(samples, zero, "normal", crash.interval, normal),
+	)
+	rpm, _ := preCrashElement("Engine rpm", false, records, obdRPM, zero, "rpm")
+	report.Elements = append(report.Elements, rpm)
+	return report
+}
+
+// recordEDR writes the EDR report of a crash once its post-impact samples are
+// in, locks it with the incident record and anchors it on the priority path
+func (vehicle *Vehicle) recordEDR(crash edrCrash, samples []IMUSample) {
+	report := vehicle.buildEDRReport(crash, samples, vehicle.recorder.recordsSince(crash.trigger.Time.Add(-edrOBDHistory)))
+	if hash, err := vehicle.getFileHash(report.Incident); err == nil {
+		report.IncidentHash = fmt.Sprintf("%x", hash)
+	}
+	path := fmt.Sprintf("edr_%s.json", crash.trigger.Time.Format("20060102150405"))
+	if err := writeSynced(path, report); err != nil {
+		fmt.Println("Failed to write the EDR report", err)
+		return
+	}
+	lockSegment(path)
+
+	hash, err := vehicle.getFileHash(path)
+	if err != nil {
+		fmt.Println("Failed to hash the EDR report", err)
+		return
+	}
+	txID, err := vehicle.anchorPriority(hash)
+	if err != nil {
+		fmt.Println("Failed to anchor the EDR report", err)
+		return
+	}
+	fmt.Printf("EDR report %s secured to factom. TxID: %s\n", path, txID)
+
+	data := map[string]interface{}{"edr": path, "incident": report.Incident, "complete": report.Complete, "txID": txID}
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("edr-report", data), false); err != nil {
+		fmt.Println("Failed to log EDR event", err)
+	}
+}
+
+// latestEDRReport returns the path of the most recent EDR report
+func latestEDRReport() (string, error) {
+	reports, err := filepath.Glob("edr_*.json")
+	if err != nil {
+		return "", err
+	}
+	if len(reports) == 0 {
+		return "", fmt.Errorf("no EDR report has been recorded")
+	}
+	return reports[len(reports)-1], nil
+}
+
+// edrCommand prints an EDR report, the latest unless one is named, as a
+// table of its data elements, and with -verify checks it was anchored
+func edrCommand(vehicle *Vehicle, args []string) {
+	flags := flag.NewFlagSet("edr", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "Check the report and its incident record against the chain")
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	flags.Parse(args)
+	path := flags.Arg(0)
+	if path == "" {
+		var err error
+		if path, err = latestEDRReport(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("Failed to read the EDR report", err)
+		os.Exit(1)
+	}
+	var report EDRReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		fmt.Println("Invalid EDR report", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		os.Stdout.Write(data)
+	} else {
+		printEDRReport(path, &report)
+	}
+	if !*verify {
+		return
+	}
+	failed := false
+	for _, file := range []string{path, report.Incident} {
+		result, err := vehicle.VerifyData(file)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: %v\n", file, err)
+			failed = true
+		case !result.Verified:
+			fmt.Printf("%s: not anchored\n", file)
+			failed = true
+		default:
+			fmt.Printf("%s: anchored in entry %s at block %d\n", file, result.EntryHash, result.BlockHeight)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printEDRReport prints report as a table of data elements
+func printEDRReport(path string, report *EDRReport) {
+	fmt.Printf("EDR report %s\n", path)
+	fmt.Printf("VIN %s, time zero %s, event %d, %s trigger %.2fg\n",
+		report.VIN, report.TimeZero.Format(time.RFC3339Nano), report.Event, report.Trigger.Kind, report.Trigger.Peak)
+	fmt.Printf("Incident record %s, complete: %v\n", report.Incident, report.Complete)
+	if report.Saturated {
+		fmt.Println("The crash pulse exceeded the IMU's range, delta-V is understated")
+	}
+	for _, element := range report.Elements {
+		table := "II"
+		if element.Required {
+			table = "I"
+		}
+		fmt.Printf("\n%-2s  %s: %s", table, element.Name, element.Status)
+		if element.Interval > 0 {
+			fmt.Printf(", every %d ms", element.Interval)
+		}
+		if element.Note != "" {
+			fmt.Printf(" (%s)", element.Note)
+		}
+		fmt.Println()
+		if element.Value != nil {
+			fmt.Printf("    %g %s\n", *element.Value, element.Units)
+		}
+		if len(element.Values) > 0 {
+			values := make([]string, len(element.Values))
+			for i, value := range element.Values {
+				values[i] = fmt.Sprintf("%d ms: %g", value.Ms, value.Value)
+			}
+			fmt.Printf("    %s  [%s]\n", strings.Join(values, ", "), element.Units)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sambarnes/elmobd"
+)
+
+// elmMaxPIDs is how many mode 01 PIDs one request may ask for, which CAN
+// vehicles answer in a single reply
+const elmMaxPIDs = 6
+
+// elmInit sets the adapter up for sampling: echo, linefeeds, spaces and
+// headers off so replies are as short as they can be at 38400 baud, aggressive
+// adaptive timing so it stops waiting for ECUs as soon as it has learnt how
+// long they take, and automatic protocol detection
+var elmInit = []string{"ATZ", "ATE0", "ATL0", "ATS0", "ATH0", "ATAT2", "ATSP0"}
+
+// elmSupportRanges are the PIDs whose answers are bitmaps of the next 32 PIDs
+// supported, up to the odometer's A6
+var elmSupportRanges = []byte{0x00, 0x20, 0x40, 0x60, 0x80, 0xA0}
+
+// Why the vehicle didn't answer a command of a sample
+var (
+	errOBDUnsupported = errors.New("not supported")
+	errOBDNoData      = errors.New("no data")
+)
+
+// obdReader answers the OBD commands of a sample, leaving nil those the
+// vehicle didn't answer and giving the error of each, and reads the vehicle's
+// stored trouble codes and the freeze frame saved with them
+type obdReader interface {
+	sample(cmds []elmobd.OBDCommand) ([]elmobd.OBDCommand, []error, error)
+	troubleCodes() ([]string, error)
+	freezeFrame(cmds []elmobd.OBDCommand) (string, []elmobd.OBDCommand, error)
+	Close() error
+}
+
+// elmobdReader runs each command on its own through elmobd, as the
+// simulated adapter requires
+type elmobdReader struct {
+	dev     *elmobd.Device
+	results []elmobd.OBDCommand
+	errs    []error
+}
+
+func (r *elmobdReader) sample(cmds []elmobd.OBDCommand) ([]elmobd.OBDCommand, []error, error) {
+	r.results = append(r.results[:0], cmds...)
+	r.errs = r.errs[:0]
+	for i, cmd := range cmds {
+		result, err := r.dev.RunOBDCommand(cmd)
+		if err != nil {
+			result = nil
+		}
+		r.results[i], r.errs = result, append(r.errs, err)
+	}
+	return r.results, r.errs, nil
+}
+
+// troubleCodes reports none, the simulated adapter has no stored codes
+func (r *elmobdReader) troubleCodes() ([]string, error) { return nil, nil }
+
+// freezeFrame reports none, the simulated adapter has no stored codes
+func (r *elmobdReader) freezeFrame(cmds []elmobd.OBDCommand) (string, []elmobd.OBDCommand, error) {
+	return "", nil, nil
+}
+
+func (r *elmobdReader) Close() error { return nil }
+
+// elm327 talks to an ELM327 adapter directly rather than through elmobd,
+// asking for up to elmMaxPIDs PIDs per request on CAN vehicles and skipping
+// those the vehicle doesn't support, which takes a sample from one round trip
+// per PID to one per six. Every buffer is reused from sample to sample.
+type elm327 struct {
+	port      *os.File
+	timeout   time.Duration       // for the adapter to answer a request
+	buf       []byte              // reply being read
+	req       []byte              // request being written
+	pids      []byte              // PIDs of the next request
+	frames    []byte              // decoded replies of the current sample
+	line      []byte              // a PID's answer, formatted for elmobd
+	results   []elmobd.OBDCommand // of the current sample
+	errs      []error             // of the current sample, nil for each answered
+	answers   [256][]byte         // data of each PID in the current sample, into frames
+	widths    [256]int            // data bytes of each PID sampled
+	supported [256]bool           // PIDs the vehicle reports supporting
+	multi     bool                // the protocol is CAN, answering several PIDs per request
+}
+
+// openELM327 sets up the adapter at path to sample cmds, or any subset of them,
+// which must all be mode 01, and asks the vehicle which of them it supports.
+// Every request fails if the adapter doesn't answer it within timeout.
+func openELM327(path string, cmds []elmobd.OBDCommand, timeout time.Duration) (*elm327, error) {
+	// raw mode so the tty does not buffer until a newline the adapter never sends
+	if out, err := exec.Command("stty", "-F", path, "38400", "raw", "-echo").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("configuring %s: %v %s", path, err, out)
+	}
+	port, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// without deadlines a wedged adapter would block the recorder forever
+	if err := port.SetDeadline(time.Time{}); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("%s does not support timeouts: %v", path, err)
+	}
+	e := &elm327{port: port, timeout: timeout, buf: make([]byte, 0, 256), frames: make([]byte, 0, 256)}
+	// bitmaps of the PIDs supported in each range of 32
+	for _, pid := range elmSupportRanges {
+		e.widths[pid] = 4
+	}
+	for _, cmd := range cmds {
+		if cmd.ModeID() != 1 {
+			port.Close()
+			return nil, fmt.Errorf("OBD command %s is not mode 01", cmd.Key())
+		}
+		e.widths[byte(cmd.ParameterID())] = int(cmd.DataWidth())
+	}
+	if err := e.init(); err != nil {
+		port.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// init resets the adapter, finds the vehicle's protocol and reads the PIDs it supports
+func (e *elm327) init() error {
+	for _, command := range elmInit {
+		if _, err := e.command(command); err != nil {
+			return fmt.Errorf("OBD adapter %s: %v", command, err)
+		}
+	}
+	// the first request searches for the protocol, so it may take a few seconds
+	for _, base := range elmSupportRanges {
+		e.frames, e.answers[base] = e.frames[:0], nil
+		if err := e.query([]byte{base}); err != nil {
+			return err
+		}
+		bitmap := e.answers[base]
+		if bitmap == nil {
+			if base == 0x00 {
+				return errors.New("vehicle did not answer supported PIDs")
+			}
+			break
+		}
+		for i := 0; i < 32; i++ {
+			e.supported[int(base)+i+1] = bitmap[i/8]&(0x80>>uint(i%8)) != 0
+		}
+		if !e.supported[int(base)+32] {
+			break // no further range
+		}
+	}
+	protocol, err := e.command("ATDPN")
+	if err != nil {
+		return err
+	}
+	protocol = bytes.TrimPrefix(bytes.TrimSpace(protocol), []byte("A"))
+	e.multi = len(protocol) > 0 && protocol[0] >= '6' && protocol[0] <= '9'
+	return nil
+}
+
+// command sends a line to the adapter and returns its reply, up to the prompt.
+// The reply is only valid until the next command.
+func (e *elm327) command(line string) ([]byte, error) {
+	e.req = append(append(e.req[:0], line...), '\r')
+	return e.roundTrip()
+}
+
+func (e *elm327) roundTrip() ([]byte, error) {
+	if err := e.port.SetDeadline(time.Now().Add(e.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := e.port.Write(e.req); err != nil {
+		return nil, err
+	}
+	e.buf = e.buf[:0]
+	for {
+		if len(e.buf) == cap(e.buf) {
+			e.buf = append(e.buf, 0)[:len(e.buf)]
+		}
+		n, err := e.port.Read(e.buf[len(e.buf):cap(e.buf)])
+		e.buf = e.buf[:len(e.buf)+n]
+		// the adapter prints '>' when it is ready for the next command
+		if i := bytes.IndexByte(e.buf, '>'); i >= 0 {
+			return e.buf[:i], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// query asks for the current value of mode 01 pids, recording the data of
+// each the vehicle answers in answers
+func (e *elm327) query(pids []byte) error {
+	const hexDigits = "0123456789ABCDEF"
+	e.req = append(e.req[:0], '0', '1')
+	for _, pid := range pids {
+		e.req = append(e.req, hexDigits[pid>>4], hexDigits[pid&0xf])
+	}
+	e.req = append(e.req, '\r')
+	reply, err := e.roundTrip()
+	if err != nil {
+		return err
+	}
+	return e.parseReply(reply, e.recordAnswers)
+}
+
+// parseReply splits a reply into messages, one per line or, for CAN
+// multi-frame messages, one per byte count line followed by numbered frames,
+// and passes each to record
+func (e *elm327) parseReply(reply []byte, record func(msg []byte)) error {
+	start, length := -1, 0 // of the message being decoded in frames
+	end := func() {
+		if start >= 0 {
+			msg := e.frames[start:]
+			if length > 0 && length < len(msg) {
+				msg = msg[:length] // drop the last frame's padding
+			}
+			record(msg)
+		}
+		start, length = -1, 0
+	}
+	for len(reply) > 0 {
+		line := reply
+		if i := bytes.IndexByte(reply, '\r'); i >= 0 {
+			line, reply = reply[:i], reply[i+1:]
+		} else {
+			reply = nil
+		}
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0, bytes.HasPrefix(line, []byte("SEARCHING")), bytes.HasPrefix(line, []byte("BUS INIT")), bytes.Equal(line, []byte("NO DATA")):
+			continue
+		case bytes.Contains(line, []byte("ERROR")), bytes.HasPrefix(line, []byte("UNABLE")), bytes.Equal(line, []byte("?")), bytes.Equal(line, []byte("STOPPED")):
+			return fmt.Errorf("OBD adapter: %s", line)
+		}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			// CAN frame index, frame 0 begins the message announced by the byte count
+			if bytes.Equal(bytes.TrimSpace(line[:i]), []byte("0")) {
+				count := length
+				end()
+				start, length = len(e.frames), count
+			}
+			mark := len(e.frames)
+			var ok bool
+			if e.frames, ok = appendHex(e.frames, line[i+1:]); !ok {
+				e.frames = e.frames[:mark]
+			}
+			continue
+		}
+		end()
+		if len(bytes.Replace(line, []byte(" "), nil, -1)) == 3 {
+			// byte count of the multi-frame message that follows
+			if count, ok := appendHex(nil, append([]byte("0"), line...)); ok {
+				length = int(count[0])<<8 | int(count[1])
+			}
+			continue
+		}
+		mark := len(e.frames)
+		var ok bool
+		if e.frames, ok = appendHex(e.frames, line); !ok {
+			e.frames = e.frames[:mark]
+			continue
+		}
+		start = mark
+		end()
+	}
+	end()
+	return nil
+}
+
+// recordAnswers walks a mode 01 reply, 0x41 followed by each PID and its
+// data, keeping the first answer to every PID
+func (e *elm327) recordAnswers(msg []byte) {
+	if len(msg) < 2 || msg[0] != 0x41 {
+		return
+	}
+	for i := 1; i < len(msg); {
+		pid := msg[i]
+		width := e.widths[pid]
+		if width == 0 || i+1+width > len(msg) {
+			return
+		}
+		if e.answers[pid] == nil {
+			e.answers[pid] = msg[i+1 : i+1+width]
+		}
+		i += 1 + width
+	}
+}
+
+// appendHex decodes hex digits, ignoring spaces, to dst. It reports false if
+// line holds anything else or an odd number of digits.
+func appendHex(dst, line []byte) ([]byte, bool) {
+	var high byte
+	odd := false
+	for _, c := range line {
+		var nibble byte
+		switch {
+		case c == ' ':
+			continue
+		case c >= '0' && c <= '9':
+			nibble = c - '0'
+		case c >= 'A' && c <= 'F':
+			nibble = c - 'A' + 10
+		case c >= 'a' && c <= 'f':
+			nibble = c - 'a' + 10
+		default:
+			return dst, false
+		}
+		if odd {
+			dst = append(dst, high<<4|nibble)
+		} else {
+			high = nibble
+		}
+		odd = !odd
+	}
+	return dst, !odd
+}
+
+// sample asks the vehicle for every supported command in cmds, as few to a
+// request as the protocol allows, and decodes the answers into them
+func (e *elm327) sample(cmds []elmobd.OBDCommand) ([]elmobd.OBDCommand, []error, error) {
+	perRequest := 1
+	if e.multi {
+		perRequest = elmMaxPIDs
+	}
+	e.frames = e.frames[:0]
+	e.pids = e.pids[:0]
+	for _, cmd := range cmds {
+		pid := byte(cmd.ParameterID())
+		e.answers[pid] = nil
+		if !e.supported[pid] {
+			continue
+		}
+		if e.pids = append(e.pids, pid); len(e.pids) == perRequest {
+			if err := e.query(e.pids); err != nil {
+				return nil, nil, err
+			}
+			e.pids = e.pids[:0]
+		}
+	}
+	if len(e.pids) > 0 {
+		if err := e.query(e.pids); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	e.results = append(e.results[:0], cmds...)
+	e.errs = e.errs[:0]
+	for i, cmd := range cmds {
+		e.errs = append(e.errs, nil)
+		pid := byte(cmd.ParameterID())
+		data := e.answers[pid]
+		if data == nil {
+			e.results[i], e.errs[i] = nil, errOBDNoData
+			if !e.supported[pid] {
+				e.errs[i] = errOBDUnsupported
+			}
+			continue
+		}
+		// elmobd decodes the "41 0C 1A F8" lines it reads itself
+		e.line = append(append(e.line[:0], 0x41, pid), data...)
+		result, err := elmobd.NewResult(fmt.Sprintf("% X", e.line))
+		if err == nil {
+			err = cmd.SetValue(result)
+		}
+		if err != nil {
+			e.results[i], e.errs[i] = nil, err
+		}
+	}
+	return e.results, e.errs, nil
+}
+
+// troubleCodes reads the vehicle's stored diagnostic trouble codes (mode 03),
+// e.g. "P0133", from every ECU that answers
+func (e *elm327) troubleCodes() ([]string, error) {
+	reply, err := e.command("03")
+	if err != nil {
+		return nil, err
+	}
+	e.frames = e.frames[:0]
+	var codes []string
+	err = e.parseReply(reply, func(msg []byte) {
+		if len(msg) < 1 || msg[0] != 0x43 {
+			return
+		}
+		msg = msg[1:]
+		if e.multi && len(msg) > 0 {
+			msg = msg[1:] // CAN replies count their codes first
+		}
+		for i := 0; i+1 < len(msg); i += 2 {
+			if msg[i] == 0 && msg[i+1] == 0 {
+				continue // padding
+			}
+			codes = append(codes, dtcString(msg[i], msg[i+1]))
+		}
+	})
+	return codes, err
+}
+
+// dtcString formats the two bytes of a trouble code, e.g. "P0133"
+func dtcString(a, b byte) string {
+	return fmt.Sprintf("%c%d%X%02X", "PCBU"[a>>6], a>>4&0x3, a&0xf, b)
+}
+
+// freezeFrame reads the freeze frame the vehicle saved when a trouble code
+// was set (mode 02, frame 0): the code that set it and the values of cmds at
+// the time, nil for those it didn't save. The code is empty if there is none.
+func (e *elm327) freezeFrame(cmds []elmobd.OBDCommand) (string, []elmobd.OBDCommand, error) {
+	reply, err := e.command("020200")
+	if err != nil {
+		return "", nil, err
+	}
+	code := ""
+	e.frames = e.frames[:0]
+	err = e.parseReply(reply, func(msg []byte) {
+		if code == "" && len(msg) >= 5 && msg[0] == 0x42 && msg[1] == 0x02 && (msg[3] != 0 || msg[4] != 0) {
+			code = dtcString(msg[3], msg[4])
+		}
+	})
+	if err != nil || code == "" {
+		return "", nil, err
+	}
+
+	results := make([]elmobd.OBDCommand, len(cmds))
+	for i, cmd := range cmds {
+		pid := byte(cmd.ParameterID())
+		width := e.widths[pid]
+		if !e.supported[pid] || width == 0 {
+			continue
+		}
+		reply, err := e.command(fmt.Sprintf("02%02X00", pid))
+		if err != nil {
+			return "", nil, err
+		}
+		var data []byte
+		e.frames = e.frames[:0]
+		if err := e.parseReply(reply, func(msg []byte) {
+			// 0x42, the PID and the frame number before the data
+			if data == nil && len(msg) >= 3+width && msg[0] == 0x42 && msg[1] == pid {
+				data = msg[3 : 3+width]
+			}
+		}); err != nil {
+			return "", nil, err
+		}
+		if data == nil {
+			continue
+		}
+		e.line = append(append(e.line[:0], 0x41, pid), data...)
+		result, err := elmobd.NewResult(fmt.Sprintf("% X", e.line))
+		if err == nil {
+			err = cmd.SetValue(result)
+		}
+		if err == nil {
+			results[i] = cmd
+		}
+	}
+	return code, results, nil
+}
+
+func (e *elm327) Close() error {
+	return e.port.Close()
+}
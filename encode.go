@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"time"
+	"unicode/utf8"
+)
+
+// Records are encoded many times a second, by hand rather than with
+// encoding/json and fmt, appending to buffers that are reused, so high sample
+// rates don't keep a small board busy collecting garbage. The output is byte
+// for byte what encoding/json writes.
+
+// recordSeparator ends every record in exported segments
+const recordSeparator = "------------------------------------------------------------------\n"
+
+const hexDigits = "0123456789abcdef"
+
+// appendText appends the record formatted the way it appears in exported segments
+func (record *OBDRecord) appendText(buf []byte) []byte {
+	buf = record.Time.UTC().AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, "\nPosition: "...)
+	buf = append(buf, record.Position...)
+	for _, reading := range record.Readings {
+		buf = append(buf, '\n')
+		buf = append(buf, reading.Name...)
+		buf = append(buf, ": "...)
+		buf = append(buf, reading.Value...)
+		if reading.Error != "" {
+			buf = append(buf, " ("...)
+			buf = append(buf, reading.Error...)
+			buf = append(buf, ')')
+		} else if reading.Units != "" {
+			buf = append(buf, ' ')
+			buf = append(buf, reading.Units...)
+		}
+	}
+	buf = append(buf, '\n')
+	return append(buf, recordSeparator...)
+}
+
+// appendJSON appends the record as encoding/json would marshal it
+func (record *OBDRecord) appendJSON(buf []byte) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = record.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, `","position":`...)
+	buf = appendJSONString(buf, record.Position)
+	buf = append(buf, `,"readings":`...)
+	if record.Readings == nil {
+		buf = append(buf, "null"...)
+	} else {
+		buf = append(buf, '[')
+		for i, reading := range record.Readings {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `{"name":`...)
+			buf = appendJSONString(buf, reading.Name)
+			buf = append(buf, `,"value":`...)
+			buf = appendJSONString(buf, reading.Value)
+			if reading.Units != "" {
+				buf = append(buf, `,"units":`...)
+				buf = appendJSONString(buf, reading.Units)
+			}
+			if reading.Error != "" {
+				buf = append(buf, `,"error":`...)
+				buf = appendJSONString(buf, reading.Error)
+			}
+			buf = append(buf, '}')
+		}
+		buf = append(buf, ']')
+	}
+	return append(buf, '}')
+}
+
+// appendJSON appends the record's write-ahead log line, as encoding/json
+// would marshal it, with its newline
+func (record *pendingRecord) appendJSON(buf []byte) []byte {
+	buf = append(buf, `{"vin":`...)
+	buf = appendJSONString(buf, record.VIN)
+	buf = append(buf, `,"key":"`...)
+	n := len(buf)
+	buf = append(buf, make([]byte, base64.StdEncoding.EncodedLen(len(record.Key)))...)
+	base64.StdEncoding.Encode(buf[n:], record.Key)
+	buf = append(buf, `","value":`...)
+	buf = append(buf, record.Value...)
+	return append(buf, "}\n"...)
+}
+
+// appendJSONString appends s as a JSON string escaped like encoding/json does,
+// including its HTML escaping and replacement of invalid UTF-8
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
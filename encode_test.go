@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// joinText formats a record the way Text did before records were appended to
+// reused buffers, the baseline of the text benchmarks
+func joinText(record *OBDRecord) string {
+	lines := []string{
+		record.Time.UTC().Format(time.RFC3339Nano),
+		"Position: " + record.Position,
+	}
+	for _, reading := range record.Readings {
+		line := reading.Name + ": " + reading.Value
+		if reading.Error != "" {
+			line += " (" + reading.Error + ")"
+		} else if reading.Units != "" {
+			line += " " + reading.Units
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, recordSeparator)
+	return strings.Join(lines, "\n")
+}
+
+func TestAppendTextMatchesJoin(t *testing.T) {
+	record := benchRecord()
+	if got, want := string(record.appendText(nil)), joinText(record); got != want {
+		t.Errorf("appendText wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAppendJSONMatchesMarshal(t *testing.T) {
+	at := time.Date(2020, 1, 2, 15, 4, 5, 123456789, time.UTC)
+	tests := []struct {
+		name   string
+		record *OBDRecord
+	}{
+		{"typical", benchRecord()},
+		{"nil readings", &OBDRecord{Time: at, Position: "unknown"}},
+		{"empty readings", &OBDRecord{Time: at, Readings: []Reading{}}},
+		{"not UTC", &OBDRecord{Time: at.In(time.FixedZone("", -5*3600)), Readings: []Reading{{Name: "Vehicle Speed", Value: "88"}}}},
+		{"no fraction of a second", &OBDRecord{Time: at.Truncate(time.Second)}},
+	}
+	texts := []struct {
+		name, s string
+	}{
+		{"quotes", `say "hi"`},
+		{"backslashes", `C:\obd\` + `\`},
+		{"html", "<b>&amp;</b>"},
+		{"control bytes", "\x00\x01\x1f\n\r\t\x7f"},
+		{"invalid UTF-8", "bad \xff\xfe and cut \xe2\x82"},
+		{"line separators", "a\u2028b\u2029c"},
+		{"multibyte", "Temp 90°C, 温度"},
+		{"empty", ""},
+	}
+	for _, text := range texts {
+		tests = append(tests, struct {
+			name   string
+			record *OBDRecord
+		}{text.name, &OBDRecord{Time: at, Position: text.s, Readings: []Reading{
+			{Name: text.s, Value: text.s, Units: text.s},
+			{Name: "Oil Temp", Value: text.s, Error: text.s},
+		}}})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.record.appendJSON(nil)
+			if string(got) != string(want) {
+				t.Fatalf("record appendJSON wrote\n%s\nwant\n%s", got, want)
+			}
+			pending := pendingRecord{VIN: tt.record.Position, Key: timeKey(tt.record.Time), Value: got}
+			if want, err = json.Marshal(pending); err != nil {
+				t.Fatal(err)
+			}
+			if got := pending.appendJSON(nil); string(got) != string(want)+"\n" {
+				t.Errorf("pending record appendJSON wrote\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeTextJoin(b *testing.B) {
+	record := benchRecord()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = joinText(record)
+	}
+}
+
+func BenchmarkEncodeTextAppend(b *testing.B) {
+	record := benchRecord()
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = record.appendText(buf[:0])
+	}
+}
+
+func BenchmarkEncodeJSONMarshal(b *testing.B) {
+	record := benchRecord()
+	pending := pendingRecord{VIN: benchVIN, Key: timeKey(record.Time), Value: record.appendJSON(nil)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(record)
+		json.Marshal(pending)
+	}
+}
+
+func BenchmarkEncodeJSONAppend(b *testing.B) {
+	record := benchRecord()
+	pending := pendingRecord{VIN: benchVIN, Key: timeKey(record.Time), Value: record.appendJSON(nil)}
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = record.appendJSON(buf[:0])
+		buf = pending.appendJSON(buf[:0])
+	}
+}
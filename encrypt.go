@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedMagic prefixes every file written by deviceKey.seal
+var encryptedMagic = []byte("BBENC1")
+
+// encryptedExt is appended to the path of encrypted evidence files
+const encryptedExt = ".enc"
+
+// EncryptionConfig enables encryption at rest of video and OBD files. Hashes
+// are always taken over the plaintext, so anchors do not depend on the key.
+type EncryptionConfig struct {
+	KeyPath string `json:"keyPath"` // device key file, generated on first use
+
+	// PassphraseEnv names an environment variable holding the owner's
+	// passphrase. If set, the device key is stored wrapped by it.
+	PassphraseEnv string `json:"passphraseEnv"`
+}
+
+// keyFile is the on-disk form of the device key
+type keyFile struct {
+	Key   []byte `json:"key"`            // raw key, or the sealed key if Salt is set
+	Salt  []byte `json:"salt,omitempty"` // scrypt salt of the passphrase wrapping key
+	Nonce []byte `json:"nonce,omitempty"`
+}
+
+// deviceKey encrypts evidence files with AES-256-GCM
+type deviceKey struct {
+	aead cipher.AEAD
+}
+
+// loadDeviceKey reads the device key described by config, creating it if the
+// key file does not exist yet
+func loadDeviceKey(config *EncryptionConfig) (*deviceKey, error) {
+	var passphrase []byte
+	if config.PassphraseEnv != "" {
+		passphrase = []byte(os.Getenv(config.PassphraseEnv))
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("passphrase variable %s is empty", config.PassphraseEnv)
+		}
+	}
+
+	data, err := ioutil.ReadFile(config.KeyPath)
+	if os.IsNotExist(err) {
+		return createDeviceKey(config.KeyPath, passphrase)
+	} else if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	key := file.Key
+	if file.Salt != nil {
+		if passphrase == nil {
+			return nil, errors.New("device key is wrapped but no passphrase is configured")
+		}
+		wrap, err := passphraseAEAD(passphrase, file.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = wrap.Open(nil, file.Nonce, file.Key, nil); err != nil {
+			return nil, errors.New("wrong passphrase for device key")
+		}
+	}
+	return newDeviceKey(key)
+}
+
+// createDeviceKey generates a random key and saves it, wrapped if a passphrase is given
+func createDeviceKey(path string, passphrase []byte) (*deviceKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	file := keyFile{Key: key}
+	if passphrase != nil {
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return nil, err
+		}
+		wrap, err := passphraseAEAD(passphrase, file.Salt)
+		if err != nil {
+			return nil, err
+		}
+		file.Nonce = make([]byte, wrap.NonceSize())
+		if _, err := rand.Read(file.Nonce); err != nil {
+			return nil, err
+		}
+		file.Key = wrap.Seal(nil, file.Nonce, key, nil)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return newDeviceKey(key)
+}
+
+// passphraseAEAD derives the key wrapping cipher from the owner's passphrase
+func passphraseAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+func newDeviceKey(key []byte) (*deviceKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceKey{aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext as magic | nonce | ciphertext
+func (k *deviceKey) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte(nil), encryptedMagic...), nonce...)
+	return k.aead.Seal(out, nonce, plaintext, encryptedMagic), nil
+}
+
+// open decrypts data produced by seal
+func (k *deviceKey) open(data []byte) ([]byte, error) {
+	if !isEncrypted(data) || len(data) < len(encryptedMagic)+k.aead.NonceSize() {
+		return nil, errors.New("not an encrypted evidence file")
+	}
+	data = data[len(encryptedMagic):]
+	nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, encryptedMagic)
+}
+
+// isEncrypted returns true if data starts with the encrypted file magic
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// readEvidence reads the file at path, decrypting it if it is encrypted
+func (vehicle *Vehicle) readEvidence(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !isEncrypted(data) {
+		return data, err
+	}
+	if vehicle.key == nil {
+		return nil, fmt.Errorf("%s is encrypted and no device key is loaded", path)
+	}
+	return vehicle.key.open(data)
+}
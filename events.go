@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// eventLogPath is the local append-only log of every signed event
+const eventLogPath = "events.log"
+
+// Event is something notable that happened to the vehicle, e.g. entering a geofence
+type Event struct {
+	Type string                 `json:"type"`
+	VIN  string                 `json:"vin"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+
+	// ClockUncertain is set on events timestamped before the clock was synced
+	ClockUncertain bool `json:"clockUncertain,omitempty"`
+}
+
+// SignedEvent is an event as written to the event log
+type SignedEvent struct {
+	Event     json.RawMessage `json:"event"`     // the exact bytes that were signed
+	Signature string          `json:"signature"` // hex ed25519 signature of Event
+	PubKey    string          `json:"pubkey"`    // hex public key of the signer
+}
+
+// NewEvent creates an event of the given type for the vehicle, timestamped now
+func (vehicle *Vehicle) NewEvent(eventType string, data map[string]interface{}) Event {
+	return Event{
+		Type: eventType,
+		VIN:  vehicle.vin,
+		Time: time.Now().UTC(),
+		Data: data,
+
+		ClockUncertain: !vehicle.clock.certain(),
+	}
+}
+
+// LogEvent signs the event with the owner's key and appends it to the local event
+// log. If anchor is true the signed event is also written to the vehicle's chain
+// and the txID returned.
+// ExtIDs = [0]:signature, [1]:public key, [2]:"event", [3]:event type
+func (vehicle *Vehicle) LogEvent(event Event, anchor bool) (string, error) {
+	if vehicle.owner == nil {
+		return "", errors.New("vehicle has no owner to sign events")
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	signature := ed.Sign(vehicle.owner.ecAddress.Sec, payload)
+
+	line, err := json.Marshal(SignedEvent{
+		Event:     payload,
+		Signature: hex.EncodeToString(signature[:]),
+		PubKey:    hex.EncodeToString(vehicle.owner.ecAddress.PubBytes()),
+	})
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(eventLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(append(line, '\n'))
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Event logged: %s\n", event.Type)
+
+	if !anchor {
+		return "", nil
+	}
+	entry := factom.Entry{}
+	entry.ChainID = vehicle.chainID
+	entry.ExtIDs = [][]byte{signature[:], vehicle.owner.ecAddress.PubBytes(), []byte("event"), []byte(event.Type)}
+	entry.Content = payload
+
+	return vehicle.commitEntry(&entry)
+}
+
+// toEventData converts a JSON-serializable struct into Event.Data
+func toEventData(v interface{}) map[string]interface{} {
+	data := make(map[string]interface{})
+	b, err := json.Marshal(v)
+	if err != nil {
+		return data
+	}
+	json.Unmarshal(b, &data)
+	return data
+}
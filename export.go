@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Datasets that can be exported for analysis
+const (
+	DatasetTelemetry = "telemetry" // one row per OBD reading
+	DatasetTrips     = "trips"     // one row per trip summary
+	DatasetUBI       = "ubi"       // one row per day of usage-based insurance aggregates
+	DatasetNMEA      = "nmea"      // one row per raw GPS sentence, if nmeaLog is set
+)
+
+// Export formats. JSON exports hold one object per line.
+const (
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatParquet = "parquet"
+	FormatMDF     = "mf4"    // ASAM MDF 4, telemetry only
+	FormatNMEA    = "nmea"   // the raw sentences, one per line, nmea only
+	FormatTorque  = "torque" // Torque Pro's CSV layout, telemetry only
+)
+
+var (
+	exportDatasets = []string{DatasetTelemetry, DatasetTrips, DatasetUBI, DatasetNMEA}
+	exportFormats  = []string{FormatCSV, FormatJSON, FormatParquet, FormatMDF, FormatNMEA, FormatTorque}
+)
+
+// exportStream marks the anchored hashes of data exports in hash entry metadata
+const exportStream = "export"
+
+// TelemetryRow is one reading of an OBD record, flattened so every format has
+// the same columns whichever PIDs the vehicle supports
+type TelemetryRow struct {
+	Time     time.Time `json:"time" parquet:"time"`
+	Position string    `json:"position" parquet:"position"`
+	Name     string    `json:"name" parquet:"name"`
+	Value    string    `json:"value" parquet:"value"`
+	Number   *float64  `json:"number,omitempty" parquet:"number,optional"` // Value, if numeric
+	Units    string    `json:"units,omitempty" parquet:"units"`
+	Error    string    `json:"error,omitempty" parquet:"error"` // why the PID did not answer
+}
+
+// telemetryChannel is a numeric series of a telemetry export
+type telemetryChannel struct {
+	name  string
+	units string
+}
+
+// telemetryRecord is the values of one OBD record, NaN where a channel has none
+type telemetryRecord struct {
+	time   time.Time
+	values []float64
+}
+
+// DataExport describes a written export and the anchor of its hash
+type DataExport struct {
+	Dataset string    `json:"dataset"`
+	Format  string    `json:"format"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Rows    int       `json:"rows"`
+	Hash    string    `json:"hash"` // hex SHA-256 of the file
+	TxID    string    `json:"txID"`
+}
+
+// ContentType returns the MIME type of the export's format
+func (export *DataExport) ContentType() string {
+	switch export.Format {
+	case FormatCSV, FormatTorque:
+		return "text/csv"
+	case FormatJSON:
+		return "application/x-ndjson"
+	case FormatMDF:
+		return "application/octet-stream"
+	case FormatNMEA:
+		return "text/plain"
+	}
+	return "application/vnd.apache.parquet"
+}
+
+// FileName returns a name for the export, e.g. telemetry_20200102150405.csv
+func (export *DataExport) FileName() string {
+	ext := export.Format
+	if ext == FormatTorque {
+		ext = "csv"
+	}
+	return fmt.Sprintf("%s_%s.%s", export.Dataset, export.From.UTC().Format("20060102150405"), ext)
+}
+
+// checkExport validates the dataset and format of an export
+func checkExport(dataset, format string) error {
+	if !contains(exportDatasets, dataset) {
+		return fmt.Errorf("unknown dataset %q, expected one of %s", dataset, strings.Join(exportDatasets, ", "))
+	}
+	if !contains(exportFormats, format) {
+		return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(exportFormats, ", "))
+	}
+	if (format == FormatMDF || format == FormatTorque) && dataset != DatasetTelemetry {
+		return fmt.Errorf("%s exports hold measurements, only the %s dataset", format, DatasetTelemetry)
+	}
+	if format == FormatNMEA && dataset != DatasetNMEA {
+		return fmt.Errorf("%s exports hold raw GPS sentences, only the %s dataset", FormatNMEA, DatasetNMEA)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportData writes the dataset's rows between from and to, inclusive, to path
+// in the given format and anchors the file's hash, so anyone handed the file
+// can check it is what the vehicle exported
+func (vehicle *Vehicle) ExportData(store *Store, dataset, format string, from, to time.Time, path string) (*DataExport, error) {
+	if err := checkExport(dataset, format); err != nil {
+		return nil, err
+	}
+	rows, err := vehicle.exportRows(store, dataset, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	sha := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(file, sha))
+	if format == FormatMDF {
+		err = writeMDF(buffered, rows, vehicle.vin)
+	} else {
+		err = writeRows(buffered, dataset, format, rows)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	export := &DataExport{Dataset: dataset, Format: format, From: from, To: to, Rows: len(rows), Hash: hex.EncodeToString(sha.Sum(nil))}
+	if export.TxID, err = vehicle.secureHashWithMeta(sha.Sum(nil), &HashMeta{Stream: exportStream}); err != nil {
+		return nil, err
+	}
+	appendAudit("data-exported", map[string]interface{}{
+		"dataset": dataset, "format": format, "from": from, "to": to,
+		"rows": export.Rows, "hash": export.Hash, "txID": export.TxID,
+	})
+	return export, nil
+}
+
+// exportRows returns the rows of a dataset, TelemetryRow, TripSummary, UBIRow
+// or NMEASentence values
+func (vehicle *Vehicle) exportRows(store *Store, dataset string, from, to time.Time) ([]interface{}, error) {
+	var rows []interface{}
+	switch dataset {
+	case DatasetTelemetry:
+		records, err := store.Records(vehicle.vin, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			for _, reading := range record.Readings {
+				row := TelemetryRow{Time: record.Time.UTC(), Position: record.Position, Name: reading.Name, Value: reading.Value, Units: reading.Units, Error: reading.Error}
+				if number, err := strconv.ParseFloat(reading.Value, 64); err == nil {
+					row.Number = &number
+				}
+				rows = append(rows, row)
+			}
+		}
+	case DatasetTrips, DatasetUBI:
+		trips, err := loadTrips()
+		if err != nil {
+			return nil, err
+		}
+		var inRange []*TripSummary
+		for _, trip := range trips {
+			if !trip.Start.Before(from) && !trip.Start.After(to) {
+				inRange = append(inRange, trip)
+			}
+		}
+		if dataset == DatasetUBI {
+			for _, row := range aggregateUBI(inRange, time.Local) {
+				rows = append(rows, row)
+			}
+			break
+		}
+		for _, trip := range inRange {
+			rows = append(rows, *trip)
+		}
+	case DatasetNMEA:
+		sentences, err := readNMEA(from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, sentence := range sentences {
+			rows = append(rows, sentence)
+		}
+	}
+	return rows, nil
+}
+
+// writeRows encodes the rows of dataset in format
+func writeRows(w io.Writer, dataset, format string, rows []interface{}) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		return writeCSV(w, dataset, rows)
+	case FormatNMEA:
+		return writeNMEA(w, rows)
+	case FormatTorque:
+		return writeTorque(w, rows)
+	}
+	var model interface{} = TelemetryRow{}
+	switch dataset {
+	case DatasetTrips:
+		model = TripSummary{}
+	case DatasetUBI:
+		model = UBIRow{}
+	case DatasetNMEA:
+		model = NMEASentence{}
+	}
+	out := parquet.NewWriter(w, parquet.SchemaOf(model))
+	for _, row := range rows {
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// writeCSV writes a header line and one line per row
+func writeCSV(w io.Writer, dataset string, rows []interface{}) error {
+	out := csv.NewWriter(w)
+	switch dataset {
+	case DatasetTrips:
+		out.Write([]string{"vin", "start", "end", "duration", "distance", "maxSpeed", "harshEvents", "driver"})
+	case DatasetUBI:
+		out.Write([]string{"vin", "date", "trips", "distance", "duration", "nightKm", "peakKm", "weekendKm", "maxSpeed", "harshEvents"})
+	case DatasetNMEA:
+		out.Write([]string{"time", "sentence"})
+	default:
+		out.Write([]string{"time", "position", "name", "value", "number", "units", "error"})
+	}
+	for _, row := range rows {
+		var line []string
+		switch row := row.(type) {
+		case TelemetryRow:
+			number := ""
+			if row.Number != nil {
+				number = strconv.FormatFloat(*row.Number, 'f', -1, 64)
+			}
+			line = []string{row.Time.Format(time.RFC3339Nano), row.Position, row.Name, row.Value, number, row.Units, row.Error}
+		case TripSummary:
+			line = []string{
+				row.VIN, row.Start.UTC().Format(time.RFC3339), row.End.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(row.Duration, 'f', 0, 64), strconv.FormatFloat(row.Distance, 'f', 3, 64),
+				strconv.FormatFloat(row.MaxSpeed, 'f', 1, 64), strconv.Itoa(row.HarshEvents), row.Driver,
+			}
+		case UBIRow:
+			line = []string{
+				row.VIN, row.Date, strconv.Itoa(row.Trips), strconv.FormatFloat(row.Distance, 'f', 3, 64),
+				strconv.FormatFloat(row.Duration, 'f', 0, 64), strconv.FormatFloat(row.NightKm, 'f', 3, 64),
+				strconv.FormatFloat(row.PeakKm, 'f', 3, 64), strconv.FormatFloat(row.WeekendKm, 'f', 3, 64),
+				strconv.FormatFloat(row.MaxSpeed, 'f', 1, 64), strconv.Itoa(row.HarshEvents),
+			}
+		case NMEASentence:
+			line = []string{row.Time.Format(time.RFC3339Nano), row.Sentence}
+		}
+		out.Write(line)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// groupTelemetry groups telemetry rows into one record per OBD reading time,
+// with latitude and longitude channels first, then a channel per PID that
+// answered with a number. located reports whether any position was recorded
+// in the clear, otherwise the first two channels never hold a value.
+func groupTelemetry(rows []interface{}) (channels []telemetryChannel, records []telemetryRecord, located bool) {
+	channels = []telemetryChannel{{name: "Latitude", units: "deg"}, {name: "Longitude", units: "deg"}}
+	index := make(map[string]int)
+	for _, row := range rows {
+		row, ok := row.(TelemetryRow)
+		if !ok {
+			continue
+		}
+		if len(records) == 0 || !records[len(records)-1].time.Equal(row.Time) {
+			record := telemetryRecord{time: row.Time}
+			if lat, lon, ok := parseClearPosition(row.Position); ok {
+				record.values = []float64{lat, lon}
+				located = true
+			} else {
+				record.values = []float64{math.NaN(), math.NaN()}
+			}
+			records = append(records, record)
+		}
+		if row.Number == nil || row.Error != "" {
+			continue
+		}
+		i, ok := index[row.Name]
+		if !ok {
+			i = len(channels)
+			index[row.Name] = i
+			channels = append(channels, telemetryChannel{name: row.Name, units: row.Units})
+		}
+		record := &records[len(records)-1]
+		for len(record.values) <= i {
+			record.values = append(record.values, math.NaN())
+		}
+		record.values[i] = *row.Number
+	}
+	return channels, records, located
+}
+
+// parseClearPosition reads the latitude and longitude of a position recorded
+// without location privacy, e.g. "52.520008, 13.404954 (estimated)"
+func parseClearPosition(position string) (lat, lon float64, ok bool) {
+	position = strings.TrimSuffix(position, " (estimated)")
+	if _, err := fmt.Sscanf(position, "%f, %f", &lat, &lon); err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// factomdTimeout bounds every request to factomd, so a hung node fails the
+// request instead of stalling whatever made it. Set from the config's timeouts.
+var factomdTimeout = 30 * time.Second
+
+// withFactomdTimeout runs op, a factomd request, and returns its result, or an
+// error if it takes longer than factomdTimeout. The factom library can't cancel
+// a request, so one that times out is abandoned and its result discarded.
+func withFactomdTimeout(what string, op func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := op()
+		done <- result{value, err}
+	}()
+	timer := time.NewTimer(factomdTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%s: factomd did not answer within %v", what, factomdTimeout)
+	}
+}
+
+// factomdClient is the ChainClient of the factomd configured with
+// factom.SetFactomdServer, every request bounded by factomdTimeout
+type factomdClient struct{}
+
+func (factomdClient) commitChain(chain *factom.Chain, ecAddress *factom.ECAddress) (string, error) {
+	txID, err := withFactomdTimeout("chain commit", func() (interface{}, error) {
+		return factom.CommitChain(chain, ecAddress)
+	})
+	if err != nil {
+		return "", err
+	}
+	return txID.(string), nil
+}
+
+func (factomdClient) revealChain(chain *factom.Chain) (string, error) {
+	entryHash, err := withFactomdTimeout("chain reveal", func() (interface{}, error) {
+		return factom.RevealChain(chain)
+	})
+	if err != nil {
+		return "", err
+	}
+	return entryHash.(string), nil
+}
+
+func (factomdClient) commitEntry(entry *factom.Entry, ecAddress *factom.ECAddress) (string, error) {
+	txID, err := withFactomdTimeout("entry commit", func() (interface{}, error) {
+		return factom.CommitEntry(entry, ecAddress)
+	})
+	if err != nil {
+		return "", err
+	}
+	return txID.(string), nil
+}
+
+func (factomdClient) revealEntry(entry *factom.Entry) (string, error) {
+	entryHash, err := withFactomdTimeout("entry reveal", func() (interface{}, error) {
+		return factom.RevealEntry(entry)
+	})
+	if err != nil {
+		return "", err
+	}
+	return entryHash.(string), nil
+}
+
+func (factomdClient) entry(entryHash string) (*factom.Entry, error) {
+	entry, err := withFactomdTimeout("entry lookup", func() (interface{}, error) {
+		return factom.GetEntry(entryHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*factom.Entry), nil
+}
+
+func (factomdClient) chainHead(chainID string) (string, error) {
+	keyMR, err := withFactomdTimeout("chain head lookup", func() (interface{}, error) {
+		return factom.GetChainHead(chainID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return keyMR.(string), nil
+}
+
+func (factomdClient) entryBlock(keyMR string) (*factom.EBlock, error) {
+	block, err := withFactomdTimeout("entry block lookup", func() (interface{}, error) {
+		return factom.GetEBlock(keyMR)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block.(*factom.EBlock), nil
+}
+
+func (factomdClient) receipt(entryHash string) (*factom.Receipt, error) {
+	receipt, err := withFactomdTimeout("receipt lookup", func() (interface{}, error) {
+		return factom.GetReceipt(entryHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipt.(*factom.Receipt), nil
+}
+
+func (factomdClient) ecBalance(address string) (int64, error) {
+	balance, err := withFactomdTimeout("balance lookup", func() (interface{}, error) {
+		return factom.GetECBalance(address)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return balance.(int64), nil
+}
+
+// chainState asks factomd whether chainID is on chain or waiting for its
+// block. It returns ChainAbsent for a chain it doesn't know, which may still
+// have a commit pending.
+func (factomdClient) chainState(chainID string) (ChainState, error) {
+	var result struct {
+		ChainHead string `json:"chainhead"`
+		InProcess bool   `json:"chaininprocesslist"`
+	}
+	err := newFactomdNode(factom.FactomdServer()).call("chain-head", map[string]string{"chainid": chainID}, &result)
+	if rpcErr, ok := err.(*rpcError); ok && rpcErr.code == rpcMissingChainHead {
+		return ChainAbsent, nil
+	} else if err != nil {
+		return ChainUnknown, err
+	}
+	if result.ChainHead == "" && result.InProcess {
+		return ChainPending, nil
+	}
+	return ChainConfirmed, nil
+}
+
+// commitAck reports whether factomd accepted the commit txID, and whether it
+// has the reveal too
+func (factomdClient) commitAck(txID string) (committed, revealed bool, err error) {
+	var ack commitAck
+	params := map[string]string{"hash": txID, "chainid": "c"}
+	if err := newFactomdNode(factom.FactomdServer()).call("ack", params, &ack); err != nil {
+		return false, false, err
+	}
+	accepted := func(status string) bool {
+		return status == ackTransactionACK || status == ackDBlockConfirmed
+	}
+	return accepted(ack.CommitData.Status), accepted(ack.EntryData.Status), nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// FleetConfig connects the device to a fleet management server, see fleet-server
+type FleetConfig struct {
+	Server string     `json:"server"` // base URL, e.g. "https://fleet.example.com"
+	Token  string     `json:"token"`  // device token issued by the fleet server
+	TLS    *TLSConfig `json:"tls"`    // present a device certificate, trusting only TLS.CA for the server
+	Funded bool       `json:"funded"` // entries are paid by the organization's entry credits on the fleet server
+	Push   int        `json:"push"`   // seconds between telemetry pushes for the fleet dashboard, 0 for none
+}
+
+// Fleet protocol settings. The agent keeps a long poll open to the server, so
+// commands reach the device within moments even behind NAT or a mobile carrier.
+const (
+	fleetPollTimeout = 25 * time.Second // how long the server holds a poll open
+	fleetRetryWait   = 30 * time.Second // wait after the server could not be reached
+)
+
+// Fleet command kinds
+const (
+	FleetConfigPush = "config"   // replace the device config, applied at the next start
+	FleetEvidence   = "evidence" // upload the evidence recorded between From and To
+)
+
+// FleetCommand is queued on the fleet server for a device
+type FleetCommand struct {
+	ID     string          `json:"id"`
+	Kind   string          `json:"kind"`
+	Config json.RawMessage `json:"config,omitempty"` // for config pushes
+	From   time.Time       `json:"from,omitempty"`   // for evidence retrieval
+	To     time.Time       `json:"to,omitempty"`
+}
+
+// FleetResult reports the outcome of a command back to the fleet server
+type FleetResult struct {
+	ID       string    `json:"id"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// FleetHeartbeat is the health report sent with every poll
+type FleetHeartbeat struct {
+	VIN    string    `json:"vin"`
+	Time   time.Time `json:"time"`
+	Status *Status   `json:"status"`
+}
+
+// fleetAgent talks to the fleet server on behalf of a vehicle
+type fleetAgent struct {
+	vehicle    *Vehicle
+	config     *FleetConfig
+	configPath string
+	client     *http.Client
+	residency  *ResidencyConfig // where data may go, config pushes can't widen it
+}
+
+// NewFleetAgent sets up the connection to the fleet server. Config pushes are
+// written to configPath.
+func (vehicle *Vehicle) NewFleetAgent(config *FleetConfig, configPath string, residency *ResidencyConfig) (*fleetAgent, error) {
+	agent := &fleetAgent{
+		vehicle:    vehicle,
+		config:     config,
+		configPath: configPath,
+		client:     &http.Client{Timeout: fleetPollTimeout + 30*time.Second},
+		residency:  residency,
+	}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		agent.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	residency.guard(agent.client)
+	return agent, nil
+}
+
+// Run polls the fleet server for commands and runs them until stop is closed
+func (agent *fleetAgent) Run(stop <-chan struct{}) error {
+	fmt.Printf("Fleet agent connecting to %s\n", agent.config.Server)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		commands, err := agent.poll()
+		if err != nil {
+			fmt.Println("Fleet server unreachable", err)
+			if !sleep(fleetRetryWait, stop) {
+				return nil
+			}
+			continue
+		}
+		for _, command := range commands {
+			result := FleetResult{ID: command.ID, OK: true}
+			if err := agent.run(command); err != nil {
+				result.OK = false
+				result.Error = err.Error()
+			}
+			result.Finished = time.Now().UTC()
+			appendAudit("fleet-"+command.Kind, map[string]interface{}{"id": command.ID, "ok": result.OK, "error": result.Error})
+			if err := agent.post("/agent/result", "application/json", jsonBody(result), nil); err != nil {
+				fmt.Println("Failed to report fleet command result", err)
+			}
+		}
+	}
+}
+
+// RunTelemetry pushes the samples, anchors and driving scores recorded since
+// the last push to the fleet server every interval, until stop is closed. A
+// failed push is retried with everything since the last one that succeeded.
+func (agent *fleetAgent) RunTelemetry(interval time.Duration, stop <-chan struct{}) error {
+	since := time.Now().UTC()
+	for {
+		if !sleep(interval, stop) {
+			return nil
+		}
+		now := time.Now().UTC()
+		telemetry, err := agent.telemetry(since, now)
+		if err == nil {
+			err = agent.post("/agent/telemetry", "application/json", jsonBody(telemetry), nil)
+		}
+		if err != nil {
+			fmt.Println("Failed to push fleet telemetry", err)
+			continue
+		}
+		since = now
+	}
+}
+
+// telemetry collects what was recorded between since and now, the latest
+// fleetMaxSamples samples of it, with the vehicle's position on the last
+func (agent *fleetAgent) telemetry(since, now time.Time) (*FleetTelemetry, error) {
+	vehicle := agent.vehicle
+	telemetry := &FleetTelemetry{VIN: vehicle.vin, Samples: []FleetSample{}, Anchors: []Anchor{}, Scores: []*DrivingScore{}}
+	records, err := vehicle.store.Records(vehicle.vin, since, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > fleetMaxSamples {
+		records = records[len(records)-fleetMaxSamples:]
+	}
+	for _, record := range records {
+		sample := FleetSample{Time: record.Time, Readings: record.Readings}
+		if len(record.Readings) > obdSpeed {
+			sample.Speed, _ = strconv.ParseFloat(record.Readings[obdSpeed].Value, 64)
+		}
+		telemetry.Samples = append(telemetry.Samples, sample)
+	}
+	if n := len(telemetry.Samples); n > 0 {
+		// only full locations are shared, as in the vehicle's own events
+		location := vehicle.positionData()
+		lat, latOK := location["lat"].(float64)
+		lon, lonOK := location["lon"].(float64)
+		if latOK && lonOK {
+			telemetry.Samples[n-1].Lat, telemetry.Samples[n-1].Lon = &lat, &lon
+		}
+	}
+	for _, anchor := range vehicle.anchored.recent() {
+		if anchor.Time.After(since) {
+			telemetry.Anchors = append(telemetry.Anchors, anchor)
+		}
+	}
+	// scores are anchored once their trip or month ends
+	scores, err := loadScores("", since.AddDate(0, -2, 0), now)
+	if err != nil {
+		return nil, err
+	}
+	for _, score := range scores {
+		if score.End.After(since) {
+			telemetry.Scores = append(telemetry.Scores, score)
+		}
+	}
+	return telemetry, nil
+}
+
+// anchor has the fleet server commit and reveal entry, paid by the
+// organization, and returns the txID
+func (agent *fleetAgent) anchor(entry *factom.Entry) (string, error) {
+	var reply struct {
+		TxID string `json:"txID"`
+	}
+	req := fleetEntry{ChainID: entry.ChainID, ExtIDs: entry.ExtIDs, Content: entry.Content}
+	if err := agent.post("/agent/anchor", "application/json", jsonBody(req), &reply); err != nil {
+		return "", err
+	}
+	return reply.TxID, nil
+}
+
+// createChain has the fleet server create the vehicle's chain with first as
+// its first entry, paid by the organization
+func (agent *fleetAgent) createChain(first *factom.Entry) (string, error) {
+	var reply struct {
+		TxID string `json:"txID"`
+	}
+	req := fleetEntry{ChainID: first.ChainID, ExtIDs: first.ExtIDs, Content: first.Content, NewChain: true}
+	if err := agent.post("/agent/anchor", "application/json", jsonBody(req), &reply); err != nil {
+		return "", err
+	}
+	return reply.TxID, nil
+}
+
+func jsonBody(v interface{}) io.Reader {
+	data, _ := json.Marshal(v)
+	return bytes.NewReader(data)
+}
+
+// post sends body to the fleet server's path and decodes the JSON reply into v, if not nil
+func (agent *fleetAgent) post(path, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(agent.config.Server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+agent.config.Token)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(fleetVINHeader, agent.vehicle.vin)
+	resp, err := agent.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("fleet server: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// poll reports the device's health and waits for commands
+func (agent *fleetAgent) poll() ([]FleetCommand, error) {
+	heartbeat := FleetHeartbeat{VIN: agent.vehicle.vin, Time: time.Now().UTC(), Status: agent.vehicle.status()}
+	var commands []FleetCommand
+	err := agent.post("/agent/poll", "application/json", jsonBody(heartbeat), &commands)
+	return commands, err
+}
+
+func (agent *fleetAgent) run(command FleetCommand) error {
+	switch command.Kind {
+	case FleetConfigPush:
+		// validate before replacing the working config, which must keep
+		// data where the residency of the device allows
+		pushed, err := ParseConfig(command.Config)
+		if err != nil {
+			return err
+		}
+		if err := agent.residency.check(pushed); err != nil {
+			return fmt.Errorf("refusing config: %v", err)
+		}
+		if agent.residency != nil && pushed.Residency == nil {
+			return fmt.Errorf("refusing config: it drops the device's data residency")
+		}
+		if err := writeAtomic(agent.configPath, command.Config); err != nil {
+			return err
+		}
+		fmt.Println("Fleet server pushed a new config, it applies at the next start")
+		return nil
+	case FleetEvidence:
+		return agent.uploadEvidence(command)
+	}
+	return fmt.Errorf("unknown command %q", command.Kind)
+}
+
+// uploadEvidence exports the requested evidence and uploads it as a tar.gz
+func (agent *fleetAgent) uploadEvidence(command FleetCommand) error {
+	dir, err := ioutil.TempDir("", "blackbox-fleet")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path, _, err := agent.vehicle.ExportEvidence(dir, command.From, command.To)
+	if err != nil {
+		return err
+	}
+	agent.vehicle.logAccess("evidence-export", "fleet:"+command.ID, evidenceData, map[string]interface{}{
+		"via": "fleet", "server": agent.config.Server, "command": command.ID,
+	})
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(tarDir(w, path))
+	}()
+	err = agent.post("/agent/evidence?id="+command.ID, "application/gzip", r, nil)
+	r.Close()
+	return err
+}
+
+// tarDir writes the files under dir to w as a tar.gz, named relative to dir's parent
+func tarDir(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	parent := filepath.Dir(dir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
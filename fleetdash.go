@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Fleet dashboard settings
+const (
+	fleetMaxSamples     = 600              // samples sent per telemetry push, the latest kept
+	fleetAnchorCount    = 20               // recent anchors kept per device
+	fleetOfflineAfter   = 3 * time.Minute  // without a poll, a device is offline
+	fleetAnchorStale    = 30 * time.Minute // without an anchor, a recording device is behind
+	defaultSampleDays   = 30               // days of samples kept in the local series
+	fleetRetentionCheck = time.Hour
+)
+
+// fleetSamplesBucket holds <vin>/fleet/<time> -> FleetSample in an
+// organization's index
+var fleetSamplesBucket = []byte("fleet")
+
+// InfluxConfig copies fleet telemetry into an InfluxDB 2 bucket, e.g. for
+// Grafana, on top of the server's own series
+type InfluxConfig struct {
+	URL    string `json:"url"` // e.g. "http://localhost:8086"
+	Token  string `json:"token"`
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+}
+
+// FleetSample is one telemetry sample pushed by a device. Positions are only
+// sent by devices recording full locations.
+type FleetSample struct {
+	Time     time.Time `json:"time"`
+	Lat      *float64  `json:"lat,omitempty"`
+	Lon      *float64  `json:"lon,omitempty"`
+	Speed    float64   `json:"speed"` // km/h
+	Readings []Reading `json:"readings,omitempty"`
+}
+
+// FleetTelemetry is what a device pushes to /agent/telemetry: its samples,
+// anchors and driving scores since the last push
+type FleetTelemetry struct {
+	VIN     string          `json:"vin"`
+	Samples []FleetSample   `json:"samples"`
+	Anchors []Anchor        `json:"anchors"`
+	Scores  []*DrivingScore `json:"scores"`
+}
+
+// FleetVehicle is one vehicle of the fleet overview
+type FleetVehicle struct {
+	VIN            string        `json:"vin"`
+	Health         string        `json:"health"` // "ok", "warning" or "offline"
+	Problems       []string      `json:"problems"`
+	LastSeen       time.Time     `json:"lastSeen"`
+	Driver         string        `json:"driver,omitempty"`
+	Position       *FleetSample  `json:"position,omitempty"`
+	PendingAnchors int           `json:"pendingAnchors"`
+	LastAnchor     *Anchor       `json:"lastAnchor,omitempty"`
+	Score          *DrivingScore `json:"score,omitempty"`   // latest trip
+	Monthly        *DrivingScore `json:"monthly,omitempty"` // latest month
+}
+
+// FleetOverview is the fleet dashboard's data, GET /orgs/<org>/overview
+type FleetOverview struct {
+	Org      FleetOrg       `json:"org"`
+	Vehicles []FleetVehicle `json:"vehicles"`
+}
+
+// PutFleetSamples stores samples pushed by vin's device
+func (s *Store) PutFleetSamples(vin string, samples []FleetSample) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, fleetSamplesBucket)
+		if err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			value, err := json.Marshal(sample)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(timeKey(sample.Time), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FleetSamples returns the samples of vin between start and end
+func (s *Store) FleetSamples(vin string, start, end time.Time) ([]FleetSample, error) {
+	samples := []FleetSample{}
+	err := s.scan(vin, fleetSamplesBucket, start, end, func(value []byte) error {
+		var sample FleetSample
+		if err := json.Unmarshal(value, &sample); err != nil {
+			return err
+		}
+		samples = append(samples, sample)
+		return nil
+	})
+	return samples, err
+}
+
+// DeleteFleetSamples removes the samples of vin taken before t
+func (s *Store) DeleteFleetSamples(vin string, before time.Time) error {
+	max := timeKey(before)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, fleetSamplesBucket)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// influxEscape escapes a line protocol tag key, tag value or field key
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// influxLines encodes samples as line protocol, one "blackbox" point per
+// sample with the numeric readings as fields
+func influxLines(org, vin string, samples []FleetSample) []byte {
+	var buf bytes.Buffer
+	for _, sample := range samples {
+		fields := []string{"speed=" + strconv.FormatFloat(sample.Speed, 'f', -1, 64)}
+		if sample.Lat != nil && sample.Lon != nil {
+			fields = append(fields, "lat="+strconv.FormatFloat(*sample.Lat, 'f', -1, 64), "lon="+strconv.FormatFloat(*sample.Lon, 'f', -1, 64))
+		}
+		for _, reading := range sample.Readings {
+			if v, err := strconv.ParseFloat(reading.Value, 64); err == nil {
+				fields = append(fields, influxEscape(reading.Name)+"="+strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+		fmt.Fprintf(&buf, "blackbox,org=%s,vin=%s %s %d\n", influxEscape(org), influxEscape(vin), strings.Join(fields, ","), sample.Time.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+// writeInflux sends samples to the InfluxDB 2 write API
+func writeInflux(config *InfluxConfig, org, vin string, samples []FleetSample) error {
+	query := url.Values{"org": {config.Org}, "bucket": {config.Bucket}, "precision": {"ns"}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(config.URL, "/")+"/api/v2/write?"+query.Encode(), bytes.NewReader(influxLines(org, vin, samples)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+config.Token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB replied %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// handleTelemetry stores a device's samples in the organization's series and
+// keeps its position, anchors and scores for the overview
+func (s *fleetServer) handleTelemetry(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	var telemetry FleetTelemetry
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&telemetry); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := org.store.PutFleetSamples(vin, telemetry.Samples); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if s.config.Influx != nil && len(telemetry.Samples) > 0 {
+		if err := writeInflux(s.config.Influx, org.id, vin, telemetry.Samples); err != nil {
+			fmt.Printf("Failed to write telemetry of %s to InfluxDB: %v\n", vin, err)
+		}
+	}
+
+	s.mu.Lock()
+	device := s.deviceLocked(vin)
+	for i := range telemetry.Samples {
+		if sample := &telemetry.Samples[i]; sample.Lat != nil && (device.Position == nil || sample.Time.After(device.Position.Time)) {
+			device.Position = sample
+		}
+	}
+	device.Anchors = append(device.Anchors, telemetry.Anchors...)
+	if len(device.Anchors) > fleetAnchorCount {
+		device.Anchors = device.Anchors[len(device.Anchors)-fleetAnchorCount:]
+	}
+	for _, score := range telemetry.Scores {
+		if score.Period == ScoreMonth {
+			device.Monthly = score
+		} else {
+			device.Score = score
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// fleetHealth rates a device from its last heartbeat and pushes
+func fleetHealth(device *FleetDevice, now time.Time) (string, []string) {
+	if now.Sub(device.LastSeen) > fleetOfflineAfter {
+		return "offline", []string{"last seen " + device.LastSeen.Format(time.RFC3339)}
+	}
+	problems := []string{}
+	if status := device.Status; status != nil {
+		if status.Storage != "normal" {
+			problems = append(problems, "storage "+status.Storage)
+		}
+		if status.Backlog != "normal" {
+			problems = append(problems, "anchoring "+status.Backlog)
+		}
+		if status.Thermal != "normal" {
+			problems = append(problems, "thermal "+status.Thermal)
+		}
+		if status.TimeConfidence == TimeConfidenceLow {
+			problems = append(problems, "clock not synced")
+		}
+		for _, task := range status.Tasks {
+			if !task.Running && task.LastError != "" {
+				problems = append(problems, task.Name+" failing")
+			}
+		}
+		if status.Recording && len(device.Anchors) > 0 && now.Sub(device.Anchors[len(device.Anchors)-1].Time) > fleetAnchorStale {
+			problems = append(problems, "no anchor for "+now.Sub(device.Anchors[len(device.Anchors)-1].Time).Round(time.Minute).String())
+		}
+	}
+	if len(problems) > 0 {
+		return "warning", problems
+	}
+	return "ok", problems
+}
+
+// overview summarizes the organization's vehicles for the dashboard
+func (s *fleetServer) overview(org *fleetOrg) FleetOverview {
+	overview := FleetOverview{Org: s.summary(org), Vehicles: []FleetVehicle{}}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for vin := range org.config.Devices {
+		device, ok := s.devices[vin]
+		if !ok {
+			overview.Vehicles = append(overview.Vehicles, FleetVehicle{VIN: vin, Health: "offline", Problems: []string{"never connected"}})
+			continue
+		}
+		vehicle := FleetVehicle{
+			VIN:      vin,
+			LastSeen: device.LastSeen,
+			Position: device.Position,
+			Score:    device.Score,
+			Monthly:  device.Monthly,
+		}
+		vehicle.Health, vehicle.Problems = fleetHealth(device, now)
+		if device.Status != nil {
+			vehicle.Driver, vehicle.PendingAnchors = device.Status.Driver, device.Status.PendingAnchors
+		}
+		if n := len(device.Anchors); n > 0 {
+			anchor := device.Anchors[n-1]
+			vehicle.LastAnchor = &anchor
+		}
+		overview.Vehicles = append(overview.Vehicles, vehicle)
+	}
+	sort.Slice(overview.Vehicles, func(i, j int) bool { return overview.Vehicles[i].VIN < overview.Vehicles[j].VIN })
+	return overview
+}
+
+// handleDeviceTelemetry returns the samples of a device between the from and
+// to query parameters
+func (s *fleetServer) handleDeviceTelemetry(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	samples, err := org.store.FleetSamples(vin, start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+// runSeriesRetention deletes samples older than the configured days
+func (s *fleetServer) runSeriesRetention() {
+	days := s.config.SampleDays
+	if days <= 0 {
+		days = defaultSampleDays
+	}
+	for {
+		before := time.Now().AddDate(0, 0, -days)
+		for _, org := range s.orgs {
+			for vin := range org.config.Devices {
+				if err := org.store.DeleteFleetSamples(vin, before); err != nil {
+					fmt.Printf("Failed to prune the samples of %s of %s: %v\n", vin, org.id, err)
+				}
+			}
+		}
+		time.Sleep(fleetRetentionCheck)
+	}
+}
+
+// handleDashboardPage serves the fleet dashboard. The page holds no data, it
+// reads the overview with the organization token given after # in its URL.
+func (s *fleetServer) handleDashboardPage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, fleetDashboardHTML, fleetDashboardRefresh)
+}
+
+// fleetDashboardRefresh is the milliseconds between overview refreshes
+const fleetDashboardRefresh = 10000
+
+// fleetDashboardHTML is the fleet dashboard page, opened as
+// /orgs/<org>/dashboard#token=<organization admin token>. It polls
+// overview; %d is the poll interval.
+const fleetDashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Blackbox fleet</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css">
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>
+body { font-family: sans-serif; margin: 0; background: #f4f4f4; color: #222; }
+header { background: #222; color: #fff; padding: 12px 16px; display: flex; justify-content: space-between; }
+main { padding: 16px; display: grid; gap: 16px; }
+section { background: #fff; border-radius: 6px; padding: 12px 16px; }
+h2 { font-size: 1em; margin: 0 0 8px; color: #666; text-transform: uppercase; }
+#map { height: 420px; }
+table { width: 100%%; border-collapse: collapse; font-size: 0.9em; }
+th { text-align: left; color: #666; font-weight: normal; }
+td, th { padding: 3px 4px; border-bottom: 1px solid #eee; }
+.ok { color: #2a7d2a; } .warning { color: #b07400; } .offline { color: #b00020; }
+</style>
+</head>
+<body>
+<header><span id="org">Blackbox fleet</span><span id="counts"></span></header>
+<main>
+<section><div id="map"></div></section>
+<section><h2>Vehicles</h2><table>
+<thead><tr><th>VIN</th><th>Health</th><th>Driver</th><th>Last seen</th><th>Anchoring</th><th>Trip score</th><th>Month score</th></tr></thead>
+<tbody id="vehicles"></tbody></table></section>
+</main>
+<script>
+function esc(s) { return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"})[c]); }
+function when(t) { return t && !t.startsWith("0001") ? new Date(t).toLocaleString() : "never"; }
+function score(s) { return s ? s.score.toFixed(0) : ""; }
+
+const map = L.map("map").setView([39.5, -98.35], 4);
+L.tileLayer("https://tile.openstreetmap.org/{z}/{x}/{y}.png", {maxZoom: 19, attribution: "&copy; OpenStreetMap contributors"}).addTo(map);
+const markers = {};
+var fitted = false;
+
+function render(d) {
+  document.getElementById("org").textContent = "Blackbox fleet · " + d.org.name;
+  const counts = {ok: 0, warning: 0, offline: 0};
+  d.vehicles.forEach(v => counts[v.health]++);
+  document.getElementById("counts").textContent = counts.ok + " ok, " + counts.warning + " warning, " + counts.offline + " offline" +
+    (d.org.needsFunds ? " · entry credits low" : "");
+  document.getElementById("vehicles").innerHTML = d.vehicles.map(v => "<tr>" + [
+    esc(v.vin),
+    '<span class="' + v.health + '" title="' + esc(v.problems.join(", ")) + '">' + v.health + (v.problems.length ? ": " + esc(v.problems[0]) : "") + "</span>",
+    esc(v.driver || ""),
+    when(v.lastSeen),
+    v.pendingAnchors > 0 ? v.pendingAnchors + " pending" : (v.lastAnchor ? "anchored " + when(v.lastAnchor.time) : ""),
+    score(v.score),
+    score(v.monthly),
+  ].map(c => "<td>" + c + "</td>").join("") + "</tr>").join("");
+
+  const bounds = [];
+  d.vehicles.forEach(v => {
+    if (!v.position || v.position.lat === undefined) return;
+    const at = [v.position.lat, v.position.lon];
+    bounds.push(at);
+    const label = esc(v.vin) + "<br>" + v.position.speed.toFixed(0) + " km/h at " + when(v.position.time);
+    if (markers[v.vin]) markers[v.vin].setLatLng(at).setPopupContent(label);
+    else markers[v.vin] = L.marker(at).addTo(map).bindPopup(label);
+  });
+  if (!fitted && bounds.length) { map.fitBounds(bounds, {maxZoom: 12}); fitted = true; }
+}
+
+const params = new URLSearchParams(location.hash.slice(1));
+if (params.get("token")) {
+  sessionStorage.setItem("fleetToken", params.get("token"));
+  history.replaceState(null, "", location.pathname);
+}
+const token = sessionStorage.getItem("fleetToken");
+
+function poll() {
+  fetch(location.pathname.replace(/dashboard$/, "overview"), {headers: {Authorization: "Bearer " + token}})
+    .then(r => r.json()).then(render).catch(e => console.log(e)).finally(() => setTimeout(poll, %d));
+}
+poll();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// fleetVINHeader names the device on every agent request
+const fleetVINHeader = "X-Blackbox-VIN"
+
+// defaultFleetOrg is the organization of devices listed at the top level of a
+// single tenant fleet server config
+const defaultFleetOrg = "default"
+
+// FleetServerConfig configures the reference fleet management server. The
+// server hosts organizations, each with its own devices, operators, chain
+// index and entry credits, isolated from the others.
+type FleetServerConfig struct {
+	Listen     string                     `json:"listen"`     // address to serve on, e.g. ":8443"
+	AdminToken string                     `json:"adminToken"` // bearer token of the server operator, who sees each organization's funding but none of its data
+	Orgs       map[string]*FleetOrgConfig `json:"orgs"`       // organizations by ID
+	Devices    map[string]string          `json:"devices"`    // device token by VIN of the "default" organization, run by the server operator
+	Dir        string                     `json:"dir"`        // where each organization's evidence and index are kept, default "fleet"
+	Factomd    string                     `json:"factomd"`    // factomd API for indexing and paying for entries, default localhost:8088
+	TLS        *TLSConfig                 `json:"tls"`        // require mutual TLS, devices present certificates issued by TLS.CA
+	Influx     *InfluxConfig              `json:"influx"`     // also write device telemetry to InfluxDB, optional
+	SampleDays int                        `json:"sampleDays"` // days of device telemetry kept, default 30
+}
+
+// FleetOrgConfig is one organization on the fleet server
+type FleetOrgConfig struct {
+	Name       string            `json:"name"`
+	AdminToken string            `json:"adminToken"` // bearer token of the organization's operators
+	Devices    map[string]string `json:"devices"`    // device token by VIN
+	ECKey      string            `json:"ecKey"`      // private EC address paying for the entries of devices set to "funded", optional
+	MinBalance int64             `json:"minBalance"` // entry credit balance below which the organization needs funding
+	Residency  *ResidencyConfig  `json:"residency"`  // where its devices' data may go, enforced on config pushes, optional
+}
+
+// FleetDevice is what the server knows about a device. Position, Anchors
+// (most recent last) and the latest trip and monthly scores come from its
+// telemetry pushes.
+type FleetDevice struct {
+	VIN      string         `json:"vin"`
+	LastSeen time.Time      `json:"lastSeen"`
+	Status   *Status        `json:"status,omitempty"`
+	Pending  []FleetCommand `json:"pending"` // queued, not yet picked up
+	Results  []FleetResult  `json:"results"` // most recent last
+	Position *FleetSample   `json:"position,omitempty"`
+	Anchors  []Anchor       `json:"anchors"`
+	Score    *DrivingScore  `json:"score,omitempty"`
+	Monthly  *DrivingScore  `json:"monthly,omitempty"`
+}
+
+// FleetOrg summarizes an organization and its entry credit account
+type FleetOrg struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Devices     int    `json:"devices"`
+	ECAddress   string `json:"ecAddress,omitempty"`
+	ECBalance   *int64 `json:"ecBalance,omitempty"` // nil if factomd could not be reached
+	NeedsFunds  bool   `json:"needsFunds"`          // balance below the organization's minBalance
+	EntriesPaid int    `json:"entriesPaid"`         // since the server started
+	ECSpent     int64  `json:"ecSpent"`
+}
+
+// fleetEntry is an entry a funded device asks the server to pay for
+type fleetEntry struct {
+	ChainID  string   `json:"chainID"`
+	ExtIDs   [][]byte `json:"extIDs"`
+	Content  []byte   `json:"content"`
+	NewChain bool     `json:"newChain,omitempty"` // the first entry of the vehicle's chain
+}
+
+// chainCreationCost is the entry credits creating a chain costs on top of its first entry
+const chainCreationCost = 10
+
+// fleetResultCount is how many command results are kept per device
+const fleetResultCount = 50
+
+// fleetOrg is the state of one organization
+type fleetOrg struct {
+	id        string
+	config    *FleetOrgConfig
+	ecAddress *factom.ECAddress // nil if the organization doesn't pay for entries
+	store     *Store            // index of its vehicles' chains
+
+	// guarded by fleetServer.mu
+	entriesPaid int
+	ecSpent     int64
+}
+
+// fleetServer is the reference fleet management server. Devices long poll
+// /agent/poll; operators queue commands and read device state under /orgs.
+type fleetServer struct {
+	config *FleetServerConfig
+	orgs   map[string]*fleetOrg
+	vins   map[string]*fleetOrg // organization of each device
+	chain  chainReader
+	client ChainClient // commits and reveals the entries organizations pay for
+
+	mu      sync.Mutex
+	devices map[string]*FleetDevice
+	wake    map[string]chan struct{} // closed when a command is queued for the device
+}
+
+// LoadFleetServerConfig reads the fleet server's JSON config file
+func LoadFleetServerConfig(path string) (*FleetServerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &FleetServerConfig{Listen: ":8443", Dir: "fleet", Factomd: "localhost:8088"}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.AdminToken == "" {
+		return nil, fmt.Errorf("fleet server: adminToken is required")
+	}
+	if len(config.Devices) > 0 {
+		if config.Orgs == nil {
+			config.Orgs = make(map[string]*FleetOrgConfig)
+		}
+		if _, ok := config.Orgs[defaultFleetOrg]; ok {
+			return nil, fmt.Errorf("fleet server: devices given both at the top level and in the %q organization", defaultFleetOrg)
+		}
+		config.Orgs[defaultFleetOrg] = &FleetOrgConfig{Name: "Default", AdminToken: config.AdminToken, Devices: config.Devices}
+	}
+	vins := make(map[string]string)
+	for id, org := range config.Orgs {
+		if !validOrgID(id) {
+			return nil, fmt.Errorf("fleet server: invalid organization ID %q", id)
+		}
+		if org.AdminToken == "" {
+			return nil, fmt.Errorf("fleet server: organization %s has no adminToken", id)
+		}
+		if org.Residency != nil {
+			if err := org.Residency.validate(); err != nil {
+				return nil, fmt.Errorf("fleet server: organization %s: %v", id, err)
+			}
+		}
+		for vin := range org.Devices {
+			if other, ok := vins[vin]; ok {
+				return nil, fmt.Errorf("fleet server: %s is a device of both %s and %s", vin, other, id)
+			}
+			vins[vin] = id
+		}
+	}
+	return config, nil
+}
+
+// validOrgID accepts IDs safe to use as a directory name
+func validOrgID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newFleetServer opens every organization's index and entry credit account
+func newFleetServer(config *FleetServerConfig) (*fleetServer, error) {
+	s := &fleetServer{
+		config:  config,
+		orgs:    make(map[string]*fleetOrg),
+		vins:    make(map[string]*fleetOrg),
+		chain:   newFactomdNode(config.Factomd),
+		client:  factomdClient{},
+		devices: make(map[string]*FleetDevice),
+		wake:    make(map[string]chan struct{}),
+	}
+	for id, orgConfig := range config.Orgs {
+		org := &fleetOrg{id: id, config: orgConfig}
+		if orgConfig.ECKey != "" {
+			address, err := factom.GetECAddress(orgConfig.ECKey)
+			if err != nil {
+				return nil, fmt.Errorf("organization %s: %v", id, err)
+			}
+			org.ecAddress = address
+		}
+		dir := filepath.Join(config.Dir, id)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		store, err := OpenStore(filepath.Join(dir, "index.db"))
+		if err != nil {
+			return nil, fmt.Errorf("organization %s: %v", id, err)
+		}
+		org.store = store
+		s.orgs[id] = org
+		for vin := range orgConfig.Devices {
+			s.vins[vin] = org
+		}
+	}
+	return s, nil
+}
+
+// ServeFleet serves the fleet server until it fails
+func ServeFleet(config *FleetServerConfig) error {
+	factom.SetFactomdServer(config.Factomd)
+	s, err := newFleetServer(config)
+	if err != nil {
+		return err
+	}
+	go s.runIndexes()
+	go s.runSeriesRetention()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agent/poll", s.device(s.handlePoll))
+	mux.HandleFunc("/agent/result", s.device(s.handleResult))
+	mux.HandleFunc("/agent/evidence", s.device(s.handleEvidence))
+	mux.HandleFunc("/agent/anchor", s.device(s.handleAnchor))
+	mux.HandleFunc("/agent/telemetry", s.device(s.handleTelemetry))
+	mux.HandleFunc("/orgs", s.handleOrgs)
+	mux.HandleFunc("/orgs/", s.handleOrg)
+	server := &http.Server{
+		Addr:        config.Listen,
+		Handler:     mux,
+		ReadTimeout: 10 * time.Minute, // evidence uploads
+	}
+	fmt.Printf("Fleet server listening on %s for %d organizations\n", config.Listen, len(s.orgs))
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func tokenMatches(r *http.Request, token string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// device authenticates agent requests by the token issued to the VIN they name
+func (s *fleetServer) device(handler func(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := r.Header.Get(fleetVINHeader)
+		org, ok := s.vins[vin]
+		if !ok || !tokenMatches(r, org.config.Devices[vin]) {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("unknown device or token"))
+			return
+		}
+		// with mutual TLS the certificate must be the device's own
+		if name := peerName(r.TLS); r.TLS != nil && name != vin {
+			writeError(w, http.StatusForbidden, fmt.Errorf("certificate %q does not belong to %s", name, vin))
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		handler(w, r, org, vin)
+	}
+}
+
+// deviceLocked returns the device's record, creating it. s.mu must be held.
+func (s *fleetServer) deviceLocked(vin string) *FleetDevice {
+	device, ok := s.devices[vin]
+	if !ok {
+		device = &FleetDevice{VIN: vin}
+		s.devices[vin] = device
+		s.wake[vin] = make(chan struct{})
+	}
+	return device
+}
+
+// handlePoll records the device's heartbeat and answers with its queued
+// commands, holding the request open until one is queued or fleetPollTimeout
+func (s *fleetServer) handlePoll(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	var heartbeat FleetHeartbeat
+	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout := time.NewTimer(fleetPollTimeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		device := s.deviceLocked(vin)
+		device.LastSeen = time.Now().UTC()
+		device.Status = heartbeat.Status
+		commands := device.Pending
+		device.Pending = nil
+		wake := s.wake[vin]
+		s.mu.Unlock()
+
+		if len(commands) > 0 {
+			writeJSON(w, http.StatusOK, commands)
+			return
+		}
+		select {
+		case <-wake:
+		case <-timeout.C:
+			writeJSON(w, http.StatusOK, []FleetCommand{})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *fleetServer) handleResult(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	var result FleetResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	device := s.deviceLocked(vin)
+	device.Results = append(device.Results, result)
+	if len(device.Results) > fleetResultCount {
+		device.Results = device.Results[len(device.Results)-fleetResultCount:]
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// evidencePath is where the evidence retrieved by a command is kept
+func (s *fleetServer) evidencePath(org *fleetOrg, vin, id string) string {
+	return filepath.Join(s.config.Dir, org.id, vin, id+".tar.gz")
+}
+
+func validFleetID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return id != "" && err == nil
+}
+
+func (s *fleetServer) handleEvidence(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	id := r.URL.Query().Get("id")
+	if !validFleetID(id) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid command id"))
+		return
+	}
+	path := s.evidencePath(org, vin, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	file, err := os.OpenFile(path+tempExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = io.Copy(file, r.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+tempExt, path)
+	}
+	if err != nil {
+		os.Remove(path + tempExt)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Fleet server received evidence %s from %s of %s\n", id, vin, org.id)
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// handleAnchor commits and reveals an entry of a device's own chain, or
+// creates the chain, paid from its organization's entry credits
+func (s *fleetServer) handleAnchor(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	if org.ecAddress == nil {
+		writeError(w, http.StatusForbidden, fmt.Errorf("organization %s does not pay for entries", org.id))
+		return
+	}
+	var req fleetEntry
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// the organization's credits only pay for its own vehicles
+	if req.ChainID != vehicleChainID(vin) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("entry is not for the chain of %s", vin))
+		return
+	}
+	entry := &factom.Entry{ChainID: req.ChainID, ExtIDs: req.ExtIDs, Content: req.Content}
+	cost, err := factom.EntryCost(entry)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var txID string
+	if req.NewChain {
+		chain := factom.NewChain(entry)
+		if chain.ChainID != req.ChainID {
+			writeError(w, http.StatusForbidden, fmt.Errorf("entry does not create the chain of %s", vin))
+			return
+		}
+		cost += chainCreationCost
+		txID, err = commitRevealChain(s.client, defaultRetry, chain, org.ecAddress)
+	} else {
+		txID, err = commitRevealEntry(s.client, defaultRetry, entry, org.ecAddress)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	s.mu.Lock()
+	org.entriesPaid++
+	org.ecSpent += int64(cost)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// summary describes the organization and fetches its entry credit balance
+func (s *fleetServer) summary(org *fleetOrg) FleetOrg {
+	s.mu.Lock()
+	summary := FleetOrg{
+		ID:          org.id,
+		Name:        org.config.Name,
+		Devices:     len(org.config.Devices),
+		EntriesPaid: org.entriesPaid,
+		ECSpent:     org.ecSpent,
+	}
+	s.mu.Unlock()
+	if org.ecAddress != nil {
+		summary.ECAddress = org.ecAddress.String()
+		if balance, err := s.client.ecBalance(summary.ECAddress); err == nil {
+			summary.ECBalance = &balance
+			summary.NeedsFunds = balance < org.config.MinBalance
+		}
+	}
+	return summary
+}
+
+// handleOrgs lists the organizations and their funding to the server operator
+func (s *fleetServer) handleOrgs(w http.ResponseWriter, r *http.Request) {
+	if !tokenMatches(r, s.config.AdminToken) {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("admin token required"))
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	orgs := make([]FleetOrg, 0, len(s.orgs))
+	for _, org := range s.orgs {
+		orgs = append(orgs, s.summary(org))
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].ID < orgs[j].ID })
+	writeJSON(w, http.StatusOK, orgs)
+}
+
+// handleOrg serves an organization to its operators:
+//
+//	GET  /orgs/<org>                                organization and funding summary
+//	GET  /orgs/<org>/dashboard#token=<token>        fleet dashboard page
+//	GET  /orgs/<org>/overview                       map, health, anchoring and scores of every vehicle
+//	GET  /orgs/<org>/devices                        every device that has connected
+//	GET  /orgs/<org>/devices/<vin>                  device state
+//	POST /orgs/<org>/devices/<vin>/commands         queue a FleetCommand, returned with its ID
+//	GET  /orgs/<org>/devices/<vin>/evidence/<id>    evidence uploaded for an evidence command
+//	GET  /orgs/<org>/devices/<vin>/telemetry?from=&to=
+//	                                                samples the device pushed
+//	GET  /orgs/<org>/entries?vin=&from=&to=&kind=&type=&stream=
+//	                                                the organization's chain index
+func (s *fleetServer) handleOrg(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/")
+	if len(parts) == 2 && parts[1] == "dashboard" {
+		// the page carries no data, its requests send the token
+		s.handleDashboardPage(w, r)
+		return
+	}
+	org, ok := s.orgs[parts[0]]
+	if !ok || !tokenMatches(r, org.config.AdminToken) {
+		// unknown organizations look the same as wrong tokens
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("organization admin token required"))
+		return
+	}
+	parts = parts[1:]
+	switch {
+	case len(parts) == 0:
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.summary(org))
+		}
+	case len(parts) == 1 && parts[0] == "devices":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		s.mu.Lock()
+		devices := []FleetDevice{}
+		for vin := range org.config.Devices {
+			if device, ok := s.devices[vin]; ok {
+				devices = append(devices, *device)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(devices, func(i, j int) bool { return devices[i].VIN < devices[j].VIN })
+		writeJSON(w, http.StatusOK, devices)
+	case len(parts) == 1 && parts[0] == "overview":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.overview(org))
+		}
+	case len(parts) == 1 && parts[0] == "entries":
+		s.handleOrgEntries(w, r, org)
+	case len(parts) >= 2 && parts[0] == "devices":
+		s.handleDevice(w, r, org, parts[1], parts[2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleDevice serves one device of org, rest is the path after its VIN
+func (s *fleetServer) handleDevice(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string, rest []string) {
+	if _, ok := org.config.Devices[vin]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown device %q", vin))
+		return
+	}
+	switch {
+	case len(rest) == 0:
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		s.mu.Lock()
+		device := *s.deviceLocked(vin)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, device)
+	case len(rest) == 1 && rest[0] == "commands":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.queueCommand(w, r, org, vin)
+	case len(rest) == 2 && rest[0] == "evidence" && validFleetID(rest[1]):
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		http.ServeFile(w, r, s.evidencePath(org, vin, rest[1]))
+	case len(rest) == 1 && rest[0] == "telemetry":
+		s.handleDeviceTelemetry(w, r, org, vin)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fleetServer) queueCommand(w http.ResponseWriter, r *http.Request, org *fleetOrg, vin string) {
+	var command FleetCommand
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch command.Kind {
+	case FleetConfigPush:
+		config, err := ParseConfig(command.Config)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := org.config.Residency.check(config); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if org.config.Residency != nil && config.Residency == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("the organization pins data residency, the config must set residency"))
+			return
+		}
+	case FleetEvidence:
+		if !command.From.Before(command.To) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown command %q", command.Kind))
+		return
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	command.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	device := s.deviceLocked(vin)
+	device.Pending = append(device.Pending, command)
+	close(s.wake[vin])
+	s.wake[vin] = make(chan struct{})
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, command)
+}
+
+// handleOrgEntries queries the organization's chain index. vin is required and
+// must be one of the organization's devices.
+func (s *fleetServer) handleOrgEntries(w http.ResponseWriter, r *http.Request, org *fleetOrg) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	vin := r.URL.Query().Get("vin")
+	if _, ok := org.config.Devices[vin]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown device %q", vin))
+		return
+	}
+	start, end, filter, err := parseEntryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := org.store.ChainEntries(vin, start, end, filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []*IndexedEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// runIndexes keeps every organization's index of its vehicles' chains up to date
+func (s *fleetServer) runIndexes() {
+	for {
+		for _, org := range s.orgs {
+			for vin := range org.config.Devices {
+				vehicle, err := NewVehicle(vin, s.client)
+				if err != nil {
+					continue
+				}
+				vehicle.store = org.store
+				if _, err := vehicle.SyncChainIndex(s.chain, vin); err != nil {
+					fmt.Printf("Failed to index the chain of %s of %s: %v\n", vin, org.id, err)
+				}
+			}
+		}
+		time.Sleep(chainIndexInterval)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Geofence is a circular area that emits an event whenever the vehicle enters or leaves it
+type Geofence struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Radius float64 `json:"radius"` // meters
+	Anchor bool    `json:"anchor"` // also anchor enter/exit events on chain
+}
+
+// Contains returns true if the coordinate lies inside the geofence
+func (fence Geofence) Contains(lat, lon float64) bool {
+	return distanceMeters(fence.Lat, fence.Lon, lat, lon) <= fence.Radius
+}
+
+// geofenceMonitor remembers which fences the vehicle was last seen inside
+type geofenceMonitor struct {
+	fences []Geofence
+	inside map[string]bool
+}
+
+func newGeofenceMonitor(fences []Geofence) *geofenceMonitor {
+	return &geofenceMonitor{fences: fences, inside: make(map[string]bool)}
+}
+
+// update returns the fences entered and exited since the previous fix. The first
+// fix only establishes state, so starting up inside a fence is not an "enter".
+func (m *geofenceMonitor) update(fix *Fix, first bool) (entered, exited []Geofence) {
+	for _, fence := range m.fences {
+		now := fence.Contains(fix.Lat, fix.Lon)
+		was := m.inside[fence.Name]
+		m.inside[fence.Name] = now
+		if first || now == was {
+			continue
+		}
+		if now {
+			entered = append(entered, fence)
+		} else {
+			exited = append(exited, fence)
+		}
+	}
+	return entered, exited
+}
+
+func (vehicle *Vehicle) logGeofenceEvent(eventType string, fence Geofence, fix *Fix) {
+	data := vehicle.locationData(fix)
+	data["geofence"] = fence.Name
+	data["gpsTime"] = fix.Time
+	event := vehicle.NewEvent(eventType, data)
+	txID, err := vehicle.LogEvent(event, fence.Anchor)
+	if err != nil {
+		fmt.Println("Failed to log geofence event", err)
+		return
+	}
+	if txID != "" {
+		fmt.Printf("Geofence event secured to factom. TxID: %s\n", txID)
+	}
+}
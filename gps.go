@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fix is a single position reported by the GPS receiver
+type Fix struct {
+	Time   time.Time `json:"time"`
+	Lat    float64   `json:"lat"`    // decimal degrees, north positive
+	Lon    float64   `json:"lon"`    // decimal degrees, east positive
+	Speed  float64   `json:"speed"`  // km/h over ground
+	Course float64   `json:"course"` // degrees true
+
+	// Estimated is set on positions dead-reckoned during a GPS outage
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// GPS reads fixes from an NMEA 0183 stream, usually a serial GPS receiver
+type GPS struct {
+	reader *bufio.Reader
+	closer io.Closer
+
+	// raw, if set, is passed every sentence read, valid or not, as it was sent
+	raw func(sentence string)
+}
+
+// OpenGPS opens the NMEA serial device at path. Next fails if the receiver
+// sends nothing for timeout.
+func OpenGPS(path string, timeout time.Duration) (*GPS, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = file
+	// recorded NMEA files never block, and don't support deadlines
+	if file.SetReadDeadline(time.Time{}) == nil {
+		r = &deadlineReader{file: file, timeout: timeout}
+	}
+	gps := NewGPS(r)
+	gps.closer = file
+	return gps, nil
+}
+
+// deadlineReader fails a read of file that waits longer than timeout
+type deadlineReader struct {
+	file    *os.File
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if err := r.file.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.file.Read(p)
+}
+
+// NewGPS reads NMEA sentences from r
+func NewGPS(r io.Reader) *GPS {
+	return &GPS{reader: bufio.NewReader(r)}
+}
+
+// Close releases the underlying device
+func (gps *GPS) Close() error {
+	if gps.closer == nil {
+		return nil
+	}
+	return gps.closer.Close()
+}
+
+// Next blocks until the receiver reports a valid fix. Sentences other than RMC,
+// void fixes, and sentences with bad checksums are skipped.
+func (gps *GPS) Next() (*Fix, error) {
+	for {
+		line, err := gps.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if gps.raw != nil && (strings.HasPrefix(line, "$") || strings.HasPrefix(line, "!")) {
+			gps.raw(line)
+		}
+		fix, err := parseRMC(line)
+		if err != nil {
+			continue
+		}
+		return fix, nil
+	}
+}
+
+var errNoFix = errors.New("nmea: no fix")
+
+// parseRMC parses a $--RMC (recommended minimum) sentence, e.g.
+// $GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A
+func parseRMC(sentence string) (*Fix, error) {
+	fields, err := nmeaFields(sentence)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 10 || !strings.HasSuffix(fields[0], "RMC") {
+		return nil, fmt.Errorf("nmea: not an RMC sentence: %s", sentence)
+	}
+	if fields[2] != "A" {
+		return nil, errNoFix
+	}
+
+	t, err := time.Parse("020106 150405", fields[9]+" "+strings.SplitN(fields[1], ".", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	lat, err := nmeaDegrees(fields[3], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	lon, err := nmeaDegrees(fields[5], fields[6])
+	if err != nil {
+		return nil, err
+	}
+	knots, _ := strconv.ParseFloat(fields[7], 64)
+	course, _ := strconv.ParseFloat(fields[8], 64)
+
+	return &Fix{
+		Time:   t.UTC(),
+		Lat:    lat,
+		Lon:    lon,
+		Speed:  knots * 1.852,
+		Course: course,
+	}, nil
+}
+
+// nmeaFields validates the checksum of an NMEA sentence and splits its fields
+func nmeaFields(sentence string) ([]string, error) {
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, fmt.Errorf("nmea: missing start delimiter: %s", sentence)
+	}
+	body := sentence[1:]
+	if i := strings.LastIndex(body, "*"); i >= 0 {
+		want, err := strconv.ParseUint(body[i+1:], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("nmea: bad checksum: %s", sentence)
+		}
+		body = body[:i]
+		var sum byte
+		for j := 0; j < len(body); j++ {
+			sum ^= body[j]
+		}
+		if sum != byte(want) {
+			return nil, fmt.Errorf("nmea: checksum mismatch: %s", sentence)
+		}
+	}
+	return strings.Split(body, ","), nil
+}
+
+// nmeaDegrees converts a ddmm.mmmm value and N/S/E/W hemisphere to decimal degrees
+func nmeaDegrees(value, hemisphere string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	degrees := math.Floor(v / 100)
+	degrees += (v - degrees*100) / 60
+	if hemisphere == "S" || hemisphere == "W" {
+		degrees = -degrees
+	}
+	return degrees, nil
+}
+
+// distanceMeters returns the great-circle distance between two coordinates
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// RecordGPS reads fixes from gps until it is closed, keeping the vehicle's
+// position current and logging a signed "geofence-enter" or "geofence-exit"
+// event for each boundary crossing of the given fences
+func (vehicle *Vehicle) RecordGPS(gps *GPS, fences []Geofence) error {
+	monitor := newGeofenceMonitor(fences)
+	first := true
+	for {
+		fix, err := gps.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		vehicle.clock.gpsFix(fix)
+		if vehicle.privacyMode.active() {
+			// the fix still keeps time, but where the vehicle is isn't kept, and
+			// geofences start over afterwards rather than reveal crossings
+			first = true
+			continue
+		}
+		vehicle.position.set(fix)
+		if err := appendTrackPoint(fix); err != nil {
+			fmt.Println("Failed to log position", err)
+		}
+
+		entered, exited := monitor.update(fix, first)
+		for _, fence := range entered {
+			vehicle.logGeofenceEvent("geofence-enter", fence, fix)
+		}
+		for _, fence := range exited {
+			vehicle.logGeofenceEvent("geofence-exit", fence, fix)
+		}
+		first = false
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// trackLogPath is the local log of every position, one JSON Fix per line
+const trackLogPath = "track.log"
+
+var trackLogMu sync.Mutex
+
+// appendTrackPoint adds a position to the track log
+func appendTrackPoint(fix *Fix) error {
+	line, err := json.Marshal(fix)
+	if err != nil {
+		return err
+	}
+	trackLogMu.Lock()
+	defer trackLogMu.Unlock()
+	file, err := os.OpenFile(trackLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// readTrack returns the logged positions between start and end, inclusive
+func readTrack(start, end time.Time) ([]Fix, error) {
+	file, err := os.Open(trackLogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var track []Fix
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var fix Fix
+		if err := json.Unmarshal(scanner.Bytes(), &fix); err != nil {
+			continue // a torn line from a power cut
+		}
+		if fix.Time.Before(start) || fix.Time.After(end) {
+			continue
+		}
+		track = append(track, fix)
+	}
+	return track, scanner.Err()
+}
+
+// loadTrips returns the summaries of every recorded trip from the event log, oldest first
+func loadTrips() ([]*TripSummary, error) {
+	var trips []*TripSummary
+	err := readEvents("trip-summary", func() interface{} { return new(TripSummary) }, func(data interface{}, _ *SignedEvent) {
+		trips = append(trips, data.(*TripSummary))
+	})
+	return trips, err
+}
+
+// readEvents decodes the data of every event of eventType in the event log,
+// oldest first, into a value from newData and passes it to fn with the signed
+// event it came from
+func readEvents(eventType string, newData func() interface{}, fn func(data interface{}, signed *SignedEvent)) error {
+	file, err := os.Open(eventLogPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var signed SignedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &signed); err != nil {
+			continue
+		}
+		var event struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(signed.Event, &event); err != nil || event.Type != eventType || event.Data == nil {
+			continue
+		}
+		data := newData()
+		if err := json.Unmarshal(event.Data, data); err != nil {
+			continue
+		}
+		fn(data, &signed)
+	}
+	return scanner.Err()
+}
+
+// GPX 1.1 document, see http://www.topografix.com/GPX/1/1/
+type gpxDocument struct {
+	XMLName xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Desc    string     `xml:"desc"`
+	Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+	Type string  `xml:"type,omitempty"`
+}
+
+// ExportTripGPX writes the trip's track to a GPX file at path and anchors the
+// file's hash, returning the txID. Dead-reckoned points are typed "estimated".
+func (vehicle *Vehicle) ExportTripGPX(trip *TripSummary, path string) (string, error) {
+	track, err := readTrack(trip.Start, trip.End)
+	if err != nil {
+		return "", err
+	}
+	if len(track) == 0 {
+		return "", fmt.Errorf("no positions were logged during the trip starting %s", trip.Start)
+	}
+	name := fmt.Sprintf("%s %s", vehicle.vin, trip.Start.Format(time.RFC3339))
+	desc := fmt.Sprintf("%.1f km, max %.0f km/h, %d harsh events", trip.Distance, trip.MaxSpeed, trip.HarshEvents)
+	if err := writeGPX(path, name, desc, track); err != nil {
+		return "", err
+	}
+
+	hash, err := vehicle.getFileHash(path)
+	if err != nil {
+		return "", err
+	}
+	return vehicle.secureHashOnChain(hash)
+}
+
+// writeGPX writes track to a GPX file at path as a single track segment
+func writeGPX(path, name, desc string, track []Fix) error {
+	doc := gpxDocument{
+		Version: "1.1",
+		Creator: "blackbox",
+		Track:   gpxTrack{Name: name, Desc: desc},
+	}
+	for _, fix := range track {
+		point := gpxPoint{Lat: fix.Lat, Lon: fix.Lon, Time: fix.Time.UTC().Format(time.RFC3339)}
+		if fix.Estimated {
+			point.Type = "estimated"
+		}
+		doc.Track.Segment = append(doc.Track.Segment, point)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(xml.Header); err != nil {
+		file.Close()
+		return err
+	}
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// GRPCConfig enables the gRPC API described by proto/blackbox.proto, for
+// integrators building on the device in other languages
+type GRPCConfig struct {
+	Listen    string     `json:"listen"`    // address to serve on, e.g. "127.0.0.1:9090"
+	TLS       *TLSConfig `json:"tls"`       // require mutual TLS
+	RateLimit float64    `json:"rateLimit"` // calls per second per client, default 5
+	RateBurst int        `json:"rateBurst"` // calls allowed at once, default 20
+}
+
+// telemetryPollInterval is how often StreamTelemetry checks for a new sample
+const telemetryPollInterval = 100 * time.Millisecond
+
+// The messages of proto/blackbox.proto are encoded by hand with protowire
+// rather than generated, so the device doesn't carry the protobuf runtime.
+// protoCodec replaces grpc's default "proto" codec with one that calls them.
+
+// protoMessage is a reply that encodes itself in the protobuf wire format
+type protoMessage interface {
+	marshalProto() []byte
+}
+
+// protoRequest is a request that decodes itself from the protobuf wire format
+type protoRequest interface {
+	unmarshalProto(b []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	return m.marshalProto(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoRequest)
+	if !ok {
+		return fmt.Errorf("cannot decode %T", v)
+	}
+	return m.unmarshalProto(data)
+}
+
+// Encoding helpers. Like generated code, fields holding their zero value are omitted.
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// appendTimestamp encodes t as a google.protobuf.Timestamp
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	m = appendVarint(m, 1, uint64(t.Unix()))
+	m = appendVarint(m, 2, uint64(t.Nanosecond()))
+	return appendMessage(b, num, m)
+}
+
+// appendMap encodes a map<string, string>, formatting each value as text
+func appendMap(b []byte, num protowire.Number, values map[string]interface{}) []byte {
+	for key, value := range values {
+		var m []byte
+		m = appendString(m, 1, key)
+		m = appendString(m, 2, fmt.Sprint(value))
+		b = appendMessage(b, num, m)
+	}
+	return b
+}
+
+// parseProto calls field with the value of every field in b. field returns the
+// length of the value it consumed, or a negative protowire error code.
+func parseProto(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// emptyRequest is every request message without fields
+type emptyRequest struct{}
+
+func (*emptyRequest) unmarshalProto(b []byte) error {
+	return parseProto(b, protowire.ConsumeFieldValue)
+}
+
+type setRecordingRequest struct {
+	recording bool
+}
+
+func (req *setRecordingRequest) unmarshalProto(b []byte) error {
+	return parseProto(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			req.recording = protowire.DecodeBool(v)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+type setPrivacyModeRequest struct {
+	active bool
+}
+
+func (req *setPrivacyModeRequest) unmarshalProto(b []byte) error {
+	return parseProto(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			req.active = protowire.DecodeBool(v)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+func (req *verifyRequest) unmarshalProto(b []byte) error {
+	return parseProto(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b)
+		}
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeString(b)
+			req.Path = v
+			return n
+		case 2:
+			v, n := protowire.ConsumeString(b)
+			req.Hash = v
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// identity is the reply of GetIdentity
+type identity struct {
+	vin            string
+	chainID        string
+	ownerKey       []byte
+	ownerChainID   string
+	previousOwners [][]byte
+}
+
+func (id *identity) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, id.vin)
+	b = appendString(b, 2, id.chainID)
+	b = appendBytes(b, 3, id.ownerKey)
+	b = appendString(b, 4, id.ownerChainID)
+	for _, key := range id.previousOwners {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, key)
+	}
+	return b
+}
+
+func (s *Status) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, s.VIN)
+	b = appendString(b, 2, s.ChainID)
+	b = appendBool(b, 3, s.Recording)
+	if segment := s.Segment; segment != nil {
+		var m []byte
+		m = appendString(m, 1, segment.Stream)
+		m = appendVarint(m, 2, segment.Seq)
+		m = appendTimestamp(m, 3, segment.Start)
+		m = appendString(m, 4, segment.Path)
+		m = appendVarint(m, 5, uint64(segment.Records))
+		b = appendMessage(b, 4, m)
+	}
+	b = appendString(b, 5, s.Storage)
+	b = appendString(b, 6, s.TimeSource)
+	b = appendString(b, 7, s.TimeConfidence)
+	b = appendVarint(b, 8, uint64(s.PendingAnchors))
+	b = appendMap(b, 9, s.Position)
+	for _, alert := range s.Alerts {
+		var m []byte
+		m = appendString(m, 1, alert.Kind)
+		m = appendString(m, 2, alert.Message)
+		m = appendTimestamp(m, 3, alert.Time)
+		b = appendMessage(b, 10, m)
+	}
+	b = appendString(b, 11, s.Backlog)
+	b = appendVarint(b, 12, s.DroppedSamples)
+	b = appendString(b, 13, s.Thermal)
+	b = appendDouble(b, 14, s.TemperatureC)
+	b = appendString(b, 15, s.Driver)
+	b = appendBool(b, 16, s.PrivacyMode)
+	return b
+}
+
+func (record *OBDRecord) marshalProto() []byte {
+	var b []byte
+	b = appendTimestamp(b, 1, record.Time)
+	b = appendString(b, 2, record.Position)
+	for _, reading := range record.Readings {
+		var m []byte
+		m = appendString(m, 1, reading.Name)
+		m = appendString(m, 2, reading.Value)
+		m = appendString(m, 3, reading.Units)
+		m = appendString(m, 4, reading.Error)
+		b = appendMessage(b, 3, m)
+	}
+	return b
+}
+
+// anchorList is the reply of ListAnchors
+type anchorList []Anchor
+
+func (anchors anchorList) marshalProto() []byte {
+	var b []byte
+	for _, anchor := range anchors {
+		var m []byte
+		m = appendTimestamp(m, 1, anchor.Time)
+		m = appendString(m, 2, anchor.TxID)
+		m = appendString(m, 3, anchor.Kind)
+		m = appendString(m, 4, anchor.Hash)
+		b = appendMessage(b, 1, m)
+	}
+	return b
+}
+
+func (result *VerifyResult) marshalProto() []byte {
+	var b []byte
+	b = appendBool(b, 1, result.Verified)
+	b = appendString(b, 2, result.EntryHash)
+	b = appendVarint(b, 3, uint64(result.BlockHeight))
+	b = appendTimestamp(b, 4, result.BlockTime)
+	b = appendBytes(b, 5, result.SigningKey)
+	b = appendString(b, 6, result.EntryBlockKeyMR)
+	b = appendVarint(b, 7, uint64(result.EntrySequence))
+	b = appendVarint(b, 8, uint64(result.EntryPosition))
+	for _, malformed := range result.Malformed {
+		var m []byte
+		m = appendString(m, 1, malformed.EntryHash)
+		m = appendString(m, 2, malformed.Reason)
+		b = appendMessage(b, 9, m)
+	}
+	b = appendVarint(b, 10, uint64(result.Duplicates))
+	return b
+}
+
+// blackboxServer is the Blackbox service of proto/blackbox.proto
+type blackboxServer interface {
+	GetIdentity(ctx context.Context, req *emptyRequest) (*identity, error)
+	GetStatus(ctx context.Context, req *emptyRequest) (*Status, error)
+	SetRecording(ctx context.Context, req *setRecordingRequest) (*Status, error)
+	SetPrivacyMode(ctx context.Context, req *setPrivacyModeRequest) (*Status, error)
+	StreamTelemetry(req *emptyRequest, stream grpc.ServerStream) error
+	ListAnchors(ctx context.Context, req *emptyRequest) (anchorList, error)
+	Verify(ctx context.Context, req *verifyRequest) (*VerifyResult, error)
+}
+
+// grpcService serves the Blackbox service for a vehicle
+type grpcService struct {
+	vehicle *Vehicle
+}
+
+func (s *grpcService) GetIdentity(ctx context.Context, req *emptyRequest) (*identity, error) {
+	vehicle := s.vehicle
+	return &identity{
+		vin:            vehicle.vin,
+		chainID:        vehicle.chainID,
+		ownerKey:       vehicle.owner.ecAddress.PubBytes(),
+		ownerChainID:   vehicle.owner.chainID,
+		previousOwners: vehicle.previousOwners,
+	}, nil
+}
+
+func (s *grpcService) GetStatus(ctx context.Context, req *emptyRequest) (*Status, error) {
+	return s.vehicle.sharedStatus(rpcToken(ctx)), nil
+}
+
+func (s *grpcService) SetRecording(ctx context.Context, req *setRecordingRequest) (*Status, error) {
+	details := map[string]interface{}{"via": "grpc"}
+	if p, ok := peer.FromContext(ctx); ok {
+		details["remote"] = p.Addr.String()
+	}
+	s.vehicle.setRecording(req.recording, details)
+	return s.vehicle.sharedStatus(rpcToken(ctx)), nil
+}
+
+func (s *grpcService) SetPrivacyMode(ctx context.Context, req *setPrivacyModeRequest) (*Status, error) {
+	details := map[string]interface{}{"via": "grpc"}
+	if p, ok := peer.FromContext(ctx); ok {
+		details["remote"] = p.Addr.String()
+	}
+	if _, err := s.vehicle.SetPrivacyMode(req.active, "grpc", details); err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return s.vehicle.sharedStatus(rpcToken(ctx)), nil
+}
+
+// StreamTelemetry sends each new OBD sample until the client goes away
+func (s *grpcService) StreamTelemetry(req *emptyRequest, stream grpc.ServerStream) error {
+	ticker := time.NewTicker(telemetryPollInterval)
+	defer ticker.Stop()
+	located := s.vehicle.consent.permits(rpcToken(stream.Context()), DataLocation)
+	var last time.Time
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+		}
+		record := s.vehicle.recorder.latestRecord()
+		if record == nil || !record.Time.After(last) {
+			continue
+		}
+		if !located {
+			record = withoutPosition(record)
+		}
+		if err := stream.SendMsg(record); err != nil {
+			return err
+		}
+		last = record.Time
+	}
+}
+
+func (s *grpcService) ListAnchors(ctx context.Context, req *emptyRequest) (anchorList, error) {
+	return anchorList(s.vehicle.anchored.recent()), nil
+}
+
+func (s *grpcService) Verify(ctx context.Context, req *verifyRequest) (*VerifyResult, error) {
+	path := req.Path
+	if req.Hash != "" {
+		hash, err := hex.DecodeString(req.Hash)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var ok bool
+		if path, ok = findObject(hash); !ok {
+			return nil, status.Errorf(codes.NotFound, "no local file has hash %s", req.Hash)
+		}
+	}
+	if path == "" {
+		return nil, status.Error(codes.InvalidArgument, "path or hash required")
+	}
+	result, err := s.vehicle.VerifyData(path)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return result, nil
+}
+
+// unaryMethod describes a unary RPC, decoding its request with newRequest and
+// answering it with call
+func unaryMethod(name string, newRequest func() protoRequest,
+	call func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(blackboxServer), ctx, req.(protoRequest))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/blackbox.v1.Blackbox/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+func newEmptyRequest() protoRequest { return new(emptyRequest) }
+
+var blackboxServiceDesc = grpc.ServiceDesc{
+	ServiceName: "blackbox.v1.Blackbox",
+	HandlerType: (*blackboxServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("GetIdentity", newEmptyRequest, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.GetIdentity(ctx, req.(*emptyRequest))
+		}),
+		unaryMethod("GetStatus", newEmptyRequest, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.GetStatus(ctx, req.(*emptyRequest))
+		}),
+		unaryMethod("SetRecording", func() protoRequest { return new(setRecordingRequest) }, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.SetRecording(ctx, req.(*setRecordingRequest))
+		}),
+		unaryMethod("SetPrivacyMode", func() protoRequest { return new(setPrivacyModeRequest) }, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.SetPrivacyMode(ctx, req.(*setPrivacyModeRequest))
+		}),
+		unaryMethod("ListAnchors", newEmptyRequest, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.ListAnchors(ctx, req.(*emptyRequest))
+		}),
+		unaryMethod("Verify", func() protoRequest { return new(verifyRequest) }, func(srv blackboxServer, ctx context.Context, req protoRequest) (protoMessage, error) {
+			return srv.Verify(ctx, req.(*verifyRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTelemetry",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(emptyRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(blackboxServer).StreamTelemetry(req, stream)
+			},
+		},
+	},
+	Metadata: "proto/blackbox.proto",
+}
+
+// ServeGRPC serves the gRPC API on config.Listen until it fails
+func (vehicle *Vehicle) ServeGRPC(config *GRPCConfig) error {
+	var options []grpc.ServerOption
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	guard := &rpcGuard{tokens: vehicle.tokens, consent: vehicle.consent, limiter: newRateLimiter(config.RateLimit, config.RateBurst), access: newAccessLog(vehicle)}
+	options = append(options,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			var reply interface{}
+			err := guard.call(ctx, info.FullMethod, func(ctx context.Context) (err error) {
+				reply, err = handler(ctx, req)
+				return err
+			})
+			return reply, err
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return guard.call(stream.Context(), info.FullMethod, func(ctx context.Context) error {
+				return handler(srv, &accessStream{ServerStream: stream, ctx: ctx})
+			})
+		}),
+	)
+	encoding.RegisterCodec(protoCodec{})
+	server := grpc.NewServer(options...)
+	server.RegisterService(&blackboxServiceDesc, &grpcService{vehicle: vehicle})
+	fmt.Printf("gRPC API listening on %s\n", config.Listen)
+	return server.Serve(listener)
+}
+
+// grpcScopes is the API token scope each RPC requires
+var grpcScopes = map[string]string{
+	"GetIdentity":     ScopeReadTelemetry,
+	"GetStatus":       ScopeReadTelemetry,
+	"SetRecording":    ScopeControlRecording,
+	"SetPrivacyMode":  ScopeControlRecording,
+	"StreamTelemetry": ScopeReadTelemetry,
+	"ListAnchors":     ScopeReadTelemetry,
+	"Verify":          ScopeReadTelemetry,
+}
+
+// grpcData is the data each RPC discloses, which a token issued to a
+// recipient only receives with the owner's consent
+var grpcData = map[string][]string{
+	"GetStatus":       {DataTelemetry},
+	"SetRecording":    {DataTelemetry},
+	"SetPrivacyMode":  {DataTelemetry},
+	"StreamTelemetry": {DataTelemetry},
+	"ListAnchors":     {DataAnchors},
+	"Verify":          {DataAnchors},
+}
+
+// authorizeRPC checks the bearer token in the "authorization" metadata of a
+// call and returns it, nil if the API is open
+func (s *tokenStore) authorizeRPC(ctx context.Context, fullMethod string) (*APIToken, error) {
+	scope, ok := grpcScopes[fullMethod[strings.LastIndex(fullMethod, "/")+1:]]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "no scope grants %s", fullMethod)
+	}
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	token, code, err := s.authorize(authorization, scope)
+	switch {
+	case err == nil:
+		return token, nil
+	case code == http.StatusUnauthorized:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case code == http.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil, status.Error(codes.Internal, err.Error())
+}
+
+// rpcGuard rate limits, authorizes and audits calls, like guardAPI does for
+// the HTTP API
+type rpcGuard struct {
+	tokens  *tokenStore
+	consent *consentStore
+	limiter *rateLimiter
+	access  *accessLog
+}
+
+// call runs handler if the caller may make the call, with the token that
+// authorized it in the context, then audits it
+func (g *rpcGuard) call(ctx context.Context, fullMethod string, handler func(ctx context.Context) error) error {
+	details := map[string]interface{}{"via": "grpc", "method": fullMethod}
+	var host string
+	if p, ok := peer.FromContext(ctx); ok {
+		details["remote"] = p.Addr.String()
+		host = clientHost(p.Addr.String())
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if name := peerName(&info.State); name != "" {
+				details["client"] = name
+			}
+		}
+	}
+	var token *APIToken
+	var err error
+	if !g.limiter.allow(host, time.Now()) {
+		err = status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	} else if token, err = g.tokens.authorizeRPC(ctx, fullMethod); err == nil {
+		err = g.shares(token, fullMethod)
+	}
+	if err == nil {
+		err = handler(context.WithValue(ctx, accessContextKey{}, &accessInfo{token: token}))
+	}
+	if token != nil {
+		details["token"], details["tokenName"] = token.ID, token.Name
+	}
+	code := status.Code(err)
+	details["status"] = code.String()
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	read := grpcScopes[method] == ScopeReadTelemetry || code == codes.ResourceExhausted
+	var record *AccessRecord
+	if grpcScopes[method] == ScopeReadTelemetry && code == codes.OK {
+		record = &AccessRecord{Action: "rpc-read", Resource: fullMethod, Data: grpcData[method], Who: requestWho("grpc", details, token)}
+	}
+	g.access.record(details, read, fmt.Sprintf("%v %s %s %s", details["token"], host, fullMethod, code), record)
+	return err
+}
+
+// shares returns an error unless the consent policy shares the data of
+// fullMethod with the recipient of token, nil if the API is open
+func (g *rpcGuard) shares(token *APIToken, fullMethod string) error {
+	if token == nil {
+		return nil
+	}
+	data := grpcData[fullMethod[strings.LastIndex(fullMethod, "/")+1:]]
+	if err := g.consent.allows(token.Recipient, data...); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// accessStream is a ServerStream whose context carries the accessInfo of its call
+type accessStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *accessStream) Context() context.Context { return s.ctx }
+
+// rpcToken returns the token that authorized a call, nil if the API is open
+func rpcToken(ctx context.Context) *APIToken {
+	if info, ok := ctx.Value(accessContextKey{}).(*accessInfo); ok {
+		return info.token
+	}
+	return nil
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duty statuses of an hours-of-service log, as in the FMCSA ELD rule
+const (
+	DutyOff     = "off-duty"
+	DutySleeper = "sleeper"
+	DutyDriving = "driving"
+	DutyOn      = "on-duty" // on duty, not driving
+)
+
+var dutyStatuses = []string{DutyOff, DutySleeper, DutyDriving, DutyOn}
+
+// Origins of a duty status record
+const (
+	OriginAuto   = "auto"   // from ignition and motion
+	OriginDriver = "driver" // set by the driver
+)
+
+// Limits checked against the hours used
+const (
+	LimitDrive  = "drive"
+	LimitWindow = "window"
+	LimitCycle  = "cycle"
+)
+
+// Hours-of-service settings
+const (
+	hosDrivingKmh    = 8.0              // ~5 mph, moving faster with the engine on is driving
+	hosStopTimeout   = 5 * time.Minute  // stopped this long ends driving, the driver is then on duty
+	hosRestTimeout   = 15 * time.Minute // ignition off this long ends automatic on-duty time
+	hosCheckInterval = time.Minute      // between limit checks while driving
+	hosMinAnnotation = 4                // characters an edit's annotation needs, as the ELD rule asks
+	hosDateLayout    = "2006-01-02"
+)
+
+// HOSConfig enables the commercial-driver mode and sets its limits, by
+// default the US property-carrying ones: 11 hours driving within 14 hours of
+// coming on duty after 10 hours of rest, and 70 hours on duty in 8 days
+type HOSConfig struct {
+	DriveHours  float64 `json:"driveHours"`
+	WindowHours float64 `json:"windowHours"`
+	RestHours   float64 `json:"restHours"` // off duty or in the sleeper this long starts a new shift
+	CycleHours  float64 `json:"cycleHours"`
+	CycleDays   int     `json:"cycleDays"`
+}
+
+// withDefaults returns the config with unset limits at their defaults
+func (config HOSConfig) withDefaults() HOSConfig {
+	if config.DriveHours == 0 {
+		config.DriveHours = 11
+	}
+	if config.WindowHours == 0 {
+		config.WindowHours = 14
+	}
+	if config.RestHours == 0 {
+		config.RestHours = 10
+	}
+	if config.CycleHours == 0 {
+		config.CycleHours = 70
+	}
+	if config.CycleDays == 0 {
+		config.CycleDays = 8
+	}
+	return config
+}
+
+// DutyRecord is the content of a "duty-status" event, a change of the
+// driver's duty status. Records are never rewritten, edits are logged as
+// "duty-edit" events referring to them.
+type DutyRecord struct {
+	Time      time.Time `json:"time"`
+	Status    string    `json:"status"`
+	Origin    string    `json:"origin"`
+	Driver    string    `json:"driver,omitempty"`
+	DriverKey string    `json:"driverKey,omitempty"`
+	Location  string    `json:"location"`
+	Note      string    `json:"note,omitempty"`
+	Edited    bool      `json:"edited,omitempty"` // status changed by an edit, in daily logs
+}
+
+// DutyEdit is the content of a "duty-edit" event, changing the status of the
+// record logged at Record. Every edit carries the reason it was made.
+type DutyEdit struct {
+	Time       time.Time `json:"time"`
+	Record     time.Time `json:"record"`
+	From       string    `json:"from"`
+	Status     string    `json:"status"`
+	Annotation string    `json:"annotation"`
+	Editor     string    `json:"editor"`
+}
+
+// HOSViolation is a limit exceeded while driving
+type HOSViolation struct {
+	Time  time.Time `json:"time"`
+	Limit string    `json:"limit"` // LimitDrive, LimitWindow or LimitCycle
+	Hours float64   `json:"hours"` // used against the limit
+}
+
+// DailyLog is the content of a "hos-daily-log" event, a driver's record of
+// duty status for one local day, anchored after the day ends and again,
+// marked amended, whenever a record of the day is edited
+type DailyLog struct {
+	VIN        string             `json:"vin"`
+	Date       string             `json:"date"`    // local date, 2006-01-02
+	Records    []DutyRecord       `json:"records"` // edits applied, the first holds the status at midnight
+	Edits      []DutyEdit         `json:"edits"`
+	Hours      map[string]float64 `json:"hours"` // per duty status
+	Violations []HOSViolation     `json:"violations"`
+	Amended    bool               `json:"amended"`
+	Created    time.Time          `json:"created"`
+}
+
+// HOSStatus is the driver's current duty status and the hours they have left
+type HOSStatus struct {
+	Status     string       `json:"status"`
+	Since      time.Time    `json:"since"`
+	Driver     string       `json:"driver,omitempty"`
+	DriveLeft  float64      `json:"driveLeft"`  // hours
+	WindowLeft float64      `json:"windowLeft"` // hours
+	CycleLeft  float64      `json:"cycleLeft"`  // hours
+	Today      []DutyRecord `json:"today"`
+}
+
+// hosUsage is the time used against each limit at some point
+type hosUsage struct {
+	shift  time.Time // end of the last rest long enough to reset the limits
+	drive  time.Duration
+	window time.Duration
+	cycle  time.Duration
+}
+
+// dutySpan is the time a status lasted
+type dutySpan struct {
+	start, end time.Time
+	status     string
+}
+
+// resting reports whether status counts towards a rest
+func resting(status string) bool {
+	return status == DutyOff || status == DutySleeper
+}
+
+// dutySpans returns the spans of the sorted records between from and to
+func dutySpans(records []DutyRecord, from, to time.Time) []dutySpan {
+	var spans []dutySpan
+	for i, record := range records {
+		start, end := record.Time, to
+		if i+1 < len(records) {
+			end = records[i+1].Time
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			spans = append(spans, dutySpan{start: start, end: end, status: record.Status})
+		}
+	}
+	return spans
+}
+
+// usageAt returns the hours used against the limits at
+func usageAt(records []DutyRecord, at time.Time, config HOSConfig) hosUsage {
+	spans := dutySpans(records, at.Add(-time.Duration(config.CycleDays)*24*time.Hour), at)
+	var usage hosUsage
+	if len(spans) > 0 {
+		usage.shift = spans[0].start
+	}
+	var rest time.Duration
+	for _, span := range spans {
+		if !resting(span.status) {
+			rest = 0
+			usage.cycle += span.end.Sub(span.start)
+			continue
+		}
+		// off duty and sleeper time add up to a rest
+		if rest += span.end.Sub(span.start); rest >= time.Duration(config.RestHours*float64(time.Hour)) {
+			usage.shift = span.end
+		}
+	}
+	var windowStart time.Time
+	for _, span := range spans {
+		if span.end.After(usage.shift) && !resting(span.status) {
+			if windowStart.IsZero() {
+				windowStart = span.start
+			}
+			if span.status == DutyDriving {
+				usage.drive += span.end.Sub(span.start)
+			}
+		}
+	}
+	if !windowStart.IsZero() {
+		usage.window = at.Sub(windowStart)
+	}
+	return usage
+}
+
+// violations returns the limits the usage exceeds
+func (usage hosUsage) violations(at time.Time, config HOSConfig) []HOSViolation {
+	var violations []HOSViolation
+	for _, limit := range []struct {
+		name  string
+		used  time.Duration
+		hours float64
+	}{
+		{LimitDrive, usage.drive, config.DriveHours},
+		{LimitWindow, usage.window, config.WindowHours},
+		{LimitCycle, usage.cycle, config.CycleHours},
+	} {
+		if limit.used.Hours() > limit.hours {
+			violations = append(violations, HOSViolation{Time: at, Limit: limit.name, Hours: limit.used.Hours()})
+		}
+	}
+	return violations
+}
+
+// applyDutyEdits returns the records with the latest edit of each applied
+func applyDutyEdits(records []DutyRecord, edits []DutyEdit) []DutyRecord {
+	latest := make(map[int64]DutyEdit, len(edits))
+	for _, edit := range edits {
+		latest[edit.Record.UnixNano()] = edit
+	}
+	edited := make([]DutyRecord, len(records))
+	for i, record := range records {
+		if edit, ok := latest[record.Time.UnixNano()]; ok {
+			record.Status, record.Edited = edit.Status, true
+		}
+		edited[i] = record
+	}
+	return edited
+}
+
+// loadDutyLog returns the duty status records and edits from the event log,
+// oldest first
+func loadDutyLog() ([]DutyRecord, []DutyEdit, error) {
+	var records []DutyRecord
+	var edits []DutyEdit
+	err := readEvents("duty-status", func() interface{} { return new(DutyRecord) }, func(data interface{}, _ *SignedEvent) {
+		records = append(records, *data.(*DutyRecord))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = readEvents("duty-edit", func() interface{} { return new(DutyEdit) }, func(data interface{}, _ *SignedEvent) {
+		edits = append(edits, *data.(*DutyEdit))
+	})
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, edits, err
+}
+
+// loadDailyLogs returns the latest anchored log of each date between from
+// and to, oldest first
+func loadDailyLogs(from, to string) ([]*DailyLog, error) {
+	latest := make(map[string]*DailyLog)
+	err := readEvents("hos-daily-log", func() interface{} { return new(DailyLog) }, func(data interface{}, _ *SignedEvent) {
+		if log := data.(*DailyLog); log.Date >= from && log.Date <= to {
+			latest[log.Date] = log
+		}
+	})
+	logs := make([]*DailyLog, 0, len(latest))
+	for _, log := range latest {
+		logs = append(logs, log)
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Date < logs[j].Date })
+	return logs, err
+}
+
+// dayBounds returns the start and end of a local date
+func dayBounds(date string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(hosDateLayout, date, time.Local)
+	if err != nil {
+		return start, start, err
+	}
+	return start, start.AddDate(0, 0, 1), nil
+}
+
+// buildDailyLog returns the log of date from all records and edits
+func buildDailyLog(vin, date string, records []DutyRecord, edits []DutyEdit, config HOSConfig) (*DailyLog, error) {
+	start, end, err := dayBounds(date)
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+	edited := applyDutyEdits(records, edits)
+	log := &DailyLog{
+		VIN:        vin,
+		Date:       date,
+		Records:    []DutyRecord{},
+		Edits:      []DutyEdit{},
+		Hours:      make(map[string]float64),
+		Violations: []HOSViolation{},
+		Created:    time.Now().UTC(),
+	}
+	for i, record := range edited {
+		if !record.Time.Before(end) {
+			break
+		}
+		// the status at midnight is the last one recorded before it
+		if record.Time.Before(start) {
+			if i+1 < len(edited) && !edited[i+1].Time.After(start) {
+				continue
+			}
+			record.Time = start
+		}
+		log.Records = append(log.Records, record)
+	}
+	for _, edit := range edits {
+		if !edit.Record.Before(start) && edit.Record.Before(end) {
+			log.Edits = append(log.Edits, edit)
+		}
+	}
+	violated := make(map[string]bool)
+	for _, span := range dutySpans(edited, start, end) {
+		log.Hours[span.status] += span.end.Sub(span.start).Hours()
+		if span.status != DutyDriving {
+			continue
+		}
+		for _, violation := range usageAt(edited, span.end, config).violations(span.end, config) {
+			if !violated[violation.Limit] {
+				violated[violation.Limit] = true
+				log.Violations = append(log.Violations, violation)
+			}
+		}
+	}
+	return log, nil
+}
+
+// hosTracker derives the driver's duty status from ignition and motion,
+// applies the driver's own status changes and edits, and anchors a daily log
+// after each day
+type hosTracker struct {
+	mu      sync.Mutex
+	config  HOSConfig
+	records []DutyRecord
+	edits   []DutyEdit
+	moving  bool
+	stopped time.Time            // when the vehicle stopped, zero while moving
+	off     time.Time            // when the ignition went off, zero while it is on
+	last    time.Time            // previous sample
+	logged  string               // last date whose log was anchored
+	checked time.Time            // last limit check
+	alerted map[string]time.Time // shift each limit was last alerted for
+}
+
+// newHOSTracker restores the duty log from the event log
+func newHOSTracker(config HOSConfig) (*hosTracker, error) {
+	t := &hosTracker{config: config, alerted: make(map[string]time.Time)}
+	var err error
+	if t.records, t.edits, err = loadDutyLog(); err != nil {
+		return nil, err
+	}
+	logs, err := loadDailyLogs("", "9999")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(logs) > 0:
+		t.logged = logs[len(logs)-1].Date
+	case len(t.records) > 0:
+		t.logged = t.records[0].Time.Local().AddDate(0, 0, -1).Format(hosDateLayout)
+	default:
+		t.logged = time.Now().AddDate(0, 0, -1).Format(hosDateLayout)
+	}
+	return t, nil
+}
+
+// current returns the latest record with its edits applied, off duty if none
+func (t *hosTracker) current() DutyRecord {
+	if len(t.records) == 0 {
+		return DutyRecord{Status: DutyOff, Origin: OriginAuto}
+	}
+	return applyDutyEdits(t.records[len(t.records)-1:], t.edits)[0]
+}
+
+// record logs and anchors a change of duty status
+func (t *hosTracker) record(vehicle *Vehicle, status, origin string, at time.Time, note string) (string, error) {
+	record := DutyRecord{
+		Time:     at.UTC(),
+		Status:   status,
+		Origin:   origin,
+		Location: vehicle.describePosition(vehicle.position.latest()),
+		Note:     note,
+	}
+	if assignment := vehicle.drivers.assignment(); assignment != nil {
+		record.Driver, record.DriverKey = assignment.Driver, assignment.Key
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("duty-status", toEventData(record)), true)
+	if err != nil {
+		return "", err
+	}
+	t.records = append(t.records, record)
+	fmt.Printf("Duty status %s secured to factom. TxID: %s\n", status, txID)
+	return txID, nil
+}
+
+// update follows a trip sample: moving with the engine on is driving,
+// stopping for hosStopTimeout puts the driver on duty and the ignition off for
+// hosRestTimeout takes them off duty, unless they set on-duty themselves.
+// A gap in the samples longer than hosRestTimeout counts as the ignition off.
+func (t *hosTracker) update(vehicle *Vehicle, sample TripSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.last.IsZero() && sample.Time.Sub(t.last) > hosRestTimeout && t.off.IsZero() {
+		t.off = t.last
+		if t.stopped.IsZero() {
+			t.stopped = t.last
+		}
+	}
+	t.last = sample.Time
+	t.moving = sample.Ignition && sample.Speed >= hosDrivingKmh
+	if t.moving {
+		t.stopped = time.Time{}
+	} else if t.stopped.IsZero() {
+		t.stopped = sample.Time
+	}
+	if sample.Ignition {
+		t.off = time.Time{}
+	} else if t.off.IsZero() {
+		t.off = sample.Time
+	}
+
+	current := t.current()
+	var err error
+	switch {
+	case t.moving && current.Status != DutyDriving:
+		_, err = t.record(vehicle, DutyDriving, OriginAuto, sample.Time, "")
+	case !t.moving && current.Status == DutyDriving && sample.Time.Sub(t.stopped) >= hosStopTimeout:
+		_, err = t.record(vehicle, DutyOn, OriginAuto, t.stopped, "")
+	case !t.off.IsZero() && current.Status == DutyOn && current.Origin == OriginAuto && sample.Time.Sub(t.off) >= hosRestTimeout:
+		_, err = t.record(vehicle, DutyOff, OriginAuto, t.off, "")
+	}
+	if err != nil {
+		fmt.Println("Failed to record duty status", err)
+	}
+
+	if t.moving && sample.Time.Sub(t.checked) >= hosCheckInterval {
+		t.checked = sample.Time
+		t.checkLimits(vehicle, sample.Time)
+	}
+	if today := sample.Time.Local().Format(hosDateLayout); today > t.logged {
+		t.anchorLogs(vehicle, today)
+	}
+}
+
+// checkLimits alerts once per shift for each limit exceeded
+func (t *hosTracker) checkLimits(vehicle *Vehicle, at time.Time) {
+	usage := usageAt(applyDutyEdits(t.records, t.edits), at, t.config)
+	for _, violation := range usage.violations(at, t.config) {
+		if t.alerted[violation.Limit].Equal(usage.shift) {
+			continue
+		}
+		t.alerted[violation.Limit] = usage.shift
+		vehicle.raiseAlert("hos-"+violation.Limit, fmt.Sprintf("hours-of-service %s limit exceeded, %.1f hours used", violation.Limit, violation.Hours),
+			map[string]interface{}{"limit": violation.Limit, "hours": violation.Hours})
+	}
+}
+
+// anchorLogs anchors the logs of the days after the last one logged, up to
+// but not including today
+func (t *hosTracker) anchorLogs(vehicle *Vehicle, today string) {
+	for {
+		start, _, err := dayBounds(t.logged)
+		if err != nil {
+			fmt.Println("Failed to find the next daily log", err)
+			return
+		}
+		date := start.AddDate(0, 0, 1).Format(hosDateLayout)
+		if date >= today {
+			return
+		}
+		if err := t.anchorLog(vehicle, date, false); err != nil {
+			fmt.Println("Failed to anchor daily log", err)
+			return
+		}
+		t.logged = date
+	}
+}
+
+// anchorLog logs the daily log of date as a signed "hos-daily-log" event and
+// anchors it. The day's driver countersigns it, certifying their records.
+func (t *hosTracker) anchorLog(vehicle *Vehicle, date string, amended bool) error {
+	log, err := buildDailyLog(vehicle.vin, date, t.records, t.edits, t.config)
+	if err != nil {
+		return err
+	}
+	log.Amended = amended
+	data := toEventData(log)
+	var driverKey string
+	for _, record := range log.Records {
+		if record.DriverKey != "" {
+			driverKey = record.DriverKey
+		}
+	}
+	if driverKey != "" {
+		content, err := json.Marshal(log)
+		var sig []byte
+		if err == nil {
+			sig, err = vehicle.drivers.countersign(driverKey, content)
+		}
+		if err != nil {
+			fmt.Println("Failed to countersign daily log", err)
+		} else {
+			data["driverSig"] = hex.EncodeToString(sig)
+		}
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("hos-daily-log", data), true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Daily log of %s secured to factom. TxID: %s\n", date, txID)
+	return nil
+}
+
+// SetStatus records a status the driver sets. Driving is only ever recorded
+// from motion, and the driver cannot leave it while the vehicle moves.
+func (t *hosTracker) SetStatus(vehicle *Vehicle, status, note string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !contains(dutyStatuses, status) || status == DutyDriving {
+		return "", fmt.Errorf("unknown status %q, expected off-duty, sleeper or on-duty", status)
+	}
+	if t.moving {
+		return "", fmt.Errorf("the vehicle is moving")
+	}
+	return t.record(vehicle, status, OriginDriver, time.Now(), note)
+}
+
+// Edit changes the status of the record logged at recordTime, keeping the
+// record and anchoring the edit with its annotation. Automatically recorded
+// driving time cannot be edited away and no time can be edited into driving.
+// Editing a day whose log was anchored anchors an amended log.
+func (t *hosTracker) Edit(vehicle *Vehicle, recordTime time.Time, status, annotation, editor string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !contains(dutyStatuses, status) {
+		return "", fmt.Errorf("unknown status %q", status)
+	}
+	if status == DutyDriving {
+		return "", fmt.Errorf("driving time is only recorded from motion")
+	}
+	if len(strings.TrimSpace(annotation)) < hosMinAnnotation {
+		return "", fmt.Errorf("edits need an annotation of at least %d characters", hosMinAnnotation)
+	}
+	i := sort.Search(len(t.records), func(i int) bool { return !t.records[i].Time.Before(recordTime) })
+	if i == len(t.records) || !t.records[i].Time.Equal(recordTime) {
+		return "", fmt.Errorf("no duty status recorded at %s", recordTime.Format(time.RFC3339Nano))
+	}
+	record := applyDutyEdits(t.records[i:i+1], t.edits)[0]
+	if record.Origin == OriginAuto && t.records[i].Status == DutyDriving {
+		return "", fmt.Errorf("automatically recorded driving time cannot be edited")
+	}
+	edit := DutyEdit{
+		Time:       time.Now().UTC(),
+		Record:     record.Time,
+		From:       record.Status,
+		Status:     status,
+		Annotation: annotation,
+		Editor:     editor,
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("duty-edit", toEventData(edit)), true)
+	if err != nil {
+		return "", err
+	}
+	t.edits = append(t.edits, edit)
+	if date := record.Time.Local().Format(hosDateLayout); date <= t.logged {
+		if err := t.anchorLog(vehicle, date, true); err != nil {
+			fmt.Println("Failed to anchor amended daily log", err)
+		}
+	}
+	return txID, nil
+}
+
+// Status returns the current duty status, the hours left and today's records
+func (t *hosTracker) Status() (*HOSStatus, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	current := t.current()
+	usage := usageAt(applyDutyEdits(t.records, t.edits), now, t.config)
+	today, err := buildDailyLog("", now.Format(hosDateLayout), t.records, t.edits, t.config)
+	if err != nil {
+		return nil, err
+	}
+	return &HOSStatus{
+		Status:     current.Status,
+		Since:      current.Time,
+		Driver:     current.Driver,
+		DriveLeft:  hoursLeft(t.config.DriveHours, usage.drive),
+		WindowLeft: hoursLeft(t.config.WindowHours, usage.window),
+		CycleLeft:  hoursLeft(t.config.CycleHours, usage.cycle),
+		Today:      today.Records,
+	}, nil
+}
+
+func hoursLeft(limit float64, used time.Duration) float64 {
+	if left := limit - used.Hours(); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// hosEditor names who made an API or BLE edit from its request details
+func hosEditor(details map[string]interface{}) string {
+	for _, key := range []string{"client", "phone", "token", "remote"} {
+		if v, ok := details[key]; ok {
+			return fmt.Sprintf("%s %v", key, v)
+		}
+	}
+	return "unknown"
+}
+
+// statusRequest is the body of POST /hos/status
+type statusRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// editRequest is the body of POST /hos/edit
+type editRequest struct {
+	Record     time.Time `json:"record"` // time of the record to edit
+	Status     string    `json:"status"`
+	Annotation string    `json:"annotation"`
+}
+
+// hosEnabled rejects requests while hours-of-service mode is off
+func (vehicle *Vehicle) hosEnabled(w http.ResponseWriter) bool {
+	if vehicle.hos == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("hours-of-service mode is off, set hos in the config"))
+		return false
+	}
+	return true
+}
+
+// handleHOS returns the current duty status and the hours left
+func (vehicle *Vehicle) handleHOS(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) || !vehicle.hosEnabled(w) {
+		return
+	}
+	status, err := vehicle.hos.Status()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleDutyStatus sets the status the driver gives
+func (vehicle *Vehicle) handleDutyStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !vehicle.hosEnabled(w) {
+		return
+	}
+	var req statusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	txID, err := vehicle.hos.SetStatus(vehicle, req.Status, req.Note)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// handleDutyEdit edits a duty status record
+func (vehicle *Vehicle) handleDutyEdit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !vehicle.hosEnabled(w) {
+		return
+	}
+	var req editRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details := requestDetails(r)
+	txID, err := vehicle.hos.Edit(vehicle, req.Record, req.Status, req.Annotation, hosEditor(details))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details["record"], details["status"], details["annotation"] = req.Record, req.Status, req.Annotation
+	appendAudit("duty-edit", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// handleDailyLogs returns the latest anchored daily logs of the days between
+// the from and to query parameters
+func (vehicle *Vehicle) handleDailyLogs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	logs, err := loadDailyLogs(start.Local().Format(hosDateLayout), end.Local().Format(hosDateLayout))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logs)
+}
+
+// hosCommand prints the driver's duty status and a day's log, as anchored or,
+// for a day not yet logged, as it stands
+func hosCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("hos", flag.ExitOnError)
+	date := flags.String("date", time.Now().Format(hosDateLayout), "Day of the log to print, 2006-01-02")
+	flags.Parse(args)
+	if config.HOS == nil {
+		fmt.Println("Hours-of-service mode is off, set hos in the config")
+		os.Exit(2)
+	}
+	tracker, err := newHOSTracker(config.HOS.withDefaults())
+	if err != nil {
+		fmt.Println("Failed to read the duty log", err)
+		os.Exit(1)
+	}
+	status, err := tracker.Status()
+	if err != nil {
+		fmt.Println("Failed to read the duty log", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s since %s, %.1fh driving, %.1fh window and %.1fh cycle left\n", status.Status,
+		status.Since.Local().Format("2006-01-02 15:04"), status.DriveLeft, status.WindowLeft, status.CycleLeft)
+
+	logs, err := loadDailyLogs(*date, *date)
+	var log *DailyLog
+	if err == nil && len(logs) > 0 {
+		log = logs[0]
+		fmt.Printf("Daily log of %s, anchored %s\n", *date, log.Created.Local().Format("2006-01-02 15:04"))
+	} else if err == nil {
+		log, err = buildDailyLog(vehicle.vin, *date, tracker.records, tracker.edits, tracker.config)
+		fmt.Printf("Daily log of %s, not yet anchored\n", *date)
+	}
+	if err != nil {
+		fmt.Println("Failed to read the daily log", err)
+		os.Exit(1)
+	}
+	for _, record := range log.Records {
+		mark := ""
+		if record.Edited {
+			mark = " (edited)"
+		}
+		fmt.Printf("  %s  %-8s  %-6s  %s  %s%s\n", record.Time.Local().Format("15:04"), record.Status,
+			record.Origin, record.Driver, record.Location, mark)
+	}
+	for _, edit := range log.Edits {
+		fmt.Printf("  edit of %s: %s -> %s by %s: %s\n", edit.Record.Local().Format("15:04"), edit.From, edit.Status, edit.Editor, edit.Annotation)
+	}
+	for _, status := range dutyStatuses {
+		fmt.Printf("  %-8s %5.2fh\n", status, log.Hours[status])
+	}
+	for _, violation := range log.Violations {
+		fmt.Printf("  VIOLATION %s limit at %s, %.1f hours\n", violation.Limit, violation.Time.Local().Format("15:04"), violation.Hours)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// i2cSlave is the ioctl request selecting the peripheral address (linux/i2c-dev.h)
+const i2cSlave = 0x0703
+
+// i2cDevice is a single peripheral on a Linux /dev/i2c-N bus
+type i2cDevice struct {
+	file *os.File
+}
+
+// openI2C opens the bus at path and addresses the peripheral at addr
+func openI2C(path string, addr int) (*i2cDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), i2cSlave, uintptr(addr)); errno != 0 {
+		file.Close()
+		return nil, errno
+	}
+	return &i2cDevice{file: file}, nil
+}
+
+// writeReg sets a single register
+func (d *i2cDevice) writeReg(reg, value byte) error {
+	_, err := d.file.Write([]byte{reg, value})
+	return err
+}
+
+// readRegs fills buf with consecutive registers starting at reg
+func (d *i2cDevice) readRegs(reg byte, buf []byte) error {
+	if _, err := d.file.Write([]byte{reg}); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(d.file, buf)
+	return err
+}
+
+func (d *i2cDevice) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoI2C = errors.New("i2c: only supported on linux")
+
+// i2cDevice is unavailable outside of Linux
+type i2cDevice struct{}
+
+func openI2C(path string, addr int) (*i2cDevice, error) { return nil, errNoI2C }
+
+func (d *i2cDevice) writeReg(reg, value byte) error      { return errNoI2C }
+func (d *i2cDevice) readRegs(reg byte, buf []byte) error { return errNoI2C }
+func (d *i2cDevice) Close() error                        { return nil }
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IFTA report settings
+const (
+	iftaStream       = "ifta-report"
+	iftaMaxFixGap    = time.Minute // longer gaps between fixes are not counted into distance
+	iftaUnknown      = "??"        // jurisdiction of distance outside every boundary
+	defaultIFTAField = "postal"    // GeoJSON property holding the jurisdiction code
+)
+
+// IFTAConfig enables IFTA fuel-tax reporting
+type IFTAConfig struct {
+	Jurisdictions string `json:"jurisdictions"` // GeoJSON file of state and province boundaries
+	Property      string `json:"property"`      // feature property with the jurisdiction code, default "postal"
+	Base          string `json:"base"`          // base jurisdiction the return is filed in
+	Fuel          string `json:"fuel"`          // fuel type reported, default diesel
+}
+
+// Jurisdiction is an IFTA member state or province and its boundary
+type Jurisdiction struct {
+	Code     string
+	polygons [][][][2]float64 // polygons of rings of [lon, lat], the first ring outer, others holes
+	min, max [2]float64       // bounding box
+}
+
+// FuelPurchase is the content of a "fuel-purchase" event. Tax paid at the
+// pump is credited to the jurisdiction the fuel was bought in.
+type FuelPurchase struct {
+	Time         time.Time `json:"time"`
+	Jurisdiction string    `json:"jurisdiction"`
+	Gallons      float64   `json:"gallons"`
+	Fuel         string    `json:"fuel,omitempty"`
+	Vendor       string    `json:"vendor,omitempty"`
+	Invoice      string    `json:"invoice,omitempty"`
+	Amount       float64   `json:"amount,omitempty"`      // total paid
+	ReceiptHash  string    `json:"receiptHash,omitempty"` // hex SHA-256 of the receipt image or PDF
+	EntryHash    string    `json:"entryHash,omitempty"`   // chain entry anchoring the purchase, when loaded
+}
+
+// IFTARow is the distance and fuel of one jurisdiction in a quarter
+type IFTARow struct {
+	Jurisdiction   string  `json:"jurisdiction"`
+	Miles          float64 `json:"miles"`
+	TaxableGallons float64 `json:"taxableGallons"` // Miles at the quarter's average MPG
+	PaidGallons    float64 `json:"paidGallons"`    // bought there, tax paid at the pump
+	NetGallons     float64 `json:"netGallons"`     // tax is owed on these, or credited if negative
+}
+
+// IFTADay is the distance driven in a jurisdiction on one day, the
+// supporting data of the quarter's miles
+type IFTADay struct {
+	Date         string  `json:"date"`
+	Jurisdiction string  `json:"jurisdiction"`
+	Miles        float64 `json:"miles"`
+}
+
+// IFTAReport is a quarter's IFTA return data. Miles come from the GPS track,
+// gallons from anchored fuel purchases, and the report's hash is anchored.
+type IFTAReport struct {
+	VIN          string         `json:"vin"`
+	ChainID      string         `json:"chainID"`
+	Base         string         `json:"base"`
+	Fuel         string         `json:"fuel"`
+	Quarter      string         `json:"quarter"` // e.g. 2025Q3
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Created      time.Time      `json:"created"`
+	Rows         []IFTARow      `json:"rows"`
+	TotalMiles   float64        `json:"totalMiles"`
+	TotalGallons float64        `json:"totalGallons"`
+	MPG          float64        `json:"mpg"`
+	TripMiles    float64        `json:"tripMiles"` // from the OBD trip summaries, to check the GPS miles against
+	Days         []IFTADay      `json:"days"`
+	Purchases    []FuelPurchase `json:"purchases"`
+	Hash         string         `json:"-"`
+	TxID         string         `json:"-"`
+}
+
+// loadJurisdictions reads the boundaries of a GeoJSON FeatureCollection of
+// Polygon and MultiPolygon features, coded by property
+func loadJurisdictions(path, property string) ([]Jurisdiction, error) {
+	if property == "" {
+		property = defaultIFTAField
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, err
+	}
+	var jurisdictions []Jurisdiction
+	for i, feature := range collection.Features {
+		code, _ := feature.Properties[property].(string)
+		if code == "" {
+			return nil, fmt.Errorf("feature %d has no %q property", i, property)
+		}
+		j := Jurisdiction{Code: strings.ToUpper(code)}
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			j.polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &j.polygons)
+		default:
+			err = fmt.Errorf("unsupported geometry %q", feature.Geometry.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jurisdiction %s: %v", j.Code, err)
+		}
+		j.min, j.max = [2]float64{180, 90}, [2]float64{-180, -90}
+		for _, polygon := range j.polygons {
+			for _, ring := range polygon {
+				for _, p := range ring {
+					j.min = [2]float64{minFloat(j.min[0], p[0]), minFloat(j.min[1], p[1])}
+					j.max = [2]float64{maxFloat(j.max[0], p[0]), maxFloat(j.max[1], p[1])}
+				}
+			}
+		}
+		jurisdictions = append(jurisdictions, j)
+	}
+	return jurisdictions, nil
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// inRing reports whether the point lies inside the ring, by ray casting
+func inRing(ring [][2]float64, lon, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Contains reports whether the coordinate lies inside the jurisdiction
+func (j *Jurisdiction) Contains(lat, lon float64) bool {
+	if lon < j.min[0] || lat < j.min[1] || lon > j.max[0] || lat > j.max[1] {
+		return false
+	}
+	for _, polygon := range j.polygons {
+		if len(polygon) == 0 || !inRing(polygon[0], lon, lat) {
+			continue
+		}
+		hole := false
+		for _, ring := range polygon[1:] {
+			hole = hole || inRing(ring, lon, lat)
+		}
+		if !hole {
+			return true
+		}
+	}
+	return false
+}
+
+// locateJurisdiction returns the code of the jurisdiction containing the
+// coordinate, iftaUnknown if none does
+func locateJurisdiction(jurisdictions []Jurisdiction, lat, lon float64) string {
+	for i := range jurisdictions {
+		if jurisdictions[i].Contains(lat, lon) {
+			return jurisdictions[i].Code
+		}
+	}
+	return iftaUnknown
+}
+
+// jurisdictionMiles splits the distance between the fixes of a track by the
+// jurisdiction and local day each leg ends in. Dead-reckoned positions are
+// counted, as leaving out a tunnel or outage would under-report the miles.
+func jurisdictionMiles(track []Fix, jurisdictions []Jurisdiction) []IFTADay {
+	miles := make(map[[2]string]float64)
+	for i := 1; i < len(track); i++ {
+		from, to := &track[i-1], &track[i]
+		if to.Time.Sub(from.Time) > iftaMaxFixGap {
+			continue
+		}
+		key := [2]string{to.Time.Local().Format(hosDateLayout), locateJurisdiction(jurisdictions, to.Lat, to.Lon)}
+		miles[key] += distanceMeters(from.Lat, from.Lon, to.Lat, to.Lon) / 1000 / kmPerMile
+	}
+	days := make([]IFTADay, 0, len(miles))
+	for key, m := range miles {
+		days = append(days, IFTADay{Date: key[0], Jurisdiction: key[1], Miles: m})
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if days[i].Date != days[j].Date {
+			return days[i].Date < days[j].Date
+		}
+		return days[i].Jurisdiction < days[j].Jurisdiction
+	})
+	return days
+}
+
+// parseQuarter returns the local start and end of a quarter like 2025Q3
+func parseQuarter(quarter string) (time.Time, time.Time, error) {
+	var year, q int
+	if _, err := fmt.Sscanf(strings.ToUpper(quarter), "%dQ%d", &year, &q); err != nil || q < 1 || q > 4 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid quarter %q, expected e.g. 2025Q3", quarter)
+	}
+	start := time.Date(year, time.Month(3*q-2), 1, 0, 0, 0, 0, time.Local)
+	return start, start.AddDate(0, 3, 0), nil
+}
+
+// lastQuarter returns the quarter before the one t is in, the one due to be filed
+func lastQuarter(t time.Time) string {
+	t = t.In(time.Local)
+	year, q := t.Year(), (int(t.Month())-1)/3
+	if q == 0 {
+		year, q = year-1, 4
+	}
+	return fmt.Sprintf("%dQ%d", year, q)
+}
+
+// loadFuelPurchases returns the fuel purchases made between from and to,
+// oldest first
+func (vehicle *Vehicle) loadFuelPurchases(from, to time.Time) ([]FuelPurchase, error) {
+	var purchases []FuelPurchase
+	err := readEvents("fuel-purchase", func() interface{} { return new(FuelPurchase) }, func(data interface{}, signed *SignedEvent) {
+		purchase := data.(*FuelPurchase)
+		if purchase.Time.Before(from) || !purchase.Time.Before(to) {
+			return
+		}
+		purchase.EntryHash = eventEntryHash(vehicle.chainID, "fuel-purchase", signed)
+		purchases = append(purchases, *purchase)
+	})
+	sort.SliceStable(purchases, func(i, j int) bool { return purchases[i].Time.Before(purchases[j].Time) })
+	return purchases, err
+}
+
+// RecordFuelPurchase logs a fuel purchase as a signed, anchored
+// "fuel-purchase" event and returns the txID. Without a jurisdiction it is
+// the one the vehicle is in.
+func (vehicle *Vehicle) RecordFuelPurchase(purchase *FuelPurchase) (string, error) {
+	if purchase.Gallons <= 0 {
+		return "", fmt.Errorf("gallons must be positive")
+	}
+	if purchase.ReceiptHash != "" {
+		if hash, err := hex.DecodeString(purchase.ReceiptHash); err != nil || len(hash) != sha256.Size {
+			return "", fmt.Errorf("receiptHash must be a hex SHA-256")
+		}
+	}
+	if purchase.Time.IsZero() {
+		purchase.Time = time.Now().UTC()
+	}
+	if purchase.Fuel == "" && vehicle.ifta != nil {
+		purchase.Fuel = vehicle.ifta.Fuel
+	}
+	purchase.Jurisdiction = strings.ToUpper(purchase.Jurisdiction)
+	if purchase.Jurisdiction == "" {
+		if fix := vehicle.position.latest(); fix != nil && vehicle.jurisdictions != nil {
+			purchase.Jurisdiction = locateJurisdiction(vehicle.jurisdictions, fix.Lat, fix.Lon)
+		}
+		if purchase.Jurisdiction == "" || purchase.Jurisdiction == iftaUnknown {
+			return "", fmt.Errorf("jurisdiction required, the vehicle's position is not in a known one")
+		}
+	}
+	purchase.EntryHash = ""
+	return vehicle.LogEvent(vehicle.NewEvent("fuel-purchase", toEventData(purchase)), true)
+}
+
+// BuildIFTAReport totals the quarter's miles per jurisdiction from the GPS
+// track and its fuel purchases, and computes the gallons taxable in each at
+// the quarter's average MPG
+func (vehicle *Vehicle) BuildIFTAReport(config *IFTAConfig, quarter string) (*IFTAReport, error) {
+	from, to, err := parseQuarter(quarter)
+	if err != nil {
+		return nil, err
+	}
+	track, err := readTrack(from, to)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	purchases, err := vehicle.loadFuelPurchases(from, to)
+	if err != nil {
+		return nil, err
+	}
+	trips, err := loadTrips()
+	if err != nil {
+		return nil, err
+	}
+	report := &IFTAReport{
+		VIN:       vehicle.vin,
+		ChainID:   vehicle.chainID,
+		Base:      config.Base,
+		Fuel:      config.Fuel,
+		Quarter:   strings.ToUpper(quarter),
+		From:      from.UTC(),
+		To:        to.UTC(),
+		Created:   time.Now().UTC(),
+		Days:      jurisdictionMiles(track, vehicle.jurisdictions),
+		Purchases: purchases,
+	}
+	if report.Fuel == "" {
+		report.Fuel = "diesel"
+	}
+	if report.Purchases == nil {
+		report.Purchases = []FuelPurchase{}
+	}
+	for _, trip := range trips {
+		if !trip.Start.Before(from) && trip.Start.Before(to) {
+			report.TripMiles += trip.Distance / kmPerMile
+		}
+	}
+
+	rows := make(map[string]*IFTARow)
+	row := func(code string) *IFTARow {
+		if rows[code] == nil {
+			rows[code] = &IFTARow{Jurisdiction: code}
+		}
+		return rows[code]
+	}
+	for _, day := range report.Days {
+		row(day.Jurisdiction).Miles += day.Miles
+		report.TotalMiles += day.Miles
+	}
+	for _, purchase := range purchases {
+		row(purchase.Jurisdiction).PaidGallons += purchase.Gallons
+		report.TotalGallons += purchase.Gallons
+	}
+	if report.TotalGallons > 0 {
+		report.MPG = report.TotalMiles / report.TotalGallons
+	}
+	report.Rows = make([]IFTARow, 0, len(rows))
+	for _, r := range rows {
+		if report.MPG > 0 {
+			r.TaxableGallons = r.Miles / report.MPG
+		}
+		r.NetGallons = r.TaxableGallons - r.PaidGallons
+		report.Rows = append(report.Rows, *r)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Jurisdiction < report.Rows[j].Jurisdiction })
+	return report, nil
+}
+
+// writeIFTAReport writes the report as JSON or as CSV: the rows of the
+// return, then the daily miles and the purchases supporting them
+func writeIFTAReport(w io.Writer, report *IFTAReport, format string) error {
+	if format == FormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) }
+	out := csv.NewWriter(w)
+	out.Write([]string{"jurisdiction", "miles", "taxableGallons", "paidGallons", "netGallons"})
+	for _, r := range report.Rows {
+		out.Write([]string{r.Jurisdiction, f(r.Miles), f(r.TaxableGallons), f(r.PaidGallons), f(r.NetGallons)})
+	}
+	out.Write([]string{"total", f(report.TotalMiles), "", f(report.TotalGallons), ""})
+	out.Write([]string{"mpg", strconv.FormatFloat(report.MPG, 'f', 2, 64)})
+	out.Write([]string{"trip miles", f(report.TripMiles)})
+	out.Write([]string{"quarter " + report.Quarter, "base " + report.Base, "vin " + report.VIN, "chain " + report.ChainID})
+	out.Write(nil)
+	out.Write([]string{"date", "jurisdiction", "miles"})
+	for _, day := range report.Days {
+		out.Write([]string{day.Date, day.Jurisdiction, f(day.Miles)})
+	}
+	out.Write(nil)
+	out.Write([]string{"purchased", "jurisdiction", "gallons", "vendor", "invoice", "receiptHash", "entryHash"})
+	for _, p := range report.Purchases {
+		out.Write([]string{p.Time.Format(time.RFC3339), p.Jurisdiction, f(p.Gallons), p.Vendor, p.Invoice, p.ReceiptHash, p.EntryHash})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// ExportIFTAReport writes the quarter's report to path and anchors the file's hash
+func (vehicle *Vehicle) ExportIFTAReport(config *IFTAConfig, quarter, format, path string) (*IFTAReport, error) {
+	if format != FormatCSV && format != FormatJSON {
+		return nil, fmt.Errorf("unknown format %q, expected csv or json", format)
+	}
+	report, err := vehicle.BuildIFTAReport(config, quarter)
+	if err != nil {
+		return nil, err
+	}
+	sha := sha256.New()
+	if err := writeFileWith(path, func(w io.Writer) error {
+		return writeIFTAReport(io.MultiWriter(w, sha), report, format)
+	}); err != nil {
+		return nil, err
+	}
+	report.Hash = hex.EncodeToString(sha.Sum(nil))
+	if report.TxID, err = vehicle.secureHashWithMeta(sha.Sum(nil), &HashMeta{Stream: iftaStream}); err != nil {
+		return nil, err
+	}
+	appendAudit("ifta-report", map[string]interface{}{
+		"quarter": report.Quarter, "miles": report.TotalMiles, "gallons": report.TotalGallons, "hash": report.Hash, "txID": report.TxID,
+	})
+	return report, nil
+}
+
+// iftaEnabled rejects requests while IFTA reporting is not configured
+func (vehicle *Vehicle) iftaEnabled(w http.ResponseWriter) bool {
+	if vehicle.ifta == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("IFTA reporting is off, set ifta in the config"))
+		return false
+	}
+	return true
+}
+
+// handleFuel returns the fuel purchases made between the from and to query parameters
+func (vehicle *Vehicle) handleFuel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	purchases, err := vehicle.loadFuelPurchases(start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if purchases == nil {
+		purchases = []FuelPurchase{}
+	}
+	writeJSON(w, http.StatusOK, purchases)
+}
+
+// handleRecordFuel records a fuel purchase
+func (vehicle *Vehicle) handleRecordFuel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !vehicle.iftaEnabled(w) {
+		return
+	}
+	var purchase FuelPurchase
+	if err := json.NewDecoder(r.Body).Decode(&purchase); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	txID, err := vehicle.RecordFuelPurchase(&purchase)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details := requestDetails(r)
+	details["gallons"], details["jurisdiction"] = purchase.Gallons, purchase.Jurisdiction
+	appendAudit("fuel-purchase", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// handleIFTA sends the IFTA report of the quarter query parameter, by default
+// the last one, as csv or json, the format parameter. The report's hash is
+// anchored before it is sent.
+func (vehicle *Vehicle) handleIFTA(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) || !vehicle.iftaEnabled(w) {
+		return
+	}
+	quarter, format := r.URL.Query().Get("quarter"), r.URL.Query().Get("format")
+	if quarter == "" {
+		quarter = lastQuarter(time.Now())
+	}
+	if format == "" {
+		format = FormatCSV
+	}
+	dir, err := ioutil.TempDir("", "blackbox-api")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ifta")
+	report, err := vehicle.ExportIFTAReport(vehicle.ifta, quarter, format, path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+	contentType := "text/csv"
+	if format == FormatJSON {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", iftaFileName(report.Quarter, format)))
+	w.Header().Set("X-Blackbox-Hash", report.Hash)
+	w.Header().Set("X-Blackbox-TxID", report.TxID)
+	w.Header().Set("X-Blackbox-Rows", strconv.Itoa(len(report.Rows)))
+	io.Copy(w, file)
+}
+
+// iftaFileName returns a name for a report, e.g. ifta_2025Q3.csv
+func iftaFileName(quarter, format string) string {
+	return fmt.Sprintf("ifta_%s.%s", quarter, format)
+}
+
+// hashFile returns the hex SHA-256 of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
+
+// iftaCommand records fuel purchases and writes quarterly IFTA reports:
+//
+//	blackbox ifta fuel -gallons 120.5 -jurisdiction TX [-vendor] [-invoice] [-receipt file]
+//	blackbox ifta report [-quarter 2025Q3] [-format csv|json] [-o]
+func iftaCommand(vehicle *Vehicle, config *Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox ifta fuel|report")
+		os.Exit(2)
+	}
+	if config.IFTA == nil {
+		fmt.Println("IFTA reporting is off, set ifta in the config")
+		os.Exit(2)
+	}
+	jurisdictions, err := loadJurisdictions(config.IFTA.Jurisdictions, config.IFTA.Property)
+	if err != nil {
+		fmt.Println("Failed to load jurisdiction boundaries", err)
+		os.Exit(1)
+	}
+	vehicle.ifta, vehicle.jurisdictions = config.IFTA, jurisdictions
+	switch args[0] {
+	case "fuel":
+		flags := flag.NewFlagSet("ifta fuel", flag.ExitOnError)
+		gallons := flags.Float64("gallons", 0, "Gallons bought")
+		jurisdiction := flags.String("jurisdiction", "", "State or province the fuel was bought in, e.g. TX")
+		at := flags.String("time", "", "When the fuel was bought, RFC3339 (default: now)")
+		vendor := flags.String("vendor", "", "Seller of the fuel")
+		invoice := flags.String("invoice", "", "Receipt or invoice number")
+		amount := flags.Float64("amount", 0, "Total paid")
+		receipt := flags.String("receipt", "", "Receipt image or PDF, its hash is anchored with the purchase")
+		flags.Parse(args[1:])
+		purchase := &FuelPurchase{
+			Jurisdiction: *jurisdiction,
+			Gallons:      *gallons,
+			Vendor:       *vendor,
+			Invoice:      *invoice,
+			Amount:       *amount,
+		}
+		if *at != "" {
+			if purchase.Time, err = time.Parse(time.RFC3339, *at); err != nil {
+				fmt.Println("Invalid -time", err)
+				os.Exit(2)
+			}
+		}
+		if *receipt != "" {
+			if purchase.ReceiptHash, err = hashFile(*receipt); err != nil {
+				fmt.Println("Failed to hash the receipt", err)
+				os.Exit(1)
+			}
+		}
+		txID, err := vehicle.RecordFuelPurchase(purchase)
+		if err != nil {
+			fmt.Println("Failed to record fuel purchase", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Fuel purchase of %.1f gallons in %s secured to factom. TxID: %s\n", purchase.Gallons, purchase.Jurisdiction, txID)
+	case "report":
+		flags := flag.NewFlagSet("ifta report", flag.ExitOnError)
+		quarter := flags.String("quarter", lastQuarter(time.Now()), "Quarter to report, e.g. 2025Q3")
+		format := flags.String("format", FormatCSV, "csv or json")
+		out := flags.String("o", "", "Output path (default: ifta_<quarter>.<format>)")
+		flags.Parse(args[1:])
+		path := *out
+		if path == "" {
+			path = iftaFileName(strings.ToUpper(*quarter), *format)
+		}
+		report, err := vehicle.ExportIFTAReport(config.IFTA, *quarter, *format, path)
+		if err != nil {
+			fmt.Println("Failed to write IFTA report", err)
+			os.Exit(1)
+		}
+		for _, r := range report.Rows {
+			fmt.Printf("%-3s %9.1f mi %8.1f gal taxable %8.1f gal paid %8.1f gal net\n", r.Jurisdiction, r.Miles, r.TaxableGallons, r.PaidGallons, r.NetGallons)
+		}
+		fmt.Printf("%.1f miles (%.1f by trip summaries), %.1f gallons, %.2f MPG written to %s\n",
+			report.TotalMiles, report.TripMiles, report.TotalGallons, report.MPG, path)
+		fmt.Printf("SHA-256 %s secured to factom. TxID: %s\n", report.Hash, report.TxID)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: blackbox ifta fuel|report")
+		os.Exit(2)
+	}
+}
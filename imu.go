@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// IMUConfig selects the I2C accelerometer/gyroscope
+type IMUConfig struct {
+	Device  string `json:"device"`  // I2C bus, e.g. /dev/i2c-1
+	Address int    `json:"address"` // 0x68 for an MPU-6050 with AD0 low
+	Rate    int    `json:"rate"`    // samples per second
+}
+
+// IMUSample is one reading from the IMU. Axes follow the vehicle:
+// x forward, y left, z up, assuming the device is mounted level and facing forward.
+type IMUSample struct {
+	Time  time.Time  `json:"time"`
+	Accel [3]float64 `json:"accel"` // g
+	Gyro  [3]float64 `json:"gyro"`  // degrees/s
+}
+
+// MPU-6050 registers and scales
+const (
+	mpuPowerMgmt1   = 0x6B
+	mpuGyroConfig   = 0x1B
+	mpuAccelConfig  = 0x1C
+	mpuAccelXOut    = 0x3B
+	mpuAccelRange8g = 0x10
+	mpuGyroRange500 = 0x08
+	mpuAccelPerG    = 4096.0 // LSB/g at ±8g
+	mpuGyroPerDeg   = 65.5   // LSB/(deg/s) at ±500 deg/s
+)
+
+// MPU6050 is an InvenSense MPU-6050 6-axis IMU on an I2C bus
+type MPU6050 struct {
+	dev *i2cDevice
+}
+
+// OpenMPU6050 wakes the IMU at addr on the I2C bus at path and configures its ranges
+func OpenMPU6050(path string, addr int) (*MPU6050, error) {
+	dev, err := openI2C(path, addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, reg := range [][2]byte{
+		{mpuPowerMgmt1, 0}, // leave sleep mode
+		{mpuAccelConfig, mpuAccelRange8g},
+		{mpuGyroConfig, mpuGyroRange500},
+	} {
+		if err := dev.writeReg(reg[0], reg[1]); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	return &MPU6050{dev: dev}, nil
+}
+
+// Read returns the current acceleration and rotation rates
+func (m *MPU6050) Read() (IMUSample, error) {
+	// accel x,y,z, temperature, gyro x,y,z as big endian int16s
+	var buf [14]byte
+	if err := m.dev.readRegs(mpuAccelXOut, buf[:]); err != nil {
+		return IMUSample{}, err
+	}
+	word := func(i int) float64 {
+		return float64(int16(uint16(buf[i])<<8 | uint16(buf[i+1])))
+	}
+	sample := IMUSample{Time: time.Now()}
+	for axis := 0; axis < 3; axis++ {
+		sample.Accel[axis] = word(axis*2) / mpuAccelPerG
+		sample.Gyro[axis] = word(8+axis*2) / mpuGyroPerDeg
+	}
+	return sample, nil
+}
+
+func (m *MPU6050) Close() error {
+	return m.dev.Close()
+}
+
+// Harsh event thresholds
+const (
+	hardBrakeG        = 0.45 // sustained deceleration
+	harshCorneringG   = 0.45 // sustained lateral acceleration
+	impactG           = 2.5  // instantaneous jolt on any axis
+	harshFilterAlpha  = 0.2  // low-pass filter weight, ignores potholes for braking/cornering
+	harshCooldown     = 3 * time.Second
+	harshHighRateTime = 30 * time.Second // OBD sampling stays high-rate this long after an event
+)
+
+// HarshEvent is a hard brake, harsh turn, or impact detected by the IMU
+type HarshEvent struct {
+	Kind string    `json:"kind"` // "hard-brake", "harsh-cornering", or "impact"
+	Time time.Time `json:"time"`
+	Peak float64   `json:"peak"` // g
+}
+
+// harshDetector finds harsh events in a stream of IMU samples
+type harshDetector struct {
+	filtered  [3]float64
+	lastEvent map[string]time.Time
+}
+
+func newHarshDetector() *harshDetector {
+	return &harshDetector{lastEvent: make(map[string]time.Time)}
+}
+
+// update feeds one sample and returns the harsh event it triggers, if any
+func (d *harshDetector) update(sample IMUSample) *HarshEvent {
+	for axis := range d.filtered {
+		d.filtered[axis] += harshFilterAlpha * (sample.Accel[axis] - d.filtered[axis])
+	}
+
+	// impacts use the raw reading, with gravity removed from the vertical axis
+	jolt := math.Sqrt(sample.Accel[0]*sample.Accel[0] +
+		sample.Accel[1]*sample.Accel[1] +
+		(sample.Accel[2]-1)*(sample.Accel[2]-1))
+	switch {
+	case jolt >= impactG:
+		return d.trigger("impact", sample.Time, jolt)
+	case -d.filtered[0] >= hardBrakeG:
+		return d.trigger("hard-brake", sample.Time, -d.filtered[0])
+	case math.Abs(d.filtered[1]) >= harshCorneringG:
+		return d.trigger("harsh-cornering", sample.Time, math.Abs(d.filtered[1]))
+	}
+	return nil
+}
+
+// trigger returns a new event unless one of the same kind fired within harshCooldown
+func (d *harshDetector) trigger(kind string, at time.Time, peak float64) *HarshEvent {
+	if at.Sub(d.lastEvent[kind]) < harshCooldown {
+		return nil
+	}
+	d.lastEvent[kind] = at
+	return &HarshEvent{Kind: kind, Time: at, Peak: peak}
+}
+
+// RecordIMU polls the IMU at rate samples per second, handling every harsh event,
+// crash, and orientation change it detects. It returns once stop is closed or
+// if the IMU can no longer be read.
+func (vehicle *Vehicle) RecordIMU(imu *MPU6050, rate int, stop <-chan struct{}) error {
+	if rate <= 0 {
+		rate = 50
+	}
+	vehicle.recorder.setIMU(true)
+	defer vehicle.recorder.setIMU(false)
+	detector := newHarshDetector()
+	history := newIMURing(rate * int(preEventWindow/time.Second))
+	orientation := newOrientationMonitor()
+	interval := time.Second / time.Duration(rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// a crash's EDR report waits for the samples after the impact, or is made
+	// with what there is if the IMU stops first
+	var pending *edrCrash
+	var lastCrash time.Time
+	flush := func() {
+		if pending != nil {
+			go vehicle.recordEDR(*pending, history.snapshot())
+			pending = nil
+		}
+	}
+	defer flush()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		sample, err := imu.Read()
+		if err != nil {
+			return err
+		}
+		history.add(sample)
+		if pending != nil && sample.Time.Sub(pending.trigger.Time) >= edrRecordingTime {
+			flush()
+		}
+		vehicle.position.rotate(sample.Gyro[2], time.Second/time.Duration(rate))
+		if event := orientation.update(sample); event != nil {
+			go vehicle.handleOrientationEvent(event)
+		}
+		event := detector.update(sample)
+		if event == nil {
+			continue
+		}
+		if event.Kind == "impact" && event.Peak >= crashG {
+			go vehicle.handleCrash(event, history.snapshot())
+			flush()
+			pending = &edrCrash{trigger: event, interval: interval}
+			if event.Time.Sub(lastCrash) <= edrMultiEvent {
+				pending.previous = lastCrash
+			}
+			lastCrash = event.Time
+		} else {
+			go vehicle.handleHarshEvent(event)
+		}
+	}
+}
+
+// handleHarshEvent switches OBD logging to high-rate, locks the current segment so
+// it is never pruned, and immediately anchors a signed "harsh-event" including the
+// hash of the segment as written so far
+func (vehicle *Vehicle) handleHarshEvent(event *HarshEvent) {
+	fmt.Printf("Harsh event: %s (%.2fg)\n", event.Kind, event.Peak)
+	vehicle.recorder.boost(harshHighRateTime)
+	vehicle.recorder.addHarshEvent()
+
+	data := toEventData(event)
+	if segment := vehicle.recorder.segment(); segment != nil {
+		if err := lockSegment(segment.Path); err != nil {
+			fmt.Println("Failed to lock segment", err)
+		}
+		// the segment is still being recorded, so record the hash of its export so far
+		if export, count, err := vehicle.store.ExportSegment(vehicle.vin, segment, event.Time); err == nil {
+			hash := sha256.Sum256(export)
+			data["segment"] = segment.Path
+			data["segmentRecords"] = count
+			data["segmentHash"] = hex.EncodeToString(hash[:])
+		}
+	}
+
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("harsh-event", data), true)
+	if err != nil {
+		fmt.Println("Failed to anchor harsh event", err)
+		return
+	}
+	fmt.Printf("Harsh event secured to factom. TxID: %s\n", txID)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// leaseCheckInterval is how often finished months are checked for a mileage
+// statement
+const leaseCheckInterval = time.Hour
+
+// leaseDateLayout is how lease dates are given on the command line
+const leaseDateLayout = "2006-01-02"
+
+// LeaseTerms are the terms of a lease or subscription of the vehicle. Both
+// parties sign their JSON encoding, see leaseSigned.
+type LeaseTerms struct {
+	ID           string    `json:"id"` // the lessor's contract number
+	VIN          string    `json:"vin"`
+	ContractHash string    `json:"contractHash"` // hex SHA-256 of the signed contract document
+	Lessor       string    `json:"lessor"`       // hex ed25519 public key
+	Lessee       string    `json:"lessee"`       // hex ed25519 public key
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	AllowanceKm  float64   `json:"allowanceKm"`           // over the whole term
+	ExcessPerKm  float64   `json:"excessPerKm,omitempty"` // charged for each km over the allowance
+	Currency     string    `json:"currency,omitempty"`
+}
+
+// SignedLease is the content of an anchored "lease" event: terms co-signed by
+// lessor and lessee
+type SignedLease struct {
+	Terms     LeaseTerms `json:"terms"`
+	LessorSig string     `json:"lessorSig"` // hex ed25519 signature of leaseSigned(Terms)
+	LesseeSig string     `json:"lesseeSig"`
+	EntryHash string     `json:"entryHash,omitempty"` // of the anchored event, set when read back
+}
+
+// LeaseStatement is the content of an anchored "lease-mileage" event, the
+// anchored trip mileage of one month of a lease against its allowance
+type LeaseStatement struct {
+	Lease       string    `json:"lease"` // ID of the lease
+	LeaseEntry  string    `json:"leaseEntry"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	DrivenKm    float64   `json:"drivenKm"`    // in the month
+	TotalKm     float64   `json:"totalKm"`     // since the lease started
+	AllowedKm   float64   `json:"allowedKm"`   // the allowance pro rata up to End
+	OverKm      float64   `json:"overKm"`      // TotalKm - AllowedKm, negative while under
+	ProjectedKm float64   `json:"projectedKm"` // at the end of the term at the pace so far
+	ExcessCost  float64   `json:"excessCost"`  // of ProjectedKm over the allowance
+	Final       bool      `json:"final,omitempty"`
+}
+
+// LeaseStatus is an anchored lease with its monthly statements
+type LeaseStatus struct {
+	Lease      SignedLease      `json:"lease"`
+	Statements []LeaseStatement `json:"statements"`
+}
+
+// leaseSigned returns what lessor and lessee sign: the JSON encoding of the
+// terms
+func leaseSigned(terms LeaseTerms) []byte {
+	data, _ := json.Marshal(terms)
+	return data
+}
+
+// validate checks the terms and both signatures
+func (lease *SignedLease) validate(vin string) error {
+	terms := lease.Terms
+	switch {
+	case terms.ID == "":
+		return fmt.Errorf("lease id required")
+	case terms.VIN != vin:
+		return fmt.Errorf("lease is for %q, not %s", terms.VIN, vin)
+	case !terms.Start.Before(terms.End):
+		return fmt.Errorf("lease must start before it ends")
+	case terms.AllowanceKm <= 0:
+		return fmt.Errorf("allowanceKm must be positive")
+	case terms.ExcessPerKm < 0:
+		return fmt.Errorf("excessPerKm must not be negative")
+	}
+	if hash, err := hex.DecodeString(terms.ContractHash); err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("contractHash must be a hex SHA-256")
+	}
+	if terms.Lessor == terms.Lessee {
+		return fmt.Errorf("lessor and lessee must sign with different keys")
+	}
+	message := leaseSigned(terms)
+	if !verifyDriverSig(terms.Lessor, lease.LessorSig, message) {
+		return fmt.Errorf("invalid lessor signature")
+	}
+	if !verifyDriverSig(terms.Lessee, lease.LesseeSig, message) {
+		return fmt.Errorf("invalid lessee signature")
+	}
+	return nil
+}
+
+// AnchorLease verifies a co-signed lease and anchors it as a signed "lease"
+// event, returning the txID. A lease ID can only be anchored once.
+func (vehicle *Vehicle) AnchorLease(lease *SignedLease) (string, error) {
+	if err := lease.validate(vehicle.vin); err != nil {
+		return "", err
+	}
+	leases, err := vehicle.loadLeases()
+	if err != nil {
+		return "", err
+	}
+	for _, l := range leases {
+		if l.Lease.Terms.ID == lease.Terms.ID {
+			return "", fmt.Errorf("lease %s is already anchored", lease.Terms.ID)
+		}
+	}
+	lease.EntryHash = ""
+	return vehicle.LogEvent(vehicle.NewEvent("lease", toEventData(lease)), true)
+}
+
+// loadLeases returns the anchored leases, oldest first, with their statements
+func (vehicle *Vehicle) loadLeases() ([]*LeaseStatus, error) {
+	var leases []*LeaseStatus
+	byID := make(map[string]*LeaseStatus)
+	err := readEvents("lease", func() interface{} { return new(SignedLease) }, func(data interface{}, signed *SignedEvent) {
+		lease := data.(*SignedLease)
+		if _, ok := byID[lease.Terms.ID]; ok {
+			return
+		}
+		lease.EntryHash = eventEntryHash(vehicle.chainID, "lease", signed)
+		status := &LeaseStatus{Lease: *lease, Statements: []LeaseStatement{}}
+		byID[lease.Terms.ID] = status
+		leases = append(leases, status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readEvents("lease-mileage", func() interface{} { return new(LeaseStatement) }, func(data interface{}, _ *SignedEvent) {
+		statement := data.(*LeaseStatement)
+		if status, ok := byID[statement.Lease]; ok {
+			status.Statements = append(status.Statements, *statement)
+		}
+	})
+	return leases, err
+}
+
+// leaseMonths returns the calendar months of the term ending by now, each
+// clipped to the term, as start and end pairs
+func leaseMonths(terms LeaseTerms, now time.Time) [][2]time.Time {
+	var months [][2]time.Time
+	for start := terms.Start; start.Before(terms.End); {
+		end := monthStart(start).AddDate(0, 1, 0)
+		if end.After(terms.End) {
+			end = terms.End
+		}
+		if end.After(now) {
+			break
+		}
+		months = append(months, [2]time.Time{start, end})
+		start = end
+	}
+	return months
+}
+
+// buildStatement totals the anchored trips of the lease up to end
+func buildStatement(lease *SignedLease, trips []*TripSummary, start, end time.Time) *LeaseStatement {
+	terms := lease.Terms
+	statement := &LeaseStatement{Lease: terms.ID, LeaseEntry: lease.EntryHash, Start: start, End: end, Final: !end.Before(terms.End)}
+	for _, trip := range trips {
+		if trip.Start.Before(terms.Start) || !trip.Start.Before(end) {
+			continue
+		}
+		statement.TotalKm += trip.Distance
+		if !trip.Start.Before(start) {
+			statement.DrivenKm += trip.Distance
+		}
+	}
+	share := end.Sub(terms.Start).Seconds() / terms.End.Sub(terms.Start).Seconds()
+	statement.AllowedKm = terms.AllowanceKm * share
+	statement.OverKm = statement.TotalKm - statement.AllowedKm
+	statement.ProjectedKm = statement.TotalKm / share
+	statement.ExcessCost = math.Max(0, statement.ProjectedKm-terms.AllowanceKm) * terms.ExcessPerKm
+	return statement
+}
+
+// anchorStatements anchors a "lease-mileage" statement for every finished
+// month of every lease that has none yet, alerting when the mileage is over
+// the allowance so far
+func (vehicle *Vehicle) anchorStatements(now time.Time) error {
+	leases, err := vehicle.loadLeases()
+	if err != nil || len(leases) == 0 {
+		return err
+	}
+	trips, err := loadTrips()
+	if err != nil {
+		return err
+	}
+	for _, status := range leases {
+		stated := make(map[int64]bool, len(status.Statements))
+		for _, statement := range status.Statements {
+			stated[statement.Start.UnixNano()] = true
+		}
+		for _, month := range leaseMonths(status.Lease.Terms, now) {
+			if stated[month[0].UnixNano()] {
+				continue
+			}
+			statement := buildStatement(&status.Lease, trips, month[0], month[1])
+			txID, err := vehicle.LogEvent(vehicle.NewEvent("lease-mileage", toEventData(statement)), true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Lease %s mileage to %s, %.0f of %.0f km allowed, secured to factom. TxID: %s\n",
+				statement.Lease, statement.End.Format(leaseDateLayout), statement.TotalKm, statement.AllowedKm, txID)
+			if statement.OverKm > 0 {
+				vehicle.raiseAlert("lease-over-allowance", fmt.Sprintf("lease %s is %.0f km over its allowance", statement.Lease, statement.OverKm),
+					map[string]interface{}{"lease": statement.Lease, "overKm": statement.OverKm, "projectedKm": statement.ProjectedKm})
+			}
+		}
+	}
+	return nil
+}
+
+// RunLeaseStatements anchors the monthly mileage statements of the vehicle's
+// leases as months end, until stop is closed
+func (vehicle *Vehicle) RunLeaseStatements(stop <-chan struct{}) error {
+	for {
+		if err := vehicle.anchorStatements(time.Now()); err != nil {
+			fmt.Println("Failed to anchor lease statements", err)
+		}
+		if !sleep(leaseCheckInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// handleLeases returns the anchored leases and their monthly statements
+func (vehicle *Vehicle) handleLeases(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	leases, err := vehicle.loadLeases()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if leases == nil {
+		leases = []*LeaseStatus{}
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+// handleAnchorLease verifies and anchors a lease co-signed by lessor and lessee
+func (vehicle *Vehicle) handleAnchorLease(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var lease SignedLease
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	txID, err := vehicle.AnchorLease(&lease)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details := requestDetails(r)
+	details["lease"], details["contractHash"] = lease.Terms.ID, lease.Terms.ContractHash
+	appendAudit("lease-anchored", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// readLeaseKey reads a hex ed25519 private key written by lease keygen
+func readLeaseKey(path string) (*[ed.PrivateKeySize]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) != ed.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not a hex ed25519 private key", path)
+	}
+	var private [ed.PrivateKeySize]byte
+	copy(private[:], secret)
+	return &private, nil
+}
+
+func readLeaseTerms(path string) (*LeaseTerms, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	terms := new(LeaseTerms)
+	return terms, json.Unmarshal(data, terms)
+}
+
+// leaseCommand drafts, signs and anchors leases and lists their statements:
+//
+//	blackbox lease keygen -o lessor.key
+//	blackbox lease terms -id -contract file -lessor key -lessee key -start -end -allowance-km [-excess-per-km] [-o terms.json]
+//	blackbox lease sign -terms terms.json -key lessor.key
+//	blackbox lease anchor -terms terms.json -lessor-sig -lessee-sig
+//	blackbox lease status
+func leaseCommand(vehicle *Vehicle, args []string) {
+	usage := "usage: blackbox lease keygen|terms|sign|anchor|status"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "keygen":
+		flags := flag.NewFlagSet("lease keygen", flag.ExitOnError)
+		out := flags.String("o", "lease.key", "Path to write the private key to")
+		flags.Parse(args[1:])
+		public, private, err := ed.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Println("Failed to generate a key", err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(*out, []byte(hex.EncodeToString(private[:])+"\n"), 0600); err != nil {
+			fmt.Println("Failed to write the key", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Private key written to %s. Public key: %s\n", *out, hex.EncodeToString(public[:]))
+	case "terms":
+		flags := flag.NewFlagSet("lease terms", flag.ExitOnError)
+		id := flags.String("id", "", "Contract number")
+		contract := flags.String("contract", "", "Contract document, its hash is signed and anchored")
+		lessor := flags.String("lessor", "", "Lessor's hex public key")
+		lessee := flags.String("lessee", "", "Lessee's hex public key")
+		start := flags.String("start", "", "First day of the term, YYYY-MM-DD")
+		end := flags.String("end", "", "Day the term ends, YYYY-MM-DD")
+		allowance := flags.Float64("allowance-km", 0, "Mileage allowance over the whole term, km")
+		excess := flags.Float64("excess-per-km", 0, "Charge per km over the allowance")
+		currency := flags.String("currency", "", "Currency of the excess charge")
+		out := flags.String("o", "terms.json", "Path to write the terms to")
+		flags.Parse(args[1:])
+		terms := &LeaseTerms{
+			ID:          *id,
+			VIN:         vehicle.vin,
+			Lessor:      strings.ToLower(*lessor),
+			Lessee:      strings.ToLower(*lessee),
+			AllowanceKm: *allowance,
+			ExcessPerKm: *excess,
+			Currency:    *currency,
+		}
+		var err error
+		if terms.ContractHash, err = hashFile(*contract); err != nil {
+			fmt.Println("Failed to hash the contract", err)
+			os.Exit(1)
+		}
+		if terms.Start, err = time.ParseInLocation(leaseDateLayout, *start, time.Local); err != nil {
+			fmt.Println("Invalid -start", err)
+			os.Exit(2)
+		}
+		if terms.End, err = time.ParseInLocation(leaseDateLayout, *end, time.Local); err != nil {
+			fmt.Println("Invalid -end", err)
+			os.Exit(2)
+		}
+		data, _ := json.MarshalIndent(terms, "", "  ")
+		if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+			fmt.Println("Failed to write the terms", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Lease terms written to %s, for lessor and lessee to sign with lease sign\n", *out)
+	case "sign":
+		flags := flag.NewFlagSet("lease sign", flag.ExitOnError)
+		termsPath := flags.String("terms", "terms.json", "Lease terms to sign")
+		keyPath := flags.String("key", "lease.key", "Private key written by lease keygen")
+		flags.Parse(args[1:])
+		terms, err := readLeaseTerms(*termsPath)
+		if err != nil {
+			fmt.Println("Failed to read the terms", err)
+			os.Exit(1)
+		}
+		private, err := readLeaseKey(*keyPath)
+		if err != nil {
+			fmt.Println("Failed to read the key", err)
+			os.Exit(1)
+		}
+		fmt.Println(hex.EncodeToString(ed.Sign(private, leaseSigned(*terms))[:]))
+	case "anchor":
+		flags := flag.NewFlagSet("lease anchor", flag.ExitOnError)
+		termsPath := flags.String("terms", "terms.json", "Lease terms")
+		lessorSig := flags.String("lessor-sig", "", "Lessor's signature from lease sign")
+		lesseeSig := flags.String("lessee-sig", "", "Lessee's signature from lease sign")
+		flags.Parse(args[1:])
+		terms, err := readLeaseTerms(*termsPath)
+		if err != nil {
+			fmt.Println("Failed to read the terms", err)
+			os.Exit(1)
+		}
+		txID, err := vehicle.AnchorLease(&SignedLease{Terms: *terms, LessorSig: *lessorSig, LesseeSig: *lesseeSig})
+		if err != nil {
+			fmt.Println("Failed to anchor the lease", err)
+			os.Exit(1)
+		}
+		appendAudit("lease-anchored", map[string]interface{}{"via": "cli", "lease": terms.ID, "contractHash": terms.ContractHash})
+		fmt.Printf("Lease %s secured to factom. TxID: %s\n", terms.ID, txID)
+	case "status":
+		leases, err := vehicle.loadLeases()
+		if err != nil {
+			fmt.Println("Failed to read leases", err)
+			os.Exit(1)
+		}
+		for _, status := range leases {
+			terms := status.Lease.Terms
+			fmt.Printf("Lease %s  %s to %s  %.0f km allowed  entry %.16s\n",
+				terms.ID, terms.Start.Local().Format(leaseDateLayout), terms.End.Local().Format(leaseDateLayout), terms.AllowanceKm, status.Lease.EntryHash)
+			sort.Slice(status.Statements, func(i, j int) bool { return status.Statements[i].Start.Before(status.Statements[j].Start) })
+			for _, s := range status.Statements {
+				fmt.Printf("  to %s  %7.0f km driven  %8.0f of %8.0f km  projected %8.0f km  excess %.2f %s\n",
+					s.End.Local().Format(leaseDateLayout), s.DrivenKm, s.TotalKm, s.AllowedKm, s.ProjectedKm, s.ExcessCost, terms.Currency)
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// A load test step is sustained if producers kept at least this share of the
+// target rate and the pipeline drained within a tenth of the step once they
+// stopped, i.e. it wasn't merely buffering a growing backlog.
+const (
+	sustainedShare    = 0.95
+	sustainedMinDrain = 2 * time.Second
+)
+
+// LoadTestConfig sets the synthetic data driven through the pipeline
+type LoadTestConfig struct {
+	Rate          float64       // samples per second of the first step, doubled every step
+	MaxRate       float64       // last rate tried
+	Step          time.Duration // how long each rate is held
+	Latency       time.Duration // round trip of the mock anchor backend
+	VideoKB       int           // footage per video segment, 0 for no video
+	VideoInterval time.Duration // between video segments
+}
+
+// LoadStep is the outcome of driving the pipeline at one rate
+type LoadStep struct {
+	Rate      float64       // target samples per second
+	Achieved  float64       // samples per second producers managed to submit
+	Segments  int64         // segments anchored
+	Failed    int64         // segments that failed
+	Entries   int64         // entries committed to the mock backend
+	Hashes    int64         // hashes in those entries
+	Drain     time.Duration // to empty the pipeline once producers stopped
+	HeapPeak  uint64        // bytes of heap in use at most
+	Sustained bool
+}
+
+// mockAnchors stands in for factomd, taking latency to commit each entry
+type mockAnchors struct {
+	latency time.Duration
+	entries int64
+	hashes  int64
+}
+
+func (m *mockAnchors) send(entry *factom.Entry) (string, error) {
+	time.Sleep(m.latency)
+	atomic.AddInt64(&m.entries, 1)
+	atomic.AddInt64(&m.hashes, int64(len(entryHashes(entry))))
+	sum := sha256.Sum256(entry.Content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// watchHeap samples the heap in use until stop is closed and returns its peak
+func watchHeap(stop <-chan struct{}) <-chan uint64 {
+	peak := make(chan uint64, 1)
+	go func() {
+		var max uint64
+		var mem runtime.MemStats
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&mem)
+			if mem.HeapInuse > max {
+				max = mem.HeapInuse
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return peak
+}
+
+// RunLoadTest drives a pipeline with synthetic OBD samples, and footage if
+// configured, at rates doubling from config.Rate to config.MaxRate, anchoring
+// against a mock backend, and returns each step until one isn't sustained.
+// It works in a temporary directory, signing with owner's key.
+func RunLoadTest(owner *Person, config LoadTestConfig) ([]LoadStep, error) {
+	dir, err := ioutil.TempDir("", "blackbox-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	// segments and objects are written relative to the working directory
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+	defer os.Chdir(wd)
+
+	vehicle, err := NewVehicle(benchVIN, newMemoryChain())
+	if err != nil {
+		return nil, err
+	}
+	vehicle.owner = owner
+	if vehicle.store, err = OpenStore(filepath.Join(dir, "bench.db")); err != nil {
+		return nil, err
+	}
+	defer vehicle.store.Close()
+	if vehicle.anchors, err = openAnchorQueue(filepath.Join(dir, anchorQueuePath)); err != nil {
+		return nil, err
+	}
+	backend := &mockAnchors{latency: config.Latency}
+	vehicle.anchorBackend = backend.send
+
+	var steps []LoadStep
+	var start time.Time // vehicle time of the next sample, carried across steps
+	for rate := config.Rate; rate <= config.MaxRate; rate *= 2 {
+		step := vehicle.loadStep(backend, rate, config, &start)
+		steps = append(steps, step)
+		if !step.Sustained {
+			break
+		}
+	}
+	return steps, nil
+}
+
+// loadStep runs the pipeline at one rate. Samples are a second apart in
+// vehicle time, whatever the rate, so telemetry segments close every
+// segmentDuration samples.
+func (vehicle *Vehicle) loadStep(backend *mockAnchors, rate float64, config LoadTestConfig, at *time.Time) LoadStep {
+	step := LoadStep{Rate: rate}
+	entries, hashes := atomic.LoadInt64(&backend.entries), atomic.LoadInt64(&backend.hashes)
+	stopHeap := make(chan struct{})
+	heap := watchHeap(stopHeap)
+
+	vehicle.pipeline = newPipeline(vehicle, nil)
+	counted := make(chan struct{})
+	go func() {
+		for result := range vehicle.pipeline.SubscribeSegments() {
+			if result.Err != nil {
+				step.Failed++
+			} else {
+				step.Segments++
+			}
+		}
+		close(counted)
+	}()
+
+	if at.IsZero() {
+		*at = time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	}
+	stop := make(chan struct{})
+	var producers sync.WaitGroup
+	if config.VideoKB > 0 {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			vehicle.produceFootage(config.VideoKB, config.VideoInterval, stop)
+		}()
+	}
+
+	record := benchRecord()
+	interval := time.Duration(float64(time.Second) / rate)
+	started := time.Now()
+	next := started
+	samples := 0
+	for time.Since(started) < config.Step {
+		sample := *record
+		sample.Time = *at
+		*at = at.Add(normalSampleInterval)
+		vehicle.pipeline.submit(Sample{Source: telemetryStream, Record: &sample})
+		samples++
+		next = next.Add(interval)
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	step.Achieved = float64(samples) / time.Since(started).Seconds()
+	close(stop)
+	producers.Wait()
+
+	stopped := time.Now()
+	vehicle.pipeline.close()
+	<-counted
+	step.Drain = time.Since(stopped)
+	close(stopHeap)
+	step.HeapPeak = <-heap
+	step.Entries = atomic.LoadInt64(&backend.entries) - entries
+	step.Hashes = atomic.LoadInt64(&backend.hashes) - hashes
+
+	maxDrain := config.Step / 10
+	if maxDrain < sustainedMinDrain {
+		maxDrain = sustainedMinDrain
+	}
+	step.Sustained = step.Achieved >= sustainedShare*rate && step.Drain <= maxDrain && step.Failed == 0
+	return step
+}
+
+// produceFootage submits a video segment of kb random kilobytes every
+// interval until stop is closed, hashed as it is written like captured footage
+func (vehicle *Vehicle) produceFootage(kb int, interval time.Duration, stop <-chan struct{}) {
+	data := make([]byte, kb<<10)
+	for {
+		if !sleep(interval, stop) {
+			return
+		}
+		rand.Read(data)
+		segment, err := vehicle.newSegment("video", time.Now())
+		if err != nil {
+			fmt.Println("Failed to start video segment", err)
+			return
+		}
+		if err := writeAtomic(segment.Path, data); err != nil {
+			fmt.Println("Failed to write footage", err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		segment.Hash = hex.EncodeToString(sum[:])
+		segment.End = time.Now()
+		vehicle.pipeline.submitSegment(segment)
+	}
+}
+
+// printLoadTest prints each step and the highest sustained rate
+func printLoadTest(steps []LoadStep, config LoadTestConfig) {
+	fmt.Printf("%10s %10s %9s %8s %8s %10s %9s %8s\n", "rate/s", "achieved/s", "segments", "entries", "hashes", "entries/s", "drain", "heap MB")
+	var best *LoadStep
+	var heapPeak uint64
+	for i := range steps {
+		step := &steps[i]
+		mark := ""
+		if step.Sustained {
+			best = step
+		} else {
+			mark = "  not sustained"
+		}
+		if step.HeapPeak > heapPeak {
+			heapPeak = step.HeapPeak
+		}
+		seconds := (config.Step + step.Drain).Seconds()
+		fmt.Printf("%10.0f %10.1f %9d %8d %8d %10.1f %9s %8.1f%s\n", step.Rate, step.Achieved, step.Segments, step.Entries, step.Hashes,
+			float64(step.Entries)/seconds, step.Drain.Round(time.Millisecond), float64(step.HeapPeak)/(1<<20), mark)
+	}
+	if best == nil {
+		fmt.Printf("No rate from %.0f samples/s was sustained\n", config.Rate)
+	} else {
+		seconds := (config.Step + best.Drain).Seconds()
+		if best == &steps[len(steps)-1] {
+			fmt.Printf("Max sustainable sample rate: at least %.0f samples/s, raise -max-rate to go further\n", best.Rate)
+		} else {
+			fmt.Printf("Max sustainable sample rate: %.0f samples/s\n", best.Rate)
+		}
+		fmt.Printf("Commit throughput: %.1f entries/s, %.1f hashes/s\n", float64(best.Entries)/seconds, float64(best.Hashes)/seconds)
+	}
+	fmt.Printf("Memory high-water mark: %.1f MB heap in use\n", float64(heapPeak)/(1<<20))
+}
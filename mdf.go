@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ASAM MDF 4 blocks and field values used by the telemetry export. The file
+// holds one data group with one channel group: a time master channel in
+// seconds since the header's start time and a 64 bit float channel per numeric
+// PID, with an invalidation bit set where the PID did not answer.
+const (
+	mdfVersion       = 410
+	mdfHeaderSize    = 24 // block id, reserved, length and link count
+	mdfIDSize        = 64
+	mdfChannelValue  = 0 // cn_type of a fixed length channel
+	mdfChannelMaster = 2
+	mdfSyncNone      = 0
+	mdfSyncTime      = 1
+	mdfFloatLE       = 4 // cn_data_type of an IEEE 754 little endian float
+	mdfInvalValid    = 1 << 1
+)
+
+// Link indexes of the blocks whose links are set after the blocks they point
+// to are written
+const (
+	hdLinkDG      = 0
+	hdLinkFH      = 1
+	hdLinkComment = 5
+	fhLinkComment = 1
+	dgLinkCG      = 1
+	dgLinkData    = 2
+	cgLinkCN      = 1
+	cgLinkName    = 2
+	cnLinkNext    = 0
+	cnLinkName    = 2
+	cnLinkUnit    = 6
+)
+
+// mdfBuilder lays out MDF blocks in memory, as their links are absolute
+// offsets into the file
+type mdfBuilder struct {
+	buf []byte
+}
+
+// block appends a block with links link slots and returns its offset
+func (b *mdfBuilder) block(id string, links int, data []byte) int64 {
+	offset := int64(len(b.buf))
+	header := make([]byte, mdfHeaderSize+8*links)
+	copy(header, "##"+id)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(header)+len(data)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(links))
+	b.buf = append(b.buf, header...)
+	b.buf = append(b.buf, data...)
+	// blocks start at multiples of 8
+	for len(b.buf)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	return offset
+}
+
+// link sets link i of the block at offset to target
+func (b *mdfBuilder) link(offset int64, i int, target int64) {
+	binary.LittleEndian.PutUint64(b.buf[offset+mdfHeaderSize+8*int64(i):], uint64(target))
+}
+
+// text appends a TX block holding s
+func (b *mdfBuilder) text(s string) int64 {
+	return b.block("TX", 0, append([]byte(s), 0))
+}
+
+// meta appends an MD block holding XML
+func (b *mdfBuilder) meta(xml string) int64 {
+	return b.block("MD", 0, append([]byte(xml), 0))
+}
+
+// channel appends a CN block of a 64 bit float at byteOffset in the record,
+// naming it and its units. invalBit is its bit in the invalidation bytes, -1
+// if it is always valid.
+func (b *mdfBuilder) channel(kind, sync uint8, byteOffset int, invalBit int, name, units string) int64 {
+	nameBlock := b.text(name)
+	var unitBlock int64
+	if units != "" {
+		unitBlock = b.text(units)
+	}
+	data := make([]byte, 72)
+	data[0], data[1], data[2] = kind, sync, mdfFloatLE
+	binary.LittleEndian.PutUint32(data[4:], uint32(byteOffset))
+	binary.LittleEndian.PutUint32(data[8:], 64)
+	if invalBit >= 0 {
+		binary.LittleEndian.PutUint32(data[12:], mdfInvalValid)
+		binary.LittleEndian.PutUint32(data[16:], uint32(invalBit))
+	}
+	offset := b.block("CN", 8, data)
+	b.link(offset, cnLinkName, nameBlock)
+	b.link(offset, cnLinkUnit, unitBlock)
+	return offset
+}
+
+// writeMDF writes telemetry rows as an ASAM MDF 4.10 file, the measurement
+// format of automotive analysis tools such as CANape and vSignalyzer
+func writeMDF(w io.Writer, rows []interface{}, vin string) error {
+	channels, records, located := groupTelemetry(rows)
+	if !located {
+		// positions are private or missing, leave out channels that would
+		// never hold a value
+		channels = channels[2:]
+		for i := range records {
+			records[i].values = records[i].values[2:]
+		}
+	}
+	var start time.Time
+	if len(records) > 0 {
+		start = records[0].time
+	}
+
+	b := &mdfBuilder{}
+	id := make([]byte, mdfIDSize)
+	copy(id, fmt.Sprintf("%-8s%-8s%-8s", "MDF", "4.10", "blackbox"))
+	binary.LittleEndian.PutUint16(id[28:], mdfVersion)
+	b.buf = append(b.buf, id...)
+
+	headerData := make([]byte, 32)
+	if !start.IsZero() {
+		binary.LittleEndian.PutUint64(headerData, uint64(start.UnixNano()))
+	}
+	header := b.block("HD", 6, headerData)
+
+	historyData := make([]byte, 16)
+	binary.LittleEndian.PutUint64(historyData, uint64(time.Now().UnixNano()))
+	history := b.block("FH", 2, historyData)
+	b.link(history, fhLinkComment, b.meta("<FHcomment><TX>Exported from the blackbox record, the file's SHA-256 is anchored on the vehicle's chain</TX>"+
+		"<tool_id>blackbox</tool_id><tool_vendor>blackbox</tool_vendor><tool_version>1</tool_version></FHcomment>"))
+	b.link(header, hdLinkFH, history)
+
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(vin))
+	b.link(header, hdLinkComment, b.meta("<HDcomment><TX>OBD-II telemetry of VIN "+escaped.String()+"</TX>"+
+		"<common_properties><e name=\"VIN\">"+escaped.String()+"</e></common_properties></HDcomment>"))
+
+	group := b.block("DG", 4, make([]byte, 8))
+	b.link(header, hdLinkDG, group)
+
+	valueBytes := 8 * (1 + len(channels))
+	invalBytes := (len(channels) + 7) / 8
+	groupData := make([]byte, 32)
+	binary.LittleEndian.PutUint64(groupData[8:], uint64(len(records)))
+	binary.LittleEndian.PutUint32(groupData[24:], uint32(valueBytes))
+	binary.LittleEndian.PutUint32(groupData[28:], uint32(invalBytes))
+	channelGroup := b.block("CG", 6, groupData)
+	b.link(channelGroup, cgLinkName, b.text("OBD-II"))
+	b.link(group, dgLinkCG, channelGroup)
+
+	previous := b.channel(mdfChannelMaster, mdfSyncTime, 0, -1, "Time", "s")
+	b.link(channelGroup, cgLinkCN, previous)
+	for i, channel := range channels {
+		cn := b.channel(mdfChannelValue, mdfSyncNone, 8*(1+i), i, channel.name, channel.units)
+		b.link(previous, cnLinkNext, cn)
+		previous = cn
+	}
+
+	data := make([]byte, 0, len(records)*(valueBytes+invalBytes))
+	record := make([]byte, valueBytes+invalBytes)
+	for _, r := range records {
+		for i := range record {
+			record[i] = 0
+		}
+		binary.LittleEndian.PutUint64(record, math.Float64bits(r.time.Sub(start).Seconds()))
+		for i := range channels {
+			value := math.NaN()
+			if i < len(r.values) {
+				value = r.values[i]
+			}
+			if math.IsNaN(value) {
+				record[valueBytes+i/8] |= 1 << uint(i%8)
+				value = 0
+			}
+			binary.LittleEndian.PutUint64(record[8*(1+i):], math.Float64bits(value))
+		}
+		data = append(data, record...)
+	}
+	b.link(group, dgLinkData, b.block("DT", 0, data))
+
+	_, err := w.Write(b.buf)
+	return err
+}
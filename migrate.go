@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State archive layout
+const (
+	stateDatabaseName = "blackbox.db"
+	stateKeyName      = "device.key"
+	stateReceiptsDir  = "receipts/"
+	stateManifestName = "manifest.json"
+)
+
+// stateFiles are the small local files carried over to a replacement device.
+// Raw evidence is not included, it is expected to be uploaded or exported.
+var stateFiles = []string{eventLogPath, auditLogPath, trackLogPath, nmeaLogPath, locationPreimagePath, orientationStatePath, pairedPhonesPath, apiTokensPath, credentialsPath}
+
+// StateManifest describes a state archive
+type StateManifest struct {
+	VIN      string    `json:"vin"`
+	Created  time.Time `json:"created"`
+	Files    []string  `json:"files"`
+	Receipts int       `json:"receipts"` // receipts fetched for anchored segments
+	KeyFile  bool      `json:"keyFile"`  // device key included
+	Wrapped  bool      `json:"wrapped"`  // the included key is passphrase wrapped
+}
+
+// ExportState writes the local database, key metadata, on-chain receipts of
+// anchored segments, and state files to a gzipped tar archive
+func (vehicle *Vehicle) ExportState(w io.Writer, config *Config) (*StateManifest, error) {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	manifest := &StateManifest{VIN: vehicle.vin, Created: time.Now().UTC()}
+	add := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		manifest.Files = append(manifest.Files, name)
+		return err
+	}
+
+	var db bytes.Buffer
+	if err := vehicle.store.Backup(&db); err != nil {
+		return nil, err
+	}
+	if err := add(stateDatabaseName, db.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if config.Encryption != nil {
+		key, err := ioutil.ReadFile(config.Encryption.KeyPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var file keyFile
+			if err := json.Unmarshal(key, &file); err != nil {
+				return nil, err
+			}
+			manifest.KeyFile, manifest.Wrapped = true, file.Salt != nil
+			if err := add(stateKeyName, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	incidents, err := filepath.Glob("incident_*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range append(append([]string(nil), stateFiles...), incidents...) {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := add(path, data); err != nil {
+			return nil, err
+		}
+	}
+
+	// receipts let past data be verified without trusting a factomd node later
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if segment.EntryHash == "" {
+			continue
+		}
+		receipt, err := vehicle.chain.receipt(segment.EntryHash)
+		if err != nil {
+			fmt.Printf("No receipt for %s: %v\n", segment.EntryHash, err)
+			continue
+		}
+		data, err := json.Marshal(receipt)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(stateReceiptsDir+segment.EntryHash+".json", data); err != nil {
+			return nil, err
+		}
+		manifest.Receipts++
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := add(stateManifestName, data); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// ImportState restores an archive written by ExportState. Existing files are
+// only replaced if overwrite is true.
+func ImportState(r io.Reader, config *Config, overwrite bool) (*StateManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = data
+	}
+	manifest := new(StateManifest)
+	if err := json.Unmarshal(files[stateManifestName], manifest); err != nil {
+		return nil, fmt.Errorf("archive has no valid manifest: %v", err)
+	}
+
+	// map archive names to local paths, receipts are kept alongside the database
+	targets := make(map[string]string)
+	for name := range files {
+		switch {
+		case name == stateManifestName:
+		case name == stateDatabaseName:
+			targets[name] = config.Database
+		case name == stateKeyName:
+			if config.Encryption == nil {
+				return nil, fmt.Errorf("archive holds a device key but encryption is not configured")
+			}
+			targets[name] = config.Encryption.KeyPath
+		case filepath.Base(name) != name && filepath.Dir(name)+"/" != stateReceiptsDir:
+			return nil, fmt.Errorf("unexpected path %q in archive", name)
+		default:
+			targets[name] = name
+		}
+	}
+	if !overwrite {
+		for _, path := range targets {
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("%s already exists", path)
+			}
+		}
+	}
+	if err := os.MkdirAll(stateReceiptsDir, 0700); err != nil {
+		return nil, err
+	}
+	for name, path := range targets {
+		if err := ioutil.WriteFile(path, files[name], 0600); err != nil {
+			return nil, err
+		}
+	}
+	appendAudit("import-state", map[string]interface{}{"vin": manifest.VIN, "created": manifest.Created, "files": len(targets)})
+	return manifest, nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// Purposes a trip can be tagged with, the categories of IRS mileage deductions
+const (
+	PurposeBusiness = "business"
+	PurposePersonal = "personal"
+	PurposeMedical  = "medical"
+	PurposeCharity  = "charity"
+)
+
+var tripPurposes = []string{PurposeBusiness, PurposePersonal, PurposeMedical, PurposeCharity}
+
+// Mileage report styles
+const (
+	ReportIRS  = "irs"  // US standard mileage rates per purpose
+	ReportHMRC = "hmrc" // UK approved mileage allowance payments, business only
+)
+
+// irsRates are the 2025 IRS standard mileage rates in dollars per mile
+var irsRates = map[string]float64{PurposeBusiness: 0.70, PurposeMedical: 0.21, PurposeCharity: 0.14}
+
+// HMRC approved mileage allowance payments for cars, in pounds per business mile
+const (
+	hmrcRate          = 0.45
+	hmrcReducedRate   = 0.25  // after hmrcRateThreshold business miles in a tax year
+	hmrcRateThreshold = 10000 // miles
+)
+
+// kmPerMile converts trip distances, recorded in km, for reports in miles
+const kmPerMile = 1.609344
+
+// mileageReportStream marks the anchored hashes of mileage reports in hash entry metadata
+const mileageReportStream = "mileage-report"
+
+// TripTag is the content of a "trip-tag" event, the purpose the driver gave a
+// trip. The latest tag of a trip replaces any before it.
+type TripTag struct {
+	Trip    time.Time `json:"trip"` // start of the trip, which identifies it
+	Purpose string    `json:"purpose"`
+	Note    string    `json:"note,omitempty"` // e.g. the client visited
+}
+
+// TaggedTrip is a trip summary with its purpose and the hash of the chain
+// entry anchoring the summary
+type TaggedTrip struct {
+	TripSummary
+	Purpose   string `json:"purpose,omitempty"`
+	Note      string `json:"note,omitempty"`
+	EntryHash string `json:"entryHash"`
+}
+
+// MileageReport is a mileage log for tax or expense claims. Every trip's
+// distance comes from a trip summary anchored when the trip ended, whose
+// entry hash is listed so the totals can be checked against the chain.
+type MileageReport struct {
+	VIN       string             `json:"vin"`
+	ChainID   string             `json:"chainID"`
+	Vehicle   *VehicleInfo       `json:"vehicle,omitempty"`
+	Style     string             `json:"style"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Created   time.Time          `json:"created"`
+	Trips     []TaggedTrip       `json:"trips"`
+	Miles     map[string]float64 `json:"miles"`     // total per purpose, "" for untagged trips
+	Allowance float64            `json:"allowance"` // deductible or reimbursable amount
+	Currency  string             `json:"currency"`
+	Hash      string             `json:"-"`
+	TxID      string             `json:"-"`
+}
+
+// eventEntryHash returns the hash of the chain entry LogEvent anchored for a
+// signed event of eventType
+func eventEntryHash(chainID, eventType string, signed *SignedEvent) string {
+	signature, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return ""
+	}
+	key, err := hex.DecodeString(signed.PubKey)
+	if err != nil {
+		return ""
+	}
+	entry := factom.Entry{
+		ChainID: chainID,
+		ExtIDs:  [][]byte{signature, key, []byte("event"), []byte(eventType)},
+		Content: signed.Event,
+	}
+	return hex.EncodeToString(entry.Hash())
+}
+
+// loadTaggedTrips returns the trips starting between from and to, oldest
+// first, with their latest tags
+func (vehicle *Vehicle) loadTaggedTrips(from, to time.Time) ([]TaggedTrip, error) {
+	tags := make(map[int64]*TripTag)
+	err := readEvents("trip-tag", func() interface{} { return new(TripTag) }, func(data interface{}, _ *SignedEvent) {
+		tag := data.(*TripTag)
+		tags[tag.Trip.UnixNano()] = tag
+	})
+	if err != nil {
+		return nil, err
+	}
+	var trips []TaggedTrip
+	err = readEvents("trip-summary", func() interface{} { return new(TripSummary) }, func(data interface{}, signed *SignedEvent) {
+		summary := data.(*TripSummary)
+		if summary.Start.Before(from) || summary.Start.After(to) {
+			return
+		}
+		trip := TaggedTrip{TripSummary: *summary, EntryHash: eventEntryHash(vehicle.chainID, "trip-summary", signed)}
+		if tag := tags[summary.Start.UnixNano()]; tag != nil {
+			trip.Purpose, trip.Note = tag.Purpose, tag.Note
+		}
+		trips = append(trips, trip)
+	})
+	return trips, err
+}
+
+// TagTrip records the purpose of the trip starting at start as a signed,
+// anchored "trip-tag" event and returns the txID
+func (vehicle *Vehicle) TagTrip(start time.Time, purpose, note string) (string, error) {
+	if !contains(tripPurposes, purpose) {
+		return "", fmt.Errorf("unknown purpose %q, expected business, personal, medical or charity", purpose)
+	}
+	trips, err := vehicle.loadTaggedTrips(start, start)
+	if err != nil {
+		return "", err
+	}
+	if len(trips) == 0 {
+		return "", fmt.Errorf("no trip started at %s", start.Format(time.RFC3339Nano))
+	}
+	tag := TripTag{Trip: trips[0].Start, Purpose: purpose, Note: note}
+	return vehicle.LogEvent(vehicle.NewEvent("trip-tag", toEventData(tag)), true)
+}
+
+// BuildMileageReport totals the trips starting between from and to by purpose
+// and computes the allowance of style
+func (vehicle *Vehicle) BuildMileageReport(style string, from, to time.Time) (*MileageReport, error) {
+	if style != ReportIRS && style != ReportHMRC {
+		return nil, fmt.Errorf("unknown report style %q, expected irs or hmrc", style)
+	}
+	trips, err := vehicle.loadTaggedTrips(from, to)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].Start.Before(trips[j].Start) })
+	report := &MileageReport{
+		VIN:      vehicle.vin,
+		ChainID:  vehicle.chainID,
+		Vehicle:  vehicle.info,
+		Style:    style,
+		From:     from.UTC(),
+		To:       to.UTC(),
+		Created:  time.Now().UTC(),
+		Trips:    trips,
+		Miles:    make(map[string]float64),
+		Currency: "USD",
+	}
+	if style == ReportHMRC {
+		report.Currency = "GBP"
+	}
+	// HMRC's reduced rate applies past the threshold within the range, which
+	// should be one tax year, 6 April to 5 April
+	var business float64
+	for _, trip := range trips {
+		miles := trip.Distance / kmPerMile
+		report.Miles[trip.Purpose] += miles
+		switch {
+		case style == ReportIRS:
+			report.Allowance += miles * irsRates[trip.Purpose]
+		case trip.Purpose == PurposeBusiness:
+			full := clampMiles(hmrcRateThreshold-business, miles)
+			report.Allowance += full*hmrcRate + (miles-full)*hmrcReducedRate
+			business += miles
+		}
+	}
+	return report, nil
+}
+
+// clampMiles returns miles, at most limit and at least 0
+func clampMiles(limit, miles float64) float64 {
+	if limit < 0 {
+		return 0
+	}
+	if miles > limit {
+		return limit
+	}
+	return miles
+}
+
+// writeMileageReport writes the report as CSV, one line per trip followed by
+// the totals, or as JSON
+func writeMileageReport(w io.Writer, report *MileageReport, format string) error {
+	if format == FormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "start", "end", "miles", "purpose", "note", "entryHash"})
+	for _, trip := range report.Trips {
+		start := trip.Start.In(time.Local)
+		out.Write([]string{
+			start.Format("2006-01-02"), start.Format("15:04"), trip.End.In(time.Local).Format("15:04"),
+			strconv.FormatFloat(trip.Distance/kmPerMile, 'f', 1, 64), trip.Purpose, trip.Note, trip.EntryHash,
+		})
+	}
+	out.Write(nil)
+	for _, purpose := range append(tripPurposes, "") {
+		if miles, ok := report.Miles[purpose]; ok {
+			label := purpose
+			if label == "" {
+				label = "untagged"
+			}
+			out.Write([]string{"total " + label, "", "", strconv.FormatFloat(miles, 'f', 1, 64)})
+		}
+	}
+	out.Write([]string{"allowance " + report.Currency, "", "", strconv.FormatFloat(report.Allowance, 'f', 2, 64)})
+	out.Write([]string{"vin " + report.VIN, "", "", "", "", "", "chain " + report.ChainID})
+	out.Flush()
+	return out.Error()
+}
+
+// ExportMileageReport writes the report of style between from and to to path
+// and anchors the file's hash
+func (vehicle *Vehicle) ExportMileageReport(style, format string, from, to time.Time, path string) (*MileageReport, error) {
+	if format != FormatCSV && format != FormatJSON {
+		return nil, fmt.Errorf("unknown format %q, expected csv or json", format)
+	}
+	report, err := vehicle.BuildMileageReport(style, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sha := sha256.New()
+	if err := writeFileWith(path, func(w io.Writer) error {
+		return writeMileageReport(io.MultiWriter(w, sha), report, format)
+	}); err != nil {
+		return nil, err
+	}
+	report.Hash = hex.EncodeToString(sha.Sum(nil))
+	if report.TxID, err = vehicle.secureHashWithMeta(sha.Sum(nil), &HashMeta{Stream: mileageReportStream}); err != nil {
+		return nil, err
+	}
+	appendAudit("mileage-report", map[string]interface{}{
+		"style": style, "from": from, "to": to, "trips": len(report.Trips), "hash": report.Hash, "txID": report.TxID,
+	})
+	return report, nil
+}
+
+// tagRequest is the body of POST /trips/tag
+type tagRequest struct {
+	Trip    time.Time `json:"trip"`
+	Purpose string    `json:"purpose"`
+	Note    string    `json:"note"`
+}
+
+// handleTrips returns the trips starting between the from and to query
+// parameters with their tags
+func (vehicle *Vehicle) handleTrips(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	trips, err := vehicle.loadTaggedTrips(start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if trips == nil {
+		trips = []TaggedTrip{}
+	}
+	writeJSON(w, http.StatusOK, trips)
+}
+
+// handleTagTrip tags a trip, identified by its start, with a purpose
+func (vehicle *Vehicle) handleTagTrip(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req tagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	txID, err := vehicle.TagTrip(req.Trip, req.Purpose, req.Note)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details := requestDetails(r)
+	details["trip"], details["purpose"] = req.Trip, req.Purpose
+	appendAudit("trip-tagged", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// handleMileage sends the mileage report of the style query parameter (irs or
+// hmrc) for trips between from and to as csv or json, the format parameter.
+// The report's hash is anchored before it is sent.
+func (vehicle *Vehicle) handleMileage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	style, format := r.URL.Query().Get("style"), r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+	dir, err := ioutil.TempDir("", "blackbox-api")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mileage")
+	report, err := vehicle.ExportMileageReport(style, format, start, end, path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+	contentType := "text/csv"
+	if format == FormatJSON {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", mileageFileName(style, format, start)))
+	w.Header().Set("X-Blackbox-Hash", report.Hash)
+	w.Header().Set("X-Blackbox-TxID", report.TxID)
+	w.Header().Set("X-Blackbox-Rows", strconv.Itoa(len(report.Trips)))
+	io.Copy(w, file)
+}
+
+// mileageFileName returns a name for a report, e.g. mileage_irs_20250101.csv
+func mileageFileName(style, format string, from time.Time) string {
+	return fmt.Sprintf("mileage_%s_%s.%s", style, from.Format("20060102"), format)
+}
+
+// mileageCommand tags trips and writes mileage reports:
+//
+//	blackbox mileage tag -trip <start> -purpose business [-note ...]
+//	blackbox mileage report [-style irs|hmrc] [-format csv|json] [-from] [-to] [-o]
+func mileageCommand(vehicle *Vehicle, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox mileage tag|report")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "tag":
+		flags := flag.NewFlagSet("mileage tag", flag.ExitOnError)
+		trip := flags.String("trip", "", "Start of the trip, RFC3339 to the second")
+		purpose := flags.String("purpose", PurposeBusiness, "business, personal, medical or charity")
+		note := flags.String("note", "", "e.g. the client visited")
+		flags.Parse(args[1:])
+		start, err := time.Parse(time.RFC3339, *trip)
+		if err != nil {
+			fmt.Println("Invalid -trip", err)
+			os.Exit(2)
+		}
+		// trips start at sub-second times, match the whole second given
+		trips, err := vehicle.loadTaggedTrips(start, start.Add(time.Second-1))
+		if err == nil && len(trips) == 0 {
+			err = fmt.Errorf("no trip started at %s", *trip)
+		}
+		var txID string
+		if err == nil {
+			txID, err = vehicle.TagTrip(trips[0].Start, *purpose, *note)
+		}
+		if err != nil {
+			fmt.Println("Failed to tag trip", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Trip tagged %s. TxID: %s\n", *purpose, txID)
+	case "report":
+		flags := flag.NewFlagSet("mileage report", flag.ExitOnError)
+		style := flags.String("style", ReportIRS, "irs or hmrc")
+		format := flags.String("format", FormatCSV, "csv or json")
+		from := flags.String("from", "", "Start of the range, RFC3339 (default: the start of the year)")
+		to := flags.String("to", "", "End of the range, RFC3339 (default: now)")
+		out := flags.String("o", "", "Output path (default: mileage_<style>_<from>.<format>)")
+		flags.Parse(args[1:])
+		end := time.Now()
+		start := time.Date(end.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+		var err error
+		if *from != "" {
+			if start, err = time.Parse(time.RFC3339, *from); err != nil {
+				fmt.Println("Invalid -from", err)
+				os.Exit(2)
+			}
+		}
+		if *to != "" {
+			if end, err = time.Parse(time.RFC3339, *to); err != nil {
+				fmt.Println("Invalid -to", err)
+				os.Exit(2)
+			}
+		}
+		path := *out
+		if path == "" {
+			path = mileageFileName(*style, *format, start)
+		}
+		report, err := vehicle.ExportMileageReport(*style, *format, start, end, path)
+		if err != nil {
+			fmt.Println("Failed to write mileage report", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d trips, %.1f business miles, allowance %.2f %s written to %s\n",
+			len(report.Trips), report.Miles[PurposeBusiness], report.Allowance, report.Currency, path)
+		fmt.Printf("SHA-256 %s secured to factom. TxID: %s\n", report.Hash, report.TxID)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mileage command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files caching what NHTSA reported about the vehicle
+const (
+	vehicleInfoPath = "vehicle.json" // VIN decoded at registration
+	recallsPath     = "recalls.json" // open recalls as of the last check
+)
+
+// NHTSA API defaults, see https://vpic.nhtsa.dot.gov/api/ and
+// https://www.nhtsa.gov/nhtsa-datasets-and-apis
+const (
+	defaultVPICURL       = "https://vpic.nhtsa.dot.gov/api/vehicles"
+	defaultRecallsURL    = "https://api.nhtsa.gov/recalls"
+	defaultRecallHours   = 24
+	nhtsaRequestTimeout  = 30 * time.Second
+	nhtsaRetryWait       = 10 * time.Minute // after a failed recall check
+	nhtsaMaxResponseSize = 1 << 20
+)
+
+// NHTSAConfig enables decoding the VIN with NHTSA's vPIC API at registration
+// and checking NHTSA's recall API for open recalls
+type NHTSAConfig struct {
+	VPICURL    string `json:"vpicURL"`    // default defaultVPICURL
+	RecallsURL string `json:"recallsURL"` // default defaultRecallsURL
+	Interval   int    `json:"interval"`   // hours between recall checks, default 24
+}
+
+// VehicleInfo is what the VIN decodes to, written as the content of the
+// vehicle's chain entry
+type VehicleInfo struct {
+	VIN       string `json:"vin"`
+	Make      string `json:"make"`
+	Model     string `json:"model"`
+	Year      string `json:"year"`
+	Trim      string `json:"trim,omitempty"`
+	BodyClass string `json:"bodyClass,omitempty"`
+}
+
+// Recall is an NHTSA safety recall campaign covering the vehicle
+type Recall struct {
+	Campaign    string    `json:"campaign"` // NHTSA campaign number, e.g. "20V123000"
+	Component   string    `json:"component"`
+	Summary     string    `json:"summary"`
+	Consequence string    `json:"consequence,omitempty"`
+	Remedy      string    `json:"remedy,omitempty"`
+	Reported    string    `json:"reported,omitempty"` // date NHTSA received the report
+	Seen        time.Time `json:"seen"`               // first check that found it
+}
+
+// nhtsaClient queries NHTSA's public APIs, which need no key
+type nhtsaClient struct {
+	vpicURL    string
+	recallsURL string
+	http       *http.Client
+}
+
+func newNHTSAClient(config *NHTSAConfig) *nhtsaClient {
+	c := &nhtsaClient{
+		vpicURL:    strings.TrimSuffix(config.VPICURL, "/"),
+		recallsURL: strings.TrimSuffix(config.RecallsURL, "/"),
+		http:       &http.Client{Timeout: nhtsaRequestTimeout},
+	}
+	if c.vpicURL == "" {
+		c.vpicURL = defaultVPICURL
+	}
+	if c.recallsURL == "" {
+		c.recallsURL = defaultRecallsURL
+	}
+	return c
+}
+
+// get decodes the JSON reply to a GET of rawURL into out
+func (c *nhtsaClient) get(rawURL string, out interface{}) error {
+	resp, err := c.http.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("NHTSA replied %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, nhtsaMaxResponseSize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// decodeVIN returns the make, model and year of vin
+func (c *nhtsaClient) decodeVIN(vin string) (*VehicleInfo, error) {
+	var reply struct {
+		Results []struct {
+			Make      string
+			Model     string
+			ModelYear string
+			Trim      string
+			BodyClass string
+			ErrorText string
+		}
+	}
+	if err := c.get(fmt.Sprintf("%s/DecodeVinValues/%s?format=json", c.vpicURL, url.PathEscape(vin)), &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Results) == 0 {
+		return nil, fmt.Errorf("vPIC returned nothing for %s", vin)
+	}
+	result := reply.Results[0]
+	if result.Make == "" || result.ModelYear == "" {
+		return nil, fmt.Errorf("vPIC could not decode %s: %s", vin, result.ErrorText)
+	}
+	return &VehicleInfo{VIN: vin, Make: result.Make, Model: result.Model, Year: result.ModelYear, Trim: result.Trim, BodyClass: result.BodyClass}, nil
+}
+
+// recalls returns the recall campaigns covering the vehicle's make, model and year
+func (c *nhtsaClient) recalls(info *VehicleInfo) ([]Recall, error) {
+	query := url.Values{"make": {info.Make}, "model": {info.Model}, "modelYear": {info.Year}}
+	var reply struct {
+		Results []struct {
+			NHTSACampaignNumber string
+			Component           string
+			Summary             string
+			Consequence         string
+			Remedy              string
+			ReportReceivedDate  string
+		} `json:"results"`
+	}
+	if err := c.get(c.recallsURL+"/recallsByVehicle?"+query.Encode(), &reply); err != nil {
+		return nil, err
+	}
+	recalls := make([]Recall, 0, len(reply.Results))
+	for _, r := range reply.Results {
+		recalls = append(recalls, Recall{
+			Campaign:    r.NHTSACampaignNumber,
+			Component:   r.Component,
+			Summary:     r.Summary,
+			Consequence: r.Consequence,
+			Remedy:      r.Remedy,
+			Reported:    r.ReportReceivedDate,
+		})
+	}
+	return recalls, nil
+}
+
+// loadVehicleInfo returns the decoded VIN cached at registration, nil if there is none
+func loadVehicleInfo(vin string) (*VehicleInfo, error) {
+	data, err := ioutil.ReadFile(vehicleInfoPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var info VehicleInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if info.VIN != vin {
+		return nil, nil // decoded for another vehicle
+	}
+	return &info, nil
+}
+
+// vehicleInfo returns the decoded VIN, from the cache or else from vPIC, and
+// caches it. Decoding is best effort, a vehicle registers without it.
+func (c *nhtsaClient) vehicleInfo(vin string) *VehicleInfo {
+	info, err := loadVehicleInfo(vin)
+	if err != nil {
+		fmt.Println("Failed to read the decoded VIN", err)
+	}
+	if info != nil {
+		return info
+	}
+	if info, err = c.decodeVIN(vin); err != nil {
+		fmt.Println("Failed to decode the VIN", err)
+		return nil
+	}
+	if data, err := json.MarshalIndent(info, "", "  "); err == nil {
+		if err := writeAtomic(vehicleInfoPath, data); err != nil {
+			fmt.Println("Failed to cache the decoded VIN", err)
+		}
+	}
+	fmt.Printf("VIN decoded: %s %s %s\n", info.Year, info.Make, info.Model)
+	return info
+}
+
+// loadRecalls returns the open recalls found by the last check
+func loadRecalls() ([]Recall, error) {
+	data, err := ioutil.ReadFile(recallsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var recalls []Recall
+	return recalls, json.Unmarshal(data, &recalls)
+}
+
+// checkRecalls fetches the recalls covering the vehicle, alerting the owner
+// and logging an event for each campaign not seen before, and saves them
+func (vehicle *Vehicle) checkRecalls(client *nhtsaClient) error {
+	recalls, err := client.recalls(vehicle.info)
+	if err != nil {
+		return err
+	}
+	known, err := loadRecalls()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]time.Time, len(known))
+	for _, r := range known {
+		seen[r.Campaign] = r.Seen
+	}
+	now := time.Now().UTC()
+	for i := range recalls {
+		recall := &recalls[i]
+		if at, ok := seen[recall.Campaign]; ok {
+			recall.Seen = at
+			continue
+		}
+		recall.Seen = now
+		vehicle.raiseAlert("recall", fmt.Sprintf("open recall %s: %s", recall.Campaign, recall.Component),
+			map[string]interface{}{"campaign": recall.Campaign})
+		if _, err := vehicle.LogEvent(vehicle.NewEvent("recall", toEventData(recall)), false); err != nil {
+			fmt.Println("Failed to log recall", err)
+		}
+	}
+	data, err := json.MarshalIndent(recalls, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(recallsPath, data)
+}
+
+// RunRecallChecks checks for open recalls every interval until stop is closed
+func (vehicle *Vehicle) RunRecallChecks(config *NHTSAConfig, stop <-chan struct{}) error {
+	interval := time.Duration(defaultRecallHours) * time.Hour
+	if config.Interval > 0 {
+		interval = time.Duration(config.Interval) * time.Hour
+	}
+	client := newNHTSAClient(config)
+	for {
+		wait := interval
+		if vehicle.info == nil {
+			vehicle.info = client.vehicleInfo(vehicle.vin)
+		}
+		if vehicle.info == nil {
+			wait = nhtsaRetryWait
+		} else if err := vehicle.checkRecalls(client); err != nil {
+			fmt.Println("Failed to check for recalls", err)
+			wait = nhtsaRetryWait
+		}
+		if !sleep(wait, stop) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nmeaLogPath is the local log of the GPS receiver's raw sentences, kept when
+// nmeaLog is set for workflows that need the original sentences rather than
+// the parsed positions of the track log
+const nmeaLogPath = "nmea.log"
+
+var nmeaLogMu sync.Mutex
+
+// NMEASentence is a sentence as the receiver sent it and when it arrived
+type NMEASentence struct {
+	Time     time.Time `json:"time" parquet:"time"` // local clock when the sentence was read
+	Sentence string    `json:"sentence" parquet:"sentence"`
+}
+
+// logNMEA appends a raw sentence to the NMEA log, unless privacy mode is on
+func (vehicle *Vehicle) logNMEA(sentence string) {
+	if vehicle.privacyMode.active() {
+		return
+	}
+	if err := appendNMEA(NMEASentence{Time: time.Now().UTC(), Sentence: sentence}); err != nil {
+		fmt.Println("Failed to log NMEA sentence", err)
+	}
+}
+
+// appendNMEA adds a sentence to the NMEA log
+func appendNMEA(sentence NMEASentence) error {
+	line, err := json.Marshal(sentence)
+	if err != nil {
+		return err
+	}
+	nmeaLogMu.Lock()
+	defer nmeaLogMu.Unlock()
+	file, err := os.OpenFile(nmeaLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// readNMEA returns the sentences logged between start and end, inclusive
+func readNMEA(start, end time.Time) ([]NMEASentence, error) {
+	file, err := os.Open(nmeaLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sentences []NMEASentence
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var sentence NMEASentence
+		if err := json.Unmarshal(scanner.Bytes(), &sentence); err != nil {
+			continue // a torn line from a power cut
+		}
+		if sentence.Time.Before(start) || sentence.Time.After(end) {
+			continue
+		}
+		sentences = append(sentences, sentence)
+	}
+	return sentences, scanner.Err()
+}
+
+// writeNMEA writes the sentences of rows as the receiver sent them, each
+// ended by CR LF as NMEA 0183 specifies
+func writeNMEA(w io.Writer, rows []interface{}) error {
+	for _, row := range rows {
+		if sentence, ok := row.(NMEASentence); ok {
+			if _, err := io.WriteString(w, strings.TrimRight(sentence.Sentence, "\r\n")+"\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
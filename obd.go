@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sambarnes/elmobd"
+)
+
+// dtcInterval is how often the vehicle's stored trouble codes are read
+const dtcInterval = time.Minute
+
+// TroubleCodes is the content of a "trouble-codes" event, logged whenever the
+// vehicle's stored diagnostic trouble codes change
+type TroubleCodes struct {
+	Time  time.Time `json:"time"`
+	Codes []string  `json:"codes"`
+}
+
+// FreezeFrame is the content of a "freeze-frame" event: the readings the
+// vehicle saved when Code was set, logged when new trouble codes appear
+type FreezeFrame struct {
+	Time     time.Time `json:"time"`
+	Code     string    `json:"code"`
+	Readings []Reading `json:"readings"`
+}
+
+// obdValue returns the numeric value of an OBD command result, or 0 if the
+// command failed or its value isn't numeric
+func obdValue(cmd elmobd.OBDCommand) float64 {
+	if cmd == nil {
+		return 0
+	}
+	value, err := strconv.ParseFloat(cmd.ValueAsLit(), 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// obdLiteral returns the formatted value of an OBD command result, or "n/a" if
+// the command failed
+func obdLiteral(cmd elmobd.OBDCommand) string {
+	if cmd == nil {
+		return "n/a"
+	}
+	return cmd.ValueAsLit()
+}
+
+// obdReadings are the readings of every OBD sample, in record order
+var obdReadings = []struct {
+	name    string
+	units   string
+	command func() elmobd.OBDCommand
+}{
+	{"Runtime Since Start", "sec", func() elmobd.OBDCommand { return elmobd.NewRuntimeSinceStart() }},
+	{"Vehicle Speed", "km/h", func() elmobd.OBDCommand { return elmobd.NewVehicleSpeed() }},
+	{"Engine RPM", "", func() elmobd.OBDCommand { return elmobd.NewEngineRPM() }},
+	{"Throttle Position", "%", func() elmobd.OBDCommand { return elmobd.NewThrottlePosition() }},
+	{"Fuel Pressure", "kPa", func() elmobd.OBDCommand { return elmobd.NewFuelPressure() }},
+	{"Timing Advance", "deg before TDC", func() elmobd.OBDCommand { return elmobd.NewTimingAdvance() }},
+	{"Coolant Temp", "C", func() elmobd.OBDCommand { return elmobd.NewCoolantTemperature() }},
+	{"Engine Load", "%", func() elmobd.OBDCommand { return elmobd.NewEngineLoad() }},
+	{"Intake Manifold Pressure", "kPa", func() elmobd.OBDCommand { return elmobd.NewIntakeManifoldPressure() }},
+	{"MAF Air Flow Rate", "grams/sec", func() elmobd.OBDCommand { return elmobd.NewMafAirFlowRate() }},
+	{"Short Term Fuel Trim 1", "%", func() elmobd.OBDCommand { return elmobd.NewShortFuelTrim1() }},
+	{"Short Term Fuel Trim 2", "%", func() elmobd.OBDCommand { return elmobd.NewShortFuelTrim2() }},
+	{"Long Term Fuel Trim 1", "%", func() elmobd.OBDCommand { return elmobd.NewLongFuelTrim1() }},
+	{"Long Term Fuel Trim 2", "%", func() elmobd.OBDCommand { return elmobd.NewLongFuelTrim2() }},
+	{"Ambient Air Temp", "C", func() elmobd.OBDCommand { return elmobd.NewAmbientTemperature() }},
+	{"Control Module Voltage", "V", func() elmobd.OBDCommand { return elmobd.NewControlModuleVoltage() }},
+}
+
+// Indexes into obdReadings of the readings the recorder acts on
+const (
+	obdSpeed    = 1
+	obdRPM      = 2
+	obdThrottle = 3
+	obdVoltage  = 15
+)
+
+// obdCommands returns a command for each of obdReadings, reused from sample
+// to sample
+func obdCommands() []elmobd.OBDCommand {
+	cmds := make([]elmobd.OBDCommand, len(obdReadings))
+	for i, reading := range obdReadings {
+		cmds[i] = reading.command()
+	}
+	return cmds
+}
+
+// OBDDevice is the vehicle's OBD adapter. It is configured once at startup
+// and opened again each time the OBD recording task restarts.
+type OBDDevice interface {
+	Open(cmds []elmobd.OBDCommand) (obdReader, error)
+}
+
+// serialOBD is an ELM327 adapter on a serial device
+type serialOBD struct {
+	path    string
+	timeout time.Duration
+}
+
+// NewSerialOBD returns the ELM327 adapter at path, simulated if there is no
+// device there when it is opened. A request the adapter doesn't answer within
+// timeout fails the sample.
+func NewSerialOBD(path string, timeout time.Duration) OBDDevice {
+	return &serialOBD{path: path, timeout: timeout}
+}
+
+// Open connects to the adapter to sample cmds
+func (dev *serialOBD) Open(cmds []elmobd.OBDCommand) (obdReader, error) {
+	return openOBD(dev.path, cmds, dev.timeout)
+}
+
+// openOBD opens the ELM327 adapter at path to sample cmds, or the simulated
+// adapter if there is no device there
+func openOBD(path string, cmds []elmobd.OBDCommand, timeout time.Duration) (obdReader, error) {
+	if _, err := os.Stat(path); err == nil {
+		return openELM327(path, cmds, timeout)
+	}
+	fmt.Println("No OBD adapter at", path, "simulating one")
+	dev, err := elmobd.NewTestDevice(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new device: %v", err)
+	}
+	return &elmobdReader{dev: dev}, nil
+}
+
+// obdErrorCounts counts the commands the vehicle failed to answer since
+// startup, by reading and error, e.g. "Vehicle Speed: no data", for diagnostics
+type obdErrorCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// add counts the errors of a sample's commands, one for each of obdReadings
+func (c *obdErrorCounts) add(errs []error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if c.counts == nil {
+			c.counts = make(map[string]int)
+		}
+		c.counts[obdReadings[i].name+": "+err.Error()]++
+	}
+}
+
+// snapshot returns a copy of the counts
+func (c *obdErrorCounts) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for key, n := range c.counts {
+		counts[key] = n
+	}
+	return counts
+}
+
+// checkTroubleCodes reads the vehicle's stored trouble codes and, if they
+// differ from last, logs and anchors them, alerting on any new code. It
+// returns the codes now stored.
+func (vehicle *Vehicle) checkTroubleCodes(dev obdReader, last []string) []string {
+	codes, err := dev.troubleCodes()
+	if err != nil {
+		fmt.Println("Failed to read trouble codes", err)
+		return last
+	}
+	if strings.Join(codes, ",") == strings.Join(last, ",") {
+		return last
+	}
+	var added []string
+	for _, code := range codes {
+		if !contains(last, code) {
+			added = append(added, code)
+		}
+	}
+	if len(added) > 0 {
+		vehicle.raiseAlert("trouble-codes", "new trouble codes "+strings.Join(added, ", "),
+			map[string]interface{}{"codes": added})
+	}
+	event := TroubleCodes{Time: time.Now().UTC(), Codes: codes}
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("trouble-codes", toEventData(event)), true); err != nil {
+		fmt.Println("Failed to log trouble codes", err)
+	}
+	if len(added) > 0 {
+		vehicle.logFreezeFrame(dev)
+	}
+	return codes
+}
+
+// logFreezeFrame reads the vehicle's freeze frame and logs and anchors it, so
+// the conditions a code was set under are on record before any dispute
+func (vehicle *Vehicle) logFreezeFrame(dev obdReader) {
+	code, results, err := dev.freezeFrame(obdCommands())
+	if err != nil {
+		fmt.Println("Failed to read freeze frame", err)
+		return
+	}
+	if code == "" {
+		return
+	}
+	frame := FreezeFrame{Time: time.Now().UTC(), Code: code, Readings: []Reading{}}
+	for i, reading := range obdReadings {
+		if results[i] != nil {
+			frame.Readings = append(frame.Readings, Reading{Name: reading.name, Value: obdLiteral(results[i]), Units: reading.units})
+		}
+	}
+	if _, err := vehicle.LogEvent(vehicle.NewEvent("freeze-frame", toEventData(frame)), true); err != nil {
+		fmt.Println("Failed to log freeze frame", err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sambarnes/elmobd"
+)
+
+// Odometer attestation settings
+const (
+	odometerInterval   = 24 * time.Hour
+	odometerRetryWait  = 10 * time.Minute // after a failed attestation
+	odometerStatePath  = "odometer.json"
+	odometerMaxFixGap  = time.Minute // longer gaps between fixes are not counted into GPS distance
+	odometerMinGPSKm   = 10.0        // GPS distance needed before the odometer is compared with it
+	odometerMinGPSRate = 0.5         // the odometer must advance at least this share of the GPS distance
+)
+
+// OdometerReading is the content of an anchored "odometer" event. Any reading
+// lower than one anchored before it is evidence the odometer was rolled back.
+type OdometerReading struct {
+	Time               time.Time `json:"time"`
+	OdometerKm         *float64  `json:"odometerKm,omitempty"`         // PID A6, on vehicles reporting it
+	DistanceSinceClear *float64  `json:"distanceSinceClear,omitempty"` // PID 31, km since trouble codes were cleared
+	GPSKm              float64   `json:"gpsKm"`                        // GPS distance accumulated since attestation began
+}
+
+// odometerState is what attestation keeps between runs
+type odometerState struct {
+	Last    *OdometerReading `json:"last"`
+	GPSKm   float64          `json:"gpsKm"`
+	Tracked time.Time        `json:"tracked"` // track log counted into GPSKm up to here
+
+	attempted time.Time // last attestation, successful or not
+}
+
+// odometerCommands returns the OBD commands of an odometer reading
+func odometerCommands() []elmobd.OBDCommand {
+	return []elmobd.OBDCommand{elmobd.NewOdometer(), elmobd.NewDistSinceDTCClear()}
+}
+
+func loadOdometerState() (*odometerState, error) {
+	state := new(odometerState)
+	data, err := ioutil.ReadFile(odometerStatePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return state, json.Unmarshal(data, state)
+}
+
+func (state *odometerState) save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(odometerStatePath, data)
+}
+
+// due reports whether a day has passed since the last attestation, and the
+// retry wait since the last attempt
+func (state *odometerState) due() bool {
+	if time.Since(state.attempted) < odometerRetryWait {
+		return false
+	}
+	return state.Last == nil || time.Since(state.Last.Time) >= odometerInterval
+}
+
+// trackKm returns the distance between the real fixes of the track log logged
+// between from and to
+func trackKm(from, to time.Time) (float64, error) {
+	track, err := readTrack(from, to)
+	if err != nil {
+		return 0, err
+	}
+	var meters float64
+	var last *Fix
+	for i := range track {
+		fix := &track[i]
+		if fix.Estimated {
+			continue
+		}
+		if last != nil && fix.Time.Sub(last.Time) <= odometerMaxFixGap {
+			meters += distanceMeters(last.Lat, last.Lon, fix.Lat, fix.Lon)
+		}
+		last = fix
+	}
+	return meters / 1000, nil
+}
+
+// attestOdometer reads the odometer, adds the GPS distance driven since the
+// last attestation and anchors both as a signed "odometer" event, alerting if
+// the odometer went back or advanced much less than the vehicle moved
+func (vehicle *Vehicle) attestOdometer(dev obdReader, cmds []elmobd.OBDCommand, state *odometerState) error {
+	state.attempted = time.Now()
+	results, errs, err := dev.sample(cmds)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if !state.Tracked.IsZero() {
+		km, err := trackKm(state.Tracked, now)
+		if err != nil {
+			return err
+		}
+		state.GPSKm += km
+	}
+	state.Tracked = now
+
+	reading := &OdometerReading{Time: now, GPSKm: state.GPSKm}
+	if results[0] != nil {
+		km := obdValue(results[0])
+		reading.OdometerKm = &km
+	} else {
+		fmt.Println("Odometer not read:", errs[0])
+	}
+	if results[1] != nil {
+		km := obdValue(results[1])
+		reading.DistanceSinceClear = &km
+	} else {
+		fmt.Println("Distance since codes cleared not read:", errs[1])
+	}
+	if last := state.Last; last != nil && last.OdometerKm != nil && reading.OdometerKm != nil {
+		driven, moved := *reading.OdometerKm-*last.OdometerKm, reading.GPSKm-last.GPSKm
+		switch {
+		case driven < 0:
+			vehicle.raiseAlert("odometer-rollback", fmt.Sprintf("odometer went back from %.0f km to %.0f km", *last.OdometerKm, *reading.OdometerKm),
+				map[string]interface{}{"from": *last.OdometerKm, "to": *reading.OdometerKm})
+		case moved >= odometerMinGPSKm && driven < moved*odometerMinGPSRate:
+			vehicle.raiseAlert("odometer-mismatch", fmt.Sprintf("odometer advanced %.0f km while GPS logged %.0f km", driven, moved),
+				map[string]interface{}{"odometerKm": driven, "gpsKm": moved})
+		}
+	}
+
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("odometer", toEventData(reading)), true)
+	if err != nil {
+		return err
+	}
+	state.Last = reading
+	if err := state.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Odometer reading secured to factom. TxID: %s\n", txID)
+	return nil
+}
+
+// OdometerHistory is the anchored odometer readings of a vehicle's chain
+type OdometerHistory struct {
+	Readings  []*OdometerReading
+	Keys      []string // hex key that signed each reading
+	Rollbacks []int    // indexes of readings lower than one before them
+}
+
+// odometerHistory returns the odometer readings anchored on vin's chain,
+// oldest first, with a valid signature
+func odometerHistory(store *Store, vin string) (*OdometerHistory, error) {
+	entries, err := store.ChainEntries(vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindEvent && e.EventType == "odometer" && e.Verified
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := new(OdometerHistory)
+	highest := -1.0
+	for _, entry := range entries {
+		var event struct {
+			Data OdometerReading `json:"data"`
+		}
+		if err := json.Unmarshal(entry.Event, &event); err != nil {
+			continue
+		}
+		reading := event.Data
+		if reading.OdometerKm != nil {
+			if *reading.OdometerKm < highest {
+				history.Rollbacks = append(history.Rollbacks, len(history.Readings))
+			} else {
+				highest = *reading.OdometerKm
+			}
+		}
+		history.Readings = append(history.Readings, &reading)
+		history.Keys = append(history.Keys, entry.SigningKey)
+	}
+	return history, nil
+}
+
+// odometerCommand prints the odometer readings anchored on a vehicle's chain
+// and fails if any is lower than one anchored before it, so a buyer can check
+// for rollback fraud from the chain alone
+func odometerCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("odometer", flag.ExitOnError)
+	vin := flags.String("vin", vehicle.vin, "Vehicle whose chain to check")
+	offline := flags.Bool("offline", false, "Use the local chain index without syncing it")
+	flags.Parse(args)
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if !*offline {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, *vin); err != nil {
+			fmt.Println("Failed to sync the chain index, use -offline to skip", err)
+			os.Exit(1)
+		}
+	}
+	history, err := odometerHistory(store, *vin)
+	if err != nil {
+		fmt.Println("Failed to query the chain index", err)
+		os.Exit(1)
+	}
+	rollback := make(map[int]bool, len(history.Rollbacks))
+	for _, i := range history.Rollbacks {
+		rollback[i] = true
+	}
+	for i, reading := range history.Readings {
+		odometer := "n/a"
+		if reading.OdometerKm != nil {
+			odometer = fmt.Sprintf("%.0f km", *reading.OdometerKm)
+		}
+		mark := ""
+		if rollback[i] {
+			mark = "  ROLLBACK"
+		}
+		fmt.Printf("%s  odometer %s  GPS %.0f km  signed by %.16s%s\n",
+			reading.Time.Local().Format("2006-01-02 15:04"), odometer, reading.GPSKm, history.Keys[i], mark)
+	}
+	if len(history.Rollbacks) > 0 {
+		fmt.Printf("FAILED: %d readings are lower than one anchored before them\n", len(history.Rollbacks))
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d readings, the odometer never went back\n", len(history.Readings))
+}
@@ -0,0 +1,1223 @@
+package main
+
+import "net/http"
+
+// handleOpenAPI serves the API's OpenAPI description, which the clients under
+// clients/ are written against
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+// openAPISpec describes the local HTTP API. Keep it in step with api.go,
+// auth.go, dashboard.go and chainindex.go.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Blackbox device API",
+    "version": "1.0.0",
+    "description": "Local HTTP API of the blackbox recorder: status, live telemetry, recording control, anchoring and verification of evidence on the Factom chain. Once an API token is issued every operation requires a bearer token granting the operation's x-scope; 401 and 403 answers carry an Error. A token issued to a recipient only reaches operations whose x-data categories the owner's consent policy shares with that recipient, and positions are left out of status and telemetry unless location is shared. Requests are rate limited per client, answering 429 with Retry-After, and every request is written to the device's anchored audit log."
+  },
+  "security": [{"token": []}],
+  "paths": {
+    "/status": {
+      "get": {
+        "operationId": "getStatus",
+        "summary": "Current recorder state",
+        "x-scope": "read-telemetry",
+        "x-data": ["telemetry"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}}
+        }
+      }
+    },
+    "/telemetry": {
+      "get": {
+        "operationId": "getTelemetry",
+        "summary": "Latest OBD sample and position",
+        "x-scope": "read-telemetry",
+        "x-data": ["telemetry"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Telemetry"}}}}
+        }
+      }
+    },
+    "/recording/start": {
+      "post": {
+        "operationId": "startRecording",
+        "summary": "Resume OBD recording",
+        "x-scope": "control-recording",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RecordingState"}}}}
+        }
+      }
+    },
+    "/recording/stop": {
+      "post": {
+        "operationId": "stopRecording",
+        "summary": "Pause OBD recording",
+        "x-scope": "control-recording",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RecordingState"}}}}
+        }
+      }
+    },
+    "/privacy/start": {
+      "post": {
+        "operationId": "startPrivacyMode",
+        "summary": "Suspend capturing the location, anchoring a signed marker; OBD recording carries on",
+        "x-scope": "control-recording",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PrivacyMode"}}}}
+        }
+      }
+    },
+    "/privacy/stop": {
+      "post": {
+        "operationId": "stopPrivacyMode",
+        "summary": "Resume capturing the location, anchoring a signed marker of how long privacy mode lasted",
+        "x-scope": "control-recording",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PrivacyMode"}}}}
+        }
+      }
+    },
+    "/trouble-codes": {
+      "get": {
+        "operationId": "getTroubleCodes",
+        "summary": "Diagnostic trouble codes stored as of the last time they were read",
+        "x-scope": "read-telemetry",
+        "x-data": ["trouble-codes"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"troubleCodes": {"type": "array", "items": {"type": "string"}}}}}}},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/anchors": {
+      "get": {
+        "operationId": "listAnchors",
+        "summary": "Most recently anchored entries, oldest first",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Anchor"}}}}}
+        }
+      }
+    },
+    "/verify": {
+      "post": {
+        "operationId": "verify",
+        "summary": "Check a local file, by path or by the hash it was anchored with, against the chain",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VerifyRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VerifyResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries": {
+      "get": {
+        "operationId": "listEntries",
+        "summary": "Query the local index of a vehicle's chain",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "parameters": [
+          {"$ref": "#/components/parameters/vin"},
+          {"$ref": "#/components/parameters/from"},
+          {"$ref": "#/components/parameters/to"},
+          {"name": "kind", "in": "query", "schema": {"type": "string", "enum": ["hash", "event", "other"]}},
+          {"name": "type", "in": "query", "description": "Event type", "schema": {"type": "string"}},
+          {"name": "stream", "in": "query", "description": "Stream of hash entries, e.g. obd, video, incident", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/sync"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Entries"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/incidents": {
+      "get": {
+        "operationId": "listIncidents",
+        "summary": "Anchored incident records",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "parameters": [
+          {"$ref": "#/components/parameters/vin"},
+          {"$ref": "#/components/parameters/from"},
+          {"$ref": "#/components/parameters/to"},
+          {"$ref": "#/components/parameters/sync"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Entries"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/transfers": {
+      "get": {
+        "operationId": "listTransfers",
+        "summary": "Ownership transfer events",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "parameters": [
+          {"$ref": "#/components/parameters/vin"},
+          {"$ref": "#/components/parameters/from"},
+          {"$ref": "#/components/parameters/to"},
+          {"$ref": "#/components/parameters/sync"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Entries"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/dashboard": {
+      "get": {
+        "operationId": "getDashboard",
+        "summary": "Everything shown on the owner's dashboard",
+        "x-scope": "read-telemetry",
+        "x-data": ["telemetry"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Dashboard"}}}}
+        }
+      }
+    },
+    "/evidence": {
+      "get": {
+        "operationId": "exportEvidence",
+        "summary": "Evidence recorded in a time range, with proofs and VERIFY.txt, as a tar.gz",
+        "x-scope": "export-evidence",
+        "x-data": ["telemetry", "location", "video", "trouble-codes"],
+        "parameters": [
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "redact", "in": "query", "description": "Comma separated fields to redact from telemetry files, e.g. position,Vehicle Speed, and video to withhold footage. Redacted files stay verifiable line by line against their entries. Redacting position leaves location out of x-data, and video video.", "schema": {"type": "string"}},
+          {"name": "audience", "in": "query", "description": "Seal the tar.gz to the key this registered audience published on its identity chain, by default the token's recipient if it is one. Open it with blackbox audience open.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/gzip": {"schema": {"type": "string", "format": "binary"}}, "application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/export": {
+      "get": {
+        "operationId": "exportData",
+        "summary": "Telemetry, trips, daily usage-based insurance aggregates or raw GPS sentences recorded in a time range as CSV, JSON lines, Parquet, ASAM MDF 4 or Torque Pro's CSV layout for telemetry, or the original NMEA sentences, with the file's hash anchored before it is sent",
+        "x-scope": "export-evidence",
+        "parameters": [
+          {"name": "dataset", "in": "query", "required": true, "description": "Discloses the x-data telemetry and location, trips, scores for ubi, or location for nmea", "schema": {"type": "string", "enum": ["telemetry", "trips", "ubi", "nmea"]}},
+          {"name": "format", "in": "query", "description": "Default csv, mf4 and torque only for telemetry, nmea only for nmea", "schema": {"type": "string", "enum": ["csv", "json", "parquet", "mf4", "nmea", "torque"]}},
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "OK",
+            "headers": {
+              "X-Blackbox-Hash": {"description": "Hex SHA-256 of the file", "schema": {"type": "string"}},
+              "X-Blackbox-TxID": {"description": "Transaction anchoring the hash", "schema": {"type": "string"}},
+              "X-Blackbox-Rows": {"description": "Rows in the file", "schema": {"type": "integer"}}
+            },
+            "content": {
+              "text/csv": {"schema": {"type": "string"}},
+              "application/x-ndjson": {"schema": {"type": "string"}},
+              "text/plain": {"schema": {"type": "string"}},
+              "application/vnd.apache.parquet": {"schema": {"type": "string", "format": "binary"}},
+              "application/octet-stream": {"schema": {"type": "string", "format": "binary"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/transfer": {
+      "post": {
+        "operationId": "initiateTransfer",
+        "summary": "Sign and anchor a transfer event offering the vehicle to a new owner",
+        "x-scope": "transfer-ownership",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransferResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/driver": {
+      "post": {
+        "operationId": "assignDriver",
+        "summary": "Authenticate a driver by PIN or NFC tag and assign them to the vehicle until the trip ends",
+        "x-scope": "assign-driver",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DriverRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DriverResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/scores": {
+      "get": {
+        "operationId": "listScores",
+        "summary": "Anchored driving scores of trips and months starting in a time range",
+        "x-scope": "read-telemetry",
+        "x-data": ["scores"],
+        "parameters": [
+          {"name": "period", "in": "query", "description": "Default both", "schema": {"type": "string", "enum": ["trip", "month"]}},
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/DrivingScore"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/trips": {
+      "get": {
+        "operationId": "listTrips",
+        "summary": "Anchored trip summaries starting in a time range, with the purpose they were tagged with",
+        "x-scope": "read-telemetry",
+        "x-data": ["trips"],
+        "parameters": [
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/TaggedTrip"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/trips/tag": {
+      "post": {
+        "operationId": "tagTrip",
+        "summary": "Tag a trip, identified by its start, as business, personal, medical or charity in a signed, anchored event",
+        "x-scope": "tag-trips",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TripTag"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/mileage": {
+      "get": {
+        "operationId": "mileageReport",
+        "summary": "IRS or HMRC style mileage report of the trips starting in a time range, with the file's hash anchored before it is sent",
+        "x-scope": "export-evidence",
+        "x-data": ["trips"],
+        "parameters": [
+          {"name": "style", "in": "query", "required": true, "schema": {"type": "string", "enum": ["irs", "hmrc"]}},
+          {"name": "format", "in": "query", "description": "Default csv", "schema": {"type": "string", "enum": ["csv", "json"]}},
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "OK",
+            "headers": {
+              "X-Blackbox-Hash": {"description": "Hex SHA-256 of the file", "schema": {"type": "string"}},
+              "X-Blackbox-TxID": {"description": "Transaction anchoring the hash", "schema": {"type": "string"}},
+              "X-Blackbox-Rows": {"description": "Trips in the report", "schema": {"type": "integer"}}
+            },
+            "content": {
+              "text/csv": {"schema": {"type": "string"}},
+              "application/json": {"schema": {"type": "object"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hos": {
+      "get": {
+        "operationId": "getHOSStatus",
+        "summary": "The driver's hours-of-service duty status, hours left and today's records",
+        "x-scope": "read-telemetry",
+        "x-data": ["hours-of-service"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HOSStatus"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hos/status": {
+      "post": {
+        "operationId": "setDutyStatus",
+        "summary": "Set the driver's duty status in a signed, anchored record. Driving is only recorded from motion.",
+        "x-scope": "duty-status",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DutyStatusRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hos/edit": {
+      "post": {
+        "operationId": "editDutyStatus",
+        "summary": "Change the status of a duty record with an annotation. The record is kept, the edit is anchored and an amended daily log is anchored for days already logged.",
+        "x-scope": "duty-status",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DutyEditRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hos/logs": {
+      "get": {
+        "operationId": "listDailyLogs",
+        "summary": "Latest anchored hours-of-service daily logs of the days in a time range",
+        "x-scope": "read-telemetry",
+        "x-data": ["hours-of-service"],
+        "parameters": [
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/DailyLog"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/fuel": {
+      "get": {
+        "operationId": "listFuelPurchases",
+        "summary": "Anchored fuel purchases made in a time range",
+        "x-scope": "read-telemetry",
+        "x-data": ["fuel"],
+        "parameters": [
+          {"name": "from", "in": "query", "description": "Start of the range, default two hours ago", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "description": "End of the range, default now", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/FuelPurchase"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/fuel/record": {
+      "post": {
+        "operationId": "recordFuelPurchase",
+        "summary": "Record a fuel purchase for IFTA reports in a signed, anchored event, optionally with the hash of its receipt",
+        "x-scope": "record-fuel",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/FuelPurchase"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/ifta": {
+      "get": {
+        "operationId": "iftaReport",
+        "summary": "Quarterly IFTA report of miles per jurisdiction from GPS and fuel purchases, with the file's hash anchored before it is sent",
+        "x-scope": "export-evidence",
+        "x-data": ["fuel"],
+        "parameters": [
+          {"name": "quarter", "in": "query", "description": "e.g. 2025Q3, default the last quarter", "schema": {"type": "string"}},
+          {"name": "format", "in": "query", "description": "Default csv", "schema": {"type": "string", "enum": ["csv", "json"]}}
+        ],
+        "responses": {
+          "200": {
+            "description": "OK",
+            "headers": {
+              "X-Blackbox-Hash": {"description": "Hex SHA-256 of the file", "schema": {"type": "string"}},
+              "X-Blackbox-TxID": {"description": "Transaction anchoring the hash", "schema": {"type": "string"}},
+              "X-Blackbox-Rows": {"description": "Jurisdictions in the report", "schema": {"type": "integer"}}
+            },
+            "content": {
+              "text/csv": {"schema": {"type": "string"}},
+              "application/json": {"schema": {"type": "object"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/leases": {
+      "get": {
+        "operationId": "listLeases",
+        "summary": "Anchored leases with their monthly mileage statements",
+        "x-scope": "read-telemetry",
+        "x-data": ["contracts"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/LeaseStatus"}}}}}
+        }
+      }
+    },
+    "/leases/anchor": {
+      "post": {
+        "operationId": "anchorLease",
+        "summary": "Verify the lessor's and lessee's signatures of lease terms and anchor them in a signed event. A mileage statement against the allowance is anchored after every month of the term.",
+        "x-scope": "anchor-lease",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SignedLease"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/policies": {
+      "get": {
+        "operationId": "listPolicies",
+        "summary": "Insurance policy bindings written to the vehicle's chain by insurers, and whether the owner countersigned them, as of the last chain index sync",
+        "x-scope": "read-telemetry",
+        "x-data": ["contracts"],
+        "parameters": [
+          {"name": "at", "in": "query", "description": "Only the countersigned policies covering this time", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PolicyCoverage"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/policies/countersign": {
+      "post": {
+        "operationId": "countersignPolicy",
+        "summary": "Countersign an insurer's policy binding with the owner's key in an anchored event",
+        "x-scope": "countersign-policy",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "object", "required": ["entry"], "properties": {"entry": {"type": "string", "description": "hash of the binding entry"}}}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"txID": {"type": "string"}}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/credentials": {
+      "get": {
+        "operationId": "listCredentials",
+        "summary": "W3C Verifiable Credentials issued of the vehicle's registration, ownership and transfers, as VC-JWTs signed by the owner",
+        "x-scope": "read-telemetry",
+        "x-data": ["anchors"],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/IssuedCredential"}}}}}
+        }
+      }
+    },
+    "/credentials/issue": {
+      "post": {
+        "operationId": "issueCredential",
+        "summary": "Issue a Verifiable Credential of a fact on the vehicle's chain, as of the last chain index sync, signed by the owner's did:key with its hash anchored",
+        "x-scope": "transfer-ownership",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "object", "required": ["type"], "properties": {
+            "type": {"type": "string", "enum": ["registration", "ownership", "transfer"]},
+            "entry": {"type": "string", "description": "hash of the transfer event entry, default the latest transfer"}
+          }}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssuedCredential"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/1.0/identifiers/{did}": {
+      "get": {
+        "operationId": "resolveDID",
+        "summary": "Resolve a did:blackbox of a person's or vehicle's identity chain, or a VIN, to its DID document, as a universal resolver driver does",
+        "x-scope": "read-telemetry",
+        "parameters": [{"name": "did", "in": "path", "required": true, "schema": {"type": "string"}, "description": "did:blackbox:<chain ID> or a VIN"}],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/ld+json;profile=\"https://w3id.org/did-resolution\"": {"schema": {"$ref": "#/components/schemas/DIDResolution"}}}},
+          "400": {"description": "Not a did:blackbox", "content": {"application/ld+json;profile=\"https://w3id.org/did-resolution\"": {"schema": {"$ref": "#/components/schemas/DIDResolution"}}}},
+          "404": {"description": "No identity chain", "content": {"application/ld+json;profile=\"https://w3id.org/did-resolution\"": {"schema": {"$ref": "#/components/schemas/DIDResolution"}}}},
+          "502": {"description": "The chain couldn't be read", "content": {"application/ld+json;profile=\"https://w3id.org/did-resolution\"": {"schema": {"$ref": "#/components/schemas/DIDResolution"}}}}
+        }
+      }
+    },
+    "/tokens": {
+      "get": {
+        "operationId": "listTokens",
+        "summary": "Issued API tokens, without their secrets",
+        "x-scope": "manage-keys",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/APIToken"}}}}}
+        }
+      },
+      "post": {
+        "operationId": "issueToken",
+        "summary": "Issue an API token, its secret is only returned here. The first token is issued with the api-token command.",
+        "x-scope": "manage-keys",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TokenRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssuedToken"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tokens/{id}": {
+      "delete": {
+        "operationId": "revokeToken",
+        "summary": "Revoke an API token",
+        "x-scope": "manage-keys",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"ok": {"type": "boolean"}}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/debug/dump": {
+      "get": {
+        "operationId": "getDiagnostics",
+        "summary": "Goroutine stacks, queue depths and memory statistics. Served, with pprof and expvar under /debug/, only when the API has debug enabled.",
+        "x-scope": "diagnostics",
+        "parameters": [
+          {"name": "stacks", "in": "query", "schema": {"type": "string", "enum": ["0", "1"]}, "description": "0 to leave out goroutine stacks"}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Diagnostics"}}}}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document",
+        "security": [],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer", "description": "API token from the api-token command or POST /tokens"}
+    },
+    "parameters": {
+      "vin": {"name": "vin", "in": "query", "description": "Vehicle to query, default the device's", "schema": {"type": "string", "minLength": 17, "maxLength": 17}},
+      "from": {"name": "from", "in": "query", "description": "Earliest block time, default the chain's start", "schema": {"type": "string", "format": "date-time"}},
+      "to": {"name": "to", "in": "query", "description": "Latest block time, default now", "schema": {"type": "string", "format": "date-time"}},
+      "sync": {"name": "sync", "in": "query", "description": "1 to sync the index with the chain before answering", "schema": {"type": "string", "enum": ["1"]}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Entries": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/IndexedEntry"}}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      },
+      "Status": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "chainID": {"type": "string"},
+          "recording": {"type": "boolean"},
+          "segment": {"$ref": "#/components/schemas/Segment"},
+          "storage": {"type": "string", "enum": ["normal", "low", "critical", "emergency"]},
+          "timeSource": {"type": "string"},
+          "timeConfidence": {"type": "string"},
+          "pendingAnchors": {"type": "integer"},
+          "backlog": {"type": "string", "enum": ["normal", "behind", "shedding"]},
+          "droppedSamples": {"type": "integer", "format": "int64"},
+          "thermal": {"type": "string", "enum": ["normal", "warm", "throttled"]},
+          "temperatureC": {"type": "number"},
+          "driver": {"type": "string"},
+          "privacyMode": {"type": "boolean"},
+          "position": {"type": "object", "additionalProperties": true},
+          "alerts": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/Alert"}},
+          "tasks": {"type": "array", "items": {"$ref": "#/components/schemas/TaskStatus"}}
+        }
+      },
+      "TaskStatus": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "running": {"type": "boolean"},
+          "restarts": {"type": "integer"},
+          "lastError": {"type": "string"},
+          "failed": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Diagnostics": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "goroutines": {"type": "integer"},
+          "queues": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/QueueDepth"}},
+          "memory": {"$ref": "#/components/schemas/MemoryStats"},
+          "obdErrors": {"type": "object", "additionalProperties": {"type": "integer"}, "description": "failed OBD commands since startup, keyed reading: error"},
+          "tasks": {"type": "array", "items": {"$ref": "#/components/schemas/TaskStatus"}},
+          "stacks": {"type": "string"}
+        }
+      },
+      "QueueDepth": {
+        "type": "object",
+        "properties": {
+          "length": {"type": "integer"},
+          "capacity": {"type": "integer"}
+        }
+      },
+      "MemoryStats": {
+        "type": "object",
+        "properties": {
+          "heapAlloc": {"type": "integer", "format": "int64"},
+          "heapSys": {"type": "integer", "format": "int64"},
+          "heapObjects": {"type": "integer", "format": "int64"},
+          "sys": {"type": "integer", "format": "int64"},
+          "totalAlloc": {"type": "integer", "format": "int64"},
+          "numGC": {"type": "integer"},
+          "pauseTotalNs": {"type": "integer", "format": "int64"}
+        }
+      },
+      "Segment": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "seq": {"type": "integer", "format": "int64"},
+          "stream": {"type": "string"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "header": {"type": "string"},
+          "path": {"type": "string"},
+          "records": {"type": "integer"},
+          "hash": {"type": "string"},
+          "txID": {"type": "string"},
+          "compression": {"type": "string"},
+          "entryHash": {"type": "string"},
+          "uploadURL": {"type": "string"},
+          "uploadedAt": {"type": "string", "format": "date-time"},
+          "pruned": {"type": "boolean"},
+          "driver": {"type": "string", "description": "hex identity key of the driver assigned when the segment started"},
+          "clockUncertain": {"type": "boolean", "description": "recorded before the clock was synced or across a step of it, timestamps may be wrong"}
+        }
+      },
+      "Alert": {
+        "type": "object",
+        "properties": {
+          "kind": {"type": "string"},
+          "message": {"type": "string"},
+          "time": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Telemetry": {
+        "type": "object",
+        "properties": {
+          "record": {"$ref": "#/components/schemas/OBDRecord"},
+          "position": {"type": "object", "additionalProperties": true}
+        }
+      },
+      "OBDRecord": {
+        "type": "object",
+        "nullable": true,
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "position": {"type": "string"},
+          "readings": {"type": "array", "items": {"$ref": "#/components/schemas/Reading"}}
+        }
+      },
+      "Reading": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "value": {"type": "string", "description": "n/a when the PID did not answer"},
+          "units": {"type": "string"},
+          "error": {"type": "string", "description": "why the PID did not answer, e.g. no data or not supported"}
+        }
+      },
+      "RecordingState": {
+        "type": "object",
+        "properties": {"recording": {"type": "boolean"}}
+      },
+      "PrivacyMode": {
+        "type": "object",
+        "properties": {
+          "active": {"type": "boolean"},
+          "since": {"type": "string", "format": "date-time"},
+          "source": {"type": "string", "enum": ["button", "api", "grpc", "schedule"]}
+        }
+      },
+      "Anchor": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "txID": {"type": "string"},
+          "kind": {"type": "string", "description": "hash, a stream, or event:<type>"},
+          "hash": {"type": "string"}
+        }
+      },
+      "VerifyRequest": {
+        "type": "object",
+        "description": "Name either a local path or the hex SHA-256 the file was anchored with",
+        "properties": {
+          "path": {"type": "string"},
+          "hash": {"type": "string"}
+        }
+      },
+      "VerifyResult": {
+        "type": "object",
+        "properties": {
+          "verified": {"type": "boolean"},
+          "entryHash": {"type": "string"},
+          "blockHeight": {"type": "integer", "format": "int64"},
+          "blockTime": {"type": "string", "format": "date-time"},
+          "signingKey": {"type": "string", "format": "byte"},
+          "entryBlockKeyMR": {"type": "string"},
+          "entrySequence": {"type": "integer", "format": "int64"},
+          "entryPosition": {"type": "integer"},
+          "duplicates": {"type": "integer", "description": "later entries by the owner anchoring the same hash, e.g. replays; the location is the earliest's"},
+          "malformed": {"type": "array", "items": {"$ref": "#/components/schemas/MalformedEntry"}, "description": "entries shaped like hash entries but breaking their schema, skipped"}
+        }
+      },
+      "MalformedEntry": {
+        "type": "object",
+        "properties": {
+          "entryHash": {"type": "string"},
+          "reason": {"type": "string", "description": "e.g. a signature of the wrong length or an unknown schema version"}
+        }
+      },
+      "IndexedEntry": {
+        "type": "object",
+        "properties": {
+          "entryHash": {"type": "string"},
+          "blockHeight": {"type": "integer", "format": "int64"},
+          "blockTime": {"type": "string", "format": "date-time"},
+          "entryBlockKeyMR": {"type": "string"},
+          "entrySequence": {"type": "integer", "format": "int64"},
+          "entryPosition": {"type": "integer"},
+          "kind": {"type": "string", "enum": ["hash", "event", "other"]},
+          "eventType": {"type": "string"},
+          "stream": {"type": "string"},
+          "hash": {"type": "string"},
+          "hashes": {"type": "array", "items": {"type": "string"}},
+          "event": {"type": "object", "additionalProperties": true},
+          "signingKey": {"type": "string"},
+          "verified": {"type": "boolean"},
+          "signedByOwner": {"type": "boolean"},
+          "driver": {"type": "string", "description": "hex identity key of the driver countersigning a hash entry"},
+          "driverVerified": {"type": "boolean"},
+          "clockUncertain": {"type": "boolean", "description": "the hashed data was timestamped while the recorder's clock was uncertain"}
+        }
+      },
+      "TripSummary": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "duration": {"type": "number", "description": "seconds"},
+          "distance": {"type": "number", "description": "km"},
+          "maxSpeed": {"type": "number", "description": "km/h"},
+          "harshEvents": {"type": "integer"},
+          "speeding": {"type": "number", "description": "seconds above the scoring speed limit"},
+          "driver": {"type": "string"},
+          "driverKey": {"type": "string"}
+        }
+      },
+      "TaggedTrip": {
+        "allOf": [
+          {"$ref": "#/components/schemas/TripSummary"},
+          {
+            "type": "object",
+            "properties": {
+              "purpose": {"type": "string", "enum": ["business", "personal", "medical", "charity"]},
+              "note": {"type": "string"},
+              "entryHash": {"type": "string", "description": "hash of the chain entry anchoring the trip summary"}
+            }
+          }
+        ]
+      },
+      "TripTag": {
+        "type": "object",
+        "required": ["trip", "purpose"],
+        "properties": {
+          "trip": {"type": "string", "format": "date-time", "description": "start of the trip, as listed by listTrips"},
+          "purpose": {"type": "string", "enum": ["business", "personal", "medical", "charity"]},
+          "note": {"type": "string"}
+        }
+      },
+      "DutyRecord": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "status": {"type": "string", "enum": ["off-duty", "sleeper", "driving", "on-duty"]},
+          "origin": {"type": "string", "enum": ["auto", "driver"]},
+          "driver": {"type": "string"},
+          "driverKey": {"type": "string"},
+          "location": {"type": "string"},
+          "note": {"type": "string"},
+          "edited": {"type": "boolean"}
+        }
+      },
+      "DutyEdit": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "record": {"type": "string", "format": "date-time"},
+          "from": {"type": "string"},
+          "status": {"type": "string"},
+          "annotation": {"type": "string"},
+          "editor": {"type": "string"}
+        }
+      },
+      "HOSViolation": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "limit": {"type": "string", "enum": ["drive", "window", "cycle"]},
+          "hours": {"type": "number"}
+        }
+      },
+      "DailyLog": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "date": {"type": "string", "format": "date"},
+          "records": {"type": "array", "items": {"$ref": "#/components/schemas/DutyRecord"}},
+          "edits": {"type": "array", "items": {"$ref": "#/components/schemas/DutyEdit"}},
+          "hours": {"type": "object", "additionalProperties": {"type": "number"}, "description": "hours per duty status"},
+          "violations": {"type": "array", "items": {"$ref": "#/components/schemas/HOSViolation"}},
+          "amended": {"type": "boolean"},
+          "created": {"type": "string", "format": "date-time"}
+        }
+      },
+      "HOSStatus": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["off-duty", "sleeper", "driving", "on-duty"]},
+          "since": {"type": "string", "format": "date-time"},
+          "driver": {"type": "string"},
+          "driveLeft": {"type": "number", "description": "hours"},
+          "windowLeft": {"type": "number", "description": "hours"},
+          "cycleLeft": {"type": "number", "description": "hours"},
+          "today": {"type": "array", "items": {"$ref": "#/components/schemas/DutyRecord"}}
+        }
+      },
+      "DutyStatusRequest": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"type": "string", "enum": ["off-duty", "sleeper", "on-duty"]},
+          "note": {"type": "string"}
+        }
+      },
+      "DutyEditRequest": {
+        "type": "object",
+        "required": ["record", "status", "annotation"],
+        "properties": {
+          "record": {"type": "string", "format": "date-time", "description": "time of the record to edit"},
+          "status": {"type": "string", "enum": ["off-duty", "sleeper", "on-duty"]},
+          "annotation": {"type": "string", "minLength": 4}
+        }
+      },
+      "FuelPurchase": {
+        "type": "object",
+        "required": ["gallons"],
+        "properties": {
+          "time": {"type": "string", "format": "date-time", "description": "default now"},
+          "jurisdiction": {"type": "string", "description": "state or province code, default the one the vehicle is in"},
+          "gallons": {"type": "number"},
+          "fuel": {"type": "string"},
+          "vendor": {"type": "string"},
+          "invoice": {"type": "string"},
+          "amount": {"type": "number", "description": "total paid"},
+          "receiptHash": {"type": "string", "description": "hex SHA-256 of the receipt image or PDF"},
+          "entryHash": {"type": "string", "readOnly": true, "description": "chain entry anchoring the purchase"}
+        }
+      },
+      "LeaseTerms": {
+        "type": "object",
+        "required": ["id", "vin", "contractHash", "lessor", "lessee", "start", "end", "allowanceKm"],
+        "properties": {
+          "id": {"type": "string", "description": "the lessor's contract number"},
+          "vin": {"type": "string"},
+          "contractHash": {"type": "string", "description": "hex SHA-256 of the signed contract document"},
+          "lessor": {"type": "string", "description": "hex ed25519 public key"},
+          "lessee": {"type": "string", "description": "hex ed25519 public key"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "allowanceKm": {"type": "number", "description": "over the whole term"},
+          "excessPerKm": {"type": "number", "description": "charged for each km over the allowance"},
+          "currency": {"type": "string"}
+        }
+      },
+      "SignedLease": {
+        "type": "object",
+        "required": ["terms", "lessorSig", "lesseeSig"],
+        "properties": {
+          "terms": {"$ref": "#/components/schemas/LeaseTerms"},
+          "lessorSig": {"type": "string", "description": "hex ed25519 signature of the JSON encoding of terms"},
+          "lesseeSig": {"type": "string", "description": "hex ed25519 signature of the JSON encoding of terms"},
+          "entryHash": {"type": "string", "readOnly": true, "description": "chain entry anchoring the lease"}
+        }
+      },
+      "LeaseStatement": {
+        "type": "object",
+        "properties": {
+          "lease": {"type": "string", "description": "ID of the lease"},
+          "leaseEntry": {"type": "string", "description": "chain entry anchoring the lease"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "drivenKm": {"type": "number", "description": "anchored trip distance in the month"},
+          "totalKm": {"type": "number", "description": "since the lease started"},
+          "allowedKm": {"type": "number", "description": "the allowance pro rata up to end"},
+          "overKm": {"type": "number", "description": "totalKm - allowedKm, negative while under"},
+          "projectedKm": {"type": "number", "description": "at the end of the term at the pace so far"},
+          "excessCost": {"type": "number"},
+          "final": {"type": "boolean"}
+        }
+      },
+      "LeaseStatus": {
+        "type": "object",
+        "properties": {
+          "lease": {"$ref": "#/components/schemas/SignedLease"},
+          "statements": {"type": "array", "items": {"$ref": "#/components/schemas/LeaseStatement"}}
+        }
+      },
+      "IssuedCredential": {
+        "type": "object",
+        "properties": {
+          "kind": {"type": "string", "enum": ["registration", "ownership", "transfer"]},
+          "id": {"type": "string", "description": "urn:uuid of the credential"},
+          "jwt": {"type": "string", "description": "the credential as a compact JWT signed with EdDSA, its vc claim holding the W3C credential"},
+          "hash": {"type": "string", "description": "hex SHA-256 of jwt, anchored on the vehicle's chain"},
+          "txID": {"type": "string"},
+          "issued": {"type": "string", "format": "date-time"}
+        }
+      },
+      "DIDResolution": {
+        "type": "object",
+        "properties": {
+          "didDocument": {
+            "type": "object",
+            "nullable": true,
+            "properties": {
+              "@context": {"type": "array", "items": {"type": "string"}},
+              "id": {"type": "string"},
+              "alsoKnownAs": {"type": "array", "items": {"type": "string"}, "description": "urn:vin of a vehicle, did:key of a person"},
+              "controller": {"type": "string", "description": "DID of the vehicle's owner"},
+              "verificationMethod": {"type": "array", "items": {"type": "object", "properties": {
+                "id": {"type": "string"},
+                "type": {"type": "string", "enum": ["Ed25519VerificationKey2020", "X25519KeyAgreementKey2020"]},
+                "controller": {"type": "string"},
+                "publicKeyMultibase": {"type": "string"}
+              }}},
+              "authentication": {"type": "array", "items": {"type": "string"}},
+              "assertionMethod": {"type": "array", "items": {"type": "string"}},
+              "keyAgreement": {"type": "array", "items": {"type": "string"}, "description": "audience keys"},
+              "service": {"type": "array", "items": {"type": "object", "properties": {
+                "id": {"type": "string"},
+                "type": {"type": "string"},
+                "serviceEndpoint": {"type": "string"}
+              }}}
+            }
+          },
+          "didResolutionMetadata": {"type": "object", "properties": {
+            "contentType": {"type": "string"},
+            "error": {"type": "string", "enum": ["invalidDid", "notFound", "internalError"]},
+            "message": {"type": "string"}
+          }},
+          "didDocumentMetadata": {"type": "object", "properties": {
+            "created": {"type": "string", "format": "date-time", "description": "block time of the chain's first entry"},
+            "updated": {"type": "string", "format": "date-time", "description": "block time of the last entry changing the document"},
+            "versionId": {"type": "string", "description": "hash of that entry"},
+            "chainHead": {"type": "string"}
+          }}
+        }
+      },
+      "PolicyCoverage": {
+        "type": "object",
+        "properties": {
+          "entry": {"type": "string", "description": "hash of the insurer's binding entry"},
+          "bound": {"type": "string", "format": "date-time", "description": "block time of the binding entry"},
+          "insurerKey": {"type": "string", "description": "hex public key that signed the binding"},
+          "binding": {
+            "type": "object",
+            "properties": {
+              "insurer": {"type": "string"},
+              "policyHash": {"type": "string", "description": "hex SHA-256 of the policy ID, a colon and the VIN"},
+              "start": {"type": "string", "format": "date-time"},
+              "end": {"type": "string", "format": "date-time"}
+            }
+          },
+          "countersigned": {"type": "boolean"},
+          "countersignEntry": {"type": "string"}
+        }
+      },
+      "DrivingScore": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "period": {"type": "string", "enum": ["trip", "month"]},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "trips": {"type": "integer"},
+          "distance": {"type": "number", "description": "km"},
+          "speedingRatio": {"type": "number", "description": "share of driving time above the speed limit"},
+          "harshPer100Km": {"type": "number"},
+          "nightShare": {"type": "number", "description": "share of distance driven at night"},
+          "score": {"type": "number", "description": "0 to 100, higher is safer"},
+          "driver": {"type": "string"}
+        }
+      },
+      "StorageUsage": {
+        "type": "object",
+        "properties": {
+          "freeBytes": {"type": "integer", "format": "int64"},
+          "evidenceBytes": {"type": "integer", "format": "int64"}
+        }
+      },
+      "TransferRequest": {
+        "type": "object",
+        "required": ["newOwner"],
+        "properties": {"newOwner": {"type": "string", "description": "hex ed25519 public key of the new owner"}}
+      },
+      "TransferResult": {
+        "type": "object",
+        "properties": {"txID": {"type": "string"}}
+      },
+      "DriverRequest": {
+        "type": "object",
+        "properties": {
+          "driver": {"type": "string", "description": "name of the driver, with pin"},
+          "pin": {"type": "string"},
+          "nfc": {"type": "string", "description": "UID of the driver's NFC tag"}
+        }
+      },
+      "DriverAssignment": {
+        "type": "object",
+        "properties": {
+          "vin": {"type": "string"},
+          "driver": {"type": "string"},
+          "key": {"type": "string", "description": "hex ed25519 identity key of the driver"},
+          "method": {"type": "string", "enum": ["pin", "nfc", "ble"]},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "DriverResult": {
+        "type": "object",
+        "properties": {
+          "assignment": {"$ref": "#/components/schemas/DriverAssignment"},
+          "txID": {"type": "string"}
+        }
+      },
+      "Scope": {"type": "string", "enum": ["read-telemetry", "control-recording", "export-evidence", "manage-keys", "transfer-ownership", "diagnostics", "assign-driver", "tag-trips", "duty-status", "record-fuel", "anchor-lease", "countersign-policy"]},
+      "APIToken": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "hash": {"type": "string", "description": "hex SHA-256 of the secret"},
+          "scopes": {"type": "array", "items": {"$ref": "#/components/schemas/Scope"}},
+          "created": {"type": "string", "format": "date-time"},
+          "recipient": {"type": "string", "description": "who the token was issued to, limiting it to the data the consent policy shares with them; absent for the owner's tokens"}
+        }
+      },
+      "TokenRequest": {
+        "type": "object",
+        "required": ["scopes"],
+        "properties": {
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"$ref": "#/components/schemas/Scope"}},
+          "recipient": {"type": "string"}
+        }
+      },
+      "IssuedToken": {
+        "allOf": [
+          {"$ref": "#/components/schemas/APIToken"},
+          {"type": "object", "properties": {"token": {"type": "string", "description": "the secret, send as Authorization: Bearer <token>"}}}
+        ]
+      },
+      "Dashboard": {
+        "type": "object",
+        "properties": {
+          "status": {"$ref": "#/components/schemas/Status"},
+          "telemetry": {"$ref": "#/components/schemas/Telemetry"},
+          "trips": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/TripSummary"}},
+          "anchors": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/Anchor"}},
+          "ecBalance": {"type": "integer", "format": "int64"},
+          "storage": {"$ref": "#/components/schemas/StorageUsage"},
+          "vehicle": {"$ref": "#/components/schemas/VehicleInfo"},
+          "recalls": {"type": "array", "items": {"$ref": "#/components/schemas/Recall"}}
+        }
+      },
+      "VehicleInfo": {
+        "type": "object",
+        "description": "The VIN decoded by NHTSA vPIC",
+        "properties": {
+          "vin": {"type": "string"},
+          "make": {"type": "string"},
+          "model": {"type": "string"},
+          "year": {"type": "string"},
+          "trim": {"type": "string"},
+          "bodyClass": {"type": "string"}
+        }
+      },
+      "Recall": {
+        "type": "object",
+        "properties": {
+          "campaign": {"type": "string", "description": "NHTSA campaign number"},
+          "component": {"type": "string"},
+          "summary": {"type": "string"},
+          "consequence": {"type": "string"},
+          "remedy": {"type": "string"},
+          "reported": {"type": "string"},
+          "seen": {"type": "string", "format": "date-time"}
+        }
+      }
+    }
+  }
+}
+`
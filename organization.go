@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// Membership actions written to an organization's chain
+const (
+	MembershipEnroll = "enroll"
+	MembershipRetire = "retire"
+)
+
+// OrgConfig makes the device's vehicle one of an organization's,
+// signing and paying for its entries with the organization's address
+type OrgConfig struct {
+	Name  string `json:"name"`
+	ECKey string `json:"ecKey"` // private EC address of the organization
+}
+
+// Organization is an identity, e.g. a fleet operator, owning many vehicles
+// and paying for all their anchoring from one funded address. Vehicles are
+// enrolled and retired by signed entries on its identity chain, so the
+// vehicles it owns can be listed from chain data alone.
+type Organization struct {
+	name      string
+	ecAddress *factom.ECAddress // signs memberships and every enrolled vehicle's entries, and pays for them
+	chainID   string            // identity chain holding enrollments and retirements
+	owner     *Person           // owner of the enrolled vehicles, with the organization's address
+	vehicles  []*Vehicle        // enrolled, as of the last enroll, retire or sync
+}
+
+// Membership is a vehicle joining or leaving an organization, the content of
+// a membership entry
+type Membership struct {
+	Action string    `json:"action"`
+	VIN    string    `json:"vin"`
+	Time   time.Time `json:"time"`
+}
+
+// EnrolledVehicle is a vehicle of an organization as read from its chain
+type EnrolledVehicle struct {
+	VIN      string    `json:"vin"`
+	ChainID  string    `json:"chainID"`
+	Enrolled time.Time `json:"enrolled"` // block time of the latest enrollment
+}
+
+// NewOrganization creates an organization using ecAddress as payment and
+// identity, with its chains on chain
+func NewOrganization(name string, ecAddress *factom.ECAddress, chain ChainClient) *Organization {
+	return &Organization{
+		name:      name,
+		ecAddress: ecAddress,
+		chainID:   constructChainID([][]byte{[]byte("Organization Identity Chain"), ecAddress.PubBytes()}),
+		owner:     NewPerson(ecAddress, chain),
+	}
+}
+
+// RegistrationState returns the state of the organization's chain like
+// Person.RegistrationState
+func (org *Organization) RegistrationState() (ChainState, error) {
+	return chainState(org.owner.chain, org.chainID)
+}
+
+// Register will try to create a factom chain for the organization and return
+// the txID, "" if it exists. It is safe to call again, see registerChain.
+// ExtIDs = [0]:"Organization Identity Chain", [1]:public key in binary
+func (org *Organization) Register() (string, error) {
+	chainEntry := factom.Entry{}
+	chainEntry.ExtIDs = [][]byte{[]byte("Organization Identity Chain"), org.ecAddress.PubBytes()}
+	chainEntry.Content = []byte(org.name)
+	return registerChainPaid(org.owner.chain, factom.NewChain(&chainEntry), org.ecAddress)
+}
+
+// Enroll makes vehicle one of the organization's, registering its chain if
+// needed, and returns the txID of the enrollment. From then on the vehicle's
+// entries are signed and paid for by the organization.
+func (org *Organization) Enroll(vehicle *Vehicle) (string, error) {
+	if org.enrolled(vehicle.vin) >= 0 {
+		return "", fmt.Errorf("%s is already enrolled in %s", vehicle.vin, org.name)
+	}
+	vehicle.owner = org.owner
+	if _, err := vehicle.Register(org.ecAddress); err != nil {
+		return "", err
+	}
+	txID, err := org.logMembership(MembershipEnroll, vehicle.vin)
+	if err != nil {
+		return "", err
+	}
+	org.vehicles = append(org.vehicles, vehicle)
+	return txID, nil
+}
+
+// Retire removes the vehicle with vin from the organization and returns the
+// txID of the retirement. Its chain and the evidence on it are kept.
+func (org *Organization) Retire(vin string) (string, error) {
+	i := org.enrolled(vin)
+	if i < 0 {
+		return "", fmt.Errorf("%s is not enrolled in %s", vin, org.name)
+	}
+	txID, err := org.logMembership(MembershipRetire, vin)
+	if err != nil {
+		return "", err
+	}
+	org.vehicles = append(org.vehicles[:i], org.vehicles[i+1:]...)
+	return txID, nil
+}
+
+// enrolled returns the index of vin in the organization's vehicles, -1 if it
+// isn't one of them
+func (org *Organization) enrolled(vin string) int {
+	for i, vehicle := range org.vehicles {
+		if vehicle.vin == vin {
+			return i
+		}
+	}
+	return -1
+}
+
+// logMembership signs and anchors a membership entry on the organization's
+// chain and returns the txID
+// ExtIDs = [0]:signature, [1]:public key, [2]:"membership", [3]:action
+func (org *Organization) logMembership(action, vin string) (string, error) {
+	content, err := json.Marshal(Membership{Action: action, VIN: vin, Time: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	signature := ed.Sign(org.ecAddress.Sec, content)
+	entry := &factom.Entry{
+		ChainID: org.chainID,
+		ExtIDs:  [][]byte{signature[:], org.ecAddress.PubBytes(), []byte("membership"), []byte(action)},
+		Content: content,
+	}
+	txID, err := commitRevealEntry(org.owner.chain, defaultRetry, entry, org.ecAddress)
+	if err != nil {
+		return "", err
+	}
+	appendAudit("org-"+action, map[string]interface{}{"org": org.chainID, "vin": vin, "txID": txID})
+	return txID, nil
+}
+
+// membership returns the membership an entry of the organization's chain
+// records, nil if it isn't a membership entry signed by the organization
+func (org *Organization) membership(entry *factom.Entry) *Membership {
+	ext := entry.ExtIDs
+	if len(ext) != 4 || string(ext[2]) != "membership" || len(ext[0]) != ed.SignatureSize || entrySize(entry) > maxEntrySize {
+		return nil
+	}
+	if !bytes.Equal(ext[1], org.ecAddress.PubBytes()) {
+		return nil
+	}
+	var signature [ed.SignatureSize]byte
+	copy(signature[:], ext[0])
+	if !ed.Verify(org.ecAddress.PubFixed(), entry.Content, &signature) {
+		return nil
+	}
+	var membership Membership
+	if err := json.Unmarshal(entry.Content, &membership); err != nil || membership.Action != string(ext[3]) {
+		return nil
+	}
+	return &membership
+}
+
+// ListVehicles replays the organization's chain and returns the vehicles
+// enrolled and not since retired, by VIN
+func (org *Organization) ListVehicles(reader chainReader) ([]EnrolledVehicle, error) {
+	keyMR, err := reader.chainHead(org.chainID)
+	if err != nil {
+		return nil, err
+	}
+	// entry blocks are walked newest first, so the first membership seen of
+	// each vehicle is its current one, unless a later entry replays an older
+	// membership, which its signed time gives away
+	type current struct {
+		membership *Membership
+		enrolled   time.Time
+	}
+	latest := make(map[string]current)
+	walked := make(map[string]bool)
+	for keyMR != "" && keyMR != zeroHash {
+		if walked[keyMR] {
+			return nil, fmt.Errorf("entry block %s links back to itself", keyMR)
+		}
+		walked[keyMR] = true
+		eblock, err := reader.entryBlock(keyMR)
+		if err != nil {
+			return nil, err
+		} else if eblock == nil {
+			return nil, fmt.Errorf("entry block %s not found", keyMR)
+		}
+		for i := len(eblock.EntryList) - 1; i >= 0; i-- {
+			entry, err := reader.entry(eblock.EntryList[i].EntryHash)
+			if err != nil {
+				return nil, err
+			} else if entry == nil {
+				return nil, fmt.Errorf("entry %s not found", eblock.EntryList[i].EntryHash)
+			}
+			membership := org.membership(entry)
+			if membership == nil {
+				continue
+			}
+			if seen, ok := latest[membership.VIN]; ok && !membership.Time.After(seen.membership.Time) {
+				continue
+			}
+			latest[membership.VIN] = current{membership, time.Unix(eblock.Header.Timestamp, 0).UTC()}
+		}
+		keyMR = eblock.Header.PrevKeyMR
+	}
+	var vehicles []EnrolledVehicle
+	for vin, c := range latest {
+		if c.membership.Action == MembershipEnroll {
+			vehicles = append(vehicles, EnrolledVehicle{VIN: vin, ChainID: vehicleChainID(vin), Enrolled: c.enrolled})
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool { return vehicles[i].VIN < vehicles[j].VIN })
+	return vehicles, nil
+}
+
+// SyncVehicles replaces the organization's vehicles with those its chain lists
+func (org *Organization) SyncVehicles(reader chainReader) error {
+	enrolled, err := org.ListVehicles(reader)
+	if err != nil {
+		return err
+	}
+	org.vehicles = org.vehicles[:0]
+	for _, e := range enrolled {
+		vehicle, err := NewVehicle(e.VIN, org.owner.chain)
+		if err != nil {
+			continue
+		}
+		vehicle.owner = org.owner
+		org.vehicles = append(org.vehicles, vehicle)
+	}
+	return nil
+}
+
+// Balance returns the entry credits left to pay for the organization's vehicles
+func (org *Organization) Balance() (int64, error) {
+	return org.owner.chain.ecBalance(org.ecAddress.String())
+}
+
+// openOrganization returns the organization configured with its chains on
+// chain, nil if there is none
+func (config *Config) openOrganization(chain ChainClient) (*Organization, error) {
+	if config.Organization == nil {
+		return nil, nil
+	}
+	ecAddress, err := factom.GetECAddress(config.Organization.ECKey)
+	if err != nil {
+		return nil, fmt.Errorf("organization: %v", err)
+	}
+	return NewOrganization(config.Organization.Name, ecAddress, chain), nil
+}
+
+// orgCommand manages the configured organization's vehicles:
+//
+//	blackbox org register
+//	blackbox org enroll <vin>...
+//	blackbox org retire <vin>...
+//	blackbox org list [-json]
+func orgCommand(config *Config, args []string) {
+	org, err := config.openOrganization(factomdClient{})
+	if err == nil && org == nil {
+		err = errors.New("no organization configured")
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox org register|enroll|retire|list")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "register":
+		txID, err := org.Register()
+		if err != nil {
+			fmt.Println("Failed to register the organization", err)
+			os.Exit(1)
+		}
+		printRegistration(org.owner.chain, "Organization", org.chainID, txID)
+	case "enroll", "retire":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "usage: blackbox org %s <vin>...\n", args[0])
+			os.Exit(2)
+		}
+		if err := org.SyncVehicles(org.owner.chain); err != nil {
+			fmt.Println("Failed to read the organization's vehicles", err)
+			os.Exit(1)
+		}
+		done := map[string]string{"enroll": "enrolled", "retire": "retired"}[args[0]]
+		for _, vin := range args[1:] {
+			var txID string
+			if args[0] == "enroll" {
+				vehicle, err := NewVehicle(vin, org.owner.chain)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(2)
+				}
+				if config.NHTSA != nil {
+					// best effort, the vehicle enrolls without it
+					if vehicle.info, err = newNHTSAClient(config.NHTSA).decodeVIN(vin); err != nil {
+						fmt.Println("Failed to decode the VIN", err)
+					}
+				}
+				txID, err = org.Enroll(vehicle)
+			} else {
+				txID, err = org.Retire(vin)
+			}
+			if err != nil {
+				fmt.Printf("Failed to %s %s: %v\n", args[0], vin, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s %s. TxID: %s\n", vin, done, txID)
+		}
+	case "list":
+		flags := flag.NewFlagSet("org list", flag.ExitOnError)
+		asJSON := flags.Bool("json", false, "Print the vehicles as JSON")
+		flags.Parse(args[1:])
+		vehicles, err := org.ListVehicles(org.owner.chain)
+		if err != nil {
+			fmt.Println("Failed to read the organization's vehicles", err)
+			os.Exit(1)
+		}
+		if *asJSON {
+			out, _ := json.MarshalIndent(vehicles, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		for _, v := range vehicles {
+			fmt.Printf("%s  %s  enrolled %s\n", v.VIN, v.ChainID, v.Enrolled.Format(time.RFC3339))
+		}
+		if balance, err := org.Balance(); err == nil {
+			fmt.Printf("%d vehicles, %d entry credits at %s\n", len(vehicles), balance, org.ecAddress.String())
+		} else {
+			fmt.Printf("%d vehicles\n", len(vehicles))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown org command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+// testOrganization returns a registered organization with a new key, its
+// chains kept in memory, and runs the test in a directory of its own
+func testOrganization(t *testing.T) (*Organization, *memoryChain) {
+	t.Helper()
+	inTempDir(t)
+	chain := newMemoryChain()
+	org := NewOrganization("fleet", testOwner(t).ecAddress, chain)
+	if _, err := org.Register(); err != nil {
+		t.Fatal(err)
+	}
+	return org, chain
+}
+
+func TestListVehiclesLoops(t *testing.T) {
+	for _, loop := range chainLoops {
+		t.Run(loop.name, func(t *testing.T) {
+			org, chain := testOrganization(t)
+			if _, err := org.logMembership(MembershipEnroll, benchVIN); err != nil {
+				t.Fatal(err)
+			}
+			loopChain(chain, org.chainID, loop.link)
+
+			if _, err := org.ListVehicles(chain); err == nil {
+				t.Fatal("listed a looping chain without an error")
+			}
+		})
+	}
+}
+
+func TestListVehiclesReplayedEnrollment(t *testing.T) {
+	org, chain := testOrganization(t)
+	if _, err := org.logMembership(MembershipEnroll, benchVIN); err != nil {
+		t.Fatal(err)
+	}
+	chain.mu.Lock()
+	enrollment := chain.entries[chain.blocks[chain.heads[org.chainID]].EntryList[0].EntryHash]
+	chain.mu.Unlock()
+	if _, err := org.logMembership(MembershipRetire, benchVIN); err != nil {
+		t.Fatal(err)
+	}
+	// anyone can write the enrollment's bytes to the chain again
+	if _, err := commitRevealEntry(chain, defaultRetry, enrollment, org.ecAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	vehicles, err := org.ListVehicles(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vehicles) != 0 {
+		t.Errorf("a replayed enrollment re-enrolled %s", vehicles[0].VIN)
+	}
+}
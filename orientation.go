@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Orientation detection settings
+const (
+	orientationStatePath  = "orientation.json"
+	calibrationTime       = 2 * time.Second // averaged to find the mounting orientation
+	gravityFilterAlpha    = 0.05            // slow low-pass filter isolating gravity
+	rolloverTiltDeg       = 60.0            // tilt from the mounting orientation
+	rolloverRateDegPerS   = 60.0            // roll or pitch rate seen shortly before the tilt
+	rolloverRateWindow    = 2 * time.Second // how recent that rotation must be
+	reorientedTiltDeg     = 30.0            // tilt that means the device itself moved
+	reorientedHoldTime    = 5 * time.Second // how long the tilt must persist
+	orientationSavePeriod = 1 * time.Minute
+)
+
+// orientationState is the mounting orientation remembered across power cycles
+type orientationState struct {
+	Gravity [3]float64 `json:"gravity"` // g, in device axes
+	Time    time.Time  `json:"time"`    // last time the device was seen in this orientation
+}
+
+// OrientationEvent describes a rollover or a change in how the device is mounted
+type OrientationEvent struct {
+	Kind         string     `json:"kind"` // "rollover", "device-reoriented", or "device-reoriented-offline"
+	Time         time.Time  `json:"time"`
+	Tilt         float64    `json:"tilt"` // degrees from the previous mounting orientation
+	Gravity      [3]float64 `json:"gravity"`
+	OfflineSince *time.Time `json:"offlineSince,omitempty"`
+}
+
+// orientationMonitor tracks the gravity vector relative to the mounting orientation
+type orientationMonitor struct {
+	saved      *orientationState
+	calibrate  []IMUSample
+	baseline   [3]float64
+	gravity    [3]float64
+	ready      bool
+	lastRotate time.Time // last time the rotation rate exceeded rolloverRateDegPerS
+	tiltSince  time.Time // when the current tilt beyond reorientedTiltDeg began
+	rolledOver bool
+	lastSaved  time.Time
+}
+
+func newOrientationMonitor() *orientationMonitor {
+	m := &orientationMonitor{}
+	if data, err := ioutil.ReadFile(orientationStatePath); err == nil {
+		var saved orientationState
+		if json.Unmarshal(data, &saved) == nil {
+			m.saved = &saved
+		}
+	}
+	return m
+}
+
+// update feeds one sample and returns an orientation event if one occurred
+func (m *orientationMonitor) update(sample IMUSample) *OrientationEvent {
+	if !m.ready {
+		return m.calibrateWith(sample)
+	}
+	for axis := range m.gravity {
+		m.gravity[axis] += gravityFilterAlpha * (sample.Accel[axis] - m.gravity[axis])
+	}
+	if math.Abs(sample.Gyro[0]) >= rolloverRateDegPerS || math.Abs(sample.Gyro[1]) >= rolloverRateDegPerS {
+		m.lastRotate = sample.Time
+	}
+	m.save(sample.Time)
+
+	tilt := vectorAngle(m.baseline, m.gravity)
+	if tilt < reorientedTiltDeg {
+		m.tiltSince = time.Time{}
+		m.rolledOver = false
+		return nil
+	}
+	if m.rolledOver {
+		return nil
+	}
+	if tilt >= rolloverTiltDeg && sample.Time.Sub(m.lastRotate) <= rolloverRateWindow {
+		m.rolledOver = true
+		return &OrientationEvent{Kind: "rollover", Time: sample.Time, Tilt: tilt, Gravity: m.gravity}
+	}
+	if m.tiltSince.IsZero() {
+		m.tiltSince = sample.Time
+	}
+	if sample.Time.Sub(m.tiltSince) >= reorientedHoldTime {
+		// the device was moved, adopt its new orientation so we only report it once
+		event := &OrientationEvent{Kind: "device-reoriented", Time: sample.Time, Tilt: tilt, Gravity: m.gravity}
+		m.baseline = m.gravity
+		m.tiltSince = time.Time{}
+		return event
+	}
+	return nil
+}
+
+// calibrateWith averages samples until calibrationTime has passed, then compares
+// the result against the orientation saved before the last power off
+func (m *orientationMonitor) calibrateWith(sample IMUSample) *OrientationEvent {
+	m.calibrate = append(m.calibrate, sample)
+	if sample.Time.Sub(m.calibrate[0].Time) < calibrationTime {
+		return nil
+	}
+	for _, s := range m.calibrate {
+		for axis := range m.baseline {
+			m.baseline[axis] += s.Accel[axis] / float64(len(m.calibrate))
+		}
+	}
+	m.gravity = m.baseline
+	m.calibrate = nil
+	m.ready = true
+
+	if m.saved == nil {
+		return nil
+	}
+	tilt := vectorAngle(m.saved.Gravity, m.baseline)
+	if tilt < reorientedTiltDeg {
+		return nil
+	}
+	offlineSince := m.saved.Time
+	return &OrientationEvent{
+		Kind:         "device-reoriented-offline",
+		Time:         sample.Time,
+		Tilt:         tilt,
+		Gravity:      m.baseline,
+		OfflineSince: &offlineSince,
+	}
+}
+
+// save periodically persists the mounting orientation so a device that is moved
+// while powered off can be detected at the next start
+func (m *orientationMonitor) save(now time.Time) {
+	if now.Sub(m.lastSaved) < orientationSavePeriod {
+		return
+	}
+	m.lastSaved = now
+	data, err := json.Marshal(orientationState{Gravity: m.baseline, Time: now})
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(orientationStatePath, data, 0600); err != nil {
+		fmt.Println("Failed to save orientation", err)
+	}
+}
+
+// vectorAngle returns the angle between a and b in degrees
+func vectorAngle(a, b [3]float64) float64 {
+	var dot, la, lb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		la += a[i] * a[i]
+		lb += b[i] * b[i]
+	}
+	if la == 0 || lb == 0 {
+		return 0
+	}
+	cos := math.Max(-1, math.Min(1, dot/math.Sqrt(la*lb)))
+	return math.Acos(cos) * 180 / math.Pi
+}
+
+// handleOrientationEvent anchors a signed orientation event. A rollover also
+// locks the current OBD segment like any other incident.
+func (vehicle *Vehicle) handleOrientationEvent(event *OrientationEvent) {
+	fmt.Printf("Orientation event: %s (%.0f deg)\n", event.Kind, event.Tilt)
+	if event.Kind == "rollover" {
+		vehicle.recorder.boost(harshHighRateTime)
+		if segment := vehicle.recorder.segment(); segment != nil {
+			if err := lockSegment(segment.Path); err != nil {
+				fmt.Println("Failed to lock segment", err)
+			}
+		}
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent(event.Kind, toEventData(event)), true)
+	if err != nil {
+		fmt.Println("Failed to anchor orientation event", err)
+		return
+	}
+	fmt.Printf("Orientation event secured to factom. TxID: %s\n", txID)
+}
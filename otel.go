@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP export settings. Spans wait in memory between exports, and while the
+// endpoint can't be reached, up to otelMaxSpans.
+const (
+	otelDefaultInterval = 30 // seconds between exports
+	otelDefaultService  = "blackbox"
+	otelMaxSpans        = 4096
+	otelScope           = "github.com/sambarnes/blackbox"
+)
+
+// OTLP/HTTP paths and the enum values used, see opentelemetry-proto
+const (
+	otlpTracesPath   = "/v1/traces"
+	otlpMetricsPath  = "/v1/metrics"
+	otlpJSON         = "application/json"
+	otlpSpanInternal = 1
+	otlpStatusError  = 2
+	otlpCumulative   = 2
+)
+
+// otelLatencyBounds are the bucket bounds, in seconds, of the time from
+// closing a segment to anchoring it
+var otelLatencyBounds = []float64{1, 5, 15, 30, 60, 300, 900, 3600}
+
+// OTelConfig exports traces of the recording and anchoring pipeline and
+// metrics of the recorder over OTLP/HTTP, so fleet operators can plug devices
+// into an OpenTelemetry collector, or a backend taking OTLP directly such as
+// Grafana Tempo or Honeycomb
+type OTelConfig struct {
+	Endpoint string            `json:"endpoint"` // base URL, e.g. "https://api.honeycomb.io", "/v1/traces" and "/v1/metrics" are appended
+	Headers  map[string]string `json:"headers"`  // sent with every export, e.g. {"x-honeycomb-team": "<api key>"}
+	TLS      *TLSConfig        `json:"tls"`      // present a device certificate, trusting only TLS.CA for the endpoint
+	Interval int               `json:"interval"` // seconds between exports, default 30
+	Service  string            `json:"service"`  // service.name of the devices, default "blackbox"
+}
+
+// validate checks the endpoint is a URL and fills in defaults
+func (config *OTelConfig) validate() error {
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return fmt.Errorf("otel endpoint %q must be an http or https URL", config.Endpoint)
+	}
+	if config.Interval < 0 {
+		return fmt.Errorf("otel interval must not be negative")
+	}
+	if config.Interval == 0 {
+		config.Interval = otelDefaultInterval
+	}
+	if config.Service == "" {
+		config.Service = otelDefaultService
+	}
+	return nil
+}
+
+// otlpAttribute is a key and value in OTLP JSON, the value keyed by its type
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// attr returns an OTLP attribute of a string, integer, float or bool
+func attr(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case uint64:
+		v = map[string]interface{}{"intValue": strconv.FormatUint(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+// otlpTime is a time as OTLP JSON encodes it, nanoseconds since the epoch in a string
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpTraces is the body of an OTLP/HTTP traces export
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpPoint is a data point of a gauge, sum or histogram
+type otlpPoint struct {
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Start        string          `json:"startTimeUnixNano,omitempty"`
+	Time         string          `json:"timeUnixNano"`
+	AsInt        string          `json:"asInt,omitempty"`
+	AsDouble     *float64        `json:"asDouble,omitempty"`
+	Count        string          `json:"count,omitempty"`
+	Sum          *float64        `json:"sum,omitempty"`
+	BucketCounts []string        `json:"bucketCounts,omitempty"`
+	Bounds       []float64       `json:"explicitBounds,omitempty"`
+}
+
+type otlpPoints struct {
+	DataPoints  []otlpPoint `json:"dataPoints"`
+	Temporality int         `json:"aggregationTemporality,omitempty"`
+	Monotonic   bool        `json:"isMonotonic,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Unit        string      `json:"unit,omitempty"`
+	Gauge       *otlpPoints `json:"gauge,omitempty"`
+	Sum         *otlpPoints `json:"sum,omitempty"`
+	Histogram   *otlpPoints `json:"histogram,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+// otlpMetrics is the body of an OTLP/HTTP metrics export
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// segmentOutcome keys the count of segments leaving the pipeline
+type segmentOutcome struct {
+	stream, outcome string
+}
+
+// latencyHistogram counts segments by the time they took to be anchored
+type latencyHistogram struct {
+	buckets []uint64 // one more than otelLatencyBounds
+	count   uint64
+	sum     float64
+}
+
+// otelExporter turns the pipeline's results into spans and keeps the
+// counters of its metrics, sending both to the OTLP endpoint
+type otelExporter struct {
+	vehicle  *Vehicle
+	config   *OTelConfig
+	client   *http.Client
+	resource otlpResource
+	started  time.Time
+
+	mu       sync.Mutex
+	spans    []otlpSpan
+	records  uint64
+	segments map[segmentOutcome]uint64
+	latency  map[string]*latencyHistogram // by stream
+}
+
+// newOTelExporter returns an exporter of the vehicle's telemetry, not
+// following redirects outside the residency endpoints
+func (vehicle *Vehicle) newOTelExporter(config *OTelConfig, residency *ResidencyConfig) (*otelExporter, error) {
+	exporter := &otelExporter{
+		vehicle: vehicle,
+		config:  config,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		resource: otlpResource{Attributes: []otlpAttribute{
+			attr("service.name", config.Service),
+			attr("service.instance.id", vehicle.vin),
+			attr("vehicle.vin", vehicle.vin),
+			attr("blackbox.chain_id", vehicle.chainID),
+		}},
+		started:  time.Now(),
+		segments: make(map[segmentOutcome]uint64),
+		latency:  make(map[string]*latencyHistogram),
+	}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		exporter.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	residency.guard(exporter.client)
+	return exporter, nil
+}
+
+// spanID returns a random OTLP trace or span ID of n bytes
+func spanID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// collect counts stored records and turns segment results into traces until
+// the pipeline closes both channels
+func (exporter *otelExporter) collect(records <-chan Sample, results <-chan SegmentResult) {
+	for records != nil || results != nil {
+		select {
+		case _, ok := <-records:
+			if !ok {
+				records = nil
+				continue
+			}
+			exporter.mu.Lock()
+			exporter.records++
+			exporter.mu.Unlock()
+		case result, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			exporter.addResult(result)
+		}
+	}
+}
+
+// addResult records a segment's trace, count and latency
+func (exporter *otelExporter) addResult(result SegmentResult) {
+	spans := segmentSpans(result)
+	outcome := segmentOutcome{stream: result.Segment.Stream, outcome: "anchored"}
+	if result.Err != nil {
+		outcome.outcome = "failed"
+	}
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	if over := len(exporter.spans) - otelMaxSpans; over > 0 {
+		exporter.spans = append([]otlpSpan(nil), exporter.spans[over:]...)
+	}
+	exporter.segments[outcome]++
+	if result.Err != nil {
+		return
+	}
+	histogram := exporter.latency[outcome.stream]
+	if histogram == nil {
+		histogram = &latencyHistogram{buckets: make([]uint64, len(otelLatencyBounds)+1)}
+		exporter.latency[outcome.stream] = histogram
+	}
+	seconds := result.Took.Seconds()
+	histogram.buckets[sort.SearchFloat64s(otelLatencyBounds, seconds)]++
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// segmentSpans returns the trace of a segment through the pipeline: a
+// "segment" span from its start to its anchoring with a child per stage,
+// "record", "hash" and "anchor", ending in the one that failed, if any
+func segmentSpans(result SegmentResult) []otlpSpan {
+	segment := result.Segment
+	end := result.Closed.Add(result.Took)
+	start := segment.Start
+	if start.IsZero() || start.After(result.Closed) {
+		start = result.Closed
+	}
+	traceID := spanID(16)
+	root := otlpSpan{
+		TraceID: traceID,
+		SpanID:  spanID(8),
+		Name:    "segment",
+		Kind:    otlpSpanInternal,
+		Start:   otlpTime(start),
+		End:     otlpTime(end),
+		Attributes: []otlpAttribute{
+			attr("blackbox.stream", segment.Stream),
+			attr("blackbox.seq", segment.Seq),
+			attr("blackbox.records", segment.Records),
+			attr("blackbox.clock_uncertain", segment.ClockUncertain),
+		},
+	}
+	if segment.TxID != "" {
+		root.Attributes = append(root.Attributes, attr("blackbox.tx_id", segment.TxID))
+	}
+	child := func(name string, from, to time.Time) otlpSpan {
+		return otlpSpan{TraceID: traceID, SpanID: spanID(8), ParentSpanID: root.SpanID, Name: name,
+			Kind: otlpSpanInternal, Start: otlpTime(from), End: otlpTime(to)}
+	}
+	spans := []otlpSpan{root, child("record", start, result.Closed)}
+	if result.Hashed.IsZero() {
+		spans = append(spans, child("hash", result.Closed, end))
+	} else {
+		spans = append(spans, child("hash", result.Closed, result.Hashed), child("anchor", result.Hashed, end))
+	}
+	if result.Err != nil {
+		status := &otlpStatus{Code: otlpStatusError, Message: result.Err.Error()}
+		spans[0].Status, spans[len(spans)-1].Status = status, status
+	}
+	return spans
+}
+
+// metrics returns the recorder's metrics as of now: the pipeline's counters
+// since the exporter started and gauges of its queues and health
+func (exporter *otelExporter) metrics() []otlpMetric {
+	vehicle := exporter.vehicle
+	now, start := otlpTime(time.Now()), otlpTime(exporter.started)
+	gauge := func(name, unit, description string, value float64, attrs ...otlpAttribute) otlpMetric {
+		return otlpMetric{Name: name, Unit: unit, Description: description, Gauge: &otlpPoints{
+			DataPoints: []otlpPoint{{Attributes: attrs, Time: now, AsDouble: &value}},
+		}}
+	}
+	counter := func(name, unit, description string, points ...otlpPoint) otlpMetric {
+		for i := range points {
+			points[i].Start, points[i].Time = start, now
+		}
+		return otlpMetric{Name: name, Unit: unit, Description: description, Sum: &otlpPoints{
+			DataPoints: points, Temporality: otlpCumulative, Monotonic: true,
+		}}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metrics := []otlpMetric{
+		counter("blackbox.samples.dropped", "{sample}", "Samples shed while anchoring fell behind",
+			otlpPoint{AsInt: strconv.FormatUint(vehicle.backlog.droppedSamples(), 10)}),
+		gauge("blackbox.backlog.level", "1", "Anchoring backlog level, 0 when anchoring keeps up", float64(vehicle.backlog.get())),
+		gauge("blackbox.storage.level", "1", "Free space level, 0 when there is enough", float64(vehicle.storage.get())),
+		gauge("blackbox.storage.free", "By", "Free space on the data partition", float64(vehicle.storage.lastFree())),
+		gauge("blackbox.thermal.level", "1", "SoC temperature level, 0 when cool", float64(vehicle.thermal.get())),
+		gauge("blackbox.thermal.temperature", "Cel", "SoC temperature", vehicle.thermal.lastTemperature()),
+		gauge("process.runtime.go.goroutines", "{goroutine}", "Goroutines running", float64(runtime.NumGoroutine())),
+		gauge("process.runtime.go.mem.heap_alloc", "By", "Bytes of live heap objects", float64(mem.HeapAlloc)),
+	}
+
+	queues := otlpMetric{Name: "blackbox.queue.length", Unit: "{item}", Description: "Items waiting in the pipeline's queues", Gauge: &otlpPoints{}}
+	depths := vehicle.queueDepths()
+	names := make([]string, 0, len(depths))
+	for name := range depths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		length := float64(depths[name].Length)
+		queues.Gauge.DataPoints = append(queues.Gauge.DataPoints, otlpPoint{Attributes: []otlpAttribute{attr("queue", name)}, Time: now, AsDouble: &length})
+	}
+	if len(queues.Gauge.DataPoints) > 0 {
+		metrics = append(metrics, queues)
+	}
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	metrics = append(metrics, counter("blackbox.records.stored", "{record}", "Records stored by the pipeline",
+		otlpPoint{AsInt: strconv.FormatUint(exporter.records, 10)}))
+	var outcomes []otlpPoint
+	for key, count := range exporter.segments {
+		outcomes = append(outcomes, otlpPoint{
+			Attributes: []otlpAttribute{attr("stream", key.stream), attr("outcome", key.outcome)},
+			AsInt:      strconv.FormatUint(count, 10),
+		})
+	}
+	if len(outcomes) > 0 {
+		metrics = append(metrics, counter("blackbox.segments", "{segment}", "Segments leaving the pipeline, anchored or failed", outcomes...))
+	}
+	if len(exporter.latency) > 0 {
+		latency := otlpMetric{Name: "blackbox.segment.anchor_latency", Unit: "s", Description: "Time from closing a segment to anchoring it",
+			Histogram: &otlpPoints{Temporality: otlpCumulative}}
+		for stream, histogram := range exporter.latency {
+			buckets := make([]string, len(histogram.buckets))
+			for i, count := range histogram.buckets {
+				buckets[i] = strconv.FormatUint(count, 10)
+			}
+			sum := histogram.sum
+			latency.Histogram.DataPoints = append(latency.Histogram.DataPoints, otlpPoint{
+				Attributes: []otlpAttribute{attr("stream", stream)}, Start: start, Time: now,
+				Count: strconv.FormatUint(histogram.count, 10), Sum: &sum, BucketCounts: buckets, Bounds: otelLatencyBounds,
+			})
+		}
+		metrics = append(metrics, latency)
+	}
+	return metrics
+}
+
+// export sends the spans collected since the last export and the metrics as
+// of now. Spans that couldn't be sent are kept for the next export.
+func (exporter *otelExporter) export() error {
+	exporter.mu.Lock()
+	spans := exporter.spans
+	exporter.spans = nil
+	exporter.mu.Unlock()
+
+	if len(spans) > 0 {
+		traces := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+			Resource:   exporter.resource,
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: otelScope}, Spans: spans}},
+		}}}
+		if err := exporter.post(otlpTracesPath, traces); err != nil {
+			exporter.mu.Lock()
+			exporter.spans = append(spans, exporter.spans...)
+			if over := len(exporter.spans) - otelMaxSpans; over > 0 {
+				exporter.spans = exporter.spans[over:]
+			}
+			exporter.mu.Unlock()
+			return fmt.Errorf("exporting traces: %v", err)
+		}
+	}
+
+	metrics := otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     exporter.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: otelScope}, Metrics: exporter.metrics()}},
+	}}}
+	if err := exporter.post(otlpMetricsPath, metrics); err != nil {
+		return fmt.Errorf("exporting metrics: %v", err)
+	}
+	return nil
+}
+
+// post sends an OTLP JSON request to path under the endpoint
+func (exporter *otelExporter) post(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(exporter.config.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", otlpJSON)
+	req.Header.Set("User-Agent", "blackbox-otel")
+	for key, value := range exporter.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s replied %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Run exports every interval until stop is closed, then once more so the
+// last segments' traces aren't lost
+func (exporter *otelExporter) Run(stop <-chan struct{}) error {
+	interval := time.Duration(exporter.config.Interval) * time.Second
+	for sleep(interval, stop) {
+		if err := exporter.export(); err != nil {
+			fmt.Println("Failed OpenTelemetry export", err)
+		}
+	}
+	if err := exporter.export(); err != nil {
+		fmt.Println("Failed OpenTelemetry export", err)
+	}
+	return nil
+}
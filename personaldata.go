@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// purgeLogPath is the local log of driver data purges, one SignedPurge per
+// line, kept so what was deleted and when can be shown later
+const purgeLogPath = "purges.log"
+
+// drivingPeriod is a span of recording attributed to a driver
+type drivingPeriod struct {
+	start, end time.Time
+}
+
+// DriverDataExport is everything personal the device holds about a driver:
+// their profile without credentials, and the telemetry, positions and trips
+// recorded while they were assigned to the vehicle
+type DriverDataExport struct {
+	Driver    Driver               `json:"driver"`
+	Created   time.Time            `json:"created"`
+	Segments  []*Segment           `json:"segments"`           // recorded while assigned, their files under files/
+	Records   []*OBDRecord         `json:"records"`            // telemetry of those segments, with positions
+	Track     []Fix                `json:"track"`              // positions logged meanwhile
+	Locations []LocationCommitment `json:"locations"`          // preimages of hash-only locations recorded meanwhile
+	Trips     []*TripSummary       `json:"trips"`              // trips they drove
+	Retained  []string             `json:"retained,omitempty"` // what a purge keeps, and why
+}
+
+// DriverPurge documents the deletion of a driver's raw telemetry and location
+// data. Segments keep their hash and anchor, which are not personal, so what
+// was recorded can still be shown to have been deleted rather than forged.
+type DriverPurge struct {
+	VIN               string          `json:"vin"`
+	DriverKey         string          `json:"driverKey"` // hex identity key, the driver's name isn't kept
+	Time              time.Time       `json:"time"`
+	Segments          []PurgedSegment `json:"segments"`
+	Locked            []PurgedSegment `json:"locked,omitempty"` // kept, locked around incidents
+	TrackPoints       int             `json:"trackPoints"`
+	LocationPreimages int             `json:"locationPreimages"`
+	NMEASentences     int             `json:"nmeaSentences,omitempty"` // raw GPS sentences, if they were logged
+}
+
+// PurgedSegment is a segment whose records and file a purge deleted, or kept
+// because it is locked
+type PurgedSegment struct {
+	Stream    string    `json:"stream"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Hash      string    `json:"hash,omitempty"`
+	TxID      string    `json:"txID,omitempty"`
+	EntryHash string    `json:"entryHash,omitempty"`
+	Records   int       `json:"records"` // telemetry records deleted
+}
+
+// SignedPurge is a DriverPurge as written to the purge log, signed by the
+// owner like the event log
+type SignedPurge struct {
+	Purge     json.RawMessage `json:"purge"`     // the exact bytes that were signed
+	Signature string          `json:"signature"` // hex ed25519 signature of Purge
+	PubKey    string          `json:"pubkey"`    // hex public key of the signer
+}
+
+// driverSegments returns the segments recorded with the driver whose key is
+// given assigned, and the periods they span
+func (vehicle *Vehicle) driverSegments(key string) ([]*Segment, []drivingPeriod, error) {
+	if key == "" {
+		// segments recorded without a driver have none either
+		return nil, nil, errors.New("no driver key")
+	}
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	var theirs []*Segment
+	var periods []drivingPeriod
+	for _, segment := range segments {
+		if segment.Driver != key {
+			continue
+		}
+		end := segment.End
+		if end.IsZero() {
+			end = time.Now()
+		}
+		theirs = append(theirs, segment)
+		periods = append(periods, drivingPeriod{segment.Start, end})
+	}
+	return theirs, periods, nil
+}
+
+// during returns true if t falls in any of periods
+func during(periods []drivingPeriod, t time.Time) bool {
+	for _, p := range periods {
+		if !t.Before(p.start) && !t.After(p.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportDriverData writes everything the device holds about driver to dir:
+// data.json, a DriverDataExport, and the files of their segments under files/
+func (vehicle *Vehicle) ExportDriverData(driver Driver, dir string) (*DriverDataExport, error) {
+	segments, periods, err := vehicle.driverSegments(driver.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0700); err != nil {
+		return nil, err
+	}
+	driver.Secret, driver.PINHash, driver.Salt = "", "", ""
+	export := &DriverDataExport{Driver: driver, Created: time.Now().UTC(), Segments: segments}
+
+	for _, segment := range segments {
+		if segment.Stream == telemetryStream && !segment.Pruned {
+			records, err := vehicle.store.Records(vehicle.vin, segment.Start, segment.End)
+			if err != nil {
+				return nil, err
+			}
+			export.Records = append(export.Records, records...)
+		}
+		if segment.Path == "" || segment.Pruned {
+			continue
+		}
+		data, err := vehicle.readEvidence(segment.Path)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", segment.Path, err)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "files", segment.FileName()), data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if track, err := readTrack(time.Time{}, time.Now()); err == nil {
+		for _, fix := range track {
+			if during(periods, fix.Time) {
+				export.Track = append(export.Track, fix)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = forEachLine(locationPreimagePath, func(line []byte) {
+		var c LocationCommitment
+		if json.Unmarshal(line, &c) == nil && during(periods, c.Time) {
+			export.Locations = append(export.Locations, c)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	trips, err := loadTrips()
+	if err != nil {
+		return nil, err
+	}
+	for _, trip := range trips {
+		if trip.DriverKey == driver.Key {
+			export.Trips = append(export.Trips, trip)
+		}
+	}
+	export.Retained = []string{
+		"signed events, e.g. trip summaries, as they are anchored on chain where they can't be deleted",
+		"segments locked around incidents",
+		"hashes and anchors of every segment, which are not personal",
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(filepath.Join(dir, "data.json"), data); err != nil {
+		return nil, err
+	}
+	appendAudit("driver-data-export", map[string]interface{}{
+		"driverKey":   driver.Key,
+		"destination": dir,
+		"segments":    len(segments),
+	})
+	return export, nil
+}
+
+// PurgeDriverData deletes the raw telemetry and location data recorded while
+// the driver whose key is given was assigned: the records and files of their
+// segments, unless locked around an incident, and the positions and location
+// preimages logged meanwhile. The purge is signed by the owner, appended to
+// the purge log and audited, and returned.
+func (vehicle *Vehicle) PurgeDriverData(key string) (*DriverPurge, error) {
+	if vehicle.owner == nil {
+		return nil, errors.New("vehicle has no owner to sign the purge")
+	}
+	segments, periods, err := vehicle.driverSegments(key)
+	if err != nil {
+		return nil, err
+	}
+	purge := &DriverPurge{VIN: vehicle.vin, DriverKey: key, Time: time.Now().UTC()}
+
+	// files shared with a segment that is kept stay, like pruning
+	all, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]bool)
+	for _, segment := range all {
+		if !segment.Pruned && (segment.Driver != key || isSegmentLocked(segment.Path)) {
+			kept[segment.Path] = true
+		}
+	}
+
+	for _, segment := range segments {
+		purged := PurgedSegment{
+			Stream:    segment.Stream,
+			Start:     segment.Start,
+			End:       segment.End,
+			Hash:      segment.Hash,
+			TxID:      segment.TxID,
+			EntryHash: segment.EntryHash,
+		}
+		if isSegmentLocked(segment.Path) {
+			purge.Locked = append(purge.Locked, purged)
+			continue
+		}
+		if segment.Pruned {
+			continue
+		}
+		if segment.Stream == telemetryStream {
+			end := segment.End
+			if end.IsZero() {
+				end = time.Now()
+			}
+			if purged.Records, err = vehicle.store.DeleteRecords(vehicle.vin, segment.Start, end); err != nil {
+				return nil, err
+			}
+		}
+		if segment.Path != "" && !kept[segment.Path] {
+			if err := os.Remove(segment.Path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		segment.Pruned = true
+		if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+			return nil, err
+		}
+		purge.Segments = append(purge.Segments, purged)
+	}
+
+	trackLogMu.Lock()
+	purge.TrackPoints, err = dropLines(trackLogPath, func(line []byte) bool {
+		var fix Fix
+		return json.Unmarshal(line, &fix) == nil && during(periods, fix.Time)
+	})
+	trackLogMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("purging the track log: %v", err)
+	}
+	nmeaLogMu.Lock()
+	purge.NMEASentences, err = dropLines(nmeaLogPath, func(line []byte) bool {
+		var sentence NMEASentence
+		return json.Unmarshal(line, &sentence) == nil && during(periods, sentence.Time)
+	})
+	nmeaLogMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("purging the NMEA log: %v", err)
+	}
+	locationPreimageMu.Lock()
+	purge.LocationPreimages, err = dropLines(locationPreimagePath, func(line []byte) bool {
+		var c LocationCommitment
+		return json.Unmarshal(line, &c) == nil && during(periods, c.Time)
+	})
+	locationPreimageMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("purging location preimages: %v", err)
+	}
+
+	if err := vehicle.logPurge(purge); err != nil {
+		return nil, err
+	}
+	appendAudit("driver-data-purge", map[string]interface{}{
+		"driverKey":         key,
+		"segments":          len(purge.Segments),
+		"locked":            len(purge.Locked),
+		"trackPoints":       purge.TrackPoints,
+		"locationPreimages": purge.LocationPreimages,
+		"nmeaSentences":     purge.NMEASentences,
+	})
+	return purge, nil
+}
+
+// logPurge signs purge with the owner's key and appends it to the purge log
+func (vehicle *Vehicle) logPurge(purge *DriverPurge) error {
+	payload, err := json.Marshal(purge)
+	if err != nil {
+		return err
+	}
+	signature := ed.Sign(vehicle.owner.ecAddress.Sec, payload)
+	line, err := json.Marshal(SignedPurge{
+		Purge:     payload,
+		Signature: hex.EncodeToString(signature[:]),
+		PubKey:    hex.EncodeToString(vehicle.owner.ecAddress.PubBytes()),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(purgeLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// forEachLine passes every line of the file at path to fn, none if it doesn't exist
+func forEachLine(path string, fn func(line []byte)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// dropLines rewrites the file at path without the lines drop returns true
+// for, and returns how many were dropped
+func dropLines(path string, drop func(line []byte) bool) (int, error) {
+	var kept bytes.Buffer
+	dropped := 0
+	err := forEachLine(path, func(line []byte) {
+		if drop(line) {
+			dropped++
+			return
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	})
+	if err != nil || dropped == 0 {
+		return 0, err
+	}
+	return dropped, writeAtomic(path, kept.Bytes())
+}
+
+// findDriver returns the vehicle's driver with the given name
+func findDriver(name string) (Driver, error) {
+	drivers, err := loadDrivers()
+	if err != nil {
+		return Driver{}, err
+	}
+	for _, d := range drivers {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Driver{}, fmt.Errorf("no driver %q", name)
+}
+
+// privacyCommand exports or purges the personal data held about a driver:
+//
+//	blackbox privacy export -driver <name> [-out <dir>]
+//	blackbox privacy purge -driver <name> | -key <hex key>
+func privacyCommand(vehicle *Vehicle, config *Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox privacy export|purge -driver <name>")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("privacy "+args[0], flag.ExitOnError)
+	name := flags.String("driver", "", "Name of the driver")
+	key := flags.String("key", "", "Hex identity key of the driver, for purging data of a driver since removed")
+	out := flags.String("out", "", "Directory the export is written to (default: driver_<name>)")
+	flags.Parse(args[1:])
+
+	var driver Driver
+	switch {
+	case *name != "":
+		var err error
+		if driver, err = findDriver(*name); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	case *key != "" && args[0] == "purge":
+		driver.Key = *key
+	default:
+		fmt.Fprintf(os.Stderr, "usage: blackbox privacy %s -driver <name>\n", args[0])
+		os.Exit(2)
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+
+	switch args[0] {
+	case "export":
+		dir := *out
+		if dir == "" {
+			dir = "driver_" + driver.Name
+		}
+		export, err := vehicle.ExportDriverData(driver, dir)
+		if err != nil {
+			fmt.Println("Failed to export the driver's data", err)
+			os.Exit(1)
+		}
+		who := cliWho("")
+		who["driver"] = driver.Name
+		vehicle.logAccess("driver-data-export", dir, []string{DataTelemetry, DataLocation, DataTrips}, who)
+		fmt.Printf("Exported %d segments, %d records, %d positions and %d trips of %s to %s\n",
+			len(export.Segments), len(export.Records), len(export.Track), len(export.Trips), driver.Name, dir)
+	case "purge":
+		purge, err := vehicle.PurgeDriverData(driver.Key)
+		if err != nil {
+			fmt.Println("Failed to purge the driver's data", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Purged %d segments, %d positions and %d location preimages, recorded in %s\n",
+			len(purge.Segments), purge.TrackPoints, purge.LocationPreimages, purgeLogPath)
+		if len(purge.Locked) > 0 {
+			fmt.Printf("Kept %d segments locked around incidents\n", len(purge.Locked))
+		}
+		if driver.Name != "" {
+			fmt.Printf("Their profile stays until removed with: blackbox driver remove -name %s\n", driver.Name)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown privacy command %q\n", args[0])
+		os.Exit(2)
+	}
+}
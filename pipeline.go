@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pipeline sizes. Finishing a segment hashes, writes and anchors it, which can
+// take longer than recording the next one on a slow network or with big
+// files, so the hash stage runs on several goroutines, anchoring doesn't wait
+// for confirmations, and producers only wait once a channel is full.
+const (
+	sampleQueueDepth  = 64 // samples waiting to be stored
+	segmentQueueDepth = 16 // segments waiting to be hashed, and hashed segments waiting to be anchored
+	subscriberDepth   = 64 // records or results a subscriber may fall behind by
+	hashWorkers       = 2
+	pendingAnchors    = 16          // entries being committed before the anchor stage waits
+	segmentDuration   = time.Minute // telemetry covered by one segment
+	telemetryStream   = "obd"       // stream of telemetry segments, named for its first producer
+)
+
+// Sample is one set of readings from a producer, e.g. the OBD loop. Flush
+// closes the open telemetry segment once Record is in it, e.g. at ignition
+// off, so it is anchored without waiting out segmentDuration.
+type Sample struct {
+	Source string // producer, e.g. "obd"
+	Record *OBDRecord
+	Flush  bool
+}
+
+// closedSegment is a segment whose data is complete
+type closedSegment struct {
+	segment *Segment
+	closed  time.Time
+}
+
+// hashedSegment is a closed segment whose file is written and hashed
+type hashedSegment struct {
+	closedSegment
+	hash   []byte
+	hashed time.Time
+}
+
+// SegmentResult is a segment leaving the pipeline, anchored unless Err is set
+type SegmentResult struct {
+	Segment *Segment
+	Err     error
+	Took    time.Duration // from closing the segment to anchoring it
+	Closed  time.Time
+	Hashed  time.Time // when its file was written and hashed, zero if that failed
+}
+
+// pipeline carries recorded data through stages connected by bounded channels:
+//
+//	producers → samples → store → segment → hash → anchor → batch → subscribers
+//
+// Producers submit samples, or closed segments of their own (video footage),
+// and subscribers receive stored records and finished segments, so new
+// producers and consumers plug in without touching the stages or each other.
+type pipeline struct {
+	vehicle  *Vehicle
+	samples  chan Sample
+	footage  chan *Segment // closed segments written by producers
+	segments chan closedSegment
+	hashed   chan hashedSegment
+	batched  chan hashedSegment // hashed segments waiting to share an entry
+	results  chan SegmentResult
+	done     chan struct{} // closed once every stage has drained
+	batching *BatchConfig  // nil to anchor every segment on its own
+
+	anchoring  chan struct{} // holds a token per entry being committed
+	confirming sync.WaitGroup
+
+	mu                 sync.Mutex
+	recordSubscribers  []chan Sample
+	segmentSubscribers []chan SegmentResult
+}
+
+// newPipeline starts the stages of the vehicle's data path. Segments are
+// batched into shared entries as configured by batching, if not nil.
+func newPipeline(vehicle *Vehicle, batching *BatchConfig) *pipeline {
+	p := &pipeline{
+		vehicle:  vehicle,
+		samples:  make(chan Sample, sampleQueueDepth),
+		footage:  make(chan *Segment, segmentQueueDepth),
+		segments: make(chan closedSegment, segmentQueueDepth),
+		hashed:   make(chan hashedSegment, segmentQueueDepth),
+		batched:  make(chan hashedSegment, segmentQueueDepth),
+		results:  make(chan SegmentResult, segmentQueueDepth),
+		done:     make(chan struct{}),
+		batching: batching,
+
+		anchoring: make(chan struct{}, pendingAnchors),
+	}
+	stored := make(chan Sample, sampleQueueDepth)
+	go p.store(stored)
+	go p.segment(stored)
+	runStage(hashWorkers, p.hash, func() { close(p.hashed) })
+	go p.anchor()
+	go p.batch()
+	go p.publish()
+	return p
+}
+
+// runStage runs n copies of stage and calls done once all have returned
+func runStage(n int, stage func(), done func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stage()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		done()
+	}()
+}
+
+// submit sends a sample down the pipeline, waiting while it is full. While
+// the backlog is shedding a sample the pipeline can't take is dropped and
+// counted instead, so producers keep their sample rate.
+func (p *pipeline) submit(sample Sample) {
+	if p.vehicle.backlog.get() < backlogShedding {
+		p.samples <- sample
+		return
+	}
+	select {
+	case p.samples <- sample:
+	default:
+		p.vehicle.backlog.drop()
+	}
+}
+
+// submitSegment sends a closed segment whose file the producer wrote itself
+// to be hashed and anchored, waiting while the pipeline is full
+func (p *pipeline) submitSegment(segment *Segment) {
+	p.footage <- segment
+}
+
+// close drains the pipeline once its producers have stopped: the open
+// telemetry segment is closed and every segment is hashed and anchored
+func (p *pipeline) close() {
+	close(p.samples)
+	close(p.footage)
+	<-p.done
+}
+
+// SubscribeRecords returns a channel receiving every stored record. A
+// subscriber more than subscriberDepth records behind misses records rather
+// than slowing recording down.
+func (p *pipeline) SubscribeRecords() <-chan Sample {
+	ch := make(chan Sample, subscriberDepth)
+	p.mu.Lock()
+	p.recordSubscribers = append(p.recordSubscribers, ch)
+	p.mu.Unlock()
+	return ch
+}
+
+// SubscribeSegments returns a channel receiving the result of every segment,
+// dropped like records when the subscriber falls behind
+func (p *pipeline) SubscribeSegments() <-chan SegmentResult {
+	ch := make(chan SegmentResult, subscriberDepth)
+	p.mu.Lock()
+	p.segmentSubscribers = append(p.segmentSubscribers, ch)
+	p.mu.Unlock()
+	return ch
+}
+
+// store writes samples to the database and passes them on
+func (p *pipeline) store(out chan<- Sample) {
+	defer close(out)
+	vehicle := p.vehicle
+	for sample := range p.samples {
+		if err := vehicle.store.PutRecord(vehicle.vin, sample.Record); err != nil {
+			fmt.Println("Failed to store record", err)
+			continue
+		}
+		vehicle.recorder.addRecord(sample.Record.Text())
+		p.mu.Lock()
+		for _, ch := range p.recordSubscribers {
+			select {
+			case ch <- sample:
+			default:
+			}
+		}
+		p.mu.Unlock()
+		out <- sample
+	}
+}
+
+// segment groups stored records into telemetry segments of segmentDuration
+// and forwards closed segments, including producers' footage, to be hashed
+func (p *pipeline) segment(stored <-chan Sample) {
+	defer close(p.segments)
+	vehicle := p.vehicle
+	var open *Segment
+	var last time.Time // time of the open segment's last record
+	closeOpen := func() {
+		open.End = last
+		p.segments <- closedSegment{segment: open, closed: time.Now()}
+		vehicle.recorder.setSegment(nil)
+		open = nil
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	samples, footage := stored, p.footage
+	for samples != nil || footage != nil {
+		select {
+		case sample, ok := <-samples:
+			if !ok {
+				samples = nil
+				continue
+			}
+			at := sample.Record.Time
+			if open != nil && at.Sub(open.Start) >= segmentDuration {
+				closeOpen()
+			}
+			if open == nil {
+				segment, err := vehicle.newSegment(telemetryStream, at)
+				if err == nil {
+					err = vehicle.store.PutSegment(vehicle.vin, segment)
+				}
+				if err != nil {
+					fmt.Println("Failed to start segment", err)
+					continue
+				}
+				open = segment
+				vehicle.recorder.setSegment(segment)
+			}
+			last = at
+			if sample.Flush {
+				closeOpen()
+			}
+		case segment, ok := <-footage:
+			if !ok {
+				footage = nil
+				continue
+			}
+			p.segments <- closedSegment{segment: segment, closed: time.Now()}
+		case now := <-ticker.C:
+			// close a segment whose producers went quiet, e.g. while paused
+			if open != nil && now.Sub(open.Start) >= segmentDuration+normalSampleInterval {
+				closeOpen()
+			}
+		}
+	}
+	if open != nil {
+		closeOpen()
+	}
+}
+
+// hash writes and hashes closed segments
+func (p *pipeline) hash() {
+	for closed := range p.segments {
+		hash, err := p.vehicle.hashSegment(closed.segment)
+		if err != nil {
+			p.results <- SegmentResult{Segment: closed.segment, Err: err, Took: time.Since(closed.closed), Closed: closed.closed}
+			continue
+		}
+		p.hashed <- hashedSegment{closedSegment: closed, hash: hash, hashed: time.Now()}
+	}
+}
+
+// anchor anchors the hashes of hashed segments, passing those that may
+// share an entry on to be batched
+func (p *pipeline) anchor() {
+	defer close(p.batched)
+	for hashed := range p.hashed {
+		if p.batchConfig().batches(hashed.segment) {
+			p.batched <- hashed
+			continue
+		}
+		p.confirm([]hashedSegment{hashed})
+	}
+}
+
+// confirm starts anchoring segments in one entry and, without waiting for
+// the commit, returns unless pendingAnchors entries are already in flight.
+// Once committed the transaction is recorded and their results are sent.
+func (p *pipeline) confirm(batch []hashedSegment) {
+	segments := make([]*Segment, len(batch))
+	hashes := make([][]byte, len(batch))
+	for i, hashed := range batch {
+		segments[i], hashes[i] = hashed.segment, hashed.hash
+	}
+	p.anchoring <- struct{}{}
+	anchored := p.vehicle.anchorSegmentsAsync(segments, hashes)
+	p.confirming.Add(1)
+	go func() {
+		defer p.confirming.Done()
+		result := <-anchored
+		<-p.anchoring
+		err := p.vehicle.recordAnchor(segments, result)
+		for _, hashed := range batch {
+			p.results <- SegmentResult{Segment: hashed.segment, Err: err, Took: time.Since(hashed.closed),
+				Closed: hashed.closed, Hashed: hashed.hashed}
+		}
+	}()
+}
+
+// publish sends segment results to subscribers
+func (p *pipeline) publish() {
+	defer close(p.done)
+	for result := range p.results {
+		p.mu.Lock()
+		for _, ch := range p.segmentSubscribers {
+			select {
+			case ch <- result:
+			default:
+			}
+		}
+		p.mu.Unlock()
+	}
+	p.mu.Lock()
+	for _, ch := range p.recordSubscribers {
+		close(ch)
+	}
+	for _, ch := range p.segmentSubscribers {
+		close(ch)
+	}
+	p.mu.Unlock()
+}
+
+// reportSegmentResults alerts the owner to segments that could not be
+// finished, until results is closed
+func (vehicle *Vehicle) reportSegmentResults(results <-chan SegmentResult) {
+	for result := range results {
+		segment := result.Segment
+		if result.Err != nil {
+			vehicle.raiseAlert("segment-failed", fmt.Sprintf("%s segment %d was not finished: %v", segment.Stream, segment.Seq, result.Err),
+				map[string]interface{}{"stream": segment.Stream, "seq": segment.Seq, "start": segment.Start})
+			continue
+		}
+		if result.Took > time.Minute {
+			fmt.Printf("%s segment %d took %s to be anchored\n", segment.Stream, segment.Seq, result.Took.Round(time.Second))
+		}
+	}
+}
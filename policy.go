@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// Event types of insurance policies on the vehicle's chain
+const (
+	policyBindingEvent     = "policy-binding"     // written by the insurer with its own key
+	policyCountersignEvent = "policy-countersign" // the owner's acceptance of a binding
+)
+
+// PolicyBinding is the data of a "policy-binding" event an insurer writes to
+// the vehicle's chain, signed with its identity key. The policy ID itself is
+// not published, only its hash with the VIN.
+type PolicyBinding struct {
+	Insurer    string    `json:"insurer"`    // name of the insurer
+	PolicyHash string    `json:"policyHash"` // see policyHash
+	Start      time.Time `json:"start"`      // coverage window
+	End        time.Time `json:"end"`
+}
+
+// PolicyCountersign is the data of the owner's "policy-countersign" event,
+// accepting the binding anchored in Entry
+type PolicyCountersign struct {
+	Entry      string    `json:"entry"`   // hash of the insurer's binding entry
+	Insurer    string    `json:"insurer"` // hex public key that signed it
+	PolicyHash string    `json:"policyHash"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// PolicyCoverage is a policy binding found on the vehicle's chain and whether
+// the owner countersigned it
+type PolicyCoverage struct {
+	Entry            string        `json:"entry"`
+	Bound            time.Time     `json:"bound"`      // block time of the binding entry
+	InsurerKey       string        `json:"insurerKey"` // hex public key that signed the binding
+	Binding          PolicyBinding `json:"binding"`
+	Countersigned    bool          `json:"countersigned"`
+	CountersignEntry string        `json:"countersignEntry,omitempty"`
+}
+
+// policyHash returns the hex SHA-256 of a policy ID and the VIN it covers,
+// which the insurer and owner can show matches their policy document
+func policyHash(policyID, vin string) string {
+	sum := sha256.Sum256([]byte(policyID + ":" + vin))
+	return hex.EncodeToString(sum[:])
+}
+
+// BindPolicy writes an insurer's policy binding to the chain of vin through
+// client, signed with and paid by the insurer's EC address, and returns the
+// entry hash and txID
+// ExtIDs = [0]:signature, [1]:insurer's public key, [2]:"event", [3]:"policy-binding"
+func BindPolicy(client ChainClient, insurer *factom.ECAddress, vin string, binding PolicyBinding) (string, string, error) {
+	if !binding.Start.Before(binding.End) {
+		return "", "", fmt.Errorf("coverage must start before it ends")
+	}
+	data := toEventData(binding)
+	content, err := json.Marshal(Event{Type: policyBindingEvent, VIN: vin, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		return "", "", err
+	}
+	signature := ed.Sign(insurer.Sec, content)
+	entry := &factom.Entry{
+		ChainID: vehicleChainID(vin),
+		ExtIDs:  [][]byte{signature[:], insurer.PubBytes(), []byte("event"), []byte(policyBindingEvent)},
+		Content: content,
+	}
+	txID, err := commitRevealEntry(client, defaultRetry, entry, insurer)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(entry.Hash()), txID, nil
+}
+
+// policies returns the policy bindings on the vehicle's chain as of the last
+// index sync, with a valid insurer signature, and whether the owner has
+// countersigned each
+func (vehicle *Vehicle) policies() ([]*PolicyCoverage, error) {
+	entries, err := vehicle.store.ChainEntries(vehicle.vin, time.Time{}, time.Now(), func(e *IndexedEntry) bool {
+		return e.Kind == EntryKindEvent && e.Verified && (e.EventType == policyBindingEvent || e.EventType == policyCountersignEvent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	coverage := []*PolicyCoverage{}
+	byEntry := make(map[string]*PolicyCoverage)
+	for _, entry := range entries {
+		var event Event
+		if json.Unmarshal(entry.Event, &event) != nil || event.VIN != vehicle.vin {
+			continue
+		}
+		data, _ := json.Marshal(event.Data)
+		switch entry.EventType {
+		case policyBindingEvent:
+			policy := &PolicyCoverage{Entry: entry.EntryHash, Bound: entry.BlockTime, InsurerKey: entry.SigningKey}
+			if json.Unmarshal(data, &policy.Binding) != nil || entry.SignedByOwner {
+				continue
+			}
+			coverage = append(coverage, policy)
+			byEntry[entry.EntryHash] = policy
+		case policyCountersignEvent:
+			var countersign PolicyCountersign
+			if !entry.SignedByOwner || json.Unmarshal(data, &countersign) != nil {
+				continue
+			}
+			// the countersignature must be of the binding as the insurer wrote it
+			policy := byEntry[countersign.Entry]
+			if policy != nil && policy.InsurerKey == countersign.Insurer && policy.Binding.PolicyHash == countersign.PolicyHash &&
+				policy.Binding.Start.Equal(countersign.Start) && policy.Binding.End.Equal(countersign.End) {
+				policy.Countersigned, policy.CountersignEntry = true, entry.EntryHash
+			}
+		}
+	}
+	return coverage, nil
+}
+
+// CountersignPolicy anchors the owner's countersignature of the policy
+// binding in entry and returns the txID
+func (vehicle *Vehicle) CountersignPolicy(entry string) (string, error) {
+	policies, err := vehicle.policies()
+	if err != nil {
+		return "", err
+	}
+	for _, policy := range policies {
+		if policy.Entry != entry {
+			continue
+		}
+		if policy.Countersigned {
+			return "", fmt.Errorf("policy binding %s is already countersigned", entry)
+		}
+		countersign := PolicyCountersign{
+			Entry:      policy.Entry,
+			Insurer:    policy.InsurerKey,
+			PolicyHash: policy.Binding.PolicyHash,
+			Start:      policy.Binding.Start,
+			End:        policy.Binding.End,
+		}
+		return vehicle.LogEvent(vehicle.NewEvent(policyCountersignEvent, toEventData(countersign)), true)
+	}
+	return "", fmt.Errorf("no policy binding %s on the vehicle's chain, sync the chain index first", entry)
+}
+
+// coverageAt returns the countersigned policies covering t
+func (vehicle *Vehicle) coverageAt(t time.Time) ([]*PolicyCoverage, error) {
+	policies, err := vehicle.policies()
+	if err != nil {
+		return nil, err
+	}
+	covering := []*PolicyCoverage{}
+	for _, policy := range policies {
+		if policy.Countersigned && !t.Before(policy.Binding.Start) && t.Before(policy.Binding.End) {
+			covering = append(covering, policy)
+		}
+	}
+	return covering, nil
+}
+
+// handlePolicies returns the policy bindings on the vehicle's chain, or with
+// the at query parameter only the countersigned ones covering that time
+func (vehicle *Vehicle) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	var policies []*PolicyCoverage
+	var err error
+	if at := r.URL.Query().Get("at"); at != "" {
+		t, parseErr := time.Parse(time.RFC3339, at)
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, parseErr)
+			return
+		}
+		policies, err = vehicle.coverageAt(t)
+	} else {
+		policies, err = vehicle.policies()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, policies)
+}
+
+// countersignRequest is the body of POST /policies/countersign
+type countersignRequest struct {
+	Entry string `json:"entry"` // hash of the insurer's binding entry
+}
+
+// handleCountersignPolicy anchors the owner's countersignature of a binding
+func (vehicle *Vehicle) handleCountersignPolicy(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req countersignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	txID, err := vehicle.CountersignPolicy(strings.ToLower(req.Entry))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	details := requestDetails(r)
+	details["entry"] = req.Entry
+	appendAudit("policy-countersigned", details)
+	writeJSON(w, http.StatusOK, map[string]string{"txID": txID})
+}
+
+// printPolicy prints a policy binding on one line
+func printPolicy(policy *PolicyCoverage) {
+	status := "NOT countersigned"
+	if policy.Countersigned {
+		status = "countersigned"
+	}
+	fmt.Printf("%s  %s  %s to %s  policy %.16s  insurer key %.16s  %s\n", policy.Entry, policy.Binding.Insurer,
+		policy.Binding.Start.Local().Format("2006-01-02 15:04"), policy.Binding.End.Local().Format("2006-01-02 15:04"),
+		policy.Binding.PolicyHash, policy.InsurerKey, status)
+}
+
+// policyCommand binds insurance policies to vehicles and proves coverage:
+//
+//	blackbox policy bind -ec-key <insurer's private EC key> -vin -insurer -policy-id -start -end
+//	blackbox policy list [-offline]
+//	blackbox policy countersign -entry <binding entry hash>
+//	blackbox policy check [-at <time>] [-offline]
+func policyCommand(vehicle *Vehicle, config *Config, args []string) {
+	usage := "usage: blackbox policy bind|list|countersign|check"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if args[0] == "bind" {
+		// run by the insurer, needs no database
+		flags := flag.NewFlagSet("policy bind", flag.ExitOnError)
+		ecKey := flags.String("ec-key", "", "Insurer's private EC address, its identity key and paying for the entry")
+		vin := flags.String("vin", vehicle.vin, "Vehicle covered")
+		insurer := flags.String("insurer", "", "Name of the insurer")
+		policyID := flags.String("policy-id", "", "Policy number, only its hash is written")
+		start := flags.String("start", "", "Start of coverage, RFC3339 or YYYY-MM-DD")
+		end := flags.String("end", "", "End of coverage, RFC3339 or YYYY-MM-DD")
+		flags.Parse(args[1:])
+		if *ecKey == "" || *policyID == "" || *insurer == "" {
+			fmt.Fprintln(os.Stderr, "usage: blackbox policy bind -ec-key <key> -vin <vin> -insurer <name> -policy-id <id> -start <time> -end <time>")
+			os.Exit(2)
+		}
+		address, err := factom.GetECAddress(*ecKey)
+		if err != nil {
+			fmt.Println("Invalid -ec-key", err)
+			os.Exit(2)
+		}
+		binding := PolicyBinding{Insurer: *insurer, PolicyHash: policyHash(*policyID, *vin)}
+		if binding.Start, err = parseWarrantyTime(*start); err != nil {
+			fmt.Println("Invalid -start", err)
+			os.Exit(2)
+		}
+		if binding.End, err = parseWarrantyTime(*end); err != nil {
+			fmt.Println("Invalid -end", err)
+			os.Exit(2)
+		}
+		entry, txID, err := BindPolicy(vehicle.chain, address, *vin, binding)
+		if err != nil {
+			fmt.Println("Failed to bind the policy", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Policy bound to %s in entry %s. TxID: %s\nThe owner accepts it with: blackbox policy countersign -entry %s\n", *vin, entry, txID, entry)
+		return
+	}
+
+	flags := flag.NewFlagSet("policy "+args[0], flag.ExitOnError)
+	offline := flags.Bool("offline", false, "Use the local chain index without syncing it")
+	entry := flags.String("entry", "", "Binding entry hash, for countersign")
+	at := flags.String("at", "", "Time coverage is checked at, RFC3339 (default: now)")
+	flags.Parse(args[1:])
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if !*offline {
+		if _, err := vehicle.SyncChainIndex(vehicle.chain, vehicle.vin); err != nil {
+			fmt.Println("Failed to sync the chain index, use -offline to skip", err)
+			os.Exit(1)
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		policies, err := vehicle.policies()
+		if err != nil {
+			fmt.Println("Failed to query the chain index", err)
+			os.Exit(1)
+		}
+		for _, policy := range policies {
+			printPolicy(policy)
+		}
+	case "countersign":
+		txID, err := vehicle.CountersignPolicy(strings.ToLower(*entry))
+		if err != nil {
+			fmt.Println("Failed to countersign", err)
+			os.Exit(1)
+		}
+		appendAudit("policy-countersigned", map[string]interface{}{"via": "cli", "entry": *entry})
+		fmt.Printf("Policy binding %s countersigned. TxID: %s\n", *entry, txID)
+	case "check":
+		t := time.Now()
+		if *at != "" {
+			if t, err = time.Parse(time.RFC3339, *at); err != nil {
+				fmt.Println("Invalid -at", err)
+				os.Exit(2)
+			}
+		}
+		policies, err := vehicle.coverageAt(t)
+		if err != nil {
+			fmt.Println("Failed to query the chain index", err)
+			os.Exit(1)
+		}
+		for _, policy := range policies {
+			printPolicy(policy)
+		}
+		if len(policies) == 0 {
+			fmt.Printf("NOT COVERED: no countersigned policy on the chain covers %s\n", t.Format(time.RFC3339))
+			os.Exit(1)
+		}
+		fmt.Printf("COVERED at %s by %d countersigned policies\n", t.Format(time.RFC3339), len(policies))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
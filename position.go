@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Position tracking settings
+const (
+	maxFixAge         = 2 * time.Second  // how long a GPS fix is the vehicle's current position
+	maxDeadReckoning  = 30 * time.Minute // give up estimating after this long without GPS
+	minCourseSpeedKmh = 5.0              // GPS course is unreliable below this speed
+)
+
+// positionTracker holds the most recent position so recorders on other goroutines
+// can tag their samples with it. While GPS is unavailable it dead-reckons from
+// OBD speed and the IMU's yaw rate, starting at the last good fix.
+type positionTracker struct {
+	mu         sync.Mutex
+	fix        *Fix
+	received   time.Time // local clock, the GPS clock may disagree with it
+	heading    float64   // degrees true
+	hasHeading bool
+	estimate   *Fix      // dead-reckoned position, nil while GPS is available
+	advanced   time.Time // last time the estimate was moved
+}
+
+// latest returns the current GPS fix, or the dead-reckoned estimate during an
+// outage, or nil if the position is unknown
+func (t *positionTracker) latest() *Fix {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fix != nil && time.Since(t.received) <= maxFixAge {
+		return t.fix
+	}
+	return t.estimate
+}
+
+// set records a fix from the GPS receiver, ending any dead reckoning
+func (t *positionTracker) set(fix *Fix) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.estimate != nil {
+		fmt.Printf("GPS reacquired, dead reckoning was off by %.0f m\n",
+			distanceMeters(t.estimate.Lat, t.estimate.Lon, fix.Lat, fix.Lon))
+	}
+	t.fix = fix
+	t.received = time.Now()
+	t.estimate = nil
+	if fix.Speed >= minCourseSpeedKmh {
+		t.heading = fix.Course
+		t.hasHeading = true
+	}
+}
+
+// clear forgets the position, both the last fix and any estimate from it
+func (t *positionTracker) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fix = nil
+	t.estimate = nil
+}
+
+// rotate applies the IMU's yaw rate (degrees/s, counterclockwise positive) over dt
+func (t *positionTracker) rotate(yawRate float64, dt time.Duration) {
+	t.mu.Lock()
+	t.heading = math.Mod(t.heading-yawRate*dt.Seconds()+360, 360)
+	t.mu.Unlock()
+}
+
+// advance moves the dead-reckoned position at speed (km/h) along the current
+// heading and returns the new estimate. It does nothing and returns nil while GPS
+// is available or if there is no fix to start from.
+func (t *positionTracker) advance(speed float64, at time.Time) *Fix {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fix == nil || !t.hasHeading || time.Since(t.received) <= maxFixAge {
+		return nil
+	}
+	if time.Since(t.received) > maxDeadReckoning {
+		t.estimate = nil
+		return nil
+	}
+	if t.estimate == nil {
+		start := *t.fix
+		start.Estimated = true
+		t.estimate = &start
+		t.advanced = t.received
+		fmt.Println("GPS lost, dead reckoning from OBD speed")
+	}
+
+	dt := at.Sub(t.advanced)
+	t.advanced = at
+	if dt <= 0 {
+		return t.estimate
+	}
+	const earthRadius = 6371000.0
+	meters := speed / 3.6 * dt.Seconds()
+	heading := t.heading * math.Pi / 180
+	next := *t.estimate
+	next.Lat += meters * math.Cos(heading) / earthRadius * 180 / math.Pi
+	next.Lon += meters * math.Sin(heading) / (earthRadius * math.Cos(next.Lat*math.Pi/180)) * 180 / math.Pi
+	next.Time = at.UTC()
+	next.Speed = speed
+	next.Course = t.heading
+	t.estimate = &next
+	return &next
+}
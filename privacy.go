@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Location privacy modes
+const (
+	LocationFull    = "full"    // record exact coordinates
+	LocationGeohash = "geohash" // record a truncated geohash
+	LocationHash    = "hash"    // record only a salted hash, revealable later
+)
+
+// locationPreimagePath holds the salts needed to reveal hash-only locations.
+// It never leaves the device unless the owner chooses to reveal a location.
+const locationPreimagePath = "location_preimages.log"
+
+// LocationPrivacy controls how positions appear in recorded evidence and on chain
+type LocationPrivacy struct {
+	Mode      string `json:"mode"`      // LocationFull, LocationGeohash, or LocationHash
+	Precision int    `json:"precision"` // geohash characters to keep, 5 is roughly 5km
+}
+
+// LocationCommitment is the preimage of a hash-only location. Publishing it proves
+// the vehicle was at Lat/Lon at Time without revealing any other location.
+type LocationCommitment struct {
+	Commitment string    `json:"commitment"`
+	Salt       string    `json:"salt"`
+	Lat        float64   `json:"lat"`
+	Lon        float64   `json:"lon"`
+	Time       time.Time `json:"time"`
+	Estimated  bool      `json:"estimated,omitempty"`
+}
+
+var locationPreimageMu sync.Mutex
+
+// message is the canonical byte string committed to
+func (c *LocationCommitment) message() []byte {
+	return []byte(fmt.Sprintf("%.7f,%.7f,%s", c.Lat, c.Lon, c.Time.UTC().Format(time.RFC3339Nano)))
+}
+
+// Verify returns true if the commitment matches its revealed preimage
+func (c *LocationCommitment) Verify() bool {
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(append(salt, c.message()...))
+	return hex.EncodeToString(hash[:]) == c.Commitment
+}
+
+// commitLocation creates a salted commitment to fix and stores its preimage locally
+func commitLocation(fix *Fix) (string, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	c := LocationCommitment{Salt: hex.EncodeToString(salt), Lat: fix.Lat, Lon: fix.Lon, Time: fix.Time, Estimated: fix.Estimated}
+	hash := sha256.Sum256(append(salt, c.message()...))
+	c.Commitment = hex.EncodeToString(hash[:])
+
+	line, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	locationPreimageMu.Lock()
+	defer locationPreimageMu.Unlock()
+	file, err := os.OpenFile(locationPreimagePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return "", err
+	}
+	return c.Commitment, nil
+}
+
+// RevealLocation looks up the preimage of a hash-only location so it can be shared
+func RevealLocation(commitment string) (*LocationCommitment, error) {
+	file, err := os.Open(locationPreimagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	needle := []byte(commitment)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !bytes.Contains(scanner.Bytes(), needle) {
+			continue
+		}
+		var c LocationCommitment
+		if err := json.Unmarshal(scanner.Bytes(), &c); err == nil && c.Commitment == commitment {
+			return &c, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no location with commitment %s", commitment)
+}
+
+// locationData returns the representation of fix allowed by the vehicle's
+// privacy mode, for inclusion in event data
+func (vehicle *Vehicle) locationData(fix *Fix) map[string]interface{} {
+	data := make(map[string]interface{})
+	if fix == nil {
+		return data
+	}
+	if fix.Estimated {
+		data["estimated"] = true
+	}
+	switch vehicle.privacy.Mode {
+	case LocationGeohash:
+		data["geohash"] = geohash(fix.Lat, fix.Lon, vehicle.privacy.precision())
+	case LocationHash:
+		commitment, err := commitLocation(fix)
+		if err != nil {
+			fmt.Println("Failed to commit location", err)
+			return data
+		}
+		data["locationCommitment"] = commitment
+	default:
+		data["lat"] = fix.Lat
+		data["lon"] = fix.Lon
+	}
+	return data
+}
+
+// describePosition formats a position for OBD records according to the
+// vehicle's privacy mode
+func (vehicle *Vehicle) describePosition(fix *Fix) string {
+	if vehicle.privacyMode.active() {
+		return privatePosition
+	}
+	if fix == nil {
+		return "unknown"
+	}
+	var description string
+	switch vehicle.privacy.Mode {
+	case LocationGeohash:
+		description = "geohash " + geohash(fix.Lat, fix.Lon, vehicle.privacy.precision())
+	case LocationHash:
+		commitment, err := commitLocation(fix)
+		if err != nil {
+			return "unknown"
+		}
+		description = "commitment " + commitment
+	default:
+		description = fmt.Sprintf("%.6f, %.6f", fix.Lat, fix.Lon)
+	}
+	if fix.Estimated {
+		description += " (estimated)"
+	}
+	return description
+}
+
+func (p LocationPrivacy) precision() int {
+	if p.Precision <= 0 || p.Precision > 12 {
+		return 5
+	}
+	return p.Precision
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a coordinate as a geohash of the given length
+func geohash(lat, lon float64, length int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, length)
+	even := true
+	var bit, ch int
+	for len(hash) < length {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if lon >= mid {
+				ch |= 1 << uint(4-bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				ch |= 1 << uint(4-bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// privacyModePath keeps privacy mode across restarts, so a reboot doesn't
+// quietly resume capturing the location
+const privacyModePath = "privacy_mode.json"
+
+// Events anchored when privacy mode starts and ends, so the gap in positions
+// is explained by the owner's signed markers rather than looking like tampering
+const (
+	privacyStartEvent = "privacy-mode-start"
+	privacyEndEvent   = "privacy-mode-end"
+)
+
+// privacyScheduleInterval is how often the privacy schedule is checked
+const privacyScheduleInterval = 30 * time.Second
+
+// privatePosition is how OBD records describe the position in privacy mode
+const privatePosition = "private"
+
+// PrivacyConfig sets how privacy mode is switched besides the API. In
+// privacy mode the location isn't captured, positions are neither tracked,
+// logged nor recorded in evidence, while OBD logging carries on.
+type PrivacyConfig struct {
+	Button   string          `json:"button"`   // sysfs GPIO value file of a button toggling privacy mode
+	Schedule []PrivacyWindow `json:"schedule"` // times of day privacy mode switches on by itself
+}
+
+// PrivacyWindow is a stretch of local time on some days, ending the next
+// day if End is before Start
+type PrivacyWindow struct {
+	Days  []string `json:"days"`  // days it starts on, e.g. "sat", every day if empty
+	Start string   `json:"start"` // "15:04"
+	End   string   `json:"end"`
+}
+
+// PrivacyModeState is whether privacy mode is on, since when and who
+// switched it on
+type PrivacyModeState struct {
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since,omitempty"`
+	Source string    `json:"source,omitempty"` // "button", "api", "grpc" or "schedule"
+}
+
+// privacyMode is the privacy mode of a recording vehicle
+type privacyMode struct {
+	mu    sync.Mutex
+	state PrivacyModeState
+}
+
+// loadPrivacyMode returns the privacy mode saved at privacyModePath, off if
+// none was
+func loadPrivacyMode() (*privacyMode, error) {
+	mode := new(privacyMode)
+	data, err := ioutil.ReadFile(privacyModePath)
+	if os.IsNotExist(err) {
+		return mode, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &mode.state); err != nil {
+		return nil, fmt.Errorf("%s: %v", privacyModePath, err)
+	}
+	return mode, nil
+}
+
+// active reports whether privacy mode is on, never for a nil mode
+func (m *privacyMode) active() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.Active
+}
+
+// current returns the privacy mode's state
+func (m *privacyMode) current() PrivacyModeState {
+	if m == nil {
+		return PrivacyModeState{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// switchTo turns privacy mode on or off and saves it. It returns the state it
+// replaces and false if the mode was already as asked.
+func (m *privacyMode) switchTo(active bool, source string) (PrivacyModeState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.state
+	if previous.Active == active {
+		return previous, false, nil
+	}
+	next := PrivacyModeState{}
+	if active {
+		next = PrivacyModeState{Active: true, Since: time.Now().UTC(), Source: source}
+	}
+	if err := writeSynced(privacyModePath, next); err != nil {
+		return previous, false, err
+	}
+	m.state = next
+	return previous, true, nil
+}
+
+// SetPrivacyMode turns privacy mode on or off. Turning it on forgets the
+// current position at once. Each switch anchors a signed marker, the end
+// marker carrying when privacy mode started, and is recorded in the audit log
+// with details of who asked.
+func (vehicle *Vehicle) SetPrivacyMode(active bool, source string, details map[string]interface{}) (PrivacyModeState, error) {
+	if vehicle.privacyMode == nil {
+		return PrivacyModeState{}, fmt.Errorf("privacy mode is only available while recording")
+	}
+	previous, switched, err := vehicle.privacyMode.switchTo(active, source)
+	if err != nil || !switched {
+		return vehicle.privacyMode.current(), err
+	}
+	data := map[string]interface{}{"source": source}
+	eventType, action := privacyStartEvent, "privacy-mode-started"
+	if active {
+		vehicle.position.clear()
+		fmt.Printf("Privacy mode on (%s), the location is not captured\n", source)
+	} else {
+		eventType, action = privacyEndEvent, "privacy-mode-ended"
+		data["since"] = previous.Since
+		data["seconds"] = int(time.Since(previous.Since).Seconds())
+		fmt.Printf("Privacy mode off (%s) after %s\n", source, time.Since(previous.Since).Round(time.Second))
+	}
+	if txID, err := vehicle.LogEvent(vehicle.NewEvent(eventType, data), true); err != nil {
+		fmt.Println("Failed to anchor the privacy mode marker", err)
+	} else {
+		fmt.Printf("Privacy mode marker secured to factom. TxID: %s\n", txID)
+	}
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	details["source"] = source
+	appendAudit(action, details)
+	return vehicle.privacyMode.current(), nil
+}
+
+// parseClock parses a "15:04" time of day into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected e.g. 18:30", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWeekday parses the first three letters of a day's English name
+func parseWeekday(value string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(value, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q, expected e.g. mon", value)
+}
+
+// validate checks the button and windows of a privacy config
+func (config *PrivacyConfig) validate() error {
+	for _, window := range config.Schedule {
+		if _, err := parseClock(window.Start); err != nil {
+			return fmt.Errorf("privacy schedule start: %v", err)
+		}
+		if _, err := parseClock(window.End); err != nil {
+			return fmt.Errorf("privacy schedule end: %v", err)
+		}
+		for _, day := range window.Days {
+			if _, err := parseWeekday(day); err != nil {
+				return fmt.Errorf("privacy schedule: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// contains reports whether the window covers local time t
+func (window PrivacyWindow) contains(t time.Time) bool {
+	start, _ := parseClock(window.Start)
+	end, _ := parseClock(window.End)
+	minute := t.Hour()*60 + t.Minute()
+	startDay := t
+	switch {
+	case start <= end && (minute < start || minute >= end):
+		return false
+	case start > end && minute < end:
+		// past midnight in a window that started the day before
+		startDay = t.AddDate(0, 0, -1)
+	case start > end && minute < start:
+		return false
+	}
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, day := range window.Days {
+		if weekday, err := parseWeekday(day); err == nil && weekday == startDay.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduled reports whether the schedule covers local time t
+func (config *PrivacyConfig) scheduled(t time.Time) bool {
+	for _, window := range config.Schedule {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchPrivacy switches privacy mode when the button is pressed and as the
+// schedule's windows begin and end. A window ending only turns off privacy
+// mode the schedule turned on, and one beginning while privacy mode was
+// turned off by hand within it waits for the next window.
+func (vehicle *Vehicle) WatchPrivacy(config *PrivacyConfig, stop <-chan struct{}) error {
+	pressed := false
+	scheduled := false
+	var checked time.Time
+	for {
+		if !sleep(usbPollInterval, stop) {
+			return nil
+		}
+		if config.Button != "" {
+			value, err := ioutil.ReadFile(config.Button)
+			if err != nil {
+				return fmt.Errorf("reading the privacy button: %v", err)
+			}
+			// buttons pull the line low when pressed, act on the press not the hold
+			down := strings.TrimSpace(string(value)) == "0"
+			if down && !pressed {
+				vehicle.SetPrivacyMode(!vehicle.privacyMode.active(), "button", nil)
+			}
+			pressed = down
+		}
+		if len(config.Schedule) == 0 || time.Since(checked) < privacyScheduleInterval {
+			continue
+		}
+		checked = time.Now()
+		now := config.scheduled(checked)
+		if now && !scheduled {
+			vehicle.SetPrivacyMode(true, "schedule", nil)
+		} else if !now && scheduled && vehicle.privacyMode.current().Source == "schedule" {
+			vehicle.SetPrivacyMode(false, "schedule", nil)
+		}
+		scheduled = now
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/FactomProject/factom"
+)
+
+// factomdNode is a minimal factomd v2 API client bound to a single endpoint.
+// The factom package only talks to one global server at a time, so quorum
+// verification needs its own client per node.
+type factomdNode struct {
+	url    string
+	client *http.Client
+}
+
+// newFactomdNode returns a client for the factomd API at server, where server
+// is either a host[:port] (like factom.SetFactomdServer takes) or a full URL
+func newFactomdNode(server string) *factomdNode {
+	return &factomdNode{url: factomdURL(server), client: &http.Client{Timeout: factomdTimeout}}
+}
+
+// factomdURL returns the v2 API URL of server, spelled the same for every way
+// of writing the same endpoint: scheme and host lower case, without the
+// scheme's default port or a trailing slash
+func factomdURL(server string) string {
+	raw := server
+	if lower := strings.ToLower(raw); !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(raw, "/") + "/v2"
+	}
+	u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if host, port, err := net.SplitHostPort(u.Host); err == nil &&
+		(u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443") {
+		u.Host = host
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	if !strings.HasSuffix(u.Path, "/v2") {
+		u.Path += "/v2"
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int         `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// rpcMissingChainHead is factomd's error code for a chain it doesn't know
+const rpcMissingChainHead = -32009
+
+// rpcError is an error factomd answered a request with
+type rpcError struct {
+	url, method string
+	code        int
+	message     string
+}
+
+func (err *rpcError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", err.url, err.method, err.message)
+}
+
+// call sends a single JSON-RPC request to the node and decodes its result
+func (node *factomdNode) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(jsonRPCRequest{JSONRPC: "2.0", ID: 0, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp, err := node.client.Post(node.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var rpcResp jsonRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("%s: %s: %v", node.url, method, err)
+	}
+	if rpcResp.Error != nil {
+		return &rpcError{url: node.url, method: method, code: rpcResp.Error.Code, message: rpcResp.Error.Message}
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
+
+// chainHead returns the KeyMR of the latest entry block in chainID
+func (node *factomdNode) chainHead(chainID string) (string, error) {
+	var result struct {
+		ChainHead string `json:"chainhead"`
+	}
+	err := node.call("chain-head", map[string]string{"chainid": chainID}, &result)
+	return result.ChainHead, err
+}
+
+// entryBlock returns the entry block with the given KeyMR
+func (node *factomdNode) entryBlock(keyMR string) (*factom.EBlock, error) {
+	eblock := new(factom.EBlock)
+	if err := node.call("entry-block", map[string]string{"keymr": keyMR}, eblock); err != nil {
+		return nil, err
+	}
+	return eblock, nil
+}
+
+// entry returns the entry with the given hash
+func (node *factomdNode) entry(entryHash string) (*factom.Entry, error) {
+	var result struct {
+		ChainID string   `json:"chainid"`
+		Content string   `json:"content"`
+		ExtIDs  []string `json:"extids"`
+	}
+	if err := node.call("entry", map[string]string{"hash": entryHash}, &result); err != nil {
+		return nil, err
+	}
+
+	entry := factom.Entry{ChainID: result.ChainID}
+	content, err := hex.DecodeString(result.Content)
+	if err != nil {
+		return nil, err
+	}
+	entry.Content = content
+	for _, extID := range result.ExtIDs {
+		b, err := hex.DecodeString(extID)
+		if err != nil {
+			return nil, err
+		}
+		entry.ExtIDs = append(entry.ExtIDs, b)
+	}
+	return &entry, nil
+}
+
+// receipt returns the receipt proving entryHash is included in the directory block
+func (node *factomdNode) receipt(entryHash string) (*factom.Receipt, error) {
+	var result struct {
+		Receipt *factom.Receipt `json:"receipt"`
+	}
+	if err := node.call("receipt", map[string]string{"hash": entryHash}, &result); err != nil {
+		return nil, err
+	}
+	if result.Receipt == nil {
+		return nil, fmt.Errorf("%s: no receipt for entry %s", node.url, entryHash)
+	}
+	return result.Receipt, nil
+}
+
+// quorumVote is what a single node claims about the entry holding a local hash.
+// Two nodes agree only if every field is identical.
+type quorumVote struct {
+	entryHash           string
+	content             string // hex SHA-256 of the entry's ExtIDs and content as the node returned them
+	entryBlockKeyMR     string
+	directoryBlockKeyMR string
+}
+
+// entryDigest returns the hex SHA-256 of an entry's ExtIDs, each prefixed by
+// its 2 byte length as in Factom's encoding, and its content
+func entryDigest(entry *factom.Entry) string {
+	h := sha256.New()
+	for _, ext := range entry.ExtIDs {
+		h.Write([]byte{byte(len(ext) >> 8), byte(len(ext))})
+		h.Write(ext)
+	}
+	h.Write(entry.Content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// vote asks the node where hash is anchored on the vehicle's chain. A nil vote
+// with a nil error means the node does not know of such an entry.
+func (node *factomdNode) vote(vehicle *Vehicle, hash []byte) (*quorumVote, *VerifyResult, error) {
+	result, err := findHashEntry(node, vehicle, hash)
+	if err != nil || !result.Verified {
+		return nil, result, err
+	}
+	entry, err := node.entry(result.EntryHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	receipt, err := node.receipt(result.EntryHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &quorumVote{
+		entryHash:           result.EntryHash,
+		content:             entryDigest(entry),
+		entryBlockKeyMR:     receipt.EntryBlockKeyMR,
+		directoryBlockKeyMR: receipt.DirectoryBlockKeyMR,
+	}, result, nil
+}
+
+// VerifyDataQuorum checks the integrity of a local file against several independent
+// factomd servers. The file is only considered verified if at least quorum servers
+// return the same entry, content, and receipt for its hash, so a single compromised
+// or out of sync API node can neither forge nor hide a match. A server listed
+// twice, however it is spelled, only votes once.
+func (vehicle *Vehicle) VerifyDataQuorum(filepath string, servers []string, quorum int) (*VerifyResult, error) {
+	if quorum < 2 {
+		return nil, errors.New("quorum verification requires at least 2 agreeing servers")
+	}
+	servers, err := distinctServers(servers)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) < quorum {
+		return nil, fmt.Errorf("quorum of %d requires at least %d servers, got %d", quorum, quorum, len(servers))
+	}
+	fmt.Println("Quorum verifying started...")
+	localHash, err := vehicle.getFileHash(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	votes := make(map[quorumVote]int)
+	for _, server := range servers {
+		vote, result, err := newFactomdNode(server).vote(vehicle, localHash)
+		if err != nil {
+			// an unreachable node simply doesn't vote
+			fmt.Printf("Quorum node %s failed: %v\n", server, err)
+			continue
+		}
+		if vote == nil {
+			continue
+		}
+		votes[*vote]++
+		if votes[*vote] >= quorum {
+			return result, nil
+		}
+	}
+	if len(votes) > 1 {
+		return nil, fmt.Errorf("factomd servers disagree on the entry for hash %x", localHash)
+	}
+	return &VerifyResult{Verified: false}, nil
+}
+
+// distinctServers returns the API URLs of servers, failing if two of them are
+// the same endpoint, which would let one node vote twice
+func distinctServers(servers []string) ([]string, error) {
+	seen := make(map[string]string)
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		u := factomdURL(strings.TrimSpace(server))
+		if first, ok := seen[u]; ok {
+			return nil, fmt.Errorf("quorum servers %s and %s are the same node", first, server)
+		}
+		seen[u] = server
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestFactomdURL(t *testing.T) {
+	tests := []struct {
+		server, want string
+	}{
+		{"localhost:8088", "http://localhost:8088/v2"},
+		{"http://localhost:8088", "http://localhost:8088/v2"},
+		{"http://localhost:8088/", "http://localhost:8088/v2"},
+		{"http://localhost:8088/v2", "http://localhost:8088/v2"},
+		{"HTTP://LocalHost:8088/v2/", "http://localhost:8088/v2"},
+		{"https://api.factomd.net:443", "https://api.factomd.net/v2"},
+		{"http://node.example:80/v2", "http://node.example/v2"},
+		{"https://node.example/factomd", "https://node.example/factomd/v2"},
+	}
+	for _, tt := range tests {
+		if got := factomdURL(tt.server); got != tt.want {
+			t.Errorf("factomdURL(%q) = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestDistinctServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		wantErr bool
+	}{
+		{"distinct", []string{"a.example:8088", "b.example:8088", "https://c.example"}, false},
+		{"same node twice", []string{"a.example:8088", "a.example:8088"}, true},
+		{"same node spelled differently", []string{"a.example:8088", "HTTP://A.example:8088/v2/"}, true},
+		{"default port", []string{"https://a.example", "https://a.example:443/"}, true},
+		{"other port", []string{"a.example:8088", "a.example:8089"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls, err := distinctServers(tt.servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if err == nil && len(urls) != len(tt.servers) {
+				t.Errorf("got %d servers, want %d", len(urls), len(tt.servers))
+			}
+		})
+	}
+}
+
+func TestVerifyDataQuorumDuplicateServer(t *testing.T) {
+	vehicle := &Vehicle{}
+	if _, err := vehicle.VerifyDataQuorum("missing", []string{"a.example:8088", "http://a.example:8088/v2"}, 2); err == nil {
+		t.Fatal("one node listed twice met a quorum of 2")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sambarnes/elmobd"
+)
+
+// Reading is a single named value in an OBD record. Value is "n/a" and Error
+// says why when the vehicle didn't answer.
+type Reading struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Units string `json:"units,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// OBDRecord is one sample of every PID and sensor, taken at Time
+type OBDRecord struct {
+	Time     time.Time `json:"time"`
+	Position string    `json:"position"`
+	Readings []Reading `json:"readings"`
+}
+
+// add appends the result of an OBD command, recording "n/a" and err if it failed
+func (record *OBDRecord) add(name string, cmd elmobd.OBDCommand, err error, units string) {
+	reading := Reading{Name: name, Value: obdLiteral(cmd), Units: units}
+	if cmd == nil {
+		if err == nil {
+			err = errOBDNoData
+		}
+		reading.Error = err.Error()
+	}
+	record.Readings = append(record.Readings, reading)
+}
+
+// Text formats the record the way it appears in exported segments
+func (record *OBDRecord) Text() string {
+	return string(record.appendText(make([]byte, 0, 64+48*len(record.Readings))))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// OBD sampling intervals
+const (
+	normalSampleInterval   = 1 * time.Second
+	highRateSampleInterval = 200 * time.Millisecond
+)
+
+// recorderState is shared between the OBD, GPS, and IMU recorders, which each
+// run on their own goroutine
+type recorderState struct {
+	mu            sync.Mutex
+	obdSegment    *Segment  // OBD segment being recorded
+	highRateUntil time.Time // sample at highRateSampleInterval until then
+	harshEvents   int       // harsh events not yet counted against a trip
+	imu           bool      // an IMU is recording and detects harsh events
+	recent        []string  // most recent OBD records, oldest first
+	latest        *OBDRecord
+	history       []*OBDRecord // OBD records of the last edrOBDHistory, for EDR pre-crash data
+	paused        bool         // recording stopped by the owner
+}
+
+// sampleInterval returns how long the OBD recorder should wait between samples
+func (s *recorderState) sampleInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.highRateUntil) {
+		return highRateSampleInterval
+	}
+	return normalSampleInterval
+}
+
+// boost switches to high-rate sampling for at least d
+func (s *recorderState) boost(d time.Duration) {
+	s.mu.Lock()
+	if until := time.Now().Add(d); until.After(s.highRateUntil) {
+		s.highRateUntil = until
+	}
+	s.mu.Unlock()
+}
+
+func (s *recorderState) setSegment(segment *Segment) {
+	s.mu.Lock()
+	s.obdSegment = segment
+	s.mu.Unlock()
+}
+
+// segment returns the OBD segment being recorded, or nil
+func (s *recorderState) segment() *Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.obdSegment
+}
+
+func (s *recorderState) addHarshEvent() {
+	s.mu.Lock()
+	s.harshEvents++
+	s.mu.Unlock()
+}
+
+// setIMU records whether an IMU is recording
+func (s *recorderState) setIMU(recording bool) {
+	s.mu.Lock()
+	s.imu = recording
+	s.mu.Unlock()
+}
+
+// imuRecording returns true while an IMU is recording, its harsh events then
+// being the only ones counted against trips
+func (s *recorderState) imuRecording() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.imu
+}
+
+// takeHarshEvents returns and resets the number of harsh events since the last call
+func (s *recorderState) takeHarshEvents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.harshEvents
+	s.harshEvents = 0
+	return n
+}
+
+// addRecord remembers an OBD record for incident snapshots
+func (s *recorderState) addRecord(record string) {
+	s.mu.Lock()
+	s.recent = append(s.recent, record)
+	if len(s.recent) > recentOBDRecords {
+		s.recent = s.recent[len(s.recent)-recentOBDRecords:]
+	}
+	s.mu.Unlock()
+}
+
+// setLatest remembers the most recent OBD record for status displays and
+// EDR pre-crash data
+func (s *recorderState) setLatest(record *OBDRecord) {
+	s.mu.Lock()
+	s.latest = record
+	s.history = append(s.history, record)
+	for len(s.history) > 0 && record.Time.Sub(s.history[0].Time) > edrOBDHistory {
+		s.history = s.history[1:]
+	}
+	s.mu.Unlock()
+}
+
+// recordsSince returns the OBD records taken since t, oldest first
+func (s *recorderState) recordsSince(t time.Time) []*OBDRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []*OBDRecord
+	for _, record := range s.history {
+		if !record.Time.Before(t) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// latestRecord returns the most recent OBD record, or nil
+func (s *recorderState) latestRecord() *OBDRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest
+}
+
+// setPaused stops or resumes OBD sampling
+func (s *recorderState) setPaused(paused bool) {
+	s.mu.Lock()
+	s.paused = paused
+	s.mu.Unlock()
+}
+
+func (s *recorderState) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// recentRecords returns a copy of the most recent OBD records
+func (s *recorderState) recentRecords() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.recent...)
+}
+
+// lockSegment marks the segment at path as evidence of an incident by creating
+// a "<path>.lock" file next to it. Locked segments are never pruned.
+func lockSegment(path string) error {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// isSegmentLocked returns true if lockSegment was called on path
+func isSegmentLocked(path string) bool {
+	_, err := os.Stat(path + ".lock")
+	return err == nil
+}
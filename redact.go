@@ -0,0 +1,352 @@
+package main
+
+// Field-level redaction of evidence exports. Every line of a telemetry
+// segment, each field of its header and each record's time, position and
+// readings, is a leaf of a Merkle tree salted line by line, and the tree's
+// root is anchored in the metadata of the segment's entry beside the hash of
+// the whole file. An export can then replace lines, e.g. every position, by
+// their leaf hash: the recipient recomputes the root from the lines shown and
+// the hashes of those redacted and checks it against the entry, learning
+// nothing of what was redacted as its salt stays on the device.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// fieldSeedsPath holds the seeds salting the field trees of segments. Like
+// speedOpeningsPath it never leaves the device, exports reveal the salts of
+// the lines they show.
+const fieldSeedsPath = "field_seeds.log"
+
+// Redactions with a meaning beyond the lines of telemetry segments
+const (
+	redactPosition = "position" // precise GPS, also withholding the events and incidents that carry it
+	redactVideo    = "video"    // footage, exported as proofs without their files
+)
+
+// redactedValue replaces the value of a redacted line in an exported segment
+const redactedValue = "[redacted]"
+
+// Redaction opens a segment exported with some of its lines redacted. Lines
+// lists every line of the exported file in order: a line shown has the salt
+// of its leaf, a redacted one the leaf's hash.
+type Redaction struct {
+	Fields []string       `json:"fields"` // what was redacted, as asked
+	Root   string         `json:"root"`   // hex root of the segment's field tree
+	Path   []MerkleStep   `json:"path,omitempty"`
+	Lines  []RedactedLine `json:"lines"`
+}
+
+// RedactedLine is the leaf of a line of a redacted export
+type RedactedLine struct {
+	Salt string `json:"salt,omitempty"` // hex, the line is shown
+	Hash string `json:"hash,omitempty"` // hex leaf hash, the line is redacted
+}
+
+// fieldSeed is a segment's seed as kept on the device
+type fieldSeed struct {
+	Hash string `json:"hash"` // hex SHA-256 of the segment
+	Seed string `json:"seed"` // hex
+}
+
+// parseRedaction splits a comma separated list of fields to redact
+func parseRedaction(value string) []string {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// redacts reports whether fields redact name, ignoring case
+func redacts(fields []string, name string) bool {
+	for _, field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineRedactions returns the fields redacting lines of telemetry segments
+func lineRedactions(fields []string) []string {
+	var lines []string
+	for _, field := range fields {
+		if !strings.EqualFold(field, redactVideo) {
+			lines = append(lines, field)
+		}
+	}
+	return lines
+}
+
+// redactedEvidenceData is what an evidence export redacting fields discloses,
+// the consent it needs from its recipient
+func redactedEvidenceData(fields []string) []string {
+	var categories []string
+	for _, category := range evidenceData {
+		if category == DataLocation && redacts(fields, redactPosition) || category == DataVideo && redacts(fields, redactVideo) {
+			continue
+		}
+		categories = append(categories, category)
+	}
+	return categories
+}
+
+// segmentLines splits a segment's text into the lines its field tree is over
+func segmentLines(text []byte) [][]byte {
+	lines := bytes.Split(text, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineField returns the name of the field on a line, "" for lines without
+// one such as a record's time and separators
+func lineField(line []byte) string {
+	if i := bytes.Index(line, []byte(": ")); i > 0 {
+		return string(line[:i])
+	}
+	return ""
+}
+
+// fieldLeaf hashes the leaf of a line
+func fieldLeaf(salt, line []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(salt)
+	h.Write(line)
+	return h.Sum(nil)
+}
+
+// fieldTree returns the Merkle tree over the lines of a segment's text
+func fieldTree(text, seed []byte) [][][]byte {
+	lines := segmentLines(text)
+	leaves := make([][]byte, len(lines))
+	for i, line := range lines {
+		leaves[i] = fieldLeaf(leafSalt(seed, i), line)
+	}
+	return merkleLevels(leaves)
+}
+
+// commitFields returns the root of the field tree over a segment's text and
+// the new seed salting it, to keep with keepFieldSeed once the segment is hashed
+func commitFields(text []byte) (string, []byte, error) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return "", nil, err
+	}
+	root := merkleRoot(fieldTree(text, seed))
+	if root == nil {
+		return "", nil, fmt.Errorf("the segment has no lines")
+	}
+	return hex.EncodeToString(root), seed, nil
+}
+
+var fieldSeedsMu sync.Mutex
+
+// keepFieldSeed keeps the seed of the segment with the given hash on the device
+func keepFieldSeed(hash string, seed []byte) error {
+	line, err := json.Marshal(fieldSeed{Hash: hash, Seed: hex.EncodeToString(seed)})
+	if err != nil {
+		return err
+	}
+	fieldSeedsMu.Lock()
+	defer fieldSeedsMu.Unlock()
+	file, err := os.OpenFile(fieldSeedsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// loadFieldSeed returns the seed of the segment with the given hash, nil if
+// none was kept
+func loadFieldSeed(hash string) ([]byte, error) {
+	fieldSeedsMu.Lock()
+	defer fieldSeedsMu.Unlock()
+	var seed []byte
+	err := forEachLine(fieldSeedsPath, func(line []byte) {
+		var kept fieldSeed
+		if json.Unmarshal(line, &kept) == nil && kept.Hash == hash {
+			seed, _ = hex.DecodeString(kept.Seed)
+		}
+	})
+	return seed, err
+}
+
+// commitSegmentFields sets meta.Fields to the root over the field roots of
+// segments, in the order of their hashes, and gives each segment the path
+// from its root to it. Entries with a segment that has no field tree commit
+// to none.
+func commitSegmentFields(meta *HashMeta, segments []*Segment) {
+	roots := make([][]byte, len(segments))
+	for i, segment := range segments {
+		root, err := hex.DecodeString(segment.Fields)
+		if err != nil || len(root) != sha256.Size {
+			return
+		}
+		roots[i] = root
+	}
+	levels := merkleLevels(roots)
+	meta.Fields = hex.EncodeToString(merkleRoot(levels))
+	for i, segment := range segments {
+		segment.FieldsPath = merklePath(levels, i)
+	}
+}
+
+// redactSegment returns the text of a telemetry segment with the lines of
+// fields replaced by redactedValue, and the Redaction opening it
+func redactSegment(segment *Segment, text []byte, fields []string) ([]byte, *Redaction, error) {
+	if segment.Fields == "" {
+		return nil, nil, fmt.Errorf("the segment has no field tree to redact it by")
+	}
+	seed, err := loadFieldSeed(segment.Hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading field seeds: %v", err)
+	} else if seed == nil {
+		return nil, nil, fmt.Errorf("the seed of the segment's field tree is missing")
+	}
+	levels := fieldTree(text, seed)
+	if hex.EncodeToString(merkleRoot(levels)) != segment.Fields {
+		return nil, nil, fmt.Errorf("the segment does not match its field tree")
+	}
+	redaction := &Redaction{Fields: fields, Root: segment.Fields, Path: segment.FieldsPath}
+	var out []byte
+	for i, line := range segmentLines(text) {
+		if field := lineField(line); field != "" && redacts(fields, field) {
+			redaction.Lines = append(redaction.Lines, RedactedLine{Hash: hex.EncodeToString(levels[0][i])})
+			line = []byte(field + ": " + redactedValue)
+		} else {
+			redaction.Lines = append(redaction.Lines, RedactedLine{Salt: hex.EncodeToString(leafSalt(seed, i))})
+		}
+		out = append(append(out, line...), '\n')
+	}
+	return out, redaction, nil
+}
+
+// VerifyRedaction checks the text of a redacted segment against the entry
+// anchoring it: the lines shown and the hashes of those redacted must rebuild
+// the segment's field tree, committed to by the entry's metadata, and the
+// entry must be signed by publicKey and hold the segment's hash.
+func VerifyRedaction(reader chainReader, proof *EvidenceProof, publicKey string, text []byte) error {
+	redaction := proof.Redaction
+	if redaction == nil {
+		return fmt.Errorf("the file is not redacted")
+	}
+	lines := segmentLines(text)
+	if len(lines) != len(redaction.Lines) {
+		return fmt.Errorf("the file has %d lines, the redaction %d", len(lines), len(redaction.Lines))
+	}
+	leaves := make([][]byte, len(lines))
+	for i, line := range redaction.Lines {
+		if line.Hash != "" {
+			leaf, err := hex.DecodeString(line.Hash)
+			if err != nil || len(leaf) != sha256.Size {
+				return fmt.Errorf("line %d: malformed hash", i+1)
+			}
+			leaves[i] = leaf
+			continue
+		}
+		salt, err := hex.DecodeString(line.Salt)
+		if err != nil || len(salt) != sha256.Size {
+			return fmt.Errorf("line %d: malformed salt", i+1)
+		}
+		leaves[i] = fieldLeaf(salt, lines[i])
+	}
+	root := merkleRoot(merkleLevels(leaves))
+	if hex.EncodeToString(root) != redaction.Root {
+		return fmt.Errorf("the lines do not rebuild the segment's field tree")
+	}
+	fields, err := merkleFold(root, redaction.Path)
+	if err != nil {
+		return err
+	}
+
+	entry, err := reader.entry(proof.EntryHash)
+	if err != nil {
+		return fmt.Errorf("looking up entry %s: %v", proof.EntryHash, err)
+	} else if entry == nil {
+		return fmt.Errorf("entry %s not found", proof.EntryHash)
+	}
+	if entry.ChainID != proof.ChainID {
+		return fmt.Errorf("entry %s is not on chain %s", proof.EntryHash, proof.ChainID)
+	}
+	parsed, err := parseHashEntry(entry)
+	if err != nil {
+		return fmt.Errorf("entry %s: %v", proof.EntryHash, err)
+	}
+	if parsed.meta == nil || parsed.meta.Fields != hex.EncodeToString(fields) {
+		return fmt.Errorf("entry %s does not commit to the segment's field tree", proof.EntryHash)
+	}
+	if hex.EncodeToString(parsed.key[:]) != publicKey {
+		return fmt.Errorf("entry %s is signed by %x, not %s", proof.EntryHash, parsed.key, publicKey)
+	}
+	if !ed.Verify(&parsed.key, parsed.signed, &parsed.signature) {
+		return fmt.Errorf("entry %s has a bad signature", proof.EntryHash)
+	}
+	for _, hash := range parsed.hashes {
+		if hex.EncodeToString(hash) == proof.SHA256 {
+			return nil
+		}
+	}
+	return fmt.Errorf("entry %s does not anchor %s", proof.EntryHash, proof.SHA256)
+}
+
+// verifyRedactionCommand checks every redacted file of an evidence export
+// against the chain
+func verifyRedactionCommand(vehicle *Vehicle, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox verify-redaction <export folder>")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(args[0], "manifest.json"))
+	if err != nil {
+		fmt.Println("Failed to read the manifest", err)
+		os.Exit(1)
+	}
+	var manifest EvidenceManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		fmt.Println("Malformed manifest", err)
+		os.Exit(1)
+	}
+	verified, failed := 0, 0
+	for i := range manifest.Proofs {
+		proof := &manifest.Proofs[i]
+		if proof.Redaction == nil {
+			continue
+		}
+		text, err := ioutil.ReadFile(filepath.Join(args[0], filepath.FromSlash(proof.File)))
+		if err == nil {
+			err = VerifyRedaction(vehicle.chain, proof, manifest.PublicKey, text)
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", proof.File, err)
+			failed++
+			continue
+		}
+		verified++
+	}
+	fmt.Printf("%d redacted files verified, %d failed\n", verified, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// registrationsPath records chain registrations committed but not yet seen on
+// chain, so calling Register again doesn't pay for the chain twice
+const registrationsPath = "registrations.json"
+
+// registrationPendingFor is how long a registration factomd doesn't
+// acknowledge may still be pending. Past it the commit is taken as lost and
+// made again.
+const registrationPendingFor = 10 * time.Minute
+
+// Statuses factomd's ack method reports for a commit or reveal it accepted.
+// Others, "Unknown" and "NotConfirmed", mean it may yet be lost.
+const (
+	ackTransactionACK  = "TransactionACK"
+	ackDBlockConfirmed = "DBlockConfirmed"
+)
+
+// errRegistrationPending is returned for a registration whose commit was
+// interrupted before factomd returned its transaction, within
+// registrationPendingFor of it
+var errRegistrationPending = errors.New("a registration of the chain may still be pending, try again later")
+
+// registrationMu serializes registrations, so concurrent calls can't both
+// commit the same chain
+var registrationMu sync.Mutex
+
+// ChainState is what is known of the registration of a chain
+type ChainState int
+
+const (
+	ChainUnknown   ChainState = iota // factomd couldn't be asked, e.g. it is unreachable
+	ChainAbsent                      // neither on chain nor pending, registering commits it
+	ChainPending                     // committed, or revealed and waiting for its block
+	ChainConfirmed                   // on chain
+)
+
+func (state ChainState) String() string {
+	switch state {
+	case ChainAbsent:
+		return "absent"
+	case ChainPending:
+		return "pending"
+	case ChainConfirmed:
+		return "confirmed"
+	}
+	return "unknown"
+}
+
+// chainState returns the state of the registration of chainID, taking
+// commits made here that factomd doesn't show yet as pending until
+// registerChain would commit them again
+func chainState(client ChainClient, chainID string) (ChainState, error) {
+	state, err := client.chainState(chainID)
+	if state != ChainAbsent {
+		return state, err
+	}
+	registrationMu.Lock()
+	defer registrationMu.Unlock()
+	pending, err := loadRegistrations()
+	if err != nil {
+		return ChainUnknown, fmt.Errorf("reading pending registrations: %v", err)
+	}
+	r := pending[chainID]
+	if r == nil {
+		return ChainAbsent, nil
+	}
+	committed, _, err := r.acknowledged(client)
+	if err != nil {
+		return ChainUnknown, err
+	}
+	if committed || time.Since(r.Started) < registrationPendingFor {
+		return ChainPending, nil
+	}
+	return ChainAbsent, nil
+}
+
+// printRegistration reports the state of what's chain after registering it,
+// with txID if it was committed just now
+func printRegistration(client ChainClient, what, chainID, txID string) {
+	state, err := chainState(client, chainID)
+	switch {
+	case err != nil:
+		fmt.Printf("%s registration state unknown: %v. ChainID: %s\n", what, err, chainID)
+	case txID != "":
+		fmt.Printf("%s registered, %s. TxID: %s\n", what, state, txID)
+	default:
+		fmt.Printf("%s registration %s. ChainID: %s\n", what, state, chainID)
+	}
+}
+
+// pendingRegistration is a chain registration made but not yet seen on chain
+type pendingRegistration struct {
+	ChainID string    `json:"chainID"`
+	TxID    string    `json:"txID,omitempty"` // empty until the commit returns
+	Started time.Time `json:"started"`
+}
+
+// commitAck is factomd's acknowledgement of a commit and its reveal
+type commitAck struct {
+	CommitData struct {
+		Status string `json:"status"`
+	} `json:"commitdata"`
+	EntryData struct {
+		Status string `json:"status"`
+	} `json:"entrydata"`
+}
+
+// acknowledged reports whether factomd accepted the commit, and whether it has
+// the reveal too
+func (r *pendingRegistration) acknowledged(client ChainClient) (committed, revealed bool, err error) {
+	if r.TxID == "" {
+		return false, false, nil
+	}
+	return client.commitAck(r.TxID)
+}
+
+// loadRegistrations reads the pending registrations by chain ID
+func loadRegistrations() (map[string]*pendingRegistration, error) {
+	pending := make(map[string]*pendingRegistration)
+	data, err := ioutil.ReadFile(registrationsPath)
+	if os.IsNotExist(err) {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*pendingRegistration
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, r := range list {
+		pending[r.ChainID] = r
+	}
+	return pending, nil
+}
+
+// saveRegistrations writes the pending registrations, removing the file once
+// there are none
+func saveRegistrations(pending map[string]*pendingRegistration) error {
+	if len(pending) == 0 {
+		if err := os.Remove(registrationsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	list := make([]*pendingRegistration, 0, len(pending))
+	for _, r := range pending {
+		list = append(list, r)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(registrationsPath, data)
+}
+
+// registerChain creates chainID by calling commit and, if not nil, reveal,
+// and returns the commit's txID, or "" if the chain already exists or is
+// waiting for its block. It is safe to call repeatedly: while an earlier
+// commit is pending its txID is returned instead of paying again, a commit
+// factomd accepted is only revealed, and nothing is committed while factomd
+// can't tell whether the chain exists.
+func registerChain(client ChainClient, chainID string, commit func() (string, error), reveal func() error) (string, error) {
+	state, err := client.chainState(chainID)
+	if err != nil {
+		return "", fmt.Errorf("looking up chain %s: %v", chainID, err)
+	}
+	registrationMu.Lock()
+	defer registrationMu.Unlock()
+	pending, err := loadRegistrations()
+	if err != nil {
+		return "", fmt.Errorf("reading pending registrations: %v", err)
+	}
+	if state != ChainAbsent {
+		if _, ok := pending[chainID]; ok && state == ChainConfirmed {
+			delete(pending, chainID)
+			if err := saveRegistrations(pending); err != nil {
+				return "", fmt.Errorf("recording registration of %s: %v", chainID, err)
+			}
+		}
+		return "", nil
+	}
+
+	if r := pending[chainID]; r != nil {
+		committed, revealed, err := r.acknowledged(client)
+		if err != nil {
+			return "", fmt.Errorf("checking the pending registration of %s: %v", chainID, err)
+		}
+		switch {
+		case committed && (revealed || reveal == nil):
+			return r.TxID, nil
+		case committed:
+			if err := reveal(); err != nil {
+				return "", err
+			}
+			return r.TxID, nil
+		case time.Since(r.Started) < registrationPendingFor:
+			if r.TxID == "" {
+				return "", errRegistrationPending
+			}
+			return r.TxID, nil
+		}
+		fmt.Printf("Registration of %s committed at %s was lost, committing again\n", chainID, r.Started.Format(time.RFC3339))
+	}
+
+	// recorded before committing, so an interrupted commit isn't made again
+	// while it may still be pending
+	r := &pendingRegistration{ChainID: chainID, Started: time.Now().UTC()}
+	pending[chainID] = r
+	if err := saveRegistrations(pending); err != nil {
+		return "", fmt.Errorf("recording registration of %s: %v", chainID, err)
+	}
+	txID, err := commit()
+	if err != nil {
+		delete(pending, chainID)
+		if saveErr := saveRegistrations(pending); saveErr != nil {
+			fmt.Println("Failed to record the failed registration", saveErr)
+		}
+		return "", err
+	}
+	r.TxID = txID
+	if err := saveRegistrations(pending); err != nil {
+		return "", fmt.Errorf("recording registration of %s: %v", chainID, err)
+	}
+	if reveal != nil {
+		if err := reveal(); err != nil {
+			return "", fmt.Errorf("revealing chain %s committed in %s, registering again reveals it: %v", chainID, txID, err)
+		}
+	}
+	return txID, nil
+}
+
+// registerChainPaid registers chain paid by ecAddress, retrying its commit and
+// reveal as defaultRetry allows
+func registerChainPaid(client ChainClient, chain *factom.Chain, ecAddress *factom.ECAddress) (string, error) {
+	commit := func() (string, error) {
+		var txID string
+		err := defaultRetry.do("Chain commit", func() (err error) {
+			txID, err = client.commitChain(chain, ecAddress)
+			return err
+		})
+		return txID, err
+	}
+	reveal := func() error {
+		return defaultRetry.do("Chain reveal", func() error {
+			_, err := client.revealChain(chain)
+			return err
+		})
+	}
+	return registerChain(client, chain.ChainID, commit, reveal)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// researchStatePath remembers the last day contributed, so no day is
+// contributed twice and spends its privacy budget again
+const researchStatePath = "research_state.json"
+
+// Research contribution settings. A day's contribution is bounded by clipping
+// the vehicle's totals over every region, so the most one vehicle-day can
+// change the statistics is known and the noise added hides it.
+const (
+	researchCheckInterval = time.Hour
+	researchBacklog       = 7                // days missed while off that are still contributed
+	researchTrackGap      = 10 * time.Second // consecutive positions further apart don't count as driving
+	researchMaxKm         = 1500.0           // distance a vehicle contributes per day at most
+	researchMaxHours      = 24.0
+	researchMaxEvents     = 50.0 // harsh events a vehicle contributes per day at most
+	researchMetrics       = 3    // noisy values per region, each spends a third of the budget
+	researchDefaultEps    = 1.0
+)
+
+// ResearchConfig opts the vehicle in to contributing anonymized, aggregated
+// statistics to a shared research endpoint. Only noisy per-region totals are
+// sent, without the VIN, chain or any identifier of the vehicle.
+type ResearchConfig struct {
+	URL     string   `json:"url"`     // shared endpoint the daily statistics are POSTed to
+	Token   string   `json:"token"`   // optional bearer token shared by every contributor
+	Regions []string `json:"regions"` // geohash cells reported on, the same for every contributor
+	Epsilon float64  `json:"epsilon"` // differential privacy budget spent on each day, default 1
+}
+
+// ResearchContribution is what is sent for one day: for every configured
+// region, noisy totals of distance, driving time and harsh events. Values may
+// be negative, the noise averages out over many contributors, so average
+// speed is total km over total hours and harsh-event rates total events over
+// total km.
+type ResearchContribution struct {
+	Day     string        `json:"day"` // UTC date, e.g. "2026-10-16"
+	Epsilon float64       `json:"epsilon"`
+	Regions []RegionStats `json:"regions"`
+}
+
+// RegionStats are a day's totals within one region
+type RegionStats struct {
+	Region      string  `json:"region"` // geohash cell
+	Km          float64 `json:"km"`
+	Hours       float64 `json:"hours"`
+	HarshEvents float64 `json:"harshEvents"`
+}
+
+// researchState is the last day contributed
+type researchState struct {
+	Day string `json:"day"`
+}
+
+// validate checks the research config, defaulting its budget
+func (config *ResearchConfig) validate() error {
+	if config.URL == "" {
+		return fmt.Errorf("research url is required")
+	}
+	if len(config.Regions) == 0 {
+		return fmt.Errorf("research regions are required, the same geohash cells for every contributor")
+	}
+	for _, region := range config.Regions {
+		if region == "" || strings.Trim(region, geohashAlphabet) != "" {
+			return fmt.Errorf("invalid research region %q, expected a geohash", region)
+		}
+	}
+	if config.Epsilon < 0 {
+		return fmt.Errorf("research epsilon must not be negative")
+	}
+	if config.Epsilon == 0 {
+		config.Epsilon = researchDefaultEps
+	}
+	return nil
+}
+
+// region returns the configured region containing a position, "" if none
+func (config *ResearchConfig) region(lat, lon float64) string {
+	for _, region := range config.Regions {
+		if strings.HasPrefix(geohash(lat, lon, len(region)), region) {
+			return region
+		}
+	}
+	return ""
+}
+
+// dayStats returns the exact totals of day in every configured region, from
+// the track log and the harsh events logged, clipped to the most a vehicle
+// contributes per day
+func (config *ResearchConfig) dayStats(day time.Time) ([]RegionStats, error) {
+	start, end := day, day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	track, err := readTrack(start, end)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	stats := make(map[string]*RegionStats, len(config.Regions))
+	for _, region := range config.Regions {
+		stats[region] = &RegionStats{Region: region}
+	}
+	for i := 1; i < len(track); i++ {
+		a, b := track[i-1], track[i]
+		gap := b.Time.Sub(a.Time)
+		if gap <= 0 || gap > researchTrackGap {
+			continue
+		}
+		if region := config.region(a.Lat, a.Lon); region != "" {
+			stats[region].Km += distanceMeters(a.Lat, a.Lon, b.Lat, b.Lon) / 1000
+			stats[region].Hours += gap.Hours()
+		}
+	}
+	err = readEvents("harsh-event", func() interface{} { return new(HarshEvent) }, func(data interface{}, _ *SignedEvent) {
+		event := data.(*HarshEvent)
+		if event.Time.Before(start) || event.Time.After(end) {
+			return
+		}
+		// the harsh event happened where the vehicle last was
+		for i := len(track) - 1; i >= 0; i-- {
+			if !track[i].Time.After(event.Time) {
+				if event.Time.Sub(track[i].Time) <= researchTrackGap {
+					if region := config.region(track[i].Lat, track[i].Lon); region != "" {
+						stats[region].HarshEvents++
+					}
+				}
+				break
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var km, hours, events float64
+	for _, s := range stats {
+		km, hours, events = km+s.Km, hours+s.Hours, events+s.HarshEvents
+	}
+	result := make([]RegionStats, 0, len(config.Regions))
+	for _, region := range config.Regions {
+		s := stats[region]
+		s.Km *= clipScale(km, researchMaxKm)
+		s.Hours *= clipScale(hours, researchMaxHours)
+		s.HarshEvents *= clipScale(events, researchMaxEvents)
+		result = append(result, *s)
+	}
+	return result, nil
+}
+
+// clipScale returns the factor scaling total down to at most max
+func clipScale(total, max float64) float64 {
+	if total <= max {
+		return 1
+	}
+	return max / total
+}
+
+// laplace returns noise from the Laplace distribution with scale b
+func laplace(b float64) (float64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	// uniform in (-0.5, 0.5), never exactly ±0.5
+	u := (float64(binary.BigEndian.Uint64(buf[:])>>11)+0.5)/(1<<53) - 0.5
+	return -b * math.Copysign(math.Log(1-2*math.Abs(u)), u), nil
+}
+
+// contribution adds noise to the exact stats of day. A vehicle-day changes
+// each metric's vector over regions by at most its clip in L1 norm, so noise
+// of scale clip/(epsilon/3) on every value makes the day epsilon-differentially
+// private.
+func (config *ResearchConfig) contribution(day time.Time, exact []RegionStats) (*ResearchContribution, error) {
+	contribution := &ResearchContribution{Day: day.Format("2006-01-02"), Epsilon: config.Epsilon}
+	perMetric := config.Epsilon / researchMetrics
+	for _, s := range exact {
+		noisy := RegionStats{Region: s.Region}
+		for _, metric := range []struct {
+			value, clip float64
+			out         *float64
+		}{
+			{s.Km, researchMaxKm, &noisy.Km},
+			{s.Hours, researchMaxHours, &noisy.Hours},
+			{s.HarshEvents, researchMaxEvents, &noisy.HarshEvents},
+		} {
+			noise, err := laplace(metric.clip / perMetric)
+			if err != nil {
+				return nil, err
+			}
+			*metric.out = round(metric.value+noise, 1)
+		}
+		contribution.Regions = append(contribution.Regions, noisy)
+	}
+	return contribution, nil
+}
+
+// send POSTs a contribution to the research endpoint, with no header or
+// field identifying the vehicle
+func (config *ResearchConfig) send(contribution *ResearchContribution, residency *ResidencyConfig) error {
+	req, err := http.NewRequest(http.MethodPost, config.URL, jsonBody(contribution))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "blackbox-research")
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	residency.guard(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("research endpoint replied %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// loadResearchState returns the last day contributed, "" if none
+func loadResearchState() (string, error) {
+	data, err := ioutil.ReadFile(researchStatePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var state researchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", fmt.Errorf("%s: %v", researchStatePath, err)
+	}
+	return state.Day, nil
+}
+
+// RunResearch contributes each finished UTC day's statistics once, including
+// days missed while the device was off up to a week back, until stop is
+// closed. A day is marked contributed before it is sent, so a failed send
+// loses the day rather than risking spending its budget twice.
+func (vehicle *Vehicle) RunResearch(config *ResearchConfig, residency *ResidencyConfig, stop <-chan struct{}) error {
+	for {
+		last, err := loadResearchState()
+		if err != nil {
+			return err
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		day := today.AddDate(0, 0, -researchBacklog)
+		if previous, err := time.Parse("2006-01-02", last); err == nil && !previous.Before(day) {
+			day = previous.AddDate(0, 0, 1)
+		}
+		for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+			exact, err := config.dayStats(day)
+			if err != nil {
+				return fmt.Errorf("computing research statistics: %v", err)
+			}
+			contribution, err := config.contribution(day, exact)
+			if err != nil {
+				return err
+			}
+			if err := writeSynced(researchStatePath, researchState{Day: contribution.Day}); err != nil {
+				return err
+			}
+			if err := config.send(contribution, residency); err != nil {
+				fmt.Printf("Failed to contribute research statistics of %s: %v\n", contribution.Day, err)
+				continue
+			}
+			appendAudit("research-contribution", map[string]interface{}{
+				"day": contribution.Day, "epsilon": contribution.Epsilon, "regions": len(contribution.Regions), "url": config.URL,
+			})
+			fmt.Printf("Contributed research statistics of %s\n", contribution.Day)
+		}
+		if !sleep(researchCheckInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// researchCommand previews the statistics a day contributes, the exact
+// totals next to one draw of the noisy values sent
+func researchCommand(config *Config, args []string) {
+	if len(args) == 0 || args[0] != "preview" {
+		fmt.Fprintln(os.Stderr, "usage: blackbox research preview [-day YYYY-MM-DD]")
+		os.Exit(2)
+	}
+	if config.Research == nil {
+		fmt.Println("Research contributions are not configured, set research in the config")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("research preview", flag.ExitOnError)
+	dayFlag := flags.String("day", "", "UTC day to preview (default: yesterday)")
+	flags.Parse(args[1:])
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if *dayFlag != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", *dayFlag); err != nil {
+			fmt.Println("Invalid day", err)
+			os.Exit(2)
+		}
+	}
+	exact, err := config.Research.dayStats(day)
+	if err != nil {
+		fmt.Println("Failed to compute the statistics", err)
+		os.Exit(1)
+	}
+	contribution, err := config.Research.contribution(day, exact)
+	if err != nil {
+		fmt.Println("Failed to add noise", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Statistics of %s, epsilon %g, sent to %s\n", contribution.Day, contribution.Epsilon, config.Research.URL)
+	fmt.Printf("%-12s  %18s  %18s  %18s\n", "region", "km (sent)", "hours (sent)", "harsh (sent)")
+	for i, s := range exact {
+		noisy := contribution.Regions[i]
+		fmt.Printf("%-12s  %8.1f (%7.1f)  %8.2f (%7.1f)  %8.0f (%7.1f)\n", s.Region, s.Km, noisy.Km, s.Hours, noisy.Hours, s.HarshEvents, noisy.HarshEvents)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ResidencyConfig pins where the device's data may be stored off the device:
+// the cloud upload of evidence, the fleet server it syncs with, the research
+// endpoint of anonymized statistics and the OpenTelemetry endpoint. Operators set it per vehicle in
+// the device config, or per fleet on the fleet server, which then refuses to
+// push a config sending data elsewhere.
+type ResidencyConfig struct {
+	Regions   []string `json:"regions"`   // upload regions, e.g. "eu-central-1" or "europe-west3", any if empty
+	Endpoints []string `json:"endpoints"` // host names uploads and fleet sync may reach, "*" matching any part, e.g. "*.s3.eu-central-1.amazonaws.com"; any if empty
+}
+
+// validate checks the residency config names something and its patterns parse
+func (r *ResidencyConfig) validate() error {
+	if len(r.Regions) == 0 && len(r.Endpoints) == 0 {
+		return fmt.Errorf("residency needs regions or endpoints")
+	}
+	for _, pattern := range r.Endpoints {
+		if _, err := path.Match(pattern, ""); err != nil || strings.ContainsAny(pattern, "/:") {
+			return fmt.Errorf("invalid residency endpoint %q, expected a host name pattern", pattern)
+		}
+	}
+	return nil
+}
+
+// allowsHost reports whether data may be sent to host, with or without a port
+func (r *ResidencyConfig) allowsHost(host string) bool {
+	if r == nil || len(r.Endpoints) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range r.Endpoints {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsRegion reports whether data may be stored in region
+func (r *ResidencyConfig) allowsRegion(region string) bool {
+	return r == nil || len(r.Regions) == 0 || contains(r.Regions, region)
+}
+
+// checkURL returns an error unless rawURL, where what is sent, is an allowed
+// endpoint
+func (r *ResidencyConfig) checkURL(what, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%s %q is not a URL", what, rawURL)
+	}
+	if !r.allowsHost(u.Host) {
+		return fmt.Errorf("%s %s is outside the residency endpoints %s", what, u.Host, strings.Join(r.Endpoints, ", "))
+	}
+	return nil
+}
+
+// check returns an error unless config only sends data where r allows: its
+// upload bucket's region and endpoint, its fleet server, research endpoint and
+// OpenTelemetry endpoint
+func (r *ResidencyConfig) check(config *Config) error {
+	if r == nil {
+		return nil
+	}
+	if upload := config.Upload; upload != nil {
+		endpoint, region, _, err := upload.target()
+		if err != nil {
+			return err
+		}
+		if !r.allowsRegion(region) {
+			return fmt.Errorf("upload region %s is outside the residency regions %s", region, strings.Join(r.Regions, ", "))
+		}
+		if err := r.checkURL("upload endpoint", endpoint); err != nil {
+			return err
+		}
+	}
+	if fleet := config.Fleet; fleet != nil {
+		if err := r.checkURL("fleet server", fleet.Server); err != nil {
+			return err
+		}
+	}
+	if research := config.Research; research != nil {
+		if err := r.checkURL("research endpoint", research.URL); err != nil {
+			return err
+		}
+	}
+	if otel := config.OTel; otel != nil {
+		if err := r.checkURL("otel endpoint", otel.Endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guard stops client from following redirects outside the residency
+// endpoints, which would send the request body along
+func (r *ResidencyConfig) guard(client *http.Client) {
+	if r == nil || len(r.Endpoints) == 0 {
+		return
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !r.allowsHost(req.URL.Host) {
+			return fmt.Errorf("refusing redirect to %s, outside the residency endpoints", req.URL.Host)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
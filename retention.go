@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetentionConfig sets how many days each kind of data is kept. Zero keeps it
+// forever. Locked data, such as segments around incidents, is never pruned.
+type RetentionConfig struct {
+	VideoDays int `json:"videoDays"`
+	OBDDays   int `json:"obdDays"`
+}
+
+// retentionInterval is how often the pruner runs
+const retentionInterval = time.Hour
+
+// RunRetention prunes expired data now and then every retentionInterval
+// until stop is closed
+func (vehicle *Vehicle) RunRetention(config RetentionConfig, stop <-chan struct{}) error {
+	for {
+		if err := vehicle.Prune(config, time.Now()); err != nil {
+			fmt.Println("Pruning failed", err)
+		}
+		if !sleep(retentionInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// Prune deletes data older than its retention period. Segments keep their
+// metadata (hash and txID) so the anchors stay meaningful, only the raw records
+// and the stored file are removed. Every deletion is recorded in the audit log.
+func (vehicle *Vehicle) Prune(config RetentionConfig, now time.Time) error {
+	cutoffs := make(map[string]time.Time)
+	if config.OBDDays > 0 {
+		cutoffs["obd"] = now.AddDate(0, 0, -config.OBDDays)
+	}
+	if config.VideoDays > 0 {
+		cutoff := now.AddDate(0, 0, -config.VideoDays)
+		cutoffs["video"] = cutoff
+		// loose files from before videos were indexed
+		for _, pattern := range []string{"*.h264", "*.h264" + encryptedExt} {
+			if err := pruneFiles(pattern, "video", cutoff); err != nil {
+				return err
+			}
+		}
+	}
+	return vehicle.pruneSegments(cutoffs, now)
+}
+
+// pruneSegments removes the records and files of segments that ended before
+// the cutoff of their stream. Files shared by a segment that is kept, or
+// locked, stay.
+func (vehicle *Vehicle) pruneSegments(cutoffs map[string]time.Time, now time.Time) error {
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, now)
+	if err != nil {
+		return err
+	}
+	expired := func(segment *Segment) bool {
+		cutoff, ok := cutoffs[segment.Stream]
+		return ok && !segment.End.IsZero() && segment.End.Before(cutoff) && !isSegmentLocked(segment.Path)
+	}
+	kept := make(map[string]bool)
+	for _, segment := range segments {
+		if !segment.Pruned && !expired(segment) {
+			kept[segment.Path] = true
+		}
+	}
+
+	for _, segment := range segments {
+		if segment.Pruned || !expired(segment) {
+			continue
+		}
+		deleted := 0
+		if segment.Stream == "obd" {
+			if deleted, err = vehicle.store.DeleteRecords(vehicle.vin, segment.Start, segment.End); err != nil {
+				return err
+			}
+		}
+		if segment.Path != "" && !kept[segment.Path] {
+			if err := os.Remove(segment.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		segment.Pruned = true
+		if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+			return err
+		}
+		appendAudit("prune", map[string]interface{}{
+			"stream":  segment.Stream,
+			"path":    segment.Path,
+			"start":   segment.Start,
+			"end":     segment.End,
+			"records": deleted,
+			"hash":    segment.Hash,
+		})
+	}
+	return nil
+}
+
+// pruneFiles removes unlocked files matching pattern last modified before cutoff
+func pruneFiles(pattern, stream string, cutoff time.Time) error {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) || isSegmentLocked(path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		appendAudit("prune", map[string]interface{}{
+			"stream":   stream,
+			"path":     path,
+			"modified": info.ModTime(),
+			"size":     info.Size(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/FactomProject/factom"
+)
+
+// defaultRetry is how factomd operations are retried. A failed commit or
+// reveal is usually a busy or briefly unreachable node, so it is tried again
+// a few times before the error is returned, and entries the vehicle anchors
+// are then left to its anchor queue.
+var defaultRetry = retryPolicy{attempts: 4, base: time.Second, max: 15 * time.Second}
+
+// queueRetry is how entries already in the anchor queue are sent. The queue
+// retries them every anchorRetryInterval, so a failure isn't retried at once.
+var queueRetry = retryPolicy{attempts: 1}
+
+// retryPolicy retries an operation with exponential backoff: the first retry
+// waits about base, each following one twice as long up to max. Waits are
+// jittered so recorders that lost the same node don't retry in step.
+type retryPolicy struct {
+	attempts int // tries in all, the first included
+	base     time.Duration
+	max      time.Duration
+}
+
+// do calls op until it succeeds or the policy's attempts are used up,
+// returning the last error. what names op in log lines and errors.
+func (policy retryPolicy) do(what string, op func() error) error {
+	wait := policy.base
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if attempt >= policy.attempts {
+			if attempt > 1 {
+				return fmt.Errorf("%s failed %d times: %v", what, attempt, err)
+			}
+			return err
+		}
+		fmt.Printf("%s attempt %d failed: %v\n", what, attempt, err)
+		time.Sleep(jitter(wait))
+		if wait *= 2; wait > policy.max {
+			wait = policy.max
+		}
+	}
+}
+
+// jitter returns a random duration between half of d and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// revealError is a reveal that failed after its commit was made. The entry is
+// paid for, revealing it later needs no new commit, so callers able to keep
+// txID reveal it again after checking the commit with commitAck.
+type revealError struct {
+	txID string
+	err  error
+}
+
+func (e *revealError) Error() string {
+	return e.err.Error()
+}
+
+// commitRevealChain commits chain, paid by ecAddress, and reveals it,
+// retrying each step as policy allows, so a reveal that fails is retried
+// without committing again. If every reveal fails the error is a
+// *revealError. A commit that failed is retried as a new commit, which pays
+// twice if factomd accepted the failed one but didn't answer in time.
+func commitRevealChain(client ChainClient, policy retryPolicy, chain *factom.Chain, ecAddress *factom.ECAddress) (string, error) {
+	var txID string
+	err := policy.do("Chain commit", func() (err error) {
+		txID, err = client.commitChain(chain, ecAddress)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = policy.do("Chain reveal", func() error {
+		_, err := client.revealChain(chain)
+		return err
+	})
+	if err != nil {
+		return "", &revealError{txID: txID, err: err}
+	}
+	return txID, nil
+}
+
+// commitRevealEntry commits entry, paid by ecAddress, and reveals it like
+// commitRevealChain
+func commitRevealEntry(client ChainClient, policy retryPolicy, entry *factom.Entry, ecAddress *factom.ECAddress) (string, error) {
+	var txID string
+	err := policy.do("Entry commit", func() (err error) {
+		txID, err = client.commitEntry(entry, ecAddress)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = policy.do("Entry reveal", func() error {
+		_, err := client.revealEntry(entry)
+		return err
+	})
+	if err != nil {
+		return "", &revealError{txID: txID, err: err}
+	}
+	return txID, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Periods a driving score covers
+const (
+	ScoreTrip  = "trip"
+	ScoreMonth = "month"
+)
+
+// ScoringConfig weighs driving behavior into a score out of 100. Each
+// penalty is taken off for every point of its measure.
+type ScoringConfig struct {
+	SpeedingKmh     float64 `json:"speedingKmh"`     // driving above this counts as speeding
+	SpeedingPenalty float64 `json:"speedingPenalty"` // per percent of driving time speeding
+	HarshPenalty    float64 `json:"harshPenalty"`    // per harsh event per 100 km
+	NightPenalty    float64 `json:"nightPenalty"`    // per percent of distance driven at night
+}
+
+// DrivingScore summarizes how a trip, or a month of trips, was driven. Scores
+// are logged as signed "driving-score" events and anchored, so an insurer or
+// parent can trust the score without the raw telemetry.
+type DrivingScore struct {
+	VIN           string    `json:"vin"`
+	Period        string    `json:"period"` // ScoreTrip or ScoreMonth
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Trips         int       `json:"trips"`
+	Distance      float64   `json:"distance"`      // km
+	SpeedingRatio float64   `json:"speedingRatio"` // share of driving time above SpeedingKmh
+	HarshPer100Km float64   `json:"harshPer100Km"`
+	NightShare    float64   `json:"nightShare"` // share of distance driven at night
+	Score         float64   `json:"score"`      // 0 to 100, higher is safer
+	Driver        string    `json:"driver,omitempty"`
+}
+
+// scoreTrips scores trips driven between start and end
+func scoreTrips(vin, period string, start, end time.Time, trips []*TripSummary, config ScoringConfig) *DrivingScore {
+	score := &DrivingScore{VIN: vin, Period: period, Start: start, End: end, Trips: len(trips)}
+	var duration, speeding, harsh, night float64
+	for _, trip := range trips {
+		score.Distance += trip.Distance
+		duration += trip.Duration
+		speeding += trip.Speeding
+		harsh += float64(trip.HarshEvents)
+		for _, day := range aggregateUBI([]*TripSummary{trip}, time.Local) {
+			night += day.NightKm
+		}
+	}
+	if duration > 0 {
+		score.SpeedingRatio = speeding / duration
+	}
+	if score.Distance > 0 {
+		score.HarshPer100Km = harsh / score.Distance * 100
+		score.NightShare = night / score.Distance
+	}
+	penalty := config.SpeedingPenalty*score.SpeedingRatio*100 +
+		config.HarshPenalty*score.HarshPer100Km +
+		config.NightPenalty*score.NightShare*100
+	score.Score = math.Max(0, 100-penalty)
+	return score
+}
+
+// monthStart returns the first instant of t's month in local time
+func monthStart(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+}
+
+// anchorScores logs and anchors the score of a trip that just ended and, if
+// it is the first trip of a month, the score of the month before
+func (vehicle *Vehicle) anchorScores(trip *TripSummary) {
+	score := scoreTrips(vehicle.vin, ScoreTrip, trip.Start, trip.End, []*TripSummary{trip}, vehicle.scoring)
+	score.Driver = trip.Driver
+	vehicle.anchorScore(score)
+
+	trips, err := loadTrips()
+	if err != nil {
+		fmt.Println("Failed to load trips for the monthly score", err)
+		return
+	}
+	// the trip just ended is the last one logged
+	if len(trips) < 2 {
+		return
+	}
+	previous := trips[len(trips)-2]
+	month := monthStart(previous.Start)
+	if !month.Before(monthStart(trip.Start)) {
+		return
+	}
+	next := month.AddDate(0, 1, 0)
+	var inMonth []*TripSummary
+	for _, t := range trips[:len(trips)-1] {
+		if !t.Start.Before(month) && t.Start.Before(next) {
+			inMonth = append(inMonth, t)
+		}
+	}
+	vehicle.anchorScore(scoreTrips(vehicle.vin, ScoreMonth, month, next, inMonth, vehicle.scoring))
+}
+
+func (vehicle *Vehicle) anchorScore(score *DrivingScore) {
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("driving-score", toEventData(score)), true)
+	if err != nil {
+		fmt.Println("Failed to anchor driving score", err)
+		return
+	}
+	fmt.Printf("Driving score %.0f for the %s secured to factom. TxID: %s\n", score.Score, score.Period, txID)
+}
+
+// loadScores returns the driving scores of the given period, or of any period
+// if it is empty, starting between from and to, from the event log, oldest first
+func loadScores(period string, from, to time.Time) ([]*DrivingScore, error) {
+	var scores []*DrivingScore
+	err := readEvents("driving-score", func() interface{} { return new(DrivingScore) }, func(data interface{}, _ *SignedEvent) {
+		score := data.(*DrivingScore)
+		if (period == "" || score.Period == period) && !score.Start.Before(from) && !score.Start.After(to) {
+			scores = append(scores, score)
+		}
+	})
+	return scores, err
+}
+
+// handleScores returns the anchored driving scores starting between the from
+// and to query parameters, of the period parameter (trip or month) if given
+func (vehicle *Vehicle) handleScores(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	start, end, err := queryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period != "" && period != ScoreTrip && period != ScoreMonth {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown period %q, expected trip or month", period))
+		return
+	}
+	scores, err := loadScores(period, start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if scores == nil {
+		scores = []*DrivingScore{}
+	}
+	writeJSON(w, http.StatusOK, scores)
+}
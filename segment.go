@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tempExt marks files still being written. They are renamed into place only
+// once complete, so a power cut never leaves a partial file under a final name.
+const tempExt = ".tmp"
+
+// writeAtomic writes data to path via a synced temp file and a rename
+func writeAtomic(path string, data []byte) error {
+	tmp := path + tempExt
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so a rename within it survives a power cut
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// newSegment starts a segment of stream at start, numbered after the stream's
+// previous segment. Path is provisional until the segment is finished.
+func (vehicle *Vehicle) newSegment(stream string, start time.Time) (*Segment, error) {
+	segment := &Segment{VIN: vehicle.vin, Stream: stream, Start: start, Driver: vehicle.drivers.activeKey()}
+	segment.ClockUncertain, segment.clockSkews = !vehicle.clock.certain(), vehicle.clock.skewCount()
+	if stream == "obd" {
+		segment.Compression = vehicle.compression
+	}
+	if vehicle.store != nil {
+		seq, err := vehicle.store.NextSeq(vehicle.vin, stream)
+		if err != nil {
+			return nil, err
+		}
+		segment.Seq = seq
+	}
+	segment.Header = vehicle.segmentHeader(segment)
+	segment.Path = segment.FileName()
+	return segment, nil
+}
+
+// FileName returns the segment's name outside the content addressed store,
+// <vin>_<stream>_<seq>_<start>.<ext>, e.g. in exports and uploads
+func (segment *Segment) FileName() string {
+	return fmt.Sprintf("%s_%s_%06d_%s%s", segment.VIN, segment.Stream, segment.Seq,
+		segment.Start.UTC().Format("20060102T150405Z"), segmentExt(segment))
+}
+
+// finishSegment exports a segment ending at segment.End from the database,
+// writes it, anchors its hash, and marks it complete in the store
+func (vehicle *Vehicle) finishSegment(segment *Segment) error {
+	hash, err := vehicle.hashSegment(segment)
+	if err != nil {
+		return err
+	}
+	return vehicle.anchorSegment(segment, hash)
+}
+
+// hashSegment writes a closed segment to the object store and records its
+// hash. Telemetry segments are exported from the database, footage was
+// written by its producer.
+func (vehicle *Vehicle) hashSegment(segment *Segment) ([]byte, error) {
+	if vehicle.clock.skewCount() != segment.clockSkews {
+		segment.ClockUncertain = true
+	}
+	if segment.Stream == "video" {
+		return vehicle.hashVideoSegment(segment)
+	}
+	export, count, err := vehicle.store.ExportSegment(vehicle.vin, segment, segment.End)
+	if err != nil {
+		return nil, err
+	}
+	fields, seed, err := commitFields(export)
+	if err != nil {
+		return nil, err
+	}
+	if export, err = compress(export, segment.Compression); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(export)
+	if vehicle.hashOnly() {
+		// out of space or too far behind, anchor the hash but drop the raw records
+		if _, err := vehicle.store.DeleteRecords(vehicle.vin, segment.Start, segment.End); err != nil {
+			return nil, err
+		}
+		segment.Path = ""
+		segment.Pruned = true
+	} else {
+		// the segment was recorded under a provisional name, carry its lock over
+		locked := isSegmentLocked(segment.Path)
+		if _, segment.Path, err = vehicle.putObject(export); err != nil {
+			return nil, err
+		}
+		// the seed is kept before the segment records its root, a root that
+		// can't be opened redacts nothing
+		if err := keepFieldSeed(hex.EncodeToString(hash[:]), seed); err != nil {
+			return nil, err
+		}
+		segment.Fields = fields
+		if locked {
+			if err := lockSegment(segment.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// record the hash first, if anchoring is interrupted the queued entry is
+	// matched back to the segment by it
+	segment.Records = count
+	segment.Hash = hex.EncodeToString(hash[:])
+	if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+		return nil, err
+	}
+	return hash[:], nil
+}
+
+// anchorSegment anchors a hashed segment and records the transaction
+func (vehicle *Vehicle) anchorSegment(segment *Segment, hash []byte) error {
+	segments := []*Segment{segment}
+	return vehicle.recordAnchor(segments, <-vehicle.anchorSegmentsAsync(segments, [][]byte{hash}))
+}
+
+// anchorSegmentsAsync starts anchoring the hashes of segments of one stream,
+// a single hash in an entry of its own, several in one entry listing them.
+// ExtIDs = [0]:signature of hashes+meta, [1]:public key, [2]:JSON meta
+func (vehicle *Vehicle) anchorSegmentsAsync(segments []*Segment, hashes [][]byte) <-chan AnchorResult {
+	meta := &HashMeta{Stream: segments[0].Stream, Compression: segments[0].Compression, Driver: segments[0].Driver, ClockUncertain: segments[0].ClockUncertain}
+	if len(hashes) > 1 {
+		meta.Hashes = len(hashes)
+	}
+	commitSegmentFields(meta, segments)
+	return vehicle.AnchorAsyncWithMeta(bytes.Join(hashes, nil), meta)
+}
+
+// recordAnchor records the transaction anchoring segments on each of them
+func (vehicle *Vehicle) recordAnchor(segments []*Segment, result AnchorResult) error {
+	if result.Err != nil {
+		return result.Err
+	}
+	for _, segment := range segments {
+		segment.TxID = result.TxID
+		if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+			return err
+		}
+	}
+	if len(segments) == 1 {
+		fmt.Printf("File secured to factom. TxID: %s\n", result.TxID)
+	} else {
+		fmt.Printf("%d %s segments secured to factom. TxID: %s\n", len(segments), segments[0].Stream, result.TxID)
+	}
+	return nil
+}
+
+// recoverSegments finishes segments left open by a crash or power cut. The
+// store's open segments are the journal: each is closed at its last record and
+// written and anchored as if recording had ended normally. Leftover temp files
+// are removed, they were never anchored.
+func (vehicle *Vehicle) recoverSegments() error {
+	temps, err := filepath.Glob("*" + tempExt)
+	if err != nil {
+		return err
+	}
+	for _, path := range temps {
+		fmt.Printf("Removing partial file %s\n", path)
+		os.Remove(path)
+	}
+
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if !segment.End.IsZero() {
+			continue
+		}
+		records, err := vehicle.store.Records(vehicle.vin, segment.Start, time.Now())
+		if err != nil {
+			return err
+		}
+		segment.End = segment.Start
+		if len(records) > 0 {
+			segment.End = records[len(records)-1].Time
+		}
+		fmt.Printf("Recovering interrupted %s segment started %s\n", segment.Stream, segment.Start.Format(time.RFC3339))
+		if err := vehicle.finishSegment(segment); err != nil {
+			return err
+		}
+		appendAudit("recover-segment", map[string]interface{}{
+			"stream":  segment.Stream,
+			"start":   segment.Start,
+			"end":     segment.End,
+			"records": segment.Records,
+			"hash":    segment.Hash,
+		})
+	}
+	return nil
+}
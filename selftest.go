@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sambarnes/elmobd"
+)
+
+// SelfTestConfig sets the drive the self test records
+type SelfTestConfig struct {
+	Samples       int           // OBD samples of the scripted drive, the engine stopping at the last
+	VideoKB       int           // footage per synthetic video segment, 0 for no video
+	VideoInterval time.Duration // between video segments
+}
+
+// SelfTestReport is the outcome of a self test. It passed if Failures is empty.
+type SelfTestReport struct {
+	Samples  int      // OBD samples recorded
+	Segments int      // segments that left the pipeline
+	Anchored int      // of them, anchored
+	Verified int      // of them, whose file was found on chain
+	Failures []string // what went wrong, in order
+}
+
+func (report *SelfTestReport) fail(format string, args ...interface{}) {
+	report.Failures = append(report.Failures, fmt.Sprintf(format, args...))
+}
+
+// scriptedOBD is an OBDDevice answering a scripted drive, each sample taking
+// the PID answers of the next frame and the last frame repeated once the
+// script has run out
+type scriptedOBD struct {
+	frames []map[byte][]byte // mode 01 data bytes by PID, a PID missing answers no data
+	done   chan struct{}     // closed once every frame has been sampled
+	once   sync.Once
+}
+
+// newScriptedOBD returns an OBDDevice answering frames
+func newScriptedOBD(frames []map[byte][]byte) *scriptedOBD {
+	return &scriptedOBD{frames: frames, done: make(chan struct{})}
+}
+
+// Open starts the script over
+func (dev *scriptedOBD) Open(cmds []elmobd.OBDCommand) (obdReader, error) {
+	return &scriptedReader{dev: dev}, nil
+}
+
+// scriptedReader samples a scriptedOBD
+type scriptedReader struct {
+	dev     *scriptedOBD
+	next    int
+	results []elmobd.OBDCommand
+	errs    []error
+}
+
+func (r *scriptedReader) sample(cmds []elmobd.OBDCommand) ([]elmobd.OBDCommand, []error, error) {
+	frames := r.dev.frames
+	if len(frames) == 0 {
+		return nil, nil, fmt.Errorf("empty OBD script")
+	}
+	frame := frames[len(frames)-1]
+	if r.next < len(frames) {
+		frame = frames[r.next]
+		r.next++
+	}
+	if r.next == len(frames) {
+		r.dev.once.Do(func() { close(r.dev.done) })
+	}
+
+	r.results = append(r.results[:0], cmds...)
+	r.errs = r.errs[:0]
+	for i, cmd := range cmds {
+		r.errs = append(r.errs, nil)
+		pid := byte(cmd.ParameterID())
+		data, ok := frame[pid]
+		if !ok {
+			r.results[i], r.errs[i] = nil, errOBDNoData
+			continue
+		}
+		// answered like an adapter would, for elmobd to decode
+		line := append([]byte{0x41, pid}, data...)
+		result, err := elmobd.NewResult(fmt.Sprintf("% X", line))
+		if err == nil {
+			err = cmd.SetValue(result)
+		}
+		if err != nil {
+			r.results[i], r.errs[i] = nil, err
+		}
+	}
+	return r.results, r.errs, nil
+}
+
+// troubleCodes reports none, the scripted vehicle is healthy
+func (r *scriptedReader) troubleCodes() ([]string, error) { return nil, nil }
+
+// freezeFrame reports none, the scripted vehicle has no stored codes
+func (r *scriptedReader) freezeFrame(cmds []elmobd.OBDCommand) (string, []elmobd.OBDCommand, error) {
+	return "", nil, nil
+}
+
+func (r *scriptedReader) Close() error { return nil }
+
+// scriptedDrive returns the frames of a drive of n samples: idling, speeding
+// up to 90 km/h, cruising, braking to a stop and turning the engine off at
+// the last sample
+func scriptedDrive(n int) []map[byte][]byte {
+	frames := make([]map[byte][]byte, n)
+	for i := range frames {
+		speed, rpm := 0, 800
+		switch phase := float64(i) / float64(n-1); {
+		case phase < 0.1:
+		case phase < 0.4:
+			speed = int(90 * (phase - 0.1) / 0.3)
+		case phase < 0.7:
+			speed = 90
+		default:
+			speed = int(90 * (1 - phase) / 0.3)
+		}
+		if speed > 0 {
+			rpm = 800 + speed*25
+		}
+		if i == n-1 {
+			speed, rpm = 0, 0
+		}
+		frames[i] = map[byte][]byte{
+			0x1F: {byte(i >> 8), byte(i)},                // runtime since start, seconds
+			0x0D: {byte(speed)},                          // vehicle speed, km/h
+			0x0C: {byte(rpm * 4 >> 8), byte(rpm * 4)},    // engine RPM, quarters
+			0x11: {byte(speed * 255 / 100)},              // throttle position
+			0x05: {90 + 40},                              // coolant temperature, +40 C
+			0x04: {byte(speed * 255 / 150)},              // engine load
+			0x42: {byte(13800 >> 8), byte(13800 & 0xff)}, // control module voltage, mV
+		}
+	}
+	return frames
+}
+
+// RunSelfTest records config's scripted drive, and synthetic footage if
+// configured, through the whole recording path, anchors it to a chain kept in
+// memory and verifies every segment against that chain, and that a tampered
+// copy of one fails verification. No adapter, camera or factomd is needed,
+// so it runs alike on a development machine and on the recorder itself. It
+// works in a temporary directory, signing with owner's key.
+func RunSelfTest(owner *Person, config SelfTestConfig) (*SelfTestReport, error) {
+	if config.Samples < 2 {
+		return nil, fmt.Errorf("the drive needs at least 2 samples, got %d", config.Samples)
+	}
+	dir, err := ioutil.TempDir("", "blackbox-selftest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	// segments and objects are written relative to the working directory
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+	defer os.Chdir(wd)
+
+	vehicle, err := newSelfTestVehicle(dir, owner, newMemoryChain())
+	if err != nil {
+		return nil, err
+	}
+	defer vehicle.store.Close()
+
+	report := &SelfTestReport{Samples: config.Samples}
+	results := recordSelfTest(vehicle, config, report)
+	report.Segments = len(results)
+	if report.Segments == 0 {
+		report.fail("no segment was recorded")
+	}
+	var tamperWith string
+	for _, result := range results {
+		segment := result.Segment
+		if result.Err != nil {
+			report.fail("%s segment from %s: %v", segment.Stream, segment.Start.Format(time.RFC3339), result.Err)
+			continue
+		}
+		report.Anchored++
+		if segment.Path == "" {
+			continue
+		}
+		verified, err := vehicle.VerifyData(segment.Path)
+		if err != nil {
+			report.fail("verifying %s: %v", segment.Path, err)
+		} else if !verified.Verified {
+			report.fail("%s is not on chain", segment.Path)
+		} else {
+			report.Verified++
+			tamperWith = segment.Path
+		}
+	}
+	if tamperWith != "" {
+		if err := checkTamperDetected(vehicle, tamperWith); err != nil {
+			report.fail("%v", err)
+		}
+	}
+	return report, nil
+}
+
+// newSelfTestVehicle returns the self test's vehicle owned by owner, its
+// database and anchor queue in dir and its chain registered on chain
+func newSelfTestVehicle(dir string, owner *Person, chain ChainClient) (*Vehicle, error) {
+	vehicle, err := NewVehicle(benchVIN, chain)
+	if err != nil {
+		return nil, err
+	}
+	vehicle.owner = owner
+	if vehicle.store, err = OpenStore(filepath.Join(dir, "selftest.db")); err != nil {
+		return nil, err
+	}
+	if vehicle.anchors, err = openAnchorQueue(filepath.Join(dir, anchorQueuePath)); err != nil {
+		vehicle.store.Close()
+		return nil, err
+	}
+	if _, err := vehicle.Register(owner.ecAddress); err != nil {
+		vehicle.store.Close()
+		return nil, fmt.Errorf("registering the vehicle's chain: %v", err)
+	}
+	return vehicle, nil
+}
+
+// recordSelfTest records config's scripted drive, and footage if configured,
+// through the vehicle's pipeline and returns every segment that left it,
+// adding what went wrong while recording to report
+func recordSelfTest(vehicle *Vehicle, config SelfTestConfig, report *SelfTestReport) []SegmentResult {
+	obd := newScriptedOBD(scriptedDrive(config.Samples))
+	vehicle.obd = obd
+	vehicle.pipeline = newPipeline(vehicle, nil)
+	var results []SegmentResult
+	counted := make(chan struct{})
+	go func() {
+		for result := range vehicle.pipeline.SubscribeSegments() {
+			results = append(results, result)
+		}
+		close(counted)
+	}()
+
+	// sampled at the high rate so the drive takes seconds, not minutes
+	vehicle.recorder.boost(time.Duration(config.Samples+10) * highRateSampleInterval)
+	stop := make(chan struct{})
+	var producers sync.WaitGroup
+	var recordErr error
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		recordErr = vehicle.RecordOBD(stop)
+	}()
+	if config.VideoKB > 0 {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			vehicle.produceFootage(config.VideoKB, config.VideoInterval, stop)
+		}()
+	}
+	select {
+	case <-obd.done:
+	case <-time.After(time.Duration(config.Samples) * 2 * normalSampleInterval):
+		report.fail("the drive was not recorded in time")
+	}
+	close(stop)
+	producers.Wait()
+	if recordErr != nil {
+		report.fail("recording OBD: %v", recordErr)
+	}
+	vehicle.pipeline.close()
+	<-counted
+	return results
+}
+
+// checkTamperDetected verifies a copy of the evidence file at path with a byte
+// changed, and returns an error unless it fails verification
+func checkTamperDetected(vehicle *Vehicle, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading %s to tamper with: %v", path, err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	data[len(data)/2] ^= 0xff
+	tampered := path + ".tampered"
+	if err := ioutil.WriteFile(tampered, data, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(tampered)
+	result, err := vehicle.VerifyData(tampered)
+	if err == nil && result.Verified {
+		return fmt.Errorf("a tampered copy of %s verified", path)
+	}
+	return nil
+}
+
+// printSelfTest prints the report and whether the self test passed
+func printSelfTest(report *SelfTestReport) {
+	fmt.Printf("Samples recorded: %d\n", report.Samples)
+	fmt.Printf("Segments: %d, anchored: %d, verified on chain: %d\n", report.Segments, report.Anchored, report.Verified)
+	if len(report.Failures) == 0 {
+		fmt.Println("Self test passed")
+		return
+	}
+	for _, failure := range report.Failures {
+		fmt.Println("FAIL:", failure)
+	}
+	fmt.Printf("Self test failed, %d problems\n", len(report.Failures))
+}
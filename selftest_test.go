@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// testOwner returns a person with a new key
+func testOwner(t testing.TB) *Person {
+	t.Helper()
+	pub, sec, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Person{ecAddress: &factom.ECAddress{Pub: pub, Sec: sec}}
+}
+
+// inTempDir runs the test in a directory of its own, as segments are written
+// relative to the working directory
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// anchoringEntry returns the hash of the entry on chain anchoring hash, found
+// without findHashEntry
+func anchoringEntry(chain *memoryChain, hash []byte) string {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	for entryHash, entry := range chain.entries {
+		fields, err := parseHashEntry(entry)
+		if err != nil {
+			continue
+		}
+		for _, anchored := range fields.hashes {
+			if bytes.Equal(anchored, hash) {
+				return entryHash
+			}
+		}
+	}
+	return ""
+}
+
+func TestSelfTestRecordAnchorVerify(t *testing.T) {
+	dir := inTempDir(t)
+	chain := newMemoryChain()
+	vehicle, err := newSelfTestVehicle(dir, testOwner(t), chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vehicle.store.Close()
+
+	report := &SelfTestReport{Samples: 20}
+	results := recordSelfTest(vehicle, SelfTestConfig{Samples: 20, VideoKB: 16, VideoInterval: 200 * time.Millisecond}, report)
+	if len(report.Failures) > 0 {
+		t.Fatalf("recording failed: %v", report.Failures)
+	}
+	if len(results) == 0 {
+		t.Fatal("no segment left the pipeline")
+	}
+	verified := 0
+	var tamperWith string
+	for _, result := range results {
+		segment := result.Segment
+		if result.Err != nil {
+			t.Fatalf("%s segment %d: %v", segment.Stream, segment.Seq, result.Err)
+		}
+		if segment.Path == "" {
+			continue
+		}
+		hash, err := hex.DecodeString(segment.Hash)
+		if err != nil || len(hash) == 0 {
+			t.Fatalf("%s: bad hash %q", segment.Path, segment.Hash)
+		}
+		want := anchoringEntry(chain, hash)
+		if want == "" {
+			t.Fatalf("%s: no entry on chain anchors %s", segment.Path, segment.Hash)
+		}
+		got, err := vehicle.VerifyData(segment.Path)
+		if err != nil {
+			t.Fatalf("verifying %s: %v", segment.Path, err)
+		}
+		if !got.Verified {
+			t.Fatalf("%s did not verify", segment.Path)
+		}
+		if got.EntryHash != want {
+			t.Errorf("%s verified against entry %s, want %s", segment.Path, got.EntryHash, want)
+		}
+		verified++
+		tamperWith = segment.Path
+	}
+	if verified == 0 {
+		t.Fatal("no segment file was verified")
+	}
+
+	data, err := ioutil.ReadFile(tamperWith)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	tampered := tamperWith + ".tampered"
+	if err := ioutil.WriteFile(tampered, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := vehicle.VerifyData(tampered); err == nil && got.Verified {
+		t.Errorf("a tampered copy of %s verified against entry %s", tamperWith, got.EntryHash)
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	report, err := RunSelfTest(testOwner(t), SelfTestConfig{Samples: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failures) > 0 {
+		t.Fatalf("self test failed: %v", report.Failures)
+	}
+	if report.Verified == 0 || report.Verified != report.Anchored {
+		t.Errorf("%d of %d anchored segments verified", report.Verified, report.Anchored)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sensor is any extra source of readings logged in OBD segments alongside the
+// vehicle's own PIDs, e.g. a trailer scale or refrigeration thermometer
+type Sensor interface {
+	Name() string             // label used in records, e.g. "Trailer Temp"
+	Units() string            // units of the sampled value, e.g. "C"
+	Sample() (float64, error) // take a reading now
+}
+
+// SensorConfig configures one sensor in the config file. Options are passed
+// untouched to the factory registered for Kind.
+type SensorConfig struct {
+	Kind    string          `json:"kind"`
+	Name    string          `json:"name"`
+	Units   string          `json:"units"`
+	Options json.RawMessage `json:"options"`
+}
+
+// SensorFactory creates the sensors described by a config entry
+type SensorFactory func(config SensorConfig) ([]Sensor, error)
+
+var (
+	sensorTypesMu sync.Mutex
+	sensorTypes   = map[string]SensorFactory{}
+)
+
+// RegisterSensorType makes a kind of sensor available to the config file.
+// Programs embedding blackbox call it from init to add their own hardware.
+func RegisterSensorType(kind string, factory SensorFactory) {
+	sensorTypesMu.Lock()
+	sensorTypes[kind] = factory
+	sensorTypesMu.Unlock()
+}
+
+// NewSensors creates the sensors for a config entry using its registered factory
+func NewSensors(config SensorConfig) ([]Sensor, error) {
+	sensorTypesMu.Lock()
+	factory, ok := sensorTypes[config.Kind]
+	sensorTypesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sensor kind %q", config.Kind)
+	}
+	return factory(config)
+}
+
+// RegisterSensor adds a sensor whose readings are logged in every OBD record.
+// Sensors must be registered before recording starts.
+func (vehicle *Vehicle) RegisterSensor(sensor Sensor) {
+	vehicle.sensors = append(vehicle.sensors, sensor)
+}
+
+// sampleSensors appends a reading from every registered sensor to the readings
+// of an OBD record. A failed reading is recorded as such rather than skipped.
+func (vehicle *Vehicle) sampleSensors(readings []Reading) []Reading {
+	for _, sensor := range vehicle.sensors {
+		value, err := sensor.Sample()
+		if err != nil {
+			readings = append(readings, Reading{Name: sensor.Name(), Value: fmt.Sprintf("error (%v)", err)})
+			continue
+		}
+		readings = append(readings, Reading{Name: sensor.Name(), Value: strconv.FormatFloat(value, 'f', -1, 64), Units: sensor.Units()})
+	}
+	return readings
+}
+
+/*
+ * Built in sensors
+ */
+
+func init() {
+	RegisterSensorType("file", newFileSensor)
+	RegisterSensorType("bmp280", newBMP280Sensors)
+}
+
+// fileSensor reads a number from a file, which covers most sysfs drivers such as
+// 1-Wire thermometers (/sys/bus/w1/devices/28-*/temperature) and IIO ADCs
+type fileSensor struct {
+	name  string
+	units string
+	path  string
+	scale float64
+}
+
+func newFileSensor(config SensorConfig) ([]Sensor, error) {
+	var options struct {
+		Path  string  `json:"path"`
+		Scale float64 `json:"scale"`
+	}
+	if err := json.Unmarshal(config.Options, &options); err != nil {
+		return nil, err
+	}
+	if options.Scale == 0 {
+		options.Scale = 1
+	}
+	return []Sensor{&fileSensor{name: config.Name, units: config.Units, path: options.Path, scale: options.Scale}}, nil
+}
+
+func (s *fileSensor) Name() string  { return s.name }
+func (s *fileSensor) Units() string { return s.units }
+
+func (s *fileSensor) Sample() (float64, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * s.scale, nil
+}
+
+// bmp280Sensor exposes one of the two values a BMP280 measures
+type bmp280Sensor struct {
+	bmp      *BMP280
+	name     string
+	units    string
+	pressure bool
+}
+
+func newBMP280Sensors(config SensorConfig) ([]Sensor, error) {
+	var options EnvironmentConfig
+	if err := json.Unmarshal(config.Options, &options); err != nil {
+		return nil, err
+	}
+	bmp, err := OpenBMP280(options.Device, options.Address)
+	if err != nil {
+		return nil, err
+	}
+	return bmp.Sensors(), nil
+}
+
+// Sensors returns the BMP280's temperature and pressure as separate sensors
+func (bmp *BMP280) Sensors() []Sensor {
+	return []Sensor{
+		&bmp280Sensor{bmp: bmp, name: "Cabin Temp", units: "C"},
+		&bmp280Sensor{bmp: bmp, name: "Barometric Pressure", units: "hPa", pressure: true},
+	}
+}
+
+func (s *bmp280Sensor) Name() string  { return s.name }
+func (s *bmp280Sensor) Units() string { return s.units }
+
+func (s *bmp280Sensor) Sample() (float64, error) {
+	temperature, pressure, err := s.bmp.Read()
+	if s.pressure {
+		return pressure, err
+	}
+	return temperature, err
+}
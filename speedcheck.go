@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Speed cross-validation thresholds
+const (
+	speedCheckMinKmh      = 10.0 // below this, GPS speed is mostly noise
+	speedCheckAbsKmh      = 5.0  // always tolerate this much difference
+	speedCheckRelative    = 0.10 // and this fraction of the GPS speed
+	speedCheckSustainSecs = 10   // consecutive mismatches before a discrepancy is reported
+)
+
+// SpeedDiscrepancy is a sustained disagreement between the OBD speed PID and GPS
+// speed, which points to a tampered or failing speed sensor
+type SpeedDiscrepancy struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Samples int       `json:"samples"`
+	MeanOBD float64   `json:"meanObd"` // km/h
+	MeanGPS float64   `json:"meanGps"` // km/h
+	Ratio   float64   `json:"ratio"`   // MeanOBD / MeanGPS
+}
+
+// speedValidator compares pairs of OBD and GPS speed samples
+type speedValidator struct {
+	mismatches []speedPair // current run of consecutive mismatches
+	open       bool        // the current run is long enough to be reported
+}
+
+type speedPair struct {
+	at       time.Time
+	obd, gps float64
+}
+
+func newSpeedValidator() *speedValidator {
+	return &speedValidator{}
+}
+
+// compare checks the OBD speed against the current fix and returns a discrepancy
+// once a sustained run of mismatches ends. Samples without a GPS fix, or too slow
+// for GPS speed to be meaningful, neither extend nor end a run.
+func (v *speedValidator) compare(at time.Time, obdSpeed float64, fix *Fix) *SpeedDiscrepancy {
+	if fix == nil || fix.Estimated || fix.Speed < speedCheckMinKmh {
+		return nil
+	}
+	tolerance := math.Max(speedCheckAbsKmh, fix.Speed*speedCheckRelative)
+	if math.Abs(obdSpeed-fix.Speed) > tolerance {
+		v.mismatches = append(v.mismatches, speedPair{at: at, obd: obdSpeed, gps: fix.Speed})
+		if !v.open && len(v.mismatches) >= speedCheckSustainSecs {
+			v.open = true
+			fmt.Printf("Speed discrepancy: OBD %.0f km/h vs GPS %.0f km/h\n", obdSpeed, fix.Speed)
+		}
+		return nil
+	}
+	return v.flush()
+}
+
+// flush ends the current run of mismatches, returning it if it was sustained
+func (v *speedValidator) flush() *SpeedDiscrepancy {
+	run := v.mismatches
+	open := v.open
+	v.mismatches = nil
+	v.open = false
+	if !open {
+		return nil
+	}
+
+	d := &SpeedDiscrepancy{Start: run[0].at, End: run[len(run)-1].at, Samples: len(run)}
+	for _, pair := range run {
+		d.MeanOBD += pair.obd
+		d.MeanGPS += pair.gps
+	}
+	d.MeanOBD /= float64(len(run))
+	d.MeanGPS /= float64(len(run))
+	d.Ratio = d.MeanOBD / d.MeanGPS
+	return d
+}
+
+// logSpeedDiscrepancy anchors a signed "speed-discrepancy" event
+func (vehicle *Vehicle) logSpeedDiscrepancy(d *SpeedDiscrepancy) {
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("speed-discrepancy", toEventData(d)), true)
+	if err != nil {
+		fmt.Println("Failed to log speed discrepancy", err)
+		return
+	}
+	fmt.Printf("Speed discrepancy secured to factom. TxID: %s\n", txID)
+}
@@ -0,0 +1,671 @@
+package main
+
+// Speed compliance proofs, experimental. While recording, the highest speed
+// of every slot of a window is committed to in a Merkle tree with a salted
+// leaf per slot and threshold, stating whether the slot stayed under the
+// threshold, went over it or has no speed recorded. Only the tree's root is
+// anchored. To prove "speed never exceeded X during T" the owner reveals the
+// leaves of threshold X for the slots of T, each with its salt and path to
+// the anchored root. The proof is selective disclosure rather than zero
+// knowledge: it shows the vehicle stayed at or under X in every slot of T and
+// that recording covered it, but none of the speeds themselves, the other
+// thresholds or the slots outside T.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// speedOpeningsPath holds what opens the speed commitments, their seeds and
+// slot maxima. Like locationPreimagePath it never leaves the device, proofs
+// reveal single leaves.
+const speedOpeningsPath = "speed_openings.log"
+
+// speedCommitmentEvent is the type of the events anchoring speed commitments
+const speedCommitmentEvent = "speed-commitment"
+
+// Defaults of SpeedProofConfig
+const (
+	defaultSpeedSlot   = 30   // seconds
+	defaultSpeedWindow = 3600 // seconds
+)
+
+var defaultSpeedThresholds = []int{30, 50, 60, 80, 90, 100, 110, 120, 130}
+
+// maxMerklePath bounds the path of a revealed leaf, far above any tree a
+// window produces, so a hostile proof can't make verification hash forever
+const maxMerklePath = 64
+
+// States of a slot against a threshold, as committed in its leaf
+const (
+	speedUnder  = "under" // every speed sampled in the slot at or below the threshold
+	speedOver   = "over"  // some speed above it
+	speedNoData = "none"  // no speed sampled in the slot
+)
+
+// SpeedProofConfig enables the experimental speed commitments, from which
+// the owner can later prove the vehicle kept to a speed limit
+type SpeedProofConfig struct {
+	Slot       int   `json:"slot"`       // seconds per slot, the granularity of proofs, default 30
+	Window     int   `json:"window"`     // seconds per anchored commitment, a multiple of slot, default 3600
+	Thresholds []int `json:"thresholds"` // km/h limits that can be proven, ascending, defaultSpeedThresholds if empty
+}
+
+func (config *SpeedProofConfig) slot() time.Duration {
+	if config.Slot > 0 {
+		return time.Duration(config.Slot) * time.Second
+	}
+	return defaultSpeedSlot * time.Second
+}
+
+func (config *SpeedProofConfig) window() time.Duration {
+	if config.Window > 0 {
+		return time.Duration(config.Window) * time.Second
+	}
+	return defaultSpeedWindow * time.Second
+}
+
+func (config *SpeedProofConfig) thresholds() []int {
+	if len(config.Thresholds) > 0 {
+		return config.Thresholds
+	}
+	return defaultSpeedThresholds
+}
+
+// validate checks the slots tile windows and the thresholds ascend
+func (config *SpeedProofConfig) validate() error {
+	if config.Slot < 0 || config.Window < 0 {
+		return fmt.Errorf("speedProofs slot and window must not be negative")
+	}
+	if config.window()%config.slot() != 0 {
+		return fmt.Errorf("speedProofs window must be a multiple of slot")
+	}
+	for i, threshold := range config.thresholds() {
+		if threshold <= 0 || (i > 0 && threshold <= config.thresholds()[i-1]) {
+			return fmt.Errorf("speedProofs thresholds must be positive and ascending")
+		}
+	}
+	return nil
+}
+
+// SpeedCommitment is the public part of a window's commitment, logged and
+// anchored as a speed-commitment event
+type SpeedCommitment struct {
+	VIN        string    `json:"vin"`
+	Start      time.Time `json:"start"`
+	Slot       int       `json:"slot"` // seconds
+	Slots      int       `json:"slots"`
+	Thresholds []int     `json:"thresholds"` // km/h
+	Root       string    `json:"root"`       // hex Merkle root over the leaves, slot by slot and threshold by threshold
+}
+
+// end returns when the commitment's last slot ends
+func (c *SpeedCommitment) end() time.Time {
+	return c.Start.Add(time.Duration(c.Slots*c.Slot) * time.Second)
+}
+
+// threshold returns the index of limit among the commitment's thresholds, -1
+// if it isn't one
+func (c *SpeedCommitment) threshold(limit int) int {
+	for k, threshold := range c.Thresholds {
+		if threshold == limit {
+			return k
+		}
+	}
+	return -1
+}
+
+// speedOpening is a commitment with what opens it, kept on the device
+type speedOpening struct {
+	SpeedCommitment
+	Seed string    `json:"seed"` // hex, derives the salt of every leaf
+	Max  []float64 `json:"max"`  // highest speed sampled per slot, km/h, -1 for none
+}
+
+// state returns the state of slot against threshold
+func (o *speedOpening) state(slot, threshold int) string {
+	switch {
+	case o.Max[slot] < 0:
+		return speedNoData
+	case o.Max[slot] > float64(threshold):
+		return speedOver
+	}
+	return speedUnder
+}
+
+// levels returns the Merkle tree over the opening's leaves, level by level
+func (o *speedOpening) levels() ([][][]byte, error) {
+	seed, err := hex.DecodeString(o.Seed)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([][]byte, 0, o.Slots*len(o.Thresholds))
+	for slot := 0; slot < o.Slots; slot++ {
+		for k, threshold := range o.Thresholds {
+			salt := leafSalt(seed, slot*len(o.Thresholds)+k)
+			leaves = append(leaves, speedLeaf(salt, slot, threshold, o.state(slot, threshold)))
+		}
+	}
+	return merkleLevels(leaves), nil
+}
+
+// leafSalt derives the salt of the leaf at index from a commitment's seed, so
+// revealing one salt reveals nothing of the others
+func leafSalt(seed []byte, index int) []byte {
+	mac := hmac.New(sha256.New, seed)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(index))
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// speedLeaf hashes the leaf committing to the state of slot against threshold
+func speedLeaf(salt []byte, slot, threshold int, state string) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(salt)
+	fmt.Fprintf(h, "%d,%d,%s", slot, threshold, state)
+	return h.Sum(nil)
+}
+
+// MerkleStep is a sibling on the path from a leaf to the root
+type MerkleStep struct {
+	Hash string `json:"hash"`           // hex
+	Left bool   `json:"left,omitempty"` // the sibling is hashed on the left
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels returns the tree over leaves from the leaves up to the root. A
+// node without a sibling is carried up a level unchanged.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleRoot returns the root of a tree from merkleLevels, nil if it has no leaves
+func merkleRoot(levels [][][]byte) []byte {
+	top := levels[len(levels)-1]
+	if len(top) == 0 {
+		return nil
+	}
+	return top[0]
+}
+
+// merklePath returns the siblings from the leaf at index up to the root
+func merklePath(levels [][][]byte, index int) []MerkleStep {
+	var path []MerkleStep
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			path = append(path, MerkleStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < index})
+		}
+		index /= 2
+	}
+	return path
+}
+
+// merkleFold returns the root reached from leaf along path
+func merkleFold(leaf []byte, path []MerkleStep) ([]byte, error) {
+	if len(path) > maxMerklePath {
+		return nil, fmt.Errorf("path of %d steps is too long", len(path))
+	}
+	node := leaf
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return nil, fmt.Errorf("malformed path hash %q", step.Hash)
+		}
+		if step.Left {
+			node = merkleNode(sibling, node)
+		} else {
+			node = merkleNode(node, sibling)
+		}
+	}
+	return node, nil
+}
+
+var speedOpeningsMu sync.Mutex
+
+// appendSpeedOpening keeps an opening on the device
+func appendSpeedOpening(opening *speedOpening) error {
+	line, err := json.Marshal(opening)
+	if err != nil {
+		return err
+	}
+	speedOpeningsMu.Lock()
+	defer speedOpeningsMu.Unlock()
+	file, err := os.OpenFile(speedOpeningsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// loadSpeedOpenings returns the openings kept on the device, by start
+func loadSpeedOpenings() ([]*speedOpening, error) {
+	speedOpeningsMu.Lock()
+	defer speedOpeningsMu.Unlock()
+	var openings []*speedOpening
+	err := forEachLine(speedOpeningsPath, func(line []byte) {
+		opening := new(speedOpening)
+		if err := json.Unmarshal(line, opening); err == nil && len(opening.Max) == opening.Slots {
+			openings = append(openings, opening)
+		}
+	})
+	sort.Slice(openings, func(i, j int) bool { return openings[i].Start.Before(openings[j].Start) })
+	return openings, err
+}
+
+// speedCommitter gathers the highest speed of each slot of a window and
+// commits to them once the window ends
+type speedCommitter struct {
+	vehicle *Vehicle
+	config  *SpeedProofConfig
+	open    *speedOpening // window being gathered, nil until the next sample
+	end     time.Time     // when it ends
+}
+
+// newSpeedCommitter returns the committer of the vehicle's samples, nil
+// unless speed proofs are configured
+func (vehicle *Vehicle) newSpeedCommitter() *speedCommitter {
+	if vehicle.speedProofs == nil {
+		return nil
+	}
+	return &speedCommitter{vehicle: vehicle, config: vehicle.speedProofs}
+}
+
+// add records the speed of a sample. A window starts at the slot of its
+// first sample and ends at the next multiple of the window length, so the
+// windows of consecutive recordings don't overlap.
+func (c *speedCommitter) add(sample TripSample) {
+	if c == nil {
+		return
+	}
+	slot := c.config.slot()
+	if c.open != nil && (!sample.Time.Before(c.end) || sample.Time.Before(c.open.Start)) {
+		c.flush()
+	}
+	if c.open == nil {
+		window := c.config.window()
+		c.open = &speedOpening{SpeedCommitment: SpeedCommitment{
+			VIN:        c.vehicle.vin,
+			Start:      sample.Time.Truncate(slot).UTC(),
+			Slot:       int(slot / time.Second),
+			Thresholds: c.config.thresholds(),
+		}}
+		c.end = sample.Time.Truncate(window).Add(window)
+	}
+	i := int(sample.Time.Sub(c.open.Start) / slot)
+	for len(c.open.Max) <= i {
+		c.open.Max = append(c.open.Max, -1)
+	}
+	if sample.Speed > c.open.Max[i] {
+		c.open.Max[i] = sample.Speed
+	}
+}
+
+// flush commits to the window being gathered, if any
+func (c *speedCommitter) flush() {
+	if c == nil || c.open == nil {
+		return
+	}
+	opening := c.open
+	c.open = nil
+	if err := c.vehicle.commitSpeeds(opening); err != nil {
+		fmt.Println("Failed to commit speeds", err)
+	}
+}
+
+// commitSpeeds builds the tree of a gathered window, keeps its opening and
+// logs and anchors its commitment as a speed-commitment event
+func (vehicle *Vehicle) commitSpeeds(opening *speedOpening) error {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+	opening.Seed = hex.EncodeToString(seed)
+	opening.Slots = len(opening.Max)
+	levels, err := opening.levels()
+	if err != nil {
+		return err
+	}
+	opening.Root = hex.EncodeToString(merkleRoot(levels))
+	// kept before anchoring, a commitment that can't be opened proves nothing
+	if err := appendSpeedOpening(opening); err != nil {
+		return err
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent(speedCommitmentEvent, toEventData(opening.SpeedCommitment)), true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Speeds of %d slots from %s secured to factom. TxID: %s\n", opening.Slots, opening.Start.Local().Format("15:04"), txID)
+	return nil
+}
+
+// SpeedProof shows the vehicle never exceeded Limit between From and To
+type SpeedProof struct {
+	VIN     string             `json:"vin"`
+	ChainID string             `json:"chainID"`
+	Limit   int                `json:"limit"` // km/h
+	From    time.Time          `json:"from"`
+	To      time.Time          `json:"to"`
+	Windows []SpeedProofWindow `json:"windows"` // in order
+}
+
+// SpeedProofWindow is the anchored commitment of a window with the leaves of
+// its slots in the proof's range
+type SpeedProofWindow struct {
+	Event     *SignedEvent     `json:"event"` // the speed-commitment event as signed and anchored
+	EntryHash string           `json:"entryHash"`
+	Leaves    []SpeedLeafProof `json:"leaves"`
+}
+
+// SpeedLeafProof opens the leaf of a slot at the proof's limit as under it
+type SpeedLeafProof struct {
+	Slot int          `json:"slot"`
+	Salt string       `json:"salt"` // hex
+	Path []MerkleStep `json:"path"`
+}
+
+// ProveSpeedLimit builds the proof that the vehicle never exceeded limit, one
+// of the committed thresholds, between from and to. It fails if the speed
+// went over the limit, or wasn't recorded, in any slot of the range.
+func (vehicle *Vehicle) ProveSpeedLimit(limit int, from, to time.Time) (*SpeedProof, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	openings, err := loadSpeedOpenings()
+	if err != nil {
+		return nil, fmt.Errorf("reading speed openings: %v", err)
+	}
+	events := make(map[string]*SignedEvent)
+	err = readEvents(speedCommitmentEvent, func() interface{} { return new(SpeedCommitment) }, func(data interface{}, signed *SignedEvent) {
+		events[data.(*SpeedCommitment).Root] = signed
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading speed commitments: %v", err)
+	}
+
+	proof := &SpeedProof{VIN: vehicle.vin, ChainID: vehicle.chainID, Limit: limit, From: from.UTC(), To: to.UTC()}
+	covered := from
+	for _, opening := range openings {
+		if opening.VIN != vehicle.vin || !opening.end().After(covered) || !opening.Start.Before(to) {
+			continue
+		}
+		if opening.Start.After(covered) {
+			break
+		}
+		k := opening.threshold(limit)
+		if k < 0 {
+			return nil, fmt.Errorf("%d km/h was not committed to from %s, the thresholds are %v", limit, opening.Start.Format(time.RFC3339), opening.Thresholds)
+		}
+		signed := events[opening.Root]
+		if signed == nil {
+			return nil, fmt.Errorf("the commitment of %s was not logged", opening.Start.Format(time.RFC3339))
+		}
+		levels, err := opening.levels()
+		if err != nil {
+			return nil, err
+		}
+		seed, _ := hex.DecodeString(opening.Seed)
+		window := SpeedProofWindow{Event: signed, EntryHash: eventEntryHash(vehicle.chainID, speedCommitmentEvent, signed)}
+		slotLength := time.Duration(opening.Slot) * time.Second
+		for slot := int(covered.Sub(opening.Start) / slotLength); slot < opening.Slots; slot++ {
+			start := opening.Start.Add(time.Duration(slot) * slotLength)
+			if !start.Before(to) {
+				break
+			}
+			switch opening.state(slot, limit) {
+			case speedOver:
+				return nil, fmt.Errorf("the speed exceeded %d km/h between %s and %s", limit, start.Format(time.RFC3339), start.Add(slotLength).Format(time.RFC3339))
+			case speedNoData:
+				return nil, fmt.Errorf("no speed was recorded between %s and %s", start.Format(time.RFC3339), start.Add(slotLength).Format(time.RFC3339))
+			}
+			index := slot*len(opening.Thresholds) + k
+			window.Leaves = append(window.Leaves, SpeedLeafProof{
+				Slot: slot,
+				Salt: hex.EncodeToString(leafSalt(seed, index)),
+				Path: merklePath(levels, index),
+			})
+		}
+		proof.Windows = append(proof.Windows, window)
+		if covered = opening.end(); !covered.Before(to) {
+			return proof, nil
+		}
+	}
+	return nil, fmt.Errorf("no speeds were committed from %s", covered.Format(time.RFC3339))
+}
+
+// VerifySpeedProof checks a speed proof against the chain read by reader and
+// returns the number of slots it proves. Every commitment must be signed by
+// one of ownerKeys and anchored on the proof's chain, every leaf must open
+// its commitment as at or under the limit, and the slots must cover the
+// proof's range without a gap.
+func VerifySpeedProof(reader chainReader, proof *SpeedProof, ownerKeys [][]byte) (int, error) {
+	if !proof.From.Before(proof.To) {
+		return 0, fmt.Errorf("the proof's range is empty")
+	}
+	type interval struct{ start, end time.Time }
+	var covered []interval
+	for i, window := range proof.Windows {
+		commitment, err := verifySpeedCommitment(reader, proof, &window, ownerKeys)
+		if err != nil {
+			return 0, fmt.Errorf("window %d: %v", i, err)
+		}
+		root, err := hex.DecodeString(commitment.Root)
+		if err != nil {
+			return 0, fmt.Errorf("window %d: malformed root: %v", i, err)
+		}
+		k := commitment.threshold(proof.Limit)
+		if k < 0 {
+			return 0, fmt.Errorf("window %d does not commit to %d km/h", i, proof.Limit)
+		}
+		slotLength := time.Duration(commitment.Slot) * time.Second
+		for _, leaf := range window.Leaves {
+			if leaf.Slot < 0 || leaf.Slot >= commitment.Slots {
+				return 0, fmt.Errorf("window %d has no slot %d", i, leaf.Slot)
+			}
+			salt, err := hex.DecodeString(leaf.Salt)
+			if err != nil {
+				return 0, fmt.Errorf("window %d slot %d: malformed salt: %v", i, leaf.Slot, err)
+			}
+			opened, err := merkleFold(speedLeaf(salt, leaf.Slot, proof.Limit, speedUnder), leaf.Path)
+			if err != nil {
+				return 0, fmt.Errorf("window %d slot %d: %v", i, leaf.Slot, err)
+			}
+			if !bytes.Equal(opened, root) {
+				return 0, fmt.Errorf("window %d slot %d does not open as under %d km/h", i, leaf.Slot, proof.Limit)
+			}
+			start := commitment.Start.Add(time.Duration(leaf.Slot) * slotLength)
+			covered = append(covered, interval{start, start.Add(slotLength)})
+		}
+	}
+	sort.Slice(covered, func(i, j int) bool { return covered[i].start.Before(covered[j].start) })
+	reached := proof.From
+	for _, slot := range covered {
+		if slot.start.After(reached) {
+			break
+		}
+		if slot.end.After(reached) {
+			reached = slot.end
+		}
+	}
+	if reached.Before(proof.To) {
+		return 0, fmt.Errorf("no slot covers %s", reached.Format(time.RFC3339))
+	}
+	return len(covered), nil
+}
+
+// verifySpeedCommitment checks a window's commitment event is signed by one
+// of ownerKeys and anchored on the proof's chain, and returns the commitment
+func verifySpeedCommitment(reader chainReader, proof *SpeedProof, window *SpeedProofWindow, ownerKeys [][]byte) (*SpeedCommitment, error) {
+	signed := window.Event
+	if signed == nil {
+		return nil, fmt.Errorf("missing commitment event")
+	}
+	var event struct {
+		Type string          `json:"type"`
+		VIN  string          `json:"vin"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(signed.Event, &event); err != nil {
+		return nil, fmt.Errorf("malformed commitment event: %v", err)
+	}
+	if event.Type != speedCommitmentEvent || event.VIN != proof.VIN {
+		return nil, fmt.Errorf("not a speed commitment of %s", proof.VIN)
+	}
+	commitment := new(SpeedCommitment)
+	if err := json.Unmarshal(event.Data, commitment); err != nil {
+		return nil, fmt.Errorf("malformed commitment: %v", err)
+	}
+	if commitment.Slot <= 0 || commitment.Slots <= 0 {
+		return nil, fmt.Errorf("commitment has no slots")
+	}
+
+	var key [ed.PublicKeySize]byte
+	var sig [ed.SignatureSize]byte
+	keyBytes, err := hex.DecodeString(signed.PubKey)
+	if err != nil || len(keyBytes) != len(key) {
+		return nil, fmt.Errorf("malformed signing key")
+	}
+	sigBytes, err := hex.DecodeString(signed.Signature)
+	if err != nil || len(sigBytes) != len(sig) {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	copy(key[:], keyBytes)
+	copy(sig[:], sigBytes)
+	owner := false
+	for _, ownerKey := range ownerKeys {
+		owner = owner || bytes.Equal(ownerKey, keyBytes)
+	}
+	if !owner {
+		return nil, fmt.Errorf("signed by %s, not the vehicle's owner", signed.PubKey)
+	}
+	if !ed.Verify(&key, signed.Event, &sig) {
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	entry, err := reader.entry(window.EntryHash)
+	if err != nil {
+		return nil, fmt.Errorf("looking up entry %s: %v", window.EntryHash, err)
+	} else if entry == nil {
+		return nil, fmt.Errorf("entry %s not found", window.EntryHash)
+	}
+	if entry.ChainID != proof.ChainID || len(entry.ExtIDs) < 2 || !bytes.Equal(entry.ExtIDs[0], sigBytes) || !bytes.Equal(entry.Content, signed.Event) {
+		return nil, fmt.Errorf("entry %s on chain is not the commitment", window.EntryHash)
+	}
+	return commitment, nil
+}
+
+// speedProofCommand proves the vehicle kept to a speed limit over a time
+// range from its speed commitments, or verifies such a proof
+func speedProofCommand(vehicle *Vehicle, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox speed-proof prove|verify")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "prove":
+		flags := flag.NewFlagSet("speed-proof prove", flag.ExitOnError)
+		limit := flags.Int("limit", 0, "Speed limit in km/h, one of the committed thresholds")
+		from := flags.String("from", "", "Start of the range, RFC3339")
+		to := flags.String("to", "", "End of the range, RFC3339")
+		out := flags.String("o", "", "Output path (default: speed_proof_<limit>_<from>.json)")
+		flags.Parse(args[1:])
+		start, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			fmt.Println("Invalid -from", err)
+			os.Exit(2)
+		}
+		end, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			fmt.Println("Invalid -to", err)
+			os.Exit(2)
+		}
+		proof, err := vehicle.ProveSpeedLimit(*limit, start, end)
+		if err != nil {
+			fmt.Println("Failed to prove the speed limit:", err)
+			os.Exit(1)
+		}
+		data, err := json.MarshalIndent(proof, "", "  ")
+		if err != nil {
+			fmt.Println("Failed to encode the proof", err)
+			os.Exit(1)
+		}
+		path := *out
+		if path == "" {
+			path = fmt.Sprintf("speed_proof_%d_%s.json", *limit, start.UTC().Format("20060102T150405Z"))
+		}
+		if err := writeAtomic(path, data); err != nil {
+			fmt.Println("Failed to write the proof", err)
+			os.Exit(1)
+		}
+		appendAudit("speed-proof-created", map[string]interface{}{"limit": *limit, "from": proof.From, "to": proof.To, "windows": len(proof.Windows)})
+		fmt.Printf("Proof that the speed never exceeded %d km/h from %s to %s written to %s\n", *limit, proof.From.Format(time.RFC3339), proof.To.Format(time.RFC3339), path)
+	case "verify":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: blackbox speed-proof verify <proof.json>")
+			os.Exit(2)
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			fmt.Println("Failed to read the proof", err)
+			os.Exit(1)
+		}
+		proof := new(SpeedProof)
+		if err := json.Unmarshal(data, proof); err != nil {
+			fmt.Println("Malformed proof", err)
+			os.Exit(1)
+		}
+		if proof.ChainID != vehicle.chainID {
+			fmt.Printf("The proof is of chain %s, not this vehicle's %s\n", proof.ChainID, vehicle.chainID)
+			os.Exit(1)
+		}
+		ownerKeys := append([][]byte{vehicle.owner.ecAddress.PubBytes()}, vehicle.previousOwners...)
+		slots, err := VerifySpeedProof(vehicle.chain, proof, ownerKeys)
+		if err != nil {
+			fmt.Println("Proof NOT verified:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Verified: at or under %d km/h in all %d slots from %s to %s\n", proof.Limit, slots, proof.From.Format(time.RFC3339), proof.To.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown speed-proof command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout: <vin>/records/<time> -> OBDRecord, <vin>/segments/<start> -> Segment,
+// <vin>/sequences/<stream> -> segment counter, <vin>/chain/<key> -> IndexedEntry
+var (
+	recordsBucket   = []byte("records")
+	segmentsBucket  = []byte("segments")
+	sequenceBucket  = []byte("sequences") // <vin>/sequences/<stream> holds the stream's segment counter
+	chainBucket     = []byte("chain")     // <vin>/chain/<block time><sequence><position> -> IndexedEntry
+	chainHeadBucket = []byte("chainhead") // <vin>/chainhead/head holds the last indexed entry block
+	chainHeadKey    = []byte("head")
+)
+
+// Records are buffered in memory and written in one transaction per batch, so
+// the SD card sees a few large writes a minute instead of a sync every second.
+// Buffered records are also appended to a write-ahead log next to the database
+// so a power cut loses at most walSyncInterval of telemetry.
+const (
+	recordBatchSize     = 30
+	recordFlushInterval = 30 * time.Second
+)
+
+// Store is the local embedded database holding all telemetry, indexed by time
+type Store struct {
+	db  *bolt.DB
+	wal *writeAheadLog
+
+	mu      sync.Mutex
+	pending []pendingRecord // records not yet written
+	oldest  time.Time       // when the first pending record was buffered
+	line    []byte          // reused to encode write-ahead log lines
+}
+
+// pendingRecord is an encoded record waiting for the next batch write
+type pendingRecord struct {
+	VIN   string          `json:"vin"`
+	Key   []byte          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Segment is an interval of records that is exported, hashed, and anchored as a unit
+type Segment struct {
+	VIN         string    `json:"vin"`
+	Seq         uint64    `json:"seq"` // numbers the stream's segments from 1
+	Stream      string    `json:"stream"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end,omitempty"` // zero while recording
+	Header      string    `json:"header"`
+	Path        string    `json:"path"`                  // where the export is written
+	Records     int       `json:"records"`               // records in the segment
+	Hash        string    `json:"hash,omitempty"`        // hex SHA-256 of the export
+	TxID        string    `json:"txID,omitempty"`        // anchoring transaction
+	Compression string    `json:"compression,omitempty"` // method applied to the export before hashing
+	EntryHash   string    `json:"entryHash,omitempty"`   // entry found on chain holding Hash
+	UploadURL   string    `json:"uploadURL,omitempty"`   // where the file was uploaded
+	UploadedAt  time.Time `json:"uploadedAt,omitempty"`
+	Pruned      bool      `json:"pruned,omitempty"` // records deleted by the retention policy
+	Driver      string    `json:"driver,omitempty"` // hex identity key of the driver assigned when the segment started
+
+	// ClockUncertain marks segments recorded before the clock was synced or
+	// across a step of it, their timestamps may be wrong
+	ClockUncertain bool `json:"clockUncertain,omitempty"`
+
+	// Fields is the hex root of the tree over a telemetry segment's lines that
+	// redacted exports are checked by, FieldsPath the path from it to the root
+	// its entry commits to
+	Fields     string       `json:"fields,omitempty"`
+	FieldsPath []MerkleStep `json:"fieldsPath,omitempty"`
+
+	clockSkews int // the clock's skewCount when the segment started
+}
+
+// OpenStore opens or creates the database at path
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	wal, entries, err := openWAL(path + ".wal")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &Store{db: db, wal: wal}
+
+	// replay records buffered when the device last lost power
+	for _, entry := range entries {
+		var record pendingRecord
+		if err := json.Unmarshal(entry, &record); err == nil {
+			s.pending = append(s.pending, record)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close writes any buffered records and closes the database
+func (s *Store) Close() error {
+	flushErr := s.Flush()
+	s.wal.Close()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// Backup writes a consistent copy of the database to w, including buffered records
+func (s *Store) Backup(w io.Writer) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// timeKey encodes t so that keys sort chronologically
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if t.After(time.Unix(0, 0)) { // earlier times, including the zero Time, sort first
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
+
+// bucket returns the named bucket for vin, creating it in writable transactions
+func bucket(tx *bolt.Tx, vin string, name []byte) (*bolt.Bucket, error) {
+	if !tx.Writable() {
+		root := tx.Bucket([]byte(vin))
+		if root == nil {
+			return nil, nil
+		}
+		return root.Bucket(name), nil
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte(vin))
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists(name)
+}
+
+// put stores v as JSON under key
+func (s *Store) put(vin string, name, key []byte, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, name)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+// scan calls fn with every value whose key lies in [start, end]
+func (s *Store) scan(vin string, name []byte, start, end time.Time, fn func(value []byte) error) error {
+	if bytes.Equal(name, recordsBucket) {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	min, max := timeKey(start), timeKey(end)
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, name)
+		if err != nil || b == nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutRecord stores an OBD record for the vehicle. The record is buffered and
+// written with the next batch, reads of records always see it.
+func (s *Store) PutRecord(vin string, record *OBDRecord) error {
+	value := record.appendJSON(make([]byte, 0, 128+64*len(record.Readings)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		s.oldest = time.Now()
+	}
+	pending := pendingRecord{VIN: vin, Key: timeKey(record.Time), Value: value}
+	s.line = pending.appendJSON(s.line[:0])
+	if err := s.wal.appendLine(s.line); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pending)
+	if len(s.pending) >= recordBatchSize || time.Since(s.oldest) >= recordFlushInterval {
+		return s.flushLocked()
+	}
+	return nil
+}
+
+// Flush writes buffered records to the database in a single transaction
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *Store) flushLocked() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, record := range s.pending {
+			b, err := bucket(tx, record.VIN, recordsBucket)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(record.Key, record.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = s.pending[:0]
+	return s.wal.reset(nil)
+}
+
+// Records returns the vehicle's records taken between start and end, inclusive, oldest first
+func (s *Store) Records(vin string, start, end time.Time) ([]*OBDRecord, error) {
+	var records []*OBDRecord
+	err := s.scan(vin, recordsBucket, start, end, func(value []byte) error {
+		record := new(OBDRecord)
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// DeleteRecords removes the vehicle's records taken between start and end,
+// inclusive, and returns how many were deleted
+func (s *Store) DeleteRecords(vin string, start, end time.Time) (int, error) {
+	if err := s.Flush(); err != nil {
+		return 0, err
+	}
+	min, max := timeKey(start), timeKey(end)
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, recordsBucket)
+		if err != nil {
+			return err
+		}
+		// collect first, deleting under a cursor can skip keys
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return deleted, err
+}
+
+// NextSeq returns the next sequence number for a stream's segments
+func (s *Store) NextSeq(vin, stream string) (uint64, error) {
+	var seq uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sequences, err := bucket(tx, vin, sequenceBucket)
+		if err != nil {
+			return err
+		}
+		b, err := sequences.CreateBucketIfNotExists([]byte(stream))
+		if err != nil {
+			return err
+		}
+		seq, err = b.NextSequence()
+		return err
+	})
+	return seq, err
+}
+
+// PutSegment creates or updates a segment
+func (s *Store) PutSegment(vin string, segment *Segment) error {
+	return s.put(vin, segmentsBucket, timeKey(segment.Start), segment)
+}
+
+// Segments returns the vehicle's segments started between start and end, inclusive, oldest first
+func (s *Store) Segments(vin string, start, end time.Time) ([]*Segment, error) {
+	var segments []*Segment
+	err := s.scan(vin, segmentsBucket, start, end, func(value []byte) error {
+		segment := &Segment{VIN: vin} // segments stored before they carried their VIN
+		if err := json.Unmarshal(value, segment); err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+		return nil
+	})
+	return segments, err
+}
+
+// LastSegment returns the vehicle's latest segment, nil if it has none
+func (s *Store) LastSegment(vin string) (*Segment, error) {
+	var segment *Segment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, vin, segmentsBucket)
+		if err != nil || b == nil {
+			return err
+		}
+		if _, value := b.Cursor().Last(); value != nil {
+			segment = &Segment{VIN: vin}
+			return json.Unmarshal(value, segment)
+		}
+		return nil
+	})
+	return segment, err
+}
+
+// ExportSegment returns the deterministic byte representation of a segment: its
+// header followed by the text of every record between its start and end. The
+// same segment always exports to the same bytes, so the export's hash can be
+// anchored and later reproduced from the database.
+func (s *Store) ExportSegment(vin string, segment *Segment, end time.Time) ([]byte, int, error) {
+	records, err := s.Records(vin, segment.Start, end)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 0, len(segment.Header)+len(records)*(64+48*recordReadings(records)))
+	buf = append(buf, segment.Header...)
+	for _, record := range records {
+		buf = record.appendText(buf)
+	}
+	return buf, len(records), nil
+}
+
+// recordReadings returns the number of readings of the first record, to size
+// buffers holding many records
+func recordReadings(records []*OBDRecord) int {
+	if len(records) == 0 {
+		return 0
+	}
+	return len(records[0].Readings)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Restart backoff of supervised tasks
+const (
+	taskRestartMin  = time.Second
+	taskRestartMax  = time.Minute
+	taskStableAfter = 5 * time.Minute // a task that ran this long restarts without backoff
+)
+
+// TaskStatus is the state of a supervised task as shown in GET /status
+type TaskStatus struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"lastError,omitempty"`
+	Failed    time.Time `json:"failed,omitempty"` // when LastError happened
+}
+
+// supervisor runs the recorder's long lived tasks, e.g. OBD, video, GPS and
+// anchoring, in their own goroutines. A task that fails or panics is reported
+// and restarted after a backoff, so one failing device doesn't stop the others.
+type supervisor struct {
+	stop   chan struct{}
+	report func(name string, err error)
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	tasks []*TaskStatus
+}
+
+// newSupervisor returns a supervisor calling report with every task failure
+func newSupervisor(report func(name string, err error)) *supervisor {
+	return &supervisor{stop: make(chan struct{}), report: report}
+}
+
+// Go starts a task. run must return once stop is closed. It is called again
+// whenever it returns an error or panics, and returning nil ends the task.
+func (s *supervisor) Go(name string, run func(stop <-chan struct{}) error) {
+	task := &TaskStatus{Name: name, Running: true}
+	s.mu.Lock()
+	s.tasks = append(s.tasks, task)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		backoff := taskRestartMin
+		for {
+			started := time.Now()
+			err := runTask(run, s.stop)
+			select {
+			case <-s.stop:
+				err = nil
+			default:
+			}
+			if err == nil {
+				s.mu.Lock()
+				task.Running = false
+				s.mu.Unlock()
+				return
+			}
+
+			if time.Since(started) >= taskStableAfter {
+				backoff = taskRestartMin
+			}
+			s.mu.Lock()
+			task.Restarts++
+			task.LastError, task.Failed = err.Error(), time.Now().UTC()
+			s.mu.Unlock()
+			s.report(name, err)
+
+			select {
+			case <-s.stop:
+				s.mu.Lock()
+				task.Running = false
+				s.mu.Unlock()
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > taskRestartMax {
+				backoff = taskRestartMax
+			}
+		}
+	}()
+}
+
+// runTask calls run, turning a panic into an error
+func runTask(run func(stop <-chan struct{}) error, stop <-chan struct{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(stop)
+}
+
+// Wait blocks until every task has ended
+func (s *supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Stop tells every task to stop and waits for them to return
+func (s *supervisor) Stop() {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// status returns a copy of every task's state
+func (s *supervisor) status() []TaskStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]TaskStatus, len(s.tasks))
+	for i, task := range s.tasks {
+		tasks[i] = *task
+	}
+	return tasks
+}
+
+// sleep waits for d, returning false if stop was closed first
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// closeOnStop closes c once stop is closed, unblocking a task waiting on a
+// device read. The returned func ends the wait when the task returns first.
+func closeOnStop(stop <-chan struct{}, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thermal levels, each lightening the recorder's load as the SoC heats up
+const (
+	thermalNormal    = iota
+	thermalWarm      // video is captured at reduced quality
+	thermalThrottled // the SoC is throttling: video at minimum quality, OBD sampled at half rate
+)
+
+var thermalLevelNames = []string{"normal", "warm", "throttled"}
+
+// thermalCheckInterval is how often the SoC temperature and throttle flags are read
+const thermalCheckInterval = 30 * time.Second
+
+// defaultThermalZone is the Raspberry Pi's CPU temperature in millidegrees Celsius
+const defaultThermalZone = "/sys/class/thermal/thermal_zone0/temp"
+
+// Current state bits of the firmware's throttle flags, see vcgencmd get_throttled.
+// Under-voltage alone is left to the battery monitor, it throttles the SoC
+// when it lasts, which sets throttleActive.
+const (
+	throttleFreqCapped = 1 << 1 // ARM frequency capped
+	throttleActive     = 1 << 2 // currently throttled
+	throttleSoftTemp   = 1 << 3 // soft temperature limit active
+)
+
+// ThermalConfig sets the SoC temperatures, in degrees Celsius, of each thermal level
+type ThermalConfig struct {
+	Zone       string  `json:"zone"` // sysfs temperature file, default the CPU's
+	WarmC      float64 `json:"warmC"`
+	ThrottledC float64 `json:"throttledC"`
+}
+
+// thermalMonitor tracks the current thermal level, shared between recorders
+type thermalMonitor struct {
+	mu           sync.Mutex
+	level        int
+	temperatureC float64 // at the last measurement
+}
+
+func (m *thermalMonitor) get() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.level
+}
+
+func (m *thermalMonitor) set(level int, temperatureC float64) (changed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed = level != m.level
+	m.level = level
+	m.temperatureC = temperatureC
+	return changed
+}
+
+// lastTemperature returns the SoC temperature at the last measurement, 0 if never measured
+func (m *thermalMonitor) lastTemperature() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.temperatureC
+}
+
+// thermalLevel classifies a temperature and the firmware's throttle flags
+// against the configured thresholds
+func thermalLevel(temperatureC float64, flags uint64, config ThermalConfig) int {
+	switch {
+	case flags&(throttleFreqCapped|throttleActive|throttleSoftTemp) != 0, temperatureC >= config.ThrottledC:
+		return thermalThrottled
+	case temperatureC >= config.WarmC:
+		return thermalWarm
+	}
+	return thermalNormal
+}
+
+// readTemperature returns the temperature of a sysfs thermal zone in degrees Celsius
+func readTemperature(zone string) (float64, error) {
+	data, err := ioutil.ReadFile(zone)
+	if err != nil {
+		return 0, err
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("thermal zone %s: %v", zone, err)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// readThrottleFlags returns the firmware's throttle flags, parsed from the
+// "throttled=0x50005" printed by vcgencmd
+func readThrottleFlags() (uint64, error) {
+	out, err := exec.Command("vcgencmd", "get_throttled").Output()
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	return strconv.ParseUint(value, 0, 32)
+}
+
+// sampleInterval returns how long the OBD recorder should wait between
+// samples, twice as long while the SoC is throttling
+func (vehicle *Vehicle) sampleInterval() time.Duration {
+	interval := vehicle.recorder.sampleInterval()
+	if vehicle.thermal.get() >= thermalThrottled {
+		interval *= 2
+	}
+	return interval
+}
+
+// MonitorThermal reads the SoC temperature and throttle flags every
+// thermalCheckInterval and moves the vehicle between thermal levels, alerting
+// the owner on every change so the quality of evidence recorded meanwhile is
+// explained, until stop is closed. Without a thermal zone, e.g. off a
+// Raspberry Pi, it returns at once.
+func (vehicle *Vehicle) MonitorThermal(config ThermalConfig, stop <-chan struct{}) error {
+	zone := config.Zone
+	if zone == "" {
+		zone = defaultThermalZone
+	}
+	if _, err := readTemperature(zone); err != nil {
+		fmt.Println("Thermal monitoring unavailable", err)
+		return nil
+	}
+	for {
+		temperatureC, err := readTemperature(zone)
+		if err != nil {
+			return err
+		}
+		// without vcgencmd the temperature alone sets the level
+		flags, _ := readThrottleFlags()
+		level := thermalLevel(temperatureC, flags, config)
+		if vehicle.thermal.set(level, temperatureC) {
+			vehicle.raiseAlert("thermal-"+thermalLevelNames[level],
+				fmt.Sprintf("SoC is %s at %.1f°C, throttle flags %#x", thermalLevelNames[level], temperatureC, flags),
+				map[string]interface{}{"temperatureC": temperatureC, "throttleFlags": flags})
+			appendAudit("thermal-level", map[string]interface{}{"level": thermalLevelNames[level], "temperatureC": temperatureC, "throttleFlags": flags})
+		}
+		if !sleep(thermalCheckInterval, stop) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time confidence levels recorded in segment headers
+const (
+	TimeConfidenceHigh   = "high"   // disciplined by GPS PPS
+	TimeConfidenceMedium = "medium" // set from GPS NMEA time or NTP
+	TimeConfidenceLow    = "low"    // free running clock, possibly never set (no RTC)
+	TimeConfidenceUnset  = "unset"  // found wrong at startup and not synced since
+)
+
+// Time sync settings
+const (
+	ppsStepThreshold  = 10 * time.Millisecond
+	nmeaStepThreshold = 1 * time.Second // NMEA sentences arrive up to ~0.5s late
+	ntpStepThreshold  = 100 * time.Millisecond
+	ntpInterval       = 15 * time.Minute
+	gpsSyncGrace      = 1 * time.Minute // wait this long for GPS before falling back to NTP
+	syncValidFor      = 24 * time.Hour  // a sync this old says little about the drifting clock
+	clockSkewLimit    = time.Minute     // a sync stepping the clock further finds the timestamps since the last one wrong
+)
+
+// minPlausibleTime is earlier than the clock of any recorder running this
+// build can correctly read. A Pi without an RTC boots in 1970, or at the time
+// fake-hwclock last saved.
+var minPlausibleTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// errClockUnset is returned for entries held in the anchor queue because the
+// clock hasn't been synced since it was found wrong at startup
+var errClockUnset = errors.New("held until the clock is synced")
+
+// timeSync keeps the system clock set from the best available source and
+// reports how much its timestamps can be trusted. A clock that is suspect,
+// found wrong at startup or off by more than clockSkewLimit and impossible to
+// set, isn't trusted at all until a sync sets it.
+type timeSync struct {
+	mu       sync.Mutex
+	ppsPath  string // sysfs assert file of the PPS device, e.g. /sys/class/pps/pps0/assert
+	source   string // "gps-pps", "gps", "ntp", or "system"
+	level    string
+	offset   time.Duration // correction applied at the last sync
+	lastSync time.Time
+	suspect  bool
+	skews    int // syncs that found the clock off by more than clockSkewLimit
+}
+
+func newTimeSync(ppsPath string) *timeSync {
+	return &timeSync{ppsPath: ppsPath, source: "system", level: TimeConfidenceLow}
+}
+
+// status returns the current time source and confidence
+func (c *timeSync) status() (source, confidence string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.suspect {
+		return c.source, TimeConfidenceUnset
+	}
+	if c.source != "system" && time.Since(c.lastSync) > syncValidFor {
+		return c.source, TimeConfidenceLow
+	}
+	return c.source, c.level
+}
+
+// checkStartup marks the clock suspect if it reads earlier than
+// minPlausibleTime or than latest, the newest time already recorded, as it
+// does after booting without an RTC until the first sync
+func (c *timeSync) checkStartup(latest time.Time) {
+	now := time.Now()
+	if now.After(minPlausibleTime) && now.After(latest) {
+		return
+	}
+	c.mu.Lock()
+	c.suspect = true
+	c.mu.Unlock()
+	fmt.Printf("Clock reads %s, earlier than it can be, holding anchors until it is synced\n", now.UTC().Format(time.RFC3339))
+}
+
+// certain reports whether the clock can be trusted enough to anchor what is
+// timestamped by it
+func (c *timeSync) certain() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.suspect
+}
+
+// skewCount returns how many times a sync found the clock wrong. Data recorded
+// across a change of the count has timestamps from before and after the step.
+func (c *timeSync) skewCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skews
+}
+
+// gpsFix syncs the clock to a GPS fix, using the PPS pulse for sub-millisecond
+// accuracy when available
+func (c *timeSync) gpsFix(fix *Fix) {
+	now := time.Now()
+	offset := fix.Time.Sub(now) // coarse, includes serial latency
+	source, level, threshold := "gps", TimeConfidenceMedium, nmeaStepThreshold
+
+	if pulse, err := readPPSAssert(c.ppsPath); err == nil && now.Sub(pulse) < time.Second {
+		// the pulse marks the start of a UTC second, which the NMEA time identifies
+		utc := pulse.Add(offset).Round(time.Second)
+		offset = utc.Sub(pulse)
+		source, level, threshold = "gps-pps", TimeConfidenceHigh, ppsStepThreshold
+	}
+	c.apply(source, level, offset, threshold)
+}
+
+// apply steps the clock by offset if it exceeds threshold and records the sync
+func (c *timeSync) apply(source, level string, offset, threshold time.Duration) {
+	skewed := offset > clockSkewLimit || offset < -clockSkewLimit
+	if offset > threshold || offset < -threshold {
+		if err := setSystemTime(time.Now().Add(offset)); err != nil {
+			c.mu.Lock()
+			if c.source != source {
+				fmt.Printf("Clock is off by %s but could not be set: %v\n", offset, err)
+			}
+			c.source, c.level, c.offset = source, TimeConfidenceLow, offset
+			if skewed && !c.suspect {
+				c.suspect = true
+				c.skews++
+			}
+			c.mu.Unlock()
+			return
+		}
+		fmt.Printf("Clock stepped by %s from %s\n", offset, source)
+	}
+	c.mu.Lock()
+	c.source, c.level, c.offset, c.lastSync = source, level, offset, time.Now()
+	if skewed {
+		c.skews++
+	}
+	if c.suspect {
+		fmt.Println("Clock synced, anchoring resumes")
+		c.suspect = false
+	}
+	c.mu.Unlock()
+}
+
+// run falls back to NTP whenever GPS hasn't synced the clock recently, until
+// stop is closed
+func (c *timeSync) run(servers []string, stop <-chan struct{}) error {
+	if !sleep(gpsSyncGrace, stop) {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		gpsSynced := strings.HasPrefix(c.source, "gps") && time.Since(c.lastSync) < ntpInterval
+		c.mu.Unlock()
+		if !gpsSynced {
+			for _, server := range servers {
+				offset, err := queryNTP(server)
+				if err != nil {
+					fmt.Printf("NTP query to %s failed: %v\n", server, err)
+					continue
+				}
+				c.apply("ntp", TimeConfidenceMedium, offset, ntpStepThreshold)
+				break
+			}
+		}
+		if !sleep(ntpInterval, stop) {
+			return nil
+		}
+	}
+}
+
+// readPPSAssert returns the system time of the last PPS pulse from a sysfs
+// assert file, formatted "<sec>.<nsec>#<sequence>"
+func readPPSAssert(path string) (time.Time, error) {
+	if path == "" {
+		return time.Time{}, errors.New("no PPS device")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	stamp := strings.SplitN(strings.TrimSpace(string(data)), "#", 2)[0]
+	parts := strings.SplitN(stamp, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("malformed PPS assert %q", stamp)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// ntpEpochOffset is the number of seconds between 1900 (NTP) and 1970 (Unix)
+const ntpEpochOffset = 2208988800
+
+// queryNTP returns the offset of the local clock from an SNTP server
+func queryNTP(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := make([]byte, 48)
+	request[0] = 0x23 // LI 0, version 4, client mode
+	t1 := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 48)
+	if _, err := conn.Read(response); err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+	if response[1] == 0 {
+		return 0, errors.New("ntp: kiss-of-death response")
+	}
+
+	t2 := ntpTime(response[32:40])
+	t3 := ntpTime(response[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// ntpTime decodes a 64 bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := int64(math.Round(float64(frac) * 1e9 / (1 << 32)))
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
+
+// segmentHeader returns the header written at the top of every OBD segment,
+// recording who produced it, which file it is, and how far its timestamps can
+// be trusted
+func (vehicle *Vehicle) segmentHeader(segment *Segment) string {
+	source, confidence := vehicle.clock.status()
+	return strings.Join([]string{
+		"Blackbox Segment",
+		fmt.Sprintf("VIN: %s", segment.VIN),
+		fmt.Sprintf("Stream: %s", segment.Stream),
+		fmt.Sprintf("Sequence: %d", segment.Seq),
+		fmt.Sprintf("Start: %s", segment.Start.UTC().Format(time.RFC3339Nano)),
+		fmt.Sprintf("File: %s", segment.FileName()),
+		fmt.Sprintf("Time Source: %s", source),
+		fmt.Sprintf("Time Confidence: %s", confidence),
+		"==================================================================\n",
+	}, "\n")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig secures a network surface with mutual TLS. On a server, Cert and
+// Key identify the server and clients must present a certificate issued by CA.
+// On a client, Cert and Key are presented to the server, whose certificate must
+// be issued by CA. Device certificates for the fleet server carry the VIN as
+// their common name.
+type TLSConfig struct {
+	Cert string `json:"cert"` // PEM certificate
+	Key  string `json:"key"`  // PEM private key
+	CA   string `json:"ca"`   // PEM bundle of the CAs trusted for the peer
+}
+
+// load returns the key pair and the CA pool
+func (c *TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return cert, nil, err
+	}
+	if c.CA == "" {
+		return cert, nil, fmt.Errorf("tls: a CA is required to authenticate the peer")
+	}
+	pem, err := ioutil.ReadFile(c.CA)
+	if err != nil {
+		return cert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return cert, nil, fmt.Errorf("tls: no certificates found in %s", c.CA)
+	}
+	return cert, pool, nil
+}
+
+// serverConfig returns the config of a server requiring client certificates
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// clientConfig returns the config of a client presenting its certificate
+func (c *TLSConfig) clientConfig() (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// peerName returns the common name of the verified client certificate, if any
+func peerName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// torqueStream is the stream of segments imported from Torque Pro logs, kept
+// apart from the telemetry the device recorded itself
+const torqueStream = "torque"
+
+// Time layouts of the Torque Pro CSV log, e.g. "Sat Jun 01 12:00:00 GMT+01:00
+// 2019" for the GPS time and "01-Jun-2019 12:00:00.123" for the phone's clock
+const (
+	torqueGPSTime    = "Mon Jan 02 15:04:05 GMT-07:00 2006"
+	torqueDeviceTime = "02-Jan-2006 15:04:05.000"
+)
+
+// Leading columns of every Torque Pro log
+const (
+	torqueColGPSTime    = "GPS Time"
+	torqueColDeviceTime = "Device Time"
+	torqueColLongitude  = "Longitude"
+	torqueColLatitude   = "Latitude"
+)
+
+// torqueColumns maps Torque Pro's names of the PIDs the recorder reads to the
+// recorder's, so imported logs line up with recorded ones. Torque puts the
+// unit in parentheses after the name, e.g. "Speed (OBD)(km/h)".
+var torqueColumns = []struct {
+	torque, name, units string
+}{
+	{"Run time since engine start", "Runtime Since Start", "s"},
+	{"Speed (OBD)", "Vehicle Speed", "km/h"},
+	{"Engine RPM", "Engine RPM", "rpm"},
+	{"Throttle Position(Manifold)", "Throttle Position", "%"},
+	{"Fuel pressure", "Fuel Pressure", "kpa"},
+	{"Timing Advance", "Timing Advance", "°"},
+	{"Engine Coolant Temperature", "Coolant Temp", "°C"},
+	{"Engine Load", "Engine Load", "%"},
+	{"Intake Manifold Pressure", "Intake Manifold Pressure", "kpa"},
+	{"Mass Air Flow Rate", "MAF Air Flow Rate", "g/s"},
+	{"Fuel Trim Bank 1 Short Term", "Short Term Fuel Trim 1", "%"},
+	{"Fuel Trim Bank 2 Short Term", "Short Term Fuel Trim 2", "%"},
+	{"Fuel Trim Bank 1 Long Term", "Long Term Fuel Trim 1", "%"},
+	{"Fuel Trim Bank 2 Long Term", "Long Term Fuel Trim 2", "%"},
+	{"Ambient air temp", "Ambient Air Temp", "°C"},
+	{"Voltage (Control Module)", "Control Module Voltage", "V"},
+}
+
+// torqueConversions convert imperial units Torque may be set to log in to the
+// metric ones above
+var torqueConversions = map[string]struct {
+	metric  string
+	convert func(float64) float64
+}{
+	"mph": {"km/h", func(v float64) float64 { return v * 1.609344 }},
+	"°f":  {"°c", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"psi": {"kpa", func(v float64) float64 { return v * 6.894757 }},
+}
+
+// splitTorqueColumn splits a Torque column into its name and the unit in its
+// last parentheses, "" if it has none
+func splitTorqueColumn(column string) (name, unit string) {
+	column = strings.TrimSpace(column)
+	if i := strings.LastIndex(column, "("); i > 0 && strings.HasSuffix(column, ")") {
+		return column[:i], column[i+1 : len(column)-1]
+	}
+	return column, ""
+}
+
+// torqueReading is how a Torque column is imported: the recorder's reading it
+// maps to, converted to its units, or the column as it was named
+type torqueReading struct {
+	name    string
+	units   string
+	convert func(float64) float64
+}
+
+// torqueImportColumn returns how a Torque column is imported
+func torqueImportColumn(column string) torqueReading {
+	name, unit := splitTorqueColumn(column)
+	for _, c := range torqueColumns {
+		if !strings.EqualFold(c.torque, name) {
+			continue
+		}
+		units := readingUnits(c.name)
+		if strings.EqualFold(unit, c.units) {
+			return torqueReading{name: c.name, units: units}
+		}
+		if conversion, ok := torqueConversions[strings.ToLower(unit)]; ok && conversion.metric == strings.ToLower(c.units) {
+			return torqueReading{name: c.name, units: units, convert: conversion.convert}
+		}
+	}
+	// kept under Torque's name, so it exports back the same
+	return torqueReading{name: strings.TrimSpace(column)}
+}
+
+// torqueExportColumn returns the Torque column of a reading
+func torqueExportColumn(name, units string) string {
+	for _, c := range torqueColumns {
+		if c.name == name {
+			return c.torque + "(" + c.units + ")"
+		}
+	}
+	if units == "" || strings.HasSuffix(name, ")") {
+		return name
+	}
+	return name + "(" + units + ")"
+}
+
+// readingUnits returns the units the recorder gives a reading
+func readingUnits(name string) string {
+	for _, reading := range obdReadings {
+		if reading.name == name {
+			return reading.units
+		}
+	}
+	return ""
+}
+
+// parseTorqueTime returns the time of a Torque row, from its GPS time or
+// else the phone's clock in loc
+func parseTorqueTime(gpsTime, deviceTime string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(torqueGPSTime, strings.TrimSpace(gpsTime)); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.ParseInLocation(torqueDeviceTime, strings.TrimSpace(deviceTime), loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", deviceTime)
+	}
+	return t.UTC(), nil
+}
+
+// torqueMissing reports whether a Torque cell holds no value
+func torqueMissing(value string) bool {
+	return value == "" || value == "-" || value == "∞" || value == "-∞"
+}
+
+// ReadTorqueLog parses a Torque Pro CSV log into OBD records, positions
+// described by the vehicle's location privacy. Torque repeats the header
+// when a new trip starts in the same file.
+func (vehicle *Vehicle) ReadTorqueLog(r io.Reader, loc *time.Location) ([]*OBDRecord, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.LazyQuotes = true
+	var header []string
+	var columns []torqueReading
+	var records []*OBDRecord
+	for line := 1; ; line++ {
+		row, err := in.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(row) > 0 && strings.TrimSpace(strings.TrimPrefix(row[0], "\ufeff")) == torqueColGPSTime {
+			header = make([]string, len(row))
+			columns = make([]torqueReading, len(row))
+			for i, column := range row {
+				header[i] = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+				columns[i] = torqueImportColumn(header[i])
+			}
+			continue
+		}
+		if header == nil {
+			return nil, fmt.Errorf("line %d: not a Torque log, expected a header starting with %q", line, torqueColGPSTime)
+		}
+		var gpsTime, deviceTime, lat, lon string
+		record := &OBDRecord{}
+		for i, value := range row {
+			if i >= len(header) {
+				break
+			}
+			value = strings.TrimSpace(value)
+			switch header[i] {
+			case torqueColGPSTime:
+				gpsTime = value
+			case torqueColDeviceTime:
+				deviceTime = value
+			case torqueColLatitude:
+				lat = value
+			case torqueColLongitude:
+				lon = value
+			case "":
+			default:
+				if torqueMissing(value) {
+					continue
+				}
+				reading := Reading{Name: columns[i].name, Value: value, Units: columns[i].units}
+				if convert := columns[i].convert; convert != nil {
+					number, err := strconv.ParseFloat(value, 64)
+					if err != nil {
+						continue
+					}
+					reading.Value = strconv.FormatFloat(convert(number), 'f', -1, 64)
+				}
+				record.Readings = append(record.Readings, reading)
+			}
+		}
+		if record.Time, err = parseTorqueTime(gpsTime, deviceTime, loc); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		var fix *Fix
+		if latitude, err := strconv.ParseFloat(lat, 64); err == nil {
+			if longitude, err := strconv.ParseFloat(lon, 64); err == nil {
+				fix = &Fix{Time: record.Time, Lat: latitude, Lon: longitude}
+			}
+		}
+		record.Position = vehicle.describePosition(fix)
+		if len(record.Readings) > 0 || fix != nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// ImportTorqueLog stores the records of a Torque Pro log as a segment of its
+// own and anchors it. The segment's header names the file and its hash, so the
+// anchor also commits to the original log. A log overlapping telemetry
+// already stored is refused, the two would mix in the same segment.
+func (vehicle *Vehicle) ImportTorqueLog(path string, loc *time.Location) (*Segment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := vehicle.ReadTorqueLog(bytes.NewReader(data), loc)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s holds no readings", path)
+	}
+	start, end := records[0].Time, records[0].Time
+	for _, record := range records {
+		if record.Time.Before(start) {
+			start = record.Time
+		}
+		if record.Time.After(end) {
+			end = record.Time
+		}
+	}
+	existing, err := vehicle.store.Records(vehicle.vin, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("%d records are already stored between %s and %s", len(existing), start.Local().Format(time.RFC3339), end.Local().Format(time.RFC3339))
+	}
+
+	for _, record := range records {
+		if err := vehicle.store.PutRecord(vehicle.vin, record); err != nil {
+			return nil, err
+		}
+	}
+	if err := vehicle.store.Flush(); err != nil {
+		return nil, err
+	}
+	segment, err := vehicle.newSegment(torqueStream, start)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	segment.End, segment.Driver = end, ""
+	// the phone's clock, not the device's, timed the records
+	segment.ClockUncertain = true
+	segment.Header = strings.Join([]string{
+		"Blackbox Segment",
+		fmt.Sprintf("VIN: %s", segment.VIN),
+		fmt.Sprintf("Stream: %s", segment.Stream),
+		fmt.Sprintf("Sequence: %d", segment.Seq),
+		fmt.Sprintf("Start: %s", segment.Start.UTC().Format(time.RFC3339Nano)),
+		fmt.Sprintf("File: %s", segment.FileName()),
+		fmt.Sprintf("Imported From: %s", filepath.Base(path)),
+		fmt.Sprintf("Imported SHA-256: %s", hex.EncodeToString(sum[:])),
+		fmt.Sprintf("Imported: %s", time.Now().UTC().Format(time.RFC3339)),
+		"==================================================================\n",
+	}, "\n")
+	if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+		return nil, err
+	}
+	if err := vehicle.finishSegment(segment); err != nil {
+		return nil, err
+	}
+	appendAudit("torque-import", map[string]interface{}{
+		"file": path, "sha256": hex.EncodeToString(sum[:]), "records": segment.Records,
+		"start": start, "end": end, "hash": segment.Hash, "txID": segment.TxID,
+	})
+	return segment, nil
+}
+
+// writeTorque writes telemetry rows in the Torque Pro CSV layout, one line
+// per OBD record and a column per PID, so spreadsheets built on Torque logs
+// keep working
+func writeTorque(w io.Writer, rows []interface{}) error {
+	channels, records, _ := groupTelemetry(rows)
+	out := csv.NewWriter(w)
+	header := []string{torqueColGPSTime, torqueColDeviceTime, torqueColLongitude, torqueColLatitude}
+	// the latitude and longitude channels are the columns above
+	for _, channel := range channels[2:] {
+		header = append(header, torqueExportColumn(channel.name, channel.units))
+	}
+	out.Write(header)
+	cell := func(value float64) string {
+		if math.IsNaN(value) {
+			return "-"
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, record := range records {
+		local := record.time.In(time.Local)
+		line := []string{local.Format(torqueGPSTime), local.Format(torqueDeviceTime)}
+		for i := range channels {
+			value := math.NaN()
+			if i < len(record.values) {
+				value = record.values[i]
+			}
+			line = append(line, cell(value))
+		}
+		// Torque puts longitude before latitude
+		line[2], line[3] = line[3], line[2]
+		out.Write(line)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// importTorqueCommand imports Torque Pro CSV logs, anchoring each as a
+// segment of the torque stream
+func importTorqueCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("import-torque", flag.ExitOnError)
+	zone := flags.String("tz", "Local", "Time zone of the phone's clock, for rows without GPS time")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: blackbox import-torque [-tz zone] <log.csv>...")
+		os.Exit(2)
+	}
+	loc, err := time.LoadLocation(*zone)
+	if err != nil {
+		fmt.Println("Invalid -tz", err)
+		os.Exit(2)
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	vehicle.privacy = config.LocationPrivacy
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			fmt.Println("Failed to load device key", err)
+			os.Exit(1)
+		}
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		segment, err := vehicle.ImportTorqueLog(path, loc)
+		if err != nil {
+			fmt.Printf("Failed to import %s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Imported %d records of %s, %s to %s\n", segment.Records, path,
+			segment.Start.Local().Format(time.RFC3339), segment.End.Local().Format(time.RFC3339))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tpmsStaleAfter is how long a tire reading is logged before it is considered lost.
+// Most sensors transmit every minute while rolling and far less often when parked.
+const tpmsStaleAfter = 10 * time.Minute
+
+// TPMSOptions configures a "tpms" sensor entry. Tire pressure is not a standard
+// OBD-II PID, so readings come from a receiver program printing one JSON object
+// per line, such as `rtl_433 -F json` for 315/433MHz sensors or a bridge for
+// Bluetooth sensors emitting the same fields.
+type TPMSOptions struct {
+	Command []string          `json:"command"` // receiver program and arguments
+	Tires   map[string]string `json:"tires"`   // tire position (e.g. "FL") -> sensor ID
+}
+
+// tpmsReading is the subset of rtl_433's TPMS output we understand
+type tpmsReading struct {
+	ID           tpmsID   `json:"id"`
+	PressureKPa  *float64 `json:"pressure_kPa"`
+	PressurePSI  *float64 `json:"pressure_PSI"`
+	PressureBar  *float64 `json:"pressure_bar"`
+	TemperatureC *float64 `json:"temperature_C"`
+	received     time.Time
+}
+
+// tpmsID accepts sensor IDs printed as either JSON numbers or strings
+type tpmsID string
+
+func (id *tpmsID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	*id = tpmsID(s)
+	return nil
+}
+
+// kPa returns the reading's pressure in kPa
+func (r *tpmsReading) kPa() (float64, bool) {
+	switch {
+	case r.PressureKPa != nil:
+		return *r.PressureKPa, true
+	case r.PressurePSI != nil:
+		return *r.PressurePSI * 6.894757, true
+	case r.PressureBar != nil:
+		return *r.PressureBar * 100, true
+	}
+	return 0, false
+}
+
+// tpmsReceiver keeps the latest reading from every sensor the receiver hears
+type tpmsReceiver struct {
+	mu       sync.Mutex
+	readings map[string]*tpmsReading
+}
+
+func init() {
+	RegisterSensorType("tpms", newTPMSSensors)
+}
+
+// newTPMSSensors starts the receiver program and returns a pressure and
+// temperature sensor for each configured tire
+func newTPMSSensors(config SensorConfig) ([]Sensor, error) {
+	var options TPMSOptions
+	if err := json.Unmarshal(config.Options, &options); err != nil {
+		return nil, err
+	}
+	if len(options.Command) == 0 {
+		return nil, errors.New("tpms: no receiver command configured")
+	}
+	receiver := &tpmsReceiver{readings: make(map[string]*tpmsReading)}
+	if err := receiver.start(options.Command); err != nil {
+		return nil, err
+	}
+
+	tires := make([]string, 0, len(options.Tires))
+	for tire := range options.Tires {
+		tires = append(tires, tire)
+	}
+	sort.Strings(tires)
+
+	var sensors []Sensor
+	for _, tire := range tires {
+		id := options.Tires[tire]
+		sensors = append(sensors,
+			&tpmsSensor{receiver: receiver, tire: tire, id: id},
+			&tpmsSensor{receiver: receiver, tire: tire, id: id, temperature: true})
+	}
+	return sensors, nil
+}
+
+// start runs the receiver program in the background, restarting it if it exits
+func (r *tpmsReceiver) start(command []string) error {
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := r.listen(command); err != nil {
+				fmt.Println("TPMS receiver stopped", err)
+			}
+			time.Sleep(10 * time.Second)
+		}
+	}()
+	return nil
+}
+
+func (r *tpmsReceiver) listen(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		reading := new(tpmsReading)
+		if err := json.Unmarshal(scanner.Bytes(), reading); err != nil || reading.ID == "" {
+			continue
+		}
+		reading.received = time.Now()
+		r.mu.Lock()
+		r.readings[string(reading.ID)] = reading
+		r.mu.Unlock()
+	}
+	return cmd.Wait()
+}
+
+// latest returns the most recent reading from sensor id
+func (r *tpmsReceiver) latest(id string) (*tpmsReading, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reading, ok := r.readings[id]
+	if !ok {
+		return nil, fmt.Errorf("tpms: no reading from sensor %s", id)
+	}
+	if time.Since(reading.received) > tpmsStaleAfter {
+		return nil, fmt.Errorf("tpms: sensor %s silent since %s", id, reading.received.Format(time.Kitchen))
+	}
+	return reading, nil
+}
+
+// tpmsSensor is the pressure or temperature of one tire
+type tpmsSensor struct {
+	receiver    *tpmsReceiver
+	tire        string
+	id          string
+	temperature bool
+}
+
+func (s *tpmsSensor) Name() string {
+	if s.temperature {
+		return fmt.Sprintf("Tire %s Temp", s.tire)
+	}
+	return fmt.Sprintf("Tire %s Pressure", s.tire)
+}
+
+func (s *tpmsSensor) Units() string {
+	if s.temperature {
+		return "C"
+	}
+	return "kPa"
+}
+
+func (s *tpmsSensor) Sample() (float64, error) {
+	reading, err := s.receiver.latest(s.id)
+	if err != nil {
+		return 0, err
+	}
+	if s.temperature {
+		if reading.TemperatureC == nil {
+			return 0, errors.New("tpms: sensor does not report temperature")
+		}
+		return *reading.TemperatureC, nil
+	}
+	pressure, ok := reading.kPa()
+	if !ok {
+		return 0, errors.New("tpms: reading has no pressure")
+	}
+	return pressure, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Trip detection thresholds
+const (
+	tripIdleTimeout   = 5 * time.Minute  // stationary this long with the engine on ends a trip
+	harshAccelKmhPerS = 12.0             // ~0.34g speed gain in one second
+	harshBrakeKmhPerS = 15.0             // ~0.42g speed loss in one second
+	minTripDistanceKm = 0.05             // shorter "trips" are just repositioning in a driveway
+	maxSampleGap      = 10 * time.Second // longer gaps are not integrated into distance
+)
+
+// TripSample is the subset of telemetry the trip detector needs
+type TripSample struct {
+	Time     time.Time
+	Speed    float64 // km/h
+	Ignition bool    // engine running
+}
+
+// TripSummary is the compact, anchorable record of one trip
+type TripSummary struct {
+	VIN         string    `json:"vin" parquet:"vin"`
+	Start       time.Time `json:"start" parquet:"start"`
+	End         time.Time `json:"end" parquet:"end"`
+	Duration    float64   `json:"duration" parquet:"duration"` // seconds
+	Distance    float64   `json:"distance" parquet:"distance"` // km
+	MaxSpeed    float64   `json:"maxSpeed" parquet:"maxSpeed"` // km/h
+	HarshEvents int       `json:"harshEvents" parquet:"harshEvents"`
+	Speeding    float64   `json:"speeding" parquet:"speeding"`             // seconds above the scoring speed limit
+	Driver      string    `json:"driver,omitempty" parquet:"driver"`       // name of the driver assigned, if any
+	DriverKey   string    `json:"driverKey,omitempty" parquet:"driverKey"` // their identity key
+}
+
+// TripDetector turns a stream of samples into trips. A trip starts once the
+// vehicle moves with the ignition on and ends when the ignition turns off or the
+// vehicle idles for longer than tripIdleTimeout.
+type TripDetector struct {
+	vin        string
+	speeding   float64 // km/h above which driving time counts as speeding, 0 for none
+	imu        bool    // harsh events come from an IMU, not from speed changes
+	current    *TripSummary
+	last       TripSample
+	lastMoving time.Time
+}
+
+// NewTripDetector creates a detector for the vehicle with the given VIN
+func NewTripDetector(vin string) *TripDetector {
+	return &TripDetector{vin: vin}
+}
+
+// Update feeds a sample to the detector and returns the summary of a trip that
+// just ended, or nil
+func (d *TripDetector) Update(sample TripSample) *TripSummary {
+	last := d.last
+	d.last = sample
+
+	if d.current == nil {
+		if sample.Ignition && sample.Speed > 0 {
+			d.current = &TripSummary{VIN: d.vin, Start: sample.Time, End: sample.Time}
+			d.lastMoving = sample.Time
+		}
+		return nil
+	}
+
+	trip := d.current
+	dt := sample.Time.Sub(last.Time)
+	if dt > 0 && dt <= maxSampleGap {
+		// trapezoidal integration of speed over the sample interval
+		trip.Distance += (sample.Speed + last.Speed) / 2 * dt.Hours()
+
+		if d.speeding > 0 && sample.Speed > d.speeding {
+			trip.Speeding += dt.Seconds()
+		}
+		// with an IMU recording, the same braking would be counted twice
+		rate := (sample.Speed - last.Speed) / dt.Seconds()
+		if !d.imu && (rate >= harshAccelKmhPerS || -rate >= harshBrakeKmhPerS) {
+			trip.HarshEvents++
+		}
+	}
+	if sample.Speed > trip.MaxSpeed {
+		trip.MaxSpeed = sample.Speed
+	}
+	if sample.Speed > 0 {
+		d.lastMoving = sample.Time
+	}
+	trip.End = sample.Time
+
+	if !sample.Ignition || sample.Time.Sub(d.lastMoving) >= tripIdleTimeout {
+		return d.finish()
+	}
+	return nil
+}
+
+// RecordHarshEvent counts a harsh event detected by another sensor (e.g. an IMU)
+// against the trip in progress. While an IMU is recording, Update doesn't count
+// harsh events from speed changes itself.
+func (d *TripDetector) RecordHarshEvent() {
+	if d.current != nil {
+		d.current.HarshEvents++
+	}
+}
+
+// InProgress returns true if a trip has started and not yet ended
+func (d *TripDetector) InProgress() bool {
+	return d.current != nil
+}
+
+// Finish ends the trip in progress, if any, and returns its summary
+func (d *TripDetector) Finish() *TripSummary {
+	if d.current == nil {
+		return nil
+	}
+	return d.finish()
+}
+
+func (d *TripDetector) finish() *TripSummary {
+	trip := d.current
+	d.current = nil
+	trip.Duration = trip.End.Sub(trip.Start).Seconds()
+	if trip.Distance < minTripDistanceKm {
+		return nil
+	}
+	return trip
+}
+
+// anchorTrip logs the trip summary as a signed "trip-summary" event and anchors
+// it. The driver assigned, if any, countersigns the summary.
+func (vehicle *Vehicle) anchorTrip(trip *TripSummary) {
+	var driverSig []byte
+	if assignment := vehicle.drivers.assignment(); assignment != nil {
+		trip.Driver, trip.DriverKey = assignment.Driver, assignment.Key
+		summary, err := json.Marshal(trip)
+		if err == nil {
+			driverSig, err = vehicle.drivers.countersign(assignment.Key, summary)
+		}
+		if err != nil {
+			fmt.Println("Failed to countersign trip summary", err)
+		}
+	}
+	data := toEventData(trip)
+	if driverSig != nil {
+		data["driverSig"] = hex.EncodeToString(driverSig)
+	}
+	txID, err := vehicle.LogEvent(vehicle.NewEvent("trip-summary", data), true)
+	if err != nil {
+		fmt.Println("Failed to anchor trip summary", err)
+		return
+	}
+	fmt.Printf("Trip of %.1f km secured to factom. TxID: %s\n", trip.Distance, txID)
+	vehicle.anchorScores(trip)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTripDetectorHarshBrakeCountedOnce(t *testing.T) {
+	tests := []struct {
+		name string
+		imu  bool // an IMU is recording and reports the brake too
+	}{
+		{"speed changes only", false},
+		{"with an IMU", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trips := NewTripDetector(benchVIN)
+			trips.imu = tt.imu
+			start := time.Now()
+			// a minute at 60 km/h, 30 km/h a second later, then slowing
+			// gently to a stop
+			speeds := make([]float64, 68)
+			for i := range speeds {
+				switch {
+				case i <= 60:
+					speeds[i] = 60
+				default:
+					speeds[i] = 30 - float64(i-61)*5
+				}
+			}
+			for i, speed := range speeds {
+				trips.Update(TripSample{Time: start.Add(time.Duration(i) * time.Second), Speed: speed, Ignition: true})
+				if tt.imu && i == 61 {
+					trips.RecordHarshEvent()
+				}
+			}
+			trip := trips.Update(TripSample{Time: start.Add(time.Duration(len(speeds)) * time.Second), Ignition: false})
+			if trip == nil {
+				t.Fatal("trip did not end at ignition off")
+			}
+			if trip.HarshEvents != 1 {
+				t.Errorf("%d harsh events, want 1", trip.HarshEvents)
+			}
+		})
+	}
+}
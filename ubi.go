@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Time-of-day bands of UBI aggregates, in the vehicle's local time. Insurers
+// weigh night driving and rush hours more heavily than the rest of the day.
+const (
+	ubiNightStart = 22 // night runs from 22:00 to 05:00
+	ubiNightEnd   = 5
+)
+
+// ubiPeakHours are the weekday rush hours, [start, end) in local time
+var ubiPeakHours = [][2]int{{7, 9}, {16, 19}}
+
+// UBIRow aggregates one local day of driving the way usage-based insurance
+// programs score it: how far, when and how harshly the vehicle was driven.
+// Distance and time are split between bands assuming a constant speed over
+// each trip.
+type UBIRow struct {
+	VIN         string  `json:"vin" parquet:"vin"`
+	Date        string  `json:"date" parquet:"date"` // local, YYYY-MM-DD
+	Trips       int     `json:"trips" parquet:"trips"`
+	Distance    float64 `json:"distance" parquet:"distance"` // km
+	Duration    float64 `json:"duration" parquet:"duration"` // seconds
+	NightKm     float64 `json:"nightKm" parquet:"nightKm"`
+	PeakKm      float64 `json:"peakKm" parquet:"peakKm"` // weekday rush hours
+	WeekendKm   float64 `json:"weekendKm" parquet:"weekendKm"`
+	MaxSpeed    float64 `json:"maxSpeed" parquet:"maxSpeed"` // km/h
+	HarshEvents int     `json:"harshEvents" parquet:"harshEvents"`
+}
+
+// ubiBand returns whether local time t falls at night, in a weekday rush
+// hour or on a weekend
+func ubiBand(t time.Time) (night, peak, weekend bool) {
+	hour := t.Hour()
+	night = hour >= ubiNightStart || hour < ubiNightEnd
+	weekend = t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	if !weekend {
+		for _, hours := range ubiPeakHours {
+			if hour >= hours[0] && hour < hours[1] {
+				peak = true
+			}
+		}
+	}
+	return night, peak, weekend
+}
+
+// aggregateUBI sums trips into one row per local day, in date order. A trip
+// counts towards the day it started on, its distance towards the days and
+// bands it was driven in.
+func aggregateUBI(trips []*TripSummary, loc *time.Location) []UBIRow {
+	days := make(map[string]*UBIRow)
+	day := func(vin string, t time.Time) *UBIRow {
+		date := t.Format("2006-01-02")
+		if days[date] == nil {
+			days[date] = &UBIRow{VIN: vin, Date: date}
+		}
+		return days[date]
+	}
+	for _, trip := range trips {
+		start, end := trip.Start.In(loc), trip.End.In(loc)
+		first := day(trip.VIN, start)
+		first.Trips++
+		first.HarshEvents += trip.HarshEvents
+		if trip.MaxSpeed > first.MaxSpeed {
+			first.MaxSpeed = trip.MaxSpeed
+		}
+		total := end.Sub(start)
+		if total <= 0 {
+			first.Distance += trip.Distance
+			continue
+		}
+		// walk the trip an hour of the clock at a time, as bands change on the hour
+		for t := start; t.Before(end); {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if next.After(end) {
+				next = end
+			}
+			span := next.Sub(t)
+			km := trip.Distance * span.Seconds() / total.Seconds()
+			row := day(trip.VIN, t)
+			row.Distance += km
+			row.Duration += span.Seconds()
+			night, peak, weekend := ubiBand(t)
+			if night {
+				row.NightKm += km
+			}
+			if peak {
+				row.PeakKm += km
+			}
+			if weekend {
+				row.WeekendKm += km
+			}
+			t = next
+		}
+	}
+	rows := make([]UBIRow, 0, len(days))
+	for _, row := range days {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Date < rows[j].Date })
+	return rows
+}
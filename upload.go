@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadConfig sends anchored evidence files to object storage so they survive
+// theft of the device or failure of its SD card
+type UploadConfig struct {
+	Backend   string `json:"backend"`  // "s3", "minio" or "gcs"
+	Endpoint  string `json:"endpoint"` // base URL, required for minio
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"` // for gcs, an HMAC interoperability key
+	SecretKey string `json:"secretKey"`
+	Interval  int    `json:"interval"` // seconds between upload passes, default 300
+}
+
+// Uploader stores a file under key and returns its URL
+type Uploader interface {
+	Upload(key string, data []byte) (string, error)
+}
+
+// NewUploader creates the uploader for the configured backend. S3, MinIO, and
+// GCS all accept S3 style requests signed with AWS Signature Version 4.
+// Redirects outside residency, if set, are refused.
+func NewUploader(config *UploadConfig, residency *ResidencyConfig) (Uploader, error) {
+	u := &s3Uploader{
+		bucket:    config.Bucket,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	var err error
+	if u.endpoint, u.region, u.virtualHost, err = config.target(); err != nil {
+		return nil, err
+	}
+	residency.guard(u.client)
+	if u.bucket == "" || u.accessKey == "" || u.secretKey == "" {
+		return nil, fmt.Errorf("%s uploads need a bucket and credentials", config.Backend)
+	}
+	return u, nil
+}
+
+// target returns the endpoint and region uploads go to, defaulted for the
+// backend, and whether the bucket is part of the endpoint's host name
+func (config *UploadConfig) target() (endpoint, region string, virtualHost bool, err error) {
+	endpoint, region = strings.TrimSuffix(config.Endpoint, "/"), config.Region
+	switch config.Backend {
+	case "s3":
+		if region == "" {
+			region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", config.Bucket, region)
+			virtualHost = true
+		}
+	case "minio":
+		if endpoint == "" {
+			return "", "", false, fmt.Errorf("minio uploads need an endpoint")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+	case "gcs":
+		// GCS ignores the region, a regional endpoint keeps data in its region
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		if region == "" {
+			region = "auto"
+		}
+	default:
+		return "", "", false, fmt.Errorf("unknown upload backend %q", config.Backend)
+	}
+	return endpoint, region, virtualHost, nil
+}
+
+// s3Uploader PUTs objects to an S3 compatible API
+type s3Uploader struct {
+	endpoint    string
+	region      string
+	bucket      string
+	accessKey   string
+	secretKey   string
+	virtualHost bool // the bucket is part of the endpoint's host name
+	client      *http.Client
+}
+
+func (u *s3Uploader) Upload(key string, data []byte) (string, error) {
+	path := "/" + escapeKey(key)
+	if !u.virtualHost {
+		path = "/" + u.bucket + path
+	}
+	req, err := http.NewRequest("PUT", u.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	u.sign(req, time.Now().UTC())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("upload of %s failed: %s %s", key, resp.Status, body)
+	}
+	return req.URL.String(), nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. Every
+// header already set on req, plus host and the date, is signed.
+func (u *s3Uploader) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+u.secretKey), date)
+	key = hmacSHA256(key, u.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapeKey URI encodes each segment of an object key
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// RunUploads uploads anchored segments every interval until stop is closed
+func (vehicle *Vehicle) RunUploads(uploader Uploader, interval time.Duration, stop <-chan struct{}) error {
+	for {
+		if err := vehicle.uploadPending(uploader, vehicle.chain); err != nil {
+			fmt.Println("Upload pass failed", err)
+		}
+		if !sleep(interval, stop) {
+			return nil
+		}
+	}
+}
+
+// uploadPending uploads every segment whose hash is confirmed on chain and that
+// has not been uploaded yet. Files are uploaded exactly as stored, so encrypted
+// evidence stays encrypted in the bucket.
+func (vehicle *Vehicle) uploadPending(uploader Uploader, reader chainReader) error {
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.Hash == "" || segment.Pruned || !segment.UploadedAt.IsZero() {
+			continue
+		}
+		if segment.EntryHash == "" {
+			hash, err := hex.DecodeString(segment.Hash)
+			if err != nil {
+				return err
+			}
+			result, err := findHashEntry(reader, vehicle, hash)
+			if err != nil {
+				return err
+			}
+			if !result.Verified {
+				continue // not in an entry block yet
+			}
+			segment.EntryHash = result.EntryHash
+			if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+				return err
+			}
+		}
+
+		data, err := ioutil.ReadFile(segment.Path)
+		if err != nil {
+			fmt.Printf("Cannot upload %s: %v\n", segment.Path, err)
+			continue
+		}
+		name := segment.FileName()
+		if strings.HasSuffix(segment.Path, encryptedExt) {
+			name += encryptedExt
+		}
+		key := fmt.Sprintf("%s/%s/%s", vehicle.vin, segment.Stream, name)
+		location, err := uploader.Upload(key, data)
+		if err != nil {
+			return err
+		}
+		segment.UploadURL = location
+		segment.UploadedAt = time.Now()
+		if err := vehicle.store.PutSegment(vehicle.vin, segment); err != nil {
+			return err
+		}
+		appendAudit("upload", map[string]interface{}{
+			"stream": segment.Stream,
+			"path":   segment.Path,
+			"url":    location,
+			"hash":   segment.Hash,
+		})
+		fmt.Printf("Uploaded %s to %s\n", segment.Path, location)
+	}
+	return nil
+}
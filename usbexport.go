@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// USBExportConfig lets a driver export evidence to a USB stick at the roadside
+// by pressing a button, without a phone or laptop
+type USBExportConfig struct {
+	Button string `json:"button"` // sysfs GPIO value file of the export button
+	Hours  int    `json:"hours"`  // how far back a button export reaches, default 2
+}
+
+// usbPollInterval is how often the export button and USB mounts are checked
+const usbPollInterval = 500 * time.Millisecond
+
+// defaultExportHours is how much evidence an export covers unless configured
+const defaultExportHours = 2
+
+// EvidenceProof is everything needed to check one exported file against the chain
+type EvidenceProof struct {
+	File        string          `json:"file"`
+	Stream      string          `json:"stream"`
+	Start       time.Time       `json:"start"`
+	End         time.Time       `json:"end"`
+	SHA256      string          `json:"sha256"`
+	Compression string          `json:"compression,omitempty"`
+	ChainID     string          `json:"chainID"`
+	TxID        string          `json:"txID,omitempty"`
+	EntryHash   string          `json:"entryHash,omitempty"`
+	Receipt     json.RawMessage `json:"receipt,omitempty"`
+
+	// Redaction opens a telemetry file exported with fields redacted, whose
+	// hash no longer matches SHA256. Withheld footage has a proof but no File.
+	Redaction *Redaction `json:"redaction,omitempty"`
+	Withheld  bool       `json:"withheld,omitempty"`
+}
+
+// EvidenceManifest lists the contents of an evidence export
+type EvidenceManifest struct {
+	VIN       string          `json:"vin"`
+	ChainID   string          `json:"chainID"`
+	PublicKey string          `json:"publicKey"` // hex ed25519 key that signed every entry
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Created   time.Time       `json:"created"`
+	Proofs    []EvidenceProof `json:"proofs"`
+	Incidents []string        `json:"incidents,omitempty"`
+	Events    int             `json:"events"`
+	Redacted  []string        `json:"redacted,omitempty"` // fields redacted from the export
+}
+
+// verificationManual is written next to every export for whoever receives it
+const verificationManual = `HOW TO VERIFY THIS EVIDENCE
+===========================
+
+This folder was exported from a blackbox vehicle recorder. Every file in
+files/ had its SHA-256 hash signed by the vehicle owner's key and written to
+the Factom blockchain when it was recorded, before any dispute existed.
+
+To check a file:
+
+1. Compute its SHA-256 hash, e.g. "sha256sum files/<name>".
+2. Find the file in manifest.json and compare the hash with "sha256".
+3. Look up "entryHash" on a Factom explorer, or any factomd node, and check
+   that the entry is in chain "chainID" and that its content is that hash.
+   The entry's time is when the hash was anchored.
+4. Optionally check the entry's first ExtID, an ed25519 signature, against
+   "publicKey" in manifest.json.
+
+Files ending in .gz or .zst are compressed, the hash is of the compressed
+file. Decompress them with gzip or zstd to read them.
+
+receipts in proofs/ are Merkle proofs from the entry to a directory block,
+anchored in turn to Bitcoin, so the file can be verified even without
+trusting the node that served them.
+
+incidents/ holds crash records, each with its EDR report of the crash data
+elements 49 CFR Part 563 names (see "blackbox edr"), and events.log the
+signed events in range.
+
+If manifest.json lists "redacted" fields, the owner chose not to share them.
+Telemetry files ending in .redacted.txt show each redacted value as
+"[redacted]" and do not match "sha256", the hash of the whole file. Their
+proof's "redaction" instead holds, line by line, a salt for lines shown and a
+hash for lines redacted, from which "blackbox verify-redaction <folder>"
+rebuilds the tree of the file's lines and checks its root against the
+"fields" the entry's metadata commits to. Footage marked "withheld" was
+recorded and anchored but is not included. With "position" redacted,
+events.log and the crash records in incidents/ are left out as they carry
+positions.
+`
+
+// ExportEvidence copies every segment recorded between from and to into a new
+// folder under dir, decrypted, with its proof, related incidents and events,
+// and a manual explaining how to verify it. It returns the folder's path.
+func (vehicle *Vehicle) ExportEvidence(dir string, from, to time.Time) (string, *EvidenceManifest, error) {
+	return vehicle.exportStreams(dir, from, to, nil, nil)
+}
+
+// ExportRedacted is ExportEvidence redacting fields: the lines of telemetry
+// files naming them, e.g. "position" or "Vehicle Speed", and with "video"
+// the footage. Telemetry files that can't be redacted are left out.
+func (vehicle *Vehicle) ExportRedacted(dir string, from, to time.Time, fields []string) (string, *EvidenceManifest, error) {
+	return vehicle.exportStreams(dir, from, to, nil, fields)
+}
+
+// exportStreams is ExportEvidence of only the segments of streams, or of
+// every stream if nil, redacting fields
+func (vehicle *Vehicle) exportStreams(dir string, from, to time.Time, streams, redact []string) (string, *EvidenceManifest, error) {
+	root := filepath.Join(dir, fmt.Sprintf("blackbox_%s_%s", vehicle.vin, from.Format("20060102150405")))
+	for _, sub := range []string{"files", "proofs", "incidents"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0700); err != nil {
+			return "", nil, err
+		}
+	}
+	manifest := &EvidenceManifest{
+		VIN:       vehicle.vin,
+		ChainID:   vehicle.chainID,
+		PublicKey: fmt.Sprintf("%x", vehicle.owner.ecAddress.PubBytes()),
+		From:      from,
+		To:        to,
+		Created:   time.Now().UTC(),
+		Redacted:  redact,
+	}
+
+	segments, err := vehicle.store.Segments(vehicle.vin, time.Time{}, to)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, segment := range segments {
+		if segment.Path == "" || segment.Hash == "" || segment.End.Before(from) {
+			continue
+		}
+		if streams != nil && !contains(streams, segment.Stream) {
+			continue
+		}
+		withheld := segment.Stream == "video" && redacts(redact, redactVideo)
+		var data []byte
+		var redaction *Redaction
+		name := segment.FileName()
+		if !withheld {
+			if data, err = vehicle.readEvidence(segment.Path); err != nil {
+				fmt.Printf("Skipping %s: %v\n", segment.Path, err)
+				continue
+			}
+		}
+		if lines := lineRedactions(redact); len(lines) > 0 && segment.Stream == telemetryStream {
+			text, err := decompress(data, segment.Compression)
+			if err == nil {
+				data, redaction, err = redactSegment(segment, text, lines)
+			}
+			if err != nil {
+				fmt.Printf("Skipping %s, it can't be redacted: %v\n", segment.Path, err)
+				continue
+			}
+			name = strings.TrimSuffix(name, segmentExt(segment)) + ".redacted.txt"
+		}
+		if !withheld {
+			if err := ioutil.WriteFile(filepath.Join(root, "files", name), data, 0600); err != nil {
+				return "", nil, err
+			}
+		}
+		proof := EvidenceProof{
+			File:        "files/" + name,
+			Stream:      segment.Stream,
+			Start:       segment.Start,
+			End:         segment.End,
+			SHA256:      segment.Hash,
+			Compression: segment.Compression,
+			ChainID:     vehicle.chainID,
+			TxID:        segment.TxID,
+			EntryHash:   segment.EntryHash,
+			Redaction:   redaction,
+			Withheld:    withheld,
+		}
+		if withheld {
+			proof.File = ""
+		}
+		if segment.EntryHash != "" {
+			if receipt, err := vehicle.chain.receipt(segment.EntryHash); err == nil {
+				proof.Receipt, _ = json.Marshal(receipt)
+			}
+		}
+		proofData, err := json.MarshalIndent(proof, "", "  ")
+		if err != nil {
+			return "", nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "proofs", name+".json"), proofData, 0600); err != nil {
+			return "", nil, err
+		}
+		manifest.Proofs = append(manifest.Proofs, proof)
+	}
+
+	incidents, err := filepath.Glob("incident_*.json")
+	if err != nil {
+		return "", nil, err
+	}
+	if redacts(redact, redactPosition) {
+		incidents = nil
+	}
+	// EDR reports carry no position
+	reports, err := filepath.Glob("edr_*.json")
+	if err != nil {
+		return "", nil, err
+	}
+	for _, path := range append(incidents, reports...) {
+		layout := "incident_20060102150405.json"
+		if strings.HasPrefix(path, "edr_") {
+			layout = "edr_20060102150405.json"
+		}
+		at, err := time.ParseInLocation(layout, path, time.Local)
+		if err != nil || at.Before(from) || at.After(to) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "incidents", path), data, 0600); err != nil {
+			return "", nil, err
+		}
+		manifest.Incidents = append(manifest.Incidents, path)
+	}
+
+	if !redacts(redact, redactPosition) {
+		if manifest.Events, err = copyEvents(filepath.Join(root, eventLogPath), from, to); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "VERIFY.txt"), []byte(verificationManual), 0600); err != nil {
+		return "", nil, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := writeAtomic(filepath.Join(root, "manifest.json"), data); err != nil {
+		return "", nil, err
+	}
+	appendAudit("evidence-export", map[string]interface{}{
+		"destination": root,
+		"from":        from,
+		"to":          to,
+		"files":       len(manifest.Proofs),
+		"redacted":    redact,
+	})
+	return root, manifest, nil
+}
+
+// copyEvents writes the signed events logged between from and to to path
+func copyEvents(path string, from, to time.Time) (int, error) {
+	in, err := os.Open(eventLogPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var signed SignedEvent
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &signed) != nil || json.Unmarshal(signed.Event, &event) != nil {
+			continue
+		}
+		if event.Time.Before(from) || event.Time.After(to) {
+			continue
+		}
+		if _, err := out.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// findUSBMounts returns the mount points of removable block devices
+func findUSBMounts() ([]string, error) {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/sd") {
+			continue
+		}
+		// /dev/sda1 -> /sys/block/sda/removable
+		disk := strings.TrimRight(strings.TrimPrefix(fields[0], "/dev/"), "0123456789")
+		removable, err := ioutil.ReadFile(filepath.Join("/sys/block", disk, "removable"))
+		if err != nil || strings.TrimSpace(string(removable)) != "1" {
+			continue
+		}
+		// /proc/mounts escapes spaces in paths as \040
+		mounts = append(mounts, strings.Replace(fields[1], `\040`, " ", -1))
+	}
+	return mounts, nil
+}
+
+// WatchUSBExport exports the last config.Hours of evidence to the first USB
+// stick found whenever the export button is pressed. Progress is reported as
+// alerts so it shows wherever the owner sees them. It returns once stop is
+// closed.
+func (vehicle *Vehicle) WatchUSBExport(config *USBExportConfig, stop <-chan struct{}) error {
+	hours := config.Hours
+	if hours <= 0 {
+		hours = defaultExportHours
+	}
+	pressed := false
+	for {
+		if !sleep(usbPollInterval, stop) {
+			return nil
+		}
+		value, err := ioutil.ReadFile(config.Button)
+		if err != nil {
+			return fmt.Errorf("reading the USB export button: %v", err)
+		}
+		// buttons pull the line low when pressed, act on the press not the hold
+		down := strings.TrimSpace(string(value)) == "0"
+		if !down || pressed {
+			pressed = down
+			continue
+		}
+		pressed = true
+		vehicle.exportToUSB(hours, map[string]interface{}{"via": "button"})
+	}
+}
+
+// exportToUSB exports the last hours of evidence to the first USB stick found,
+// reporting progress as alerts. who asked for it is signed into the access log.
+func (vehicle *Vehicle) exportToUSB(hours int, who map[string]interface{}) {
+	mounts, err := findUSBMounts()
+	if err != nil || len(mounts) == 0 {
+		vehicle.raiseAlert("usb-export", "insert a USB stick, then try again", nil)
+		return
+	}
+	vehicle.raiseAlert("usb-export", fmt.Sprintf("exporting the last %d hours to %s, do not remove the stick", hours, mounts[0]), nil)
+	to := time.Now()
+	path, manifest, err := vehicle.ExportEvidence(mounts[0], to.Add(-time.Duration(hours)*time.Hour), to)
+	if err != nil {
+		vehicle.raiseAlert("usb-export", "export failed: "+err.Error(), nil)
+		return
+	}
+	syncDir(path)
+	vehicle.logAccess("evidence-export", path, evidenceData, who)
+	vehicle.raiseAlert("usb-export", fmt.Sprintf("exported %d files to %s, the stick can be removed", len(manifest.Proofs), path), nil)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/FactomProject/factom"
+)
+
+// hashEntryVersion is the schema version of the metadata of hash entries
+// written by this recorder. Entries from before versioning have none, version
+// 2 added clockUncertain and 3 fields.
+const hashEntryVersion = 3
+
+// maxEntrySize is the most bytes of ExtIDs and content Factom accepts in an
+// entry. Anybody can write to a vehicle's chain, but not more than this, so a
+// larger entry is refused rather than parsed.
+const maxEntrySize = 10240
+
+// maxHashMetaSize bounds the metadata ExtID of a hash entry. The recorder's
+// is a few hundred bytes.
+const maxHashMetaSize = 1024
+
+// errNotHashEntry is returned by parseHashEntry for entries of other kinds,
+// e.g. events or the chain's first entry
+var errNotHashEntry = errors.New("not a hash entry")
+
+// VerifyResult describes where on chain a local file's hash was found.
+// Malformed entries, those shaped like hash entries but breaking their
+// schema, are listed rather than silently skipped.
+type VerifyResult struct {
+	Verified        bool      `json:"verified"`        // true if a matching, correctly signed entry was found
+	EntryHash       string    `json:"entryHash"`       // hash of the matching entry
+	BlockHeight     int64     `json:"blockHeight"`     // directory block height containing the entry
+	BlockTime       time.Time `json:"blockTime"`       // timestamp of the entry block
+	SigningKey      []byte    `json:"signingKey"`      // public key that signed the entry
+	EntryBlockKeyMR string    `json:"entryBlockKeyMR"` // KeyMR of the entry block holding the entry
+	EntrySequence   int64     `json:"entrySequence"`   // sequence number of that entry block within the chain
+	EntryPosition   int       `json:"entryPosition"`   // index of the entry within its entry block
+
+	// Duplicates counts later entries signed by the owner anchoring the same
+	// hash, e.g. replays of the first. They prove nothing the first doesn't.
+	Duplicates int              `json:"duplicates,omitempty"`
+	Malformed  []MalformedEntry `json:"malformed,omitempty"`
+}
+
+// MalformedEntry is an entry on the vehicle's chain that verification
+// skipped as it breaks the hash entry schema
+type MalformedEntry struct {
+	EntryHash string `json:"entryHash"`
+	Reason    string `json:"reason"`
+}
+
+// hashEntryFields are the parts of a hash entry, checked by parseHashEntry
+type hashEntryFields struct {
+	signature [ed.SignatureSize]byte
+	key       [ed.PublicKeySize]byte
+	meta      *HashMeta // nil for entries with two ExtIDs
+	signed    []byte    // what the signature covers
+	hashes    [][]byte  // SHA-256 hashes anchored
+}
+
+// parseHashEntry strictly parses a hash entry, ExtIDs [sig, key] or [sig,
+// key, meta] with one SHA-256 hash or a batch of them as content. It returns
+// errNotHashEntry for entries of other kinds and a descriptive error for those
+// breaking the schema: an entry larger than Factom allows, a signature or key
+// of the wrong length, metadata that isn't a known version of HashMeta, or
+// content that isn't the hashes the metadata announces.
+func parseHashEntry(entry *factom.Entry) (*hashEntryFields, error) {
+	ext := entry.ExtIDs
+	if len(ext) != 2 && len(ext) != 3 || len(ext) == 2 && string(ext[0]) == "Vehicle Identity Chain" {
+		return nil, errNotHashEntry
+	}
+	if size := entrySize(entry); size > maxEntrySize {
+		return nil, fmt.Errorf("entry is %d bytes, more than the %d Factom allows", size, maxEntrySize)
+	}
+	if len(ext[0]) != ed.SignatureSize {
+		return nil, fmt.Errorf("signature is %d bytes, not %d", len(ext[0]), ed.SignatureSize)
+	}
+	if len(ext[1]) != ed.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, not %d", len(ext[1]), ed.PublicKeySize)
+	}
+	fields := &hashEntryFields{signed: entry.Content}
+	copy(fields.signature[:], ext[0])
+	copy(fields.key[:], ext[1])
+	hashes := 1
+	if len(ext) == 3 {
+		if len(ext[2]) > maxHashMetaSize {
+			return nil, fmt.Errorf("metadata is %d bytes, at most %d allowed", len(ext[2]), maxHashMetaSize)
+		}
+		dec := json.NewDecoder(bytes.NewReader(ext[2]))
+		dec.DisallowUnknownFields()
+		fields.meta = new(HashMeta)
+		if err := dec.Decode(fields.meta); err != nil {
+			return nil, fmt.Errorf("metadata: %v", err)
+		}
+		if dec.More() {
+			return nil, errors.New("metadata: trailing data")
+		}
+		if fields.meta.Version < 0 || fields.meta.Version > hashEntryVersion {
+			return nil, fmt.Errorf("unknown schema version %d", fields.meta.Version)
+		}
+		if fields.meta.Hashes < 0 || fields.meta.Hashes > maxBatchHashes {
+			return nil, fmt.Errorf("batch of %d hashes, at most %d allowed", fields.meta.Hashes, maxBatchHashes)
+		}
+		if fields.meta.Hashes > 0 {
+			hashes = fields.meta.Hashes
+		}
+		fields.signed = append(append([]byte(nil), entry.Content...), ext[2]...)
+	}
+	if len(entry.Content) != hashes*sha256.Size {
+		return nil, fmt.Errorf("content is %d bytes, not the %d of %d SHA-256 hashes", len(entry.Content), hashes*sha256.Size, hashes)
+	}
+	for i := 0; i < hashes; i++ {
+		fields.hashes = append(fields.hashes, entry.Content[i*sha256.Size:(i+1)*sha256.Size])
+	}
+	return fields, nil
+}
+
+// entrySize returns the bytes of an entry's ExtIDs, with their 2 byte
+// lengths, and content, which Factom limits to maxEntrySize
+func entrySize(entry *factom.Entry) int {
+	size := len(entry.Content)
+	for _, ext := range entry.ExtIDs {
+		size += 2 + len(ext)
+	}
+	return size
+}
+
+// chainReader is the subset of the factomd API needed to walk a chain block by block
+type chainReader interface {
+	chainHead(chainID string) (string, error)
+	entryBlock(keyMR string) (*factom.EBlock, error)
+	entry(entryHash string) (*factom.Entry, error)
+}
+
+// findHashEntry walks the vehicle's whole chain from its head back to the
+// first entry block and returns the location of the earliest entry signed by
+// the vehicle's owner containing hash, with the later ones counted as
+// duplicates, and the malformed entries passed on the way. An entry block
+// linking back to one already walked fails the walk, so a lying node can't
+// make it loop.
+func findHashEntry(reader chainReader, vehicle *Vehicle, hash []byte) (*VerifyResult, error) {
+	keyMR, err := reader.chainHead(vehicle.chainID)
+	if err != nil {
+		return nil, err
+	}
+	result := &VerifyResult{}
+	walked := make(map[string]bool)
+	for keyMR != "" && keyMR != zeroHash {
+		if walked[keyMR] {
+			return nil, fmt.Errorf("entry block %s links back to itself", keyMR)
+		}
+		walked[keyMR] = true
+		eblock, err := reader.entryBlock(keyMR)
+		if err != nil {
+			return nil, err
+		} else if eblock == nil {
+			return nil, fmt.Errorf("entry block %s not found", keyMR)
+		}
+		for i := len(eblock.EntryList) - 1; i >= 0; i-- {
+			ebEntry := eblock.EntryList[i]
+			entry, err := reader.entry(ebEntry.EntryHash)
+			if err != nil {
+				return nil, err
+			} else if entry == nil {
+				return nil, fmt.Errorf("entry %s not found", ebEntry.EntryHash)
+			}
+			matches, err := vehicle.entryMatchesHash(entry, hash)
+			if err != nil {
+				result.Malformed = append(result.Malformed, MalformedEntry{EntryHash: ebEntry.EntryHash, Reason: err.Error()})
+				continue
+			}
+			if !matches {
+				continue
+			}
+			if result.Verified {
+				result.Duplicates++
+			}
+			result.Verified = true
+			result.EntryHash = ebEntry.EntryHash
+			result.BlockHeight = eblock.Header.DBHeight
+			result.BlockTime = time.Unix(eblock.Header.Timestamp, 0)
+			result.SigningKey = entry.ExtIDs[1]
+			result.EntryBlockKeyMR = keyMR
+			result.EntrySequence = eblock.Header.BlockSequenceNumber
+			result.EntryPosition = i
+		}
+		keyMR = eblock.Header.PrevKeyMR
+	}
+	return result, nil
+}
+
+// zeroHash marks the end of a chain when following PrevKeyMR links
+const zeroHash = "0000000000000000000000000000000000000000000000000000000000000000"
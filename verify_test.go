@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/FactomProject/factom"
+)
+
+// testVehicle returns a vehicle with a new owner, its chain registered on a
+// chain kept in memory, and runs the test in a directory of its own
+func testVehicle(t *testing.T) (*Vehicle, *memoryChain) {
+	t.Helper()
+	inTempDir(t)
+	chain := newMemoryChain()
+	vehicle, err := NewVehicle(benchVIN, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehicle.owner = testOwner(t)
+	if _, err := vehicle.Register(vehicle.owner.ecAddress); err != nil {
+		t.Fatal(err)
+	}
+	return vehicle, chain
+}
+
+// anchorTestHash writes an entry anchoring hash to the vehicle's chain,
+// signed by signer's key
+func anchorTestHash(t testing.TB, vehicle *Vehicle, signer *Person, hash []byte) {
+	t.Helper()
+	entry, err := (&Vehicle{chainID: vehicle.chainID, owner: signer}).hashEntry(hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitRevealEntry(vehicle.chain, defaultRetry, entry, signer.ecAddress); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ways a lying node can link a chain's entry blocks, applied to a chain kept
+// in memory
+var chainLoops = []struct {
+	name string
+	link func(chain *memoryChain, chainID string)
+}{
+	{"head links to itself", func(chain *memoryChain, chainID string) {
+		head := chain.heads[chainID]
+		chain.blocks[head].Header.PrevKeyMR = head
+	}},
+	{"first block links to the head", func(chain *memoryChain, chainID string) {
+		head := chain.heads[chainID]
+		first := head
+		for chain.blocks[first].Header.PrevKeyMR != "" {
+			first = chain.blocks[first].Header.PrevKeyMR
+		}
+		chain.blocks[first].Header.PrevKeyMR = head
+	}},
+	{"block links to a missing one", func(chain *memoryChain, chainID string) {
+		head := chain.heads[chainID]
+		chain.blocks[head].Header.PrevKeyMR = strings.Repeat("ab", 32)
+	}},
+}
+
+// loopChain links the chain's entry blocks like loop does
+func loopChain(chain *memoryChain, chainID string, loop func(*memoryChain, string)) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	loop(chain, chainID)
+}
+
+func FuzzParseHashEntry(f *testing.F) {
+	hash := sha256.Sum256([]byte("segment"))
+	sig, key := bytes.Repeat([]byte{1}, 64), bytes.Repeat([]byte{2}, 32)
+	meta := func(m interface{}) []byte {
+		b, _ := json.Marshal(m)
+		return b
+	}
+	seeds := []struct {
+		sig, key, meta, content []byte
+		withMeta                bool
+	}{
+		{sig, key, nil, hash[:], false},
+		{sig, key, meta(HashMeta{Stream: "obd", Version: hashEntryVersion}), hash[:], true},
+		{sig, key, meta(HashMeta{Hashes: 2}), append(hash[:], hash[:]...), true},
+		// oversized ExtIDs and content
+		{sig, key, bytes.Repeat([]byte{'x'}, maxEntrySize), hash[:], true},
+		{sig, key, nil, bytes.Repeat(hash[:], maxEntrySize/sha256.Size+1), false},
+		// short and garbage signatures
+		{sig[:10], key, nil, hash[:], false},
+		{nil, key, nil, hash[:], false},
+		{[]byte("Vehicle Identity Chain"), []byte(benchVIN), nil, nil, false},
+		// wrong key lengths
+		{sig, key[:31], nil, hash[:], false},
+		{sig, append(key, 0), nil, hash[:], false},
+		// unknown fields, oversized, trailing or malformed metadata
+		{sig, key, []byte(`{"stream":"obd","bogus":1}`), hash[:], true},
+		{sig, key, meta(HashMeta{Stream: strings.Repeat("s", maxHashMetaSize)}), hash[:], true},
+		{sig, key, []byte(`{}{}`), hash[:], true},
+		{sig, key, []byte(`{"stream":`), hash[:], true},
+		{sig, key, []byte(`null`), hash[:], true},
+		{sig, key, meta(HashMeta{Version: hashEntryVersion + 1}), hash[:], true},
+		{sig, key, meta(HashMeta{Hashes: -1}), hash[:], true},
+		{sig, key, meta(HashMeta{Hashes: maxBatchHashes + 1}), hash[:], true},
+		{sig, key, meta(HashMeta{Hashes: 3}), hash[:], true},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.sig, seed.key, seed.meta, seed.content, seed.withMeta)
+	}
+	vehicle := &Vehicle{owner: testOwner(f)}
+	f.Fuzz(func(t *testing.T, sig, key, meta, content []byte, withMeta bool) {
+		entry := &factom.Entry{ExtIDs: [][]byte{sig, key}, Content: content}
+		if withMeta {
+			entry.ExtIDs = append(entry.ExtIDs, meta)
+		}
+		fields, err := parseHashEntry(entry)
+		vehicle.indexEntry(entry)
+		vehicle.entryMatchesHash(entry, content)
+		if err != nil {
+			return
+		}
+		if entrySize(entry) > maxEntrySize {
+			t.Fatalf("accepted an entry of %d bytes", entrySize(entry))
+		}
+		if len(fields.hashes) == 0 || len(fields.hashes) > maxBatchHashes || len(fields.hashes)*sha256.Size != len(content) {
+			t.Fatalf("accepted %d hashes in %d bytes of content", len(fields.hashes), len(content))
+		}
+		if withMeta && len(meta) > maxHashMetaSize {
+			t.Fatalf("accepted %d bytes of metadata", len(meta))
+		}
+	})
+}
+
+func TestFindHashEntryDuplicates(t *testing.T) {
+	tests := []struct {
+		name     string
+		copies   int // entries anchoring the hash signed by the owner
+		stranger int // signed by someone else
+		want     int
+	}{
+		{"anchored once", 1, 0, 0},
+		{"replayed by the owner", 3, 0, 2},
+		{"replayed by someone else", 1, 2, 0},
+		{"only anchored by someone else", 0, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vehicle, chain := testVehicle(t)
+			hash := sha256.Sum256([]byte(tt.name))
+			other := sha256.Sum256([]byte("other"))
+			anchorTestHash(t, vehicle, vehicle.owner, other[:])
+			for i := 0; i < tt.copies; i++ {
+				anchorTestHash(t, vehicle, vehicle.owner, hash[:])
+			}
+			stranger := testOwner(t)
+			for i := 0; i < tt.stranger; i++ {
+				anchorTestHash(t, vehicle, stranger, hash[:])
+			}
+
+			result, err := findHashEntry(chain, vehicle, hash[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Verified != (tt.copies > 0) {
+				t.Fatalf("verified %v with %d copies signed by the owner", result.Verified, tt.copies)
+			}
+			if result.Duplicates != tt.want {
+				t.Errorf("%d duplicates, want %d", result.Duplicates, tt.want)
+			}
+			// the registration and the other hash come first
+			if tt.copies > 0 && result.EntrySequence != 2 {
+				t.Errorf("found in entry block %d, want the earliest copy's, 2", result.EntrySequence)
+			}
+		})
+	}
+}
+
+func TestFindHashEntryMalformed(t *testing.T) {
+	vehicle, chain := testVehicle(t)
+	hash := sha256.Sum256([]byte("segment"))
+	entry, err := vehicle.hashEntry(hash[:], &HashMeta{Stream: "obd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.ExtIDs[2] = []byte(`{"stream":"obd","bogus":1}`)
+	if _, err := commitRevealEntry(chain, defaultRetry, entry, vehicle.owner.ecAddress); err != nil {
+		t.Fatal(err)
+	}
+	result, err := findHashEntry(chain, vehicle, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Verified || len(result.Malformed) != 1 {
+		t.Errorf("verified %v with %d malformed entries, want an unverified hash and 1", result.Verified, len(result.Malformed))
+	}
+}
+
+func TestFindHashEntryLoops(t *testing.T) {
+	for _, loop := range chainLoops {
+		t.Run(loop.name, func(t *testing.T) {
+			vehicle, chain := testVehicle(t)
+			hash := sha256.Sum256([]byte("segment"))
+			anchorTestHash(t, vehicle, vehicle.owner, hash[:])
+			other := sha256.Sum256([]byte("other"))
+			anchorTestHash(t, vehicle, vehicle.owner, other[:])
+			loopChain(chain, vehicle.chainID, loop.link)
+
+			missing := sha256.Sum256([]byte("missing"))
+			if _, err := findHashEntry(chain, vehicle, missing[:]); err == nil {
+				t.Fatal("walked a looping chain without an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// autoVIN in the config's vin field detects the connected vehicle over OBD
+const autoVIN = "auto"
+
+// vehiclesDir holds one data directory per VIN when the device moves between vehicles
+const vehiclesDir = "vehicles"
+
+// vinQueryTimeout bounds how long the adapter may take to answer a VIN query
+const vinQueryTimeout = 10 * time.Second
+
+// detectVIN asks the ELM327 adapter at serialPath for the vehicle's VIN
+// (service 09, PID 02). It must run before the OBD recorder opens the port.
+func detectVIN(serialPath string) (string, error) {
+	// raw mode so the tty does not buffer until a newline the adapter never sends
+	if out, err := exec.Command("stty", "-F", serialPath, "38400", "raw", "-echo").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("configuring %s: %v %s", serialPath, err, out)
+	}
+	port, err := os.OpenFile(serialPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer port.Close()
+
+	response := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		chunk := make([]byte, 64)
+		for _, command := range []string{"ATZ", "ATE0", "ATH0", "0902"} {
+			buf.Reset()
+			if _, err := port.Write([]byte(command + "\r")); err != nil {
+				break
+			}
+			// the adapter prints '>' when it is ready for the next command
+			for !bytes.Contains(buf.Bytes(), []byte(">")) {
+				n, err := port.Read(chunk)
+				if err != nil {
+					response <- nil
+					return
+				}
+				buf.Write(chunk[:n])
+			}
+		}
+		response <- buf.Bytes()
+	}()
+	select {
+	case data := <-response:
+		if data == nil {
+			return "", errors.New("no response from OBD adapter")
+		}
+		return parseVINResponse(string(data))
+	case <-time.After(vinQueryTimeout):
+		return "", errors.New("timed out waiting for OBD adapter")
+	}
+}
+
+// parseVINResponse extracts the VIN from an ELM327 response to 0902. Both CAN
+// multi-frame responses ("0: 49 02 01 31 ...") and the line per frame format of
+// older protocols ("49 02 01 00 00 00 31") are handled.
+func parseVINResponse(response string) (string, error) {
+	var data []byte
+	for _, line := range strings.FieldsFunc(response, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, ":"); i >= 0 {
+			line = line[i+1:] // CAN frame index
+		}
+		b, err := hex.DecodeString(strings.Replace(line, " ", "", -1))
+		if err != nil || len(b) < 3 {
+			continue // byte count line, prompt, or "SEARCHING..."
+		}
+		if b[0] == 0x49 && b[1] == 0x02 {
+			b = b[3:] // service, PID, and message count or frame number
+		}
+		data = append(data, b...)
+	}
+	var vin []byte
+	for _, c := range data {
+		if c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' {
+			vin = append(vin, c)
+		}
+	}
+	if len(vin) < 17 {
+		return "", fmt.Errorf("no VIN in OBD response %q", response)
+	}
+	return string(vin[len(vin)-17:]), nil
+}
+
+// vinWeights weigh each position of a VIN in its check digit, the 9th
+var vinWeights = [17]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinLetters are the values letters A to Z stand for in the check digit, '-'
+// for I, O and Q which VINs never use as they read like 1 and 0
+const vinLetters = "12345678-12345-7-923456789"
+
+// ValidateVIN returns why vin isn't a valid VIN: it must be 17 digits and
+// capital letters other than I, O and Q, and North American VINs, those
+// starting 1 to 5, must have the right check digit at position 9
+func ValidateVIN(vin string) error {
+	if len(vin) != 17 {
+		return fmt.Errorf("VIN %q has %d characters, not 17", vin, len(vin))
+	}
+	sum := 0
+	for i := 0; i < len(vin); i++ {
+		value := -1
+		switch c := vin[i]; {
+		case c >= '0' && c <= '9':
+			value = int(c - '0')
+		case c >= 'A' && c <= 'Z' && vinLetters[c-'A'] != '-':
+			value = int(vinLetters[c-'A'] - '0')
+		}
+		if value < 0 {
+			return fmt.Errorf("VIN %q has %q at position %d, VINs are digits and capital letters other than I, O and Q", vin, vin[i], i+1)
+		}
+		sum += value * vinWeights[i]
+	}
+	if vin[0] < '1' || vin[0] > '5' {
+		return nil // the check digit is only mandatory in North America
+	}
+	check := byte('0' + sum%11)
+	if sum%11 == 10 {
+		check = 'X'
+	}
+	if vin[8] != check {
+		return fmt.Errorf("VIN %q fails its check digit, position 9 is %c but should be %c", vin, vin[8], check)
+	}
+	return nil
+}
+
+// usePartition switches to the data directory of vin, creating it if needed,
+// so every local file and the database of one vehicle is kept apart from the
+// others recorded by this device
+func usePartition(vin string) error {
+	dir := filepath.Join(vehiclesDir, vin)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chdir(dir)
+}
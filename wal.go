@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// walSyncInterval bounds how much buffered data a power cut can lose
+const walSyncInterval = time.Second
+
+// writeAheadLog is an append-only file of JSON entries that are replayed at
+// startup. Appends are synced at most once per walSyncInterval, or at once
+// with appendSync, to spare the SD card.
+type writeAheadLog struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	dirty bool
+	done  chan struct{}
+}
+
+// openWAL opens the log at path and returns the raw entries already in it
+func openWAL(path string) (*writeAheadLog, []json.RawMessage, error) {
+	var entries []json.RawMessage
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if !json.Valid(scanner.Bytes()) {
+				continue // torn by the power cut that made the replay necessary
+			}
+			entries = append(entries, append(json.RawMessage(nil), scanner.Bytes()...))
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &writeAheadLog{path: path, file: file, done: make(chan struct{})}
+	go w.syncLoop()
+	return w, entries, nil
+}
+
+// append adds an entry, it is durable within walSyncInterval
+func (w *writeAheadLog) append(entry interface{}) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.dirty = true
+	return nil
+}
+
+// appendLine adds an encoded entry ending in a newline, like append
+func (w *writeAheadLog) appendLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Write(line); err != nil {
+		return err
+	}
+	w.dirty = true
+	return nil
+}
+
+// appendSync adds an entry and returns once it is on disk
+func (w *writeAheadLog) appendSync(entry interface{}) error {
+	if err := w.append(entry); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+func (w *writeAheadLog) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+func (w *writeAheadLog) syncLoop() {
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.sync()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// reset replaces the log's contents with entries, e.g. those still pending
+// once the rest have been applied
+func (w *writeAheadLog) reset(entries []interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := writeAtomic(w.path, data); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.dirty = false
+	return nil
+}
+
+// Close syncs and closes the log
+func (w *writeAheadLog) Close() error {
+	close(w.done)
+	w.sync()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// warrantyStream marks the anchored hashes of warranty bundles in hash entry
+// metadata
+const warrantyStream = "warranty"
+
+// warrantyMaxGap is the longest gap between two samples of a running engine
+// counted into its hours
+const warrantyMaxGap = time.Minute
+
+// warrantyNote is written next to the evidence export's VERIFY.txt
+const warrantyNote = `WARRANTY EVIDENCE
+=================
+
+warranty.json names the component and its lifetime, from installation to
+failure. dtc_history.json holds every change of the stored trouble codes and
+every freeze frame in that lifetime, each with the signed event exactly as it
+was logged, the chain entry that anchored it and, where available, the
+entry's receipt. The entry's time on the Factom blockchain shows the code was
+on record then, not written after the failure.
+
+conditions.csv summarizes the operating conditions of each day from the OBD
+readings: samples, engine hours and the minimum, mean and maximum of every
+reading. The readings themselves are in files/ with their proofs.
+`
+
+// WarrantyRecord is a trouble code change or freeze frame with its proof
+type WarrantyRecord struct {
+	Type      string          `json:"type"` // "trouble-codes" or "freeze-frame"
+	Time      time.Time       `json:"time"`
+	Data      interface{}     `json:"data"`  // TroubleCodes or FreezeFrame
+	Event     *SignedEvent    `json:"event"` // as signed and anchored
+	EntryHash string          `json:"entryHash"`
+	Receipt   json.RawMessage `json:"receipt,omitempty"`
+}
+
+// WarrantyDay is one day of operating conditions in a component's lifetime
+type WarrantyDay struct {
+	Date        string
+	Samples     int
+	EngineHours float64
+	Min         []float64 // per obdReadings, NaN without a numeric reading
+	Mean        []float64
+	Max         []float64
+}
+
+// WarrantyManifest describes a warranty bundle, written as warranty.json
+type WarrantyManifest struct {
+	VIN          string               `json:"vin"`
+	ChainID      string               `json:"chainID"`
+	Component    string               `json:"component"`
+	Installed    time.Time            `json:"installed"`
+	Failed       time.Time            `json:"failed"`
+	Created      time.Time            `json:"created"`
+	Files        int                  `json:"files"`        // OBD segments, with proofs
+	CodeChanges  int                  `json:"codeChanges"`  // trouble-codes records of dtc_history.json
+	FreezeFrames int                  `json:"freezeFrames"` // freeze-frame records of dtc_history.json
+	FirstSeen    map[string]time.Time `json:"firstSeen"`    // when each code was first on record
+	Days         int                  `json:"days"`         // days of conditions.csv with readings
+	EngineHours  float64              `json:"engineHours"`
+	Events       int                  `json:"events"`
+}
+
+// WarrantyBundle is a built warranty bundle and the anchor of its hash
+type WarrantyBundle struct {
+	Path     string            `json:"path"` // the .tar.gz
+	Hash     string            `json:"hash"` // hex SHA-256 of the .tar.gz
+	TxID     string            `json:"txID"`
+	Manifest *WarrantyManifest `json:"manifest"`
+}
+
+// warrantyRecords returns the trouble code changes and freeze frames logged
+// between from and to, oldest first, with their entries' receipts
+func (vehicle *Vehicle) warrantyRecords(from, to time.Time) ([]WarrantyRecord, error) {
+	var records []WarrantyRecord
+	collect := func(eventType string, at func(data interface{}) time.Time) func(data interface{}, signed *SignedEvent) {
+		return func(data interface{}, signed *SignedEvent) {
+			if t := at(data); !t.Before(from) && !t.After(to) {
+				records = append(records, WarrantyRecord{
+					Type:      eventType,
+					Time:      t,
+					Data:      data,
+					Event:     signed,
+					EntryHash: eventEntryHash(vehicle.chainID, eventType, signed),
+				})
+			}
+		}
+	}
+	err := readEvents("trouble-codes", func() interface{} { return new(TroubleCodes) },
+		collect("trouble-codes", func(data interface{}) time.Time { return data.(*TroubleCodes).Time }))
+	if err != nil {
+		return nil, err
+	}
+	err = readEvents("freeze-frame", func() interface{} { return new(FreezeFrame) },
+		collect("freeze-frame", func(data interface{}) time.Time { return data.(*FreezeFrame).Time }))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	for i := range records {
+		if receipt, err := vehicle.chain.receipt(records[i].EntryHash); err == nil {
+			records[i].Receipt, _ = json.Marshal(receipt)
+		}
+	}
+	return records, nil
+}
+
+// warrantyDay summarizes the OBD records of one day
+func warrantyDay(date string, records []*OBDRecord) *WarrantyDay {
+	day := &WarrantyDay{Date: date, Samples: len(records)}
+	n := len(obdReadings)
+	day.Min, day.Mean, day.Max = make([]float64, n), make([]float64, n), make([]float64, n)
+	counts := make([]int, n)
+	for i := range obdReadings {
+		day.Min[i], day.Max[i] = math.Inf(1), math.Inf(-1)
+	}
+	var last *OBDRecord
+	for _, record := range records {
+		running := false
+		for _, reading := range record.Readings {
+			i := readingIndex(reading.Name)
+			value, err := strconv.ParseFloat(reading.Value, 64)
+			if i < 0 || err != nil {
+				continue
+			}
+			if i == obdRPM && value > 0 {
+				running = true
+			}
+			day.Min[i], day.Max[i] = math.Min(day.Min[i], value), math.Max(day.Max[i], value)
+			day.Mean[i] += value
+			counts[i]++
+		}
+		if running && last != nil && record.Time.Sub(last.Time) <= warrantyMaxGap {
+			day.EngineHours += record.Time.Sub(last.Time).Hours()
+		}
+		if running {
+			last = record
+		} else {
+			last = nil
+		}
+	}
+	for i := range obdReadings {
+		if counts[i] == 0 {
+			day.Min[i], day.Mean[i], day.Max[i] = math.NaN(), math.NaN(), math.NaN()
+			continue
+		}
+		day.Mean[i] /= float64(counts[i])
+	}
+	return day
+}
+
+// readingIndex returns the index in obdReadings of the reading called name, or -1
+func readingIndex(name string) int {
+	for i, reading := range obdReadings {
+		if reading.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeConditions writes the daily operating conditions as CSV
+func writeConditions(w io.Writer, days []*WarrantyDay) error {
+	out := csv.NewWriter(w)
+	header := []string{"date", "samples", "engineHours"}
+	for _, reading := range obdReadings {
+		name := reading.name
+		if reading.units != "" {
+			name += " (" + reading.units + ")"
+		}
+		header = append(header, name+" min", name+" mean", name+" max")
+	}
+	out.Write(header)
+	format := func(v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	for _, day := range days {
+		line := []string{day.Date, strconv.Itoa(day.Samples), strconv.FormatFloat(day.EngineHours, 'f', 2, 64)}
+		for i := range obdReadings {
+			line = append(line, format(day.Min[i]), format(day.Mean[i]), format(day.Max[i]))
+		}
+		out.Write(line)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// BuildWarranty gathers the evidence of a failed component's lifetime, from
+// installed to failed, into a tar.gz under dir: the OBD segments with their
+// proofs and the signed events (an evidence export of the telemetry stream),
+// the history of trouble codes and freeze frames with the entries anchoring
+// them, and the daily operating conditions. The bundle's hash is anchored so
+// the manufacturer can check nothing was added or removed after it was built.
+func (vehicle *Vehicle) BuildWarranty(dir, component string, installed, failed time.Time) (*WarrantyBundle, error) {
+	if !installed.Before(failed) {
+		return nil, fmt.Errorf("the component must be installed before it failed")
+	}
+	root, evidence, err := vehicle.exportStreams(dir, installed, failed, []string{telemetryStream}, nil)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &WarrantyManifest{
+		VIN:       vehicle.vin,
+		ChainID:   vehicle.chainID,
+		Component: component,
+		Installed: installed.UTC(),
+		Failed:    failed.UTC(),
+		Created:   time.Now().UTC(),
+		Files:     len(evidence.Proofs),
+		FirstSeen: make(map[string]time.Time),
+		Events:    evidence.Events,
+	}
+
+	records, err := vehicle.warrantyRecords(installed, failed)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		switch data := record.Data.(type) {
+		case *TroubleCodes:
+			manifest.CodeChanges++
+			for _, code := range data.Codes {
+				if _, ok := manifest.FirstSeen[code]; !ok {
+					manifest.FirstSeen[code] = data.Time
+				}
+			}
+		case *FreezeFrame:
+			manifest.FreezeFrames++
+		}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(filepath.Join(root, "dtc_history.json"), data); err != nil {
+		return nil, err
+	}
+
+	var days []*WarrantyDay
+	for start := dayStart(installed); start.Before(failed); start = start.AddDate(0, 0, 1) {
+		records, err := vehicle.store.Records(vehicle.vin, start, start.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		day := warrantyDay(start.Format("2006-01-02"), records)
+		manifest.EngineHours += day.EngineHours
+		days = append(days, day)
+	}
+	manifest.Days = len(days)
+	if err := writeFileWith(filepath.Join(root, "conditions.csv"), func(w io.Writer) error {
+		return writeConditions(w, days)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writeAtomic(filepath.Join(root, "WARRANTY.txt"), []byte(warrantyNote)); err != nil {
+		return nil, err
+	}
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(filepath.Join(root, "warranty.json"), data); err != nil {
+		return nil, err
+	}
+
+	bundle := &WarrantyBundle{Path: root + ".tar.gz", Manifest: manifest}
+	sha := sha256.New()
+	if err := writeFileWith(bundle.Path, func(w io.Writer) error {
+		return tarDir(io.MultiWriter(w, sha), root)
+	}); err != nil {
+		return nil, err
+	}
+	os.RemoveAll(root)
+	bundle.Hash = hex.EncodeToString(sha.Sum(nil))
+	if bundle.TxID, err = vehicle.secureHashWithMeta(sha.Sum(nil), &HashMeta{Stream: warrantyStream}); err != nil {
+		return nil, err
+	}
+	appendAudit("warranty-built", map[string]interface{}{
+		"component": component, "installed": manifest.Installed, "failed": manifest.Failed,
+		"path": bundle.Path, "hash": bundle.Hash, "txID": bundle.TxID,
+	})
+	return bundle, nil
+}
+
+// dayStart returns the first instant of t's day in local time
+func dayStart(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// parseWarrantyTime accepts RFC3339 or a date, YYYY-MM-DD, in local time
+func parseWarrantyTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// warrantyCommand builds the warranty bundle of a failed component
+func warrantyCommand(vehicle *Vehicle, config *Config, args []string) {
+	flags := flag.NewFlagSet("warranty", flag.ExitOnError)
+	component := flags.String("component", "", "Failed component, e.g. \"turbocharger\"")
+	installed := flags.String("installed", "", "When the component was installed, RFC3339 or YYYY-MM-DD")
+	failed := flags.String("failed", "", "When it failed, RFC3339 or YYYY-MM-DD (default: now)")
+	dir := flags.String("o", ".", "Directory to write the bundle to")
+	recipient := flags.String("recipient", "", "Who the bundle is for, refusing unless the consent policy shares its data with them")
+	flags.Parse(args)
+	if *component == "" || *installed == "" {
+		fmt.Fprintln(os.Stderr, "usage: blackbox warranty -component <name> -installed <time> [-failed <time>] [-o dir] [-recipient name]")
+		os.Exit(2)
+	}
+	checkConsent(*recipient, evidenceData...)
+	from, err := parseWarrantyTime(*installed)
+	if err != nil {
+		fmt.Println("Invalid -installed", err)
+		os.Exit(2)
+	}
+	to := time.Now()
+	if *failed != "" {
+		if to, err = parseWarrantyTime(*failed); err != nil {
+			fmt.Println("Invalid -failed", err)
+			os.Exit(2)
+		}
+	}
+
+	store, err := OpenStore(config.Database)
+	if err != nil {
+		fmt.Println("Failed to open database", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	vehicle.store = store
+	if config.Encryption != nil {
+		if vehicle.key, err = loadDeviceKey(config.Encryption); err != nil {
+			fmt.Println("Failed to load device key", err)
+			os.Exit(1)
+		}
+	}
+
+	bundle, err := vehicle.BuildWarranty(*dir, *component, from, to)
+	if err != nil {
+		fmt.Println("Failed to build warranty bundle", err)
+		os.Exit(1)
+	}
+	vehicle.logAccess("warranty-export", bundle.Path, evidenceData, cliWho(*recipient))
+	m := bundle.Manifest
+	codes := make([]string, 0, len(m.FirstSeen))
+	for code, at := range m.FirstSeen {
+		codes = append(codes, code+" since "+at.Local().Format("2006-01-02 15:04"))
+	}
+	sort.Strings(codes)
+	fmt.Printf("Warranty bundle %s: %d files, %d days, %.1f engine hours, %d code changes, %d freeze frames\n",
+		bundle.Path, m.Files, m.Days, m.EngineHours, m.CodeChanges, m.FreezeFrames)
+	if len(codes) > 0 {
+		fmt.Println("Trouble codes:", strings.Join(codes, ", "))
+	}
+	fmt.Printf("SHA-256 %s secured to factom. TxID: %s\n", bundle.Hash, bundle.TxID)
+}